@@ -0,0 +1,119 @@
+package alohartc
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// An audio format offered in an m-line.
+type audioFormat struct {
+	payloadType int
+
+	// Encoding as in rtpmap, e.g. "opus/48000/2".
+	encoding string
+
+	// Format parameters, as offered.
+	fmtp string
+}
+
+// Return the encoding name, e.g. "opus".
+func (f *audioFormat) codec() string {
+	if i := strings.IndexByte(f.encoding, '/'); i >= 0 {
+		return f.encoding[:i]
+	}
+	return f.encoding
+}
+
+// Audio payload types with a static encoding, which may be offered without an
+// rtpmap (see RFC 3551 Section 6).
+var staticAudioEncodings = map[int]string{
+	0: "PCMU/8000",
+	8: "PCMA/8000",
+}
+
+// Codecs we can send and receive, in order of preference for receiving.
+var audioCodecs = []string{"opus", "PCMU", "PCMA"}
+
+// Return the format in which to offer audio from a local encoder.
+func offerAudioFormat(codec string) (audioFormat, bool) {
+	switch strings.ToLower(codec) {
+	case "opus":
+		return audioFormat{payloadType: 111, encoding: "opus/48000/2", fmtp: "minptime=10;useinbandfec=1"}, true
+	case "pcmu":
+		return audioFormat{payloadType: 0, encoding: "PCMU/8000"}, true
+	case "pcma":
+		return audioFormat{payloadType: 8, encoding: "PCMA/8000"}, true
+	}
+	return audioFormat{}, false
+}
+
+// Return the audio formats offered in m, in order of preference.
+func parseAudioFormats(m *sdp.Media) []audioFormat {
+	encodings := make(map[int]string)
+	fmtps := make(map[int]string)
+	for _, attr := range m.Attributes {
+		if attr.Key != "rtpmap" && attr.Key != "fmtp" {
+			continue
+		}
+		i := strings.IndexByte(attr.Value, ' ')
+		if i < 0 {
+			log.Warn("malformed %s: %s", attr.Key, attr.Value)
+			continue
+		}
+		pt, err := strconv.Atoi(attr.Value[:i])
+		if err != nil {
+			log.Warn("malformed %s: %s", attr.Key, attr.Value)
+			continue
+		}
+		text := strings.TrimSpace(attr.Value[i+1:])
+		if attr.Key == "rtpmap" {
+			encodings[pt] = text
+		} else {
+			fmtps[pt] = text
+		}
+	}
+
+	var formats []audioFormat
+	for _, f := range m.Format {
+		pt, err := strconv.Atoi(f)
+		if err != nil {
+			continue
+		}
+		encoding, ok := encodings[pt]
+		if !ok {
+			if encoding, ok = staticAudioEncodings[pt]; !ok {
+				continue
+			}
+		}
+		formats = append(formats, audioFormat{
+			payloadType: pt,
+			encoding:    encoding,
+			fmtp:        fmtps[pt],
+		})
+	}
+	return formats
+}
+
+// Pick the offered format of the local audio codec. With no local codec, i.e.
+// when only receiving, pick the first offered format we can depacketize.
+func selectAudioFormat(m *sdp.Media, codec string) (audioFormat, bool) {
+	formats := parseAudioFormats(m)
+	if codec != "" {
+		for _, f := range formats {
+			if strings.EqualFold(f.codec(), codec) {
+				return f, true
+			}
+		}
+		return audioFormat{}, false
+	}
+	for _, f := range formats {
+		for _, c := range audioCodecs {
+			if strings.EqualFold(f.codec(), c) {
+				return f, true
+			}
+		}
+	}
+	return audioFormat{}, false
+}
@@ -0,0 +1,70 @@
+package alohartc
+
+import (
+	"testing"
+
+	"github.com/lanikai/alohartc/internal/media/alsa"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+func TestSelectAudioFormat(t *testing.T) {
+	m := &sdp.Media{
+		Type:   "audio",
+		Format: []string{"111", "9", "0", "8"},
+		Attributes: []sdp.Attribute{
+			{Key: "rtpmap", Value: "111 opus/48000/2"},
+			{Key: "fmtp", Value: "111 minptime=10;useinbandfec=1"},
+			{Key: "rtpmap", Value: "9 G722/8000"},
+			{Key: "rtpmap", Value: "0 PCMU/8000"},
+		},
+	}
+
+	for _, tt := range []struct {
+		codec string
+		pt    int
+		ok    bool
+	}{
+		{"opus", 111, true},
+		{"PCMU", 0, true},
+		{"pcma", 8, true}, // static payload type, without rtpmap
+		{"G729", 0, false},
+		{"", 111, true}, // receive only: first supported codec
+	} {
+		f, ok := selectAudioFormat(m, tt.codec)
+		if ok != tt.ok || ok && f.payloadType != tt.pt {
+			t.Errorf("codec %q: got %d, %v; want %d, %v", tt.codec, f.payloadType, ok, tt.pt, tt.ok)
+		}
+	}
+
+	f, _ := selectAudioFormat(m, "opus")
+	if f.codec() != "opus" || f.encoding != "opus/48000/2" || f.fmtp != "minptime=10;useinbandfec=1" {
+		t.Errorf("unexpected opus format: %+v", f)
+	}
+}
+
+// ALSA capture with the default configuration must be something a browser
+// accepts, whether we offer or answer.
+func TestALSADefaultCodecNegotiates(t *testing.T) {
+	// As offered by Chrome.
+	m := &sdp.Media{
+		Type:   "audio",
+		Format: []string{"111", "63", "9", "0", "8", "13", "110", "126"},
+		Attributes: []sdp.Attribute{
+			{Key: "rtpmap", Value: "111 opus/48000/2"},
+			{Key: "fmtp", Value: "111 minptime=10;useinbandfec=1"},
+			{Key: "rtpmap", Value: "63 red/48000/2"},
+			{Key: "rtpmap", Value: "9 G722/8000"},
+			{Key: "rtpmap", Value: "0 PCMU/8000"},
+			{Key: "rtpmap", Value: "8 PCMA/8000"},
+			{Key: "rtpmap", Value: "13 CN/8000"},
+			{Key: "rtpmap", Value: "110 telephone-event/48000"},
+			{Key: "rtpmap", Value: "126 telephone-event/8000"},
+		},
+	}
+	if f, ok := selectAudioFormat(m, alsa.DefaultCodec); !ok || f.payloadType != 0 {
+		t.Errorf("default ALSA codec %s not answered: got %+v, %v", alsa.DefaultCodec, f, ok)
+	}
+	if _, ok := offerAudioFormat(alsa.DefaultCodec); !ok {
+		t.Errorf("default ALSA codec %s can't be offered", alsa.DefaultCodec)
+	}
+}
@@ -0,0 +1,226 @@
+package alohartc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/v4l2"
+)
+
+// Defaults for Camera.
+const (
+	defaultCameraSource  = "/dev/video0"
+	defaultCameraWidth   = 1280
+	defaultCameraHeight  = 720
+	defaultCameraBitrate = 1000000
+)
+
+var errNoSignaler = errors.New("camera has no signaler")
+
+// An ICECandidate is a local or remote ICE candidate, as exchanged over a
+// signaling transport.
+type ICECandidate = ice.Candidate
+
+// A Call is one remote viewer's attempt to connect, as delivered by a
+// Signaler. The viewer sends an SDP offer and trickles its ICE candidates; the
+// answer and local candidates are sent back through the Send functions.
+type Call struct {
+	// Context used to indicate the end of the call.
+	context.Context
+
+	// Channel for receiving the SDP offer from the viewer.
+	Offer <-chan string
+
+	// Channel for receiving the viewer's ICE candidates. Closed at the end of
+	// trickling.
+	RemoteCandidates <-chan ICECandidate
+
+	// Transport-specific function for sending the SDP answer to the viewer.
+	SendAnswer func(sdpAnswer string) error
+
+	// Transport-specific function for sending a local ICE candidate to the
+	// viewer. Called with nil at the end of trickling.
+	SendLocalCandidate func(c *ICECandidate) error
+}
+
+// A Signaler connects to a signaling transport, e.g. a WebSocket server or an
+// MQTT broker, and delivers incoming calls.
+type Signaler interface {
+	// Listen calls handle for each incoming call, until ctx is done or the
+	// transport fails. handle returns promptly.
+	Listen(ctx context.Context, handle func(*Call)) error
+}
+
+// SignalerFunc adapts an ordinary function to the Signaler interface.
+type SignalerFunc func(ctx context.Context, handle func(*Call)) error
+
+func (f SignalerFunc) Listen(ctx context.Context, handle func(*Call)) error {
+	return f(ctx, handle)
+}
+
+// A Camera streams live video to every viewer that calls in through its
+// Signaler, one PeerConnection per call. It covers the common case of a
+// device serving a single video source; use PeerConnection directly for
+// anything else.
+//
+// The zero value streams /dev/video0 at 1280x720 and 1 Mbps, once Signaler
+// is set.
+type Camera struct {
+	// Source of the video: the path of a V4L2 device, an MP4 file, or a URI
+	// with a registered scheme such as rtsp://. Defaults to /dev/video0.
+	// Ignored if Config.LocalVideo is set.
+	Source string
+
+	// Capture size and encoder bitrate, in bits per second, for V4L2
+	// devices. Defaults to 1280x720 at 1 Mbps.
+	Width   int
+	Height  int
+	Bitrate int
+
+	// Encoder is the path of a V4L2 memory-to-memory encoder, e.g.
+	// /dev/video11 on the Raspberry Pi 4, for cameras that only capture raw
+	// frames.
+	Encoder string
+
+	// Signaler delivers incoming calls. Required.
+	Signaler Signaler
+
+	// Config for each call's PeerConnection, e.g. to set an Authorizer or
+	// TURN servers. LocalVideo is filled in from Source if unset.
+	Config Config
+
+	// OnError, if non-nil, is called when a call fails. A failed call does
+	// not stop the camera.
+	OnError func(error)
+}
+
+// Run opens the video source and serves calls until ctx is done or the
+// Signaler fails. On return, all calls have ended and the source is closed.
+func (c *Camera) Run(ctx context.Context) error {
+	if c.Signaler == nil {
+		return errNoSignaler
+	}
+
+	config := c.Config
+	if config.LocalVideo == nil {
+		src, err := c.openSource()
+		if err != nil {
+			return err
+		}
+		if closer, ok := src.(io.Closer); ok {
+			defer closer.Close()
+		}
+		config.LocalVideo = src
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	err := c.Signaler.Listen(ctx, func(call *Call) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := serveCall(ctx, call, config); err != nil && c.OnError != nil {
+				c.OnError(err)
+			}
+		}()
+	})
+
+	// Hang up on any remaining calls.
+	cancel()
+	wg.Wait()
+	return err
+}
+
+func (c *Camera) openSource() (media.VideoSource, error) {
+	source := c.Source
+	if source == "" {
+		source = defaultCameraSource
+	}
+
+	if media.CanOpen(source) {
+		return media.Open(source)
+	}
+	if strings.HasSuffix(source, ".mp4") {
+		return media.OpenMP4(source)
+	}
+
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 {
+		return nil, fmt.Errorf("unsupported video source: %s", source)
+	}
+	cfg := v4l2.Config{
+		Width:                c.Width,
+		Height:               c.Height,
+		Bitrate:              c.Bitrate,
+		RepeatSequenceHeader: true,
+		Encoder:              c.Encoder,
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		cfg.Width, cfg.Height = defaultCameraWidth, defaultCameraHeight
+	}
+	if cfg.Bitrate == 0 {
+		cfg.Bitrate = defaultCameraBitrate
+	}
+	if c.Config.GameMode {
+		cfg.KeyframeInterval = GameModeKeyframeInterval
+		cfg.DisableBFrames = true
+	}
+	return v4l2.Open(source, cfg)
+}
+
+// Answer a call and stream to the viewer until either side hangs up.
+func serveCall(ctx context.Context, call *Call, config Config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-call.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	pc, err := NewPeerConnectionWithContext(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	pc.OnIceCandidate = func(c *ice.Candidate) {
+		if err := call.SendLocalCandidate(c); err != nil {
+			log.Warn("Failed to send local ICE candidate: %v", err)
+		}
+	}
+
+	select {
+	case offer := <-call.Offer:
+		answer, err := pc.SetRemoteDescription(offer)
+		if err != nil {
+			return err
+		}
+		if err := call.SendAnswer(answer); err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	go func() {
+		for c := range call.RemoteCandidates {
+			pc.AddIceCandidate(&c)
+		}
+		pc.AddIceCandidate(nil)
+	}()
+
+	return pc.Stream()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/ffmpeg"
+)
+
+const ffmpegPrefix = "ffmpeg:"
+
+var (
+	flagFFmpegArgs      string
+	flagFFmpegAudioArgs string
+)
+
+func init() {
+	flag.StringVarP(&flagFFmpegArgs, "ffmpeg-args", "", "", "Arguments of ffmpeg for an ffmpeg: video input, writing H.264 to stdout")
+	flag.StringVarP(&flagFFmpegAudioArgs, "ffmpeg-audio-args", "", "", "Arguments of ffmpeg for an ffmpeg: audio input, writing µ-law to stdout")
+}
+
+// Report whether an input is to be read through ffmpeg.
+func isFFmpegInput(input string) bool {
+	return strings.HasPrefix(input, ffmpegPrefix)
+}
+
+// Open an ffmpeg: video input, scaled and encoded as configured.
+func openFFmpeg(input string) (media.VideoSource, error) {
+	return ffmpeg.Open(ffmpeg.Config{
+		Input:   strings.TrimPrefix(input, ffmpegPrefix),
+		Args:    strings.Fields(flagFFmpegArgs),
+		Width:   flagWidth,
+		Height:  flagHeight,
+		Bitrate: 1000 * flagBitrate,
+	})
+}
+
+// Open an ffmpeg: audio input.
+func openFFmpegAudio(input string) (media.AudioSource, error) {
+	return ffmpeg.OpenAudio(ffmpeg.AudioConfig{
+		Input: strings.TrimPrefix(input, ffmpegPrefix),
+		Args:  strings.Fields(flagFFmpegAudioArgs),
+	})
+}
@@ -12,21 +12,68 @@ var (
 	flagSTUNAddress    string
 	flagBitrate        int
 	flagInput          string
+	flagEncoder        string
+	flagAudioInput     string
 	flagHeight         int
 	flagWidth          int
 	flagHorizontalFlip bool
 	flagVerticalFlip   bool
 	flagHelp           bool
 	flagVersion        bool
+	flagExcludeIfaces  []string
+	flagDSCP           int
+	flagSocketBuffer   int
+	flagPortRange      string
+	flagNATIPs         []string
+	flagLANOnly        bool
+	flagProxy          string
+	flagGameMode       bool
+	flagPreferQuality  bool
+	flagPlayback       bool
+	flagTURNAddress    string
+	flagTURNSecret     string
+	flagTURNUser       string
+	flagTURNCredsURL   string
+	flagTURNToken      string
+	flagLogLevel       string
+	flagLogFormat      string
+	flagSecureElement  string
+	flagSecureSlot     int
+	flagTrackResources bool
 )
 
 func init() {
 	flag.IntVarP(&flagBitrate, "bitrate", "b", 1000, "Video bitrate, in KiB")
-	flag.StringVarP(&flagInput, "input", "i", "/dev/video0", "Video source")
+	flag.StringVarP(&flagInput, "input", "i", "/dev/video0", "Video source, or empty for audio only")
+	flag.StringVarP(&flagEncoder, "encoder", "", "", "V4L2 encoder device for cameras without H.264, e.g. /dev/video11")
+	flag.StringVarP(&flagAudioInput, "audio-input", "", "", "ALSA capture device for audio, e.g. hw:1,0, or ffmpeg:INPUT")
 	flag.IntVarP(&flagHeight, "height", "y", 720, "Video width")
 	flag.IntVarP(&flagWidth, "width", "x", 1280, "Video height")
 	flag.BoolVarP(&flagHorizontalFlip, "hflip", "", false, "Flip horizontally")
 	flag.BoolVarP(&flagVerticalFlip, "vflip", "", false, "Flip vertically")
+	flag.BoolVarP(&flagGameMode, "game-mode", "", false, "Optimize for latency over quality")
+	flag.BoolVarP(&flagPreferQuality, "prefer-quality", "", false, "On slow links, queue more video before dropping any")
+	flag.BoolVarP(&flagPlayback, "playback", "", false, "Play a recording with pause/seek controls")
+
+	flag.StringSliceVarP(&flagExcludeIfaces, "exclude-interface", "e", nil, "Network interfaces to exclude from ICE")
+	flag.IntVarP(&flagDSCP, "dscp", "", 0, "DSCP to mark outgoing media with, e.g. 34 (AF41)")
+	flag.IntVarP(&flagSocketBuffer, "socket-buffer", "", 0, "Size of socket send and receive buffers, in KiB")
+	flag.StringSliceVarP(&flagNATIPs, "nat-1to1-ip", "", nil, "Public IP of a host behind 1:1 NAT, as PUBLIC or PUBLIC/LOCAL")
+	flag.BoolVarP(&flagLANOnly, "lan-only", "", false, "Use no STUN, TURN or cloud signaling, for networks without internet")
+	flag.StringVarP(&flagPortRange, "port-range", "", "", "Range of local UDP ports for media, e.g. 50000-50100")
+	flag.StringVarP(&flagTURNAddress, "turn-address", "", "", "TURN server address")
+	flag.StringVarP(&flagProxy, "proxy", "", "", "HTTP or SOCKS5 proxy for TURN over TCP/TLS, e.g. http://proxy:3128")
+	flag.StringVarP(&flagTURNSecret, "turn-secret", "", "", "TURN shared secret")
+	flag.StringVarP(&flagTURNUser, "turn-user", "", "", "TURN user name, for shared secret credentials")
+	flag.StringVarP(&flagTURNCredsURL, "turn-credentials-url", "", "", "URL from which to fetch TURN credentials")
+	flag.StringVarP(&flagTURNToken, "turn-token", "", "", "Bearer token for fetching TURN credentials")
+
+	flag.StringVarP(&flagSecureElement, "secure-element", "", "", "I2C bus of an ATECC608 holding the DTLS key, e.g. /dev/i2c-1")
+	flag.IntVarP(&flagSecureSlot, "secure-element-slot", "", 0, "ATECC608 key slot of the DTLS key")
+
+	flag.StringVarP(&flagLogLevel, "log-level", "", "", "Logging levels, e.g. 'warn,ice=debug'")
+	flag.StringVarP(&flagLogFormat, "log-format", "", "", "Log output format: text or json")
+	flag.BoolVarP(&flagTrackResources, "track-resources", "", false, "Log goroutines and sockets left behind by each connection")
 
 	flag.BoolVarP(&flagHelp, "help", "h", false, "Print usage information and exit")
 	flag.BoolVarP(&flagVersion, "version", "v", false, "Print version information and exit")
@@ -39,21 +86,127 @@ Usage: alohartcd [OPTION]...
 Authentication:
   -c, --certificate=FILE Client certificate (default: /etc/alohartcd/cert.pem)
   -k, --private-key=FILE Client private key (default: /etc/alohartcd/key.pem)
+      --secure-element=BUS
+                         Sign DTLS handshakes with the key in an ATECC608 on
+                         an I2C bus, e.g. /dev/i2c-1, instead of a fresh key
+                         for each viewer (requires the atecc608 build tag in
+                         production builds)
+      --secure-element-slot=NUM
+                         Key slot of the DTLS key (default: 0)
 
 Network:
   -6, --enable-ipv6      Permit use of IPv6 (default: disabled)
   -m, --mqtt-address=URI MQTT broker address (default: mqtt.alohartc.com:8883)
+      --mqtt-tls=false   Connect to the MQTT broker without TLS
+      --mqtt-ca=FILE     CA certificate for verifying the MQTT broker
+                         (default: don't verify)
+      --mqtt-client-id=ID
+                         MQTT client ID (default: the client certificate's
+                         common name)
+      --mqtt-topic-prefix=PREFIX
+                         Prefix of MQTT signaling topics, for a self-hosted
+                         broker (default: devices/CLIENT-ID)
   -s, --stun-address=URI STUN server address (default: turn.alohartc.com:3478)
+  -e, --exclude-interface=PATTERN
+                         Exclude matching network interfaces from ICE, e.g.
+                         'docker*' (may be repeated)
+      --dscp=NUM         Mark outgoing media with a DSCP for routers with QoS,
+                         e.g. 34 (AF41) for video or 46 (EF) for audio only
+                         (default: unmarked)
+      --socket-buffer=KIB
+                         Size of the send and receive buffers of media
+                         sockets, for bitrates the kernel default drops
+                         packets at, e.g. 1024 (default: system default)
+      --nat-1to1-ip=PUBLIC[/LOCAL]
+                         Advertise a public IP for a host behind 1:1 NAT,
+                         e.g. a cloud instance, without querying the STUN
+                         server; LOCAL picks the local address it maps (may
+                         be repeated)
+      --lan-only         For closed networks without internet: gather only
+                         host and mDNS candidates, contacting no STUN or TURN
+                         server, and skip the default MQTT broker; viewers
+                         use the local web page, or a broker on the LAN
+                         given by --mqtt-address
+      --port-range=MIN-MAX
+                         Bind media sockets only to UDP ports in this range,
+                         to match firewall rules (default: any port)
+      --turn-address=HOST:PORT
+                         TURN server for relayed connections, or a URI such
+                         as turns:HOST:443 for TLS through firewalls that
+                         allow only HTTPS (default: none)
+      --proxy=URL        HTTP(S) or SOCKS5 proxy for TURN over TCP or TLS and
+                         for fetching TURN credentials, e.g.
+                         http://proxy.example.com:3128 (default:
+                         $HTTPS_PROXY)
+      --turn-credentials-url=URL
+                         Fetch short-lived TURN credentials from URL, as JSON
+                         {"username", "password", "ttl"}
+      --turn-token=TOKEN Bearer token for --turn-credentials-url (default:
+                         $ALOHARTC_TURN_TOKEN)
+      --turn-secret=SECRET
+                         Derive TURN credentials from a secret shared with the
+                         TURN server, instead of fetching them
+      --turn-user=NAME   User name for --turn-secret (default: hostname)
+      --sip-listen=ADDR  Answer SIP calls on a local UDP address, e.g. :5060
+      --sip-registrar=HOST:PORT
+                         Register with a SIP registrar or PBX, and answer
+                         calls through it (listening on :5060 by default)
+      --sip-user=NAME    SIP user name (default: alohartc)
+      --sip-password=PASSWORD
+                         SIP password, for registering
+      --sip-domain=DOMAIN
+                         SIP domain (default: the registrar's host)
 
 Video source:
   -b, --bitrate=NUM      Set a fixed video bitrate, in KiB (default: 1000)
-  -i, --input=FILE       Video source (default: /dev/video0)
+  -i, --input=FILE       Video source (default: /dev/video0), or a URI, e.g.
+                         capture:DEVICE for a camera captured by ffmpeg on
+                         macOS or Windows, screen: for the Linux display
+                         (DRM/KMS, or e.g. screen:/dev/fb0), or bars: for a
+                         test pattern
   -x, --width=NUM        Set video width (default: 1280)
   -y, --height=NUM       Set video height (default: 720)
       --hflip            Flip video horizontally
       --vflip            Flip video vertically
+      --game-mode        Minimize latency (e.g. for teleoperation) at the
+                         expense of video quality
+      --prefer-quality   When the link can't keep up, queue more video before
+                         dropping any, at the expense of latency
+      --ffmpeg-args=ARGS Arguments of ffmpeg for an ffmpeg:INPUT video source,
+                         which must write H.264 (Annex B) to stdout, with
+                         {input}, {width}, {height} and {bitrate} replaced
+                         (default: encode with libx264 for low latency)
+      --playback         Play the input recording (MP4 or MKV) once, with
+                         pause, seek, and speed controls, instead of looping
+      --audio-input=DEVICE
+                         ALSA capture device for audio, e.g. hw:1,0,
+                         ffmpeg:INPUT to transcode INPUT with ffmpeg, or
+                         tone:HZ for a test tone, e.g. tone:440
+      --ffmpeg-audio-args=ARGS
+                         Arguments of ffmpeg for an ffmpeg:INPUT audio source,
+                         which must write 8 kHz mono µ-law to stdout
+      --max-viewers=NUM  Maximum number of concurrent viewers, all sharing the
+                         video source (default: 4)
+      --metrics-interval=DURATION
+                         Log viewer metrics at this interval, or 0 to disable
+                         (default: 1m)
+
+Restreaming:
+      --restream-rtsp=ADDR
+                         Serve H.264 video pushed by viewers to legacy clients,
+                         e.g. NVR software, at rtsp://ADDR/live, e.g. :8554
+      --restream-rtp=HOST:PORT
+                         Send H.264 video pushed by viewers as plain RTP to a
+                         host or multicast group, logging its SDP description
 
 Miscellaneous:
+      --log-level=DIRECTIVES
+                         Logging levels, as a default level and/or per
+                         subsystem (e.g. ice, dtls, rtp, media), e.g.
+                         'warn,ice=debug' (default: $LOGLEVEL, or info)
+      --log-format=FORMAT
+                         Write logs as text or json (default: $LOGFORMAT, or
+                         text)
   -h, --help             Prints this help message and exits
   -v, --version          Prints version information and exits
 
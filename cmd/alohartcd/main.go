@@ -4,26 +4,57 @@ package main
 
 import (
 	"context"
+	"crypto"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 
 	"github.com/lanikai/alohartc"
+	"github.com/lanikai/alohartc/internal/atecc608"
 	"github.com/lanikai/alohartc/internal/ice"
 	"github.com/lanikai/alohartc/internal/ice/mdns"
+	"github.com/lanikai/alohartc/internal/logging"
 	"github.com/lanikai/alohartc/internal/media"
-	"github.com/lanikai/alohartc/internal/media/rtsp"
+	"github.com/lanikai/alohartc/internal/media/alsa"
+	_ "github.com/lanikai/alohartc/internal/media/libcamera" // registers libcamera:
+	_ "github.com/lanikai/alohartc/internal/media/rtsp"      // registers rtsp://
+	_ "github.com/lanikai/alohartc/internal/media/screen"    // registers screen:
 	"github.com/lanikai/alohartc/internal/signaling"
 	"github.com/lanikai/alohartc/internal/v4l2"
 )
 
+// Return the video drop policy selected on the command line.
+func dropPolicy() alohartc.DropPolicy {
+	if flagPreferQuality {
+		return alohartc.DropForQuality
+	}
+	return alohartc.DropForLatency
+}
+
+// Parse the --port-range flag.
+func parsePortRange(s string) (alohartc.PortRange, error) {
+	if s == "" {
+		return alohartc.PortRange{}, nil
+	}
+	var r alohartc.PortRange
+	if _, err := fmt.Sscanf(s, "%d-%d", &r.Min, &r.Max); err != nil {
+		return r, fmt.Errorf("invalid port range %q: want MIN-MAX", s)
+	}
+	return r, r.Check()
+}
+
 var audioSource media.AudioSource
 var videoSource media.VideoSource
+var relayServers []alohartc.TURNServer
+var dtlsSigner crypto.Signer
+var portRange alohartc.PortRange
 
 func main() {
 	flag.Parse()
@@ -40,13 +71,52 @@ func main() {
 
 	// Configure logging
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Lmicroseconds)
+	if err := logging.Configure(flagLogLevel); err != nil {
+		log.Fatal(err)
+	}
+	if flagLogFormat != "" {
+		if err := logging.SetFormat(flagLogFormat); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// Open video source
-	{
+	var err error
+	if flagLANOnly {
+		// Nothing beyond the LAN is reachable.
+		if flagTURNAddress != "" {
+			log.Printf("Ignoring --turn-address in LAN-only mode")
+		}
+		signaling.SetLANOnly(true)
+	} else if relayServers, err = turnServers(); err != nil {
+		log.Fatal(err)
+	}
+	if portRange, err = parsePortRange(flagPortRange); err != nil {
+		log.Fatal(err)
+	}
+	if err := (alohartc.NAT1To1{IPs: flagNATIPs}).Check(); err != nil {
+		log.Fatal(err)
+	}
+
+	if flagSecureElement != "" {
+		dev, err := atecc608.Open(flagSecureElement, flagSecureSlot)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer dev.Close()
+		dtlsSigner = dev
+	}
+
+	// Open video source, unless audio only
+	if flagInput != "" {
 		err := fmt.Errorf("unsupported input: %s", flagInput)
 
-		if strings.HasPrefix(flagInput, "rtsp://") {
-			videoSource, err = rtsp.Open(flagInput)
+		if flagPlayback {
+			videoSource, err = media.OpenPlayback(flagInput)
+		} else if isFFmpegInput(flagInput) {
+			videoSource, err = openFFmpeg(flagInput)
+		} else if media.CanOpen(flagInput) {
+			// Sources registered by URI scheme, e.g. rtsp://
+			videoSource, err = media.Open(flagInput)
 		} else if strings.HasSuffix(flagInput, ".mp4") {
 			videoSource, err = media.OpenMP4(flagInput)
 		} else {
@@ -54,12 +124,20 @@ func main() {
 			if fi, err = os.Stat(flagInput); err == nil {
 				// Assume device type files are Video4Linux2 devices
 				if os.ModeDevice == fi.Mode()&os.ModeDevice {
-					videoSource, err = v4l2.Open(flagInput, v4l2.Config{
+					cfg := v4l2.Config{
 						Width:                flagWidth,
 						Height:               flagHeight,
 						Bitrate:              1000 * flagBitrate,
 						RepeatSequenceHeader: true,
-					})
+						Encoder:              flagEncoder,
+						HorizontalFlip:       flagHorizontalFlip,
+						VerticalFlip:         flagVerticalFlip,
+					}
+					if flagGameMode {
+						cfg.KeyframeInterval = alohartc.GameModeKeyframeInterval
+						cfg.DisableBFrames = true
+					}
+					videoSource, err = v4l2.Open(flagInput, cfg)
 				} else {
 					err = errors.New("Unrecognized device type")
 				}
@@ -81,46 +159,132 @@ func main() {
 		defer closer.Close()
 	}
 
+	// Open audio source, if requested
+	if flagAudioInput != "" {
+		var err error
+		if isFFmpegInput(flagAudioInput) {
+			audioSource, err = openFFmpegAudio(flagAudioInput)
+		} else if strings.HasPrefix(flagAudioInput, "tone:") {
+			var freq float64
+			if freq, err = strconv.ParseFloat(strings.TrimPrefix(flagAudioInput, "tone:"), 64); err == nil {
+				audioSource, err = media.NewToneAudioSource(freq)
+			}
+		} else {
+			audioSource, err = alsa.Open(alsa.Config{Device: flagAudioInput})
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		log.Printf("Local audio: %d Hz %s\n", audioSource.SampleRate(), audioSource.Codec())
+		if closer, ok := audioSource.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	if videoSource == nil && audioSource == nil && !restreaming() {
+		fmt.Fprintln(os.Stderr, "no video or audio input")
+		os.Exit(1)
+	}
+
+	if err := startRestreaming(); err != nil {
+		log.Fatal(err)
+	}
+
 	if err := mdns.Start(); err != nil {
 		log.Fatal(err)
 	}
 	defer mdns.Stop()
 
+	viewerSlots = make(chan struct{}, flagMaxViewers)
+	if flagMetricsInterval > 0 {
+		go logViewerMetrics(flagMetricsInterval)
+	}
+
 	signaling.Listen(doPeerSession)
 }
 
 func doPeerSession(ss *signaling.Session) {
+	logger, release, ok := acquireViewer()
+	if !ok {
+		return
+	}
+	defer release()
+
 	ctx, cancel := context.WithCancel(ss.Context)
 	defer cancel()
 
-	// Create peer connection with one video track
+	// Create peer connection with the local audio and video tracks
 	pc := alohartc.Must(alohartc.NewPeerConnectionWithContext(
 		ctx,
 		alohartc.Config{
-			LocalVideo: videoSource,
+			InterfaceFilter:   alohartc.ExcludeInterfaces(flagExcludeIfaces...),
+			GameMode:          flagGameMode,
+			DropPolicy:        dropPolicy(),
+			DSCP:              flagDSCP,
+			ReceiveBufferSize: flagSocketBuffer * 1024,
+			SendBufferSize:    flagSocketBuffer * 1024,
+			NAT1To1:           alohartc.NAT1To1{IPs: flagNATIPs},
+			LANOnly:           flagLANOnly,
+			PortRange:         portRange,
+			TURNServers:       relayServers,
+			Signer:            dtlsSigner,
+			TrackResources:    flagTrackResources,
 		}))
 	defer pc.Close()
+	if videoSource != nil {
+		if _, err := pc.AddTrack(videoSource); err != nil {
+			logger.Printf("Failed to add video track: %v", err)
+			return
+		}
+	}
+	if audioSource != nil {
+		if _, err := pc.AddTrack(audioSource); err != nil {
+			logger.Printf("Failed to add audio track: %v", err)
+			return
+		}
+	}
+
+	// Republish video pushed by the viewer, if enabled.
+	if restreaming() {
+		pc.OnTrack(func(track *alohartc.RemoteTrack) {
+			restreamTrack(logger, track)
+		})
+	}
+
+	// Let the viewer control playback of a recording.
+	if playback, ok := videoSource.(*media.Playback); ok && ss.Commands != nil {
+		go handlePlaybackCommands(ctx, playback, ss.Commands)
+	}
 
 	// Register callback for ICE candidates produced by the local ICE agent.
 	pc.OnIceCandidate = func(c *ice.Candidate) {
 		if err := ss.SendLocalCandidate(c); err != nil {
-			log.Fatal(err)
+			logger.Printf("Failed to send local candidate: %v", err)
 		}
 	}
 
+	// A certificate mismatch aborts the connection; make sure it's noticed.
+	pc.OnCertificateError = func(err error) {
+		logger.Printf("Possible man-in-the-middle, closing connection: %v", err)
+	}
+
 	// Wait for SDP offer from remote peer, then send our answer.
 	select {
 	case offer := <-ss.Offer:
 		answer, err := pc.SetRemoteDescription(offer)
 		if err != nil {
-			log.Fatal(err)
+			logger.Printf("Rejecting offer: %v", err)
+			return
 		}
 
 		if err := ss.SendAnswer(answer); err != nil {
-			log.Fatal(err)
+			logger.Printf("Failed to send answer: %v", err)
+			return
 		}
 	case <-ss.Done():
-		log.Fatal(ss.Err())
+		// The signaling session ended before the call started.
+		return
 	}
 
 	// Pass remote candidates from the signaling server to the local ICE agent.
@@ -131,7 +295,12 @@ func doPeerSession(ss *signaling.Session) {
 		pc.AddIceCandidate(nil)
 	}()
 
+	logger.Printf("Connecting to viewer")
 	if err := pc.Stream(); err != nil {
-		log.Println(err)
+		logger.Println(err)
+	}
+	if si := pc.SessionInfo(); !si.ConnectedAt.IsZero() {
+		logger.Printf("Viewer %s disconnected after %v, %d packets lost",
+			si.ViewerID, time.Since(si.ConnectedAt).Round(time.Second), si.PacketsLost)
 	}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/signaling"
+)
+
+// Apply playback commands from the viewer until ctx is done. Supported
+// commands, with their arguments:
+//
+//	pause
+//	play
+//	seek  SECONDS   jump to an absolute position
+//	skip  SECONDS   jump relative to the current position, e.g. "-10"
+//	speed FACTOR    e.g. "2" for double speed
+func handlePlaybackCommands(ctx context.Context, p *media.Playback, commands <-chan signaling.Command) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cmd := <-commands:
+			if err := applyPlaybackCommand(p, cmd); err != nil {
+				log.Printf("Playback command %q %q: %v", cmd.Name, cmd.Arg, err)
+			}
+		}
+	}
+}
+
+func applyPlaybackCommand(p *media.Playback, cmd signaling.Command) error {
+	switch cmd.Name {
+	case "pause":
+		p.Pause()
+	case "play":
+		p.Resume()
+	case "seek", "skip":
+		seconds, err := strconv.ParseFloat(cmd.Arg, 64)
+		if err != nil {
+			return err
+		}
+		t := time.Duration(seconds * float64(time.Second))
+		if cmd.Name == "skip" {
+			t += p.Position()
+		}
+		p.Seek(t)
+	case "speed":
+		speed, err := strconv.ParseFloat(cmd.Arg, 64)
+		if err != nil {
+			return err
+		}
+		return p.SetSpeed(speed)
+	default:
+		log.Printf("Ignoring unknown command %q", cmd.Name)
+	}
+	return nil
+}
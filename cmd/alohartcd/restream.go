@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/lanikai/alohartc"
+	"github.com/lanikai/alohartc/internal/media/rtsp"
+)
+
+var (
+	flagRestreamRTSP string
+	flagRestreamRTP  string
+)
+
+func init() {
+	flag.StringVarP(&flagRestreamRTSP, "restream-rtsp", "", "", "Serve video received from viewers over RTSP on this address, e.g. :8554")
+	flag.StringVarP(&flagRestreamRTP, "restream-rtp", "", "", "Send video received from viewers as RTP to this address, e.g. 239.0.0.1:5004")
+}
+
+// Path at which the RTSP server serves video received from viewers.
+const restreamPath = "/live"
+
+var rtspServer *rtsp.Server
+
+// Report whether video received from viewers is republished.
+func restreaming() bool {
+	return flagRestreamRTSP != "" || flagRestreamRTP != ""
+}
+
+// Start the RTSP server, if enabled.
+func startRestreaming() error {
+	if flagRestreamRTSP == "" {
+		return nil
+	}
+	rtspServer = rtsp.NewServer()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- rtspServer.ListenAndServe(flagRestreamRTSP)
+	}()
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+	log.Printf("Restreaming viewer video at rtsp://%s%s", flagRestreamRTSP, restreamPath)
+	return nil
+}
+
+// Republish a video track pushed by a viewer, until it ends. The most recent
+// viewer's video replaces any other.
+func restreamTrack(logger *log.Logger, track *alohartc.RemoteTrack) {
+	if track.Kind() != "video" {
+		go drainTrack(track)
+		return
+	}
+	src, err := alohartc.NewTrackSource(track)
+	if err != nil {
+		logger.Printf("Not restreaming %s track: %v", track.Codec(), err)
+		go drainTrack(track)
+		return
+	}
+
+	if rtspServer != nil {
+		rtspServer.Handle(restreamPath, src)
+	}
+	quit := make(chan struct{})
+	if flagRestreamRTP != "" {
+		go func() {
+			if err := rtsp.SendUDP(quit, flagRestreamRTP, src); err != nil {
+				logger.Printf("Restreaming to %s stopped: %v", flagRestreamRTP, err)
+			}
+		}()
+	}
+
+	// Watch the source until the track ends, which shuts down its receivers.
+	// RTP receivers need the parameter sets, so describe the stream once they
+	// arrive.
+	go func() {
+		described := flagRestreamRTP == ""
+		r := src.AddReceiver(16)
+		for buf := range r.Buffers() {
+			buf.Release()
+			if !described && src.ParameterSets() != nil {
+				described = true
+				if sdp, err := rtsp.DescribeUDP(flagRestreamRTP, src); err == nil {
+					logger.Printf("Restreaming viewer video as RTP to %s, described by:\n%s", flagRestreamRTP, sdp)
+				}
+			}
+		}
+		src.RemoveReceiver(r)
+		close(quit)
+		if rtspServer != nil {
+			rtspServer.Remove(restreamPath, src)
+		}
+	}()
+}
+
+func drainTrack(track *alohartc.RemoteTrack) {
+	for buf := range track.Buffers() {
+		buf.Release()
+	}
+}
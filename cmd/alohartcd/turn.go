@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/lanikai/alohartc"
+	"github.com/lanikai/alohartc/internal/proxy"
+)
+
+// Lifetime of credentials derived from --turn-secret.
+const turnCredentialTTL = 24 * time.Hour
+
+// Return the TURN servers configured on the command line, if any.
+func turnServers() ([]alohartc.TURNServer, error) {
+	if flagTURNAddress == "" {
+		return nil, nil
+	}
+
+	// Without --proxy, the credential request uses HTTPS_PROXY from the
+	// environment, as does a TURN server reached over TCP or TLS.
+	var proxyURL *url.URL
+	if flagProxy != "" {
+		var err error
+		if proxyURL, err = url.Parse(flagProxy); err != nil {
+			return nil, fmt.Errorf("invalid --proxy: %v", err)
+		}
+		if err := proxy.Check(proxyURL); err != nil {
+			return nil, fmt.Errorf("invalid --proxy: %v", err)
+		}
+	}
+
+	var creds alohartc.TURNCredentialProvider
+	switch {
+	case flagTURNCredsURL != "":
+		// Prefer the environment, since command lines are visible to other
+		// users.
+		token := flagTURNToken
+		if token == "" {
+			token = os.Getenv("ALOHARTC_TURN_TOKEN")
+		}
+		var client *http.Client
+		if proxyURL != nil {
+			client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		}
+		creds = alohartc.FetchTURNCredentials(flagTURNCredsURL, token, client)
+	case flagTURNSecret != "":
+		user := flagTURNUser
+		if user == "" {
+			user, _ = os.Hostname()
+		}
+		creds = alohartc.SharedSecretTURNCredentials(flagTURNSecret, user, turnCredentialTTL)
+	default:
+		return nil, errors.New("--turn-address requires --turn-credentials-url or --turn-secret")
+	}
+
+	server := alohartc.TURNServer{
+		Address:     flagTURNAddress,
+		Credentials: creds,
+		Proxy:       proxyURL,
+	}
+	return []alohartc.TURNServer{server}, nil
+}
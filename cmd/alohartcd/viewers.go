@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/lanikai/alohartc"
+)
+
+var (
+	flagMaxViewers      int
+	flagMetricsInterval time.Duration
+)
+
+func init() {
+	flag.IntVarP(&flagMaxViewers, "max-viewers", "", 4, "Maximum number of concurrent viewers")
+	flag.DurationVarP(&flagMetricsInterval, "metrics-interval", "", time.Minute, "Interval at which to log viewer metrics (0 to disable)")
+}
+
+// Slots for concurrent viewers, which all share the video source.
+var viewerSlots chan struct{}
+
+// Number of sessions started, and rejected for lack of a slot.
+var sessionCount, rejectedSessionCount uint64
+
+// Claim a viewer slot for a new session, returning a logger for the session
+// and a function to release the slot. ok is false if all slots are taken.
+func acquireViewer() (logger *log.Logger, release func(), ok bool) {
+	n := atomic.AddUint64(&sessionCount, 1)
+	select {
+	case viewerSlots <- struct{}{}:
+	default:
+		atomic.AddUint64(&rejectedSessionCount, 1)
+		log.Printf("Rejecting session %d: already serving %d viewers", n, flagMaxViewers)
+		return nil, nil, false
+	}
+
+	logger = log.New(os.Stderr, fmt.Sprintf("[session %d] ", n), log.Flags())
+	release = func() {
+		<-viewerSlots
+	}
+	return logger, release, true
+}
+
+// Log a summary of each viewer every interval.
+func logViewerMetrics(interval time.Duration) {
+	for range time.Tick(interval) {
+		viewers := alohartc.ActiveSessions()
+		log.Printf("%d viewers (%d sessions, %d rejected)", len(viewers),
+			atomic.LoadUint64(&sessionCount), atomic.LoadUint64(&rejectedSessionCount))
+		for _, v := range viewers {
+			log.Printf("Viewer %s: %d kbps, rtt %v, %.1f%% loss, relayed: %t, connected %v ago",
+				v.ViewerID, v.Bitrate/1000, v.RoundTripTime, 100*v.PacketLoss, v.Relayed(),
+				time.Since(v.ConnectedAt).Round(time.Second))
+			if d := v.Drops; d.Total() > 0 {
+				log.Printf("Viewer %s: dropped %d NALUs (%d at a full queue, %d dependent, %d disposable)",
+					v.ViewerID, d.Total(), d.QueueFull, d.Dependent, d.Disposable)
+			}
+			if l := v.Latency; l.Total() > 0 {
+				log.Printf("Viewer %s: latency %v (source %v, send %v, network %v)",
+					v.ViewerID, l.Total().Round(time.Millisecond), l.Source.Round(time.Millisecond),
+					l.Send.Round(time.Millisecond), l.Network.Round(time.Millisecond))
+			}
+		}
+	}
+}
@@ -9,10 +9,266 @@
 package alohartc
 
 import (
+	"crypto"
+	"crypto/x509"
+	"net"
+	"path"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/ice"
 	"github.com/lanikai/alohartc/internal/media"
 )
 
 type Config struct {
+	// Local media to send. Either may be nil, e.g. LocalVideo for an
+	// audio-only intercom; media without a local source is then only
+	// received (see OnTrack).
+	//
+	// Deprecated: Setting these is the same as calling AddTrack before
+	// negotiating, which also allows tracks to be added and removed later.
 	LocalAudio media.AudioSource
 	LocalVideo media.VideoSource
+
+	// InterfaceFilter, if non-nil, restricts the local network interfaces
+	// used for ICE candidate gathering. It is called with the interface name
+	// (e.g. "eth0") and one of its addresses, and returns false to exclude
+	// that address. See ExcludeInterfaces for a simple deny-list.
+	InterfaceFilter func(name string, ip net.IP) bool
+
+	// ICELoopback includes loopback interfaces in ICE candidate gathering,
+	// so that peers on the same host can connect without any network, e.g.
+	// in tests.
+	ICELoopback bool
+
+	// ICELite enables ICE-lite mode, for devices with a publicly routable IP
+	// address. The local agent gathers only host candidates and responds to
+	// the remote peer's connectivity checks without sending its own.
+	ICELite bool
+
+	// LANOnly is for closed networks with no internet access, e.g. on a
+	// factory floor or a boat. No STUN or TURN server is contacted; host
+	// candidates are gathered, each also advertised by an ephemeral mDNS
+	// hostname for browsers that expect one. The mDNS client (package
+	// internal/ice/mdns) must be started for the latter.
+	LANOnly bool
+
+	// TURNServers are used to gather relayed candidates, so that a connection
+	// can be established when no direct path exists. Ignored in ICE-lite and
+	// LAN-only modes.
+	TURNServers []TURNServer
+
+	// DSCP, if non-zero, marks every packet sent with a Differentiated
+	// Services code point, so that routers with QoS can prioritize the media
+	// [RFC8837]. Audio and video share one socket, so a single code point
+	// applies to both: DSCPAF41 suits video, with or without audio, and
+	// DSCPExpeditedForwarding audio alone. SocketPriority, if non-zero, sets
+	// the Linux SO_PRIORITY of the sockets, for local queueing disciplines.
+	DSCP           int
+	SocketPriority int
+
+	// ReceiveBufferSize and SendBufferSize, if non-zero, set the sizes in
+	// bytes of the sockets' receive and send buffers. The defaults of
+	// embedded kernels can drop packets at a few Mbps. On Linux the
+	// net.core.rmem_max and wmem_max limits apply unless the process has
+	// CAP_NET_ADMIN; SessionInfo reports the sizes actually allocated.
+	ReceiveBufferSize int
+	SendBufferSize    int
+
+	// NAT1To1, if set, gives the public addresses of a device behind 1:1
+	// NAT, such as a cloud instance, to advertise without a round trip to a
+	// STUN server.
+	NAT1To1 NAT1To1
+
+	// PortRange, if non-zero, restricts the local UDP ports used for media,
+	// including those of sockets to TURN servers, e.g. to match firewall
+	// rules. Each network interface needs a port per connection, and each
+	// TURN server another.
+	PortRange PortRange
+
+	// Authorize, if non-nil, is called with each remote SDP offer to decide
+	// whether to accept it, and which StreamPolicy applies.
+	Authorize Authorizer
+
+	// GameMode tunes the connection for minimum glass-to-glass latency, e.g.
+	// for teleoperation. Very little media is queued ahead of the network, so
+	// frames are dropped rather than delayed when the link can't keep up;
+	// retransmissions requested via NACK are sent ahead of new media;
+	// keyframes leave without waiting on the pacer; and the remote peer is
+	// asked to render video without a playout delay, if it supports the
+	// playout delay header extension. Pair with a short keyframe interval
+	// (GameModeKeyframeInterval) and no B-frames at the encoder; see the
+	// README for details.
+	GameMode bool
+
+	// H264Profile is the profile produced by LocalVideo's encoder. It decides
+	// which of the H.264 formats offered by the remote peer is accepted. The
+	// default, constrained baseline, suits nearly every hardware encoder.
+	H264Profile H264Profile
+
+	// MTU is the maximum transmission unit of the path to the remote peer,
+	// which limits the size of outgoing RTP and RTCP packets. By default it
+	// is taken from the local network interface the connection uses, but
+	// never more than 1280 bytes, since a tunnel or VPN elsewhere on the path
+	// may have a smaller MTU than the interface.
+	MTU int
+
+	// MaxReceiveBitrate caps the bitrate of video received from the remote
+	// peer (see OnTrack), in bits per second, e.g. to save a metered
+	// uplink's data allowance. It is advertised in the SDP answer (b=AS and
+	// b=TIAS), and enforced by REMB feedback if the remote peer supports it.
+	// Zero means no limit.
+	MaxReceiveBitrate int
+
+	// PacingBurst is how many bytes of video may be sent back-to-back before
+	// packets are spaced out according to the bandwidth estimate, so that a
+	// large keyframe doesn't overflow a router's queue. Defaults to 12000.
+	PacingBurst int
+
+	// ProbeBitrate is the highest bitrate, in bits per second, probed for
+	// with padding as soon as video starts, so that the remote peer's
+	// bandwidth estimate, and with it the video bitrate, ramps up within a
+	// second of connecting rather than over several. Defaults to 3 Mbps, or
+	// the stream policy's MaxBitrate if lower. Negative disables probing.
+	// Probing requires REMB feedback and the abs-send-time or transport-wide
+	// sequence number header extension.
+	ProbeBitrate int
+
+	// DropPolicy decides which video is dropped when the link can't keep up
+	// with LocalVideo. Game mode always drops for latency.
+	DropPolicy DropPolicy
+
+	// PayloadTypes overrides the RTP payload types that CreateOffer assigns
+	// to dynamic formats, keyed by encoding name: "H264" (102 by default) and
+	// "opus" (111), e.g. to interoperate with a gateway that expects a fixed
+	// mapping. Each must be distinct, in the dynamic range 96-127. Answers
+	// always use the payload types of the remote offer, whichever of its
+	// H.264 formats is chosen.
+	PayloadTypes map[string]int
+
+	// IgnoreSSRCCollisions keeps the SSRC of the local video even if the
+	// remote peer sends with the same one. By default, a new SSRC is chosen;
+	// see PeerConnection.OnSSRCCollision.
+	IgnoreSSRCCollisions bool
+
+	// Degradation, if non-nil, lowers the frame rate and resolution of
+	// LocalVideo when the bandwidth estimate stays low, and raises them on
+	// recovery.
+	Degradation *DegradationPolicy
+
+	// Signer, if non-nil, holds the private key that identifies this device
+	// in the DTLS handshake, instead of a fresh key for each connection. It
+	// must have an ECDSA public key (P-256 for browsers), and may be backed
+	// by a secure element, so that the key cannot be copied off the device.
+	// Certificate is its certificate, or nil to sign one on the fly. Remote
+	// peers check it against the fingerprint in the SDP answer, so it need
+	// not be issued by a certificate authority.
+	Signer      crypto.Signer
+	Certificate *x509.Certificate
+
+	// Polite decides which peer yields when both offer at once, in the
+	// perfect negotiation implemented by Connect. A polite peer rolls back
+	// its own offer to answer the other's; an impolite one ignores the other
+	// offer. Exactly one of the two peers must be polite.
+	Polite bool
+
+	// TrackResources accounts for the goroutines, sockets, and received
+	// buffers owned by the connection, for debugging leaks. Close reports
+	// any still outstanding a short while after the connection closes, and
+	// panics if PanicOnLeak is also set (intended for tests).
+	TrackResources bool
+	PanicOnLeak    bool
+
+	// Timeouts, for tuning to links with high or variable latency, e.g.
+	// cellular. Zero values take the defaults given.
+
+	// ConnectTimeout limits how long Stream waits for ICE to find a working
+	// path to the remote peer. Defaults to 10 seconds.
+	ConnectTimeout time.Duration
+
+	// EmbedCandidates makes SetRemoteDescription wait for ICE gathering to
+	// complete, or ICEGatheringTimeout to pass, and return an answer that
+	// carries the local candidates and a=end-of-candidates, as
+	// LocalDescription does, for peers that don't support trickle ICE, e.g.
+	// legacy SIP endpoints. OnIceCandidate is still called for each
+	// candidate. Offers from CreateOffer never carry candidates, since
+	// gathering begins only with the answer.
+	EmbedCandidates bool
+
+	// ICEGatheringTimeout limits how long ICE candidate gathering may take,
+	// so that a slow STUN or TURN server doesn't hold up the end of
+	// candidates, or LocalDescription for peers that don't trickle.
+	// Candidates not gathered in time are abandoned. Defaults to no limit,
+	// though each STUN query gives up after 5 seconds.
+	ICEGatheringTimeout time.Duration
+
+	// ICEKeepaliveInterval is how often a STUN binding request is sent on
+	// each working candidate pair, to keep NAT bindings open and measure the
+	// round-trip time (SessionInfo.ICERoundTripTime). Defaults to 30 seconds.
+	ICEKeepaliveInterval time.Duration
+
+	// DisconnectedTimeout is how long the remote peer may go without sending
+	// connectivity checks before the connection is reported disconnected
+	// (ice.EventConsentLost, via OnIceEvent). Defaults to 30 seconds.
+	DisconnectedTimeout time.Duration
+
+	// FailedTimeout is how long the connection may go without receiving any
+	// packet before it fails, ending Stream. Defaults to 5 seconds.
+	FailedTimeout time.Duration
+}
+
+// A DropPolicy decides which video is dropped when the sender falls behind
+// its source, e.g. on a slow link. Either way, a group of pictures that has
+// lost a NALU is dropped up to the next keyframe, rather than sent
+// undecodable. Drops are counted in SessionInfo.
+type DropPolicy = media.DropPolicy
+
+const (
+	// Keep the queue short, and request a keyframe to resume from as soon as
+	// video is dropped, so that it stays live. This is the default.
+	DropForLatency = media.DropForLatency
+
+	// Queue four times as much before dropping, riding out short stalls at
+	// the cost of latency, and drop pictures that no others refer to first.
+	DropForQuality = media.DropForQuality
+)
+
+// Number of NALUs queued between the video source and the RTP packetizer in
+// game mode. Just enough for a keyframe with its parameter sets.
+const gameModeQueueSize = 4
+
+// Bytes of video sent back-to-back in game mode before pacing starts, unless
+// Config.PacingBurst says otherwise: enough for a typical 720p keyframe, so
+// that it isn't held back by the pacer for tens of milliseconds.
+const gameModePacingBurst = 64000
+
+// GameModeKeyframeInterval is the keyframe interval, in frames, for encoders
+// in game mode, i.e. twice a second at 30 fps, so that a viewer recovers
+// quickly from loss that retransmission can't repair in time.
+const GameModeKeyframeInterval = 15
+
+// NAT1To1 gives the public addresses of a host behind 1:1 NAT, for
+// Config.NAT1To1, e.g. NAT1To1{IPs: []string{"203.0.113.7"}}.
+type NAT1To1 = ice.NAT1To1
+
+// PortRange is an inclusive range of UDP ports, for Config.PortRange.
+type PortRange = ice.PortRange
+
+// Differentiated Services code points for Config.DSCP.
+const (
+	DSCPExpeditedForwarding = ice.DSCPExpeditedForwarding
+	DSCPAF41                = ice.DSCPAF41
+)
+
+// ExcludeInterfaces returns an InterfaceFilter that rejects interfaces whose
+// names match any of the given shell patterns, e.g. "docker*" or "tun*". See
+// path.Match for the pattern syntax.
+func ExcludeInterfaces(patterns ...string) func(string, net.IP) bool {
+	return func(name string, ip net.IP) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				return false
+			}
+		}
+		return true
+	}
 }
@@ -0,0 +1,68 @@
+package alohartc
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/lanikai/alohartc/internal/dtls"
+)
+
+var errStreamEnded = errors.New("peer connection stopped streaming")
+
+// A DataStream carries application data over a PeerConnection's DTLS
+// transport, secured by the same handshake as the media. Each Write sends one
+// DTLS record, and each Read returns one, so the application frames its own
+// messages, e.g. for a control channel or firmware update. Like the
+// datagrams underneath, records may be lost or reordered, and records that
+// are not read promptly are dropped.
+//
+// Browsers do not accept raw application data over DTLS, only SCTP, so the
+// remote peer must be another application that speaks the same framing.
+type DataStream interface {
+	// Read reads one record of application data into p.
+	Read(p []byte) (int, error)
+
+	// Write sends p as one record of application data.
+	Write(p []byte) (int, error)
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// DTLSTransport waits for Stream to complete the DTLS handshake, and returns
+// a DataStream for sending application data alongside the media. It fails if
+// ctx is done first, or if Stream returns. The DataStream lasts as long as the
+// PeerConnection; close that to end it.
+func (pc *PeerConnection) DTLSTransport(ctx context.Context) (DataStream, error) {
+	select {
+	case <-pc.dtlsReady:
+		return dtlsDataStream{pc.dtlsConn}, nil
+	case <-pc.streamDone:
+		return nil, errStreamEnded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Wraps a DTLS connection, hiding the methods that would disrupt the media
+// sharing it.
+type dtlsDataStream struct {
+	conn *dtls.Conn
+}
+
+func (ds dtlsDataStream) Read(p []byte) (int, error) {
+	return ds.conn.Read(p)
+}
+
+func (ds dtlsDataStream) Write(p []byte) (int, error) {
+	return ds.conn.Write(p)
+}
+
+func (ds dtlsDataStream) LocalAddr() net.Addr {
+	return ds.conn.LocalAddr()
+}
+
+func (ds dtlsDataStream) RemoteAddr() net.Addr {
+	return ds.conn.RemoteAddr()
+}
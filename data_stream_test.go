@@ -0,0 +1,29 @@
+package alohartc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDTLSTransportWaits(t *testing.T) {
+	pc := &PeerConnection{
+		streamDone: make(chan struct{}),
+		dtlsReady:  make(chan struct{}),
+	}
+
+	// No handshake yet.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ds, err := pc.DTLSTransport(ctx)
+	assert.Nil(t, ds)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Stream returned without completing the handshake.
+	close(pc.streamDone)
+	ds, err = pc.DTLSTransport(context.Background())
+	assert.Nil(t, ds)
+	assert.Equal(t, errStreamEnded, err)
+}
@@ -0,0 +1,171 @@
+package alohartc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+// A DegradationStep is one level of video quality that a DegradationPolicy
+// can select.
+type DegradationStep struct {
+	// Capture frame rate, in frames per second. Zero leaves it unchanged.
+	FrameRate int
+
+	// Picture size. Zero restores the source's configured size. Only
+	// sources implementing media.ResolutionAdjuster can change it.
+	Width  int
+	Height int
+
+	// Bitrate needed to sustain the step, in bits per second. Below it, the
+	// policy steps down to the next. Ignored for the last step.
+	MinBitrate int
+}
+
+// A DegradationPolicy lowers the frame rate and resolution of the local video
+// when the bandwidth estimate stays too low for good quality at any bitrate
+// the encoder can be given, and raises them again on recovery. See
+// Config.Degradation.
+type DegradationPolicy struct {
+	// Steps, from full quality down. The first should match the source's
+	// own settings.
+	Steps []DegradationStep
+
+	// How long the estimate must stay beyond a step's limit before stepping
+	// down or up. Defaults to 5 seconds.
+	Hold time.Duration
+
+	// Headroom above a step's MinBitrate required before stepping back up
+	// to it, as a fraction, so that the policy doesn't oscillate between
+	// two steps. Defaults to 0.25.
+	Hysteresis float64
+
+	// OnChange, if non-nil, is called with the index of each newly selected
+	// step, e.g. to show the viewer that quality is reduced.
+	OnChange func(index int, step DegradationStep)
+}
+
+// DefaultDegradationSteps suit a 30 fps camera: first halve the frame rate,
+// then the resolution, then drop to 10 fps.
+var DefaultDegradationSteps = []DegradationStep{
+	{FrameRate: 30, MinBitrate: 600000},
+	{FrameRate: 15, MinBitrate: 300000},
+	{FrameRate: 15, Width: 640, Height: 360, MinBitrate: 150000},
+	{FrameRate: 10, Width: 640, Height: 360},
+}
+
+const (
+	defaultDegradationHold       = 5 * time.Second
+	defaultDegradationHysteresis = 0.25
+
+	// How often the bandwidth estimate is checked against the policy.
+	degradationInterval = time.Second
+)
+
+// Applies a DegradationPolicy to a video source.
+type degrader struct {
+	policy DegradationPolicy
+	src    media.VideoSource
+
+	mu sync.Mutex
+
+	// Latest bandwidth estimate, in bits per second, or 0 if none yet.
+	estimate int
+
+	// Index of the current step.
+	current int
+
+	// When the estimate first went beyond the current step's limits, in
+	// the direction of pending, or zero if within them.
+	since   time.Time
+	pending int
+}
+
+func newDegrader(policy DegradationPolicy, src media.VideoSource) *degrader {
+	if len(policy.Steps) == 0 {
+		policy.Steps = DefaultDegradationSteps
+	}
+	if policy.Hold <= 0 {
+		policy.Hold = defaultDegradationHold
+	}
+	if policy.Hysteresis <= 0 {
+		policy.Hysteresis = defaultDegradationHysteresis
+	}
+	return &degrader{policy: policy, src: src}
+}
+
+// Record a new bandwidth estimate.
+func (d *degrader) update(bps int) {
+	d.mu.Lock()
+	d.estimate = bps
+	d.mu.Unlock()
+}
+
+// Check the estimate against the current step's limits, and change step if
+// it has been beyond them for long enough.
+func (d *degrader) check(now time.Time) {
+	d.mu.Lock()
+	next := d.current
+	steps := d.policy.Steps
+	switch {
+	case d.estimate == 0:
+	case d.current+1 < len(steps) && d.estimate < steps[d.current].MinBitrate:
+		next = d.current + 1
+	case d.current > 0 && float64(d.estimate) > float64(steps[d.current-1].MinBitrate)*(1+d.policy.Hysteresis):
+		next = d.current - 1
+	}
+	if next == d.current {
+		d.since = time.Time{}
+		d.mu.Unlock()
+		return
+	}
+	if d.since.IsZero() || d.pending != next {
+		d.since = now
+		d.pending = next
+	}
+	if now.Sub(d.since) < d.policy.Hold {
+		d.mu.Unlock()
+		return
+	}
+	d.current = next
+	d.since = time.Time{}
+	d.mu.Unlock()
+
+	d.apply(next)
+}
+
+// Change the source to a step.
+func (d *degrader) apply(index int) {
+	step := d.policy.Steps[index]
+	log.Info("Switching video to quality step %d: %+v", index, step)
+	if step.FrameRate > 0 {
+		if enc, ok := d.src.(media.EncoderController); ok {
+			if err := enc.AdjustFrameRate(step.FrameRate); err != nil {
+				log.Warn("Failed to adjust video frame rate: %v", err)
+			}
+		}
+	}
+	if adj, ok := d.src.(media.ResolutionAdjuster); ok {
+		if err := adj.AdjustResolution(step.Width, step.Height); err != nil {
+			log.Warn("Failed to adjust video resolution: %v", err)
+		}
+	}
+	if d.policy.OnChange != nil {
+		d.policy.OnChange(index, step)
+	}
+}
+
+// Check the policy periodically, until quit is closed.
+func (d *degrader) run(quit <-chan struct{}) {
+	ticker := time.NewTicker(degradationInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			d.check(now)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package alohartc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+type fakeEncoder struct {
+	media.VideoSource
+	EncoderController
+	frameRates []int
+}
+
+func (e *fakeEncoder) AdjustFrameRate(fps int) error {
+	e.frameRates = append(e.frameRates, fps)
+	return nil
+}
+
+func TestDegrader(t *testing.T) {
+	enc := &fakeEncoder{}
+	var changes []int
+	d := newDegrader(DegradationPolicy{
+		OnChange: func(index int, step DegradationStep) {
+			changes = append(changes, index)
+		},
+	}, nil)
+	start := time.Now()
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	// No estimate yet.
+	d.check(at(0))
+	assert.Equal(t, 0, d.current)
+
+	// A brief dip is tolerated, a sustained one is not.
+	d.update(400000)
+	d.check(at(1))
+	d.update(1000000)
+	d.check(at(3))
+	d.update(400000)
+	d.check(at(4))
+	d.check(at(8))
+	assert.Equal(t, 0, d.current)
+	d.check(at(9))
+	assert.Equal(t, 1, d.current)
+
+	// Recovery to just above the step's minimum isn't enough headroom.
+	d.update(650000)
+	d.check(at(20))
+	d.check(at(30))
+	assert.Equal(t, 1, d.current)
+	d.update(800000)
+	d.check(at(31))
+	d.check(at(36))
+	assert.Equal(t, 0, d.current)
+	assert.Equal(t, []int{1, 0}, changes)
+
+	// Steps apply to the source.
+	d.src = enc
+	d.update(100000)
+	d.check(at(40))
+	d.check(at(45))
+	d.check(at(50))
+	d.check(at(55))
+	d.check(at(60))
+	d.check(at(65))
+	assert.Equal(t, 3, d.current)
+	assert.Equal(t, []int{15, 15, 10}, enc.frameRates)
+}
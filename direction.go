@@ -0,0 +1,73 @@
+package alohartc
+
+import (
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// Media directions (RFC 3264 §5.1), from the point of view of the peer whose
+// description they appear in.
+const (
+	directionSendRecv = "sendrecv"
+	directionSendOnly = "sendonly"
+	directionRecvOnly = "recvonly"
+	directionInactive = "inactive"
+)
+
+// Return the direction of a media section, which defaults to the direction
+// given at session level, and then to sendrecv.
+func mediaDirection(s *sdp.Session, m *sdp.Media) string {
+	for _, attrs := range [][]sdp.Attribute{m.Attributes, s.Attributes} {
+		for _, attr := range attrs {
+			switch attr.Key {
+			case directionSendRecv, directionSendOnly, directionRecvOnly, directionInactive:
+				return attr.Key
+			}
+		}
+	}
+	return directionSendRecv
+}
+
+// Return the direction with which to answer an offered direction, given
+// whether the local peer has media to send and wants to receive. The answer
+// sends only if the offerer receives, and receives only if it sends. See
+// RFC 3264 §6.1.
+func answerDirection(offered string, canSend, canReceive bool) string {
+	send := canSend && (offered == directionSendRecv || offered == directionRecvOnly)
+	recv := canReceive && (offered == directionSendRecv || offered == directionSendOnly)
+	switch {
+	case send && recv:
+		return directionSendRecv
+	case send:
+		return directionSendOnly
+	case recv:
+		return directionRecvOnly
+	}
+	return directionInactive
+}
+
+// Report whether a direction includes sending or receiving.
+func isSending(direction string) bool {
+	return direction == directionSendRecv || direction == directionSendOnly
+}
+
+func isReceiving(direction string) bool {
+	return direction == directionSendRecv || direction == directionRecvOnly
+}
+
+// Return the direction to offer, given whether the local peer has media to
+// send and wants to receive.
+func offerDirection(canSend, canReceive bool) string {
+	return answerDirection(directionSendRecv, canSend, canReceive)
+}
+
+// Return the direction from the other peer's point of view, e.g. to find our
+// direction from the remote peer's answer.
+func reverseDirection(direction string) string {
+	switch direction {
+	case directionSendOnly:
+		return directionRecvOnly
+	case directionRecvOnly:
+		return directionSendOnly
+	}
+	return direction
+}
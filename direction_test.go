@@ -0,0 +1,43 @@
+package alohartc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+func TestAnswerDirection(t *testing.T) {
+	tests := []struct {
+		offered          string
+		canSend, canRecv bool
+		expected         string
+	}{
+		{"sendrecv", true, false, "sendonly"},
+		{"sendrecv", false, true, "recvonly"},
+		{"sendrecv", true, true, "sendrecv"},
+		{"sendrecv", false, false, "inactive"},
+		{"recvonly", true, true, "sendonly"},
+		{"recvonly", false, true, "inactive"},
+		{"sendonly", true, true, "recvonly"},
+		{"sendonly", true, false, "inactive"},
+		{"inactive", true, true, "inactive"},
+	}
+	for _, tt := range tests {
+		got := answerDirection(tt.offered, tt.canSend, tt.canRecv)
+		assert.Equal(t, tt.expected, got, "offered %s, send %v, receive %v", tt.offered, tt.canSend, tt.canRecv)
+	}
+}
+
+func TestMediaDirection(t *testing.T) {
+	s := &sdp.Session{}
+	m := &sdp.Media{}
+	assert.Equal(t, "sendrecv", mediaDirection(s, m))
+
+	s.Attributes = []sdp.Attribute{{Key: "recvonly"}}
+	assert.Equal(t, "recvonly", mediaDirection(s, m))
+
+	m.Attributes = []sdp.Attribute{{Key: "mid", Value: "0"}, {Key: "sendonly"}}
+	assert.Equal(t, "sendonly", mediaDirection(s, m))
+}
@@ -0,0 +1,86 @@
+package alohartc_test
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lanikai/alohartc"
+)
+
+// Calls delivered by the application's own signaling transport.
+var incoming = make(chan *alohartc.Call)
+
+func ExampleCamera() {
+	cam := alohartc.Camera{
+		Source: "/dev/video0",
+		Signaler: alohartc.SignalerFunc(func(ctx context.Context, handle func(*alohartc.Call)) error {
+			for {
+				select {
+				case call := <-incoming:
+					handle(call)
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}),
+		Config: alohartc.Config{
+			TURNServers: []alohartc.TURNServer{{
+				Address:     "turn.example.com:3478",
+				Credentials: alohartc.SharedSecretTURNCredentials("secret", "camera", time.Hour),
+			}},
+		},
+		OnError: func(err error) {
+			log.Printf("call failed: %v", err)
+		},
+	}
+
+	log.Fatal(cam.Run(context.Background()))
+}
+
+func ExamplePeerConnection() {
+	var call *alohartc.Call = <-incoming
+
+	pc := alohartc.Must(alohartc.NewPeerConnection(alohartc.Config{
+		// LocalVideo: a media source, e.g. from a V4L2 device.
+	}))
+	defer pc.Close()
+
+	// Trickle local candidates to the viewer as they are gathered.
+	pc.OnIceCandidate = func(c *alohartc.ICECandidate) {
+		call.SendLocalCandidate(c)
+	}
+
+	answer, err := pc.SetRemoteDescription(<-call.Offer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	call.SendAnswer(answer)
+
+	go func() {
+		for c := range call.RemoteCandidates {
+			pc.AddIceCandidate(&c)
+		}
+		pc.AddIceCandidate(nil)
+	}()
+
+	if err := pc.Stream(); err != nil {
+		log.Print(err)
+	}
+}
+
+// The application's own channel to the remote peer, e.g. a WebSocket relaying
+// JSON-encoded messages.
+var channel alohartc.SignalingChannel
+
+func ExampleConnect() {
+	err := alohartc.Connect(context.Background(), channel, alohartc.Config{
+		// LocalVideo: a media source, e.g. from a V4L2 device.
+
+		// The browser is impolite, so that its offer wins if both offer.
+		Polite: true,
+	})
+	if err != nil {
+		log.Print(err)
+	}
+}
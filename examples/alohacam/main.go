@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -14,7 +15,11 @@ import (
 	"github.com/lanikai/alohartc/internal/ice"
 	"github.com/lanikai/alohartc/internal/ice/mdns"
 	"github.com/lanikai/alohartc/internal/media"
-	"github.com/lanikai/alohartc/internal/media/rtsp"
+	_ "github.com/lanikai/alohartc/internal/media/ffmpeg"    // registers ffmpeg: and capture:
+	_ "github.com/lanikai/alohartc/internal/media/libcamera" // registers libcamera:
+	"github.com/lanikai/alohartc/internal/media/onvif"       // registers onvif://
+	_ "github.com/lanikai/alohartc/internal/media/rtsp"      // registers rtsp://
+	_ "github.com/lanikai/alohartc/internal/media/screen"    // registers screen:
 	"github.com/lanikai/alohartc/internal/signaling"
 	"github.com/lanikai/alohartc/internal/v4l2"
 )
@@ -39,8 +44,14 @@ func main() {
 	bitrate := flag.Int("bitrate", 1500e3, "set video bitrate")
 	width := flag.Int("width", 1280, "set video width")
 	height := flag.Int("height", 720, "set video height")
+	discover := flag.Bool("discover", false, "list ONVIF cameras on the local network, and exit")
 	flag.Parse()
 
+	if *discover {
+		discoverCameras()
+		return
+	}
+
 	// Always print version information
 	version()
 
@@ -58,8 +69,8 @@ func main() {
 
 				RepeatSequenceHeader: true,
 			})
-		} else if strings.HasPrefix(*input, "rtsp://") {
-			videoSource, err = rtsp.Open(*input)
+		} else if media.CanOpen(*input) {
+			videoSource, err = media.Open(*input)
 		} else if strings.HasSuffix(*input, ".mp4") {
 			videoSource, err = media.OpenMP4(*input)
 		}
@@ -84,22 +95,64 @@ func main() {
 	signaling.Listen(doPeerSession)
 }
 
+// Print the ONVIF cameras that answer a discovery probe, as inputs to pass to
+// -i.
+func discoverCameras() {
+	devices, err := onvif.Discover(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(devices) == 0 {
+		fmt.Println("No ONVIF cameras found")
+	}
+	for _, d := range devices {
+		for _, xaddr := range d.XAddrs {
+			if u, err := url.Parse(xaddr); err == nil {
+				fmt.Printf("onvif://USER:PASSWORD@%s\t%s\n", u.Host, d.Name())
+				break
+			}
+		}
+	}
+}
+
 func doPeerSession(ss *signaling.Session) {
-	ctx, cancel := context.WithCancel(ss.Context)
-	defer cancel()
+	r := alohartc.Reconnector{
+		Policy: alohartc.ReconnectPolicy{MaxRetries: 3},
+
+		// The viewer calls again over the same signaling session, with a
+		// new offer, if the connection can't be saved.
+		Connect: func(ctx context.Context) (*alohartc.PeerConnection, error) {
+			return answerCall(ctx, ss)
+		},
+
+		// The viewer restarts ICE itself, with a new offer that answerCall
+		// passes on. Just wait for it.
+		RestartICE: func(ctx context.Context, pc *alohartc.PeerConnection) error {
+			return nil
+		},
+	}
+	if err := r.Run(ss.Context); err != nil {
+		log.Println(err)
+	}
+}
 
+// Answer the next offer from the viewer with a new peer connection, and relay
+// its signaling until ctx is done.
+func answerCall(ctx context.Context, ss *signaling.Session) (*alohartc.PeerConnection, error) {
 	// Create peer connection with one video track
-	pc := alohartc.Must(alohartc.NewPeerConnectionWithContext(
-		ctx,
-		alohartc.Config{
-			LocalVideo: videoSource,
-		}))
-	defer pc.Close()
+	pc, err := alohartc.NewPeerConnectionWithContext(ctx, alohartc.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pc.AddTrack(videoSource); err != nil {
+		pc.Close()
+		return nil, err
+	}
 
 	// Register callback for ICE candidates produced by the local ICE agent.
 	pc.OnIceCandidate = func(c *ice.Candidate) {
 		if err := ss.SendLocalCandidate(c); err != nil {
-			log.Fatal(err)
+			log.Println(err)
 		}
 	}
 
@@ -107,26 +160,44 @@ func doPeerSession(ss *signaling.Session) {
 	select {
 	case offer := <-ss.Offer:
 		answer, err := pc.SetRemoteDescription(offer)
-		if err != nil {
-			log.Fatal(err)
+		if err == nil {
+			err = ss.SendAnswer(answer)
 		}
-
-		if err := ss.SendAnswer(answer); err != nil {
-			log.Fatal(err)
+		if err != nil {
+			pc.Close()
+			return nil, err
 		}
-	case <-ss.Done():
-		log.Fatal(ss.Err())
+	case <-ctx.Done():
+		pc.Close()
+		return nil, ctx.Err()
 	}
 
-	// Pass remote candidates from the signaling server to the local ICE agent.
+	// Pass remote candidates from the signaling server to the local ICE
+	// agent, and answer new offers, which restart ICE.
 	go func() {
-		for c := range ss.RemoteCandidates {
-			pc.AddIceCandidate(&c)
+		candidates := ss.RemoteCandidates
+		for {
+			select {
+			case c, more := <-candidates:
+				if !more {
+					pc.AddIceCandidate(nil)
+					candidates = nil
+					break
+				}
+				pc.AddIceCandidate(&c)
+			case offer := <-ss.Offer:
+				answer, err := pc.SetRemoteDescription(offer)
+				if err == nil {
+					err = ss.SendAnswer(answer)
+				}
+				if err != nil {
+					log.Println(err)
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
-		pc.AddIceCandidate(nil)
 	}()
 
-	if err := pc.Stream(); err != nil {
-		log.Println(err)
-	}
+	return pc, nil
 }
@@ -0,0 +1,205 @@
+package alohartc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// ICE gathering states, as RTCIceGatheringState.
+const (
+	ICEGatheringStateNew       = "new"
+	ICEGatheringStateGathering = "gathering"
+	ICEGatheringStateComplete  = "complete"
+)
+
+// Local candidates of the ICE agent started most recently, and whether it has
+// finished gathering them.
+type gathering struct {
+	agent      *ice.Agent
+	state      string
+	candidates []ice.Candidate
+
+	// Closed when gathering completes, or is abandoned for a later agent.
+	done chan struct{}
+}
+
+// ICEGatheringState reports whether the ICE agent started most recently is
+// gathering local candidates, or has finished.
+func (pc *PeerConnection) ICEGatheringState() string {
+	pc.iceMutex.Lock()
+	defer pc.iceMutex.Unlock()
+	if pc.gathering.state == "" {
+		return ICEGatheringStateNew
+	}
+	return pc.gathering.state
+}
+
+// Begin gathering for a newly started agent, replacing any earlier agent's
+// candidates.
+func (pc *PeerConnection) beginGathering(agent *ice.Agent) {
+	pc.iceMutex.Lock()
+	changed := pc.gathering.state != ICEGatheringStateGathering
+	if !changed {
+		close(pc.gathering.done)
+	}
+	pc.gathering = gathering{
+		agent: agent,
+		state: ICEGatheringStateGathering,
+		done:  make(chan struct{}),
+	}
+	pc.iceMutex.Unlock()
+	if changed && pc.OnICEGatheringStateChange != nil {
+		pc.OnICEGatheringStateChange(ICEGatheringStateGathering)
+	}
+}
+
+// Record a local candidate of agent, unless another agent has started since.
+func (pc *PeerConnection) addGatheredCandidate(agent *ice.Agent, c ice.Candidate) {
+	pc.iceMutex.Lock()
+	if pc.gathering.agent == agent {
+		pc.gathering.candidates = append(pc.gathering.candidates, c)
+	}
+	pc.iceMutex.Unlock()
+}
+
+// Mark gathering complete for agent, unless another agent has started since.
+func (pc *PeerConnection) completeGathering(agent *ice.Agent) {
+	pc.iceMutex.Lock()
+	current := pc.gathering.agent == agent && pc.gathering.state == ICEGatheringStateGathering
+	if current {
+		pc.gathering.state = ICEGatheringStateComplete
+		close(pc.gathering.done)
+	}
+	pc.iceMutex.Unlock()
+	if current && pc.OnICEGatheringStateChange != nil {
+		pc.OnICEGatheringStateChange(ICEGatheringStateComplete)
+	}
+}
+
+// LocalDescription returns the local SDP description in effect, from
+// CreateOffer, SetRemoteDescription or RestartICE, with an a=candidate line
+// for each local candidate gathered so far, and a=end-of-candidates once
+// gathering is complete. The m-line carrying the transport has the address
+// of a default candidate, for peers that don't do ICE. A remote peer that doesn't accept trickled
+// candidates can be sent this in place of the answer from
+// SetRemoteDescription, once OnICEGatheringStateChange reports
+// ICEGatheringStateComplete (half trickle, see RFC 8838 Section 4). It
+// returns "" before any description is set.
+func (pc *PeerConnection) LocalDescription() string {
+	pc.mediaMutex.Lock()
+	desc := ""
+	if len(pc.localDescription.Media) > 0 {
+		desc = pc.localDescription.String()
+	}
+	pc.mediaMutex.Unlock()
+	if desc == "" {
+		return ""
+	}
+	s, err := sdp.ParseSession(desc)
+	if err != nil {
+		return desc
+	}
+
+	// An offer restarting ICE carries credentials whose agent hasn't
+	// started gathering.
+	pc.iceMutex.Lock()
+	var candidates []ice.Candidate
+	complete := false
+	if pc.pendingICE == nil {
+		candidates = append(candidates, pc.gathering.candidates...)
+		complete = pc.gathering.state == ICEGatheringStateComplete
+	}
+	pc.iceMutex.Unlock()
+
+	addCandidates(&s, candidates, complete)
+	setDefaultCandidate(&s, candidates)
+	return s.String()
+}
+
+// Wait until the current ICE agent finishes gathering, then return the local
+// description with its candidates, for Config.EmbedCandidates.
+func (pc *PeerConnection) waitForCandidates() (string, error) {
+	pc.iceMutex.Lock()
+	done := pc.gathering.done
+	pc.iceMutex.Unlock()
+	select {
+	case <-done:
+	case <-pc.ctx.Done():
+		return "", errClosed
+	}
+	return pc.LocalDescription(), nil
+}
+
+// Add candidates to the m-lines of their MIDs, marking the end of candidates
+// if complete.
+func addCandidates(s *sdp.Session, candidates []ice.Candidate, complete bool) {
+	for i := range s.Media {
+		m := &s.Media[i]
+		mid := m.GetAttr("mid")
+		for _, c := range candidates {
+			if c.Mid() == mid {
+				m.Attributes = append(m.Attributes, sdp.Attribute{Key: "candidate", Value: strings.TrimPrefix(c.String(), "candidate:")})
+			}
+		}
+		if complete {
+			m.Attributes = append(m.Attributes, sdp.Attribute{Key: "end-of-candidates"})
+		}
+	}
+}
+
+// Give the m-lines carrying the transport the address of a default candidate
+// (see RFC 8839 Section 4.2.1.2), in place of the placeholder 0.0.0.0:9. As
+// RFC 8445 Section 5.1.4 recommends, a relayed candidate is preferred, then a
+// server-reflexive one, for the best chance of reaching the remote peer, and
+// IPv4 over IPv6. Ties go to the first gathered.
+func setDefaultCandidate(s *sdp.Session, candidates []ice.Candidate) {
+	rank := func(c *ice.Candidate) int {
+		r := 0
+		switch c.Type() {
+		case "relay":
+			r = 4
+		case "srflx", "prflx":
+			r = 2
+		}
+		host, _ := c.Address()
+		if ip := net.ParseIP(host); ip == nil {
+			// An mDNS hostname means nothing to peers that don't do ICE.
+			return -1
+		} else if ip.To4() != nil {
+			r++
+		}
+		return r
+	}
+	var def *ice.Candidate
+	for i := range candidates {
+		if r := rank(&candidates[i]); r >= 0 && (def == nil || r > rank(def)) {
+			def = &candidates[i]
+		}
+	}
+	if def == nil {
+		return
+	}
+
+	host, port := def.Address()
+	addrType := "IP6"
+	if net.ParseIP(host).To4() != nil {
+		addrType = "IP4"
+	}
+	for i := range s.Media {
+		m := &s.Media[i]
+		if m.Port == 0 || m.GetAttr("mid") != def.Mid() {
+			continue
+		}
+		m.Port = port
+		m.Connection = &sdp.Connection{NetworkType: "IN", AddressType: addrType, Address: host}
+		for j := range m.Attributes {
+			if m.Attributes[j].Key == "rtcp" {
+				m.Attributes[j].Value = fmt.Sprintf("%d IN %s %s", port, addrType, host)
+			}
+		}
+	}
+}
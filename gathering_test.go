@@ -0,0 +1,182 @@
+package alohartc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/lanikai/alohartc/internal/sdp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Pass the candidates in an SDP description to a peer connection, as a peer
+// that doesn't trickle candidates would have them.
+func addDescriptionCandidates(t *testing.T, pc *PeerConnection, desc string) {
+	s, err := sdp.ParseSession(desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range s.Media {
+		mid := s.Media[i].GetAttr("mid")
+		for _, value := range s.Media[i].GetAttrs("candidate") {
+			c, err := ice.ParseCandidate("candidate:"+value, mid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc.AddIceCandidate(&c)
+		}
+	}
+	pc.AddIceCandidate(nil)
+}
+
+func TestHalfTrickle(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	offerer := Must(NewPeerConnection(config))
+	config = loopbackConfig()
+	config.ICEGatheringTimeout = time.Second
+	answerer := Must(NewPeerConnection(config))
+	received := receiveLoopback(answerer)
+
+	// The answerer's candidates go only in its description.
+	states := make(chan string, 4)
+	answerer.OnICEGatheringStateChange = func(state string) {
+		states <- state
+	}
+	offerer.OnIceCandidate = answerer.AddIceCandidate
+	answerer.OnIceCandidate = func(c *ICECandidate) {}
+
+	assert.Equal(t, ICEGatheringStateNew, answerer.ICEGatheringState())
+	assert.Equal(t, "", answerer.LocalDescription())
+	offer, err := offerer.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, answer, "a=candidate:")
+
+	assert.Equal(t, ICEGatheringStateGathering, <-states)
+	select {
+	case state := <-states:
+		assert.Equal(t, ICEGatheringStateComplete, state)
+	case <-time.After(5 * time.Second):
+		t.Fatal("gathering did not complete")
+	}
+	assert.Equal(t, ICEGatheringStateComplete, answerer.ICEGatheringState())
+
+	answer = answerer.LocalDescription()
+	assert.Contains(t, answer, "a=candidate:")
+	assert.Contains(t, answer, "a=end-of-candidates")
+	if err := offerer.SetRemoteAnswer(answer); err != nil {
+		t.Fatal(err)
+	}
+	addDescriptionCandidates(t, offerer, answer)
+
+	errs := make(chan error, 2)
+	for _, pc := range []*PeerConnection{offerer, answerer} {
+		go func(pc *PeerConnection) {
+			errs <- pc.Stream()
+		}(pc)
+	}
+	expectVideo(t, received)
+
+	offerer.Close()
+	answerer.Close()
+	<-errs
+	<-errs
+}
+
+func TestEmbedCandidates(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	offerer := Must(NewPeerConnection(config))
+	config = loopbackConfig()
+	config.EmbedCandidates = true
+	config.ICEGatheringTimeout = time.Second
+	answerer := Must(NewPeerConnection(config))
+	received := receiveLoopback(answerer)
+	offerer.OnIceCandidate = answerer.AddIceCandidate
+	answerer.OnIceCandidate = func(c *ICECandidate) {}
+
+	offer, err := offerer.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The answer carries the candidates, and the default one's address.
+	assert.Equal(t, ICEGatheringStateComplete, answerer.ICEGatheringState())
+	assert.Contains(t, answer, "a=candidate:")
+	assert.Contains(t, answer, "a=end-of-candidates")
+	s, err := sdp.ParseSession(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "127.0.0.1", s.Media[0].Connection.Address)
+	assert.NotEqual(t, 9, s.Media[0].Port)
+
+	if err := offerer.SetRemoteAnswer(answer); err != nil {
+		t.Fatal(err)
+	}
+	addDescriptionCandidates(t, offerer, answer)
+
+	errs := make(chan error, 2)
+	for _, pc := range []*PeerConnection{offerer, answerer} {
+		go func(pc *PeerConnection) {
+			errs <- pc.Stream()
+		}(pc)
+	}
+	expectVideo(t, received)
+
+	offerer.Close()
+	answerer.Close()
+	<-errs
+	<-errs
+}
+
+func TestSetDefaultCandidate(t *testing.T) {
+	var candidates []ice.Candidate
+	for _, desc := range []string{
+		"candidate:1 1 udp 2130706431 abcdef01-2345-4678-9abc-def012345678.local 5000 typ host",
+		"candidate:2 1 udp 2130706430 2001:db8::1 5001 typ host",
+		"candidate:3 1 udp 2130706429 192.168.1.2 5002 typ host",
+		"candidate:4 1 udp 1694498815 203.0.113.7 5003 typ srflx raddr 0.0.0.0 rport 0",
+	} {
+		c, err := ice.ParseCandidate(desc, "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		candidates = append(candidates, c)
+	}
+	s := sdp.Session{Media: []sdp.Media{{
+		Type:       "video",
+		Port:       9,
+		Connection: &sdp.Connection{NetworkType: "IN", AddressType: "IP4", Address: "0.0.0.0"},
+		Attributes: []sdp.Attribute{{Key: "mid", Value: "0"}, {Key: "rtcp", Value: "9 IN IP4 0.0.0.0"}},
+	}}}
+
+	// The server-reflexive candidate beats the host ones.
+	setDefaultCandidate(&s, candidates)
+	assert.Equal(t, 5003, s.Media[0].Port)
+	assert.Equal(t, "203.0.113.7", s.Media[0].Connection.Address)
+	assert.Equal(t, "5003 IN IP4 203.0.113.7", s.Media[0].GetAttr("rtcp"))
+
+	// IPv4 beats IPv6, and mDNS hostnames are never used.
+	setDefaultCandidate(&s, candidates[:3])
+	assert.Equal(t, "192.168.1.2", s.Media[0].Connection.Address)
+	setDefaultCandidate(&s, candidates[:2])
+	assert.Equal(t, "IP6", s.Media[0].Connection.AddressType)
+	assert.Equal(t, "2001:db8::1", s.Media[0].Connection.Address)
+}
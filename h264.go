@@ -0,0 +1,258 @@
+package alohartc
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/h264"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// H264Profile is the H.264 profile of the local video source, which decides
+// which of the remote peer's offered formats are acceptable.
+//
+// Browsers differ in what they offer. Chrome lists baseline (42001f) and
+// constrained baseline (42e01f) first. Safari on macOS and iOS lists constrained
+// high (640c1f) ahead of constrained baseline, offers each profile again with
+// packetization-mode=0, and pairs every format with an rtx format. Negotiation
+// therefore picks the first offered format (in the offerer's order of
+// preference) that exactly matches the local profile, and only falls back to a
+// format for a superset profile, which can decode the local stream, if there is
+// none. Formats without packetization-mode=1 are never chosen, since outgoing
+// NAL units are fragmented with FU-A. Exactly one format is accepted, so no
+// rtx, red, or ulpfec formats appear in the answer.
+type H264Profile = media.H264Profile
+
+const (
+	// Constrained baseline, as produced by most hardware encoders in their
+	// low-latency configurations. Also decodable by main and high profile
+	// decoders. This is the default.
+	H264ConstrainedBaseline = media.H264ProfileConstrainedBaseline
+
+	// Main profile. Also decodable by high profile decoders.
+	H264Main = media.H264ProfileMain
+
+	// High profile.
+	H264High = media.H264ProfileHigh
+)
+
+// profile_idc values (see ITU-T H.264 Table A-1).
+const (
+	profileIDCBaseline = 0x42
+	profileIDCMain     = 0x4d
+	profileIDCHigh     = 0x64
+)
+
+// An offered H.264 format.
+type h264Format struct {
+	payloadType int
+
+	// Format parameters, as offered.
+	fmtp string
+
+	params sdp.H264FormatParameters
+
+	// Offered rtcp-fb values, e.g. "nack" or "goog-remb".
+	feedback []string
+}
+
+// Return the profile_idc, the first byte of profile-level-id.
+func (f *h264Format) profileIDC() byte {
+	return byte(f.params.ProfileLevelID >> 16)
+}
+
+// Return the H.264 formats offered in m, in order of preference.
+func parseH264Formats(m *sdp.Media) []h264Format {
+	isH264 := make(map[int]bool)
+	fmtps := make(map[int]string)
+	feedback := make(map[int][]string)
+	for _, attr := range m.Attributes {
+		var pt int
+		var text string
+		switch attr.Key {
+		case "fmtp", "rtcp-fb", "rtpmap":
+			i := strings.IndexByte(attr.Value, ' ')
+			if i < 0 {
+				log.Warn("malformed %s: %s", attr.Key, attr.Value)
+				continue
+			}
+			var err error
+			if pt, err = strconv.Atoi(attr.Value[:i]); err != nil {
+				log.Warn("malformed %s: %s", attr.Key, attr.Value)
+				continue
+			}
+			text = strings.TrimSpace(attr.Value[i+1:])
+		default:
+			continue
+		}
+
+		switch attr.Key {
+		case "rtpmap":
+			isH264[pt] = strings.EqualFold(text, "H264/90000")
+		case "fmtp":
+			fmtps[pt] = text
+		case "rtcp-fb":
+			feedback[pt] = append(feedback[pt], text)
+		}
+	}
+
+	var formats []h264Format
+	for _, s := range m.Format {
+		pt, err := strconv.Atoi(s)
+		if err != nil || !isH264[pt] {
+			continue
+		}
+		f := h264Format{
+			payloadType: pt,
+			fmtp:        fmtps[pt],
+			feedback:    feedback[pt],
+		}
+		// Defaults from RFC 6184 §8.1: baseline level 1, single NAL unit mode.
+		f.params.ProfileLevelID = 0x42000a
+		if f.fmtp != "" {
+			if err := f.params.Unmarshal(f.fmtp); err != nil {
+				log.Warn("payload type %d: %v: %s", pt, err, f.fmtp)
+				continue
+			}
+		}
+		formats = append(formats, f)
+	}
+	return formats
+}
+
+// Choose the offered format to use for a local stream of the given profile.
+func selectH264Format(m *sdp.Media, profile H264Profile) (h264Format, bool) {
+	formats := parseH264Formats(m)
+
+	var exact, superset []byte
+	switch profile {
+	case H264ConstrainedBaseline:
+		exact = []byte{profileIDCBaseline}
+		superset = []byte{profileIDCMain, profileIDCHigh}
+	case H264Main:
+		exact = []byte{profileIDCMain}
+		superset = []byte{profileIDCHigh}
+	case H264High:
+		exact = []byte{profileIDCHigh}
+	}
+
+	for _, accept := range [][]byte{exact, superset} {
+		for _, f := range formats {
+			if f.params.PacketizationMode == 1 && containsByte(accept, f.profileIDC()) {
+				return f, true
+			}
+		}
+	}
+	return h264Format{}, false
+}
+
+// Report whether a remote peer accepting the format can decode a stream of the
+// given level. With level-asymmetry-allowed, the offered level only limits
+// what the peer sends (RFC 6184 §8.2.2).
+func (f *h264Format) supportsLevel(levelIDC byte) bool {
+	return f.params.LevelAsymmetryAllowed || levelIDC <= byte(f.params.ProfileLevelID)
+}
+
+// Return the SPS of a video source whose parameter sets are known before
+// streaming starts, or nil.
+func localSPS(src media.VideoSource) *h264.SPS {
+	p, ok := src.(media.ParameterSetProvider)
+	if !ok {
+		return nil
+	}
+	for _, ps := range p.ParameterSets() {
+		if len(ps) == 0 || h264.NALU(ps).Type() != h264.NALUTypeSPS {
+			continue
+		}
+		sps, err := h264.ParseSPS(ps)
+		if err != nil {
+			log.Warn("local video source: %v", err)
+			return nil
+		}
+		return sps
+	}
+	return nil
+}
+
+// Return the SPS and PPS of a video source whose parameter sets are known
+// before streaming starts, to announce in sprop-parameter-sets, or nil.
+func localParameterSets(src media.VideoSource) [][]byte {
+	p, ok := src.(media.ParameterSetProvider)
+	if !ok {
+		return nil
+	}
+	var sets [][]byte
+	for _, ps := range p.ParameterSets() {
+		if len(ps) == 0 {
+			continue
+		}
+		if t := h264.NALU(ps).Type(); t == h264.NALUTypeSPS || t == h264.NALUTypePPS {
+			sets = append(sets, ps)
+		}
+	}
+	return sets
+}
+
+// Add sprop-parameter-sets to echoed format parameters, replacing any the
+// offerer gave for its own stream.
+func withSpropParameterSets(fmtp string, sets [][]byte) string {
+	var params []string
+	for _, param := range strings.Split(fmtp, ";") {
+		param = strings.TrimSpace(param)
+		if param == "" || strings.HasPrefix(strings.ToLower(param), "sprop-parameter-sets=") {
+			continue
+		}
+		params = append(params, param)
+	}
+	var encoded []string
+	for _, ps := range sets {
+		encoded = append(encoded, base64.StdEncoding.EncodeToString(ps))
+	}
+	params = append(params, "sprop-parameter-sets="+strings.Join(encoded, ","))
+	return strings.Join(params, ";")
+}
+
+// Return the profile of a stream, for choosing among offered formats.
+func spsProfile(sps *h264.SPS) H264Profile {
+	switch sps.ProfileIDC {
+	case profileIDCBaseline:
+		return H264ConstrainedBaseline
+	case profileIDCMain:
+		return H264Main
+	}
+	return H264High
+}
+
+// Report whether the format offers the given rtcp-fb type, e.g. "nack".
+func (f *h264Format) hasFeedback(fb string) bool {
+	for _, s := range f.feedback {
+		if s == fb {
+			return true
+		}
+	}
+	return false
+}
+
+func containsByte(bs []byte, b byte) bool {
+	for _, x := range bs {
+		if x == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the profile-level-id to offer for a local stream of the given profile
+// and level_idc (see RFC 6184 Section 8.1).
+func offerProfileLevelID(profile H264Profile, levelIDC byte) int {
+	switch profile {
+	case H264Main:
+		return profileIDCMain<<16 | int(levelIDC)
+	case H264High:
+		return profileIDCHigh<<16 | int(levelIDC)
+	}
+	// Constrained baseline sets constraint_set1_flag.
+	return profileIDCBaseline<<16 | 0xe0<<8 | int(levelIDC)
+}
@@ -0,0 +1,279 @@
+package alohartc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// Video sections of offers captured from Safari and Chrome (candidates, ICE
+// credentials and fingerprints trimmed).
+
+const safariMacOffer = `v=0
+o=- 8171226618744580651 2 IN IP4 127.0.0.1
+s=-
+t=0 0
+a=group:BUNDLE 0
+m=video 9 UDP/TLS/RTP/SAVPF 96 97 98 99 100 101 127 125 104
+c=IN IP4 0.0.0.0
+a=rtcp:9 IN IP4 0.0.0.0
+a=mid:0
+a=extmap:2 http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time
+a=extmap:3 http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01
+a=recvonly
+a=rtcp-mux
+a=rtcp-rsize
+a=rtpmap:96 H264/90000
+a=rtcp-fb:96 goog-remb
+a=rtcp-fb:96 transport-cc
+a=rtcp-fb:96 ccm fir
+a=rtcp-fb:96 nack
+a=rtcp-fb:96 nack pli
+a=fmtp:96 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640c1f
+a=rtpmap:97 rtx/90000
+a=fmtp:97 apt=96
+a=rtpmap:98 H264/90000
+a=rtcp-fb:98 goog-remb
+a=rtcp-fb:98 transport-cc
+a=rtcp-fb:98 ccm fir
+a=rtcp-fb:98 nack
+a=rtcp-fb:98 nack pli
+a=fmtp:98 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f
+a=rtpmap:99 rtx/90000
+a=fmtp:99 apt=98
+a=rtpmap:100 VP8/90000
+a=rtcp-fb:100 goog-remb
+a=rtcp-fb:100 transport-cc
+a=rtcp-fb:100 ccm fir
+a=rtcp-fb:100 nack
+a=rtcp-fb:100 nack pli
+a=rtpmap:101 rtx/90000
+a=fmtp:101 apt=100
+a=rtpmap:127 red/90000
+a=rtpmap:125 rtx/90000
+a=fmtp:125 apt=127
+a=rtpmap:104 ulpfec/90000
+`
+
+// iOS lists the packetization-mode=0 variants first, and writes the format
+// parameters in a different order.
+const safariIOSOffer = `v=0
+o=- 2405389755574612316 2 IN IP4 127.0.0.1
+s=-
+t=0 0
+a=group:BUNDLE 0
+m=video 9 UDP/TLS/RTP/SAVPF 96 97 98 99 100 101 102 103
+c=IN IP4 0.0.0.0
+a=rtcp:9 IN IP4 0.0.0.0
+a=mid:0
+a=recvonly
+a=rtcp-mux
+a=rtcp-rsize
+a=rtpmap:96 H264/90000
+a=rtcp-fb:96 nack
+a=rtcp-fb:96 nack pli
+a=fmtp:96 profile-level-id=640C1F;packetization-mode=0;level-asymmetry-allowed=1
+a=rtpmap:97 rtx/90000
+a=fmtp:97 apt=96
+a=rtpmap:98 H264/90000
+a=rtcp-fb:98 nack
+a=rtcp-fb:98 nack pli
+a=fmtp:98 profile-level-id=42E01F;packetization-mode=0;level-asymmetry-allowed=1
+a=rtpmap:99 rtx/90000
+a=fmtp:99 apt=98
+a=rtpmap:100 H264/90000
+a=rtcp-fb:100 nack
+a=rtcp-fb:100 nack pli
+a=fmtp:100 profile-level-id=640C1F; packetization-mode=1; level-asymmetry-allowed=1
+a=rtpmap:101 rtx/90000
+a=fmtp:101 apt=100
+a=rtpmap:102 H264/90000
+a=rtcp-fb:102 nack
+a=rtcp-fb:102 nack pli
+a=fmtp:102 profile-level-id=42E01F; packetization-mode=1; level-asymmetry-allowed=1
+a=rtpmap:103 rtx/90000
+a=fmtp:103 apt=102
+`
+
+const chromeOffer = `v=0
+o=- 6830938501909068252 2 IN IP4 127.0.0.1
+s=-
+t=0 0
+a=group:BUNDLE 0
+m=video 9 UDP/TLS/RTP/SAVPF 96 97 98 99 100 101 102
+c=IN IP4 0.0.0.0
+a=rtcp:9 IN IP4 0.0.0.0
+a=mid:0
+a=recvonly
+a=rtcp-mux
+a=rtcp-rsize
+a=rtpmap:96 VP8/90000
+a=rtcp-fb:96 goog-remb
+a=rtcp-fb:96 nack
+a=rtpmap:97 rtx/90000
+a=fmtp:97 apt=96
+a=rtpmap:98 H264/90000
+a=rtcp-fb:98 goog-remb
+a=rtcp-fb:98 nack
+a=fmtp:98 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f
+a=rtpmap:99 rtx/90000
+a=fmtp:99 apt=98
+a=rtpmap:100 H264/90000
+a=rtcp-fb:100 goog-remb
+a=rtcp-fb:100 nack
+a=fmtp:100 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f
+a=rtpmap:101 rtx/90000
+a=fmtp:101 apt=100
+a=rtpmap:102 H264/90000
+a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f
+`
+
+// An offer listing the constrained baseline variants that encoders and
+// gateways announce, and high profile last.
+const variantsOffer = `v=0
+o=- 1 2 IN IP4 127.0.0.1
+s=-
+t=0 0
+m=video 9 UDP/TLS/RTP/SAVPF 120 121 122
+c=IN IP4 0.0.0.0
+a=mid:0
+a=rtpmap:120 H264/90000
+a=rtcp-fb:120 nack
+a=fmtp:120 packetization-mode=1;profile-level-id=42c01f
+a=rtpmap:121 H264/90000
+a=rtcp-fb:121 nack
+a=fmtp:121 packetization-mode=1;profile-level-id=42001f
+a=rtpmap:122 H264/90000
+a=rtcp-fb:122 nack
+a=fmtp:122 packetization-mode=1;profile-level-id=640028
+`
+
+func TestSelectH264Format(t *testing.T) {
+	tests := []struct {
+		name    string
+		offer   string
+		profile H264Profile
+		pt      int
+	}{
+		{"safari/baseline", safariMacOffer, H264ConstrainedBaseline, 98},
+		{"safari/main", safariMacOffer, H264Main, 96},
+		{"safari/high", safariMacOffer, H264High, 96},
+		{"ios/baseline", safariIOSOffer, H264ConstrainedBaseline, 102},
+		{"ios/high", safariIOSOffer, H264High, 100},
+		{"chrome/baseline", chromeOffer, H264ConstrainedBaseline, 98},
+		{"chrome/high", chromeOffer, H264High, -1},
+		{"variants/baseline", variantsOffer, H264ConstrainedBaseline, 120},
+		{"variants/main", variantsOffer, H264Main, 122},
+		{"variants/high", variantsOffer, H264High, 122},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := sdp.ParseSession(tt.offer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, ok := selectH264Format(&s.Media[0], tt.profile)
+			if tt.pt < 0 {
+				assert.False(t, ok)
+				return
+			}
+			if !ok {
+				t.Fatal("no format selected")
+			}
+			assert.Equal(t, tt.pt, f.payloadType)
+			assert.Equal(t, 1, f.params.PacketizationMode)
+			assert.True(t, f.hasFeedback("nack"))
+		})
+	}
+}
+
+// A video source with known parameter sets.
+type parameterSetSource struct {
+	media.VideoSource
+	sets [][]byte
+}
+
+func (s parameterSetSource) ParameterSets() [][]byte { return s.sets }
+
+func TestLocalSPS(t *testing.T) {
+	// High profile, level 4, 1920x1080.
+	sps := []byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0x40}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	src := parameterSetSource{sets: [][]byte{sps, pps}}
+
+	info := localSPS(src)
+	if info == nil {
+		t.Fatal("no SPS found")
+	}
+	assert.Equal(t, H264High, spsProfile(info))
+	assert.Nil(t, localSPS(parameterSetSource{}))
+
+	f := h264Format{params: sdp.H264FormatParameters{ProfileLevelID: 0x64001f}}
+	assert.False(t, f.supportsLevel(info.LevelIDC))
+	f.params.LevelAsymmetryAllowed = true
+	assert.True(t, f.supportsLevel(info.LevelIDC))
+}
+
+func TestCreateAnswerSafari(t *testing.T) {
+	for _, offer := range []string{safariMacOffer, safariIOSOffer} {
+		remote, err := sdp.ParseSession(offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc := &PeerConnection{remoteDescription: remote}
+		answer, err := pc.createAnswer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := answer.Media[0]
+		if assert.Len(t, m.Format, 1) {
+			assert.Equal(t, m.Format[0], fmt.Sprint(pc.DynamicType))
+		}
+		for _, value := range m.GetAttrs("rtpmap") {
+			assert.Contains(t, value, "H264/90000", "no rtx, red, or ulpfec")
+		}
+		assert.Len(t, m.GetAttrs("fmtp"), 1)
+	}
+}
+
+func TestWithSpropParameterSets(t *testing.T) {
+	sets := [][]byte{{0x67, 0x42}, {0x68, 0xce}}
+	assert.Equal(t, "sprop-parameter-sets=Z0I=,aM4=", withSpropParameterSets("", sets))
+	assert.Equal(t,
+		"level-asymmetry-allowed=1;profile-level-id=42e01f;sprop-parameter-sets=Z0I=,aM4=",
+		withSpropParameterSets("level-asymmetry-allowed=1; sprop-parameter-sets=AAAA;profile-level-id=42e01f", sets))
+}
+
+func TestCreateAnswerSpropParameterSets(t *testing.T) {
+	// Constrained baseline, level 3.1, 640x480, as in the loopback tests.
+	sps := []byte{0x67, 0x42, 0xe0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}
+	pps := []byte{0x68, 0xce, 0x06, 0xe2}
+	sei := []byte{0x06, 0x05, 0x00}
+
+	remote, err := sdp.ParseSession(safariMacOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := &PeerConnection{
+		remoteDescription: remote,
+		localVideo:        parameterSetSource{sets: [][]byte{sps, pps, sei}},
+	}
+	answer, err := pc.createAnswer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fmtp sdp.H264FormatParameters
+	value := answer.Media[0].GetAttr("fmtp")
+	if assert.NoError(t, fmtp.Unmarshal(value[strings.IndexByte(value, ' ')+1:])) {
+		assert.Equal(t, [][]byte{sps, pps}, fmtp.SpropParameterSets)
+		assert.Equal(t, 0x42e01f, fmtp.ProfileLevelID)
+	}
+}
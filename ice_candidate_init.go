@@ -0,0 +1,70 @@
+package alohartc
+
+import (
+	"github.com/lanikai/alohartc/internal/ice"
+)
+
+// ICECandidateInit is the JSON form in which browsers exchange ICE candidates,
+// as in RTCIceCandidateInit:
+//
+//	{"candidate": "candidate:...", "sdpMid": "0", "sdpMLineIndex": 0, "usernameFragment": "..."}
+//
+// An empty Candidate marks the end of candidates. Optional fields are nil if
+// absent.
+type ICECandidateInit struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// ICECandidate parses the candidate, for PeerConnection.AddIceCandidate. It
+// returns nil for the end of candidates.
+func (ci *ICECandidateInit) ICECandidate() (*ICECandidate, error) {
+	if ci.Candidate == "" {
+		return nil, nil
+	}
+
+	var mid string
+	if ci.SDPMid != nil {
+		mid = *ci.SDPMid
+	}
+	c, err := ice.ParseCandidate(ci.Candidate, mid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tag the candidate with its ICE session, unless it says already.
+	if ci.UsernameFragment != nil && c.Ufrag() == "" {
+		if c, err = ice.ParseCandidate(ci.Candidate+" ufrag "+*ci.UsernameFragment, mid); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// CandidateInit converts a local ICE candidate, as passed to OnIceCandidate,
+// to JSON form for sending to the remote peer. The nil candidate becomes the
+// end-of-candidates marker.
+func (pc *PeerConnection) CandidateInit(c *ICECandidate) ICECandidateInit {
+	if c == nil {
+		return ICECandidateInit{}
+	}
+
+	mid := c.Mid()
+	ci := ICECandidateInit{
+		Candidate: c.String(),
+		SDPMid:    &mid,
+	}
+	for i := range pc.localDescription.Media {
+		m := &pc.localDescription.Media[i]
+		if m.GetAttr("mid") == mid {
+			index := uint16(i)
+			ufrag := mediaICECredentials(&pc.localDescription, m).ufrag
+			ci.SDPMLineIndex = &index
+			ci.UsernameFragment = &ufrag
+			break
+		}
+	}
+	return ci
+}
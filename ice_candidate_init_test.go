@@ -0,0 +1,58 @@
+package alohartc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+func TestICECandidateInitJSON(t *testing.T) {
+	var ci ICECandidateInit
+	err := json.Unmarshal([]byte(`{
+		"candidate": "candidate:842163049 1 udp 1677729535 203.0.113.7 54400 typ srflx raddr 0.0.0.0 rport 0 generation 0",
+		"sdpMid": "0",
+		"sdpMLineIndex": 0,
+		"usernameFragment": "EsAw"
+	}`), &ci)
+	assert.NoError(t, err)
+
+	c, err := ci.ICECandidate()
+	assert.NoError(t, err)
+	assert.Equal(t, "0", c.Mid())
+	assert.Equal(t, "srflx", c.Type())
+	assert.Equal(t, "EsAw", c.Ufrag())
+
+	// End of candidates.
+	err = json.Unmarshal([]byte(`{"candidate": "", "sdpMid": null, "sdpMLineIndex": null}`), &ci)
+	assert.NoError(t, err)
+	c, err = ci.ICECandidate()
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+}
+
+func TestCandidateInit(t *testing.T) {
+	pc := &PeerConnection{
+		localDescription: sdp.Session{
+			Media: []sdp.Media{
+				{Attributes: []sdp.Attribute{{Key: "mid", Value: "audio"}}},
+				{Attributes: []sdp.Attribute{{Key: "mid", Value: "video"}, {Key: "ice-ufrag", Value: "AbCd"}}},
+			},
+		},
+	}
+
+	ci := ICECandidateInit{Candidate: "candidate:0 1 udp 123456789 192.168.1.1 12345 typ host", SDPMid: new(string)}
+	*ci.SDPMid = "video"
+	c, err := ci.ICECandidate()
+	assert.NoError(t, err)
+
+	data, err := json.Marshal(pc.CandidateInit(c))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"candidate":"candidate:0 1 udp 123456789 192.168.1.1 12345 typ host","sdpMid":"video","sdpMLineIndex":1,"usernameFragment":"AbCd"}`, string(data))
+
+	data, err = json.Marshal(pc.CandidateInit(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"candidate":""}`, string(data))
+}
@@ -0,0 +1,44 @@
+package alohartc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// ICE username fragment and password (see RFC 8839 Section 5.4).
+type iceCredentials struct {
+	ufrag string
+	pwd   string
+}
+
+func newICECredentials() (iceCredentials, error) {
+	// Require 24 and 128 bits of randomness for ufrag and pwd, respectively
+	rnd := make([]byte, 3+16)
+	if _, err := rand.Read(rnd); err != nil {
+		return iceCredentials{}, err
+	}
+
+	// Base64 encode ice-ufrag and ice-pwd
+	return iceCredentials{
+		ufrag: base64.StdEncoding.EncodeToString(rnd[0:3]),
+		pwd:   base64.StdEncoding.EncodeToString(rnd[3:]),
+	}, nil
+}
+
+// Return the ICE credentials of an m-line, which may be inherited from the
+// session level.
+func mediaICECredentials(s *sdp.Session, m *sdp.Media) iceCredentials {
+	creds := iceCredentials{
+		ufrag: m.GetAttr("ice-ufrag"),
+		pwd:   m.GetAttr("ice-pwd"),
+	}
+	if creds.ufrag == "" {
+		creds.ufrag = s.GetAttr("ice-ufrag")
+	}
+	if creds.pwd == "" {
+		creds.pwd = s.GetAttr("ice-pwd")
+	}
+	return creds
+}
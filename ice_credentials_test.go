@@ -0,0 +1,32 @@
+package alohartc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+func TestMediaICECredentials(t *testing.T) {
+	s := sdp.Session{
+		Attributes: []sdp.Attribute{
+			{Key: "ice-ufrag", Value: "sess"},
+			{Key: "ice-pwd", Value: "sessionpassword"},
+		},
+		Media: []sdp.Media{
+			{},
+			{Attributes: []sdp.Attribute{
+				{Key: "ice-ufrag", Value: "med"},
+				{Key: "ice-pwd", Value: "mediapassword"},
+			}},
+		},
+	}
+	assert.Equal(t, iceCredentials{"sess", "sessionpassword"}, mediaICECredentials(&s, &s.Media[0]))
+	assert.Equal(t, iceCredentials{"med", "mediapassword"}, mediaICECredentials(&s, &s.Media[1]))
+
+	creds, err := newICECredentials()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(creds.ufrag))
+	assert.Equal(t, 24, len(creds.pwd))
+}
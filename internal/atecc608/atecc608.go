@@ -0,0 +1,305 @@
+// +build atecc608 !production
+// +build linux
+
+// Package atecc608 signs with a private key held in a Microchip ATECC608
+// secure element on an I2C bus, so that a device's DTLS identity cannot be
+// copied off it. The key slot must be configured for ECDSA P-256 signing of
+// external messages.
+package atecc608
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 7-bit I2C address of an unconfigured ATECC608.
+const address = 0x60
+
+// Word addresses, i.e. the first byte written in each transaction.
+const (
+	wordSleep   = 0x01
+	wordIdle    = 0x02
+	wordCommand = 0x03
+)
+
+// Command opcodes and modes.
+const (
+	opNonce  = 0x16
+	opGenKey = 0x40
+	opSign   = 0x41
+
+	nonceModePassThrough = 0x03
+	genKeyModePublic     = 0x00
+	signModeExternal     = 0x80
+)
+
+// Maximum command execution times, with some margin over the datasheet.
+const (
+	nonceTime  = 20 * time.Millisecond
+	genKeyTime = 150 * time.Millisecond
+	signTime   = 150 * time.Millisecond
+)
+
+// Wake-to-data delay (tWHI), and the status after a successful wake.
+const (
+	wakeDelay  = 1500 * time.Microsecond
+	statusWake = 0x11
+)
+
+// ioctl request to set the address of an I2C device.
+const i2cSlave = 0x0703
+
+var (
+	errWake       = errors.New("atecc608: device did not wake")
+	errCRC        = errors.New("atecc608: bad CRC in response")
+	errResponse   = errors.New("atecc608: malformed response")
+	errDigestSize = errors.New("atecc608: digest must be 32 bytes")
+)
+
+// Device is a crypto.Signer for the private key in one slot of an ATECC608.
+type Device struct {
+	sync.Mutex
+	fd   int
+	slot uint16
+	pub  *ecdsa.PublicKey
+}
+
+// Open opens the ATECC608 on the I2C bus with device file bus (e.g.
+// /dev/i2c-1), and reads the public key of the private key in slot. The bus
+// must run at 100 kHz or slower, for the wake sequence to hold SDA low long
+// enough.
+func Open(bus string, slot int) (*Device, error) {
+	fd, err := unix.Open(bus, unix.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &Device{fd: fd, slot: uint16(slot)}
+
+	if d.pub, err = d.publicKey(); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Close puts the device to sleep and closes the bus.
+func (d *Device) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.wake() == nil {
+		d.write([]byte{wordSleep})
+	}
+	return unix.Close(d.fd)
+}
+
+// Public returns the public key of the device's private key.
+func (d *Device) Public() crypto.PublicKey {
+	return d.pub
+}
+
+// Compute the public key of the private key in d.slot.
+func (d *Device) publicKey() (*ecdsa.PublicKey, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.wake(); err != nil {
+		return nil, err
+	}
+	defer d.idle()
+
+	resp, err := d.execute(opGenKey, genKeyModePublic, d.slot, nil, genKeyTime)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 64 {
+		return nil, errResponse
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(resp[:32]),
+		Y:     new(big.Int).SetBytes(resp[32:]),
+	}, nil
+}
+
+// Sign signs a SHA-256 digest with the device's private key, returning an
+// ASN.1 encoded ECDSA signature. The rand argument is unused, since the device
+// generates its own randomness.
+func (d *Device) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if len(digest) != 32 {
+		return nil, errDigestSize
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.wake(); err != nil {
+		return nil, err
+	}
+	defer d.idle()
+
+	// Load the digest into TempKey, then sign it.
+	if _, err := d.execute(opNonce, nonceModePassThrough, 0, digest, nonceTime); err != nil {
+		return nil, err
+	}
+	resp, err := d.execute(opSign, signModeExternal, d.slot, nil, signTime)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) != 64 {
+		return nil, errResponse
+	}
+
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		new(big.Int).SetBytes(resp[:32]),
+		new(big.Int).SetBytes(resp[32:]),
+	})
+}
+
+// Wake the device by holding SDA low, i.e. writing a zero byte to address 0,
+// which no device acknowledges.
+func (d *Device) wake() error {
+	if err := d.setAddress(0); err != nil {
+		return err
+	}
+	d.write([]byte{0})
+	if err := d.setAddress(address); err != nil {
+		return err
+	}
+	time.Sleep(wakeDelay)
+
+	resp, err := d.read()
+	if err != nil {
+		return err
+	}
+	if len(resp) != 1 || resp[0] != statusWake {
+		return errWake
+	}
+	return nil
+}
+
+// Put the device in idle mode, which keeps TempKey but resets the watchdog.
+func (d *Device) idle() {
+	d.write([]byte{wordIdle})
+}
+
+// Send a command, and wait up to maxTime for its response.
+func (d *Device) execute(op, param1 byte, param2 uint16, data []byte, maxTime time.Duration) ([]byte, error) {
+	// Word address, count, opcode, param1, param2, data, CRC.
+	count := 7 + len(data)
+	pkt := make([]byte, 0, 1+count)
+	pkt = append(pkt, wordCommand, byte(count), op, param1, byte(param2), byte(param2>>8))
+	pkt = append(pkt, data...)
+	c := crc16(pkt[1:])
+	pkt = append(pkt, byte(c), byte(c>>8))
+	if err := d.write(pkt); err != nil {
+		return nil, err
+	}
+
+	// The device doesn't acknowledge reads until the command completes.
+	deadline := time.Now().Add(maxTime)
+	for {
+		time.Sleep(time.Millisecond)
+		resp, err := d.read()
+		if err == nil {
+			if len(resp) == 1 && resp[0] != 0 {
+				return nil, statusError(resp[0])
+			}
+			return resp, nil
+		}
+		if err == errCRC || err == errResponse || time.Now().After(deadline) {
+			return nil, err
+		}
+	}
+}
+
+// Read a response, returning its data without the count and CRC.
+func (d *Device) read() ([]byte, error) {
+	var count [1]byte
+	if _, err := unix.Read(d.fd, count[:]); err != nil {
+		return nil, err
+	}
+	n := int(count[0])
+	if n < 4 {
+		return nil, errResponse
+	}
+
+	buf := make([]byte, n)
+	buf[0] = count[0]
+	if _, err := io.ReadFull(fdReader(d.fd), buf[1:]); err != nil {
+		return nil, err
+	}
+	c := crc16(buf[:n-2])
+	if buf[n-2] != byte(c) || buf[n-1] != byte(c>>8) {
+		return nil, errCRC
+	}
+	return buf[1 : n-2], nil
+}
+
+func (d *Device) write(b []byte) error {
+	_, err := unix.Write(d.fd, b)
+	return err
+}
+
+func (d *Device) setAddress(addr int) error {
+	return unix.IoctlSetInt(d.fd, i2cSlave, addr)
+}
+
+type fdReader int
+
+func (fd fdReader) Read(p []byte) (int, error) {
+	return unix.Read(int(fd), p)
+}
+
+// statusError describes a status byte returned in place of a response.
+type statusError byte
+
+func (s statusError) Error() string {
+	switch s {
+	case 0x01:
+		return "atecc608: verify miscompare"
+	case 0x03:
+		return "atecc608: parse error"
+	case 0x05:
+		return "atecc608: ECC fault"
+	case 0x07:
+		return "atecc608: self test error"
+	case 0x0F:
+		return "atecc608: execution error"
+	case 0xEE:
+		return "atecc608: watchdog about to expire"
+	case 0xFF:
+		return "atecc608: CRC or other communication error"
+	}
+	return fmt.Sprintf("atecc608: status 0x%02x", byte(s))
+}
+
+// CRC-16 with polynomial 0x8005, processing the bits of each byte least
+// significant first, as used by all CryptoAuthentication devices.
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		for mask := byte(1); mask != 0; mask <<= 1 {
+			dataBit := b&mask != 0
+			crcBit := crc>>15 != 0
+			crc <<= 1
+			if dataBit != crcBit {
+				crc ^= 0x8005
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,14 @@
+// +build atecc608 !production
+// +build linux
+
+package atecc608
+
+import "testing"
+
+func TestCRC16(t *testing.T) {
+	// Status response after a successful wake: count 4, status 0x11, CRC.
+	c := crc16([]byte{0x04, 0x11})
+	if byte(c) != 0x33 || byte(c>>8) != 0x43 {
+		t.Errorf("Wrong CRC: 0x%04x", c)
+	}
+}
@@ -0,0 +1,30 @@
+// +build !linux production,!atecc608
+
+package atecc608
+
+import (
+	"crypto"
+	"errors"
+	"io"
+)
+
+var errNotSupported = errors.New("atecc608: support disabled")
+
+// Device is a crypto.Signer for the private key in one slot of an ATECC608.
+type Device struct{}
+
+func Open(bus string, slot int) (*Device, error) {
+	return nil, errNotSupported
+}
+
+func (d *Device) Close() error {
+	return errNotSupported
+}
+
+func (d *Device) Public() crypto.PublicKey {
+	return nil
+}
+
+func (d *Device) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return nil, errNotSupported
+}
@@ -0,0 +1,73 @@
+// Package clock abstracts the passage of time, so that code driven by timers
+// (connectivity checks, RTCP reports, retransmissions) can be tested without
+// waiting for them. Production code uses System; tests use a Fake, which only
+// advances when told to.
+package clock
+
+import (
+	"time"
+)
+
+// A Clock tells the time and runs timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a ticker that sends the time on its channel every d,
+	// as time.NewTicker. Ticks are dropped for slow receivers.
+	NewTicker(d time.Duration) *Ticker
+
+	// AfterFunc calls f in its own goroutine after d, as time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) *Timer
+}
+
+// A Ticker delivers ticks at intervals, like time.Ticker.
+type Ticker struct {
+	C <-chan time.Time
+
+	stop func()
+}
+
+// Stop turns off the ticker. No more ticks are sent after Stop returns.
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// A Timer is a single event, like the time.Timer returned by time.AfterFunc.
+type Timer struct {
+	stop func() bool
+}
+
+// Stop prevents the timer from firing. It returns false if the timer already
+// fired or was stopped.
+func (t *Timer) Stop() bool {
+	return t.stop()
+}
+
+// System is the clock of the operating system, from package time.
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) *Timer {
+	t := time.AfterFunc(d, f)
+	return &Timer{stop: t.Stop}
+}
+
+// Or returns c, or System if c is nil, so that the zero value of a struct with
+// a Clock field uses the system clock.
+func Or(c Clock) Clock {
+	if c == nil {
+		return System
+	}
+	return c
+}
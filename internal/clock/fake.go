@@ -0,0 +1,132 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Fake is a Clock for tests, whose time stands still until Advance is
+// called. Unlike the system clock, it calls AfterFunc functions synchronously
+// from Advance, so their effects are visible as soon as Advance returns.
+type Fake struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	now  time.Time
+
+	// Pending timers and tickers, in no particular order.
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	when time.Time
+
+	// Interval of a ticker, or 0 for a timer.
+	period time.Duration
+
+	fire func(now time.Time)
+}
+
+// NewFake returns a fake clock, set to now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c := make(chan time.Time, 1)
+	t := f.add(d, d, func(now time.Time) {
+		select {
+		case c <- now:
+		default:
+		}
+	})
+	return &Ticker{C: c, stop: func() { f.remove(t) }}
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) *Timer {
+	t := f.add(d, 0, func(time.Time) { fn() })
+	return &Timer{stop: func() bool { return f.remove(t) }}
+}
+
+func (f *Fake) add(d, period time.Duration, fire func(time.Time)) *fakeTimer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{when: f.now.Add(d), period: period, fire: fire}
+	f.timers = append(f.timers, t)
+	f.cond.Broadcast()
+	return t
+}
+
+// Remove a pending timer, returning false if it isn't pending.
+func (f *Fake) remove(t *fakeTimer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, other := range f.timers {
+		if other == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, firing timers and tickers that fall
+// due, in order. A ticker fires once for each interval that elapses (though a
+// receiver that falls behind sees only the latest tick).
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	end := f.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range f.timers {
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		f.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			for i, t := range f.timers {
+				if t == next {
+					f.timers = append(f.timers[:i], f.timers[i+1:]...)
+					break
+				}
+			}
+		}
+
+		// Fire without the lock held, since AfterFunc functions may use the
+		// clock themselves.
+		now := f.now
+		f.mu.Unlock()
+		next.fire(now)
+		f.mu.Lock()
+	}
+	f.now = end
+	f.mu.Unlock()
+}
+
+// WaitForTimers blocks until at least n timers and tickers are pending, e.g.
+// until a goroutine under test has started its tickers, so that advancing the
+// clock is sure to fire them.
+func (f *Fake) WaitForTimers(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
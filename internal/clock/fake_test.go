@@ -0,0 +1,88 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAdvance(t *testing.T) {
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+
+	var fired []time.Duration
+	f.AfterFunc(3*time.Second, func() {
+		fired = append(fired, f.Now().Sub(start))
+	})
+	stopped := f.AfterFunc(time.Second, func() {
+		t.Error("Stopped timer fired")
+	})
+	if !stopped.Stop() {
+		t.Error("Pending timer should stop")
+	}
+
+	ticker := f.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	f.Advance(time.Second)
+	select {
+	case <-ticker.C:
+		t.Error("Ticker fired early")
+	default:
+	}
+
+	f.Advance(2 * time.Second)
+	if len(fired) != 1 || fired[0] != 3*time.Second {
+		t.Errorf("Timer fired at %v, expected 3s", fired)
+	}
+	select {
+	case now := <-ticker.C:
+		if now != start.Add(2*time.Second) {
+			t.Errorf("Tick at %v, expected 2s after start", now.Sub(start))
+		}
+	default:
+		t.Error("Ticker did not fire")
+	}
+	if now := f.Now(); now != start.Add(3*time.Second) {
+		t.Errorf("Clock reads %v, expected 3s after start", now.Sub(start))
+	}
+}
+
+func TestFakeTickerDropsTicks(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	ticker := f.NewTicker(time.Second)
+
+	// Only the first of several ticks fits in the channel.
+	f.Advance(5 * time.Second)
+	if now := <-ticker.C; now != time.Unix(1, 0) {
+		t.Errorf("First tick at %v", now)
+	}
+	select {
+	case <-ticker.C:
+		t.Error("Ticks should have been dropped")
+	default:
+	}
+
+	ticker.Stop()
+	f.Advance(5 * time.Second)
+	select {
+	case <-ticker.C:
+		t.Error("Stopped ticker fired")
+	default:
+	}
+}
+
+func TestFakeWaitForTimers(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	ticks := make(chan time.Time)
+	go func() {
+		ticker := f.NewTicker(time.Second)
+		defer ticker.Stop()
+		ticks <- <-ticker.C
+	}()
+
+	f.WaitForTimers(1)
+	f.Advance(time.Second)
+	if now := <-ticks; now != time.Unix(1, 0) {
+		t.Errorf("Tick at %v", now)
+	}
+}
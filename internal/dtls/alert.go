@@ -143,3 +143,18 @@ func (a *alert) Unmarshal(data []byte) error {
 func (a *alert) String() string {
 	return fmt.Sprintf("Alert %s: %s", a.alertLevel, a.alertDescription)
 }
+
+// An alertError is a handshake error that is reported to the remote with a
+// fatal alert before the connection is torn down.
+type alertError struct {
+	alertDescription alertDescription
+	err              error
+}
+
+func (e *alertError) Error() string {
+	return e.err.Error()
+}
+
+func (e *alertError) Unwrap() error {
+	return e.err
+}
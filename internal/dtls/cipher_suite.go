@@ -60,6 +60,9 @@ func decodeCipherSuites(buf []byte) ([]cipherSuite, error) {
 		return nil, errDTLSPacketInvalidLength
 	}
 	cipherSuitesCount := int(binary.BigEndian.Uint16(buf[0:])) / 2
+	if len(buf) < 2+2*cipherSuitesCount {
+		return nil, errDTLSPacketInvalidLength
+	}
 	rtrn := []cipherSuite{}
 	for i := 0; i < cipherSuitesCount; i++ {
 		id := cipherSuiteID(binary.BigEndian.Uint16(buf[(i*2)+2:]))
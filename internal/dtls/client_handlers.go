@@ -51,7 +51,9 @@ func clientHandshakeHandler(c *Conn) error {
 
 		case *handshakeMessageCertificate:
 			if c.currFlight.get() == flight3 {
-				c.remoteCertificate = h.certificate
+				if err := c.setRemoteCertificate(h.certificate); err != nil {
+					return err
+				}
 			}
 
 		case *handshakeMessageServerKeyExchange:
@@ -127,18 +129,20 @@ func clientHandshakeHandler(c *Conn) error {
 }
 
 func clientFlightHandler(c *Conn) (bool, error) {
+	// Hold the lock while reading the current flight, so that we don't send
+	// a stale flight with state already updated for the next one
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	switch c.currFlight.get() {
 	case flight1:
 		fallthrough
 	case flight3:
-		c.lock.RLock()
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  c.localSequenceNumber,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
 					messageSequence: uint16(c.localSequenceNumber),
 				},
@@ -173,24 +177,17 @@ func clientFlightHandler(c *Conn) (bool, error) {
 					},
 				}},
 		}, false)
-		c.lock.RUnlock()
 	case flight5:
-		// TODO: Better way to end handshake
-		if c.getRemoteEpoch() != 0 {
-			// Handshake is done
-			return true, nil
-		}
-
-		c.lock.RLock()
+		// Keep retransmitting until the server's Finished arrives, which
+		// completes the handshake. Its ChangeCipherSpec alone is not enough,
+		// since the Finished that follows may have been lost.
 		sequenceNumber := c.localSequenceNumber
 		if c.remoteRequestedCertificate {
 			c.internalSend(&recordLayer{
 				recordLayerHeader: recordLayerHeader{
-					sequenceNumber:  c.localSequenceNumber,
 					protocolVersion: protocolVersion1_2,
 				},
 				content: &handshake{
-					// sequenceNumber and messageSequence line up, may need to be re-evaluated
 					handshakeHeader: handshakeHeader{
 						messageSequence: uint16(c.localSequenceNumber),
 					},
@@ -203,11 +200,9 @@ func clientFlightHandler(c *Conn) (bool, error) {
 
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  sequenceNumber,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
 					messageSequence: uint16(sequenceNumber),
 				},
@@ -228,11 +223,9 @@ func clientFlightHandler(c *Conn) (bool, error) {
 
 			c.internalSend(&recordLayer{
 				recordLayerHeader: recordLayerHeader{
-					sequenceNumber:  sequenceNumber,
 					protocolVersion: protocolVersion1_2,
 				},
 				content: &handshake{
-					// sequenceNumber and messageSequence line up, may need to be re-evaluated
 					handshakeHeader: handshakeHeader{
 						messageSequence: uint16(sequenceNumber),
 					},
@@ -247,7 +240,6 @@ func clientFlightHandler(c *Conn) (bool, error) {
 
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  sequenceNumber,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &changeCipherSpec{},
@@ -261,15 +253,12 @@ func clientFlightHandler(c *Conn) (bool, error) {
 			}
 		}
 
-		// TODO: Fix hard-coded epoch & sequenceNumber, taking retransmitting into account.
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
 				epoch:           1,
-				sequenceNumber:  0, // sequenceNumber restarts per epoch
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
 					messageSequence: uint16(sequenceNumber), // KeyExchange + 1
 				},
@@ -277,7 +266,6 @@ func clientFlightHandler(c *Conn) (bool, error) {
 					verifyData: c.localVerifyData,
 				}},
 		}, true)
-		c.lock.RUnlock()
 	default:
 		return false, fmt.Errorf("unhandled flight %s", c.currFlight.get())
 	}
@@ -9,5 +9,24 @@ import (
 // After a Config is passed to a DTLS function it must not be modified.
 type Config struct {
 	Certificate *x509.Certificate
-	PrivateKey  crypto.PrivateKey
+
+	// PrivateKey is the key for Certificate: an *ecdsa.PrivateKey, or any
+	// crypto.Signer with an ECDSA public key, e.g. one backed by a secure
+	// element that never reveals the key itself.
+	PrivateKey crypto.PrivateKey
+
+	// MTU is the largest datagram we will send. Handshake messages that do
+	// not fit (e.g. large certificates) are fragmented. Defaults to 1200. It
+	// must leave room for the record and handshake headers, 25 bytes.
+	MTU int
+
+	// VerifyPeerCertificate, if not nil, is called with the remote
+	// certificate as soon as it arrives. Returning an error aborts the
+	// handshake with a bad_certificate alert. If it is set, a server requests
+	// a certificate from the client, and checks the client's signature with
+	// it (CertificateVerify). Either side fails the handshake with a
+	// no_certificate alert if the other sends no certificate at all.
+	VerifyPeerCertificate func(cert *x509.Certificate) error
 }
+
+const defaultMTU = 1200
@@ -15,8 +15,15 @@ import (
 	"github.com/lanikai/alohartc/internal/logging"
 )
 
-const initialTickerInterval = time.Second
+// Retransmission timer bounds, see https://tools.ietf.org/html/rfc6347#section-4.2.4.1
+const initialRetransmitInterval = time.Second
+const maxRetransmitInterval = 60 * time.Second
+
 const cookieLength = 20
+
+// How many decrypted application data records can wait to be read before
+// further records are dropped.
+const decryptedQueueLength = 32
 const defaultNamedCurve = namedCurveX25519
 
 var invalidKeyingLabels = map[string]bool{
@@ -38,12 +45,16 @@ type Conn struct {
 	fragmentBuffer *fragmentBuffer // out-of-order and missing fragment handling
 	handshakeCache *handshakeCache // caching of handshake messages for verifyData generation
 	decrypted      chan []byte     // Decrypted Application Data, pull by calling `Read`
-	workerTicker   *time.Ticker
+	mtu            int
 
 	isClient                   bool
 	remoteRequestedCertificate bool // Did we get a CertificateRequest
+	remoteCertificateVerified  bool // Did the client's CertificateVerify check out
 	localEpoch, remoteEpoch    atomic.Value
-	localSequenceNumber        uint64 // uint48
+	localSequenceNumber        uint64 // handshake message_seq
+
+	recordSequenceLock    sync.Mutex
+	recordSequenceNumbers []uint64 // next outgoing record sequence number, indexed by epoch
 
 	currFlight                          *flight
 	cipherSuite                         cipherSuite // nil if a cipherSuite hasn't been chosen
@@ -51,9 +62,11 @@ type Conn struct {
 	localRandom, remoteRandom           handshakeRandom
 	localCertificate, remoteCertificate *x509.Certificate
 	localPrivateKey                     crypto.PrivateKey
+	verifyPeerCertificate               func(*x509.Certificate) error
 	localKeypair, remoteKeypair         *namedCurveKeypair
 	cookie                              []byte
 
+	localKeySignature      []byte // cache ServerKeyExchange signature
 	localCertificateVerify []byte // cache CertificateVerify
 	localVerifyData        []byte // cached VerifyData
 
@@ -93,12 +106,18 @@ func createConn(nextConn net.Conn, flightHandler flightHandler, handshakeMessage
 		flightHandler:           flightHandler,
 		localCertificate:        config.Certificate,
 		localPrivateKey:         config.PrivateKey,
+		verifyPeerCertificate:   config.VerifyPeerCertificate,
 		namedCurve:              defaultNamedCurve,
+		mtu:                     config.MTU,
 
-		decrypted:          make(chan []byte),
-		workerTicker:       time.NewTicker(initialTickerInterval),
+		decrypted:          make(chan []byte, decryptedQueueLength),
 		handshakeCompleted: make(chan bool),
 	}
+	if c.mtu <= 0 {
+		c.mtu = defaultMTU
+	} else if c.mtu <= recordLayerHeaderSize+handshakeHeaderLength {
+		return nil, errInvalidMTU
+	}
 
 	var zeroEpoch uint16
 	c.localEpoch.Store(zeroEpoch)
@@ -135,6 +154,9 @@ func createConn(nextConn net.Conn, flightHandler flightHandler, handshakeMessage
 			}
 
 			if err := c.handleIncoming(b[:i]); err != nil {
+				if e, ok := err.(*alertError); ok {
+					c.notify(alertLevelFatal, e.alertDescription)
+				}
 				c.stopWithError(err)
 				return
 			}
@@ -142,6 +164,10 @@ func createConn(nextConn net.Conn, flightHandler flightHandler, handshakeMessage
 	}()
 
 	<-c.handshakeCompleted
+	if c.getConnErr() == nil && c.verifyPeerCertificate != nil && c.RemoteCertificate() == nil {
+		c.notify(alertLevelFatal, alertNoCertificate)
+		c.stopWithError(errNoRemoteCertificate)
+	}
 	return c, c.getConnErr()
 }
 
@@ -195,14 +221,12 @@ func (c *Conn) Write(p []byte) (int, error) {
 	c.internalSend(&recordLayer{
 		recordLayerHeader: recordLayerHeader{
 			epoch:           c.getLocalEpoch(),
-			sequenceNumber:  c.localSequenceNumber,
 			protocolVersion: protocolVersion1_2,
 		},
 		content: &applicationData{
 			data: p,
 		},
 	}, true)
-	c.localSequenceNumber++
 
 	return len(p), nil
 }
@@ -257,29 +281,67 @@ func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([
 	return prfPHash(c.masterSecret, seed, length, c.cipherSuite.hashFunc())
 }
 
+// Send a record, assigning it the next sequence number for its epoch.
+// Handshake messages larger than the MTU are split across several records.
 func (c *Conn) internalSend(pkt *recordLayer, shouldEncrypt bool) {
-	raw, err := pkt.Marshal()
+	content, err := pkt.content.Marshal()
 	if err != nil {
 		c.stopWithError(err)
 		return
 	}
 
+	payloads := [][]byte{content}
 	if h, ok := pkt.content.(*handshake); ok {
-		c.handshakeCache.push(raw[recordLayerHeaderSize:], pkt.recordLayerHeader.epoch,
+		c.handshakeCache.push(content, pkt.recordLayerHeader.epoch,
 			h.handshakeHeader.messageSequence /* isLocal */, true, c.currFlight.get())
+
+		payloads, err = fragmentHandshake(content, c.mtu-recordLayerHeaderSize-handshakeHeaderLength)
+		if err != nil {
+			c.stopWithError(err)
+			return
+		}
 	}
 
-	if shouldEncrypt {
-		raw, err = c.cipherSuite.encrypt(pkt, raw)
+	for _, payload := range payloads {
+		pkt.recordLayerHeader.contentType = pkt.content.contentType()
+		pkt.recordLayerHeader.contentLen = uint16(len(payload))
+		pkt.recordLayerHeader.sequenceNumber = c.nextRecordSequenceNumber(pkt.recordLayerHeader.epoch)
+
+		raw, err := pkt.recordLayerHeader.Marshal()
 		if err != nil {
 			c.stopWithError(err)
 			return
 		}
+		raw = append(raw, payload...)
+
+		if shouldEncrypt {
+			raw, err = c.cipherSuite.encrypt(pkt, raw)
+			if err != nil {
+				c.stopWithError(err)
+				return
+			}
+		}
+
+		if _, err := c.nextConn.Write(raw); err != nil {
+			c.stopWithError(err)
+			return
+		}
 	}
+}
 
-	if _, err := c.nextConn.Write(raw); err != nil {
-		c.stopWithError(err)
+// Every record we send, including retransmissions and fragments, needs a
+// distinct sequence number, or the remote's replay protection discards it.
+// https://tools.ietf.org/html/rfc6347#section-4.1
+func (c *Conn) nextRecordSequenceNumber(epoch uint16) uint64 {
+	c.recordSequenceLock.Lock()
+	defer c.recordSequenceLock.Unlock()
+
+	for int(epoch) >= len(c.recordSequenceNumbers) {
+		c.recordSequenceNumbers = append(c.recordSequenceNumbers, 0)
 	}
+	seq := c.recordSequenceNumbers[epoch]
+	c.recordSequenceNumbers[epoch]++
+	return seq
 }
 
 func (c *Conn) handleIncoming(buf []byte) error {
@@ -309,6 +371,12 @@ func (c *Conn) handleIncomingPacket(buf []byte) error {
 		log.Info("handleIncoming: old epoch, dropping packet")
 		return nil
 	}
+	if h.epoch > c.getRemoteEpoch() {
+		// We can't decrypt this until the remote's ChangeCipherSpec arrives,
+		// which must have been lost or reordered. It will be retransmitted.
+		log.Info("handleIncoming: future epoch, dropping packet")
+		return nil
+	}
 
 	if c.getRemoteEpoch() != 0 {
 		if c.cipherSuite == nil {
@@ -328,6 +396,9 @@ func (c *Conn) handleIncomingPacket(buf []byte) error {
 	if err != nil {
 		return err
 	} else if pushSuccess {
+		if c.fragmentBuffer.popRetransmitted() {
+			return c.handleRetransmittedFlight()
+		}
 		// This was a fragmented buffer, therefore a handshake
 		return c.handshakeMessageHandler(c)
 	}
@@ -344,32 +415,76 @@ func (c *Conn) handleIncomingPacket(buf []byte) error {
 		}
 		return fmt.Errorf("alert: %v", content)
 	case *changeCipherSpec:
+		// Keys are derived from the handshake messages preceding
+		// ChangeCipherSpec. If one of those was lost, wait for the remote to
+		// retransmit the whole flight.
+		if c.masterSecret == nil {
+			log.Info("handleIncoming: ChangeCipherSpec before key exchange, dropping packet")
+			return nil
+		}
 		c.setRemoteEpoch(c.getRemoteEpoch() + 1)
 	case *applicationData:
-		c.decrypted <- content.data
+		// Like any datagram, application data may be lost. Drop it rather
+		// than stall the handshake and alert processing behind a slow reader.
+		select {
+		case c.decrypted <- content.data:
+		default:
+			log.Debug("handleIncoming: application data not read, dropping packet")
+		}
 	default:
 		return fmt.Errorf("unhandled contentType %d", content.contentType())
 	}
 	return nil
 }
 
+// Check the remote certificate against Config.VerifyPeerCertificate, if set.
+// Callers must hold c.lock.
+func (c *Conn) setRemoteCertificate(cert *x509.Certificate) error {
+	if c.verifyPeerCertificate != nil {
+		if err := c.verifyPeerCertificate(cert); err != nil {
+			return &alertError{alertBadCertificate, err}
+		}
+	}
+	c.remoteCertificate = cert
+	return nil
+}
+
+// Send an alert in the current epoch, so that an alert aborting the handshake
+// goes out in the clear, where the remote can read it.
 func (c *Conn) notify(level alertLevel, desc alertDescription) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	epoch := c.getLocalEpoch()
 	c.internalSend(&recordLayer{
 		recordLayerHeader: recordLayerHeader{
-			epoch:           c.getLocalEpoch(),
-			sequenceNumber:  c.localSequenceNumber,
+			epoch:           epoch,
 			protocolVersion: protocolVersion1_2,
 		},
 		content: &alert{
 			alertLevel:       level,
 			alertDescription: desc,
 		},
-	}, true)
+	}, epoch > 0)
+}
+
+// The remote retransmitted a flight we already processed, so our reply was
+// lost. While the handshake is in progress the retransmit timer takes care of
+// that, but the server's final flight is only ever resent in response to the
+// client's retransmission.
+func (c *Conn) handleRetransmittedFlight() error {
+	if c.isClient || c.currFlight.get() != flight6 {
+		return nil
+	}
 
-	c.localSequenceNumber++
+	// Wait until the first transmission is out of the way
+	select {
+	case <-c.handshakeCompleted:
+	default:
+		return nil
+	}
+	_, err := c.flightHandler(c)
+	return err
 }
 
 func (c *Conn) signalHandshakeComplete() {
@@ -380,22 +495,17 @@ func (c *Conn) signalHandshakeComplete() {
 	}
 }
 
+// Send the current flight, and retransmit it with exponential backoff until
+// the remote answers and we move on to the next flight.
+// https://tools.ietf.org/html/rfc6347#section-4.2.4
 func (c *Conn) startHandshakeOutbound() {
 	go func() {
-		for {
-			var (
-				isFinished bool
-				err        error
-			)
-			select {
-			case <-c.handshakeCompleted:
-				return
-			case <-c.workerTicker.C:
-				isFinished, err = c.flightHandler(c)
-			case <-c.currFlight.workerTrigger:
-				isFinished, err = c.flightHandler(c)
-			}
+		interval := initialRetransmitInterval
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
 
+		for {
+			isFinished, err := c.flightHandler(c)
 			switch {
 			case err != nil:
 				c.stopWithError(err)
@@ -405,6 +515,26 @@ func (c *Conn) startHandshakeOutbound() {
 			case isFinished:
 				return // Handshake is complete
 			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(interval)
+
+			select {
+			case <-c.handshakeCompleted:
+				return
+			case <-timer.C:
+				interval *= 2
+				if interval > maxRetransmitInterval {
+					interval = maxRetransmitInterval
+				}
+			case <-c.currFlight.workerTrigger:
+				interval = initialRetransmitInterval
+			}
 		}
 	}()
 }
@@ -419,8 +549,6 @@ func (c *Conn) stopWithError(err error) {
 
 	c.connErr.Store(struct{ error }{err})
 
-	c.workerTicker.Stop()
-
 	c.signalHandshakeComplete()
 }
 
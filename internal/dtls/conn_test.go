@@ -0,0 +1,274 @@
+package dtls
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Randomly drops a fraction of the datagrams written to it.
+type lossyConn struct {
+	net.Conn
+	loss float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newLossyConn(conn net.Conn, loss float64, seed int64) *lossyConn {
+	return &lossyConn{Conn: conn, loss: loss, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (c *lossyConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	drop := c.rng.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func TestHandshakeLossyLink(t *testing.T) {
+	cert, key, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Small enough to force the Certificate message to be fragmented
+	config := &Config{Certificate: cert, PrivateKey: key, MTU: 150}
+
+	ca, cb := net.Pipe()
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	clientResult := make(chan result, 1)
+	serverResult := make(chan result, 1)
+	go func() {
+		conn, err := Client(newLossyConn(ca, 0.1, 1), config)
+		clientResult <- result{conn, err}
+	}()
+	go func() {
+		conn, err := Server(newLossyConn(cb, 0.1, 2), config)
+		serverResult <- result{conn, err}
+	}()
+
+	var client, server *Conn
+	for client == nil || server == nil {
+		select {
+		case r := <-clientResult:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			client = r.conn
+		case r := <-serverResult:
+			if r.err != nil {
+				t.Fatal(r.err)
+			}
+			server = r.conn
+		case <-time.After(30 * time.Second):
+			t.Fatal("handshake timed out")
+		}
+	}
+	defer client.Close()
+	defer server.Close()
+
+	if remote := client.RemoteCertificate(); remote == nil || !remote.Equal(cert) {
+		t.Error("client did not receive the server certificate")
+	}
+}
+
+func TestFragmentHandshake(t *testing.T) {
+	raw, err := (&handshake{
+		handshakeHeader:  handshakeHeader{messageSequence: 2},
+		handshakeMessage: &handshakeMessageFinished{verifyData: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragments, err := fragmentHandshake(raw, 5)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(fragments) != 3 {
+		t.Fatalf("fragmentHandshake: got %d fragments, want 3", len(fragments))
+	}
+
+	// Push them out of order, along with a duplicate
+	f := newFragmentBuffer()
+	for _, i := range []int{2, 0, 2, 1} {
+		header, err := (&recordLayerHeader{contentType: contentTypeHandshake, protocolVersion: protocolVersion1_2}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := f.push(append(header, fragments[i]...)); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("fragmentBuffer didn't accept fragment")
+		}
+	}
+	f.currentMessageSequenceNumber = 2
+
+	out, _ := f.pop()
+	if string(out) != string(raw) {
+		t.Errorf("fragmentHandshake round trip: got % 02x, want % 02x", out, raw)
+	}
+
+	// No room for any of the body must not loop forever
+	if _, err := fragmentHandshake(raw, 0); err != errInvalidMTU {
+		t.Errorf("fragmentHandshake with no room: got %v, want %v", err, errInvalidMTU)
+	}
+}
+
+func TestInvalidMTU(t *testing.T) {
+	cert, key, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, cb := net.Pipe()
+	defer ca.Close()
+	defer cb.Close()
+
+	for _, mtu := range []int{1, recordLayerHeaderSize + handshakeHeaderLength} {
+		config := &Config{Certificate: cert, PrivateKey: key, MTU: mtu}
+		if _, err := Client(ca, config); err != errInvalidMTU {
+			t.Errorf("MTU %d: got %v, want %v", mtu, err, errInvalidMTU)
+		}
+	}
+}
+
+func TestVerifyPeerCertificate(t *testing.T) {
+	serverCert, serverKey, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, _, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []*x509.Certificate{serverCert, otherCert} {
+		fingerprint, err := Fingerprint(expected, HashAlgorithmSHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig := &Config{
+			Certificate: clientCert,
+			PrivateKey:  clientKey,
+			VerifyPeerCertificate: func(cert *x509.Certificate) error {
+				return VerifyFingerprint(cert, "sha-256 "+strings.ToUpper(fingerprint))
+			},
+		}
+		serverConfig := &Config{Certificate: serverCert, PrivateKey: serverKey}
+
+		ca, cb := net.Pipe()
+		serverErr := make(chan error, 1)
+		go func() {
+			conn, err := Server(cb, serverConfig)
+			if err == nil {
+				conn.Close()
+			}
+			serverErr <- err
+		}()
+
+		conn, err := Client(ca, clientConfig)
+		if expected == serverCert {
+			if err != nil {
+				t.Fatalf("handshake with matching fingerprint failed: %v", err)
+			}
+			conn.Close()
+			<-serverErr
+			continue
+		}
+
+		if !errors.Is(err, errFingerprintMismatch) {
+			t.Errorf("expected fingerprint mismatch, got %v", err)
+		}
+		select {
+		case err := <-serverErr:
+			if err == nil {
+				t.Error("server completed handshake with rejected certificate")
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("server did not abort handshake")
+		}
+	}
+}
+
+// A server with VerifyPeerCertificate requests the client's certificate, and
+// checks it along with the client's proof of holding its key.
+func TestServerVerifiesClientCertificate(t *testing.T) {
+	serverCert, serverKey, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, _, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []*x509.Certificate{clientCert, otherCert} {
+		fingerprint, err := Fingerprint(expected, HashAlgorithmSHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var verified *x509.Certificate
+		serverConfig := &Config{
+			Certificate: serverCert,
+			PrivateKey:  serverKey,
+			VerifyPeerCertificate: func(cert *x509.Certificate) error {
+				verified = cert
+				return VerifyFingerprint(cert, "sha-256 "+strings.ToUpper(fingerprint))
+			},
+		}
+		clientConfig := &Config{Certificate: clientCert, PrivateKey: clientKey}
+
+		ca, cb := net.Pipe()
+		clientErr := make(chan error, 1)
+		go func() {
+			conn, err := Client(ca, clientConfig)
+			if err == nil {
+				conn.Close()
+			}
+			clientErr <- err
+		}()
+
+		conn, err := Server(cb, serverConfig)
+		if expected == clientCert {
+			if err != nil {
+				t.Fatalf("handshake with matching fingerprint failed: %v", err)
+			}
+			if verified == nil || !verified.Equal(clientCert) {
+				t.Error("client certificate not verified")
+			}
+			conn.Close()
+			<-clientErr
+			continue
+		}
+
+		if !errors.Is(err, errFingerprintMismatch) {
+			t.Errorf("expected fingerprint mismatch, got %v", err)
+		}
+		select {
+		case err := <-clientErr:
+			if err == nil {
+				t.Error("client completed handshake with rejected certificate")
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("client did not abort handshake")
+		}
+	}
+}
@@ -42,6 +42,9 @@ func generateKeySignature(clientRandom, serverRandom, publicKey []byte, namedCur
 		return p.Sign(rand.Reader, hashed, crypto.SHA256)
 	case *rsa.PrivateKey:
 		return p.Sign(rand.Reader, hashed, crypto.SHA256)
+	case crypto.Signer:
+		// An opaque key, e.g. in a secure element.
+		return p.Sign(rand.Reader, hashed, crypto.SHA256)
 	}
 
 	return nil, errKeySignatureGenerateUnimplemented
@@ -75,6 +78,13 @@ func verifyKeySignature(hash, remoteKeySignature []byte, certificate *x509.Certi
 	return errKeySignatureVerifyUnimplemented
 }
 
+// Check the client's CertificateVerify signature over the handshake messages
+// that preceded it, using the public key of its certificate.
+// https://tools.ietf.org/html/rfc5246#section-7.4.8
+func verifyCertificateVerify(handshakeBodies []byte, hashAlgorithm HashAlgorithm, signature []byte, certificate *x509.Certificate) error {
+	return verifyKeySignature(hashAlgorithm.digest(handshakeBodies), signature, certificate, hashAlgorithm)
+}
+
 // If the server has sent a CertificateRequest message, the client MUST send the Certificate
 // message.  The ClientKeyExchange message is now sent, and the content
 // of that message will depend on the public key algorithm selected
@@ -95,6 +105,9 @@ func generateCertificateVerify(handshakeBodies []byte, privateKey crypto.Private
 		return p.Sign(rand.Reader, hashed, crypto.SHA256)
 	case *rsa.PrivateKey:
 		return p.Sign(rand.Reader, hashed, crypto.SHA256)
+	case crypto.Signer:
+		// An opaque key, e.g. in a secure element.
+		return p.Sign(rand.Reader, hashed, crypto.SHA256)
 	}
 
 	return nil, errInvalidSignatureAlgorithm
@@ -2,6 +2,10 @@ package dtls
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
 	"testing"
@@ -68,3 +72,32 @@ func TestGenerateKeySignature(t *testing.T) {
 		t.Errorf("Signature generation failed \nexp % 02x \nactual % 02x ", expectedSignature, signature)
 	}
 }
+
+// Hides the concrete key type, like a key in a secure element.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestGenerateKeySignatureSigner(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := opaqueSigner{key}
+	cert, err := SelfSign(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientRandom := make([]byte, 32)
+	serverRandom := make([]byte, 32)
+	publicKey := make([]byte, 32)
+	signature, err := generateKeySignature(clientRandom, serverRandom, publicKey, namedCurveX25519, signer, HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := valueKeySignature(clientRandom, serverRandom, publicKey, namedCurveX25519, HashAlgorithmSHA256)
+	if err := verifyKeySignature(hash, signature, cert, HashAlgorithmSHA256); err != nil {
+		t.Error(err)
+	}
+}
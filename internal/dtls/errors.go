@@ -8,6 +8,7 @@ var (
 
 	errBufferTooSmall                    = errors.New("dtls: buffer is too small")
 	errCertificateUnset                  = errors.New("dtls: handshakeMessageCertificate can not be marshalled without a certificate")
+	errCertificateVerifyMissing          = errors.New("dtls: client sent a certificate without CertificateVerify")
 	errCipherSuiteNoIntersection         = errors.New("dtls: Client+Server do not support any shared cipher suites")
 	errCipherSuiteUnset                  = errors.New("dtls: server hello can not be created without a cipher suite")
 	errCompressionmethodUnset            = errors.New("dtls: server hello can not be created without a compression method")
@@ -15,6 +16,7 @@ var (
 	errCookieMismatch                    = errors.New("dtls: Client+Server cookie does not match")
 	errCookieTooLong                     = errors.New("dtls: cookie must not be longer then 255 bytes")
 	errDTLSPacketInvalidLength           = errors.New("dtls: packet is too short")
+	errFingerprintMismatch               = errors.New("dtls: remote certificate does not match fingerprint")
 	errHandshakeInProgress               = errors.New("dtls: Handshake is in progress")
 	errHandshakeMessageUnset             = errors.New("dtls: handshake message unset, unable to marshal")
 	errInvalidCipherSpec                 = errors.New("dtls: cipher spec invalid")
@@ -23,9 +25,11 @@ var (
 	errInvalidContentType                = errors.New("dtls: invalid content type")
 	errInvalidECDSASignature             = errors.New("dtls: ECDSA signature contained zero or negative values")
 	errInvalidEllipticCurveType          = errors.New("dtls: invalid or unknown elliptic curve type")
+	errInvalidFingerprint                = errors.New("dtls: invalid fingerprint")
 	errInvalidExtensionType              = errors.New("dtls: invalid extension type")
 	errInvalidHashAlgorithm              = errors.New("dtls: invalid hash algorithm")
 	errInvalidMAC                        = errors.New("dtls: invalid mac")
+	errInvalidMTU                        = errors.New("dtls: MTU is too small for a handshake fragment")
 	errInvalidNamedCurve                 = errors.New("dtls: invalid named curve")
 	errInvalidPrivateKey                 = errors.New("dtls: invalid private key type")
 	errInvalidSignatureAlgorithm         = errors.New("dtls: invalid signature algorithm")
@@ -34,6 +38,7 @@ var (
 	errKeySignatureVerifyUnimplemented   = errors.New("dtls: Unable to verify key signature, unimplemented")
 	errLengthMismatch                    = errors.New("dtls: data length and declared length do not match")
 	errNilNextConn                       = errors.New("dtls: Conn can not be created with a nil nextConn")
+	errNoRemoteCertificate               = errors.New("dtls: remote did not send a certificate")
 	errNotEnoughRoomForNonce             = errors.New("dtls: Buffer not long enough to contain nonce")
 	errNotImplemented                    = errors.New("dtls: feature has not been implemented yet")
 	errReservedExportKeyingMaterial      = errors.New("dtls: ExportKeyingMaterial can not be used with a reserved label")
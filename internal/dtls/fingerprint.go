@@ -4,6 +4,7 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 // Fingerprint creates a fingerprint for a certificate using the specified hash algorithm
@@ -31,3 +32,24 @@ func Fingerprint(cert *x509.Certificate, algo HashAlgorithm) (string, error) {
 
 	return string(res), nil
 }
+
+// VerifyFingerprint checks that cert matches a fingerprint in the format of an
+// SDP a=fingerprint attribute, e.g. "sha-256 AB:CD:...". See RFC 8122 section 5.
+func VerifyFingerprint(cert *x509.Certificate, fingerprint string) error {
+	fields := strings.Fields(fingerprint)
+	if len(fields) != 2 {
+		return errInvalidFingerprint
+	}
+	algo, err := HashAlgorithmString(strings.ToLower(fields[0]))
+	if err != nil {
+		return err
+	}
+	actual, err := Fingerprint(cert, algo)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, fields[1]) {
+		return fmt.Errorf("%w: expected %s, got %s %s", errFingerprintMismatch, fingerprint, fields[0], strings.ToUpper(actual))
+	}
+	return nil
+}
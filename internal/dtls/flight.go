@@ -79,7 +79,9 @@ func newFlight(isClient bool) *flight {
 	if isClient {
 		val = flight1
 	}
-	return &flight{val: val, workerTrigger: make(chan struct{})}
+	// Buffered so that a transition made while the current flight is being
+	// sent is not lost
+	return &flight{val: val, workerTrigger: make(chan struct{}, 1)}
 }
 
 func (f *flight) get() flightVal {
@@ -12,6 +12,9 @@ type fragmentBuffer struct {
 
 	currentEpoch                 uint16
 	currentMessageSequenceNumber uint16
+
+	// Set when the remote retransmitted a message we have already popped
+	retransmitted bool
 }
 
 func newFragmentBuffer() *fragmentBuffer {
@@ -45,7 +48,15 @@ func (f *fragmentBuffer) push(buf []byte) (bool, error) {
 		f.cache = map[uint16][]*fragment{}
 		f.currentEpoch = frag.recordLayerHeader.epoch
 	} else if f.currentEpoch > frag.recordLayerHeader.epoch {
-		return false, nil
+		return true, nil
+	}
+
+	// A message we have already handled means the remote is retransmitting
+	// its last flight, most likely because our reply was lost.
+	// https://tools.ietf.org/html/rfc6347#section-4.2.4
+	if frag.handshakeHeader.messageSequence < f.currentMessageSequenceNumber {
+		f.retransmitted = true
+		return true, nil
 	}
 
 	if _, ok := f.cache[frag.handshakeHeader.messageSequence]; !ok {
@@ -59,6 +70,13 @@ func (f *fragmentBuffer) push(buf []byte) (bool, error) {
 	return true, nil
 }
 
+// Reports whether a retransmitted message was pushed since the last call
+func (f *fragmentBuffer) popRetransmitted() bool {
+	r := f.retransmitted
+	f.retransmitted = false
+	return r
+}
+
 func (f *fragmentBuffer) pop() ([]byte, uint16) {
 	frags, ok := f.cache[f.currentMessageSequenceNumber]
 	if !ok {
@@ -73,7 +91,15 @@ func (f *fragmentBuffer) pop() ([]byte, uint16) {
 		for _, f := range frags {
 			if f.handshakeHeader.fragmentOffset == targetOffset {
 				fragmentEnd := (f.handshakeHeader.fragmentOffset + f.handshakeHeader.fragmentLength)
+				if fragmentEnd > f.handshakeHeader.length || int(f.handshakeHeader.fragmentLength) != len(f.data) {
+					// Malformed fragment; wait for a retransmission.
+					continue
+				}
 				if fragmentEnd != f.handshakeHeader.length {
+					if f.handshakeHeader.fragmentLength == 0 {
+						// An empty fragment would never advance.
+						continue
+					}
 					if !appendMessage(fragmentEnd) {
 						return false
 					}
@@ -57,3 +57,29 @@ func TestFragmentBuffer(t *testing.T) {
 		}
 	}
 }
+
+func TestFragmentBufferMalformed(t *testing.T) {
+	for _, test := range []struct {
+		Name string
+		In   []byte
+	}{
+		{
+			// Zero-length fragment at offset 0 of a 15-byte message.
+			Name: "Empty Fragment",
+			In:   []byte{0x16, 0xfe, 0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0b, 0x00, 0x00, 0x0F, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			// Fragment claims 5 bytes but extends past the message length.
+			Name: "Fragment Past End",
+			In:   []byte{0x16, 0xfe, 0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x11, 0x0b, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x02, 0x03, 0x04},
+		},
+	} {
+		fragmentBuffer := newFragmentBuffer()
+		if _, err := fragmentBuffer.push(test.In); err != nil {
+			continue
+		}
+		if out, _ := fragmentBuffer.pop(); out != nil {
+			t.Errorf("fragmentBuffer '%s' popped malformed message % 02x", test.Name, out)
+		}
+	}
+}
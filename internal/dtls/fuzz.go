@@ -0,0 +1,37 @@
+// +build gofuzz
+
+package dtls
+
+// Fuzz is the entry point for go-fuzz. See the README for usage. Like
+// Conn.handleIncoming, it splits a datagram into records and reassembles
+// handshake messages from fragments, but skips decryption. The corpus in
+// testdata/fuzz/corpus holds the datagrams of a complete handshake.
+func Fuzz(data []byte) int {
+	pkts, err := unpackDatagram(data)
+	if err != nil {
+		return 0
+	}
+
+	interesting := 0
+	fragments := newFragmentBuffer()
+	for _, pkt := range pkts {
+		r := &recordLayer{}
+		if err := r.Unmarshal(pkt); err == nil {
+			interesting = 1
+		}
+		if _, err := fragments.push(pkt); err != nil {
+			return 0
+		}
+	}
+	for {
+		out, _ := fragments.pop()
+		if out == nil {
+			break
+		}
+		h := &handshake{}
+		if err := h.Unmarshal(out); err == nil {
+			interesting = 1
+		}
+	}
+	return interesting
+}
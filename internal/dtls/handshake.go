@@ -95,6 +95,8 @@ func (h *handshake) Unmarshal(data []byte) error {
 		h.handshakeMessage = &handshakeMessageCertificateRequest{}
 	case handshakeTypeServerHelloDone:
 		h.handshakeMessage = &handshakeMessageServerHelloDone{}
+	case handshakeTypeCertificateVerify:
+		h.handshakeMessage = &handshakeMessageCertificateVerify{}
 	case handshakeTypeClientKeyExchange:
 		h.handshakeMessage = &handshakeMessageClientKeyExchange{}
 	case handshakeTypeFinished:
@@ -104,3 +106,39 @@ func (h *handshake) Unmarshal(data []byte) error {
 	}
 	return h.handshakeMessage.Unmarshal(data[handshakeMessageHeaderLength:])
 }
+
+// Split a marshalled handshake message into fragments carrying at most
+// maxFragmentLength bytes of the message body, each with its own handshake
+// header. Messages that already fit are returned as-is.
+// https://tools.ietf.org/html/rfc6347#section-4.2.3
+func fragmentHandshake(raw []byte, maxFragmentLength int) ([][]byte, error) {
+	h := handshakeHeader{}
+	if err := h.Unmarshal(raw); err != nil {
+		return nil, err
+	}
+
+	if maxFragmentLength <= 0 {
+		return nil, errInvalidMTU
+	}
+	body := raw[handshakeHeaderLength:]
+	if len(body) <= maxFragmentLength {
+		return [][]byte{raw}, nil
+	}
+
+	fragments := [][]byte{}
+	for offset := 0; offset < len(body); offset += maxFragmentLength {
+		end := offset + maxFragmentLength
+		if end > len(body) {
+			end = len(body)
+		}
+
+		h.fragmentOffset = uint32(offset)
+		h.fragmentLength = uint32(end - offset)
+		header, err := h.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, append(header, body[offset:end]...))
+	}
+	return fragments, nil
+}
@@ -4,8 +4,12 @@ import (
 	"crypto/x509"
 )
 
+// https://tools.ietf.org/html/rfc5246#section-7.4.2
 type handshakeMessageCertificate struct {
 	certificate *x509.Certificate
+
+	// Remainder of the chain, each certifying the one preceding it
+	intermediates []*x509.Certificate
 }
 
 func (h handshakeMessageCertificate) handshakeType() handshakeType {
@@ -17,11 +21,15 @@ func (h *handshakeMessageCertificate) Marshal() ([]byte, error) {
 		return nil, errCertificateUnset
 	}
 
-	out := make([]byte, 6)
-	putBigEndianUint24(out, uint32(len(h.certificate.Raw))+3)
-	putBigEndianUint24(out[3:], uint32(len(h.certificate.Raw)))
+	out := make([]byte, 3)
+	for _, cert := range append([]*x509.Certificate{h.certificate}, h.intermediates...) {
+		certLen := make([]byte, 3)
+		putBigEndianUint24(certLen, uint32(len(cert.Raw)))
+		out = append(append(out, certLen...), cert.Raw...)
+	}
+	putBigEndianUint24(out, uint32(len(out)-3))
 
-	return append(out, h.certificate.Raw...), nil
+	return out, nil
 }
 
 func (h *handshakeMessageCertificate) Unmarshal(data []byte) error {
@@ -30,18 +38,34 @@ func (h *handshakeMessageCertificate) Unmarshal(data []byte) error {
 	}
 
 	certificateBodyLen := int(bigEndianUint24(data))
-	certificateLen := int(bigEndianUint24(data[3:]))
 	if certificateBodyLen+3 != len(data) {
 		return errLengthMismatch
-	} else if certificateLen+6 != len(data) {
-		return errLengthMismatch
 	}
 
-	cert, err := x509.ParseCertificate(data[6:])
-	if err != nil {
-		return err
+	var chain []*x509.Certificate
+	for offset := 3; offset < len(data); {
+		if offset+3 > len(data) {
+			return errBufferTooSmall
+		}
+		certificateLen := int(bigEndianUint24(data[offset:]))
+		offset += 3
+		if offset+certificateLen > len(data) {
+			return errLengthMismatch
+		}
+
+		cert, err := x509.ParseCertificate(data[offset : offset+certificateLen])
+		if err != nil {
+			return err
+		}
+		chain = append(chain, cert)
+		offset += certificateLen
+	}
+
+	h.certificate = chain[0]
+	h.intermediates = chain[1:]
+	if len(h.intermediates) == 0 {
+		h.intermediates = nil
 	}
-	h.certificate = cert
 
 	return nil
 }
@@ -63,6 +63,9 @@ func (h *handshakeMessageCertificateRequest) Unmarshal(data []byte) error {
 	}
 	offset += certificateTypesLength
 
+	if offset+2 > len(data) {
+		return errBufferTooSmall
+	}
 	signatureHashAlgorithmsLength := int(binary.BigEndian.Uint16(data[offset:]))
 	offset += 2
 
@@ -70,7 +73,7 @@ func (h *handshakeMessageCertificateRequest) Unmarshal(data []byte) error {
 		return errBufferTooSmall
 	}
 
-	for i := 0; i < signatureHashAlgorithmsLength; i += 2 {
+	for i := 0; i+1 < signatureHashAlgorithmsLength; i += 2 {
 		hash := HashAlgorithm(data[offset+i])
 		signature := signatureAlgorithm(data[offset+i+1])
 
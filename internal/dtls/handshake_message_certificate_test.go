@@ -74,3 +74,33 @@ func TestHandshakeMessageCertificate(t *testing.T) {
 		t.Errorf("handshakeMessageCertificate marshal: got %#v, want %#v", raw, rawCertificate)
 	}
 }
+
+func TestHandshakeMessageCertificateChain(t *testing.T) {
+	leaf, _, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	intermediate, _, err := GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := (&handshakeMessageCertificate{
+		certificate:   leaf,
+		intermediates: []*x509.Certificate{intermediate},
+	}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &handshakeMessageCertificate{}
+	if err := c.Unmarshal(raw); err != nil {
+		t.Fatal(err)
+	}
+	if !c.certificate.Equal(leaf) {
+		t.Error("handshakeMessageCertificate chain: leaf certificate mismatch")
+	}
+	if len(c.intermediates) != 1 || !c.intermediates[0].Equal(intermediate) {
+		t.Errorf("handshakeMessageCertificate chain: got %d intermediates, want 1", len(c.intermediates))
+	}
+}
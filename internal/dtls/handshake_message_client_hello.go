@@ -58,6 +58,9 @@ func (h *handshakeMessageClientHello) Marshal() ([]byte, error) {
 }
 
 func (h *handshakeMessageClientHello) Unmarshal(data []byte) error {
+	if len(data) <= handshakeMessageClientHelloVariableWidthStart {
+		return errBufferTooSmall
+	}
 	h.version.major = data[0]
 	h.version.minor = data[1]
 
@@ -68,9 +71,16 @@ func (h *handshakeMessageClientHello) Unmarshal(data []byte) error {
 	// rest of packet has variable width sections
 	currOffset := handshakeMessageClientHelloVariableWidthStart
 	currOffset += int(data[currOffset]) + 1 // SessionID
+	if currOffset >= len(data) {
+		return errBufferTooSmall
+	}
 
 	currOffset++
-	h.cookie = append([]byte{}, data[currOffset:currOffset+int(data[currOffset-1])]...)
+	cookieLength := int(data[currOffset-1])
+	if currOffset+cookieLength > len(data) {
+		return errBufferTooSmall
+	}
+	h.cookie = append([]byte{}, data[currOffset:currOffset+cookieLength]...)
 	currOffset += len(h.cookie)
 
 	// Cipher Suites
@@ -90,6 +100,10 @@ func (h *handshakeMessageClientHello) Unmarshal(data []byte) error {
 	currOffset += int(data[currOffset]) + 1
 
 	// Extensions
+	if len(data) <= currOffset {
+		h.extensions = []extension{}
+		return nil
+	}
 	extensions, err := decodeExtensions(data[currOffset:])
 	if err != nil {
 		return err
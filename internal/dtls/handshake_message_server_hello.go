@@ -59,6 +59,9 @@ func (h *handshakeMessageServerHello) Marshal() ([]byte, error) {
 }
 
 func (h *handshakeMessageServerHello) Unmarshal(data []byte) error {
+	if len(data) <= handshakeMessageServerHelloVariableWidthStart {
+		return errBufferTooSmall
+	}
 	h.version.major = data[0]
 	h.version.minor = data[1]
 
@@ -68,6 +71,9 @@ func (h *handshakeMessageServerHello) Unmarshal(data []byte) error {
 
 	currOffset := handshakeMessageServerHelloVariableWidthStart
 	currOffset += int(data[currOffset]) + 1 // SessionID
+	if currOffset+3 > len(data) {
+		return errBufferTooSmall
+	}
 
 	if c := cipherSuiteForID(cipherSuiteID(binary.BigEndian.Uint16(data[currOffset:]))); c != nil {
 		h.cipherSuite = c
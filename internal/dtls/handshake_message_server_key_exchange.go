@@ -34,6 +34,9 @@ func (h *handshakeMessageServerKeyExchange) Marshal() ([]byte, error) {
 }
 
 func (h *handshakeMessageServerKeyExchange) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return errBufferTooSmall
+	}
 	if _, ok := ellipticCurveTypes[ellipticCurveType(data[0])]; ok {
 		h.ellipticCurveType = ellipticCurveType(data[0])
 	} else {
@@ -47,7 +50,8 @@ func (h *handshakeMessageServerKeyExchange) Unmarshal(data []byte) error {
 
 	publicKeyLength := int(data[3])
 	offset := 4 + publicKeyLength
-	if len(data) <= publicKeyLength {
+	// Public key, then hash and signature algorithms and signature length.
+	if len(data) < offset+4 {
 		return errBufferTooSmall
 	}
 	h.publicKey = append([]byte{}, data[4:offset]...)
@@ -66,6 +70,9 @@ func (h *handshakeMessageServerKeyExchange) Unmarshal(data []byte) error {
 
 	signatureLength := int(binary.BigEndian.Uint16(data[offset:]))
 	offset += 2
+	if len(data) < offset+signatureLength {
+		return errBufferTooSmall
+	}
 	h.signature = append([]byte{}, data[offset:offset+signatureLength]...)
 	return nil
 }
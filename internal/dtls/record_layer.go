@@ -78,6 +78,9 @@ func unpackDatagram(buf []byte) ([][]byte, error) {
 		}
 
 		pktLen := (recordLayerHeaderSize + int(binary.BigEndian.Uint16(buf[offset+11:])))
+		if offset+pktLen > len(buf) {
+			return nil, errDTLSPacketInvalidLength
+		}
 		out = append(out, buf[offset:offset+pktLen])
 		offset += pktLen
 	}
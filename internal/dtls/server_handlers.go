@@ -68,7 +68,22 @@ func serverHandshakeHandler(c *Conn) error {
 
 		case *handshakeMessageCertificate:
 			if c.currFlight.get() == flight4 {
-				c.remoteCertificate = h.certificate
+				if err := c.setRemoteCertificate(h.certificate); err != nil {
+					return err
+				}
+			}
+
+		case *handshakeMessageCertificateVerify:
+			if c.currFlight.get() == flight4 {
+				if c.remoteCertificate == nil {
+					return &alertError{alertNoCertificate, errNoRemoteCertificate}
+				}
+				// The signature covers every handshake message before this one.
+				handshakeBodies := c.handshakeCache.combinedHandshake(serverExcludeRules(), true)
+				if err := verifyCertificateVerify(handshakeBodies, h.hashAlgorithm, h.signature, c.remoteCertificate); err != nil {
+					return &alertError{alertDecryptError, err}
+				}
+				c.remoteCertificateVerified = true
 			}
 
 		case *handshakeMessageClientKeyExchange:
@@ -101,6 +116,14 @@ func serverHandshakeHandler(c *Conn) error {
 
 		case *handshakeMessageFinished:
 			if c.currFlight.get() == flight4 {
+				// A requested certificate must have arrived, along with proof
+				// that the client holds its private key.
+				if c.verifyPeerCertificate != nil && !c.remoteCertificateVerified {
+					if c.remoteCertificate == nil {
+						return &alertError{alertNoCertificate, errNoRemoteCertificate}
+					}
+					return &alertError{alertHandshakeFailure, errCertificateVerifyMissing}
+				}
 				expectedVerifyData, err := prfVerifyDataClient(c.masterSecret, c.handshakeCache.combinedHandshake(serverExcludeRules(), true), c.cipherSuite.hashFunc())
 				if err != nil {
 					return err
@@ -109,6 +132,9 @@ func serverHandshakeHandler(c *Conn) error {
 				}
 				c.setLocalEpoch(1)
 				c.localSequenceNumber = 5
+				if c.verifyPeerCertificate != nil {
+					c.localSequenceNumber++ // After CertificateRequest
+				}
 				if err := c.currFlight.set(flight6); err != nil {
 					return err
 				}
@@ -123,18 +149,20 @@ func serverHandshakeHandler(c *Conn) error {
 }
 
 func serverFlightHandler(c *Conn) (bool, error) {
+	// Hold the lock while reading the current flight, so that we don't send
+	// a stale flight with state already updated for the next one
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
 	switch c.currFlight.get() {
 	case flight0:
 		// Waiting for ClientHello
 	case flight2:
-		c.lock.RLock()
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  c.localSequenceNumber,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
 					messageSequence: uint16(c.localSequenceNumber),
 				},
@@ -144,17 +172,13 @@ func serverFlightHandler(c *Conn) (bool, error) {
 				},
 			},
 		}, false)
-		c.lock.RUnlock()
 
 	case flight4:
-		c.lock.RLock()
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  c.localSequenceNumber,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
 					messageSequence: uint16(c.localSequenceNumber),
 				},
@@ -179,11 +203,9 @@ func serverFlightHandler(c *Conn) (bool, error) {
 
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  c.localSequenceNumber + 1,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
 					messageSequence: uint16(c.localSequenceNumber + 1),
 				},
@@ -192,27 +214,29 @@ func serverFlightHandler(c *Conn) (bool, error) {
 				}},
 		}, false)
 
-		serverRandom, err := c.localRandom.Marshal()
-		if err != nil {
-			return false, err
-		}
-		clientRandom, err := c.remoteRandom.Marshal()
-		if err != nil {
-			return false, err
-		}
+		// ECDSA signatures are randomized, so sign only once. Otherwise the
+		// client may see a different retransmission than we cached.
+		if len(c.localKeySignature) == 0 {
+			serverRandom, err := c.localRandom.Marshal()
+			if err != nil {
+				return false, err
+			}
+			clientRandom, err := c.remoteRandom.Marshal()
+			if err != nil {
+				return false, err
+			}
 
-		signature, err := generateKeySignature(clientRandom, serverRandom, c.localKeypair.publicKey, c.namedCurve, c.localPrivateKey, HashAlgorithmSHA256)
-		if err != nil {
-			return false, err
+			c.localKeySignature, err = generateKeySignature(clientRandom, serverRandom, c.localKeypair.publicKey, c.namedCurve, c.localPrivateKey, HashAlgorithmSHA256)
+			if err != nil {
+				return false, err
+			}
 		}
 
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  c.localSequenceNumber + 2,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
 					messageSequence: uint16(c.localSequenceNumber + 2),
 				},
@@ -222,33 +246,46 @@ func serverFlightHandler(c *Conn) (bool, error) {
 					publicKey:          c.localKeypair.publicKey,
 					hashAlgorithm:      HashAlgorithmSHA256,
 					signatureAlgorithm: signatureAlgorithmECDSA,
-					signature:          signature,
+					signature:          c.localKeySignature,
 				}},
 		}, false)
 
-		// TODO: CertificateRequest
+		// Ask for the client's certificate, if we are to verify it.
+		sequenceNumber := c.localSequenceNumber + 3
+		if c.verifyPeerCertificate != nil {
+			c.internalSend(&recordLayer{
+				recordLayerHeader: recordLayerHeader{
+					protocolVersion: protocolVersion1_2,
+				},
+				content: &handshake{
+					handshakeHeader: handshakeHeader{
+						messageSequence: uint16(sequenceNumber),
+					},
+					handshakeMessage: &handshakeMessageCertificateRequest{
+						certificateTypes: []clientCertificateType{clientCertificateTypeECDSASign},
+						signatureHashAlgorithms: []signatureHashAlgorithm{
+							{HashAlgorithmSHA256, signatureAlgorithmECDSA},
+						},
+					}},
+			}, false)
+			sequenceNumber++
+		}
 
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  c.localSequenceNumber + 3,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
-					messageSequence: uint16(c.localSequenceNumber + 3),
+					messageSequence: uint16(sequenceNumber),
 				},
 				handshakeMessage: &handshakeMessageServerHelloDone{},
 			},
 		}, false)
 
-		c.lock.RUnlock()
-
 	case flight6:
-		c.lock.RLock()
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
-				sequenceNumber:  c.localSequenceNumber,
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &changeCipherSpec{},
@@ -265,11 +302,9 @@ func serverFlightHandler(c *Conn) (bool, error) {
 		c.internalSend(&recordLayer{
 			recordLayerHeader: recordLayerHeader{
 				epoch:           1,
-				sequenceNumber:  0, // sequenceNumber restarts per epoch
 				protocolVersion: protocolVersion1_2,
 			},
 			content: &handshake{
-				// sequenceNumber and messageSequence line up, may need to be re-evaluated
 				handshakeHeader: handshakeHeader{
 					messageSequence: uint16(c.localSequenceNumber), // KeyExchange + 1
 				},
@@ -278,7 +313,6 @@ func serverFlightHandler(c *Conn) (bool, error) {
 					verifyData: c.localVerifyData,
 				}},
 		}, true)
-		c.lock.RUnlock()
 
 		// TODO: Better way to end handshake
 		c.signalHandshakeComplete()
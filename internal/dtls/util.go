@@ -43,6 +43,17 @@ func GenerateSelfSigned() (*x509.Certificate, crypto.PrivateKey, error) {
 		return nil, nil, err
 	}
 
+	cert, err := SelfSign(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, priv, nil
+}
+
+// SelfSign creates a self-signed certificate for the public key of signer.
+func SelfSign(signer crypto.Signer) (*x509.Certificate, error) {
+
 	origin := make([]byte, 16)
 
 	// Max random value, a 130-bits integer, i.e 2^130 - 1
@@ -51,7 +62,7 @@ func GenerateSelfSigned() (*x509.Certificate, crypto.PrivateKey, error) {
 	maxBigInt.Exp(big.NewInt(2), big.NewInt(130), nil).Sub(maxBigInt, big.NewInt(1))
 	serialNumber, err := rand.Int(rand.Reader, maxBigInt)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	template := x509.Certificate{
@@ -69,17 +80,12 @@ func GenerateSelfSigned() (*x509.Certificate, crypto.PrivateKey, error) {
 		IsCA:                  true,
 	}
 
-	raw, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	raw, err := x509.CreateCertificate(rand.Reader, &template, &template, signer.Public(), signer)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	cert, err := x509.ParseCertificate(raw)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return cert, priv, nil
+	return x509.ParseCertificate(raw)
 }
 
 func max(a, b int) int {
@@ -3,25 +3,34 @@ package ice
 import (
 	"context"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/lanikai/alohartc/internal/ice/mdns"
+	"github.com/lanikai/alohartc/internal/leak"
 )
 
 // RFC 8445: https://tools.ietf.org/html/rfc8445
 
-// In the language of the above specification, this is a Full implementation of a Controlled ICE
-// agent, supporting a single component of a single data stream.
+// In the language of the above specification, this is a Full (or optionally
+// Lite) implementation of an ICE agent, supporting a single component of a
+// single data stream, so RTCP must be multiplexed with RTP (rtcp-mux). The
+// agent is controlled unless SetControlling is called.
 type Agent struct {
-	mid       string // media stream ID
-	component int    // component (currently always 1)
+	mid         string // media stream ID
+	component   int    // component (currently always 1)
+	remoteUfrag string // remote ICE username fragment
+	controlling bool   // whether we nominate candidate pairs
 
-	localCandidates  []Candidate
-	remoteCandidates []Candidate
+	config AgentConfig
 
 	checklist Checklist
 
+	// Bases whose read loops have started, closed when the agent stops.
+	bases       []*Base
+	basesClosed bool
+
 	dataIn chan []byte
 
 	failure error
@@ -37,25 +46,58 @@ const (
 	mdnsResolveTimeout = 3 * time.Second
 )
 
-func NewAgent() *Agent {
-	return new(Agent)
+func NewAgent(config AgentConfig) *Agent {
+	if config.KeepaliveInterval <= 0 {
+		config.KeepaliveInterval = defaultKeepaliveInterval
+	}
+	if config.ConsentTimeout <= 0 {
+		config.ConsentTimeout = defaultConsentTimeout
+	}
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = defaultReadTimeout
+	}
+	return &Agent{config: config}
 }
 
+// Stop the agent with err, which GetDataStream returns.
 func (a *Agent) fail(err error) {
 	a.Lock()
-	defer a.Unlock()
-
 	if a.failure == nil {
 		a.failure = err
 	}
+	a.Unlock()
+
+	a.checklist.mutex.Lock()
+	a.checklist.setFailed()
+	a.checklist.mutex.Unlock()
+}
+
+func (a *Agent) getFailure() error {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.failure
+}
+
+// SetControlling selects the controlling role [RFC8445 §6.1.1], which is taken
+// by the offerer unless it is lite. Must be called before Configure.
+func (a *Agent) SetControlling(controlling bool) {
+	a.controlling = controlling
 }
 
 func (a *Agent) Configure(mid, username, localPassword, remotePassword string) {
 	a.mid = mid
 	a.component = 1
+	a.remoteUfrag = strings.SplitN(username, ":", 2)[0]
 	a.checklist.username = username
 	a.checklist.localPassword = localPassword
 	a.checklist.remotePassword = remotePassword
+	a.checklist.lite = a.config.Lite
+	a.checklist.controlling = a.controlling && !a.config.Lite
+	a.checklist.tieBreaker = newTieBreaker()
+	a.checklist.keepaliveInterval = a.config.KeepaliveInterval
+	a.checklist.consentTimeout = a.config.ConsentTimeout
+	a.checklist.clock = a.config.Clock
 	a.checklist.priorityTable = &PriorityTable{
 		ipv4: 65534, // evens
 		ipv6: 65535, // odds; slightly higher initial local preference for IPv6
@@ -75,7 +117,14 @@ func (a *Agent) Start(ctx context.Context, rcand <-chan Candidate) <-chan Candid
 // The lcand channel will be closed.
 func (a *Agent) connect(ctx context.Context, rcand <-chan Candidate, lcand chan<- Candidate) {
 	// Create a base for each network interface.
-	bases, err := initializeBases(a.component, a.mid)
+	nat, err := a.config.NAT1To1.parse()
+	if err != nil {
+		close(lcand)
+		a.fail(err)
+		return
+	}
+
+	bases, err := initializeBases(a.component, a.mid, a.config.InterfaceFilter, a.config.Loopback, a.config.PortRange)
 	if err != nil {
 		close(lcand)
 		a.fail(err)
@@ -84,36 +133,116 @@ func (a *Agent) connect(ctx context.Context, rcand <-chan Candidate, lcand chan<
 
 	// Start read loop for each base.
 	for _, base := range bases {
-		go base.readLoop(a.handleStun, a.dataIn)
+		a.startBase(base)
 	}
 
+	res := a.config.Resources
+	res.Go("ICE teardown", func() {
+		<-ctx.Done()
+		a.closeBases()
+	})
+
 	// Process incoming remote candidates.
-	go a.addAllRemoteCandidates(ctx, rcand)
+	res.Go("ICE remote candidates", func() {
+		a.addAllRemoteCandidates(ctx, rcand)
+	})
 
 	// Gather local candidates for each base.
-	go func() {
+	res.Go("ICE candidate gathering", func() {
 		defer close(lcand)
-		gatherAllCandidates(ctx, a.checklist.priorityTable, bases, func(c Candidate) {
+		gatherCtx := ctx
+		if timeout := a.config.GatheringTimeout; timeout > 0 {
+			var cancel context.CancelFunc
+			gatherCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		opts := gatherOptions{
+			reflexive:   !a.config.Lite && !a.config.LANOnly,
+			mdns:        a.config.MDNSCandidates,
+			nat:         nat,
+			turnServers: a.config.TURNServers,
+			clock:       a.config.Clock,
+		}
+		gatherAllCandidates(gatherCtx, a.checklist.priorityTable, bases, opts, a.startBase, func(c Candidate) {
 			a.addLocalCandidate(c)
 			select {
 			case lcand <- c:
 			case <-ctx.Done():
 			}
 		})
-	}()
+		if gatherCtx.Err() == context.DeadlineExceeded {
+			log.Info("ICE candidate gathering timed out after %s", a.config.GatheringTimeout)
+		}
+		if ctx.Err() == nil {
+			a.checklist.emit(EventGatheringComplete)
+		}
+		a.checklist.setGatheringDone()
+	})
 
 	// Begin connectivity checks.
-	a.checklist.run(ctx)
+	res.Go("ICE checklist", func() {
+		a.checklist.run(ctx)
+	})
 }
 
-// GetDataStream waits for a connection to be established.
+// Start the read loop of a base, which runs until the base is closed (or
+// times out).
+func (a *Agent) startBase(base *Base) {
+	desc := base.address.String()
+	base.release = a.config.Resources.Acquire(leak.Socket, desc)
+	if err := setQoS(base.PacketConn, a.config.DSCP, a.config.SocketPriority); err != nil {
+		log.Warn("Failed to set QoS on %s: %v", desc, err)
+	}
+	if err := base.configureSocket(a.config.ReadBufferSize, a.config.WriteBufferSize); err != nil {
+		log.Warn("Failed to size socket buffers on %s: %v", desc, err)
+	}
+
+	a.Lock()
+	closed := a.basesClosed
+	if !closed {
+		a.bases = append(a.bases, base)
+	}
+	a.Unlock()
+	if closed {
+		// The agent stopped while the base was being created.
+		base.Close()
+		return
+	}
+
+	a.config.Resources.Go("ICE read loop "+desc, func() {
+		base.readLoop(a.handleStun, a.dataIn, a.config.ReadTimeout)
+	})
+}
+
+// Close every base, once the agent stops.
+func (a *Agent) closeBases() {
+	a.Lock()
+	bases := a.bases
+	a.bases = nil
+	a.basesClosed = true
+	a.Unlock()
+
+	for _, base := range bases {
+		base.Close()
+	}
+}
+
+// GetDataStream waits for a connection to be established. It returns
+// ErrFailed if every candidate pair fails, once gathering has finished and the
+// remote peer has signaled end-of-candidates.
 func (a *Agent) GetDataStream(ctx context.Context) (*DataStream, error) {
-	if a.failure != nil {
-		return nil, a.failure
+	if err := a.getFailure(); err != nil {
+		return nil, err
 	}
 
 	// Wait for a candidate pair to be selected.
 	p, err := a.checklist.getSelected(ctx, nil)
+	if err == ErrFailed {
+		if failure := a.getFailure(); failure != nil {
+			// The agent failed to start.
+			return nil, failure
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -121,7 +250,7 @@ func (a *Agent) GetDataStream(ctx context.Context) (*DataStream, error) {
 	ds := newDataStream(p, a.dataIn)
 
 	// Keep checking in case the selected pair changes, until ctx is canceled.
-	go func() {
+	a.config.Resources.Go("ICE selected pair", func() {
 		for {
 			p, err = a.checklist.getSelected(ctx, p)
 			if err != nil {
@@ -129,41 +258,97 @@ func (a *Agent) GetDataStream(ctx context.Context) (*DataStream, error) {
 			}
 			ds.update(p)
 		}
-	}()
+	})
 
 	return ds, nil
 }
 
-func (a *Agent) addRemoteCandidate(c Candidate) {
-	a.Lock()
-	defer a.Unlock()
+// SelectedPair returns the local and remote candidates of the currently
+// selected candidate pair. If no pair has been selected yet, ok is false.
+func (a *Agent) SelectedPair() (local, remote Candidate, ok bool) {
+	a.checklist.mutex.Lock()
+	defer a.checklist.mutex.Unlock()
+
+	if p := a.checklist.selected; p != nil {
+		return p.local, p.remote, true
+	}
+	return
+}
+
+// SelectedPairRTT returns the smoothed round-trip time of the connectivity
+// checks and keepalives on the selected candidate pair, or 0 if not yet
+// measured, e.g. before a pair is selected, or by a lite agent, which sends
+// no checks.
+func (a *Agent) SelectedPairRTT() time.Duration {
+	a.checklist.mutex.Lock()
+	defer a.checklist.mutex.Unlock()
+
+	if p := a.checklist.selected; p != nil {
+		return p.srtt
+	}
+	return 0
+}
+
+// PathMTU returns the MTU of the selected candidate pair's local network
+// interface, less any relay overhead, or 0 if unknown. The rest of the path
+// may have a smaller MTU still.
+func (a *Agent) PathMTU() int {
+	local, _, ok := a.SelectedPair()
+	if !ok || local.base == nil {
+		return 0
+	}
+	return local.base.mtu
+}
 
+// SocketStats describes the socket of the selected candidate pair's local
+// base. If no pair has been selected yet, ok is false.
+func (a *Agent) SocketStats() (stats SocketStats, ok bool) {
+	local, _, ok := a.SelectedPair()
+	if !ok || local.base == nil {
+		return SocketStats{}, false
+	}
+	return local.base.stats(), true
+}
+
+func (a *Agent) addRemoteCandidate(c Candidate) {
 	log.Info("Remote ICE %s", c)
-	a.remoteCandidates = append(a.remoteCandidates, c)
+	a.checklist.emitCandidate(EventRemoteCandidate, c)
 	// Pair new remote candidate with all existing local candidates.
-	a.checklist.addCandidatePairs(a.localCandidates, []Candidate{c})
+	a.checklist.addRemoteCandidate(c)
 }
 
 func (a *Agent) addAllRemoteCandidates(ctx context.Context, rcand <-chan Candidate) {
+	// Remote candidates still being resolved.
+	var resolving sync.WaitGroup
+
 	for {
 		select {
 		case c, ok := <-rcand:
 			if !ok {
+				// End-of-candidates, once the last is resolved.
+				resolving.Wait()
+				a.checklist.setRemoteDone()
 				return
 			}
-			if c.address.protocol == UDP {
+			if c.ufrag != "" && c.ufrag != a.remoteUfrag {
+				log.Debug("Ignoring remote candidate of other ICE session %s (generation %d): %s", c.ufrag, c.generation, c)
+			} else if c.component != a.component {
+				log.Debug("Ignoring remote candidate for component %d, since RTCP is multiplexed: %s", c.component, c)
+			} else if c.address.protocol == UDP {
 				if c.address.resolved() {
 					a.addRemoteCandidate(c)
 				} else {
 					// Resolve the address first, then add the candidate.
+					resolving.Add(1)
 					go func() {
+						defer resolving.Done()
 						if a.resolveCandidate(ctx, &c) {
 							a.addRemoteCandidate(c)
 						}
 					}()
 				}
 			} else {
-				log.Debug("Ignoring non-UDP remote candidate: %s", c)
+				log.Debug("Ignoring TCP (%s) remote candidate: %s", c.tcpType, c)
 			}
 		case <-ctx.Done():
 			return
@@ -186,13 +371,10 @@ func (a *Agent) resolveCandidate(ctx context.Context, c *Candidate) bool {
 }
 
 func (a *Agent) addLocalCandidate(c Candidate) {
-	a.Lock()
-	defer a.Unlock()
-
 	log.Info("Local ICE %s", c)
-	a.localCandidates = append(a.localCandidates, c)
+	a.checklist.emitCandidate(EventCandidateGathered, c)
 	// Pair new local candidate with all existing remote candidates.
-	a.checklist.addCandidatePairs([]Candidate{c}, a.remoteCandidates)
+	a.checklist.addLocalCandidate(c)
 }
 
 func (a *Agent) handleStun(msg *stunMessage, raddr net.Addr, base *Base) {
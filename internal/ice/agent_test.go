@@ -0,0 +1,53 @@
+package ice
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGatheringTimeout(t *testing.T) {
+	// A STUN server that never answers, so the query would take 5 seconds.
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	defer func(s string) { flagStunServer = s }(flagStunServer)
+	flagStunServer = silent.LocalAddr().String()
+
+	a := NewAgent(AgentConfig{
+		Loopback: true,
+		InterfaceFilter: func(name string, ip net.IP) bool {
+			return ip.Equal(net.IPv4(127, 0, 0, 1))
+		},
+		GatheringTimeout: 100 * time.Millisecond,
+	})
+	a.Configure("0", "remote:local", "localpassword", "remotepassword")
+	events := make(chan EventType, 16)
+	a.OnEvent(func(e Event) {
+		select {
+		case events <- e.Type:
+		default:
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	var cands []Candidate
+	for c := range a.Start(ctx, nil) {
+		cands = append(cands, c)
+	}
+
+	// Only the host candidate is gathered, well before the query gives up.
+	assert.True(t, time.Since(start) < timeoutQuerySTUNServer/2, "gathering took %s", time.Since(start))
+	if assert.Len(t, cands, 1) {
+		assert.Equal(t, hostType, cands[0].Type())
+	}
+	assert.Equal(t, EventCandidateGathered, <-events)
+	assert.Equal(t, EventGatheringComplete, <-events)
+}
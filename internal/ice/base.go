@@ -6,9 +6,13 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/lanikai/alohartc/internal/ice/mdns"
 	"github.com/lanikai/alohartc/internal/mux"
+	"github.com/lanikai/alohartc/internal/packet"
 )
 
 const (
@@ -19,11 +23,11 @@ const (
 
 	// Timeout for querying STUN server.
 	timeoutQuerySTUNServer = 5 * time.Second
-
-	// Timeout for reads from base (i.e. its UDPConn).
-	timeoutReadFromBase = 5 * time.Second
 )
 
+// Buffers for packets read from all bases.
+var packetPool = packet.NewBufferPool(sizeMaximumTransmissionUnit)
+
 // [RFC8445] defines a base to be "The transport address that an ICE agent sends from for a
 // particular candidate." It is represented here by a UDP connection, listening on a single port.
 type Base struct {
@@ -33,29 +37,58 @@ type Base struct {
 	component int
 	sdpMid    string
 
+	// MTU of the network interface packets from this base are sent on, less
+	// any relay overhead, or 0 if unknown.
+	mtu int
+
+	// Range within which the sockets of relayed bases allocated from this
+	// base are bound.
+	ports PortRange
+
 	// STUN response handlers for transactions sent from this base, keyed by transaction ID.
 	handlers transactionHandlers
 
+	// Remote addresses of the base's valid pairs, which the read loop's
+	// rate limits don't apply to.
+	trusted trustedSources
+
 	// Single-fire channel used to indicate that the read loop has died.
 	dead chan struct{}
 
 	// Error that caused the read loop to terminate.
 	err error
+
+	// Called when the base is closed, to account for its socket.
+	release func()
+
+	// The socket, if the ECN marks of received packets are reported, with a
+	// buffer for the control messages that carry them, and their counts.
+	ecnConn *net.UDPConn
+	oob     []byte
+	ecn     ecnCounters
 }
 
 type stunHandler func(msg *stunMessage, addr net.Addr, base *Base)
 
-// Create a base for each local IP address.
-func initializeBases(component int, sdpMid string) (bases []*Base, err error) {
+// Close the base's socket, ending its read loop.
+func (base *Base) Close() error {
+	if base.release != nil {
+		base.release()
+	}
+	return base.PacketConn.Close()
+}
+
+// Create a base for each local IP address. If filter is non-nil, only addresses
+// for which it returns true are used.
+func initializeBases(component int, sdpMid string, filter func(string, net.IP) bool, loopback bool, ports PortRange) (bases []*Base, err error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return
 	}
 	for _, iface := range ifaces {
 		log.Debug("Interface %d: %s (%s)\n", iface.Index, iface.Name, iface.Flags)
-		if iface.Flags&net.FlagLoopback != 0 {
+		if iface.Flags&net.FlagLoopback != 0 && !loopback {
 			// Skip loopback interfaces to reduce the number of candidates.
-			// TODO: Probably we need these if we're not connected to any network.
 			continue
 		}
 
@@ -84,22 +117,33 @@ func initializeBases(component int, sdpMid string) (bases []*Base, err error) {
 				}
 			}
 
-			base, err := createBase(ip, component, sdpMid)
+			if filter != nil && !filter(iface.Name, ip) {
+				log.Debug("Excluding %s address %s\n", iface.Name, ip)
+				continue
+			}
+
+			base, err := createBase(ports, ip, component, sdpMid)
 			if err != nil {
 				// This can happen for link-local IPv6 addresses. Just skip it.
-				log.Debug("Failed to create base for %s\n", ip)
+				// Running out of ports in a configured range is worth a
+				// warning, though.
+				if ports != (PortRange{}) {
+					log.Warn("Failed to create base for %s: %v\n", ip, err)
+				} else {
+					log.Debug("Failed to create base for %s\n", ip)
+				}
 				continue
 			}
+			base.mtu = iface.MTU
 			bases = append(bases, base)
 		}
 	}
 	return
 }
 
-func createBase(ip net.IP, component int, sdpMid string) (*Base, error) {
-	// Listen on an arbitrary UDP port.
-	listenAddr := &net.UDPAddr{IP: ip, Port: 0}
-	conn, err := net.ListenUDP("udp", listenAddr)
+func createBase(ports PortRange, ip net.IP, component int, sdpMid string) (*Base, error) {
+	// Listen on an arbitrary UDP port, within the range if one is configured.
+	conn, err := ports.listen("udp", ip)
 	if err != nil {
 		return nil, err
 	}
@@ -112,30 +156,84 @@ func createBase(ip net.IP, component int, sdpMid string) (*Base, error) {
 		address:    address,
 		component:  component,
 		sdpMid:     sdpMid,
+		ports:      ports,
 	}, nil
 }
 
-// Gather host and server-reflexive candidates for each base. Blocks until
-// gathering is complete.
-func gatherAllCandidates(ctx context.Context, pt *PriorityTable, bases []*Base, take func(c Candidate)) {
+// How candidates are gathered.
+type gatherOptions struct {
+	// Gather server-reflexive and relayed candidates, besides host candidates.
+	reflexive bool
+
+	// Gather host candidates that advertise ephemeral mDNS hostnames.
+	mdns bool
+
+	// Public addresses of bases behind 1:1 NAT, which take the place of
+	// their host or server-reflexive candidates' addresses. May be nil.
+	nat *natMapping
+
+	// Servers to allocate relayed candidates on, if reflexive is set.
+	turnServers []TURNServer
+
+	// Clock for refreshing relayed allocations. Nil means the system clock.
+	clock clock.Clock
+}
+
+// Time for which mDNS hostnames of candidates are announced.
+const mdnsCandidateTTL = 10 * time.Minute
+
+// Gather candidates for each base, as opts specifies. Blocks until gathering
+// is complete. Relayed candidates have their own bases, which are passed to
+// startBase before the candidates are taken.
+func gatherAllCandidates(ctx context.Context, pt *PriorityTable, bases []*Base, opts gatherOptions, startBase func(*Base), take func(c Candidate)) {
 	var wg sync.WaitGroup
 	for _, b := range bases {
 		wg.Add(1)
 		go func(base *Base) {
-			base.gatherCandidates(ctx, pt, take)
+			base.gatherCandidates(ctx, pt, opts, take)
 			wg.Done()
 		}(b)
+
+		if !opts.reflexive {
+			continue
+		}
+		for _, s := range opts.turnServers {
+			wg.Add(1)
+			go func(base *Base, server TURNServer) {
+				base.gatherRelayCandidate(ctx, pt, server, opts.clock, startBase, take)
+				wg.Done()
+			}(b, s)
+		}
 	}
 	wg.Wait()
 }
 
-// Gather candidates host and server-reflexive candidates for this base.
-func (base *Base) gatherCandidates(ctx context.Context, pt *PriorityTable, take func(c Candidate)) {
+// Gather host, mDNS and server-reflexive candidates for this base, as opts
+// specifies.
+func (base *Base) gatherCandidates(ctx context.Context, pt *PriorityTable, opts gatherOptions, take func(c Candidate)) {
 	log.Debug("Gathering local candidates for base %s\n", base.address)
-	// Host candidate for peers on the same LAN.
-	take(makeHostCandidate(pt, base))
+	public, mapped := opts.nat.lookup(base)
+
+	// Host candidate for peers on the same LAN, unless replaced by the
+	// address of a 1:1 NAT.
+	host := makeHostCandidate(pt, base)
+	if mapped && opts.nat.asHost {
+		host.address = public
+		take(host)
+		return
+	}
+	take(host)
 
-	if base.address.protocol == UDP && !base.address.linkLocal {
+	if opts.mdns && base.address.protocol == UDP && !base.address.linkLocal {
+		// Host candidate for peers that only accept mDNS hostnames, e.g.
+		// browsers on the same LAN that hide their own addresses.
+		base.gatherMDNSCandidate(ctx, pt, take)
+	}
+
+	if opts.reflexive && mapped {
+		// The 1:1 NAT's address is already known.
+		take(makeServerReflexiveCandidate(pt, base, public, ""))
+	} else if opts.reflexive && base.address.protocol == UDP && !base.address.linkLocal {
 		// Query STUN server to get a server reflexive candidate.
 		mappedAddress, err := base.queryStunServer(ctx, flagStunServer)
 
@@ -156,6 +254,58 @@ func (base *Base) gatherCandidates(ctx context.Context, pt *PriorityTable, take
 	}
 }
 
+// Announce an ephemeral mDNS hostname for this base's address, and gather a
+// host candidate that advertises it.
+func (base *Base) gatherMDNSCandidate(ctx context.Context, pt *PriorityTable, take func(c Candidate)) {
+	if !mdns.Started() {
+		log.Warn("mDNS not started, so no mDNS candidate for base %s", base.address)
+		return
+	}
+	hostname := mdns.NewName()
+	if err := mdns.Announce(ctx, hostname, net.IP(base.address.ip), mdnsCandidateTTL); err != nil {
+		log.Warn("Failed to announce mDNS hostname for base %s: %v", base.address, err)
+		return
+	}
+	take(makeMDNSCandidate(pt, base, hostname))
+}
+
+// Allocate a relayed address on the TURN server, from the same IP address as
+// this base, and gather a relayed candidate for it.
+func (base *Base) gatherRelayCandidate(ctx context.Context, pt *PriorityTable, server TURNServer, clk clock.Clock, startBase func(*Base), take func(c Candidate)) {
+	if base.address.protocol != UDP || base.address.linkLocal {
+		return
+	}
+
+	conn, err := allocateTURN(ctx, base.ports, net.IP(base.address.ip), server, clk)
+
+	// If the context ended, ignore the error.
+	select {
+	case <-ctx.Done():
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	default:
+	}
+
+	if err != nil {
+		log.Warn("Failed to allocate relay on %s for base %s: %v\n", server.Address, base.address, err)
+		return
+	}
+
+	relayBase := &Base{
+		PacketConn: conn,
+		address:    makeTransportAddress(conn.relayed),
+		component:  base.component,
+		sdpMid:     base.sdpMid,
+	}
+	if base.mtu > 0 {
+		relayBase.mtu = base.mtu - turnSendOverhead
+	}
+	startBase(relayBase)
+	take(makeRelayedCandidate(pt, base, relayBase, server.Address))
+}
+
 // Return the server-reflexive address of this base.
 func (base *Base) queryStunServer(ctx context.Context, stunServer string) (mapped TransportAddress, err error) {
 	network := fmt.Sprintf("udp%d", base.address.family)
@@ -196,35 +346,43 @@ func (base *Base) queryStunServer(ctx context.Context, stunServer string) (mappe
 // Send a STUN message to the given remote address. If a handler is supplied, it will be used to
 // process the STUN response, based on the transaction ID.
 func (base *Base) sendStun(msg *stunMessage, raddr net.Addr, responseHandler stunHandler) error {
+	if responseHandler != nil {
+		if err := base.handlers.put(msg.transactionID, responseHandler); err != nil {
+			return err
+		}
+	}
 	_, err := base.WriteTo(msg.Bytes(), raddr)
-	if err == nil && responseHandler != nil {
-		base.handlers.put(msg.transactionID, responseHandler)
+	if err != nil && responseHandler != nil {
+		base.handlers.remove(msg.transactionID)
 	}
 	return err
 }
 
 // Read incoming packets from the underlying PacketConn, until an error occurs.
 // STUN messages are handled, the rest are sent to the dataIn channel.
-func (base *Base) readLoop(defaultHandler stunHandler, dataIn chan []byte) {
+func (base *Base) readLoop(defaultHandler stunHandler, dataIn chan []byte, readTimeout time.Duration) {
 	if base.dead != nil {
-		panic("Base read loop already started")
+		log.Warn("Read loop for base %s already started", base.address)
+		return
 	}
 
 	base.dead = make(chan struct{})
 	defer close(base.dead)
 
-	// Single packet read buffer.
-	buf := make([]byte, sizeMaximumTransmissionUnit)
-
 	var logOnce sync.Once
+	limiter := sourceLimiter{trusted: &base.trusted}
 	for {
 		// Set read timeout
-		base.SetReadDeadline(time.Now().Add(timeoutReadFromBase))
+		base.SetReadDeadline(time.Now().Add(readTimeout))
 
-		// Blocks (or timeouts) waiting for packet from underlying UDPConn
-		n, raddr, err := base.ReadFrom(buf)
+		// Blocks (or timeouts) waiting for packet from underlying UDPConn.
+		// Data packets are passed on in the buffer they were read into, and
+		// returned to the pool by DataStream.Read.
+		buf := packetPool.Get()
+		n, raddr, err := base.read(buf)
 
 		if err != nil {
+			packetPool.Put(buf)
 			if neterr, ok := err.(net.Error); ok {
 				// Timeout is expected for bases that are not selected.
 				if neterr.Timeout() {
@@ -252,15 +410,20 @@ func (base *Base) readLoop(defaultHandler stunHandler, dataIn chan []byte) {
 			break
 		}
 
-		// TODO: Use a sync.Pool of buffers to avoid allocating on each packet.
-		data := make([]byte, n)
-		copy(data, buf[0:n])
+		if !limiter.allow(raddr, time.Now()) {
+			packetPool.Put(buf)
+			continue
+		}
 
+		data := buf[0:n]
 		if mux.MatchSTUN(data) {
-			// Process STUN packets.
+			// Process STUN packets. Parsed messages refer to the buffer, so it
+			// isn't returned to the pool.
 			msg, err := parseStunMessage(data)
 			if err != nil {
-				log.Fatal(err)
+				atomic.AddUint64(&counters.malformed, 1)
+				log.Debug("Dropping malformed STUN packet from %s: %v\n", raddr, err)
+				continue
 			}
 
 			if msg != nil {
@@ -278,6 +441,7 @@ func (base *Base) readLoop(defaultHandler stunHandler, dataIn chan []byte) {
 				logOnce.Do(func() {
 					log.Warn("Dropping data packet (first byte %x) because reader cannot keep up", data[0])
 				})
+				packetPool.Put(buf)
 			}
 		}
 	}
@@ -288,25 +452,45 @@ func (base *Base) readLoop(defaultHandler stunHandler, dataIn chan []byte) {
 // remote peer's STUN response.
 type transactionHandlers struct {
 	sync.Mutex
-	m map[string]stunHandler
+	m map[string]transaction
+}
+
+type transaction struct {
+	handler stunHandler
+	started time.Time
 }
 
 func (t *transactionHandlers) get(transactionID string, def stunHandler) stunHandler {
 	t.lockAndInitialize()
-	handler, found := t.m[transactionID]
-	if found {
+	handler := def
+	if tr, found := t.m[transactionID]; found {
 		delete(t.m, transactionID)
-	} else {
-		handler = def
+		handler = tr.handler
 	}
 	t.Unlock()
 	return handler
 }
 
-func (t *transactionHandlers) put(transactionID string, handler stunHandler) {
+// Register a handler. Fails if the map is full, even after discarding
+// transactions that have timed out.
+func (t *transactionHandlers) put(transactionID string, handler stunHandler) error {
 	t.lockAndInitialize()
-	t.m[transactionID] = handler
-	t.Unlock()
+	defer t.Unlock()
+
+	now := time.Now()
+	if len(t.m) >= maxTransactionHandlers {
+		for id, tr := range t.m {
+			if now.Sub(tr.started) > timeoutTransaction {
+				delete(t.m, id)
+			}
+		}
+	}
+	if len(t.m) >= maxTransactionHandlers {
+		atomic.AddUint64(&counters.rejectedHandler, 1)
+		return errTooManyTransactions
+	}
+	t.m[transactionID] = transaction{handler, now}
+	return nil
 }
 
 func (t *transactionHandlers) remove(transactionID string) {
@@ -318,6 +502,6 @@ func (t *transactionHandlers) remove(transactionID string) {
 func (t *transactionHandlers) lockAndInitialize() {
 	t.Lock()
 	if t.m == nil {
-		t.m = make(map[string]stunHandler)
+		t.m = make(map[string]transaction)
 	}
 }
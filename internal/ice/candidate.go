@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"hash/fnv"
 	"net"
+	"strconv"
 	"strings"
 )
 
@@ -22,7 +23,17 @@ type Candidate struct {
 	component  int
 	attrs      []Attribute // Extension attributes
 
+	// Interpreted extension attributes, also kept in attrs.
+	tcpType    string // [RFC6544 §4.5] "active", "passive", or "so"
+	generation int    // Incremented by the remote peer on each ICE restart
+	networkID  int    // Network interface of the candidate, 0 if unknown
+	ufrag      string // ICE username fragment the candidate belongs to
+
 	base *Base // nil for remote candidates
+
+	// Ephemeral mDNS hostname advertised in place of the address of a local
+	// candidate, or "".
+	hostname string
 }
 
 type Attribute struct {
@@ -49,6 +60,14 @@ func makeHostCandidate(pt *PriorityTable, base *Base) Candidate {
 	}
 }
 
+// Make a host candidate that advertises an mDNS hostname, announced for the
+// base's address, in place of the address itself.
+func makeMDNSCandidate(pt *PriorityTable, base *Base, hostname string) Candidate {
+	c := makeHostCandidate(pt, base)
+	c.hostname = hostname
+	return c
+}
+
 func makeServerReflexiveCandidate(
 	pt *PriorityTable,
 	base *Base,
@@ -70,21 +89,17 @@ func makeServerReflexiveCandidate(
 	return c
 }
 
-func makePeerReflexiveCandidate(
-	pt *PriorityTable,
-	base *Base,
-	addr net.Addr,
-	priority uint32,
-) Candidate {
+// [RFC8445 §7.3.1.3] Make a remote peer-reflexive candidate, learned from the
+// source address of a connectivity check, with the priority the check carried.
+func makePeerReflexiveCandidate(mid string, component int, addr net.Addr, priority uint32) Candidate {
 	ta := makeTransportAddress(addr)
 	c := Candidate{
-		mid:        base.sdpMid,
+		mid:        mid,
 		address:    ta,
 		typ:        prflxType,
 		priority:   priority,
 		foundation: computeFoundation(prflxType, ta, ""),
-		component:  base.component,
-		base:       base,
+		component:  component,
 	}
 	// [RFC5245 §15.1] requires raddr/rport. This is enforced by some browsers (e.g. Firefox).
 	c.addAttribute("raddr", "0.0.0.0")
@@ -92,21 +107,51 @@ func makePeerReflexiveCandidate(
 	return c
 }
 
-// [RFC8445 §5.1.2] Prioritizing Candidates
-func computePriority(pt *PriorityTable, typ string, base *Base) uint32 {
-	var localPref, typePref int
+// Make a relayed candidate. The foundation is derived from the host base that
+// the allocation was made from, but the candidate has its own base, which sends
+// and receives through the TURN server.
+func makeRelayedCandidate(
+	pt *PriorityTable,
+	hostBase *Base,
+	relayBase *Base,
+	turnServer string,
+) Candidate {
+	c := Candidate{
+		mid:        relayBase.sdpMid,
+		address:    relayBase.address,
+		typ:        relayType,
+		priority:   computePriority(pt, relayType, relayBase),
+		foundation: computeFoundation(relayType, hostBase.address, turnServer),
+		component:  relayBase.component,
+		base:       relayBase,
+	}
+	// [RFC5245 §15.1] requires raddr/rport. This is enforced by some browsers (e.g. Firefox).
+	c.addAttribute("raddr", "0.0.0.0")
+	c.addAttribute("rport", "0")
+	return c
+}
+
+// [RFC8445 §5.1.2.2] Recommended type preferences.
+func typePreference(typ string) int {
 	switch typ {
 	case hostType:
-		typePref = 126
+		return 126
 	case prflxType:
-		typePref = 110
+		return 110
 	case srflxType:
-		typePref = 100
+		return 100
 	case relayType:
-		typePref = 0
+		return 0
 	default:
 		panic("Illegal candidate type: " + typ)
 	}
+}
+
+// [RFC8445 §5.1.2] Prioritizing Candidates. Each call takes the next local
+// preference from pt.
+func computePriority(pt *PriorityTable, typ string, base *Base) uint32 {
+	var localPref int
+	typePref := typePreference(typ)
 
 	// Intermingle IPv4 and IPv6 candidates (see RFC8421 §4) by assigning IPv6
 	// odd local preferences, and IPv4 even local preferences, with slight
@@ -146,14 +191,19 @@ func (c *Candidate) isReflexive() bool {
 }
 
 // Computes the priority of this candidate as if it were peer-reflexive, for use in connectivity
-// checks.
-func (c *Candidate) peerPriority(pt *PriorityTable) uint32 {
-	return computePriority(pt, prflxType, c.base)
+// checks [RFC8445 §7.1.1]: the peer-reflexive type preference, with the local
+// preference and component ID the candidate already has.
+func (c *Candidate) peerPriority() uint32 {
+	return uint32(typePreference(prflxType))<<24 | c.priority&0x00FFFFFF
 }
 
 func (c *Candidate) sdpString() string {
+	address := c.address.displayIP()
+	if c.hostname != "" {
+		address = c.hostname
+	}
 	s := fmt.Sprintf("candidate:%s %d %s %d %s %d typ %s",
-		c.foundation, c.component, c.address.protocol, c.priority, c.address.displayIP(), c.address.port, c.typ)
+		c.foundation, c.component, c.address.protocol, c.priority, address, c.address.port, c.typ)
 	for _, a := range c.attrs {
 		s += fmt.Sprintf(" %s %s", a.name, a.value)
 	}
@@ -164,6 +214,43 @@ func (c *Candidate) Mid() string {
 	return c.mid
 }
 
+// Type returns the candidate type: "host", "srflx", "prflx", or "relay".
+func (c *Candidate) Type() string {
+	return c.typ
+}
+
+// Address returns the IP address and port of the candidate. The address of a
+// remote candidate not yet resolved is its mDNS hostname. A local candidate
+// that advertises an mDNS hostname returns its actual address.
+func (c *Candidate) Address() (host string, port int) {
+	return c.address.displayIP(), c.address.port
+}
+
+// TCPType returns the TCP connection type ("active", "passive", or "so") of a
+// TCP candidate, or "" for UDP.
+func (c *Candidate) TCPType() string {
+	return c.tcpType
+}
+
+// Generation returns the ICE generation of the candidate, which is 0 until the
+// remote peer restarts ICE.
+func (c *Candidate) Generation() int {
+	return c.generation
+}
+
+// NetworkID returns the identifier of the remote peer's network interface that
+// the candidate was gathered on, or 0 if not known.
+func (c *Candidate) NetworkID() int {
+	return c.networkID
+}
+
+// Ufrag returns the ICE username fragment that the candidate belongs to, or ""
+// if not known. Candidates trickled before the session description arrives
+// carry it to tell which ICE session they are for.
+func (c *Candidate) Ufrag() string {
+	return c.ufrag
+}
+
 func (c Candidate) String() string {
 	return c.sdpString()
 }
@@ -216,9 +303,45 @@ func ParseCandidate(desc, sdpMid string) (c Candidate, err error) {
 			return
 		}
 		value := scanner.Text()
+		if err = c.parseAttribute(name, value); err != nil {
+			return
+		}
 		c.addAttribute(name, value)
 	}
 
+	// [RFC6544 §4.5] TCP candidates must have a tcptype, and UDP ones none.
+	if c.address.protocol == TCP && c.tcpType == "" {
+		err = fmt.Errorf("TCP candidate without tcptype")
+		return
+	}
+	if c.address.protocol == UDP && c.tcpType != "" {
+		err = fmt.Errorf("UDP candidate with tcptype %s", c.tcpType)
+		return
+	}
+
 	c.mid = sdpMid
 	return
 }
+
+// Interpret an extension attribute, if known.
+func (c *Candidate) parseAttribute(name, value string) (err error) {
+	switch name {
+	case "tcptype":
+		switch value {
+		case "active", "passive", "so":
+			c.tcpType = value
+		default:
+			err = fmt.Errorf("invalid tcptype: %s", value)
+		}
+	case "generation":
+		c.generation, err = strconv.Atoi(value)
+	case "network-id":
+		c.networkID, err = strconv.Atoi(value)
+	case "ufrag":
+		c.ufrag = value
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid %s attribute: %v", name, err)
+	}
+	return
+}
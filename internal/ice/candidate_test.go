@@ -1,8 +1,12 @@
 package ice
 
 import (
+	"context"
+	"net"
+	"strings"
 	"testing"
 
+	"github.com/lanikai/alohartc/internal/ice/mdns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,3 +33,91 @@ func TestCandidateString(t *testing.T) {
 
 	assert.Equal(t, desc, c.String())
 }
+
+func TestMDNSCandidateString(t *testing.T) {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	pt := &PriorityTable{ipv4: 65534, ipv6: 65535}
+	hostname := mdns.NewName()
+	c := makeMDNSCandidate(pt, base, hostname)
+	assert.Contains(t, c.String(), " "+hostname+" ")
+	assert.NotContains(t, c.String(), "127.0.0.1")
+
+	// The remote peer sees an unresolved host candidate.
+	r, err := ParseCandidate(c.String(), "0")
+	assert.NoError(t, err)
+	assert.False(t, r.address.resolved())
+	assert.Equal(t, hostType, r.Type())
+	assert.Equal(t, c.address.port, r.address.port)
+}
+
+func TestPeerPriority(t *testing.T) {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	// The priority sent in checks keeps the candidate's local preference,
+	// however many checks are sent.
+	pt := &PriorityTable{ipv4: 65534, ipv6: 65535}
+	c := makeHostCandidate(pt, base)
+	assert.Equal(t, uint32(110<<24|65534<<8|255), c.peerPriority())
+	assert.Equal(t, c.peerPriority(), c.peerPriority())
+	assert.Equal(t, 65533, pt.ipv4)
+}
+
+func TestNewMDNSName(t *testing.T) {
+	name := mdns.NewName()
+	assert.True(t, strings.HasSuffix(name, ".local"), name)
+	assert.Len(t, name, 36+len(".local"))
+	assert.Equal(t, byte('4'), name[14])
+	assert.NotEqual(t, name, mdns.NewName())
+}
+
+func TestGatherMDNSCandidatesNotStarted(t *testing.T) {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	// Without the mDNS client, only the host candidate is gathered.
+	var cands []Candidate
+	pt := &PriorityTable{ipv4: 65534, ipv6: 65535}
+	base.gatherCandidates(context.Background(), pt, gatherOptions{mdns: true}, func(c Candidate) {
+		cands = append(cands, c)
+	})
+	if assert.Len(t, cands, 1) {
+		assert.Equal(t, "127.0.0.1", cands[0].address.displayIP())
+	}
+}
+
+func TestParseCandidateAttributes(t *testing.T) {
+	desc := "candidate:1 1 tcp 1518280447 192.168.1.1 9 typ host tcptype passive generation 2 ufrag EsAw network-id 3"
+	c, err := ParseCandidate(desc, "mid")
+	assert.NoError(t, err)
+
+	assert.Equal(t, TCP, c.address.protocol)
+	assert.Equal(t, "passive", c.TCPType())
+	assert.Equal(t, 2, c.Generation())
+	assert.Equal(t, "EsAw", c.Ufrag())
+	assert.Equal(t, 3, c.NetworkID())
+	assert.Equal(t, desc, c.String())
+}
+
+func TestParseCandidateInvalidAttributes(t *testing.T) {
+	for _, desc := range []string{
+		"candidate:1 1 tcp 1518280447 192.168.1.1 9 typ host",
+		"candidate:1 1 tcp 1518280447 192.168.1.1 9 typ host tcptype sideways",
+		"candidate:0 1 udp 123456789 192.168.1.1 12345 typ host tcptype active",
+		"candidate:0 1 udp 123456789 192.168.1.1 12345 typ host generation zero",
+	} {
+		_, err := ParseCandidate(desc, "mid")
+		assert.Error(t, err, desc)
+	}
+}
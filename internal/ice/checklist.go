@@ -2,10 +2,13 @@ package ice
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
 )
 
 type PriorityTable struct {
@@ -25,6 +28,20 @@ type Checklist struct {
 	localPassword  string
 	remotePassword string
 
+	// Interval between keepalives on the selected pair, and how long it may
+	// go without checks from the remote peer before consent is lost.
+	keepaliveInterval time.Duration
+	consentTimeout    time.Duration
+
+	// Clock for the above and for retransmissions, or nil for the system
+	// clock.
+	clock clock.Clock
+
+	// Candidates paired so far, including remote peer-reflexive candidates
+	// learned from connectivity checks.
+	localCandidates  []Candidate
+	remoteCandidates []Candidate
+
 	// ID for next candidate pair to be added
 	nextPairID int
 
@@ -35,6 +52,12 @@ type Checklist struct {
 	// Selected candidate pair
 	selected *CandidatePair
 
+	// Whether local candidate gathering has finished, and whether the remote
+	// peer has signaled end-of-candidates. Until both, more pairs may be
+	// added, so the checklist can't fail.
+	gatheringDone bool
+	remoteDone    bool
+
 	// Mutex to prevent reading from pairs while they're being modified.
 	mutex sync.Mutex
 
@@ -42,6 +65,17 @@ type Checklist struct {
 	nextToCheck int
 
 	priorityTable *PriorityTable
+
+	// ICE-lite mode: never send connectivity checks, only respond to them.
+	lite bool
+
+	// Whether we are the controlling agent, which nominates a pair, and the
+	// tie-breaker sent with our checks [RFC8445 §7.1.1].
+	controlling bool
+	tieBreaker  []byte
+
+	// Called with each event, if set (see Agent.OnEvent).
+	onEvent func(Event)
 }
 
 type checklistState int
@@ -52,19 +86,58 @@ const (
 	checklistFailed                   = 2
 )
 
-// Pair up local candidates with remote candidates, and add them to the checklist. Then re-sort and
-// re-prune, and unfreeze top candidate pairs.
-func (cl *Checklist) addCandidatePairs(locals, remotes []Candidate) {
+// Pair a new local candidate with every remote candidate.
+func (cl *Checklist) addLocalCandidate(c Candidate) {
 	cl.mutex.Lock()
 	defer cl.mutex.Unlock()
 
+	cl.localCandidates = append(cl.localCandidates, c)
+	cl.addCandidatePairs([]Candidate{c}, cl.remoteCandidates)
+}
+
+// Pair a new remote candidate with every local candidate. If the remote peer's
+// checks already came from its address, the signaled candidate takes the place
+// of the peer-reflexive one learned from them, in its pairs too, rather than
+// pairing the same address with those bases again.
+func (cl *Checklist) addRemoteCandidate(c Candidate) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	locals := cl.localCandidates
+	for i, r := range cl.remoteCandidates {
+		if r.typ == prflxType && r.address == c.address && r.component == c.component {
+			log.Debug("Peer-reflexive %s is %s", r, c)
+			cl.remoteCandidates[i] = c
+			locals = nil
+			for _, l := range cl.localCandidates {
+				if p := cl.findPair(l.base, c.address); p != nil {
+					p.remote = c
+					p.foundation = fmt.Sprintf("%s/%s", p.local.foundation, c.foundation)
+				} else {
+					locals = append(locals, l)
+				}
+			}
+			cl.addCandidatePairs(locals, []Candidate{c})
+			return
+		}
+	}
+
+	cl.remoteCandidates = append(cl.remoteCandidates, c)
+	cl.addCandidatePairs(locals, []Candidate{c})
+}
+
+// Pair up local candidates with remote candidates, and add them to the checklist. Then re-sort and
+// re-prune, and unfreeze top candidate pairs. Must be called with the mutex held.
+func (cl *Checklist) addCandidatePairs(locals, remotes []Candidate) {
 	for _, local := range locals {
 		for _, remote := range remotes {
 			if canBePaired(local, remote) {
 				p := newCandidatePair(cl.nextPairID, local, remote)
+				p.controlling = cl.controlling
 				cl.nextPairID++
 				log.Debug("Adding candidate pair %s", p)
 				cl.pairs = append(cl.pairs, p)
+				cl.emitPair(EventPairCreated, p)
 			}
 		}
 	}
@@ -122,50 +195,66 @@ func isRedundant(p1, p2 *CandidatePair) bool {
 	return p1.remote.address == p2.remote.address && p1.local.base.address == p2.local.base.address
 }
 
+// Run connectivity checks, keepalives, and consent checks until ctx is done.
 func (cl *Checklist) run(ctx context.Context) {
-	go func() {
-		// Timer for periodic connectivity checks. This is stopped once a
-		// candidate pair has been selected.
-		Ta := time.NewTicker(50 * time.Millisecond)
-		defer Ta.Stop()
-
-		// Timer for keepalives.
-		Tr := time.NewTicker(30 * time.Second)
-		defer Tr.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case <-Ta.C:
-				// [RFC8445 §6.1.4.2] Periodic connectivity check.
-				if p := cl.nextPair(); p != nil {
-					log.Trace(4, "Next candidate pair to check: %s\n", p)
-					if err := cl.sendCheck(p); err != nil {
-						log.Warn("Failed to send connectivity check: %s", err)
-					}
-				}
+	c := clock.Or(cl.clock)
+
+	// Timer for periodic connectivity checks. This is stopped once a
+	// candidate pair has been selected.
+	Ta := c.NewTicker(50 * time.Millisecond)
+	defer Ta.Stop()
+
+	// Timer for keepalives, which are due on each pair on its own schedule.
+	Tr := c.NewTicker(cl.keepaliveInterval / keepaliveChecksPerInterval)
+	defer Tr.Stop()
 
-			case <-Tr.C:
-				// [RFC8445 §11] Send STUN binding indication to selected pair.
-				if p := cl.selected; p != nil {
-					p.sendStun(newStunBindingIndication(), nil)
+	// Timer for checking the remote peer's consent.
+	Tc := c.NewTicker(cl.consentTimeout / 6)
+	defer Tc.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-Ta.C:
+			// [RFC8445 §6.1.4.2] Periodic connectivity check. Lite
+			// agents do not perform checks.
+			if cl.lite {
+				continue
+			}
+			if p := cl.nextPair(); p != nil {
+				log.Trace(4, "Next candidate pair to check: %s\n", p)
+				if err := cl.sendCheck(p); err != nil {
+					log.Warn("Failed to send connectivity check: %s", err)
 				}
 			}
+
+		case <-Tr.C:
+			cl.sendKeepalives()
+
+		case <-Tc.C:
+			cl.checkConsent()
 		}
-	}()
+	}
 }
 
 // getSelected waits for the selected candidate pair to change from current.
-// Returns non-nil error only if the context is canceled.
+// Returns non-nil error only if the context is canceled, or the checklist
+// fails.
 func (cl *Checklist) getSelected(ctx context.Context, current *CandidatePair) (*CandidatePair, error) {
 	id, stateCh := cl.addListener()
 	defer cl.removeListener(id)
 
 	for {
-		if cl.selected != current {
-			return cl.selected, nil
+		cl.mutex.Lock()
+		selected, state := cl.selected, cl.state
+		cl.mutex.Unlock()
+		if selected != current {
+			return selected, nil
+		}
+		if state == checklistFailed {
+			return nil, ErrFailed
 		}
 
 		// Wait for state to change, then check again.
@@ -179,11 +268,24 @@ func (cl *Checklist) getSelected(ctx context.Context, current *CandidatePair) (*
 
 // [RFC8445 §7.3] Respond to STUN binding request by sending a success response.
 func (cl *Checklist) handleStunRequest(req *stunMessage, raddr net.Addr, base *Base) {
-	p := cl.findPair(base, raddr)
+	cl.mutex.Lock()
+	p := cl.findPair(base, makeTransportAddress(raddr))
 	if p == nil {
-		p = cl.adoptPeerReflexiveCandidate(base, raddr, req.getPriority())
+		p = cl.adoptRemoteAddress(base, raddr, req.getPriority())
 	}
-	if req.hasUseCandidate() && !p.nominated {
+	p.lastCheckReceived = clock.Or(cl.clock).Now()
+	p.consentLost = false
+	cl.emitPair(EventCheckReceived, p)
+	if cl.lite && p.state != Succeeded {
+		// [RFC8445 §7.3.1.5] A lite agent considers the pair valid as soon
+		// as it responds to the check.
+		p.state = Succeeded
+		cl.emitPair(EventCheckSucceeded, p)
+		base.trusted.add(raddr)
+	}
+	nominate := !cl.controlling && req.hasUseCandidate() && !p.nominated
+	cl.mutex.Unlock()
+	if nominate {
 		log.Debug("Nominating %s\n", p.id)
 		cl.nominate(p)
 	}
@@ -194,22 +296,49 @@ func (cl *Checklist) handleStunRequest(req *stunMessage, raddr net.Addr, base *B
 		log.Warn("Failed to send STUN response: %s", err)
 	}
 
-	cl.triggerCheck(p)
+	if !cl.lite {
+		cl.triggerCheck(p)
+	}
 }
 
-// [RFC8445 §7.3.1.3-4] Create a peer reflexive candidate and pair with the base.
-func (cl *Checklist) adoptPeerReflexiveCandidate(base *Base, raddr net.Addr, priority uint32) *CandidatePair {
-	cl.mutex.Lock()
-	defer cl.mutex.Unlock()
+// [RFC8445 §7.3.1.3-4] Pair the local candidate of base with the remote
+// candidate at raddr, which sent a check on a pair not in the checklist. If
+// raddr isn't a known remote candidate, it's a new peer-reflexive one, with the
+// priority from the check, but it's paired only with base. Must be called with
+// the mutex held.
+func (cl *Checklist) adoptRemoteAddress(base *Base, raddr net.Addr, priority uint32) *CandidatePair {
+	var local, remote *Candidate
+	for i := range cl.localCandidates {
+		if l := &cl.localCandidates[i]; l.base == base && l.address == base.address {
+			local = &cl.localCandidates[i]
+			break
+		}
+	}
+	if local == nil {
+		// The check beat the base's candidate out of gathering.
+		c := makeHostCandidate(cl.priorityTable, base)
+		local = &c
+	}
 
-	local := makeHostCandidate(cl.priorityTable, base)
-	remote := makePeerReflexiveCandidate(cl.priorityTable, base, raddr, priority)
-	log.Debug("New peer-reflexive %s", remote)
+	address := makeTransportAddress(raddr)
+	for i := range cl.remoteCandidates {
+		if cl.remoteCandidates[i].address == address && cl.remoteCandidates[i].component == base.component {
+			remote = &cl.remoteCandidates[i]
+			break
+		}
+	}
+	if remote == nil {
+		cl.remoteCandidates = append(cl.remoteCandidates, makePeerReflexiveCandidate(base.sdpMid, base.component, raddr, priority))
+		remote = &cl.remoteCandidates[len(cl.remoteCandidates)-1]
+		log.Debug("New peer-reflexive %s", remote)
+	}
 
-	p := newCandidatePair(cl.nextPairID, local, remote)
+	p := newCandidatePair(cl.nextPairID, *local, *remote)
+	p.controlling = cl.controlling
 	p.state = Waiting
 	cl.pairs = append(cl.pairs, p)
 	cl.nextPairID++
+	cl.emitPair(EventPairCreated, p)
 
 	cl.pairs = sortAndPrune(cl.pairs)
 	return p
@@ -242,33 +371,93 @@ func (cl *Checklist) nextPair() *CandidatePair {
 }
 
 func (cl *Checklist) sendCheck(p *CandidatePair) error {
-	req := newStunBindingRequest("")
-	req.addAttribute(stunAttrUsername, []byte(cl.username))
-	req.addAttribute(stunAttrIceControlled, []byte{1, 2, 3, 4, 5, 6, 7, 8})
-	req.addPriority(p.local.peerPriority(cl.priorityTable))
-	req.addMessageIntegrity(cl.remotePassword)
-	req.addFingerprint()
+	c := clock.Or(cl.clock)
+	cl.mutex.Lock()
+	useCandidate := p.nominated
 	p.state = InProgress
-	retransmit := time.AfterFunc(cl.rto(), func() {
+	p.lastSent = c.Now()
+	sent := p.lastSent
+	rto := cl.rto(p)
+	cl.emitPair(EventCheckSent, p)
+	cl.mutex.Unlock()
+
+	req := cl.newBindingRequest(p, useCandidate)
+	retransmit := c.AfterFunc(rto, func() {
+		cl.mutex.Lock()
+		defer cl.mutex.Unlock()
+
 		// If we don't get a response within the RTO, then move the pair back to Waiting.
 		p.state = Waiting
 		// After too many failures, mark the pair failed.
 		p.failCount++
 		if p.failCount > 3 {
 			p.state = Failed
+			cl.emitPair(EventCheckFailed, p)
+			cl.checkFailure()
 		}
 	})
 
 	log.Trace(4, "%s: Sending to %s from %s: %s\n", p.id, p.remote.address, p.local.address, req)
 	return p.sendStun(req, func(resp *stunMessage, raddr net.Addr, base *Base) {
 		retransmit.Stop()
+		cl.measureRTT(p, resp, c.Now().Sub(sent))
 		cl.processResponse(p, resp, raddr)
 	})
 }
 
-// Compute retransmission time.
-// https://tools.ietf.org/html/rfc8445#section-14.3
-func (cl *Checklist) rto() time.Duration {
+// Build a binding request for a connectivity check or keepalive on pair p.
+func (cl *Checklist) newBindingRequest(p *CandidatePair, useCandidate bool) *stunMessage {
+	req := newStunBindingRequest("")
+	req.addAttribute(stunAttrUsername, []byte(cl.username))
+	if cl.controlling {
+		req.addAttribute(stunAttrIceControlling, cl.tieBreaker)
+		if useCandidate {
+			req.addAttribute(stunAttrUseCandidate, nil)
+		}
+	} else {
+		req.addAttribute(stunAttrIceControlled, cl.tieBreaker)
+	}
+	req.addPriority(p.local.peerPriority())
+	req.addMessageIntegrity(cl.remotePassword)
+	req.addFingerprint()
+	return req
+}
+
+// Update the round-trip time of pair p with a successful response.
+func (cl *Checklist) measureRTT(p *CandidatePair, resp *stunMessage, rtt time.Duration) {
+	if resp.class != stunSuccessResponse {
+		return
+	}
+	cl.mutex.Lock()
+	p.updateRTT(rtt)
+	cl.mutex.Unlock()
+}
+
+// Bounds on the RTO of a pair whose round-trip time has been measured.
+const (
+	minCheckRTO = 100 * time.Millisecond
+	maxCheckRTO = 3 * time.Second
+)
+
+// Keepalives are due on each pair within this fraction of the keepalive
+// interval.
+const keepaliveChecksPerInterval = 5
+
+// Compute the retransmission time for a check on pair p. Must be called with
+// the mutex held. Once the pair's round-trip time has been measured, the RTO
+// follows it [RFC6298 §2]; until then, it allows for the checks on other
+// pairs paced ahead of the response [RFC8445 §14.3].
+func (cl *Checklist) rto(p *CandidatePair) time.Duration {
+	if p.srtt > 0 {
+		rto := p.srtt + 4*p.rttvar
+		if rto < minCheckRTO {
+			rto = minCheckRTO
+		} else if rto > maxCheckRTO {
+			rto = maxCheckRTO
+		}
+		return rto
+	}
+
 	n := 0
 	for _, p := range cl.pairs {
 		if p.state == Waiting || p.state == InProgress {
@@ -279,9 +468,48 @@ func (cl *Checklist) rto() time.Duration {
 	return time.Duration(n) * 50 * time.Millisecond
 }
 
+// [RFC8445 §11] Send keepalives on the pairs that are due, to keep their NAT
+// bindings open: every valid pair, so that any can take over from the
+// selected one, with binding requests that also measure its round-trip time
+// [RFC7675 §5.1]. A lite agent sends no requests, only binding indications on
+// the selected pair. A pair is due once the keepalive interval has passed
+// since a check or keepalive was last sent on it.
+func (cl *Checklist) sendKeepalives() {
+	c := clock.Or(cl.clock)
+	now := c.Now()
+	cl.mutex.Lock()
+	var due []*CandidatePair
+	for _, p := range cl.pairs {
+		if p.state != Succeeded || cl.lite && p != cl.selected {
+			continue
+		}
+		if now.Sub(p.lastSent) >= cl.keepaliveInterval {
+			p.lastSent = now
+			due = append(due, p)
+		}
+	}
+	cl.mutex.Unlock()
+
+	for _, p := range due {
+		if cl.lite {
+			p.sendStun(newStunBindingIndication(), nil)
+			continue
+		}
+		pair := p
+		err := p.sendStun(cl.newBindingRequest(p, false), func(resp *stunMessage, raddr net.Addr, base *Base) {
+			cl.measureRTT(pair, resp, c.Now().Sub(now))
+		})
+		if err != nil {
+			log.Debug("Failed to send keepalive on %s: %v", p.id, err)
+		}
+	}
+}
+
 func (cl *Checklist) processResponse(p *CandidatePair, resp *stunMessage, raddr net.Addr) {
+	cl.mutex.Lock()
 	if p.state != InProgress {
-		log.Debug("Received unexpected STUN response for %s:\n%s\n", p, resp)
+		cl.mutex.Unlock()
+		log.Debug("Received unexpected STUN response for %s:\n%s\n", p.id, resp)
 		return
 	}
 
@@ -292,21 +520,53 @@ func (cl *Checklist) processResponse(p *CandidatePair, resp *stunMessage, raddr
 	case stunSuccessResponse:
 		log.Debug("%s: Successful connectivity check", p.id)
 		p.state = Succeeded
+		cl.emitPair(EventCheckSucceeded, p)
+		if base := p.local.base; base != nil {
+			base.trusted.add(raddr)
+		}
+		if cl.controlling && !cl.hasNominated() {
+			// [RFC8445 §8.1.1] Nominate the first valid pair, by repeating
+			// the check with USE-CANDIDATE.
+			log.Debug("Nominating %s\n", p.id)
+			p.nominated = true
+			cl.emitPair(EventNominated, p)
+			cl.triggeredQueue = append(cl.triggeredQueue, p)
+			cl.mutex.Unlock()
+			return
+		}
 	case stunErrorResponse:
 		p.state = Failed
+		cl.emitPair(EventCheckFailed, p)
 		// TODO: Retries
 	default:
-		log.Fatalf("Impossible")
+		cl.mutex.Unlock()
+		log.Debug("Received STUN %s that is not a response for %s", resp, p.id)
+		return
 	}
+	cl.mutex.Unlock()
 
 	cl.updateState(p)
 }
 
+// Whether the controlling agent has nominated a pair yet. Must be called with
+// the mutex held.
+func (cl *Checklist) hasNominated() bool {
+	for _, p := range cl.pairs {
+		if p.nominated {
+			return true
+		}
+	}
+	return false
+}
+
 func (cl *Checklist) nominate(p *CandidatePair) {
+	cl.mutex.Lock()
 	if p.state == Frozen {
 		p.state = Waiting
 	}
 	p.nominated = true
+	cl.emitPair(EventNominated, p)
+	cl.mutex.Unlock()
 	cl.updateState(p)
 }
 
@@ -326,12 +586,76 @@ func (cl *Checklist) updateState(p *CandidatePair) {
 		if cl.selected == nil || p.Priority() > cl.selected.Priority() {
 			log.Info("Selected %s", p)
 			cl.selected = p
+			cl.emitPair(EventSelected, p)
 		}
 		cl.state = checklistCompleted
 		go cl.notifyListeners()
 	}
 
-	// TODO: Handle checklist failure
+	cl.checkFailure()
+}
+
+// Record that local candidate gathering has finished.
+func (cl *Checklist) setGatheringDone() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.gatheringDone = true
+	cl.checkFailure()
+}
+
+// Record that the remote peer has signaled end-of-candidates, and every
+// remote candidate has been added.
+func (cl *Checklist) setRemoteDone() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.remoteDone = true
+	cl.checkFailure()
+}
+
+// [RFC8445 §7.2.5.3.3] Fail the checklist once every pair has failed and no
+// more can be added, i.e. gathering has finished and the remote peer has
+// signaled end-of-candidates [RFC8838 §8]. A lite agent never fails, since it
+// sends no checks of its own. Must be called with the mutex held.
+func (cl *Checklist) checkFailure() {
+	if cl.state != checklistRunning || cl.selected != nil || cl.lite || !cl.gatheringDone || !cl.remoteDone {
+		return
+	}
+	for _, p := range cl.pairs {
+		if p.state != Failed {
+			return
+		}
+	}
+	log.Warn("ICE failed: all %d candidate pairs failed", len(cl.pairs))
+	cl.setFailed()
+}
+
+// Fail the checklist, unless it already completed or failed. Must be called
+// with the mutex held.
+func (cl *Checklist) setFailed() {
+	if cl.state != checklistRunning {
+		return
+	}
+	cl.state = checklistFailed
+	cl.emit(EventFailed)
+	go cl.notifyListeners()
+}
+
+// [RFC7675 §5.1] Report when the remote peer stops sending checks on the
+// selected pair.
+func (cl *Checklist) checkConsent() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	p := cl.selected
+	now := clock.Or(cl.clock).Now()
+	if p == nil || p.consentLost || now.Sub(p.lastCheckReceived) < cl.consentTimeout {
+		return
+	}
+	log.Warn("No connectivity checks from remote peer on %s for %v", p.id, cl.consentTimeout)
+	p.consentLost = true
+	cl.emitPair(EventConsentLost, p)
 }
 
 func (cl *Checklist) addListener() (int, <-chan checklistState) {
@@ -364,12 +688,11 @@ func (cl *Checklist) notifyListeners() {
 	}
 }
 
-// findPair returns first candidate pair matching the base and remote address
-func (cl *Checklist) findPair(base *Base, raddr net.Addr) *CandidatePair {
-	remoteAddress := makeTransportAddress(raddr)
-
+// findPair returns first candidate pair matching the base and remote address.
+// Must be called with the mutex held.
+func (cl *Checklist) findPair(base *Base, remoteAddress TransportAddress) *CandidatePair {
 	for _, p := range cl.pairs {
-		if p.local.address == base.address && p.remote.address == remoteAddress {
+		if p.local.base.address == base.address && p.remote.address == remoteAddress {
 			return p
 		}
 	}
@@ -378,9 +701,10 @@ func (cl *Checklist) findPair(base *Base, raddr net.Addr) *CandidatePair {
 }
 
 func (cl *Checklist) triggerCheck(p *CandidatePair) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
 	if p.state == Frozen || p.state == Waiting {
-		cl.mutex.Lock()
 		cl.triggeredQueue = append(cl.triggeredQueue, p)
-		cl.mutex.Unlock()
 	}
 }
@@ -1,8 +1,13 @@
 package ice
 
 import (
+	"context"
 	"net"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
 )
 
 func TestSortInPriorityOrder(t *testing.T) {
@@ -68,6 +73,92 @@ func TestPruneSkipsInProgress(t *testing.T) {
 	}
 }
 
+func TestLiteSelectsOnUseCandidate(t *testing.T) {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	cl := &Checklist{
+		lite:          true,
+		priorityTable: &PriorityTable{ipv4: 65534, ipv6: 65535},
+	}
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	// A check without USE-CANDIDATE succeeds, but does not select the pair.
+	req := newStunBindingRequest("")
+	req.addPriority(1000)
+	cl.handleStunRequest(req, raddr, base)
+	if cl.selected != nil {
+		t.Fatalf("Pair should not be selected before nomination: %s", cl.selected)
+	}
+	if len(cl.triggeredQueue) != 0 {
+		t.Errorf("Lite agent should not trigger checks: %v", cl.triggeredQueue)
+	}
+
+	// Nomination selects the pair immediately.
+	req = newStunBindingRequest("")
+	req.addPriority(1000)
+	req.addAttribute(stunAttrUseCandidate, nil)
+	cl.handleStunRequest(req, raddr, base)
+	if cl.selected == nil || cl.selected.state != Succeeded {
+		t.Errorf("Nominated pair should be selected: %+v", cl.selected)
+	}
+}
+
+func TestLiteEvents(t *testing.T) {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	var events []EventType
+	fake := clock.NewFake(time.Unix(0, 0))
+	cl := &Checklist{
+		lite:           true,
+		priorityTable:  &PriorityTable{ipv4: 65534, ipv6: 65535},
+		consentTimeout: defaultConsentTimeout,
+		clock:          fake,
+		onEvent: func(e Event) {
+			events = append(events, e.Type)
+		},
+	}
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	req := newStunBindingRequest("")
+	req.addPriority(1000)
+	cl.handleStunRequest(req, raddr, base)
+
+	req = newStunBindingRequest("")
+	req.addPriority(1000)
+	req.addAttribute(stunAttrUseCandidate, nil)
+	cl.handleStunRequest(req, raddr, base)
+
+	expected := []EventType{
+		EventPairCreated,
+		EventCheckReceived,
+		EventCheckSucceeded,
+		EventCheckReceived,
+		EventNominated,
+		EventSelected,
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Got events %v, expected %v", events, expected)
+	}
+
+	// Consent is lost once checks stop.
+	events = nil
+	cl.checkConsent()
+	fake.Advance(defaultConsentTimeout)
+	cl.checkConsent()
+	cl.checkConsent()
+	if !reflect.DeepEqual(events, []EventType{EventConsentLost}) {
+		t.Errorf("Got events %v, expected consent loss", events)
+	}
+}
+
 // cand returns a Candidate with a specified priority and IP address. Not all
 // Candidate fields are populated.
 func cand(priority uint32, ip string, port int) Candidate {
@@ -78,3 +169,313 @@ func cand(priority uint32, ip string, port int) Candidate {
 	c.address.port = port
 	return c
 }
+
+func TestPeerReflexiveRemoteCandidate(t *testing.T) {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	cl := &Checklist{priorityTable: &PriorityTable{ipv4: 65534, ipv6: 65535}}
+	local := makeHostCandidate(cl.priorityTable, base)
+	cl.addLocalCandidate(local)
+
+	// A check from an unknown address pairs the base's candidate with a new
+	// peer-reflexive candidate, with the check's priority.
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	req := newStunBindingRequest("")
+	req.addPriority(1000)
+	cl.handleStunRequest(req, raddr, base)
+	if len(cl.pairs) != 1 {
+		t.Fatalf("Got %d pairs, expected 1", len(cl.pairs))
+	}
+	p := cl.pairs[0]
+	if p.local.priority != local.priority || p.remote.typ != prflxType || p.remote.priority != 1000 {
+		t.Fatalf("Unexpected pair %s: %s -> %s", p.id, p.local, p.remote)
+	}
+
+	// Once signaled, the candidate takes the peer-reflexive one's place.
+	remote := Candidate{address: makeTransportAddress(raddr), typ: hostType, priority: 2000, component: 1}
+	cl.addRemoteCandidate(remote)
+	if len(cl.pairs) != 1 || cl.pairs[0] != p || len(cl.remoteCandidates) != 1 {
+		t.Fatalf("Signaled candidate should replace the peer-reflexive one: %v", cl.pairs)
+	}
+	if p.remote.typ != hostType || p.remote.priority != 2000 {
+		t.Errorf("Pair should have the signaled candidate: %s", p.remote)
+	}
+}
+
+func TestControllingPairPriority(t *testing.T) {
+	p := newCandidatePair(1, cand(100, "1.1.1.1", 1000), cand(200, "2.2.2.2", 2000))
+	if p.Priority() != 100<<32+200<<1+1 {
+		t.Errorf("Controlled priority is %d", p.Priority())
+	}
+	p.controlling = true
+	if p.Priority() != 100<<32+200<<1 {
+		t.Errorf("Controlling priority is %d", p.Priority())
+	}
+}
+
+func TestControllingNominates(t *testing.T) {
+	cl := &Checklist{controlling: true}
+	p := newCandidatePair(1, cand(100, "1.1.1.1", 1000), cand(100, "2.2.2.2", 2000))
+	cl.pairs = []*CandidatePair{p}
+	raddr := &net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 2000}
+
+	// The first successful check nominates the pair, which is checked again.
+	p.state = InProgress
+	cl.processResponse(p, newStunBindingResponse("", raddr, ""), raddr)
+	if !p.nominated || cl.nextPair() != p {
+		t.Fatalf("Pair should be nominated and checked again: %s", p)
+	}
+	if cl.selected != nil {
+		t.Fatalf("Pair should not be selected before the nomination succeeds")
+	}
+
+	// Once the check with USE-CANDIDATE succeeds, the pair is selected.
+	p.state = InProgress
+	cl.processResponse(p, newStunBindingResponse("", raddr, ""), raddr)
+	if cl.selected != p {
+		t.Errorf("Nominated pair should be selected: %+v", cl.selected)
+	}
+}
+
+func TestCheckRetransmitsThenFails(t *testing.T) {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	var failed []EventType
+	fake := clock.NewFake(time.Unix(0, 0))
+	cl := &Checklist{
+		priorityTable: &PriorityTable{ipv4: 65534, ipv6: 65535},
+		clock:         fake,
+		onEvent: func(e Event) {
+			if e.Type == EventCheckFailed {
+				failed = append(failed, e.Type)
+			}
+		},
+	}
+	remote := cand(100, "127.0.0.1", 9)
+	remote.component = 1
+	p := newCandidatePair(1, makeHostCandidate(cl.priorityTable, base), remote)
+	p.state = Waiting
+	cl.pairs = []*CandidatePair{p}
+
+	// Nobody answers on the discard port, so each check times out after the
+	// RTO, which is 50ms for the lone pair, and the pair goes back to Waiting.
+	for i := 1; i <= 4; i++ {
+		if err := cl.sendCheck(p); err != nil {
+			t.Fatal(err)
+		}
+		if p.state != InProgress {
+			t.Fatalf("Check %d: pair is %s", i, p.state)
+		}
+		fake.Advance(49 * time.Millisecond)
+		if p.state != InProgress {
+			t.Fatalf("Check %d timed out early", i)
+		}
+		fake.Advance(time.Millisecond)
+		if i < 4 && p.state != Waiting {
+			t.Fatalf("Check %d: pair is %s after RTO", i, p.state)
+		}
+	}
+	if p.state != Failed || len(failed) != 1 {
+		t.Errorf("Pair should fail after 4 checks: %s, events %v", p, failed)
+	}
+}
+
+func TestChecklistFailsOnceComplete(t *testing.T) {
+	var events []EventType
+	cl := &Checklist{
+		onEvent: func(e Event) {
+			events = append(events, e.Type)
+		},
+	}
+	p := newCandidatePair(1, cand(100, "1.1.1.1", 1000), cand(100, "2.2.2.2", 2000))
+	p.state = InProgress
+	cl.pairs = []*CandidatePair{p}
+	raddr := &net.UDPAddr{IP: net.IPv4(2, 2, 2, 2), Port: 2000}
+	cl.processResponse(p, newStunMessage(stunErrorResponse, stunBindingMethod, ""), raddr)
+
+	// More pairs may follow until both sides are done with candidates.
+	cl.setGatheringDone()
+	if cl.state != checklistRunning {
+		t.Fatalf("Checklist failed before end-of-candidates")
+	}
+	cl.setRemoteDone()
+	if cl.state != checklistFailed {
+		t.Fatalf("Checklist should fail once every pair failed")
+	}
+	if !reflect.DeepEqual(events, []EventType{EventCheckFailed, EventFailed}) {
+		t.Errorf("Got events %v", events)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := cl.getSelected(ctx, nil); err != ErrFailed {
+		t.Errorf("getSelected returned %v, expected ErrFailed", err)
+	}
+}
+
+func TestConsentLostWhileRunning(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	events := make(chan EventType, 1)
+	cl := &Checklist{
+		lite:              true,
+		keepaliveInterval: time.Hour, // no base to send keepalives on
+		consentTimeout:    defaultConsentTimeout,
+		clock:             fake,
+		onEvent: func(e Event) {
+			events <- e.Type
+		},
+	}
+	p := newCandidatePair(1, cand(100, "1.1.1.1", 1000), cand(100, "2.2.2.2", 2000))
+	p.lastCheckReceived = fake.Now()
+	cl.pairs = []*CandidatePair{p}
+	cl.selected = p
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cl.run(ctx)
+	fake.WaitForTimers(3)
+
+	// Consent is checked every 5 seconds, and lost once 30 seconds pass
+	// without checks from the remote peer.
+	for i := 0; i < 5; i++ {
+		fake.Advance(defaultConsentTimeout / 6)
+		select {
+		case e := <-events:
+			t.Fatalf("Unexpected %s after %v", e, fake.Now().Sub(time.Unix(0, 0)))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	fake.Advance(defaultConsentTimeout / 6)
+	select {
+	case e := <-events:
+		if e != EventConsentLost {
+			t.Errorf("Got %s, expected consent loss", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("Consent not lost after timeout")
+	}
+}
+
+func TestUpdateRTT(t *testing.T) {
+	p := &CandidatePair{}
+	p.updateRTT(100 * time.Millisecond)
+	if p.srtt != 100*time.Millisecond || p.rttvar != 50*time.Millisecond {
+		t.Errorf("First measurement: srtt %v, rttvar %v", p.srtt, p.rttvar)
+	}
+	p.updateRTT(20 * time.Millisecond)
+	if p.srtt != 90*time.Millisecond || p.rttvar != 57500*time.Microsecond {
+		t.Errorf("Second measurement: srtt %v, rttvar %v", p.srtt, p.rttvar)
+	}
+
+	// A clock too coarse to measure still counts.
+	p = &CandidatePair{}
+	p.updateRTT(0)
+	if p.srtt == 0 {
+		t.Error("Zero measurement was ignored")
+	}
+}
+
+func TestRTOFollowsRTT(t *testing.T) {
+	cl := &Checklist{}
+	p := newCandidatePair(1, cand(100, "1.1.1.1", 1000), cand(100, "2.2.2.2", 2000))
+	p.state = InProgress
+	cl.pairs = []*CandidatePair{p}
+
+	// Until measured, the RTO paces the checks in flight.
+	if rto := cl.rto(p); rto != 50*time.Millisecond {
+		t.Errorf("Unmeasured RTO is %v", rto)
+	}
+
+	p.srtt, p.rttvar = 200*time.Millisecond, 50*time.Millisecond
+	if rto := cl.rto(p); rto != 400*time.Millisecond {
+		t.Errorf("RTO is %v, expected 400ms", rto)
+	}
+	p.srtt, p.rttvar = time.Millisecond, 0
+	if rto := cl.rto(p); rto != minCheckRTO {
+		t.Errorf("RTO is %v, expected the minimum", rto)
+	}
+	p.srtt, p.rttvar = 5*time.Second, time.Second
+	if rto := cl.rto(p); rto != maxCheckRTO {
+		t.Errorf("RTO is %v, expected the maximum", rto)
+	}
+}
+
+func TestKeepaliveMeasuresRTT(t *testing.T) {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	go base.readLoop(func(*stunMessage, net.Addr, *Base) {}, make(chan []byte, 1), time.Minute)
+
+	// The remote peer answers binding requests after 20ms.
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	requests := make(chan struct{}, 4)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := peer.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := parseStunMessage(buf[:n])
+			if err != nil || req.class != stunRequest {
+				continue
+			}
+			requests <- struct{}{}
+			time.Sleep(20 * time.Millisecond)
+			peer.WriteTo(newStunBindingResponse(req.transactionID, raddr, "").Bytes(), raddr)
+		}
+	}()
+
+	cl := &Checklist{
+		keepaliveInterval: time.Hour,
+		priorityTable:     &PriorityTable{ipv4: 65534, ipv6: 65535},
+	}
+	remote := Candidate{address: makeTransportAddress(peer.LocalAddr()), component: 1}
+	p := newCandidatePair(1, makeHostCandidate(cl.priorityTable, base), remote)
+	p.state = Succeeded
+	cl.pairs = []*CandidatePair{p}
+
+	// The valid pair is due, having never been sent anything, and then not
+	// again within the interval.
+	cl.sendKeepalives()
+	cl.sendKeepalives()
+	<-requests
+	deadline := time.Now().Add(time.Second)
+	for {
+		cl.mutex.Lock()
+		srtt := p.srtt
+		cl.mutex.Unlock()
+		if srtt != 0 {
+			if srtt < 20*time.Millisecond {
+				t.Errorf("RTT is %v, expected at least 20ms", srtt)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Keepalive response did not measure RTT")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case <-requests:
+		t.Error("Keepalive sent again before the interval")
+	default:
+	}
+	if p.state != Succeeded {
+		t.Errorf("Keepalive changed pair state to %s", p.state)
+	}
+}
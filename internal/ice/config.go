@@ -0,0 +1,101 @@
+package ice
+
+import (
+	"net"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/lanikai/alohartc/internal/leak"
+)
+
+// AgentConfig holds optional settings for an ICE Agent. The zero value is a
+// valid configuration.
+type AgentConfig struct {
+	// InterfaceFilter, if non-nil, is called for each address of each local
+	// network interface that is up. Addresses for which it returns false are
+	// excluded from candidate gathering.
+	InterfaceFilter func(name string, ip net.IP) bool
+
+	// Loopback includes loopback interfaces, which are otherwise skipped, so
+	// that peers on the same host can connect without any network.
+	Loopback bool
+
+	// Lite selects an ICE-lite implementation [RFC8445 §2.5], for agents with
+	// a publicly routable address. Only host candidates are gathered, and no
+	// connectivity checks are sent; the agent merely responds to the remote
+	// peer's checks. The SDP must advertise "a=ice-lite".
+	Lite bool
+
+	// LANOnly gathers only host candidates, so that no STUN or TURN server
+	// is contacted, for closed networks without internet access.
+	LANOnly bool
+
+	// MDNSCandidates also gathers, for each host candidate, one that
+	// advertises an ephemeral mDNS hostname, for peers such as browsers that
+	// hide their own addresses behind mDNS and expect the same. The global
+	// mDNS client must be started.
+	MDNSCandidates bool
+
+	// TURNServers are used to gather relayed candidates, unless Lite or
+	// LANOnly is set.
+	TURNServers []TURNServer
+
+	// NAT1To1, if set, gives the public addresses of a host behind 1:1 NAT,
+	// for candidates that need no STUN server.
+	NAT1To1 NAT1To1
+
+	// PortRange, if non-zero, restricts the local UDP ports of every socket,
+	// including those to TURN servers.
+	PortRange PortRange
+
+	// GatheringTimeout, if non-zero, limits how long candidate gathering
+	// may take, so that a slow STUN or TURN server doesn't hold up the end
+	// of candidates. Candidates not gathered in time are abandoned.
+	GatheringTimeout time.Duration
+
+	// KeepaliveInterval is how often a keepalive is sent on each valid pair
+	// to keep NAT bindings open [RFC8445 §11]: a binding request, which also
+	// measures the pair's round-trip time, or, from a lite agent, a binding
+	// indication on the selected pair. Defaults to 30 seconds.
+	KeepaliveInterval time.Duration
+
+	// ConsentTimeout is how long the selected pair may go without a
+	// connectivity check from the remote peer before EventConsentLost is
+	// emitted [RFC7675 §5.1]. Defaults to 30 seconds.
+	ConsentTimeout time.Duration
+
+	// ReadTimeout is how long a base may go without receiving any packet
+	// before it is closed. When the base of the selected pair closes, the
+	// DataStream fails. Defaults to 5 seconds.
+	ReadTimeout time.Duration
+
+	// DSCP, if non-zero, marks every packet sent with a Differentiated
+	// Services code point, e.g. DSCPAF41, so that routers with QoS can
+	// prioritize the media [RFC8837]. SocketPriority, if non-zero, sets the
+	// Linux SO_PRIORITY of every socket, for local queueing disciplines.
+	DSCP           int
+	SocketPriority int
+
+	// ReadBufferSize and WriteBufferSize, if non-zero, set the sizes in bytes
+	// of every socket's receive and send buffers. The defaults of embedded
+	// kernels can be too small for bursts of high-bitrate video. On Linux the
+	// net.core.rmem_max and wmem_max limits apply unless the process has
+	// CAP_NET_ADMIN.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Clock times connectivity checks, keepalives, and consent, so that
+	// tests can drive them with a fake clock. Defaults to the system clock.
+	Clock clock.Clock
+
+	// Resources, if non-nil, accounts for the agent's sockets and
+	// goroutines, which are all released once the context passed to Start
+	// is done.
+	Resources *leak.Tracker
+}
+
+const (
+	defaultKeepaliveInterval = 30 * time.Second
+	defaultConsentTimeout    = 30 * time.Second
+	defaultReadTimeout       = 5 * time.Second
+)
@@ -2,7 +2,12 @@ package ice
 
 import "errors"
 
+// ErrFailed is returned by Agent.GetDataStream when every candidate pair has
+// failed, and no more can be added.
+var ErrFailed = errors.New("ice: all candidate pairs failed")
+
 // Typed errors
 var (
-	errSTUNInvalidMessage = errors.New("ice: STUN message is malformed")
+	errSTUNInvalidMessage  = errors.New("ice: STUN message is malformed")
+	errTooManyTransactions = errors.New("ice: too many outstanding STUN transactions")
 )
@@ -0,0 +1,153 @@
+package ice
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+)
+
+// EventType identifies a step of an Agent's progress.
+type EventType int
+
+const (
+	// A local candidate was gathered.
+	EventCandidateGathered EventType = iota
+
+	// A remote candidate was added.
+	EventRemoteCandidate
+
+	// A candidate pair was added to the checklist.
+	EventPairCreated
+
+	// A connectivity check was sent on a pair.
+	EventCheckSent
+
+	// A connectivity check was received from the remote peer on a pair.
+	EventCheckReceived
+
+	// A connectivity check on a pair succeeded.
+	EventCheckSucceeded
+
+	// A connectivity check on a pair failed, or timed out too many times.
+	EventCheckFailed
+
+	// The remote peer nominated a pair.
+	EventNominated
+
+	// A pair was selected for sending and receiving data.
+	EventSelected
+
+	// The remote peer stopped sending connectivity checks on the selected
+	// pair, so it may no longer be reachable.
+	EventConsentLost
+
+	// Candidate gathering finished, or timed out, so no more local
+	// candidates follow.
+	EventGatheringComplete
+
+	// Every candidate pair failed, and no more can be added, since gathering
+	// is complete and the remote peer signaled end-of-candidates.
+	EventFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCandidateGathered:
+		return "candidate-gathered"
+	case EventRemoteCandidate:
+		return "remote-candidate"
+	case EventPairCreated:
+		return "pair-created"
+	case EventCheckSent:
+		return "check-sent"
+	case EventCheckReceived:
+		return "check-received"
+	case EventCheckSucceeded:
+		return "check-succeeded"
+	case EventCheckFailed:
+		return "check-failed"
+	case EventNominated:
+		return "nominated"
+	case EventSelected:
+		return "selected"
+	case EventConsentLost:
+		return "consent-lost"
+	case EventGatheringComplete:
+		return "gathering-complete"
+	case EventFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// An Event describes a step of an Agent's progress, e.g. for a connection
+// diagnostics UI.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// The candidate, for EventCandidateGathered and EventRemoteCandidate.
+	Candidate *Candidate
+
+	// The candidate pair, for the events of connectivity checks.
+	Pair *PairInfo
+}
+
+// PairInfo is a snapshot of a candidate pair.
+type PairInfo struct {
+	ID        string
+	Local     Candidate
+	Remote    Candidate
+	State     CandidatePairState
+	Nominated bool
+
+	// Smoothed round-trip time of the pair's binding requests, or zero
+	// until measured.
+	RTT time.Duration
+}
+
+func (e Event) String() string {
+	switch {
+	case e.Candidate != nil:
+		return fmt.Sprintf("%s %s", e.Type, e.Candidate)
+	case e.Pair != nil:
+		return fmt.Sprintf("%s %s: %s -> %s [%s]", e.Type, e.Pair.ID, e.Pair.Local.address, e.Pair.Remote.address, e.Pair.State)
+	default:
+		return e.Type.String()
+	}
+}
+
+// OnEvent registers a function to call with each event, e.g. to display the
+// progress of connectivity checks. It must be called before Start. The
+// function is called synchronously from the agent's goroutines, so it must
+// return quickly, and must not call the agent's methods.
+func (a *Agent) OnEvent(f func(Event)) {
+	a.checklist.onEvent = f
+}
+
+func (cl *Checklist) emit(t EventType) {
+	if cl.onEvent != nil {
+		cl.onEvent(Event{Type: t, Time: clock.Or(cl.clock).Now()})
+	}
+}
+
+func (cl *Checklist) emitCandidate(t EventType, c Candidate) {
+	if cl.onEvent != nil {
+		cl.onEvent(Event{Type: t, Time: clock.Or(cl.clock).Now(), Candidate: &c})
+	}
+}
+
+func (cl *Checklist) emitPair(t EventType, p *CandidatePair) {
+	if cl.onEvent != nil {
+		cl.onEvent(Event{Type: t, Time: clock.Or(cl.clock).Now(), Pair: &PairInfo{
+			ID:        p.id,
+			Local:     p.local,
+			Remote:    p.remote,
+			State:     p.state,
+			Nominated: p.nominated,
+			RTT:       p.srtt,
+		}})
+	}
+}
@@ -0,0 +1,12 @@
+// +build gofuzz
+
+package ice
+
+// Fuzz is the entry point for go-fuzz. See the README for usage. The corpus in
+// testdata/fuzz/corpus holds binding requests, responses, and indications.
+func Fuzz(data []byte) int {
+	if _, err := parseStunMessage(data); err != nil {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,119 @@
+package ice
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits on the resources that unsolicited traffic can consume, so that a
+// flood at a base's UDP port can't exhaust memory.
+const (
+	// Maximum number of outstanding STUN transactions per base. Requests that
+	// go unanswered for longer than timeoutTransaction are forgotten.
+	maxTransactionHandlers = 256
+
+	// RFC 5389 §7.2.1: a transaction times out after 39.5s by default.
+	timeoutTransaction = 40 * time.Second
+
+	// Maximum number of packets accepted from one source address per
+	// rateLimitWindow. Generous enough for a received video stream.
+	maxPacketsPerSource = 2000
+
+	// Maximum number of distinct source addresses tracked per base per
+	// rateLimitWindow. Packets from further sources are dropped until the
+	// window ends, except from trusted sources.
+	maxSourcesPerWindow = 64
+
+	rateLimitWindow = time.Second
+)
+
+// Counters for packets and transactions dropped because of the limits above.
+// Accessed atomically.
+var counters struct {
+	rateLimited     uint64
+	malformed       uint64
+	rejectedHandler uint64
+}
+
+// IngressCounters reports how much incoming traffic has been dropped since
+// the process started.
+type IngressCounters struct {
+	// Packets dropped because their source exceeded the per-source rate
+	// limit, or too many sources were active at once.
+	RateLimitedPackets uint64
+
+	// STUN packets dropped because they could not be parsed.
+	MalformedPackets uint64
+
+	// Outgoing STUN requests abandoned because the transaction table was
+	// full.
+	RejectedTransactions uint64
+}
+
+// GetIngressCounters returns a snapshot of the ingress counters.
+func GetIngressCounters() IngressCounters {
+	return IngressCounters{
+		RateLimitedPackets:   atomic.LoadUint64(&counters.rateLimited),
+		MalformedPackets:     atomic.LoadUint64(&counters.malformed),
+		RejectedTransactions: atomic.LoadUint64(&counters.rejectedHandler),
+	}
+}
+
+// Source addresses that have passed connectivity checks with a base, so that
+// a flood from other sources can't lock out the remote peer.
+type trustedSources struct {
+	mu    sync.RWMutex
+	addrs map[string]bool
+}
+
+func (t *trustedSources) add(addr net.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.addrs == nil {
+		t.addrs = make(map[string]bool)
+	}
+	t.addrs[addr.String()] = true
+}
+
+func (t *trustedSources) contains(key string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.addrs[key]
+}
+
+// A sourceLimiter counts packets per source address in fixed windows. It is
+// used only from a base's read loop, so it needs no locking.
+type sourceLimiter struct {
+	windowStart time.Time
+	counts      map[string]int
+
+	// Sources exempt from the limits, or nil.
+	trusted *trustedSources
+}
+
+// Record a packet from addr, and report whether it should be processed.
+func (l *sourceLimiter) allow(addr net.Addr, now time.Time) bool {
+	key := addr.String()
+	if l.trusted != nil && l.trusted.contains(key) {
+		return true
+	}
+
+	if l.counts == nil || now.Sub(l.windowStart) >= rateLimitWindow {
+		l.windowStart = now
+		l.counts = make(map[string]int)
+	}
+
+	n, ok := l.counts[key]
+	if !ok && len(l.counts) >= maxSourcesPerWindow {
+		atomic.AddUint64(&counters.rateLimited, 1)
+		return false
+	}
+	if n >= maxPacketsPerSource {
+		atomic.AddUint64(&counters.rateLimited, 1)
+		return false
+	}
+	l.counts[key] = n + 1
+	return true
+}
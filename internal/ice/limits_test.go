@@ -0,0 +1,86 @@
+package ice
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSourceLimiter(t *testing.T) {
+	var l sourceLimiter
+	now := time.Now()
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+
+	for i := 0; i < maxPacketsPerSource; i++ {
+		if !l.allow(peer, now) {
+			t.Fatalf("packet %d dropped", i)
+		}
+	}
+	if l.allow(peer, now) {
+		t.Error("packet over the per-source limit was allowed")
+	}
+
+	// Other sources are unaffected, up to the limit on sources.
+	for i := 1; i < maxSourcesPerWindow; i++ {
+		if !l.allow(&net.UDPAddr{IP: net.IPv4(10, 0, 1, byte(i)), Port: 5000}, now) {
+			t.Fatalf("source %d dropped", i)
+		}
+	}
+	if l.allow(&net.UDPAddr{IP: net.IPv4(10, 0, 2, 1), Port: 5000}, now) {
+		t.Error("packet from source over the limit was allowed")
+	}
+
+	// Counts reset in the next window.
+	if !l.allow(peer, now.Add(rateLimitWindow)) {
+		t.Error("packet dropped in new window")
+	}
+}
+
+func TestSourceLimiterTrusted(t *testing.T) {
+	var trusted trustedSources
+	l := sourceLimiter{trusted: &trusted}
+	now := time.Now()
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+
+	// The peer passes a connectivity check before the flood begins.
+	if !l.allow(peer, now) {
+		t.Fatal("packet from peer dropped")
+	}
+	trusted.add(peer)
+
+	// A flood from many sources uses up every slot.
+	for i := 0; i < 4*maxSourcesPerWindow; i++ {
+		l.allow(&net.UDPAddr{IP: net.IPv4(10, 0, byte(1+i/256), byte(i)), Port: 5000}, now)
+	}
+	if l.allow(&net.UDPAddr{IP: net.IPv4(10, 0, 9, 1), Port: 5000}, now) {
+		t.Error("packet from untrusted source over the limit was allowed")
+	}
+
+	// The established peer is neither locked out nor held to the per-source
+	// limit.
+	for i := 0; i < 2*maxPacketsPerSource; i++ {
+		if !l.allow(peer, now) {
+			t.Fatalf("packet %d from trusted peer dropped", i)
+		}
+	}
+}
+
+func TestTransactionHandlersLimit(t *testing.T) {
+	var handlers transactionHandlers
+	noop := func(*stunMessage, net.Addr, *Base) {}
+	for i := 0; i < maxTransactionHandlers; i++ {
+		if err := handlers.put(fmt.Sprintf("%012d", i), noop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := handlers.put("overflow", noop); err != errTooManyTransactions {
+		t.Errorf("expected errTooManyTransactions, got %v", err)
+	}
+
+	// Transactions that have timed out make room for new ones.
+	handlers.m["000000000000"] = transaction{noop, time.Now().Add(-2 * timeoutTransaction)}
+	if err := handlers.put("overflow", noop); err != nil {
+		t.Error(err)
+	}
+}
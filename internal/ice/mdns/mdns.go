@@ -6,7 +6,9 @@ package mdns
 
 import (
 	"context"
+	"crypto/rand"
 	"errors"
+	"fmt"
 	"net"
 	"time"
 
@@ -18,6 +20,8 @@ var log = logging.DefaultLogger.WithTag("mdns")
 // Global client instance.
 var _client *Client
 
+var errNotStarted = errors.New("mdns: global client not started")
+
 // Initialize global mDNS client.
 func Start() error {
 	if _client != nil {
@@ -33,24 +37,44 @@ func Start() error {
 	return nil
 }
 
+// Stop the global mDNS client, if started.
 func Stop() {
-	checkStarted()
+	if _client == nil {
+		return
+	}
 	_client.Close()
 	_client = nil
 }
 
+// Resolve name with the global mDNS client, which must be started.
 func Resolve(ctx context.Context, name string) (net.IP, error) {
-	checkStarted()
+	if _client == nil {
+		return nil, errNotStarted
+	}
 	return _client.Resolve(ctx, name)
 }
 
+// Announce name with the global mDNS client, which must be started.
 func Announce(ctx context.Context, name string, ip net.IP, ttl time.Duration) error {
-	checkStarted()
+	if _client == nil {
+		return errNotStarted
+	}
 	return _client.Announce(ctx, name, ip, ttl)
 }
 
-func checkStarted() {
-	if _client == nil {
-		panic("mdns: global client never started")
+// Started reports whether the global mDNS client is running.
+func Started() bool {
+	return _client != nil
+}
+
+// NewName returns a fresh ephemeral hostname, a random version 4 UUID followed
+// by ".local", to announce in place of an IP address.
+func NewName() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err)
 	}
+	u[6] = u[6]&0x0f | 0x40 // Version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x.local", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
 }
@@ -0,0 +1,100 @@
+package ice
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NAT1To1 describes the public addresses of a host behind 1:1 NAT, e.g. a
+// cloud instance, so that candidates for them can be gathered without a STUN
+// server. The NAT must preserve ports. The zero value maps nothing.
+type NAT1To1 struct {
+	// Public IP addresses, each either "PUBLIC", for every local address of
+	// the same family, or "PUBLIC/LOCAL", for one local address. The forms
+	// can't be mixed, and there can be only one of the first per family.
+	IPs []string
+
+	// AsHost advertises host candidates with the public addresses in place
+	// of the local ones. Otherwise, server-reflexive candidates are gathered
+	// with the public addresses, alongside the usual host candidates.
+	AsHost bool
+}
+
+// Public IP addresses, by local address.
+type natMapping struct {
+	byLocal map[string]net.IP
+	asHost  bool
+
+	// Public addresses for every local address of each family.
+	ip4, ip6 net.IP
+}
+
+// Check returns an error if any of the addresses are invalid.
+func (n NAT1To1) Check() error {
+	_, err := n.parse()
+	return err
+}
+
+func (n NAT1To1) parse() (*natMapping, error) {
+	if len(n.IPs) == 0 {
+		return nil, nil
+	}
+	m := &natMapping{byLocal: make(map[string]net.IP), asHost: n.AsHost}
+	for _, s := range n.IPs {
+		public, local := s, ""
+		i := strings.IndexByte(s, '/')
+		if i >= 0 {
+			public, local = s[:i], s[i+1:]
+		}
+		publicIP := net.ParseIP(public)
+		if publicIP == nil {
+			return nil, fmt.Errorf("invalid 1:1 NAT address %q", s)
+		}
+		if i < 0 {
+			if len(m.byLocal) > 0 {
+				return nil, fmt.Errorf("1:1 NAT address %q needs a local address, like the others", s)
+			}
+			all := &m.ip6
+			if publicIP.To4() != nil {
+				all = &m.ip4
+			}
+			if *all != nil {
+				return nil, fmt.Errorf("1:1 NAT address %q needs a local address, to tell it from %s", s, *all)
+			}
+			*all = publicIP
+			continue
+		}
+
+		localIP := net.ParseIP(local)
+		if localIP == nil || (localIP.To4() == nil) != (publicIP.To4() == nil) {
+			return nil, fmt.Errorf("invalid 1:1 NAT address %q", s)
+		}
+		if m.ip4 != nil || m.ip6 != nil {
+			return nil, fmt.Errorf("1:1 NAT address %q has a local address, unlike the others", s)
+		}
+		if _, ok := m.byLocal[localIP.String()]; ok {
+			return nil, fmt.Errorf("1:1 NAT addresses repeat local address %s", local)
+		}
+		m.byLocal[localIP.String()] = publicIP
+	}
+	return m, nil
+}
+
+// Return the public address of a base, if it has one.
+func (m *natMapping) lookup(base *Base) (TransportAddress, bool) {
+	if m == nil || base.address.protocol != UDP || base.address.linkLocal {
+		return TransportAddress{}, false
+	}
+	ip := net.IP(base.address.ip)
+	public, ok := m.byLocal[ip.String()]
+	if !ok && base.address.family == IPv4 {
+		public = m.ip4
+	} else if !ok {
+		public = m.ip6
+	}
+	if public == nil {
+		return TransportAddress{}, false
+	}
+	return makeTransportAddress(&net.UDPAddr{IP: public, Port: base.address.port}), true
+}
@@ -0,0 +1,75 @@
+package ice
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNAT1To1Check(t *testing.T) {
+	valid := [][]string{
+		nil,
+		{"203.0.113.7"},
+		{"203.0.113.7", "2001:db8::7"},
+		{"203.0.113.7/10.0.0.7", "203.0.113.8/10.0.0.8"},
+	}
+	for _, ips := range valid {
+		assert.NoError(t, NAT1To1{IPs: ips}.Check(), "%v", ips)
+	}
+
+	invalid := [][]string{
+		{"example.com"},
+		{"203.0.113.7", "203.0.113.8"},
+		{"203.0.113.7", "203.0.113.8/10.0.0.8"},
+		{"203.0.113.8/10.0.0.8", "203.0.113.7"},
+		{"203.0.113.7/10.0.0.7", "203.0.113.8/10.0.0.7"},
+		{"203.0.113.7/2001:db8::7"},
+		{"203.0.113.7/"},
+	}
+	for _, ips := range invalid {
+		assert.Error(t, NAT1To1{IPs: ips}.Check(), "%v", ips)
+	}
+}
+
+// Gather the candidates of a loopback base with a 1:1 NAT mapping.
+func gatherNAT1To1(t *testing.T, n NAT1To1) []Candidate {
+	base, err := createBase(PortRange{}, net.IPv4(127, 0, 0, 1), 1, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	nat, err := n.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cands []Candidate
+	pt := &PriorityTable{ipv4: 65534, ipv6: 65535}
+	base.gatherCandidates(context.Background(), pt, gatherOptions{reflexive: true, nat: nat}, func(c Candidate) {
+		cands = append(cands, c)
+	})
+	return cands
+}
+
+func TestGatherNAT1To1(t *testing.T) {
+	// The public address is a server-reflexive candidate, found without
+	// querying a STUN server, which would time out.
+	cands := gatherNAT1To1(t, NAT1To1{IPs: []string{"203.0.113.7/127.0.0.1"}})
+	if assert.Len(t, cands, 2) {
+		assert.Equal(t, hostType, cands[0].Type())
+		assert.Equal(t, srflxType, cands[1].Type())
+		assert.Equal(t, "203.0.113.7", net.IP(cands[1].address.ip).String())
+		assert.Equal(t, cands[0].address.port, cands[1].address.port)
+		assert.Equal(t, cands[0].base, cands[1].base)
+	}
+
+	// Or it replaces the host candidate's address.
+	cands = gatherNAT1To1(t, NAT1To1{IPs: []string{"203.0.113.7"}, AsHost: true})
+	if assert.Len(t, cands, 1) {
+		assert.Equal(t, hostType, cands[0].Type())
+		assert.Equal(t, "203.0.113.7", net.IP(cands[0].address.ip).String())
+		assert.Equal(t, "127.0.0.1", net.IP(cands[0].base.address.ip).String())
+	}
+}
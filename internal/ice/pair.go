@@ -2,6 +2,7 @@ package ice
 
 import (
 	"fmt"
+	"time"
 )
 
 type CandidatePair struct {
@@ -14,8 +15,25 @@ type CandidatePair struct {
 	state     CandidatePairState
 	nominated bool
 
+	// Whether the local agent is controlling, which decides the priority.
+	controlling bool
+
 	// Number of failed connectivity checks for this pair.
 	failCount int
+
+	// When the remote peer last sent a connectivity check on this pair, and
+	// whether it has since stopped [RFC7675].
+	lastCheckReceived time.Time
+	consentLost       bool
+
+	// When a connectivity check or keepalive was last sent on this pair, to
+	// schedule its keepalives.
+	lastSent time.Time
+
+	// Smoothed round-trip time of binding requests on this pair, and its
+	// variation [RFC6298 §2]. Zero until measured.
+	srtt   time.Duration
+	rttvar time.Duration
 }
 
 // Candidate pair states
@@ -62,6 +80,24 @@ func newCandidatePair(seq int, local, remote Candidate) *CandidatePair {
 	}
 }
 
+// Update the smoothed round-trip time with a new measurement [RFC6298 §2].
+func (p *CandidatePair) updateRTT(sample time.Duration) {
+	if sample < time.Microsecond {
+		// Keep a measurement from a coarse clock distinct from none.
+		sample = time.Microsecond
+	}
+	if p.srtt == 0 {
+		p.srtt, p.rttvar = sample, sample/2
+		return
+	}
+	diff := p.srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	p.rttvar = (3*p.rttvar + diff) / 4
+	p.srtt = (7*p.srtt + sample) / 8
+}
+
 func (p *CandidatePair) sendStun(msg *stunMessage, handler stunHandler) error {
 	return p.local.base.sendStun(msg, p.remote.address.netAddr(), handler)
 }
@@ -70,10 +106,14 @@ func (p *CandidatePair) String() string {
 	return fmt.Sprintf("%s: %s -> %s [%s]", p.id, p.local.address, p.remote.address, p.state)
 }
 
-// TODO: Handle case where we're the controlling agent.
+// [RFC8445 §6.1.2.3] G is the priority of the controlling agent's candidate,
+// D that of the controlled agent's.
 func (p *CandidatePair) Priority() uint64 {
 	G := uint64(p.remote.priority)
 	D := uint64(p.local.priority)
+	if p.controlling {
+		G, D = D, G
+	}
 	var B uint64 = 0
 	if G > D {
 		B = 1
@@ -0,0 +1,52 @@
+package ice
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"syscall"
+)
+
+// PortRange restricts the local UDP ports an agent binds, e.g. so that a
+// firewall need only open those. The range is inclusive. The zero value
+// allows any port.
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// Check returns an error if the range is not a valid, non-empty range of
+// ports.
+func (r PortRange) Check() error {
+	if r == (PortRange{}) {
+		return nil
+	}
+	if r.Min < 1 || r.Max > 65535 || r.Min > r.Max {
+		return fmt.Errorf("invalid port range %d-%d", r.Min, r.Max)
+	}
+	return nil
+}
+
+// Bind a UDP socket to ip, on a port within the range. Ports are tried in
+// turn from a random starting point, so that agents sharing the range don't
+// all contend for the first port, skipping those already in use.
+func (r PortRange) listen(network string, ip net.IP) (*net.UDPConn, error) {
+	if r == (PortRange{}) {
+		return net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	}
+
+	n := r.Max - r.Min + 1
+	offset := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := r.Min + (offset+i)%n
+		conn, err := net.ListenUDP(network, &net.UDPAddr{IP: ip, Port: port})
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free UDP port on %s in range %d-%d", ip, r.Min, r.Max)
+}
@@ -0,0 +1,58 @@
+package ice
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortRangeCheck(t *testing.T) {
+	assert.NoError(t, PortRange{}.Check())
+	assert.NoError(t, PortRange{50000, 50000}.Check())
+	assert.NoError(t, PortRange{1, 65535}.Check())
+	assert.Error(t, PortRange{0, 100}.Check())
+	assert.Error(t, PortRange{100, 65536}.Check())
+	assert.Error(t, PortRange{200, 100}.Check())
+}
+
+func TestPortRangeListen(t *testing.T) {
+	ip := net.IPv4(127, 0, 0, 1)
+
+	// Find two adjacent free ports.
+	var r PortRange
+	for {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		conn.Close()
+		if port < 65535 {
+			r = PortRange{port, port + 1}
+			break
+		}
+	}
+
+	// Both ports are used, whichever is tried first, and then the range is
+	// exhausted.
+	var conns []*net.UDPConn
+	for i := 0; i < 2; i++ {
+		conn, err := r.listen("udp4", ip)
+		if err != nil {
+			t.Skipf("port in range taken by another process: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	seen := make(map[int]bool)
+	for _, conn := range conns {
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		assert.True(t, port >= r.Min && port <= r.Max, "port %d outside range", port)
+		seen[port] = true
+	}
+	assert.Len(t, seen, 2)
+
+	_, err := r.listen("udp4", ip)
+	assert.Error(t, err)
+}
@@ -0,0 +1,47 @@
+package ice
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Differentiated Services code points for interactive media [RFC8837 §5].
+// With BUNDLE, audio and video share a socket, and so a code point.
+const (
+	// Expedited Forwarding, recommended for audio.
+	DSCPExpeditedForwarding = 46
+
+	// Assured Forwarding class 4, low drop precedence, recommended for
+	// interactive video.
+	DSCPAF41 = 34
+)
+
+// Mark the packets sent from a socket with a DSCP, in the IPv4 TOS or IPv6
+// traffic class field, and set its Linux socket priority, for local queueing
+// disciplines. Zero leaves either unchanged. The socket of a relayed base is
+// its socket to the TURN server.
+func setQoS(conn net.PacketConn, dscp, priority int) error {
+	if c, ok := conn.(*turnConn); ok {
+		conn = c.PacketConn
+	}
+	if dscp != 0 {
+		// The DSCP is the upper six bits of the field; the lower two are
+		// for ECN.
+		tos := dscp << 2
+		var err error
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+			err = ipv4.NewPacketConn(conn).SetTOS(tos)
+		} else {
+			err = ipv6.NewPacketConn(conn).SetTrafficClass(tos)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if priority != 0 {
+		return setSocketPriority(conn, priority)
+	}
+	return nil
+}
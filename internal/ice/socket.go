@@ -0,0 +1,114 @@
+package ice
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Values of the ECN field, the lower two bits of the IPv4 TOS or IPv6 traffic
+// class [RFC3168 §5].
+const (
+	ecnNotECT = 0
+	ecnECT1   = 1
+	ecnECT0   = 2
+	ecnCE     = 3
+	ecnMask   = 3
+)
+
+// ECNCounts counts the packets received on a socket by the value of their ECN
+// field [RFC3168]. Congestion Experienced marks are set by routers that would
+// otherwise have dropped the packet.
+type ECNCounts struct {
+	NotECT uint64
+	ECT0   uint64
+	ECT1   uint64
+	CE     uint64
+}
+
+// Packet counts by ECN field value, indexed by the value. Accessed atomically.
+type ecnCounters [4]uint64
+
+func (c *ecnCounters) snapshot() ECNCounts {
+	return ECNCounts{
+		NotECT: atomic.LoadUint64(&c[ecnNotECT]),
+		ECT0:   atomic.LoadUint64(&c[ecnECT0]),
+		ECT1:   atomic.LoadUint64(&c[ecnECT1]),
+		CE:     atomic.LoadUint64(&c[ecnCE]),
+	}
+}
+
+// SocketStats describes the socket of a base.
+type SocketStats struct {
+	// Sizes of the socket's receive and send buffers, as allocated by the
+	// kernel, which may differ from the configured sizes. Zero if unknown.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Whether ECN marks of received packets are reported, and their counts.
+	ECNSupported bool
+	ECN          ECNCounts
+}
+
+// Size the buffers of a base's socket, and start reading the ECN marks of
+// received packets where supported. Must be called before the read loop
+// starts. Zero sizes leave the system defaults. The socket of a relayed base
+// is its socket to the TURN server, and ECN marks are not read on it, since
+// they describe only the last hop.
+func (base *Base) configureSocket(readBufferSize, writeBufferSize int) error {
+	conn := base.PacketConn
+	if c, ok := conn.(*turnConn); ok {
+		conn = c.PacketConn
+	}
+	if readBufferSize != 0 {
+		if err := setReadBuffer(conn, readBufferSize); err != nil {
+			return err
+		}
+	}
+	if writeBufferSize != 0 {
+		if err := setWriteBuffer(conn, writeBufferSize); err != nil {
+			return err
+		}
+	}
+
+	if udp, ok := base.PacketConn.(*net.UDPConn); ok && ecnControlSize > 0 {
+		if err := enableECN(udp); err != nil {
+			log.Debug("ECN not available on %s: %v", base.address, err)
+		} else {
+			base.ecnConn = udp
+			base.oob = make([]byte, ecnControlSize)
+		}
+	}
+	return nil
+}
+
+// Read a packet from the base's socket, counting its ECN mark if they are
+// reported.
+func (base *Base) read(b []byte) (int, net.Addr, error) {
+	if base.ecnConn == nil {
+		return base.ReadFrom(b)
+	}
+	n, addr, ecn, err := readECN(base.ecnConn, b, base.oob)
+	if err != nil {
+		return n, nil, err
+	}
+	atomic.AddUint64(&base.ecn[ecn], 1)
+	return n, addr, nil
+}
+
+// Return the buffer sizes of the base's socket, and the ECN counts of
+// the packets received on it.
+func (base *Base) stats() SocketStats {
+	conn := base.PacketConn
+	if c, ok := conn.(*turnConn); ok {
+		conn = c.PacketConn
+	}
+	var s SocketStats
+	if read, write, err := bufferSizes(conn); err == nil {
+		s.ReadBufferSize, s.WriteBufferSize = read, write
+	}
+	if base.ecnConn != nil {
+		s.ECNSupported = true
+		s.ECN = base.ecn.snapshot()
+	}
+	return s
+}
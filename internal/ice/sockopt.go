@@ -0,0 +1,115 @@
+// +build linux
+
+package ice
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Size of the buffer for control messages carrying the TOS or traffic class.
+const ecnControlSize = 64
+
+// Run fn with the file descriptor of a socket.
+func controlSocket(conn net.PacketConn, fn func(fd int) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("socket options not supported for this connection")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Set SO_PRIORITY on a socket.
+func setSocketPriority(conn net.PacketConn, priority int) error {
+	return controlSocket(conn, func(fd int) error {
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PRIORITY, priority)
+	})
+}
+
+// Set the size of a socket's receive or send buffer. SO_RCVBUFFORCE and
+// SO_SNDBUFFORCE exceed the net.core.rmem_max and wmem_max limits, which are
+// often small on embedded kernels, but need CAP_NET_ADMIN; without it, the
+// kernel caps the size.
+func setBufferSize(conn net.PacketConn, opt, size int) error {
+	force := unix.SO_RCVBUFFORCE
+	if opt == unix.SO_SNDBUF {
+		force = unix.SO_SNDBUFFORCE
+	}
+	return controlSocket(conn, func(fd int) error {
+		if unix.SetsockoptInt(fd, unix.SOL_SOCKET, force, size) == nil {
+			return nil
+		}
+		return unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, size)
+	})
+}
+
+func setReadBuffer(conn net.PacketConn, size int) error {
+	return setBufferSize(conn, unix.SO_RCVBUF, size)
+}
+
+func setWriteBuffer(conn net.PacketConn, size int) error {
+	return setBufferSize(conn, unix.SO_SNDBUF, size)
+}
+
+// Return the sizes the kernel actually allocated for a socket's buffers. Linux
+// doubles the requested size, to allow for bookkeeping overhead.
+func bufferSizes(conn net.PacketConn) (read, write int, err error) {
+	err = controlSocket(conn, func(fd int) error {
+		var err error
+		if read, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF); err != nil {
+			return err
+		}
+		write, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF)
+		return err
+	})
+	return
+}
+
+// Ask the kernel to report the TOS or traffic class of each packet received
+// on a socket, for its ECN bits.
+func enableECN(conn *net.UDPConn) error {
+	return controlSocket(conn, func(fd int) error {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+			return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+		}
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+	})
+}
+
+// Read a packet from a socket for which ECN is enabled, returning the ECN
+// field of its IP header, or ecnNotECT if the kernel didn't report it.
+func readECN(conn *net.UDPConn, b, oob []byte) (n int, addr *net.UDPAddr, ecn int, err error) {
+	n, oobn, _, addr, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, addr, ecnNotECT, nil
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS && len(m.Data) >= 1:
+			ecn = int(m.Data[0]) & ecnMask
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_TCLASS && len(m.Data) >= 4:
+			// The traffic class is a native-endian int no greater than 255,
+			// so it occupies either the first or the last byte.
+			ecn = int(m.Data[0]|m.Data[3]) & ecnMask
+		}
+	}
+	return
+}
@@ -0,0 +1,41 @@
+// +build !linux
+
+package ice
+
+import (
+	"errors"
+	"net"
+)
+
+const ecnControlSize = 0
+
+func setSocketPriority(conn net.PacketConn, priority int) error {
+	return errors.New("socket priority is only supported on Linux")
+}
+
+func setReadBuffer(conn net.PacketConn, size int) error {
+	if c, ok := conn.(*net.UDPConn); ok {
+		return c.SetReadBuffer(size)
+	}
+	return errors.New("buffer size not supported for this connection")
+}
+
+func setWriteBuffer(conn net.PacketConn, size int) error {
+	if c, ok := conn.(*net.UDPConn); ok {
+		return c.SetWriteBuffer(size)
+	}
+	return errors.New("buffer size not supported for this connection")
+}
+
+func bufferSizes(conn net.PacketConn) (read, write int, err error) {
+	return 0, 0, errors.New("buffer sizes are only reported on Linux")
+}
+
+func enableECN(conn *net.UDPConn) error {
+	return errors.New("ECN is only reported on Linux")
+}
+
+func readECN(conn *net.UDPConn, b, oob []byte) (n int, addr *net.UDPAddr, ecn int, err error) {
+	n, addr, err = conn.ReadFromUDP(b)
+	return
+}
@@ -0,0 +1,91 @@
+// +build linux
+
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSetQoSPriority(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := setQoS(conn, DSCPAF41, 5); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var priority int
+	raw.Control(func(fd uintptr) {
+		priority, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PRIORITY)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priority != 5 {
+		t.Errorf("SO_PRIORITY = %d, want 5", priority)
+	}
+}
+
+func TestConfigureSocket(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &Base{PacketConn: conn, address: makeTransportAddress(conn.LocalAddr())}
+	defer base.Close()
+
+	if err := base.configureSocket(64*1024, 32*1024); err != nil {
+		t.Fatal(err)
+	}
+	stats := base.stats()
+	// Linux doubles the requested sizes, unless capped by rmem_max.
+	if stats.ReadBufferSize == 0 || stats.WriteBufferSize == 0 {
+		t.Errorf("buffer sizes = %d, %d", stats.ReadBufferSize, stats.WriteBufferSize)
+	}
+	if !stats.ECNSupported {
+		t.Fatal("ECN not supported")
+	}
+
+	// Send one packet marked ECT(0) and one marked CE.
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	for _, tos := range []int{ecnECT0, ecnCE} {
+		if err := controlSocket(sender, func(fd int) error {
+			return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sender.WriteTo([]byte("x"), conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := base.read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || addr.String() != sender.LocalAddr().String() {
+			t.Errorf("read %d bytes from %v", n, addr)
+		}
+	}
+	want := ECNCounts{ECT0: 1, CE: 1}
+	if got := base.stats().ECN; got != want {
+		t.Errorf("ECN counts = %+v, want %+v", got, want)
+	}
+}
@@ -97,10 +97,12 @@ func (s *DataStream) Read(b []byte) (int, error) {
 			if n > len(b) {
 				// For packet-oriented connections, the destination buffer must
 				// be large enough to fit an entire packet.
+				packetPool.Put(data)
 				return 0, io.ErrShortBuffer
 			}
 
 			copy(b, data)
+			packetPool.Put(data)
 			return n, nil
 		}
 	}
@@ -11,6 +11,7 @@ import (
 	"hash/crc32"
 	"net"
 	"strings"
+	"time"
 )
 
 // STUN (Session Traversal Utilities for NAT)
@@ -83,6 +84,16 @@ func (msg *stunMessage) String() string {
 			fmt.Fprintf(b, ", MAPPED-ADDRESS %s", extractAddr(attr, msg.transactionID, false))
 		case stunAttrXorMappedAddress:
 			fmt.Fprintf(b, ", XOR-MAPPED-ADDRESS %s", extractAddr(attr, msg.transactionID, true))
+		case stunAttrXorPeerAddress:
+			fmt.Fprintf(b, ", XOR-PEER-ADDRESS %s", extractAddr(attr, msg.transactionID, true))
+		case stunAttrXorRelayedAddress:
+			fmt.Fprintf(b, ", XOR-RELAYED-ADDRESS %s", extractAddr(attr, msg.transactionID, true))
+		case stunAttrLifetime:
+			fmt.Fprintf(b, ", LIFETIME %v", binary.BigEndian.Uint32(attr.Value))
+		case stunAttrRealm:
+			fmt.Fprintf(b, ", REALM %s", string(attr.Value))
+		case stunAttrData:
+			fmt.Fprintf(b, ", DATA (%d bytes)", len(attr.Value))
 		case stunAttrUsername:
 			fmt.Fprintf(b, ", USERNAME %s", string(attr.Value))
 		case stunAttrErrorCode:
@@ -98,6 +109,8 @@ func (msg *stunMessage) String() string {
 		case stunAttrPriority:
 			fmt.Fprintf(b, ", PRIORITY %v", binary.BigEndian.Uint32(attr.Value))
 		case stunAttrSoftware:
+		case stunAttrNonce:
+		case stunAttrRequestedTransport:
 		case stunAttrFingerprint:
 		case stunAttrMessageIntegrity:
 			// Ignore these
@@ -287,6 +300,14 @@ func newStunMessage(class uint16, method uint16, transactionID string) *stunMess
 	return msg
 }
 
+// Generate the random tie-breaker for ICE-CONTROLLING and ICE-CONTROLLED
+// attributes [RFC8445 §7.1.1].
+func newTieBreaker() []byte {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return buf
+}
+
 func newStunBindingRequest(transactionID string) *stunMessage {
 	return newStunMessage(stunRequest, stunBindingMethod, transactionID)
 }
@@ -325,18 +346,25 @@ func (msg *stunMessage) Bytes() []byte {
 }
 
 const (
-	stunAttrMappedAddress     = 0x0001
-	stunAttrUsername          = 0x0006
-	stunAttrMessageIntegrity  = 0x0008
-	stunAttrErrorCode         = 0x0009
-	stunAttrUnknownAttributes = 0x000A
-	stunAttrXorMappedAddress  = 0x0020
-	stunAttrPriority          = 0x0024
-	stunAttrUseCandidate      = 0x0025
-	stunAttrSoftware          = 0x8022
-	stunAttrFingerprint       = 0x8028
-	stunAttrIceControlled     = 0x8029
-	stunAttrIceControlling    = 0x802A
+	stunAttrMappedAddress      = 0x0001
+	stunAttrUsername           = 0x0006
+	stunAttrMessageIntegrity   = 0x0008
+	stunAttrErrorCode          = 0x0009
+	stunAttrUnknownAttributes  = 0x000A
+	stunAttrLifetime           = 0x000D
+	stunAttrXorPeerAddress     = 0x0012
+	stunAttrData               = 0x0013
+	stunAttrRealm              = 0x0014
+	stunAttrNonce              = 0x0015
+	stunAttrXorRelayedAddress  = 0x0016
+	stunAttrRequestedTransport = 0x0019
+	stunAttrXorMappedAddress   = 0x0020
+	stunAttrPriority           = 0x0024
+	stunAttrUseCandidate       = 0x0025
+	stunAttrSoftware           = 0x8022
+	stunAttrFingerprint        = 0x8028
+	stunAttrIceControlled      = 0x8029
+	stunAttrIceControlling     = 0x802A
 )
 
 const stunMagicCookieBytes = "\x21\x12\xA4\x42"
@@ -379,6 +407,12 @@ func extractAddr(attr *stunAttribute, transactionID string, doXor bool) *net.UDP
 }
 
 func (msg *stunMessage) setXorMappedAddress(addr net.Addr) {
+	msg.setXorAddress(stunAttrXorMappedAddress, addr)
+}
+
+// Add an XOR-MAPPED-ADDRESS style attribute of the given type, e.g.
+// XOR-PEER-ADDRESS [RFC5766 §14.3].
+func (msg *stunMessage) setXorAddress(t uint16, addr net.Addr) {
 	var ip net.IP
 	var port int
 	switch a := addr.(type) {
@@ -407,7 +441,46 @@ func (msg *stunMessage) setXorMappedAddress(addr net.Addr) {
 	xorBytes(value[2:4], stunMagicCookieBytes[0:2])
 	xorBytes(value[4:8], stunMagicCookieBytes)
 	xorBytes(value[8:], msg.transactionID)
-	msg.addAttribute(stunAttrXorMappedAddress, value)
+	msg.addAttribute(t, value)
+}
+
+// Return the first attribute of the given type, or nil if not present.
+func (msg *stunMessage) getAttribute(t uint16) *stunAttribute {
+	for _, attr := range msg.attributes {
+		if attr.Type == t {
+			return attr
+		}
+	}
+	return nil
+}
+
+// Return the address from an XOR-MAPPED-ADDRESS style attribute of the given
+// type, or nil if not present.
+func (msg *stunMessage) getXorAddress(t uint16) *net.UDPAddr {
+	attr := msg.getAttribute(t)
+	if attr == nil || len(attr.Value) < 8 {
+		return nil
+	}
+	switch attr.Value[1] {
+	case 0x01:
+	case 0x02:
+		if len(attr.Value) < 20 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return extractAddr(attr, msg.transactionID, true)
+}
+
+// Return the numeric error code from an ERROR-CODE attribute [RFC5389 §15.6],
+// or 0 if not present.
+func (msg *stunMessage) getErrorCode() int {
+	attr := msg.getAttribute(stunAttrErrorCode)
+	if attr == nil || len(attr.Value) < 4 {
+		return 0
+	}
+	return int(attr.Value[2]&0x07)*100 + int(attr.Value[3])
 }
 
 func xorBytes(dest []byte, xor string) {
@@ -460,6 +533,21 @@ func (msg *stunMessage) getPriority() uint32 {
 	return 0
 }
 
+// RFC 5766 Section 14.2. LIFETIME
+func (msg *stunMessage) addLifetime(d time.Duration) {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(d/time.Second))
+	msg.addAttribute(stunAttrLifetime, v)
+}
+
+func (msg *stunMessage) getLifetime() time.Duration {
+	attr := msg.getAttribute(stunAttrLifetime)
+	if attr == nil || len(attr.Value) < 4 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(attr.Value)) * time.Second
+}
+
 // Check if the STUN message has a USE-CANDIDATE attribute.
 func (msg *stunMessage) hasUseCandidate() bool {
 	for _, attr := range msg.attributes {
@@ -0,0 +1,145 @@
+package ice
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A TURNServer is a relay used to gather relayed candidates [RFC5766], for
+// peers that can't reach each other directly.
+type TURNServer struct {
+	// Address of the server, as host:port for UDP, or a URI [RFC7065]:
+	// turn:host[:port] for UDP, turn:host[:port]?transport=tcp for TCP, or
+	// turns:host[:port] for TLS. TLS on port 443 gets through firewalls that
+	// allow only HTTPS.
+	Address string
+
+	// TLSConfig, if non-nil, configures TLS connections to the server, e.g.
+	// with trusted root certificates. The server name defaults to the
+	// address's host.
+	TLSConfig *tls.Config
+
+	// Proxy, if non-nil, is the URL of a proxy through which TCP and TLS
+	// connections to the server are made: http:// or https:// for an HTTP
+	// proxy, or socks5:// for a SOCKS5 proxy, with credentials if needed.
+	// Otherwise the HTTPS_PROXY environment variable is used.
+	Proxy *url.URL
+
+	// Credentials returns the username and password for the server. It is
+	// called for each allocation.
+	Credentials TURNCredentialProvider
+}
+
+// TURNCredentials are a username and password for the STUN long-term
+// credential mechanism [RFC5389 §10.2].
+type TURNCredentials struct {
+	Username string
+	Password string
+}
+
+// A TURNCredentialProvider returns credentials for a TURN server. Since it is
+// called for each allocation, it may return short-lived credentials.
+type TURNCredentialProvider func(ctx context.Context) (TURNCredentials, error)
+
+// StaticTURNCredentials returns a provider for a fixed username and password.
+func StaticTURNCredentials(username, password string) TURNCredentialProvider {
+	return func(ctx context.Context) (TURNCredentials, error) {
+		return TURNCredentials{username, password}, nil
+	}
+}
+
+// SharedSecretTURNCredentials returns a provider that derives time-limited
+// credentials from a secret shared with the TURN server, as described in
+// draft-uberti-behave-turn-rest-00 §2.2 (e.g. coturn's use-auth-secret). The
+// username is "<expiry>:<user>", where expiry is a Unix timestamp ttl from now,
+// and the password is the base64-encoded HMAC-SHA1 of the username.
+func SharedSecretTURNCredentials(secret, user string, ttl time.Duration) TURNCredentialProvider {
+	return func(ctx context.Context) (TURNCredentials, error) {
+		return makeSharedSecretCredentials(secret, user, time.Now().Add(ttl)), nil
+	}
+}
+
+func makeSharedSecretCredentials(secret, user string, expiry time.Time) TURNCredentials {
+	username := strconv.FormatInt(expiry.Unix(), 10)
+	if user != "" {
+		username += ":" + user
+	}
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return TURNCredentials{
+		Username: username,
+		Password: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	}
+}
+
+// FetchTURNCredentials returns a provider that requests credentials from an
+// HTTPS endpoint, so they never have to be stored on the device. If token is
+// non-empty it is sent as an OAuth 2.0 bearer token; other authentication
+// (e.g. a TLS client certificate) can be configured on client, which defaults
+// to http.DefaultClient. The response must be JSON of the form
+//
+//	{"username": "...", "password": "...", "ttl": 86400}
+//
+// as in draft-uberti-behave-turn-rest-00 §2.2. Credentials are reused until
+// half their TTL has elapsed.
+func FetchTURNCredentials(url, token string, client *http.Client) TURNCredentialProvider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var (
+		mu      sync.Mutex
+		cached  TURNCredentials
+		refresh time.Time
+	)
+	return func(ctx context.Context) (TURNCredentials, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Now().Before(refresh) {
+			return cached, nil
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return TURNCredentials{}, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return TURNCredentials{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return TURNCredentials{}, fmt.Errorf("TURN credential request failed: %s", resp.Status)
+		}
+
+		var body struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			TTL      int64  `json:"ttl"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return TURNCredentials{}, fmt.Errorf("invalid TURN credential response: %v", err)
+		}
+		if body.Username == "" {
+			return TURNCredentials{}, fmt.Errorf("invalid TURN credential response: missing username")
+		}
+
+		cached = TURNCredentials{body.Username, body.Password}
+		refresh = time.Now().Add(time.Duration(body.TTL) * time.Second / 2)
+		return cached, nil
+	}
+}
@@ -0,0 +1,449 @@
+package ice
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+)
+
+// TURN client, supporting UDP allocations with Send and Data indications.
+// See [RFC5766](https://tools.ietf.org/html/rfc5766). The server is reached
+// over UDP, or over TCP or TLS (see turnStream); allocations are UDP either
+// way.
+
+const (
+	// Lifetime requested for allocations. They are refreshed at half this
+	// interval.
+	turnAllocationLifetime = 10 * time.Minute
+
+	// Permissions expire after 5 minutes [RFC5766 §8], so refresh them
+	// before that.
+	turnPermissionRefresh = 4 * time.Minute
+
+	// Initial retransmission timeout for requests [RFC5389 §7.2.1].
+	turnRetransmitTimeout = 500 * time.Millisecond
+
+	// Timeout for creating an allocation.
+	timeoutTURNAllocate = 5 * time.Second
+
+	// REQUESTED-TRANSPORT protocol number for UDP.
+	turnTransportUDP = 17
+
+	// Bytes added to each relayed packet by a Send indication: the STUN
+	// header, an IPv6 XOR-PEER-ADDRESS, and the DATA attribute header with up
+	// to 3 bytes of padding.
+	turnSendOverhead = 20 + 24 + 4 + 3
+
+	turnErrorUnauthorized = 401
+	turnErrorStaleNonce   = 438
+)
+
+var errTURNNoRelayedAddress = errors.New("TURN allocation has no relayed address")
+
+// A turnConn is a net.PacketConn that sends and receives through a TURN
+// allocation. It is the PacketConn of the Base for a relayed candidate.
+type turnConn struct {
+	// Socket used to communicate with the TURN server, or a turnStream.
+	net.PacketConn
+
+	server   net.Addr
+	username string
+	password string
+
+	// Addresses allocated by the server.
+	relayed *net.UDPAddr
+	mapped  *net.UDPAddr
+
+	// Read buffer, for unwrapping Data indications.
+	buf []byte
+
+	// Clock for the refresh timers.
+	clock clock.Clock
+
+	mu sync.Mutex
+
+	// Long-term credential parameters, learned from the server's challenge.
+	realm string
+	nonce string
+	key   string
+
+	// Peers for which permissions have been installed, keyed by IP.
+	peers map[string]*net.UDPAddr
+
+	// Outstanding requests, keyed by transaction ID. Each can rebuild its
+	// request, to retry with a fresh nonce.
+	requests map[string]func() *stunMessage
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Create an allocation on the TURN server, using a new socket bound to ip, on
+// a port within ports. The allocation is refreshed on clk, or on the system
+// clock if clk is nil.
+func allocateTURN(ctx context.Context, ports PortRange, ip net.IP, server TURNServer, clk clock.Clock) (*turnConn, error) {
+	if server.Credentials == nil {
+		return nil, errors.New("no TURN credentials")
+	}
+	creds, err := server.Credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, transport, err := parseTURNAddress(server.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.PacketConn
+	var serverAddr net.Addr
+	if transport == turnUDP {
+		network := "udp4"
+		if ip.To4() == nil {
+			network = "udp6"
+		}
+		if serverAddr, err = net.ResolveUDPAddr(network, addr); err != nil {
+			return nil, err
+		}
+		if conn, err = ports.listen(network, ip); err != nil {
+			return nil, err
+		}
+	} else {
+		stream, err := dialTURNStream(ctx, ip, addr, transport, server)
+		if err != nil {
+			return nil, err
+		}
+		conn, serverAddr = stream, stream.RemoteAddr()
+	}
+
+	c := &turnConn{
+		PacketConn: conn,
+		server:     serverAddr,
+		username:   creds.Username,
+		password:   creds.Password,
+		buf:        make([]byte, 2*sizeMaximumTransmissionUnit),
+		clock:      clock.Or(clk),
+		peers:      make(map[string]*net.UDPAddr),
+		requests:   make(map[string]func() *stunMessage),
+		closed:     make(chan struct{}),
+	}
+
+	resp, err := c.roundTrip(ctx, func() *stunMessage {
+		msg := newStunMessage(stunRequest, stunAllocateMethod, "")
+		msg.addAttribute(stunAttrRequestedTransport, []byte{turnTransportUDP, 0, 0, 0})
+		msg.addLifetime(turnAllocationLifetime)
+		return msg
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.relayed = resp.getXorAddress(stunAttrXorRelayedAddress)
+	c.mapped = resp.getXorAddress(stunAttrXorMappedAddress)
+	if c.relayed == nil {
+		conn.Close()
+		return nil, errTURNNoRelayedAddress
+	}
+	lifetime := resp.getLifetime()
+	if lifetime <= 0 {
+		lifetime = turnAllocationLifetime
+	}
+	log.Info("Allocated relay %s on %s (lifetime %v)\n", c.relayed, server.Address, lifetime)
+
+	go c.refreshLoop(lifetime)
+	return c, nil
+}
+
+// Send a request and wait for the response, retransmitting as necessary.
+// Retries with credentials when challenged by the server.
+func (c *turnConn) roundTrip(ctx context.Context, build func() *stunMessage) (*stunMessage, error) {
+	deadline := time.Now().Add(timeoutTURNAllocate)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	defer c.PacketConn.SetReadDeadline(time.Time{})
+
+	for attempt := 0; attempt < 3; attempt++ {
+		req := c.authenticate(build())
+		resp, err := c.exchange(req, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if resp.class == stunSuccessResponse {
+			return resp, nil
+		}
+
+		code := resp.getErrorCode()
+		if code == turnErrorUnauthorized || code == turnErrorStaleNonce {
+			if c.updateNonce(resp) {
+				continue
+			}
+		}
+		return nil, fmt.Errorf("TURN request failed: %s", resp)
+	}
+	return nil, errors.New("TURN authentication failed")
+}
+
+// Send req until a matching response arrives, or the deadline passes.
+func (c *turnConn) exchange(req *stunMessage, deadline time.Time) (*stunMessage, error) {
+	rto := turnRetransmitTimeout
+	if _, ok := c.PacketConn.(*turnStream); ok {
+		// Requests are not retransmitted over TCP [RFC5389 §7.2.2].
+		rto = time.Until(deadline)
+	}
+	for {
+		if _, err := c.PacketConn.WriteTo(req.Bytes(), c.server); err != nil {
+			return nil, err
+		}
+
+		retransmit := time.Now().Add(rto)
+		if retransmit.After(deadline) {
+			retransmit = deadline
+		}
+		c.PacketConn.SetReadDeadline(retransmit)
+		for {
+			n, from, err := c.PacketConn.ReadFrom(c.buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if !c.fromServer(from) {
+				continue
+			}
+			resp, err := parseStunMessage(c.buf[:n])
+			if err == nil && resp.transactionID == req.transactionID {
+				return resp, nil
+			}
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, errors.New("TURN request timed out")
+		}
+		rto *= 2
+	}
+}
+
+// Add long-term credentials to the message, if the server has issued a
+// challenge. Returns msg.
+func (c *turnConn) authenticate(msg *stunMessage) *stunMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.realm != "" {
+		msg.addAttribute(stunAttrUsername, []byte(c.username))
+		msg.addAttribute(stunAttrRealm, []byte(c.realm))
+		msg.addAttribute(stunAttrNonce, []byte(c.nonce))
+		msg.addMessageIntegrity(c.key)
+	}
+	msg.addFingerprint()
+	return msg
+}
+
+// Record the realm and nonce from a 401 or 438 error response. Returns false
+// if the response offers nothing new to retry with.
+func (c *turnConn) updateNonce(resp *stunMessage) bool {
+	realm := resp.getAttribute(stunAttrRealm)
+	nonce := resp.getAttribute(stunAttrNonce)
+	if nonce == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if realm != nil && string(realm.Value) != c.realm {
+		c.realm = string(realm.Value)
+		// [RFC5389 §15.4] key = MD5(username ":" realm ":" SASLprep(password))
+		sum := md5.Sum([]byte(c.username + ":" + c.realm + ":" + c.password))
+		c.key = string(sum[:])
+	} else if string(nonce.Value) == c.nonce {
+		return false
+	}
+	c.nonce = string(nonce.Value)
+	return c.realm != ""
+}
+
+// Send a request without waiting for the response, which is handled by
+// ReadFrom. Used once the allocation exists, when the read loop owns the
+// socket.
+func (c *turnConn) sendRequest(build func() *stunMessage) {
+	msg := c.authenticate(build())
+
+	c.mu.Lock()
+	c.requests[msg.transactionID] = build
+	c.mu.Unlock()
+
+	if _, err := c.PacketConn.WriteTo(msg.Bytes(), c.server); err != nil {
+		log.Debug("Failed to send TURN request to %s: %v\n", c.server, err)
+	}
+}
+
+func (c *turnConn) handleResponse(resp *stunMessage) {
+	c.mu.Lock()
+	build, ok := c.requests[resp.transactionID]
+	delete(c.requests, resp.transactionID)
+	c.mu.Unlock()
+
+	if !ok || resp.class == stunSuccessResponse {
+		return
+	}
+
+	code := resp.getErrorCode()
+	if (code == turnErrorUnauthorized || code == turnErrorStaleNonce) && c.updateNonce(resp) {
+		c.sendRequest(build)
+		return
+	}
+	log.Warn("TURN request to %s failed: %s\n", c.server, resp)
+}
+
+// Keep the allocation and its permissions alive until the connection closes.
+func (c *turnConn) refreshLoop(lifetime time.Duration) {
+	refresh := c.clock.NewTicker(lifetime / 2)
+	defer refresh.Stop()
+	permissions := c.clock.NewTicker(turnPermissionRefresh)
+	defer permissions.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-refresh.C:
+			c.sendRequest(func() *stunMessage {
+				msg := newStunMessage(stunRequest, stunRefreshMethod, "")
+				msg.addLifetime(turnAllocationLifetime)
+				return msg
+			})
+		case <-permissions.C:
+			// sendRequest takes the mutex itself, so send once it's released.
+			c.mu.Lock()
+			peers := make([]*net.UDPAddr, 0, len(c.peers))
+			for _, peer := range c.peers {
+				peers = append(peers, peer)
+			}
+			c.mu.Unlock()
+			for _, peer := range peers {
+				c.sendRequest(createPermissionRequest(peer))
+			}
+		}
+	}
+}
+
+func createPermissionRequest(peer *net.UDPAddr) func() *stunMessage {
+	return func() *stunMessage {
+		msg := newStunMessage(stunRequest, stunCreatePermissionMethod, "")
+		msg.setXorAddress(stunAttrXorPeerAddress, peer)
+		return msg
+	}
+}
+
+// ReadFrom returns the next packet relayed from a peer. Responses from the
+// TURN server are handled internally.
+func (c *turnConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(c.buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// The base's read loop stops at the first timeout, after
+				// which nothing reads from the allocation. Release it.
+				c.Close()
+			}
+			return 0, nil, err
+		}
+		if !c.fromServer(from) {
+			continue
+		}
+
+		msg, err := parseStunMessage(c.buf[:n])
+		if err != nil {
+			// ChannelData is not used, so anything else is unexpected.
+			continue
+		}
+
+		switch {
+		case msg.class == stunIndication && msg.method == stunDataMethod:
+			peer := msg.getXorAddress(stunAttrXorPeerAddress)
+			data := msg.getAttribute(stunAttrData)
+			if peer == nil || data == nil {
+				continue
+			}
+			if len(data.Value) > len(b) {
+				log.Debug("Dropping oversized relayed packet from %s\n", peer)
+				continue
+			}
+			return copy(b, data.Value), peer, nil
+		case msg.class == stunSuccessResponse || msg.class == stunErrorResponse:
+			c.handleResponse(msg)
+		}
+	}
+}
+
+// WriteTo relays a packet to a peer, installing a permission for the peer
+// first if necessary.
+func (c *turnConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	peer, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported peer address: %v", addr)
+	}
+
+	c.mu.Lock()
+	_, permitted := c.peers[peer.IP.String()]
+	if !permitted {
+		c.peers[peer.IP.String()] = peer
+	}
+	c.mu.Unlock()
+	if !permitted {
+		c.sendRequest(createPermissionRequest(peer))
+	}
+
+	msg := newStunMessage(stunIndication, stunSendMethod, "")
+	msg.setXorAddress(stunAttrXorPeerAddress, peer)
+	msg.addAttribute(stunAttrData, b)
+	if _, err := c.PacketConn.WriteTo(msg.Bytes(), c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// LocalAddr returns the relayed address.
+func (c *turnConn) LocalAddr() net.Addr {
+	return c.relayed
+}
+
+// Close releases the allocation and closes the socket.
+func (c *turnConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		// Best effort: a zero lifetime deletes the allocation [RFC5766 §7].
+		c.sendRequest(func() *stunMessage {
+			msg := newStunMessage(stunRequest, stunRefreshMethod, "")
+			msg.addLifetime(0)
+			return msg
+		})
+		err = c.PacketConn.Close()
+	})
+	return err
+}
+
+// Report whether a packet came from the TURN server. Streams carry nothing
+// else.
+func (c *turnConn) fromServer(from net.Addr) bool {
+	if server, ok := c.server.(*net.UDPAddr); ok {
+		return sameUDPAddr(from, server)
+	}
+	return true
+}
+
+func sameUDPAddr(a net.Addr, b *net.UDPAddr) bool {
+	ua, ok := a.(*net.UDPAddr)
+	return ok && ua.Port == b.Port && ua.IP.Equal(b.IP)
+}
@@ -0,0 +1,174 @@
+package ice
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/proxy"
+)
+
+// Transports to a TURN server.
+const (
+	turnUDP = "udp"
+	turnTCP = "tcp"
+	turnTLS = "tls"
+)
+
+// Default ports for TURN [RFC7065 §3].
+const (
+	turnDefaultPort       = "3478"
+	turnDefaultSecurePort = "5349"
+)
+
+var errTURNFraming = errors.New("TURN stream out of sync")
+
+// Parse the address of a TURN server: either host:port, for UDP, or a URI
+// [RFC7065] of the form turn:host[:port][?transport=udp|tcp] or
+// turns:host[:port]. Returns host:port, and the transport.
+func parseTURNAddress(s string) (addr, transport string, err error) {
+	var port string
+	switch {
+	case strings.HasPrefix(s, "turn:"):
+		s, transport, port = s[len("turn:"):], turnUDP, turnDefaultPort
+	case strings.HasPrefix(s, "turns:"):
+		s, transport, port = s[len("turns:"):], turnTLS, turnDefaultSecurePort
+	default:
+		return s, turnUDP, nil
+	}
+
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		query, err := url.ParseQuery(s[i+1:])
+		if err != nil {
+			return "", "", fmt.Errorf("invalid TURN URI query %q", s[i+1:])
+		}
+		switch t := query.Get("transport"); {
+		case t == "" || t == "udp" && transport == turnUDP:
+		case t == "tcp" && transport == turnUDP:
+			transport = turnTCP
+		case t == "tcp":
+		default:
+			return "", "", fmt.Errorf("unsupported TURN transport %q", t)
+		}
+		s = s[:i]
+	}
+
+	// Add the default port, unless there is one already.
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(strings.Trim(s, "[]"), port)
+	}
+	return s, transport, nil
+}
+
+// Connect to a TURN server over TCP or TLS, from ip, through the server's
+// proxy, or else any proxy configured in the environment.
+func dialTURNStream(ctx context.Context, ip net.IP, addr, transport string, server TURNServer) (*turnStream, error) {
+	p := server.Proxy
+	if p == nil {
+		var err error
+		if p, err = proxy.FromEnvironment(addr); err != nil {
+			return nil, err
+		}
+	}
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+	conn, err := proxy.Dial(ctx, d, p, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if transport == turnTLS {
+		config := &tls.Config{}
+		if server.TLSConfig != nil {
+			config = server.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tc := tls.Client(conn, config)
+		if d, ok := ctx.Deadline(); ok {
+			tc.SetDeadline(d)
+		}
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tc.SetDeadline(time.Time{})
+		conn = tc
+	}
+	return &turnStream{Conn: conn}, nil
+}
+
+// A turnStream carries the messages of a TURN client over a TCP or TLS
+// connection to the server, as a net.PacketConn. Messages are framed by their
+// lengths: STUN messages by the length in their header, and ChannelData
+// messages likewise, padded to a multiple of 4 bytes [RFC5766 §11.5].
+type turnStream struct {
+	net.Conn
+
+	// Bytes received but not yet returned. A read that times out mid-message
+	// leaves its bytes here for the next.
+	pending []byte
+}
+
+// ReadFrom returns the next STUN message from the server, whose address it
+// returns.
+func (s *turnStream) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, err := frameLength(s.pending)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n > 0 && len(s.pending) >= n {
+			frame := s.pending[:n]
+			s.pending = s.pending[n:]
+			if frame[0]&0xc0 != 0 {
+				// ChannelData is not used.
+				continue
+			}
+			if len(frame) > len(b) {
+				return 0, nil, fmt.Errorf("TURN message of %d bytes exceeds buffer", len(frame))
+			}
+			return copy(b, frame), s.RemoteAddr(), nil
+		}
+
+		// Read more, compacting or growing the buffer as needed.
+		if cap(s.pending)-len(s.pending) < sizeMaximumTransmissionUnit {
+			grown := make([]byte, len(s.pending), len(s.pending)+2*sizeMaximumTransmissionUnit)
+			copy(grown, s.pending)
+			s.pending = grown
+		}
+		m, err := s.Conn.Read(s.pending[len(s.pending):cap(s.pending)])
+		s.pending = s.pending[:len(s.pending)+m]
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// WriteTo sends a message to the server, whatever addr is.
+func (s *turnStream) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.Conn.Write(b)
+}
+
+// Return the length of the message at the start of b, or 0 if there aren't
+// yet enough bytes to tell.
+func frameLength(b []byte) (int, error) {
+	if len(b) < 4 {
+		return 0, nil
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	switch b[0] >> 6 {
+	case 0:
+		return stunHeaderLength + length, nil
+	case 1:
+		return 4 + (length+3)&^3, nil
+	default:
+		return 0, errTURNFraming
+	}
+}
@@ -0,0 +1,302 @@
+package ice
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedSecretTURNCredentials(t *testing.T) {
+	// Password is base64(HMAC-SHA1("north", "1600000000:alice")).
+	creds := makeSharedSecretCredentials("north", "alice", time.Unix(1600000000, 0))
+	assert.Equal(t, "1600000000:alice", creds.Username)
+	assert.Equal(t, "gq98pTOhhHaAu0we9aV79kOVVv0=", creds.Password)
+}
+
+func TestFetchTURNCredentials(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"username": "1600000000:alice", "password": "pass", "ttl": 3600}`))
+	}))
+	defer server.Close()
+
+	provider := FetchTURNCredentials(server.URL, "secret-token", nil)
+	for i := 0; i < 2; i++ {
+		creds, err := provider(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, TURNCredentials{"1600000000:alice", "pass"}, creds)
+	}
+	// The second call is served from the cache.
+	assert.Equal(t, 1, requests)
+
+	_, err := FetchTURNCredentials(server.URL, "wrong-token", nil)(context.Background())
+	assert.Error(t, err)
+}
+
+// Run a minimal TURN server on conn. It challenges unauthenticated requests,
+// and echoes Send indications back as Data indications.
+func fakeTURNServer(t *testing.T, conn net.PacketConn, username string) {
+	relayed := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 49152}
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg, err := parseStunMessage(buf[:n])
+		if err != nil {
+			t.Errorf("invalid STUN message: %v", err)
+			continue
+		}
+
+		var resp *stunMessage
+		switch {
+		case msg.class == stunIndication && msg.method == stunSendMethod:
+			resp = newStunMessage(stunIndication, stunDataMethod, "")
+			resp.setXorAddress(stunAttrXorPeerAddress, msg.getXorAddress(stunAttrXorPeerAddress))
+			resp.addAttribute(stunAttrData, msg.getAttribute(stunAttrData).Value)
+		case msg.class != stunRequest:
+			continue
+		case msg.getAttribute(stunAttrUsername) == nil:
+			resp = newStunMessage(stunErrorResponse, msg.method, msg.transactionID)
+			resp.addAttribute(stunAttrErrorCode, append([]byte{0, 0, 4, 1}, "Unauthorized"...))
+			resp.addAttribute(stunAttrRealm, []byte("example.org"))
+			resp.addAttribute(stunAttrNonce, []byte("nonce"))
+		default:
+			assert.Equal(t, username, string(msg.getAttribute(stunAttrUsername).Value))
+			assert.NotNil(t, msg.getAttribute(stunAttrMessageIntegrity))
+			resp = newStunMessage(stunSuccessResponse, msg.method, msg.transactionID)
+			if msg.method == stunAllocateMethod {
+				resp.setXorAddress(stunAttrXorRelayedAddress, relayed)
+				resp.setXorAddress(stunAttrXorMappedAddress, from)
+				resp.addLifetime(turnAllocationLifetime)
+			}
+		}
+		conn.WriteTo(resp.Bytes(), from)
+	}
+}
+
+func TestTURNAllocation(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	go fakeTURNServer(t, serverConn, "alice")
+
+	server := TURNServer{
+		Address:     serverConn.LocalAddr().String(),
+		Credentials: StaticTURNCredentials("alice", "password"),
+	}
+	conn, err := allocateTURN(context.Background(), PortRange{}, net.IPv4(127, 0, 0, 1), server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	assert.Equal(t, "192.0.2.1:49152", conn.LocalAddr().String())
+	assert.Equal(t, "example.org", conn.realm)
+
+	peer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 5000}
+	n, err := conn.WriteTo([]byte("hello"), peer)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 100)
+	n, from, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello", string(b[:n]))
+	assert.Equal(t, peer.String(), from.String())
+}
+
+// Reports the method of each STUN request read from it.
+type requestRecorder struct {
+	net.PacketConn
+	methods chan uint16
+}
+
+func (r *requestRecorder) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, from, err := r.PacketConn.ReadFrom(b)
+	if err == nil {
+		if msg, err := parseStunMessage(b[:n]); err == nil && msg.class == stunRequest {
+			select {
+			case r.methods <- msg.method:
+			default:
+			}
+		}
+	}
+	return n, from, err
+}
+
+func TestTURNPermissionRefresh(t *testing.T) {
+	serverConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	recorder := &requestRecorder{serverConn, make(chan uint16, 16)}
+	go fakeTURNServer(t, recorder, "alice")
+
+	server := TURNServer{
+		Address:     serverConn.LocalAddr().String(),
+		Credentials: StaticTURNCredentials("alice", "password"),
+	}
+	fake := clock.NewFake(time.Unix(1500000000, 0))
+	conn, err := allocateTURN(context.Background(), PortRange{}, net.IPv4(127, 0, 0, 1), server, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Wait for the request with the given method.
+	expect := func(method uint16) {
+		t.Helper()
+		for {
+			select {
+			case m := <-recorder.methods:
+				if m == method {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no request with method %#x", method)
+			}
+		}
+	}
+
+	peer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 5000}
+	if _, err := conn.WriteTo([]byte("hello"), peer); err != nil {
+		t.Fatal(err)
+	}
+	expect(stunCreatePermissionMethod)
+
+	// The permission is refreshed before it expires.
+	fake.WaitForTimers(2)
+	fake.Advance(turnPermissionRefresh)
+	expect(stunCreatePermissionMethod)
+
+	// Nothing is left holding the lock.
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.WriteTo([]byte("hello"), peer)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("WriteTo blocked after permission refresh")
+	}
+}
+
+func TestParseTURNAddress(t *testing.T) {
+	tests := []struct {
+		in, addr, transport string
+	}{
+		{"turn.example.com:3478", "turn.example.com:3478", turnUDP},
+		{"turn:turn.example.com", "turn.example.com:3478", turnUDP},
+		{"turn:turn.example.com:80?transport=tcp", "turn.example.com:80", turnTCP},
+		{"turns:turn.example.com", "turn.example.com:5349", turnTLS},
+		{"turns:turn.example.com:443?transport=tcp", "turn.example.com:443", turnTLS},
+		{"turns:[2001:db8::1]", "[2001:db8::1]:5349", turnTLS},
+	}
+	for _, tt := range tests {
+		addr, transport, err := parseTURNAddress(tt.in)
+		if assert.NoError(t, err, tt.in) {
+			assert.Equal(t, tt.addr, addr, tt.in)
+			assert.Equal(t, tt.transport, transport, tt.in)
+		}
+	}
+
+	for _, s := range []string{"turns:example.com?transport=udp", "turn:example.com?transport=sctp"} {
+		_, _, err := parseTURNAddress(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestTURNAllocationOverTLS(t *testing.T) {
+	// Borrow httptest's certificate, which is valid for 127.0.0.1.
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	defer https.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: https.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fakeTURNServer(t, &turnStream{Conn: conn}, "alice")
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	server := TURNServer{
+		Address:     "turns:" + l.Addr().String(),
+		Credentials: StaticTURNCredentials("alice", "password"),
+		TLSConfig:   &tls.Config{RootCAs: roots},
+	}
+	conn, err := allocateTURN(context.Background(), PortRange{}, net.IPv4(127, 0, 0, 1), server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal(t, "192.0.2.1:49152", conn.LocalAddr().String())
+
+	// The fake server echoes a relayed packet back.
+	peer := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 5000}
+	_, err = conn.WriteTo([]byte("hello"), peer)
+	assert.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 100)
+	n, from, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "hello", string(b[:n]))
+	assert.Equal(t, peer.String(), from.String())
+}
+
+func TestTURNStreamFraming(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	msg := newStunBindingRequest("").Bytes()
+	go func() {
+		// A ChannelData message with 3 bytes of data, padded to 4, then a
+		// STUN message split across writes.
+		server.Write([]byte{0x40, 0x00, 0x00, 0x03, 1, 2, 3, 0})
+		server.Write(msg[:7])
+		server.Write(msg[7:])
+	}()
+
+	s := &turnStream{Conn: client}
+	b := make([]byte, 100)
+	n, _, err := s.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, msg, b[:n])
+}
@@ -0,0 +1,125 @@
+// Package leak accounts for the goroutines, sockets, and buffers owned by a
+// peer connection, so that any left behind after it closes can be reported.
+//
+// Tracking is off unless a Tracker is created; the methods of a nil *Tracker
+// do no accounting, so code can use them unconditionally.
+package leak
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Kinds of resource.
+const (
+	Goroutine = "goroutine"
+	Socket    = "socket"
+	Buffer    = "buffer"
+)
+
+// A Tracker records resources from acquisition until release.
+type Tracker struct {
+	mu   sync.Mutex
+	next int
+	live map[int]resource
+
+	// Closed and replaced on every release, to wake Wait.
+	released chan struct{}
+}
+
+type resource struct {
+	kind string
+	desc string
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		live:     make(map[int]resource),
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire records a resource of the given kind, described by desc, until the
+// returned function is called. Calling it again has no effect.
+func (t *Tracker) Acquire(kind, desc string) (release func()) {
+	if t == nil {
+		return func() {}
+	}
+
+	t.mu.Lock()
+	id := t.next
+	t.next++
+	t.live[id] = resource{kind, desc}
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.live[id]; ok {
+			delete(t.live, id)
+			close(t.released)
+			t.released = make(chan struct{})
+		}
+	}
+}
+
+// Go runs f in a new goroutine, recorded until f returns.
+func (t *Tracker) Go(desc string, f func()) {
+	release := t.Acquire(Goroutine, desc)
+	go func() {
+		defer release()
+		f()
+	}()
+}
+
+// Outstanding describes the resources not yet released, e.g.
+// "socket udp/192.168.1.2:50000", in sorted order.
+func (t *Tracker) Outstanding() []string {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var descs []string
+	for _, r := range t.live {
+		descs = append(descs, r.kind+" "+r.desc)
+	}
+	sort.Strings(descs)
+	return descs
+}
+
+// Wait waits for all resources to be released, or for ctx to be done, and
+// returns those still outstanding. Goroutines may take a moment to notice
+// that their connection has closed.
+func (t *Tracker) Wait(ctx context.Context) []string {
+	if t == nil {
+		return nil
+	}
+
+	for {
+		t.mu.Lock()
+		n, released := len(t.live), t.released
+		t.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return t.Outstanding()
+		}
+	}
+}
+
+// Error reports leaked resources, as returned by Wait.
+type Error struct {
+	Leaks []string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d resources leaked: %v", len(e.Leaks), e.Leaks)
+}
@@ -0,0 +1,46 @@
+package leak
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrackerWait(t *testing.T) {
+	tr := NewTracker()
+	releaseSocket := tr.Acquire(Socket, "udp/127.0.0.1:5000")
+	tr.Acquire(Buffer, "forgotten")
+	stop := make(chan struct{})
+	tr.Go("worker", func() { <-stop })
+
+	expected := []string{"buffer forgotten", "goroutine worker", "socket udp/127.0.0.1:5000"}
+	if out := tr.Outstanding(); !reflect.DeepEqual(out, expected) {
+		t.Errorf("Outstanding %v, expected %v", out, expected)
+	}
+
+	// Released resources drop out, including goroutines that return while
+	// Wait is waiting. The forgotten buffer leaks.
+	releaseSocket()
+	releaseSocket()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if leaks := tr.Wait(ctx); !reflect.DeepEqual(leaks, []string{"buffer forgotten"}) {
+		t.Errorf("Leaked %v, expected only the buffer", leaks)
+	}
+}
+
+func TestNilTracker(t *testing.T) {
+	var tr *Tracker
+	done := make(chan struct{})
+	tr.Go("untracked", func() { close(done) })
+	<-done
+	tr.Acquire(Socket, "untracked")()
+	if leaks := tr.Wait(context.Background()); leaks != nil {
+		t.Errorf("Nil tracker reported %v", leaks)
+	}
+}
@@ -1,49 +1,135 @@
 package logging
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-const envVar = "LOGLEVEL"
+const (
+	envVar       = "LOGLEVEL"
+	formatEnvVar = "LOGFORMAT"
+)
+
+// Output formats.
+const (
+	// Human-readable lines, colored by level.
+	FormatText = "text"
+
+	// One JSON object per line, for log shippers.
+	FormatJSON = "json"
+)
 
-var tagLevels []struct {
-	tag   string
-	level Level
+var config struct {
+	sync.Mutex
+
+	// Levels set for individual tags, overriding the default level.
+	tagLevels map[string]Level
+
+	// Every tagged logger, so that levels can be changed after the loggers
+	// are created.
+	loggers []*Logger
 }
 
+// Nonzero to write JSON rather than text. Accessed atomically.
+var jsonOutput int32
+
 func init() {
-	// Parse environment variable into comma-separated "tag=level" directives.
-	// If "tag=" is absent, use the level as the default.
-	for _, d := range strings.Split(os.Getenv(envVar), ",") {
+	if err := Configure(os.Getenv(envVar)); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid %s: %v\n", envVar, err)
+	}
+	if format := os.Getenv(formatEnvVar); format != "" {
+		if err := SetFormat(format); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid %s: %v\n", formatEnvVar, err)
+		}
+	}
+}
+
+// Configure sets logging levels from a comma-separated list of "tag=level"
+// directives, e.g. "ice=debug,dtls=warn". A directive without "tag=" sets the
+// default level for all tags. Directives override those of earlier calls, and
+// of the LOGLEVEL environment variable. Invalid directives are skipped, and
+// reported in the returned error.
+//
+// Configure should be called during startup, before logging begins, e.g. just
+// after parsing command line flags.
+func Configure(directives string) error {
+	config.Lock()
+	defer config.Unlock()
+
+	var invalid []string
+	for _, d := range strings.Split(directives, ",") {
+		d = strings.TrimSpace(d)
 		if d == "" {
 			continue
 		}
 		v := strings.SplitN(d, "=", 2)
-		levelString := v[len(v)-1]
-		if level, err := parseLevel(levelString); err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid %s directive '%s': %s\n", envVar, d, err)
+		level, err := parseLevel(v[len(v)-1])
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("'%s': %v", d, err))
+			continue
+		}
+		if len(v) == 1 {
+			defaultLevel = level
 		} else {
-			if len(v) == 1 {
-				defaultLevel = level
-			} else {
-				tagLevels = append(tagLevels, struct {
-					tag   string
-					level Level
-				}{v[0], level})
+			if config.tagLevels == nil {
+				config.tagLevels = make(map[string]Level)
 			}
+			config.tagLevels[v[0]] = level
 		}
 	}
 
+	// Apply the new levels to existing loggers.
 	DefaultLogger.Level = defaultLevel
+	for _, l := range config.loggers {
+		l.Level = l.configuredLevel()
+	}
+
+	if len(invalid) > 0 {
+		return errors.New("invalid directives " + strings.Join(invalid, ", "))
+	}
+	return nil
 }
 
-func determineLevel(tag string, fallback Level) Level {
-	for _, e := range tagLevels {
-		if e.tag == tag {
-			return e.level
-		}
+// SetFormat selects the output format of all loggers: FormatText (the
+// default) or FormatJSON.
+func SetFormat(format string) error {
+	switch strings.ToLower(format) {
+	case FormatText:
+		atomic.StoreInt32(&jsonOutput, 0)
+	case FormatJSON:
+		atomic.StoreInt32(&jsonOutput, 1)
+	default:
+		return errors.New("unknown log format: " + format)
+	}
+	return nil
+}
+
+func jsonFormat() bool {
+	return atomic.LoadInt32(&jsonOutput) != 0
+}
+
+// Remember a new logger, and set its level.
+func register(l *Logger) *Logger {
+	config.Lock()
+	defer config.Unlock()
+
+	l.Level = l.configuredLevel()
+	config.loggers = append(config.loggers, l)
+	return l
+}
+
+// Return the level configured for this logger's tag, or else its default.
+// Requires config to be locked.
+func (log *Logger) configuredLevel() Level {
+	if level, ok := config.tagLevels[log.Tag]; ok {
+		return level
+	}
+	if log.hasDefaultLevel {
+		return log.defaultLevel
 	}
-	return fallback
+	return defaultLevel
 }
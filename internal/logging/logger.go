@@ -1,11 +1,13 @@
 package logging
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
@@ -26,6 +28,13 @@ type Logger struct {
 	// Shared by all derived loggers.
 	mu *sync.Mutex
 
+	// Level used unless configured for the tag, if set by WithDefaultLevel.
+	defaultLevel    Level
+	hasDefaultLevel bool
+
+	// Key-value pairs added to each message, set by With.
+	fields []field
+
 	// TODO: Support tee'ing to other loggers.
 	//children []*Logger
 }
@@ -35,8 +44,13 @@ type Logger struct {
 //	return &Logger{determineLevel(tag), tag, out, new(sync.Mutex)}
 //}
 
+type field struct {
+	key   string
+	value interface{}
+}
+
 // Write to stderr by default.
-var DefaultLogger = &Logger{defaultLevel, "", os.Stderr, new(sync.Mutex)}
+var DefaultLogger = &Logger{Level: defaultLevel, out: os.Stderr, mu: new(sync.Mutex)}
 
 // Override the destination for this logger.
 func (log *Logger) SetDestination(out io.Writer) {
@@ -46,13 +60,31 @@ func (log *Logger) SetDestination(out io.Writer) {
 // Derive a new logger with the given tag. Look up the level based on the tag.
 func (log *Logger) WithTag(tag string) *Logger {
 	// TODO: Make sure tag doesn't contain special characters.
-	return &Logger{determineLevel(tag, log.Level), tag, log.out, log.mu}
+	l := *log
+	l.Tag = tag
+	return register(&l)
 }
 
 // Derive a new logger with the given default level. This can still be overridden at
 // runtime.
 func (log *Logger) WithDefaultLevel(level Level) *Logger {
-	return &Logger{determineLevel(log.Tag, level), log.Tag, log.out, log.mu}
+	l := *log
+	l.defaultLevel = level
+	l.hasDefaultLevel = true
+	return register(&l)
+}
+
+// Derive a new logger that adds a key-value pair to each message, e.g. to
+// identify a session:
+//
+//	slog := log.With("session", id)
+//
+// The pair is written as "key=value" after a text message, or as a member of a
+// JSON message. The derived logger keeps the level of this one.
+func (log *Logger) With(key string, value interface{}) *Logger {
+	l := *log
+	l.fields = append(log.fields[:len(log.fields):len(log.fields)], field{key, value})
+	return &l
 }
 
 // Wrapper for []byte that implements io.Writer. Simpler and cheaper than
@@ -76,7 +108,7 @@ func (b *buffer) writeByte(c byte) {
 // accommodate *most* log lines.
 var bufPool = sync.Pool{
 	New: func() interface{} {
-		return make(buffer, 256)
+		return make(buffer, 0, 256)
 	},
 }
 
@@ -88,42 +120,98 @@ func (log *Logger) Log(level Level, calldepth int, format string, a ...interface
 		return
 	}
 
+	// Get the caller of Error()/Warn()/Info()/etc.
+	_, file, line, ok := runtime.Caller(calldepth + 1)
+	if !ok {
+		file = "?"
+	}
+
 	// Grab an empty buffer from the pool.
 	buf := bufPool.Get().(buffer)
 	// When we're done, reset the buffer and return it to the pool.
 	defer bufPool.Put(buf[:0])
 
+	if jsonFormat() {
+		log.appendJSON(&buf, level, filepath.Base(file), line, fmt.Sprintf(format, a...))
+	} else {
+		log.appendText(&buf, level, filepath.Base(file), line, format, a...)
+	}
+
+	// Lock before writing to avoid interleaving of log messages.
+	log.mu.Lock()
+	if _, err := log.out.Write(buf); err != nil {
+		panic(fmt.Sprintf("Failed to log to %v: %v", log.out, err))
+	}
+	log.mu.Unlock()
+}
+
+// Write a line of text, e.g.
+//
+//	2019-01-01 12:34:56.789 D/mypackage[afile.go:33] message key=value
+func (log *Logger) appendText(buf *buffer, level Level, file string, line int, format string, a ...interface{}) {
 	buf.Write(ansiWhite)
 
 	// Write the current timestamp.
-	buf = time.Now().AppendFormat(buf, timestampFormat)
+	*buf = time.Now().AppendFormat(*buf, timestampFormat)
 
 	// Write level and tag.
-	fmt.Fprintf(&buf, " %s%c/%s", level.color(), level.letter(), log.Tag)
-
-	// Get the caller of Error()/Warn()/Info()/etc.
-	_, file, line, ok := runtime.Caller(calldepth + 1)
-	if !ok {
-		file = "?"
-	}
+	fmt.Fprintf(buf, " %s%c/%s", level.color(), level.letter(), log.Tag)
 
 	// Write file and line number.
-	fmt.Fprintf(&buf, "[%s:%d] %s", filepath.Base(file), line, ansiReset)
+	fmt.Fprintf(buf, "[%s:%d] %s", file, line, ansiReset)
 
 	// Write formatted log message.
-	fmt.Fprintf(&buf, format, a...)
+	fmt.Fprintf(buf, format, a...)
+
+	// Write fields, before any trailing newline.
+	if len(log.fields) > 0 {
+		n := len(*buf)
+		if n > 0 && (*buf)[n-1] == '\n' {
+			*buf = (*buf)[:n-1]
+		}
+		for _, f := range log.fields {
+			fmt.Fprintf(buf, " %s=%v", f.key, f.value)
+		}
+	}
 
 	// Append newline if necessary.
-	if n := len(format); n == 0 || format[n-1] != '\n' {
+	if n := len(*buf); n == 0 || (*buf)[n-1] != '\n' {
 		buf.writeByte('\n')
 	}
+}
 
-	// Lock before writing to avoid interleaving of log messages.
-	log.mu.Lock()
-	if _, err := log.out.Write(buf); err != nil {
-		panic(fmt.Sprintf("Failed to log to %v: %v", log.out, err))
+// Write a JSON object on one line, e.g.
+//
+//	{"time":"2019-01-01T12:34:56.789Z","level":"debug","tag":"mypackage","caller":"afile.go:33","msg":"message","key":"value"}
+func (log *Logger) appendJSON(buf *buffer, level Level, file string, line int, msg string) {
+	buf.writeString(`{"time":`)
+	appendJSONValue(buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.writeString(`,"level":`)
+	appendJSONValue(buf, strings.ToLower(level.String()))
+	buf.writeString(`,"tag":`)
+	appendJSONValue(buf, log.Tag)
+	buf.writeString(`,"caller":`)
+	appendJSONValue(buf, fmt.Sprintf("%s:%d", file, line))
+	buf.writeString(`,"msg":`)
+	appendJSONValue(buf, strings.TrimSuffix(msg, "\n"))
+	for _, f := range log.fields {
+		buf.writeByte(',')
+		appendJSONValue(buf, f.key)
+		buf.writeByte(':')
+		appendJSONValue(buf, f.value)
 	}
-	log.mu.Unlock()
+	buf.writeString("}\n")
+}
+
+func appendJSONValue(buf *buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
 }
 
 func (log *Logger) Error(format string, a ...interface{}) {
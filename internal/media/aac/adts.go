@@ -0,0 +1,105 @@
+// Package aac parses AAC audio in ADTS framing (ISO/IEC 13818-7 §6.2), as
+// written by encoders producing a raw .aac stream.
+package aac
+
+import (
+	"errors"
+)
+
+// Length of an ADTS header, without and with the CRC.
+const (
+	headerSize    = 7
+	headerSizeCRC = 9
+)
+
+var errNotADTS = errors.New("aac: not an ADTS header")
+
+// Sample rates indexed by sampling_frequency_index.
+var sampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// ADTSHeader holds the fields of an ADTS frame header needed to describe and
+// depacketize a stream.
+type ADTSHeader struct {
+	// MPEG-4 audio object type, e.g. 2 for AAC LC.
+	ObjectType int
+
+	SampleRate int
+	Channels   int // 0 if given in the stream instead
+
+	// Whether the header is followed by a CRC.
+	HasCRC bool
+
+	// Length of the frame in bytes, including the header.
+	FrameLength int
+
+	// Number of AAC frames (access units) in the ADTS frame, usually 1.
+	Frames int
+}
+
+// HeaderLength returns the length of the header in bytes, i.e. the offset of
+// the frame's payload.
+func (h *ADTSHeader) HeaderLength() int {
+	if h.HasCRC {
+		return headerSizeCRC
+	}
+	return headerSize
+}
+
+// ParseADTSHeader parses the header at the start of an ADTS frame.
+func ParseADTSHeader(b []byte) (*ADTSHeader, error) {
+	// syncword (12 bits), then ID and layer, which is always 0.
+	if len(b) < headerSize || b[0] != 0xff || b[1]&0xf6 != 0xf0 {
+		return nil, errNotADTS
+	}
+	h := &ADTSHeader{
+		ObjectType:  int(b[2]>>6) + 1,
+		Channels:    int(b[2]&1)<<2 | int(b[3]>>6),
+		HasCRC:      b[1]&1 == 0, // protection_absent
+		FrameLength: int(b[3]&3)<<11 | int(b[4])<<3 | int(b[5]>>5),
+		Frames:      int(b[6]&3) + 1,
+	}
+	index := int(b[2]>>2) & 0xf
+	if index >= len(sampleRates) {
+		return nil, errors.New("aac: invalid sampling frequency index")
+	}
+	h.SampleRate = sampleRates[index]
+	if h.FrameLength < h.HeaderLength() {
+		return nil, errors.New("aac: invalid ADTS frame length")
+	}
+	return h, nil
+}
+
+// ScanADTSFrames is a bufio.SplitFunc that splits an ADTS stream into frames,
+// each including its header. Bytes that don't begin a valid frame are
+// skipped, so that a reader can join a stream midway.
+func ScanADTSFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for advance < len(data) {
+		b := data[advance:]
+		if b[0] != 0xff {
+			advance++
+			continue
+		}
+		if len(b) < headerSize {
+			break
+		}
+		h, err := ParseADTSHeader(b)
+		if err != nil {
+			advance++
+			continue
+		}
+		if len(b) < h.FrameLength {
+			if atEOF {
+				// Truncated final frame.
+				return len(data), nil, nil
+			}
+			break
+		}
+		return advance + h.FrameLength, b[:h.FrameLength], nil
+	}
+	if atEOF {
+		return len(data), nil, nil
+	}
+	return advance, nil, nil
+}
@@ -0,0 +1,78 @@
+package aac
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// Return an ADTS frame of stereo 44.1 kHz AAC LC, without CRC.
+func adtsFrame(payload ...byte) []byte {
+	n := headerSize + len(payload)
+	header := []byte{
+		0xff, 0xf1,
+		1<<6 | 4<<2 | 2>>2,
+		2<<6 | byte(n>>11)&3,
+		byte(n >> 3),
+		byte(n&7)<<5 | 0x1f,
+		0xfc,
+	}
+	return append(header, payload...)
+}
+
+func TestParseADTSHeader(t *testing.T) {
+	h, err := ParseADTSHeader(adtsFrame(1, 2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ADTSHeader{
+		ObjectType:  2,
+		SampleRate:  44100,
+		Channels:    2,
+		FrameLength: 10,
+		Frames:      1,
+	}
+	if *h != expected {
+		t.Errorf("expected %+v, got %+v", expected, *h)
+	}
+	if h.HeaderLength() != 7 {
+		t.Errorf("header length = %d", h.HeaderLength())
+	}
+
+	if _, err := ParseADTSHeader([]byte{0xff, 0xf1, 0x50}); err != errNotADTS {
+		t.Errorf("expected errNotADTS for a short header, got %v", err)
+	}
+	if _, err := ParseADTSHeader([]byte{0xff, 0xf1, 0x7c, 0x80, 0x01, 0x1f, 0xfc}); err == nil {
+		t.Error("accepted an invalid sampling frequency index")
+	}
+}
+
+func TestScanADTSFrames(t *testing.T) {
+	var stream []byte
+	stream = append(stream, 0xff, 0x00, 0x12) // Junk before the first frame
+	stream = append(stream, adtsFrame(1, 2, 3)...)
+	stream = append(stream, adtsFrame(0xff, 0xf1)...) // Payload resembling a header
+	stream = append(stream, adtsFrame()...)
+	stream = append(stream, adtsFrame(4, 5, 6)[:8]...) // Truncated
+	expected := [][]byte{
+		adtsFrame(1, 2, 3),
+		adtsFrame(0xff, 0xf1),
+		adtsFrame(),
+	}
+
+	// Deliver the stream a byte at a time, to split headers across reads.
+	s := bufio.NewScanner(iotest.OneByteReader(bytes.NewReader(stream)))
+	s.Split(ScanADTSFrames)
+	var frames [][]byte
+	for s.Scan() {
+		frames = append(frames, append([]byte(nil), s.Bytes()...))
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(frames, expected) {
+		t.Errorf("expected %x, got %x", expected, frames)
+	}
+}
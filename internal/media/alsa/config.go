@@ -0,0 +1,75 @@
+package alsa
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media/g711"
+)
+
+const (
+	// Codec delivered unless Config.Codec says otherwise. Every browser
+	// decodes it, whereas L16 is never negotiated.
+	DefaultCodec = "PCMU"
+
+	defaultL16SampleRate = 48000
+	defaultFrameDuration = 20 * time.Millisecond
+)
+
+// Config selects a capture device and the format of its audio.
+type Config struct {
+	// ALSA hardware device, e.g. "hw:1,0". Defaults to the first capture
+	// device.
+	Device string
+
+	// Encoding of the delivered audio: "PCMU" (G.711 µ-law, at 8 kHz, the
+	// default) or "L16" (16-bit linear PCM, for local use, since peer
+	// connections don't negotiate it). Both are encoded in pure Go, so need
+	// no cgo.
+	Codec string
+
+	// Sample rate of the delivered audio, in Hz: 48000 or 16000, say. If the
+	// device can't capture at this rate, it captures at 48 kHz, and the
+	// audio is resampled. Defaults to 8000 for PCMU, or 48000 for L16.
+	SampleRate int
+
+	// Duration of each delivered frame. Defaults to 20 ms.
+	FrameDuration time.Duration
+
+	// Remove the sound of the speaker from the captured audio, for two-way
+	// audio. The source then implements EchoReference, which must be given
+	// the audio played to the speaker. Requires the speexdsp build tag.
+	EchoCancellation bool
+
+	// Longest echo to cancel, i.e. the reverberation time of the room plus
+	// the playback latency. Defaults to 200 ms.
+	EchoTail time.Duration
+
+	// Suppress background noise. Requires the speexdsp build tag.
+	NoiseSuppression bool
+}
+
+// Fill in the defaults for zero fields, and check the codec and sample rate.
+func (cfg *Config) setDefaults() error {
+	switch strings.ToUpper(cfg.Codec) {
+	case "", "PCMU":
+		cfg.Codec = "PCMU"
+		if cfg.SampleRate <= 0 {
+			cfg.SampleRate = g711.SampleRate
+		} else if cfg.SampleRate != g711.SampleRate {
+			return errors.New("alsa: PCMU requires a sample rate of 8000 Hz")
+		}
+	case "L16":
+		cfg.Codec = "L16"
+		if cfg.SampleRate <= 0 {
+			cfg.SampleRate = defaultL16SampleRate
+		}
+	default:
+		return errors.New("alsa: unsupported codec: " + cfg.Codec)
+	}
+	if cfg.FrameDuration <= 0 {
+		cfg.FrameDuration = defaultFrameDuration
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package alsa
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	var cfg Config
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Codec != DefaultCodec || cfg.SampleRate != 8000 || cfg.FrameDuration != 20*time.Millisecond {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+
+	cfg = Config{Codec: "l16"}
+	if err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Codec != "L16" || cfg.SampleRate != 48000 {
+		t.Errorf("unexpected L16 defaults: %+v", cfg)
+	}
+
+	for _, cfg := range []Config{{SampleRate: 48000}, {Codec: "opus"}} {
+		if err := cfg.setDefaults(); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Package alsa provides access to ALSA sound devices on Linux.
+package alsa
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Kernel's list of PCM devices.
+const procPCM = "/proc/asound/pcm"
+
+// DeviceInfo describes an ALSA PCM capture device.
+type DeviceInfo struct {
+	// ALSA device name, e.g. "hw:1,0".
+	Name string
+
+	// Card and device numbers.
+	Card, Device int
+
+	// Human-readable name, e.g. "USB Audio".
+	Label string
+}
+
+// CaptureDevices lists the PCM devices that can capture audio. If ALSA isn't
+// available, the list is empty.
+func CaptureDevices() ([]DeviceInfo, error) {
+	f, err := os.Open(procPCM)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var devices []DeviceInfo
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if d, ok := parsePCMLine(s.Text()); ok {
+			devices = append(devices, d)
+		}
+	}
+	return devices, s.Err()
+}
+
+// Parse a line of /proc/asound/pcm, e.g.
+//
+//	01-00: USB Audio : USB Audio : capture 1
+//
+// ok is false unless the device can capture.
+func parsePCMLine(line string) (d DeviceInfo, ok bool) {
+	fields := strings.Split(line, " : ")
+	if len(fields) < 3 {
+		return d, false
+	}
+	if _, err := fmt.Sscanf(fields[0], "%d-%d:", &d.Card, &d.Device); err != nil {
+		log.Debug("Unexpected line in %s: %q", procPCM, line)
+		return d, false
+	}
+	for _, f := range fields[2:] {
+		if strings.HasPrefix(strings.TrimSpace(f), "capture") {
+			ok = true
+		}
+	}
+	d.Name = fmt.Sprintf("hw:%d,%d", d.Card, d.Device)
+	d.Label = strings.TrimSpace(strings.SplitN(fields[0], ":", 2)[1])
+	return d, ok
+}
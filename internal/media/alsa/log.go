@@ -0,0 +1,7 @@
+package alsa
+
+import (
+	"github.com/lanikai/alohartc/internal/logging"
+)
+
+var log = logging.DefaultLogger.WithTag("alsa")
@@ -0,0 +1,7 @@
+// +build !speexdsp !cgo !linux
+
+package alsa
+
+func newProcessor(cfg Config, frameSize int) (processor, error) {
+	return nil, errNoProcessing
+}
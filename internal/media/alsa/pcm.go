@@ -0,0 +1,203 @@
+// +build linux
+
+package alsa
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Structures and ioctls of the ALSA PCM kernel interface (sound/asound.h), so
+// that capture needs neither cgo nor alsa-lib. Without alsa-lib there are no
+// plugins, so only hardware devices ("hw:C,D") can be opened.
+
+const (
+	sndrvPCMAccessRWInterleaved = 3
+	sndrvPCMFormatS16LE         = 2
+	sndrvPCMSubformatStd        = 0
+
+	// Indexes of snd_pcm_hw_params masks.
+	hwParamAccess    = 0
+	hwParamFormat    = 1
+	hwParamSubformat = 2
+
+	// Indexes of snd_pcm_hw_params intervals.
+	hwParamChannels   = 10 - 8
+	hwParamRate       = 11 - 8
+	hwParamPeriodSize = 13 - 8
+	hwParamBufferSize = 17 - 8
+
+	// snd_interval flags (bit fields).
+	intervalInteger = 1 << 2
+
+	// Periods per buffer.
+	numPeriods = 4
+)
+
+type sndMask struct {
+	bits [8]uint32
+}
+
+type sndInterval struct {
+	min   uint32
+	max   uint32
+	flags uint32
+}
+
+type sndPCMHwParams struct {
+	flags     uint32
+	masks     [3]sndMask
+	mres      [5]sndMask
+	intervals [12]sndInterval
+	ires      [9]sndInterval
+	rmask     uint32
+	cmask     uint32
+	info      uint32
+	msbits    uint32
+	rateNum   uint32
+	rateDen   uint32
+	fifoSize  uint // unsigned long
+	reserved  [64]byte
+}
+
+type sndXferi struct {
+	result int // snd_pcm_sframes_t
+	buf    unsafe.Pointer
+	frames uint // snd_pcm_uframes_t
+}
+
+// Compute an ioctl request number, like _IOC in asm-generic/ioctl.h.
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'A'<<8 | nr
+}
+
+var (
+	sndrvPCMIoctlHwParams = ioc(3, 0x11, unsafe.Sizeof(sndPCMHwParams{}))
+	sndrvPCMIoctlPrepare  = ioc(0, 0x40, 0)
+	sndrvPCMIoctlDrop     = ioc(0, 0x43, 0)
+	sndrvPCMIoctlReadi    = ioc(2, 0x51, unsafe.Sizeof(sndXferi{}))
+)
+
+// A PCM capture device, delivering interleaved 16-bit samples.
+type pcm struct {
+	fd int
+
+	channels   int
+	rate       int
+	periodSize int // frames
+}
+
+// Open the capture PCM of an ALSA hardware device, e.g. "hw:1,0", asking for
+// the given format. If the hardware insists, the rate or channel count may
+// differ from those requested.
+func openPCM(device string, channels, rate, periodSize int) (*pcm, error) {
+	var card, dev int
+	if _, err := fmt.Sscanf(device, "hw:%d,%d", &card, &dev); err != nil {
+		return nil, fmt.Errorf("unsupported ALSA device %q, expected hw:CARD,DEVICE", device)
+	}
+
+	path := fmt.Sprintf("/dev/snd/pcmC%dD%dc", card, dev)
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &pcm{fd: fd}
+
+	// Try the exact buffer geometry first, then let the driver choose.
+	params := hwParamsAny()
+	params.setMask(hwParamAccess, sndrvPCMAccessRWInterleaved)
+	params.setMask(hwParamFormat, sndrvPCMFormatS16LE)
+	params.setMask(hwParamSubformat, sndrvPCMSubformatStd)
+	params.setInterval(hwParamChannels, channels)
+	params.setInterval(hwParamRate, rate)
+	exact := params
+	exact.setInterval(hwParamPeriodSize, periodSize)
+	exact.setInterval(hwParamBufferSize, periodSize*numPeriods)
+	if err = p.ioctl(sndrvPCMIoctlHwParams, unsafe.Pointer(&exact)); err == nil {
+		params = exact
+	} else if err = p.ioctl(sndrvPCMIoctlHwParams, unsafe.Pointer(&params)); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("%s: unsupported format (%d channels at %d Hz): %v", device, channels, rate, err)
+	}
+
+	p.channels = int(params.intervals[hwParamChannels].min)
+	p.rate = int(params.intervals[hwParamRate].min)
+	p.periodSize = int(params.intervals[hwParamPeriodSize].min)
+
+	if err := p.ioctl(sndrvPCMIoctlPrepare, nil); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Return hardware parameters that allow any configuration, to be narrowed by
+// setMask and setInterval (like snd_pcm_hw_params_any in alsa-lib).
+func hwParamsAny() sndPCMHwParams {
+	var params sndPCMHwParams
+	for i := range params.masks {
+		for j := range params.masks[i].bits {
+			params.masks[i].bits[j] = ^uint32(0)
+		}
+	}
+	for i := range params.intervals {
+		params.intervals[i].max = ^uint32(0)
+	}
+	params.rmask = ^uint32(0)
+	params.info = ^uint32(0)
+	return params
+}
+
+func (params *sndPCMHwParams) setMask(param, value int) {
+	params.masks[param] = sndMask{}
+	params.masks[param].bits[value/32] = 1 << uint(value%32)
+}
+
+func (params *sndPCMHwParams) setInterval(param, value int) {
+	params.intervals[param] = sndInterval{
+		min:   uint32(value),
+		max:   uint32(value),
+		flags: intervalInteger,
+	}
+}
+
+func (p *pcm) ioctl(request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(p.fd), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Read one period of interleaved samples into buf, which must hold
+// periodSize*channels samples. Blocks until the samples are available.
+func (p *pcm) read(buf []int16) error {
+	for {
+		x := sndXferi{
+			buf:    unsafe.Pointer(&buf[0]),
+			frames: uint(p.periodSize),
+		}
+		err := p.ioctl(sndrvPCMIoctlReadi, unsafe.Pointer(&x))
+		switch err {
+		case nil:
+			return nil
+		case syscall.EPIPE:
+			// Overrun: samples were lost because we didn't read in time.
+			log.Debug("Capture overrun")
+			if err := p.ioctl(sndrvPCMIoctlPrepare, nil); err != nil {
+				return err
+			}
+		case syscall.EINTR:
+		default:
+			return err
+		}
+	}
+}
+
+func (p *pcm) Close() error {
+	p.ioctl(sndrvPCMIoctlDrop, nil)
+	return unix.Close(p.fd)
+}
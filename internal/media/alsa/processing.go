@@ -0,0 +1,29 @@
+package alsa
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultEchoTail = 200 * time.Millisecond
+
+var errNoProcessing = errors.New("alsa: echo cancellation and noise suppression require the speexdsp build tag")
+
+// EchoReference is implemented by sources opened with EchoCancellation. Pass
+// it each frame of audio as it is queued to the speaker, in the source's
+// sample rate and frame duration, so that its echo can be removed from the
+// captured audio.
+type EchoReference interface {
+	Playback(pcm []int16)
+}
+
+// A processing stage applied to each captured frame before delivery.
+type processor interface {
+	// Process a captured frame in place.
+	process(frame []int16)
+
+	// Note a frame played to the speaker.
+	playback(frame []int16)
+
+	close()
+}
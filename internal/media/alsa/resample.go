@@ -0,0 +1,107 @@
+package alsa
+
+import (
+	"math"
+)
+
+// A decimator reduces the sample rate of mono audio by an integer factor,
+// e.g. from 48 kHz to 16 kHz, low-pass filtering first to avoid aliasing.
+type decimator struct {
+	factor int
+
+	// Windowed-sinc low-pass filter, in fixed point with tapBits fractional
+	// bits, so that filtering takes no floating point per sample, which
+	// softfloat targets (e.g. GOARM=5, or GOMIPS=softfloat) emulate slowly.
+	taps []int32
+
+	// Input samples not yet consumed, preceded by the last len(taps)-1
+	// samples, which the filter still needs.
+	history []int16
+}
+
+const (
+	// Filter length, per unit of decimation factor.
+	tapsPerFactor = 16
+
+	// Fractional bits of the fixed-point filter taps.
+	tapBits = 16
+)
+
+func newDecimator(factor int) *decimator {
+	n := tapsPerFactor*factor + 1
+	taps := make([]float64, n)
+
+	// Cut off a little below the output Nyquist frequency.
+	cutoff := 0.9 / float64(2*factor)
+	sum := 0.0
+	for i := range taps {
+		x := float64(i - n/2)
+		sinc := 2 * cutoff
+		if x != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		// Blackman window.
+		w := 0.42 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1)) +
+			0.08*math.Cos(4*math.Pi*float64(i)/float64(n-1))
+		taps[i] = sinc * w
+		sum += taps[i]
+	}
+
+	// Normalize to unity gain, putting the rounding error in the center tap
+	// so that the fixed-point taps still sum to exactly one.
+	fixed := make([]int32, n)
+	var total int32
+	for i := range taps {
+		fixed[i] = int32(math.Round(taps[i] / sum * (1 << tapBits)))
+		total += fixed[i]
+	}
+	fixed[n/2] += 1<<tapBits - total
+
+	return &decimator{
+		factor:  factor,
+		taps:    fixed,
+		history: make([]int16, n-1),
+	}
+}
+
+// Decimate the samples in, appending the output to dst.
+func (d *decimator) process(dst, in []int16) []int16 {
+	d.history = append(d.history, in...)
+
+	n := len(d.taps)
+	i := 0
+	for ; i+n <= len(d.history); i += d.factor {
+		var acc int64
+		for j, t := range d.taps {
+			acc += int64(t) * int64(d.history[i+j])
+		}
+		// Round to nearest.
+		dst = append(dst, clamp16((acc+1<<(tapBits-1))>>tapBits))
+	}
+
+	// Keep the unconsumed samples, and the filter's memory.
+	d.history = append(d.history[:0], d.history[i:]...)
+	return dst
+}
+
+func clamp16(x int64) int16 {
+	if x > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if x < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(x)
+}
+
+// Mix interleaved samples down to mono, appending the output to dst.
+func downmix(dst, in []int16, channels int) []int16 {
+	for i := 0; i+channels <= len(in); i += channels {
+		sum := 0
+		for _, s := range in[i : i+channels] {
+			sum += int(s)
+		}
+		dst = append(dst, int16(sum/channels))
+	}
+	return dst
+}
@@ -0,0 +1,65 @@
+package alsa
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Return the RMS level of a sine wave at freq Hz, after decimating it from
+// 48 kHz to 16 kHz.
+func decimatedLevel(freq float64) float64 {
+	const rate = 48000
+	in := make([]int16, rate/10)
+	for i := range in {
+		in[i] = int16(10000 * math.Sin(2*math.Pi*freq*float64(i)/rate))
+	}
+
+	// Feed the samples in uneven chunks, as from a device.
+	d := newDecimator(3)
+	var out []int16
+	for len(in) > 0 {
+		n := 241
+		if n > len(in) {
+			n = len(in)
+		}
+		out = d.process(out, in[:n])
+		in = in[n:]
+	}
+
+	// Skip the filter's warm-up.
+	out = out[len(d.taps):]
+	sum := 0.0
+	for _, s := range out {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(out)))
+}
+
+func TestDecimator(t *testing.T) {
+	const full = 10000 / math.Sqrt2
+
+	// Passband: 1 kHz is kept.
+	if level := decimatedLevel(1000); math.Abs(level-full) > 0.02*full {
+		t.Errorf("1 kHz: expected level %.0f, got %.0f", full, level)
+	}
+
+	// Stopband: 12 kHz would alias to 4 kHz, so it must be removed.
+	if level := decimatedLevel(12000); level > 0.01*full {
+		t.Errorf("12 kHz: expected level below %.0f, got %.0f", 0.01*full, level)
+	}
+
+	// One output sample per three input samples, with no delay in the
+	// number of samples, since the filter starts out primed with silence.
+	d := newDecimator(3)
+	if out := d.process(nil, make([]int16, 4800)); len(out) != 1600 {
+		t.Errorf("expected 1600 samples, got %d", len(out))
+	}
+}
+
+func TestDownmix(t *testing.T) {
+	out := downmix(nil, []int16{100, 300, -50, -150, 7, 8}, 2)
+	if expected := []int16{200, -100, 7}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("expected %v, got %v", expected, out)
+	}
+}
@@ -0,0 +1,283 @@
+// +build linux
+
+package alsa
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/g711"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+const (
+
+	// Rate at which to capture when the device can't capture at the
+	// requested rate. Nearly all devices support it.
+	fallbackRate = 48000
+)
+
+var errNoCaptureDevice = errors.New("no ALSA capture device")
+
+// Open a capture device, delivering mono audio as G.711 µ-law ("PCMU", the
+// default) or 16-bit linear PCM ("L16", big-endian as in RFC 3551), one frame
+// per buffer. Capture starts when the first receiver is added.
+func Open(cfg Config) (media.AudioSource, error) {
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+	if cfg.Device == "" {
+		devices, err := CaptureDevices()
+		if err != nil {
+			return nil, err
+		}
+		if len(devices) == 0 {
+			return nil, errNoCaptureDevice
+		}
+		cfg.Device = devices[0].Name
+	}
+
+	frameSize := int(int64(cfg.SampleRate) * int64(cfg.FrameDuration) / int64(time.Second))
+	var proc processor
+	if cfg.EchoCancellation || cfg.NoiseSuppression {
+		var err error
+		if proc, err = newProcessor(cfg, frameSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// Prefer capturing mono at the requested rate. Failing that, capture
+	// at 48 kHz and resample, and mix stereo down to mono.
+	var p *pcm
+	var err error
+	for _, channels := range []int{1, 2} {
+		for _, rate := range []int{cfg.SampleRate, fallbackRate} {
+			if rate%cfg.SampleRate != 0 {
+				continue
+			}
+			p, err = openPCM(cfg.Device, channels, rate, frameSize*rate/cfg.SampleRate)
+			if err == nil {
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if proc != nil {
+			proc.close()
+		}
+		return nil, err
+	}
+	if p.rate%cfg.SampleRate != 0 {
+		p.Close()
+		if proc != nil {
+			proc.close()
+		}
+		return nil, errors.New("alsa: unsupported sample rate")
+	}
+	log.Info("Capturing from %s: %d channels at %d Hz, %d frames per period",
+		cfg.Device, p.channels, p.rate, p.periodSize)
+
+	s := &audioSource{
+		cfg:       cfg,
+		pcm:       p,
+		frameSize: frameSize,
+		processor: proc,
+	}
+	if factor := p.rate / cfg.SampleRate; factor > 1 {
+		s.decimator = newDecimator(factor)
+	}
+	s.Flow.Start = s.start
+	s.Flow.Stop = s.stop
+	return s, nil
+}
+
+// A media.AudioSource capturing from an ALSA device.
+type audioSource struct {
+	media.Flow
+
+	// Measures the level of each frame, for the audio level header
+	// extension.
+	media.LevelTracker
+
+	cfg Config
+
+	pcm *pcm
+
+	// Samples per delivered frame.
+	frameSize int
+
+	// Resamples to cfg.SampleRate, if the device captures at a higher rate.
+	decimator *decimator
+
+	// Echo cancellation and noise suppression, if enabled.
+	processor processor
+
+	// Capture runs in a goroutine started with the first receiver, and
+	// pauses while there are none. Guarded by mu, since Stop runs in its own
+	// goroutine.
+	mu      sync.Mutex
+	running bool
+	active  bool
+	closed  bool
+	err     error
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func (s *audioSource) Codec() string {
+	return s.cfg.Codec
+}
+
+func (s *audioSource) SampleRate() int {
+	return s.cfg.SampleRate
+}
+
+func (s *audioSource) BytesPerSample() int {
+	if s.cfg.Codec == "PCMU" {
+		return 1
+	}
+	return 2
+}
+
+func (s *audioSource) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		// Called with the Flow locked, so shut down from another goroutine.
+		go s.Flow.Shutdown(s.err)
+		return
+	}
+	s.active = true
+	if !s.running {
+		s.running = true
+		s.wake = make(chan struct{}, 1)
+		s.done = make(chan struct{})
+		go s.capture()
+	}
+	s.signal()
+}
+
+func (s *audioSource) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active = false
+}
+
+// Wake the capture goroutine. Requires mu to be locked.
+func (s *audioSource) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Read periods from the device, and deliver them in frames.
+func (s *audioSource) capture() {
+	defer close(s.done)
+
+	p := s.pcm
+	period := make([]int16, p.periodSize*p.channels)
+	var mono, pending []int16
+	capturing := false
+	for {
+		s.mu.Lock()
+		active, closed := s.active, s.closed
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+		if !active {
+			if capturing {
+				// Stop capturing, ready to start again.
+				p.ioctl(sndrvPCMIoctlDrop, nil)
+				p.ioctl(sndrvPCMIoctlPrepare, nil)
+				capturing = false
+				pending = pending[:0]
+			}
+			<-s.wake
+			continue
+		}
+
+		capturing = true
+		if err := p.read(period); err != nil {
+			log.Warn("Capture failed: %v", err)
+			s.mu.Lock()
+			s.err = err
+			s.running = false
+			s.mu.Unlock()
+			s.Flow.Shutdown(err)
+			return
+		}
+
+		samples := period
+		if p.channels > 1 {
+			mono = downmix(mono[:0], period, p.channels)
+			samples = mono
+		}
+		if s.decimator != nil {
+			pending = s.decimator.process(pending, samples)
+		} else {
+			pending = append(pending, samples...)
+		}
+
+		for len(pending) >= s.frameSize {
+			s.deliver(pending[:s.frameSize])
+			pending = append(pending[:0], pending[s.frameSize:]...)
+		}
+	}
+}
+
+// Playback implements EchoReference.
+func (s *audioSource) Playback(pcm []int16) {
+	if s.processor != nil {
+		s.processor.playback(pcm)
+	}
+}
+
+func (s *audioSource) deliver(pcm []int16) {
+	if s.processor != nil {
+		s.processor.process(pcm)
+	}
+
+	var frame []byte
+	if s.cfg.Codec == "PCMU" {
+		frame = g711.Encode(nil, pcm)
+	} else {
+		frame = make([]byte, 2*len(pcm))
+		for i, v := range pcm {
+			binary.BigEndian.PutUint16(frame[2*i:], uint16(v))
+		}
+	}
+	s.Record(frame, pcm)
+
+	buf := packet.NewSharedBuffer(frame, 1, nil)
+	buf.SetCaptureTime(time.Now())
+	s.Flow.Put(buf)
+}
+
+// Close stops capture, and closes the device.
+func (s *audioSource) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	done := s.done
+	if s.running {
+		s.signal()
+	}
+	s.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	if s.processor != nil {
+		s.processor.close()
+	}
+	return s.pcm.Close()
+}
@@ -0,0 +1,86 @@
+// +build speexdsp,cgo,linux
+
+package alsa
+
+// #cgo pkg-config: speexdsp
+// #include <speex/speex_echo.h>
+// #include <speex/speex_preprocess.h>
+import "C"
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Echo cancellation and noise suppression by SpeexDSP.
+type speexProcessor struct {
+	// Guards echo, since playback and capture run in different goroutines.
+	mu sync.Mutex
+
+	echo       *C.SpeexEchoState
+	preprocess *C.SpeexPreprocessState
+	frameSize  int
+}
+
+func newProcessor(cfg Config, frameSize int) (processor, error) {
+	p := &speexProcessor{frameSize: frameSize}
+	rate := C.int(cfg.SampleRate)
+
+	p.preprocess = C.speex_preprocess_state_init(C.int(frameSize), rate)
+	denoise := C.int(0)
+	if cfg.NoiseSuppression {
+		denoise = 1
+	}
+	C.speex_preprocess_ctl(p.preprocess, C.SPEEX_PREPROCESS_SET_DENOISE, unsafe.Pointer(&denoise))
+
+	if cfg.EchoCancellation {
+		tail := cfg.EchoTail
+		if tail <= 0 {
+			tail = defaultEchoTail
+		}
+		filterLength := C.int(int64(cfg.SampleRate) * int64(tail) / int64(time.Second))
+		p.echo = C.speex_echo_state_init(C.int(frameSize), filterLength)
+		C.speex_echo_ctl(p.echo, C.SPEEX_ECHO_SET_SAMPLING_RATE, unsafe.Pointer(&rate))
+
+		// Let the preprocessor suppress the residual echo.
+		C.speex_preprocess_ctl(p.preprocess, C.SPEEX_PREPROCESS_SET_ECHO_STATE, unsafe.Pointer(p.echo))
+	}
+	return p, nil
+}
+
+func (p *speexProcessor) process(frame []int16) {
+	if len(frame) != p.frameSize {
+		return
+	}
+	in := (*C.spx_int16_t)(unsafe.Pointer(&frame[0]))
+
+	if p.echo != nil {
+		out := make([]int16, p.frameSize)
+		p.mu.Lock()
+		C.speex_echo_capture(p.echo, in, (*C.spx_int16_t)(unsafe.Pointer(&out[0])))
+		p.mu.Unlock()
+		copy(frame, out)
+	}
+	C.speex_preprocess_run(p.preprocess, in)
+}
+
+func (p *speexProcessor) playback(frame []int16) {
+	if p.echo == nil || len(frame) != p.frameSize {
+		return
+	}
+	p.mu.Lock()
+	C.speex_echo_playback(p.echo, (*C.spx_int16_t)(unsafe.Pointer(&frame[0])))
+	p.mu.Unlock()
+}
+
+func (p *speexProcessor) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.echo != nil {
+		C.speex_echo_state_destroy(p.echo)
+		p.echo = nil
+	}
+	C.speex_preprocess_state_destroy(p.preprocess)
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package alsa
+
+import (
+	"errors"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+func Open(cfg Config) (media.AudioSource, error) {
+	return nil, errors.New("ALSA is only supported on Linux")
+}
@@ -0,0 +1,192 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media/h264"
+	"github.com/lanikai/alohartc/internal/media/raw"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+const (
+	defaultBarsWidth     = 640
+	defaultBarsHeight    = 480
+	defaultBarsFrameRate = 15
+
+	// Interval between keyframes, which are large since they are not
+	// compressed, unless a receiver asks for one.
+	barsKeyframeInterval = 10 * time.Second
+)
+
+// 75% color bars, as YCbCr (BT.601, limited range): white, yellow, cyan,
+// green, magenta, red, blue.
+var colorBars = [][3]byte{
+	{180, 128, 128},
+	{162, 44, 142},
+	{131, 156, 44},
+	{112, 72, 58},
+	{84, 184, 198},
+	{65, 100, 212},
+	{35, 212, 114},
+}
+
+func init() {
+	RegisterScheme("bars", OpenBarsURI)
+}
+
+// OpenBarsURI opens a test pattern given by a URI of the form
+//
+//	bars:?width=640&height=480&fps=15
+//
+// where every parameter is optional.
+func OpenBarsURI(uri string) (VideoSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	width, height, fps := defaultBarsWidth, defaultBarsHeight, defaultBarsFrameRate
+	q := u.Query()
+	for name, field := range map[string]*int{
+		"width":  &width,
+		"height": &height,
+		"fps":    &fps,
+	} {
+		if v := q.Get(name); v != "" {
+			if *field, err = strconv.Atoi(v); err != nil {
+				return nil, errors.New("bars: invalid " + name + ": " + v)
+			}
+		}
+	}
+	return NewBarsSource(width, height, fps)
+}
+
+// NewBarsSource returns a video source generating a test pattern in pure Go,
+// for development and demos on machines without a supported camera: color
+// bars with a frame counter, above a bar sweeping back and forth. Its H.264 is
+// lossless but barely compressed, at several Mbps for the default 640x480 at
+// 15 fps, so it suits a LAN rather than a constrained uplink.
+func NewBarsSource(width, height, fps int) (VideoSource, error) {
+	if fps <= 0 {
+		return nil, errors.New("bars: invalid frame rate")
+	}
+	enc, err := h264.NewEncoder(width, height)
+	if err != nil {
+		return nil, err
+	}
+	b := &barsSource{
+		width:  width,
+		height: height,
+		fps:    fps,
+		enc:    enc,
+	}
+	loop := newSingletonLoop(b.run)
+	b.Flow.Start = loop.start
+	b.Flow.Stop = loop.stop
+	return b, nil
+}
+
+// A VideoSource generating color bars.
+type barsSource struct {
+	Flow
+
+	width, height, fps int
+
+	// Guards enc and keyframe, since receivers may request a keyframe at any
+	// time.
+	mu       sync.Mutex
+	enc      *h264.Encoder
+	keyframe bool
+}
+
+func (b *barsSource) Codec() string {
+	return "H264"
+}
+
+func (b *barsSource) Width() int {
+	return b.width
+}
+
+func (b *barsSource) Height() int {
+	return b.height
+}
+
+// ParameterSets implements ParameterSetProvider.
+func (b *barsSource) ParameterSets() [][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.enc.ParameterSets()
+}
+
+// RequestKeyframe implements KeyframeRequester.
+func (b *barsSource) RequestKeyframe() error {
+	b.mu.Lock()
+	b.keyframe = true
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *barsSource) run(quit <-chan struct{}) error {
+	ticker := time.NewTicker(time.Second / time.Duration(b.fps))
+	defer ticker.Stop()
+
+	frame := raw.NewFrame(b.width, b.height)
+	b.RequestKeyframe()
+	lastKeyframe := time.Now()
+	for n := 0; ; n++ {
+		drawBars(frame, n, 4*b.fps)
+
+		b.mu.Lock()
+		keyframe := b.keyframe || time.Since(lastKeyframe) >= barsKeyframeInterval
+		b.keyframe = false
+		nalus := b.enc.Encode(frame.Y, frame.U, frame.V, keyframe)
+		b.mu.Unlock()
+		if keyframe {
+			lastKeyframe = time.Now()
+		}
+
+		now := time.Now()
+		for _, nalu := range nalus {
+			buf := packet.NewSharedBuffer(nalu, 1, nil)
+			buf.SetCaptureTime(now)
+			b.Flow.Put(buf)
+		}
+
+		select {
+		case <-quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Draw frame n of the pattern, whose sweeping bar crosses the frame and back
+// every period frames. The bars are redrawn every frame, but only the counter
+// and the sweeping bar change, so only their macroblocks are coded.
+func drawBars(f *raw.Frame, n, period int) {
+	barsHeight := f.Height * 3 / 4
+	for i, c := range colorBars {
+		x0 := i * f.Width / len(colorBars)
+		x1 := (i + 1) * f.Width / len(colorBars)
+		f.FillRect(x0, 0, x1-x0, barsHeight, c[0], c[1], c[2])
+	}
+	scale := f.Height / 80
+	if scale < 1 {
+		scale = 1
+	}
+	f.DrawText(2*scale, 2*scale, fmt.Sprintf("%06d", n), scale)
+
+	// A white bar, a sixteenth of the width.
+	f.FillRect(0, barsHeight, f.Width, f.Height-barsHeight, 16, 128, 128)
+	barWidth := f.Width / 16
+	phase := n % period
+	if phase > period/2 {
+		phase = period - phase
+	}
+	x := phase * (f.Width - barWidth) / (period / 2)
+	f.FillRect(x, barsHeight, barWidth, f.Height-barsHeight, 235, 128, 128)
+}
@@ -0,0 +1,51 @@
+package media
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/media/h264"
+)
+
+func TestBarsSource(t *testing.T) {
+	src, err := Open("bars:?width=64&height=48&fps=50")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 64, src.Width())
+	assert.Equal(t, 48, src.Height())
+
+	r := src.AddReceiver(16)
+	defer src.RemoveReceiver(r)
+
+	// Read NALU types until n slices have been received.
+	readTypes := func(n int) []byte {
+		var types []byte
+		timeout := time.After(5 * time.Second)
+		for slices := 0; slices < n; {
+			select {
+			case buf := <-r.Buffers():
+				typ := h264.NALU(buf.Bytes()).Type()
+				types = append(types, typ)
+				if typ == h264.NALUTypeSlice || typ == h264.NALUTypeIDR {
+					slices++
+				}
+				buf.Release()
+			case <-timeout:
+				t.Fatalf("timed out after NALUs %v", types)
+			}
+		}
+		return types
+	}
+
+	assert.Equal(t, []byte{7, 8, 5, 1, 1}, readTypes(3))
+
+	src.(KeyframeRequester).RequestKeyframe()
+	types := readTypes(3)
+	assert.Contains(t, string(types), string([]byte{7, 8, 5}))
+
+	_, err = Open("bars:?fps=0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+package media
+
+// A DropPolicy decides which H.264 video a receiver loses when it falls
+// behind its source, e.g. because the link it sends over is too slow.
+// Either way, once a NALU is dropped, the rest of its group of pictures is
+// dropped too, since it can't be decoded without it, until the next keyframe.
+type DropPolicy int
+
+const (
+	// DropForLatency keeps the queue short, so that video stays live: when
+	// the queue overflows, a keyframe is requested to resume from as soon as
+	// possible.
+	DropForLatency DropPolicy = iota
+
+	// DropForQuality queues several times as much, letting latency build up
+	// to ride out a short stall instead. Once the queue is three-quarters
+	// full, pictures that no others refer to (nal_ref_idc 0) are dropped
+	// first, which costs no keyframe.
+	DropForQuality
+)
+
+// How many times the requested capacity DropForQuality queues.
+const qualityQueueFactor = 4
+
+// DropCounts counts the NALUs dropped by a video receiver, by reason.
+type DropCounts struct {
+	// Arrived at a full queue.
+	QueueFull uint64
+
+	// Depended on a dropped NALU, and so couldn't be decoded.
+	Dependent uint64
+
+	// Referred to by no other picture, and dropped early by DropForQuality.
+	Disposable uint64
+}
+
+// Add returns the sum of two counts.
+func (c DropCounts) Add(d DropCounts) DropCounts {
+	return DropCounts{
+		QueueFull:  c.QueueFull + d.QueueFull,
+		Dependent:  c.Dependent + d.Dependent,
+		Disposable: c.Disposable + d.Disposable,
+	}
+}
+
+// Total returns the number of NALUs dropped for any reason.
+func (c DropCounts) Total() uint64 {
+	return c.QueueFull + c.Dependent + c.Disposable
+}
+
+// A VideoReceiverAdder is a video source whose receivers can drop whole
+// groups of pictures when they fall behind, rather than arbitrary NALUs.
+// Sources built on Flow are all VideoReceiverAdders.
+type VideoReceiverAdder interface {
+	// AddVideoReceiver is like AddReceiver, but drops NALUs according to
+	// policy. requestKeyframe, if not nil, is called when the receiver needs
+	// a keyframe to resume from. The returned Receiver is a DropCounter.
+	AddVideoReceiver(capacity int, policy DropPolicy, requestKeyframe func()) Receiver
+}
+
+// A DropCounter is a Receiver that counts the NALUs it dropped.
+type DropCounter interface {
+	Drops() DropCounts
+}
@@ -0,0 +1,74 @@
+package media
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+func putNALUs(f *Flow, nalus ...byte) {
+	for _, header := range nalus {
+		f.Put(packet.NewSharedBuffer([]byte{header, 0}, 1, nil))
+	}
+}
+
+// Read the headers of the queued NALUs.
+func queued(r Receiver) (headers []byte) {
+	for len(r.Buffers()) > 0 {
+		buf := <-r.Buffers()
+		headers = append(headers, buf.Bytes()[0])
+		buf.Release()
+	}
+	return headers
+}
+
+func TestDropForLatency(t *testing.T) {
+	var f Flow
+	keyframes := make(chan struct{}, 1)
+	r := f.AddVideoReceiver(2, DropForLatency, func() { keyframes <- struct{}{} })
+	defer f.RemoveReceiver(r)
+
+	// The third slice finds the queue full, so the rest of the GOP goes too,
+	// except for parameter sets, up to the next IDR picture.
+	putNALUs(&f, 0x65, 0x41, 0x41)
+	if string(queued(r)) != "\x65\x41" {
+		t.Fatal("expected the first two NALUs")
+	}
+	// The IDR picture finds the queue full again.
+	putNALUs(&f, 0x41, 0x06, 0x67, 0x68, 0x65, 0x41)
+	if got := queued(r); string(got) != "\x67\x68" {
+		t.Errorf("expected the parameter sets, got % x", got)
+	}
+	putNALUs(&f, 0x65, 0x41)
+	if got := queued(r); string(got) != "\x65\x41" {
+		t.Errorf("expected the IDR picture and what follows, got % x", got)
+	}
+
+	select {
+	case <-keyframes:
+	case <-time.After(time.Second):
+		t.Error("no keyframe requested")
+	}
+	drops := r.(DropCounter).Drops()
+	if drops != (DropCounts{QueueFull: 2, Dependent: 3}) {
+		t.Errorf("unexpected drops %+v", drops)
+	}
+}
+
+func TestDropForQuality(t *testing.T) {
+	var f Flow
+	r := f.AddVideoReceiver(2, DropForQuality, nil)
+	defer f.RemoveReceiver(r)
+
+	// Queues 8. Once 6 are queued, non-reference slices (0x01) are dropped,
+	// but reference ones (0x41) are still queued, until the last overflows.
+	putNALUs(&f, 0x65, 0x41, 0x01, 0x41, 0x01, 0x41, 0x01, 0x41, 0x01, 0x41, 0x41)
+	if got := queued(r); string(got) != "\x65\x41\x01\x41\x01\x41\x41\x41" {
+		t.Errorf("unexpected queue % x", got)
+	}
+	drops := r.(DropCounter).Drops()
+	if drops != (DropCounts{QueueFull: 1, Disposable: 2}) {
+		t.Errorf("unexpected drops %+v", drops)
+	}
+}
@@ -0,0 +1,123 @@
+// +build ffmpeg !production
+
+package ffmpeg
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/aac"
+	"github.com/lanikai/alohartc/internal/media/g711"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+const (
+	defaultAACSampleRate = 48000
+
+	// Duration of each µ-law buffer.
+	frameDuration = 20 * time.Millisecond
+)
+
+// OpenAudio opens an audio source, delivering one 20 ms frame of µ-law
+// ("PCMU") or one ADTS frame of AAC per buffer. ffmpeg starts when the first
+// receiver is added, and is restarted whenever it exits, until the last
+// receiver is removed.
+func OpenAudio(cfg AudioConfig) (media.AudioSource, error) {
+	if cfg.Input == "" {
+		return nil, errNoInput
+	}
+	var split bufio.SplitFunc
+	switch strings.ToUpper(cfg.Codec) {
+	case "", "PCMU":
+		cfg.Codec = "PCMU"
+		cfg.SampleRate = g711.SampleRate
+		split = scanFrames(int(frameDuration * g711.SampleRate / time.Second))
+	case "AAC":
+		cfg.Codec = "AAC"
+		if cfg.SampleRate <= 0 {
+			cfg.SampleRate = defaultAACSampleRate
+		}
+		split = aac.ScanADTSFrames
+	default:
+		return nil, errors.New("ffmpeg: unsupported audio codec: " + cfg.Codec)
+	}
+	template := cfg.Args
+	if len(template) == 0 {
+		template = defaultAudioArgs(cfg.Codec)
+	}
+	program, err := lookPath(cfg.Program)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &audioSource{cfg: cfg}
+	a.process = process{
+		program: program,
+		args:    expand(template, map[string]int{"rate": cfg.SampleRate}, cfg.Input),
+		split:   split,
+		handle:  a.handle,
+	}
+	a.Flow.Start = a.process.start
+	a.Flow.Stop = a.process.stop
+	return a, nil
+}
+
+// Arguments to read an input in real time, and transcode its audio to codec.
+func defaultAudioArgs(codec string) []string {
+	args := []string{
+		"-hide_banner", "-loglevel", "warning", "-nostdin",
+		"-re", "-i", "{input}",
+		"-vn",
+	}
+	if codec == "AAC" {
+		return append(args, "-c:a", "aac", "-ar", "{rate}", "-f", "adts", "pipe:1")
+	}
+	return append(args, "-ac", "1", "-ar", "{rate}", "-f", "mulaw", "pipe:1")
+}
+
+// Return a bufio.SplitFunc that splits a stream into tokens of n bytes,
+// dropping a short final token.
+func scanFrames(n int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if len(data) >= n {
+			return n, data[:n], nil
+		}
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// A media.AudioSource reading the output of ffmpeg.
+type audioSource struct {
+	media.Flow
+
+	cfg     AudioConfig
+	process process
+}
+
+func (a *audioSource) Codec() string {
+	return a.cfg.Codec
+}
+
+func (a *audioSource) SampleRate() int {
+	return a.cfg.SampleRate
+}
+
+// BytesPerSample returns 1 for µ-law, or 0 for AAC, which is compressed.
+func (a *audioSource) BytesPerSample() int {
+	if a.cfg.Codec == "PCMU" {
+		return 1
+	}
+	return 0
+}
+
+func (a *audioSource) handle(frame []byte) {
+	buf := packet.NewSharedBuffer(append([]byte(nil), frame...), 1, nil)
+	buf.SetCaptureTime(time.Now())
+	a.Flow.Put(buf)
+}
@@ -0,0 +1,91 @@
+// +build ffmpeg !production
+
+package ffmpeg
+
+import (
+	"errors"
+	"net/url"
+	"runtime"
+	"strconv"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+const defaultCaptureFrameRate = 30
+
+func init() {
+	media.RegisterScheme("capture", OpenCaptureURI)
+}
+
+// OpenCaptureURI opens a camera given by a URI of the form
+//
+//	capture:DEVICE?width=1280&height=720&bitrate=1000000&framerate=30
+//
+// where DEVICE, which may be empty, is as for OpenCapture. Query parameters
+// are named after the fields of Config, in lower case.
+func OpenCaptureURI(uri string) (media.VideoSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	device, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	q := u.Query()
+	for name, field := range map[string]*int{
+		"width":     &cfg.Width,
+		"height":    &cfg.Height,
+		"bitrate":   &cfg.Bitrate,
+		"framerate": &cfg.FrameRate,
+	} {
+		if v := q.Get(name); v != "" {
+			if *field, err = strconv.Atoi(v); err != nil {
+				return nil, errors.New("ffmpeg: invalid " + name + ": " + v)
+			}
+		}
+	}
+	return OpenCapture(device, cfg)
+}
+
+// OpenCapture opens a camera through the capture framework of the platform:
+// AVFoundation on macOS, where device is an index or name (default "0");
+// DirectShow on Windows, where device is a name as listed by
+// "ffmpeg -list_devices true -f dshow -i dummy"; and Video4Linux2 elsewhere,
+// where device is a path (default /dev/video0). The camera's video is
+// encoded by ffmpeg, as for Open.
+func OpenCapture(device string, cfg Config) (media.VideoSource, error) {
+	if cfg.FrameRate <= 0 {
+		cfg.FrameRate = defaultCaptureFrameRate
+	}
+	input, err := captureInput(runtime.GOOS, device, cfg.FrameRate)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Input = device
+	return open(cfg, defaultVideoArgs(cfg, input))
+}
+
+// Return the input arguments of ffmpeg to capture from a device.
+func captureInput(goos, device string, fps int) ([]string, error) {
+	rate := strconv.Itoa(fps)
+	switch goos {
+	case "darwin":
+		if device == "" {
+			device = "0"
+		}
+		return []string{"-f", "avfoundation", "-framerate", rate, "-i", device + ":none"}, nil
+	case "windows":
+		if device == "" {
+			return nil, errors.New("ffmpeg: DirectShow requires a device name")
+		}
+		return []string{"-f", "dshow", "-framerate", rate, "-i", "video=" + device}, nil
+	default:
+		if device == "" {
+			device = "/dev/video0"
+		}
+		return []string{"-f", "v4l2", "-framerate", rate, "-i", device}, nil
+	}
+}
@@ -0,0 +1,52 @@
+package ffmpeg
+
+// Config describes an ffmpeg video source.
+type Config struct {
+	// Input of ffmpeg, e.g. a file, URL, or device, substituted for
+	// {input} in Args.
+	Input string
+
+	// Arguments of ffmpeg, which must write an H.264 elementary stream
+	// (Annex B) to stdout, with parameter sets before every keyframe. The
+	// placeholders {input}, {width}, {height} and {bitrate} are replaced by
+	// the corresponding fields. If empty, ffmpeg reads Input in real time and
+	// encodes it with libx264 for low latency.
+	Args []string
+
+	// Size of the encoded picture, or 0 to keep the input's size. If zero,
+	// the source reports the size found in the stream once it has started.
+	Width  int
+	Height int
+
+	// Encoder bitrate, in bits per second, or 0 for the encoder's default.
+	Bitrate int
+
+	// Capture frame rate of a camera opened with OpenCapture, in frames per
+	// second. Defaults to 30.
+	FrameRate int
+
+	// Path of ffmpeg, if not on $PATH.
+	Program string
+}
+
+// AudioConfig describes an ffmpeg audio source.
+type AudioConfig struct {
+	// Input of ffmpeg, substituted for {input} in Args.
+	Input string
+
+	// Codec of the source: "PCMU" (the default), to which ffmpeg must
+	// transcode to 8 kHz mono raw µ-law, or "AAC", which ffmpeg must write in
+	// ADTS framing.
+	Codec string
+
+	// Arguments of ffmpeg, writing the stream to stdout. The placeholders
+	// {input} and {rate} are replaced by Input and SampleRate. If empty,
+	// ffmpeg reads Input in real time and transcodes it to Codec.
+	Args []string
+
+	// Sample rate of AAC output, in Hz. Defaults to 48000.
+	SampleRate int
+
+	// Path of ffmpeg, if not on $PATH.
+	Program string
+}
@@ -0,0 +1,107 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stand in for ffmpeg with a shell, whose output is given by args.
+func TestRestart(t *testing.T) {
+	src, err := Open(Config{
+		Input:   "test",
+		Program: "sh",
+		Args:    []string{"-c", `printf '\000\000\000\001\145{input}'`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := src.AddReceiver(4)
+	defer src.RemoveReceiver(r)
+
+	// The shell exits after each NALU, and is restarted.
+	for i := 0; i < 2; i++ {
+		select {
+		case buf, ok := <-r.Buffers():
+			if !ok {
+				t.Fatalf("flow shut down: %v", r.Err())
+			}
+			if !bytes.Equal(buf.Bytes(), []byte("\x65test")) {
+				t.Errorf("unexpected NALU %x", buf.Bytes())
+			}
+			buf.Release()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for NALU %d", i)
+		}
+	}
+}
+
+func TestAudio(t *testing.T) {
+	src, err := OpenAudio(AudioConfig{
+		Input:   "400",
+		Program: "sh",
+		Args:    []string{"-c", "head -c {input} /dev/zero; exec sleep 10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.Codec() != "PCMU" || src.SampleRate() != 8000 {
+		t.Errorf("unexpected format %s/%d", src.Codec(), src.SampleRate())
+	}
+	r := src.AddReceiver(4)
+	defer src.RemoveReceiver(r)
+
+	// 400 bytes hold two 20 ms frames.
+	var sizes []int
+	timeout := time.After(5 * time.Second)
+	for len(sizes) < 2 {
+		select {
+		case buf := <-r.Buffers():
+			sizes = append(sizes, len(buf.Bytes()))
+			buf.Release()
+		case <-timeout:
+			t.Fatalf("timed out after frames %v", sizes)
+		}
+	}
+	if !reflect.DeepEqual(sizes, []int{160, 160}) {
+		t.Errorf("unexpected frames %v", sizes)
+	}
+
+	if _, err := OpenAudio(AudioConfig{Input: "x", Codec: "opus", Program: "sh"}); err == nil {
+		t.Error("accepted an unsupported codec")
+	}
+}
+
+func TestDefaultArgs(t *testing.T) {
+	args := expand(defaultVideoArgs(Config{Width: 640, Height: 360}, []string{"-i", "{input}"}), map[string]int{
+		"width":  640,
+		"height": 360,
+	}, "clip.mov")
+	joined := " " + strings.Join(args, " ") + " "
+	for _, want := range []string{" -i clip.mov ", " -vf scale=640:360 ", " -f h264 pipe:1 "} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("missing %q in %v", want, args)
+		}
+	}
+}
+
+func TestCaptureInput(t *testing.T) {
+	for _, test := range []struct {
+		goos, device string
+		expected     []string
+	}{
+		{"darwin", "", []string{"-f", "avfoundation", "-framerate", "30", "-i", "0:none"}},
+		{"windows", "Integrated Camera", []string{"-f", "dshow", "-framerate", "30", "-i", "video=Integrated Camera"}},
+		{"linux", "", []string{"-f", "v4l2", "-framerate", "30", "-i", "/dev/video0"}},
+	} {
+		input, err := captureInput(test.goos, test.device, 30)
+		if err != nil || !reflect.DeepEqual(input, test.expected) {
+			t.Errorf("%s: expected %q, got %q, %v", test.goos, test.expected, input, err)
+		}
+	}
+	if _, err := captureInput("windows", "", 30); err == nil {
+		t.Error("accepted DirectShow capture without a device name")
+	}
+}
@@ -0,0 +1,7 @@
+// +build ffmpeg !production
+
+package ffmpeg
+
+import "github.com/lanikai/alohartc/internal/logging"
+
+var log = logging.DefaultLogger.WithTag("ffmpeg")
@@ -0,0 +1,167 @@
+// +build ffmpeg !production
+
+// Package ffmpeg reads video and audio from an ffmpeg subprocess, as a
+// pragmatic way to stream formats, protocols and devices that the native
+// sources don't handle yet. ffmpeg writes an H.264 elementary stream, or µ-law
+// or ADTS audio, to a pipe, and is restarted whenever it exits.
+package ffmpeg
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest NALU or audio frame expected from ffmpeg.
+const maxTokenSize = 4 << 20
+
+// Delays before restarting ffmpeg after it exits, doubling after each
+// consecutive failure.
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = 30 * time.Second
+
+	// Run time after which ffmpeg is considered to have started
+	// successfully, resetting the restart delay.
+	stableRunTime = 10 * time.Second
+)
+
+// Replace the placeholders in an argument template.
+func expand(template []string, values map[string]int, input string) []string {
+	pairs := []string{"{input}", input}
+	for name, value := range values {
+		pairs = append(pairs, "{"+name+"}", strconv.Itoa(value))
+	}
+	r := strings.NewReplacer(pairs...)
+	args := make([]string, len(template))
+	for i, arg := range template {
+		args[i] = r.Replace(arg)
+	}
+	return args
+}
+
+// A process runs ffmpeg while started, splitting its output into tokens for
+// a handler, and restarts it with increasing delays whenever it exits.
+type process struct {
+	program string
+	args    []string
+	split   bufio.SplitFunc
+
+	// Called with each token, which is only valid until it returns.
+	handle func(token []byte)
+
+	mu      sync.Mutex
+	running bool
+	cmd     *exec.Cmd
+	restart *time.Timer
+	delay   time.Duration
+}
+
+func (p *process) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running = true
+	p.delay = minRestartDelay
+	p.launch()
+}
+
+func (p *process) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running = false
+	if p.restart != nil {
+		p.restart.Stop()
+		p.restart = nil
+	}
+	if p.cmd != nil {
+		p.cmd.Process.Kill()
+		p.cmd = nil
+	}
+}
+
+// Start ffmpeg. Called with p.mu held.
+func (p *process) launch() {
+	cmd := exec.Command(p.program, p.args...)
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		var stderr io.ReadCloser
+		if stderr, err = cmd.StderrPipe(); err == nil {
+			go logOutput(stderr)
+			err = cmd.Start()
+		}
+	}
+	if err != nil {
+		log.Warn("Failed to start %s: %v", p.program, err)
+		p.scheduleRestart()
+		return
+	}
+	log.Info("Started %s %v", p.program, cmd.Args[1:])
+	p.cmd = cmd
+	go p.read(cmd, stdout, time.Now())
+}
+
+// Read the output of ffmpeg until it exits, then restart it unless stopped.
+func (p *process) read(cmd *exec.Cmd, stdout io.Reader, started time.Time) {
+	s := bufio.NewScanner(stdout)
+	s.Buffer(make([]byte, 64*1024), maxTokenSize)
+	s.Split(p.split)
+	for s.Scan() {
+		p.handle(s.Bytes())
+	}
+	err := s.Err()
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = io.EOF
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Unless stopped, in which case a new process may have started since.
+	if p.cmd != cmd {
+		return
+	}
+	p.cmd = nil
+	log.Warn("%s exited: %v", p.program, err)
+	if time.Since(started) >= stableRunTime {
+		p.delay = minRestartDelay
+	}
+	p.scheduleRestart()
+}
+
+// Launch ffmpeg again after the current delay. Called with p.mu held.
+func (p *process) scheduleRestart() {
+	log.Info("Restarting %s in %v", p.program, p.delay)
+	var timer *time.Timer
+	timer = time.AfterFunc(p.delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.restart != timer {
+			return
+		}
+		p.restart = nil
+		p.launch()
+	})
+	p.restart = timer
+
+	p.delay *= 2
+	if p.delay > maxRestartDelay {
+		p.delay = maxRestartDelay
+	}
+}
+
+// Log the diagnostics written by ffmpeg.
+func logOutput(r io.Reader) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		log.Debug("%s", s.Text())
+	}
+}
@@ -0,0 +1,23 @@
+// +build production,!ffmpeg
+
+package ffmpeg
+
+import (
+	"errors"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+var errDisabled = errors.New("ffmpeg support disabled")
+
+func Open(cfg Config) (media.VideoSource, error) {
+	return nil, errDisabled
+}
+
+func OpenAudio(cfg AudioConfig) (media.AudioSource, error) {
+	return nil, errDisabled
+}
+
+func OpenCapture(device string, cfg Config) (media.VideoSource, error) {
+	return nil, errDisabled
+}
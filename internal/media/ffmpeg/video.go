@@ -0,0 +1,159 @@
+// +build ffmpeg !production
+
+package ffmpeg
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/h264"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+const defaultProgram = "ffmpeg"
+
+var errNoInput = errors.New("ffmpeg: no input")
+
+func init() {
+	media.RegisterScheme("ffmpeg", OpenURI)
+}
+
+// OpenURI opens a video source given by a URI of the form ffmpeg:INPUT, e.g.
+// ffmpeg:/srv/clip.mov or ffmpeg:rtmp://example.com/live, where INPUT is
+// passed to ffmpeg verbatim and encoded with the default arguments.
+func OpenURI(uri string) (media.VideoSource, error) {
+	i := strings.IndexByte(uri, ':')
+	return Open(Config{Input: uri[i+1:]})
+}
+
+// Open a video source. ffmpeg starts when the first receiver is added, and
+// is restarted whenever it exits, until the last receiver is removed.
+func Open(cfg Config) (media.VideoSource, error) {
+	if cfg.Input == "" {
+		return nil, errNoInput
+	}
+	template := cfg.Args
+	if len(template) == 0 {
+		template = defaultVideoArgs(cfg, []string{"-re", "-i", "{input}"})
+	}
+	return open(cfg, template)
+}
+
+// Open a video source running ffmpeg with an argument template.
+func open(cfg Config, template []string) (media.VideoSource, error) {
+	program, err := lookPath(cfg.Program)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &videoSource{cfg: cfg}
+	v.process = process{
+		program: program,
+		args: expand(template, map[string]int{
+			"width":   cfg.Width,
+			"height":  cfg.Height,
+			"bitrate": cfg.Bitrate,
+		}, cfg.Input),
+		split:  h264.ScanNALUs,
+		handle: v.handle,
+	}
+	v.Flow.Start = v.process.start
+	v.Flow.Stop = v.process.stop
+	return v, nil
+}
+
+// Arguments to read an input, given by input arguments, and encode it for
+// WebRTC with as little latency as possible.
+func defaultVideoArgs(cfg Config, input []string) []string {
+	args := []string{"-hide_banner", "-loglevel", "warning", "-nostdin"}
+	args = append(args, input...)
+	args = append(args,
+		"-an",
+		"-c:v", "libx264",
+		"-profile:v", "baseline",
+		"-pix_fmt", "yuv420p",
+		"-preset", "ultrafast",
+		"-tune", "zerolatency",
+		"-x264-params", "repeat-headers=1",
+	)
+	if cfg.Width > 0 && cfg.Height > 0 {
+		args = append(args, "-vf", "scale={width}:{height}")
+	}
+	if cfg.Bitrate > 0 {
+		args = append(args, "-b:v", "{bitrate}", "-maxrate", "{bitrate}", "-bufsize", "{bitrate}")
+	}
+	return append(args, "-f", "h264", "pipe:1")
+}
+
+// Return the path of ffmpeg.
+func lookPath(program string) (string, error) {
+	if program == "" {
+		program = defaultProgram
+	}
+	path, err := exec.LookPath(program)
+	if err != nil {
+		return "", errors.New("ffmpeg: " + program + " not found")
+	}
+	return path, nil
+}
+
+// A media.VideoSource reading the output of ffmpeg.
+type videoSource struct {
+	media.Flow
+
+	cfg     Config
+	process process
+
+	// Guards sps, which is parsed from the stream.
+	mu  sync.Mutex
+	sps *h264.SPS
+}
+
+func (v *videoSource) Codec() string {
+	return "H264"
+}
+
+// Width returns the configured width, or else the width found in the stream,
+// which is 0 until ffmpeg has started.
+func (v *videoSource) Width() int {
+	if v.cfg.Width > 0 {
+		return v.cfg.Width
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.sps == nil {
+		return 0
+	}
+	return v.sps.Width
+}
+
+// Height returns the configured height, or else the height found in the
+// stream, which is 0 until ffmpeg has started.
+func (v *videoSource) Height() int {
+	if v.cfg.Height > 0 {
+		return v.cfg.Height
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.sps == nil {
+		return 0
+	}
+	return v.sps.Height
+}
+
+func (v *videoSource) handle(nalu []byte) {
+	if h264.NALU(nalu).Type() == h264.NALUTypeSPS {
+		if sps, err := h264.ParseSPS(nalu); err == nil {
+			v.mu.Lock()
+			v.sps = sps
+			v.mu.Unlock()
+		}
+	}
+	buf := packet.NewSharedBuffer(append([]byte(nil), nalu...), 1, nil)
+	buf.SetCaptureTime(time.Now())
+	v.Flow.Put(buf)
+}
@@ -2,6 +2,7 @@ package media
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/lanikai/alohartc/internal/packet"
 )
@@ -21,6 +22,21 @@ type Flow struct {
 }
 
 func (f *Flow) AddReceiver(capacity int) Receiver {
+	return f.addReceiver(capacity, nil)
+}
+
+// AddVideoReceiver implements VideoReceiverAdder, for H.264 video.
+func (f *Flow) AddVideoReceiver(capacity int, policy DropPolicy, requestKeyframe func()) Receiver {
+	if policy == DropForQuality {
+		capacity *= qualityQueueFactor
+	}
+	return f.addReceiver(capacity, &videoDropper{
+		policy:          policy,
+		requestKeyframe: requestKeyframe,
+	})
+}
+
+func (f *Flow) addReceiver(capacity int, video *videoDropper) Receiver {
 	f.Lock()
 	defer f.Unlock()
 
@@ -29,7 +45,8 @@ func (f *Flow) AddReceiver(capacity int) Receiver {
 	}
 
 	r := &flowReceiver{
-		ch: make(chan *packet.SharedBuffer, capacity),
+		ch:    make(chan *packet.SharedBuffer, capacity),
+		video: video,
 	}
 	f.receivers = append(f.receivers, r)
 	if f.Start != nil && len(f.receivers) == 1 {
@@ -66,12 +83,19 @@ func (f *Flow) Put(buf *packet.SharedBuffer) error {
 	defer f.Unlock()
 
 	for _, r := range f.receivers {
+		if r.video != nil && r.video.drop(buf, len(r.ch), cap(r.ch)) {
+			continue
+		}
 		buf.Hold()
 		select {
 		case r.ch <- buf:
 		default:
-			log.Warn("media.Flow: receiver missed a buffer")
-			// TODO: Keep per-receiver count of missed buffers?
+			atomic.AddUint64(&r.queueFull, 1)
+			if r.video != nil {
+				r.video.overflow()
+			} else {
+				log.Warn("media.Flow: receiver missed a buffer")
+			}
 			buf.Release()
 		}
 	}
@@ -99,8 +123,24 @@ func (f *Flow) Shutdown(cause error) {
 }
 
 type flowReceiver struct {
+	// Buffers dropped because ch was full. Accessed atomically.
+	queueFull uint64
+
 	ch  chan *packet.SharedBuffer
 	err error
+
+	// Drop policy of a video receiver, or nil.
+	video *videoDropper
+}
+
+// Drops implements DropCounter.
+func (r *flowReceiver) Drops() DropCounts {
+	c := DropCounts{QueueFull: atomic.LoadUint64(&r.queueFull)}
+	if r.video != nil {
+		c.Dependent = atomic.LoadUint64(&r.video.dependent)
+		c.Disposable = atomic.LoadUint64(&r.video.disposable)
+	}
+	return c
 }
 
 func (r *flowReceiver) Buffers() <-chan *packet.SharedBuffer {
@@ -117,3 +157,58 @@ func (r *flowReceiver) closeAndDrain() {
 		buf.Release()
 	}
 }
+
+// The drop policy of a video receiver, applied by Flow.Put with the Flow
+// locked.
+type videoDropper struct {
+	// NALUs dropped by reason. Accessed atomically.
+	dependent  uint64
+	disposable uint64
+
+	policy          DropPolicy
+	requestKeyframe func()
+
+	// Set from an overflow until the next keyframe.
+	dropping bool
+}
+
+// Report whether to drop a NALU, given the receiver's queue length and
+// capacity.
+func (d *videoDropper) drop(buf *packet.SharedBuffer, queued, capacity int) bool {
+	nalu := buf.Bytes()
+	if len(nalu) == 0 {
+		return false
+	}
+	naluType := nalu[0] & 0x1f
+	if d.dropping {
+		// Resume at the next IDR picture. Parameter sets depend on nothing,
+		// so pass them, in case the IDR picture is preceded by new ones.
+		switch naluType {
+		case 5: // IDR slice
+			d.dropping = false
+		case 7, 8: // SPS, PPS
+		default:
+			atomic.AddUint64(&d.dependent, 1)
+			return true
+		}
+	}
+	if d.policy == DropForQuality && queued >= capacity*3/4 && naluType == 1 && nalu[0]&0x60 == 0 {
+		atomic.AddUint64(&d.disposable, 1)
+		return true
+	}
+	return false
+}
+
+// Start dropping the rest of the group of pictures, after a NALU found the
+// queue full.
+func (d *videoDropper) overflow() {
+	if d.dropping {
+		return
+	}
+	d.dropping = true
+	log.Warn("media.Flow: receiver fell behind; dropping video until the next keyframe")
+	if d.requestKeyframe != nil {
+		// The source may be holding its own locks while it calls Put.
+		go d.requestKeyframe()
+	}
+}
@@ -0,0 +1,66 @@
+// Package g711 implements the ITU-T G.711 µ-law codec (RTP payload type 0,
+// "PCMU"). It is pure Go and uses only integer arithmetic, so it is suitable
+// for CGO-free builds on targets without an FPU.
+package g711
+
+// SampleRate of G.711 audio, in Hz.
+const SampleRate = 8000
+
+const (
+	bias = 0x84  // Added to magnitude before encoding
+	clip = 32635 // Maximum magnitude before bias
+)
+
+// EncodeSample converts a 16-bit linear PCM sample to µ-law.
+func EncodeSample(pcm int16) byte {
+	sample := int(pcm)
+	sign := 0
+	if sample < 0 {
+		sample = -sample
+		sign = 0x80
+	}
+	if sample > clip {
+		sample = clip
+	}
+	sample += bias
+
+	// Find the segment (position of the highest set bit above bit 7).
+	exponent := 7
+	for mask := 0x4000; sample&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (sample >> uint(exponent+3)) & 0x0f
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// DecodeSample converts a µ-law sample to 16-bit linear PCM.
+func DecodeSample(u byte) int16 {
+	u = ^u
+	sign := u & 0x80
+	exponent := uint(u>>4) & 0x07
+	mantissa := int(u & 0x0f)
+	sample := ((mantissa << 3) + bias) << exponent
+	sample -= bias
+	if sign != 0 {
+		return int16(-sample)
+	}
+	return int16(sample)
+}
+
+// Encode converts 16-bit linear PCM samples to µ-law. The result is appended
+// to dst, which may be nil.
+func Encode(dst []byte, pcm []int16) []byte {
+	for _, s := range pcm {
+		dst = append(dst, EncodeSample(s))
+	}
+	return dst
+}
+
+// Decode converts µ-law samples to 16-bit linear PCM. The result is appended
+// to dst, which may be nil.
+func Decode(dst []int16, ulaw []byte) []int16 {
+	for _, u := range ulaw {
+		dst = append(dst, DecodeSample(u))
+	}
+	return dst
+}
@@ -0,0 +1,42 @@
+package g711
+
+import (
+	"testing"
+)
+
+func TestEncodeKnownValues(t *testing.T) {
+	cases := []struct {
+		pcm  int16
+		ulaw byte
+	}{
+		{0, 0xff},
+		{-1, 0x7f},
+		{32767, 0x80},
+		{-32768, 0x00},
+		{1000, 0xce},
+	}
+	for _, c := range cases {
+		if u := EncodeSample(c.pcm); u != c.ulaw {
+			t.Errorf("EncodeSample(%d) = 0x%02x, expected 0x%02x", c.pcm, u, c.ulaw)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for pcm := -32768; pcm <= 32767; pcm += 7 {
+		decoded := int(DecodeSample(EncodeSample(int16(pcm))))
+		// Quantization error grows with magnitude, up to 1/32 of the value
+		// (plus the bias) in the highest segment.
+		tolerance := 8 + abs(pcm)/16
+		if abs(decoded-pcm) > tolerance {
+			t.Fatalf("round trip %d -> %d exceeds tolerance %d", pcm, decoded, tolerance)
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
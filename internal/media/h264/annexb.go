@@ -0,0 +1,44 @@
+package h264
+
+import (
+	"bytes"
+)
+
+var startCode = []byte{0, 0, 1}
+
+// ScanNALUs is a bufio.SplitFunc that splits an Annex B byte stream (ITU-T
+// H.264 Annex B), as written by most encoders, into NAL units without start
+// codes. Bytes before the first start code are skipped.
+func ScanNALUs(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.Index(data, startCode)
+	if start < 0 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		// Keep the last two bytes, which may begin a start code.
+		if len(data) > 2 {
+			return len(data) - 2, nil, nil
+		}
+		return 0, nil, nil
+	}
+	start += len(startCode)
+
+	end := bytes.Index(data[start:], startCode)
+	if end < 0 {
+		if !atEOF {
+			// Skip to the start code, and wait for the rest of the NALU.
+			return start - len(startCode), nil, nil
+		}
+		end = len(data)
+	} else {
+		end += start
+	}
+
+	// Trailing zeros belong to the next start code (zero_byte), or are
+	// padding (trailing_zero_8bits).
+	nalu := bytes.TrimRight(data[start:end], "\x00")
+	if len(nalu) == 0 {
+		return end, nil, nil
+	}
+	return end, nalu, nil
+}
@@ -0,0 +1,39 @@
+package h264
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestScanNALUs(t *testing.T) {
+	stream := []byte{
+		0xff,                   // Junk before the first start code
+		0, 0, 0, 1, 0x67, 1, 2, // SPS, with a 4-byte start code
+		0, 0, 1, 0x68, 3, // PPS, with a 3-byte start code
+		0, 0, 0, 1, 0x65, 0, 0, 3, 1, 4, // IDR, with emulation prevention
+		0, 0, 0, 1, 0x41, 5, 0, 0, // Slice, with trailing zeros
+	}
+	expected := [][]byte{
+		{0x67, 1, 2},
+		{0x68, 3},
+		{0x65, 0, 0, 3, 1, 4},
+		{0x41, 5},
+	}
+
+	// Deliver the stream a byte at a time, to split start codes across reads.
+	s := bufio.NewScanner(iotest.OneByteReader(bytes.NewReader(stream)))
+	s.Split(ScanNALUs)
+	var nalus [][]byte
+	for s.Scan() {
+		nalus = append(nalus, append([]byte(nil), s.Bytes()...))
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nalus, expected) {
+		t.Errorf("expected %x, got %x", expected, nalus)
+	}
+}
@@ -0,0 +1,166 @@
+package h264
+
+import (
+	"errors"
+)
+
+var errTruncated = errors.New("h264: truncated parameter set")
+
+// A bitReader reads the fields of a raw byte sequence payload (RBSP), i.e. a
+// NALU payload with emulation prevention bytes removed.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+// Return the RBSP of a NALU payload, removing each emulation prevention byte
+// (the 3 in 0x000003). See ITU-T H.264 §7.4.1.
+func unescapeRBSP(b []byte) []byte {
+	rbsp := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, c)
+	}
+	return rbsp
+}
+
+// Read n bits (at most 32) as an unsigned integer.
+func (r *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= 8*len(r.data) {
+			r.err = errTruncated
+			return 0
+		}
+		bit := r.data[r.pos/8] >> uint(7-r.pos%8) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.u(1) == 1
+}
+
+// Read an unsigned Exp-Golomb code, ue(v).
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.u(1) == 0 {
+		if r.err != nil || zeros == 31 {
+			r.err = errTruncated
+			return 0
+		}
+		zeros++
+	}
+	return int(1<<uint(zeros)-1) + int(r.u(zeros))
+}
+
+// Read a signed Exp-Golomb code, se(v).
+func (r *bitReader) se() int {
+	k := r.ue()
+	if k%2 == 1 {
+		return (k + 1) / 2
+	}
+	return -k / 2
+}
+
+// Return a NALU payload for an RBSP, inserting an emulation prevention byte
+// wherever two zero bytes are followed by a byte that could be mistaken for
+// a start code. See ITU-T H.264 §7.4.1.
+func escapeRBSP(rbsp []byte) []byte {
+	b := make([]byte, 0, len(rbsp)+len(rbsp)/64)
+	zeros := 0
+	for _, c := range rbsp {
+		if zeros >= 2 && c <= 3 {
+			b = append(b, 3)
+			zeros = 0
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// A bitWriter writes the fields of an RBSP.
+type bitWriter struct {
+	data []byte
+	cur  byte
+	n    int // bits in cur
+}
+
+// Write the low n bits of v.
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | byte(v>>uint(i)&1)
+		w.n++
+		if w.n == 8 {
+			w.data = append(w.data, w.cur)
+			w.cur, w.n = 0, 0
+		}
+	}
+}
+
+func (w *bitWriter) flag(b bool) {
+	if b {
+		w.u(1, 1)
+	} else {
+		w.u(1, 0)
+	}
+}
+
+// Write an unsigned Exp-Golomb code, ue(v).
+func (w *bitWriter) ue(v int) {
+	x := uint32(v) + 1
+	n := 0
+	for x>>uint(n) > 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, x)
+}
+
+// Write a signed Exp-Golomb code, se(v).
+func (w *bitWriter) se(v int) {
+	if v > 0 {
+		w.ue(2*v - 1)
+	} else {
+		w.ue(-2 * v)
+	}
+}
+
+// Pad with zero bits to a byte boundary.
+func (w *bitWriter) align() {
+	if w.n > 0 {
+		w.u(8-w.n, 0)
+	}
+}
+
+// Write whole bytes, which must start on a byte boundary.
+func (w *bitWriter) bytes(b []byte) {
+	if w.n != 0 {
+		panic("h264: unaligned write")
+	}
+	w.data = append(w.data, b...)
+}
+
+// Finish the RBSP with rbsp_trailing_bits, and return it.
+func (w *bitWriter) trailingBits() []byte {
+	w.u(1, 1)
+	w.align()
+	return w.data
+}
@@ -0,0 +1,255 @@
+package h264
+
+import (
+	"bytes"
+	"errors"
+)
+
+// NALU types of coded slices.
+const (
+	NALUTypeSlice = 1
+	NALUTypeIDR   = 5
+)
+
+// Slice types, in their "all slices of the picture" form.
+const (
+	sliceTypeP = 5
+	sliceTypeI = 7
+)
+
+// mb_type of I_PCM in I slices; P slices add the 5 inter types.
+const (
+	mbTypeIPCM       = 25
+	numInterMBTypesP = 5
+)
+
+// Bits of frame_num, as log2_max_frame_num_minus4 + 4.
+const frameNumBits = 4
+
+var errEncoderSize = errors.New("h264: invalid picture size")
+
+// Largest frame size, in macroblocks, of each level (ITU-T H.264 Table A-1).
+var levelLimits = []struct {
+	levelIDC    byte
+	maxFrameMBs int
+}{
+	{30, 1620},
+	{31, 3600},
+	{32, 5120},
+	{40, 8192},
+	{50, 22080},
+	{51, 36864},
+}
+
+// An Encoder compresses I420 pictures into a constrained baseline stream,
+// without transforms or motion search: keyframes code every macroblock as
+// I_PCM, i.e. uncompressed, and other frames code only the macroblocks that
+// changed since the previous frame, skipping the rest. Lossless and cheap,
+// it suits synthetic pictures that change little from frame to frame, such
+// as test patterns, rather than camera video.
+type Encoder struct {
+	width, height     int
+	mbWidth, mbHeight int
+
+	sps, pps []byte
+
+	// Previous picture, for detecting unchanged macroblocks.
+	prevY, prevU, prevV []byte
+
+	frameNum int
+	idrPicID int
+}
+
+// NewEncoder returns an encoder of pictures of the given size, which must be
+// even.
+func NewEncoder(width, height int) (*Encoder, error) {
+	if width <= 0 || height <= 0 || width%2 != 0 || height%2 != 0 {
+		return nil, errEncoderSize
+	}
+	e := &Encoder{
+		width:    width,
+		height:   height,
+		mbWidth:  (width + 15) / 16,
+		mbHeight: (height + 15) / 16,
+	}
+	level := byte(0)
+	for _, l := range levelLimits {
+		if e.mbWidth*e.mbHeight <= l.maxFrameMBs {
+			level = l.levelIDC
+			break
+		}
+	}
+	if level == 0 {
+		return nil, errEncoderSize
+	}
+	e.sps = e.encodeSPS(level)
+	e.pps = e.encodePPS()
+	return e, nil
+}
+
+// ParameterSets returns the SPS and PPS NALUs.
+func (e *Encoder) ParameterSets() [][]byte {
+	return [][]byte{e.sps, e.pps}
+}
+
+func (e *Encoder) encodeSPS(level byte) []byte {
+	w := &bitWriter{}
+	w.u(8, 66)   // profile_idc: baseline
+	w.u(8, 0xc0) // constraint_set0_flag and constraint_set1_flag
+	w.u(8, uint32(level))
+	w.ue(0)                // seq_parameter_set_id
+	w.ue(frameNumBits - 4) // log2_max_frame_num_minus4
+	w.ue(2)                // pic_order_cnt_type: output in decoding order
+	w.ue(1)                // max_num_ref_frames
+	w.flag(false)          // gaps_in_frame_num_value_allowed_flag
+	w.ue(e.mbWidth - 1)
+	w.ue(e.mbHeight - 1)
+	w.flag(true) // frame_mbs_only_flag
+	w.flag(true) // direct_8x8_inference_flag
+	cropRight := (e.mbWidth*16 - e.width) / 2
+	cropBottom := (e.mbHeight*16 - e.height) / 2
+	if cropRight > 0 || cropBottom > 0 {
+		w.flag(true) // frame_cropping_flag
+		w.ue(0)
+		w.ue(cropRight)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.flag(false)
+	}
+	w.flag(false) // vui_parameters_present_flag
+	return nalu(3, NALUTypeSPS, w.trailingBits())
+}
+
+func (e *Encoder) encodePPS() []byte {
+	w := &bitWriter{}
+	w.ue(0)       // pic_parameter_set_id
+	w.ue(0)       // seq_parameter_set_id
+	w.flag(false) // entropy_coding_mode_flag: CAVLC
+	w.flag(false) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)       // num_slice_groups_minus1
+	w.ue(0)       // num_ref_idx_l0_default_active_minus1
+	w.ue(0)       // num_ref_idx_l1_default_active_minus1
+	w.flag(false) // weighted_pred_flag
+	w.u(2, 0)     // weighted_bipred_idc
+	w.se(0)       // pic_init_qp_minus26
+	w.se(0)       // pic_init_qs_minus26
+	w.se(0)       // chroma_qp_index_offset
+	w.flag(true)  // deblocking_filter_control_present_flag
+	w.flag(false) // constrained_intra_pred_flag
+	w.flag(false) // redundant_pic_cnt_present_flag
+	return nalu(3, NALUTypePPS, w.trailingBits())
+}
+
+// Return a NALU with the given header fields and RBSP.
+func nalu(refIDC, naluType byte, rbsp []byte) []byte {
+	return append([]byte{refIDC<<5 | naluType}, escapeRBSP(rbsp)...)
+}
+
+// Encode a picture, given by its Y, U and V planes, and return its NALUs.
+// Keyframes, and the first picture, are preceded by the parameter sets.
+func (e *Encoder) Encode(y, u, v []byte, keyframe bool) [][]byte {
+	if e.prevY == nil {
+		keyframe = true
+	}
+
+	w := &bitWriter{}
+	w.ue(0) // first_mb_in_slice
+	if keyframe {
+		w.ue(sliceTypeI)
+	} else {
+		w.ue(sliceTypeP)
+	}
+	w.ue(0) // pic_parameter_set_id
+	if keyframe {
+		e.frameNum = 0
+	}
+	w.u(frameNumBits, uint32(e.frameNum))
+	if keyframe {
+		w.ue(e.idrPicID)
+		e.idrPicID = (e.idrPicID + 1) % 65536
+	} else {
+		w.flag(false) // num_ref_idx_active_override_flag
+		w.flag(false) // ref_pic_list_modification_flag_l0
+	}
+	// dec_ref_pic_marking()
+	if keyframe {
+		w.flag(false) // no_output_of_prior_pics_flag
+		w.flag(false) // long_term_reference_flag
+	} else {
+		w.flag(false) // adaptive_ref_pic_marking_mode_flag
+	}
+	w.se(0) // slice_qp_delta
+	w.ue(1) // disable_deblocking_filter_idc: off, to keep it lossless
+
+	// slice_data()
+	var mb [384]byte
+	skipped := 0
+	for mbY := 0; mbY < e.mbHeight; mbY++ {
+		for mbX := 0; mbX < e.mbWidth; mbX++ {
+			e.macroblock(mb[:], y, u, v, mbX, mbY)
+			if !keyframe {
+				var prev [384]byte
+				e.macroblock(prev[:], e.prevY, e.prevU, e.prevV, mbX, mbY)
+				if bytes.Equal(mb[:], prev[:]) {
+					skipped++
+					continue
+				}
+				w.ue(skipped) // mb_skip_run
+				skipped = 0
+				w.ue(numInterMBTypesP + mbTypeIPCM)
+			} else {
+				w.ue(mbTypeIPCM)
+			}
+			w.align() // pcm_alignment_zero_bit
+			w.bytes(mb[:])
+		}
+	}
+	if skipped > 0 {
+		w.ue(skipped)
+	}
+	rbsp := w.trailingBits()
+
+	e.prevY = append(e.prevY[:0], y...)
+	e.prevU = append(e.prevU[:0], u...)
+	e.prevV = append(e.prevV[:0], v...)
+	e.frameNum = (e.frameNum + 1) % (1 << frameNumBits)
+
+	if keyframe {
+		return [][]byte{e.sps, e.pps, nalu(3, NALUTypeIDR, rbsp)}
+	}
+	return [][]byte{nalu(2, NALUTypeSlice, rbsp)}
+}
+
+// Copy the samples of a macroblock, in the order of pcm_sample_luma and
+// pcm_sample_chroma: 16x16 Y, then 8x8 U and 8x8 V, each in raster order.
+// Macroblocks overhanging the picture repeat its edge samples, which
+// cropping hides. Zero samples, which older decoders reject in I_PCM, are
+// raised to 1.
+func (e *Encoder) macroblock(mb, y, u, v []byte, mbX, mbY int) {
+	i := 0
+	copyBlock := func(plane []byte, width, height, size int) {
+		for row := 0; row < size; row++ {
+			py := min(mbY*size+row, height-1)
+			for col := 0; col < size; col++ {
+				px := min(mbX*size+col, width-1)
+				s := plane[py*width+px]
+				if s == 0 {
+					s = 1
+				}
+				mb[i] = s
+				i++
+			}
+		}
+	}
+	copyBlock(y, e.width, e.height, 16)
+	copyBlock(u, e.width/2, e.height/2, 8)
+	copyBlock(v, e.width/2, e.height/2, 8)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,195 @@
+package h264
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitWriter(t *testing.T) {
+	w := &bitWriter{}
+	values := []int{0, 1, 2, 3, 7, 8, 255, 1000}
+	for _, v := range values {
+		w.ue(v)
+		w.se(v)
+		w.se(-v)
+	}
+	w.u(5, 0x15)
+	r := &bitReader{data: w.trailingBits()}
+	for _, v := range values {
+		if got := r.ue(); got != v {
+			t.Errorf("ue: wrote %d, read %d", v, got)
+		}
+		if got := r.se(); got != v {
+			t.Errorf("se: wrote %d, read %d", v, got)
+		}
+		if got := r.se(); got != -v {
+			t.Errorf("se: wrote %d, read %d", -v, got)
+		}
+	}
+	if got := r.u(5); got != 0x15 || r.err != nil {
+		t.Errorf("u(5) = %x, %v", got, r.err)
+	}
+}
+
+func TestEscapeRBSP(t *testing.T) {
+	rbsp := []byte{0, 0, 0, 0, 0, 1, 0, 0, 2, 0, 0, 3, 0, 0, 4}
+	escaped := escapeRBSP(rbsp)
+	expected := []byte{0, 0, 3, 0, 0, 3, 0, 1, 0, 0, 3, 2, 0, 0, 3, 3, 0, 0, 4}
+	if !bytes.Equal(escaped, expected) {
+		t.Errorf("expected %x, got %x", expected, escaped)
+	}
+	if !bytes.Equal(unescapeRBSP(escaped), rbsp) {
+		t.Errorf("round trip gave %x", unescapeRBSP(escaped))
+	}
+}
+
+// Decode the slices written by Encoder, which is a small enough subset of
+// H.264 to check the bitstream structure and the reconstructed picture.
+type testDecoder struct {
+	t        *testing.T
+	mbWidth  int
+	mbHeight int
+	y, u, v  []byte // Padded to whole macroblocks
+}
+
+func (d *testDecoder) decode(nalu []byte) {
+	r := &bitReader{data: unescapeRBSP(nalu[1:])}
+	idr := NALU(nalu).Type() == NALUTypeIDR
+	if r.ue() != 0 {
+		d.t.Fatal("first_mb_in_slice != 0")
+	}
+	sliceType := r.ue()
+	if idr && sliceType != sliceTypeI || !idr && sliceType != sliceTypeP {
+		d.t.Fatalf("slice_type %d in NALU type %d", sliceType, NALU(nalu).Type())
+	}
+	r.ue() // pic_parameter_set_id
+	r.u(frameNumBits)
+	if idr {
+		r.ue()   // idr_pic_id
+		r.flag() // no_output_of_prior_pics_flag
+		r.flag() // long_term_reference_flag
+	} else {
+		r.flag() // num_ref_idx_active_override_flag
+		r.flag() // ref_pic_list_modification_flag_l0
+		r.flag() // adaptive_ref_pic_marking_mode_flag
+	}
+	if r.se() != 0 || r.ue() != 1 {
+		d.t.Fatal("unexpected slice_qp_delta or disable_deblocking_filter_idc")
+	}
+
+	total := d.mbWidth * d.mbHeight
+	for addr := 0; addr < total; addr++ {
+		if !idr {
+			addr += r.ue() // Skipped macroblocks keep their samples.
+			if addr >= total {
+				break
+			}
+		}
+		mbType := r.ue()
+		if idr && mbType != mbTypeIPCM || !idr && mbType != numInterMBTypesP+mbTypeIPCM {
+			d.t.Fatalf("unexpected mb_type %d", mbType)
+		}
+		if r.pos%8 != 0 {
+			if r.u(8-r.pos%8) != 0 {
+				d.t.Fatal("nonzero pcm_alignment_zero_bit")
+			}
+		}
+		mbX, mbY := addr%d.mbWidth, addr/d.mbWidth
+		d.block(r, d.y, mbX, mbY, 16)
+		d.block(r, d.u, mbX, mbY, 8)
+		d.block(r, d.v, mbX, mbY, 8)
+	}
+	if r.u(1) != 1 || r.pos%8 != 0 && r.u(8-r.pos%8) != 0 || r.pos != 8*len(r.data) || r.err != nil {
+		d.t.Fatalf("malformed rbsp_trailing_bits at %d of %d bits: %v", r.pos, 8*len(r.data), r.err)
+	}
+}
+
+func (d *testDecoder) block(r *bitReader, plane []byte, mbX, mbY, size int) {
+	stride := d.mbWidth * size
+	for row := 0; row < size; row++ {
+		for col := 0; col < size; col++ {
+			plane[(mbY*size+row)*stride+mbX*size+col] = byte(r.u(8))
+		}
+	}
+}
+
+// Compare the decoded picture, cropped, with a plane.
+func (d *testDecoder) check(name string, decoded, plane []byte, width, height, size int) {
+	stride := d.mbWidth * size
+	for row := 0; row < height; row++ {
+		if !bytes.Equal(decoded[row*stride:row*stride+width], plane[row*width:(row+1)*width]) {
+			d.t.Fatalf("%s row %d differs", name, row)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	const width, height = 40, 24 // Cropped from 48x32
+	e, err := NewEncoder(width, height)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	y := make([]byte, width*height)
+	u := make([]byte, width*height/4)
+	v := make([]byte, width*height/4)
+	for i := range y {
+		y[i] = byte(16 + i%200)
+	}
+	for i := range u {
+		u[i] = byte(128 + i%64)
+		v[i] = byte(100 + i%32)
+	}
+
+	nalus := e.Encode(y, u, v, false)
+	if len(nalus) != 3 || NALU(nalus[2]).Type() != NALUTypeIDR {
+		t.Fatalf("first picture is not a keyframe: %d NALUs", len(nalus))
+	}
+	sps, err := ParseSPS(nalus[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.Width != width || sps.Height != height || sps.ProfileLevelID() != 0x42c01e {
+		t.Errorf("unexpected SPS %+v", sps)
+	}
+	if pps, err := ParsePPS(nalus[1]); err != nil || pps.EntropyCodingMode {
+		t.Errorf("unexpected PPS %+v, %v", pps, err)
+	}
+
+	d := &testDecoder{
+		t:        t,
+		mbWidth:  3,
+		mbHeight: 2,
+		y:        make([]byte, 48*32),
+		u:        make([]byte, 24*16),
+		v:        make([]byte, 24*16),
+	}
+	d.decode(nalus[2])
+	d.check("Y", d.y, y, width, height, 16)
+	d.check("U", d.u, u, width/2, height/2, 8)
+	d.check("V", d.v, v, width/2, height/2, 8)
+
+	// An unchanged picture skips every macroblock.
+	nalus = e.Encode(y, u, v, false)
+	if len(nalus) != 1 || NALU(nalus[0]).Type() != NALUTypeSlice || len(nalus[0]) > 8 {
+		t.Fatalf("unexpected NALUs for an unchanged picture: %x", nalus)
+	}
+	d.decode(nalus[0])
+
+	// Change a pixel of the last macroblock, and a chroma sample of the
+	// first.
+	y[width*height-1] = 0
+	u[0] = 1
+	nalus = e.Encode(y, u, v, false)
+	if n := len(nalus[0]); n < 2*384 || n > 3*384 {
+		t.Errorf("expected two coded macroblocks, got a %d-byte slice", n)
+	}
+	d.decode(nalus[0])
+	y[width*height-1] = 1 // Zero samples are raised to 1.
+	d.check("Y", d.y, y, width, height, 16)
+	d.check("U", d.u, u, width/2, height/2, 8)
+
+	if _, err := NewEncoder(41, 24); err != errEncoderSize {
+		t.Errorf("accepted an odd width: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package h264
+
+import (
+	"errors"
+)
+
+// NALU types of parameter sets.
+const (
+	NALUTypeSPS = 7
+	NALUTypePPS = 8
+)
+
+var (
+	errNotSPS = errors.New("h264: not a sequence parameter set")
+	errNotPPS = errors.New("h264: not a picture parameter set")
+)
+
+// SPS holds the fields of a sequence parameter set (ITU-T H.264 §7.3.2.1)
+// needed to describe a stream, e.g. in SDP.
+type SPS struct {
+	ID int
+
+	// Profile and level, as in the SDP profile-level-id parameter.
+	ProfileIDC  byte
+	Constraints byte // constraint_set0_flag through constraint_set5_flag
+	LevelIDC    byte // ten times the level number, e.g. 31 for level 3.1
+
+	ChromaFormatIDC int
+
+	// Picture size in pixels, after cropping.
+	Width  int
+	Height int
+
+	// Whether every picture is a frame (not a field).
+	FrameMBsOnly bool
+
+	PicOrderCntType int
+
+	// Frame rate from the VUI timing information, or 0 if not signaled.
+	// Only exact for streams with a fixed frame rate.
+	FrameRate float64
+
+	// Largest number of frames that precede a frame in decoding order but
+	// follow it in output order, i.e. the B-frame depth, or -1 if not
+	// signaled.
+	MaxNumReorderFrames int
+}
+
+// ProfileLevelID returns the SDP profile-level-id of the stream (RFC 6184
+// §8.1).
+func (sps *SPS) ProfileLevelID() int {
+	return int(sps.ProfileIDC)<<16 | int(sps.Constraints)<<8 | int(sps.LevelIDC)
+}
+
+// Profiles with chroma format and bit depth fields in the SPS.
+func hasChromaInfo(profileIDC byte) bool {
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		return true
+	}
+	return false
+}
+
+// ParseSPS parses a sequence parameter set NALU, including its header byte.
+func ParseSPS(nalu []byte) (*SPS, error) {
+	if len(nalu) < 4 || NALU(nalu).Type() != NALUTypeSPS {
+		return nil, errNotSPS
+	}
+	r := &bitReader{data: unescapeRBSP(nalu[1:])}
+
+	sps := &SPS{
+		ProfileIDC:          byte(r.u(8)),
+		Constraints:         byte(r.u(8)),
+		LevelIDC:            byte(r.u(8)),
+		ChromaFormatIDC:     1,
+		MaxNumReorderFrames: -1,
+	}
+	sps.ID = r.ue()
+
+	separateColourPlanes := false
+	if hasChromaInfo(sps.ProfileIDC) {
+		sps.ChromaFormatIDC = r.ue()
+		if sps.ChromaFormatIDC == 3 {
+			separateColourPlanes = r.flag()
+		}
+		r.ue()        // bit_depth_luma_minus8
+		r.ue()        // bit_depth_chroma_minus8
+		r.flag()      // qpprime_y_zero_transform_bypass_flag
+		if r.flag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if sps.ChromaFormatIDC == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	sps.PicOrderCntType = r.ue()
+	switch sps.PicOrderCntType {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.flag() // delta_pic_order_always_zero_flag
+		r.se()   // offset_for_non_ref_pic
+		r.se()   // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := 0; i < n && r.err == nil; i++ {
+			r.se() // offset_for_ref_frame
+		}
+	}
+
+	r.ue()   // max_num_ref_frames
+	r.flag() // gaps_in_frame_num_value_allowed_flag
+	widthInMBs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	sps.FrameMBsOnly = r.flag()
+	if !sps.FrameMBsOnly {
+		r.flag() // mb_adaptive_frame_field_flag
+	}
+	r.flag() // direct_8x8_inference_flag
+
+	frameHeightInMBs := heightInMapUnits
+	if !sps.FrameMBsOnly {
+		frameHeightInMBs *= 2
+	}
+	sps.Width = 16 * widthInMBs
+	sps.Height = 16 * frameHeightInMBs
+
+	if r.flag() { // frame_cropping_flag
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+
+		// Crop units depend on chroma subsampling (§7.4.2.1.1).
+		cropX, cropY := 1, 1
+		if !separateColourPlanes && sps.ChromaFormatIDC != 0 {
+			if sps.ChromaFormatIDC != 3 {
+				cropX = 2
+			}
+			if sps.ChromaFormatIDC == 1 {
+				cropY = 2
+			}
+		}
+		if !sps.FrameMBsOnly {
+			cropY *= 2
+		}
+		sps.Width -= cropX * (left + right)
+		sps.Height -= cropY * (top + bottom)
+	}
+
+	if r.flag() { // vui_parameters_present_flag
+		parseVUI(r, sps)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if sps.Width <= 0 || sps.Height <= 0 {
+		return nil, errors.New("h264: invalid picture size in SPS")
+	}
+	return sps, nil
+}
+
+func skipScalingList(r *bitReader, size int) {
+	last, next := 8, 8
+	for j := 0; j < size && r.err == nil; j++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// Parse the VUI parameters (Annex E.1.1) for the frame rate and reordering.
+func parseVUI(r *bitReader, sps *SPS) {
+	if r.flag() { // aspect_ratio_info_present_flag
+		const extendedSAR = 255
+		if r.u(8) == extendedSAR {
+			r.u(16) // sar_width
+			r.u(16) // sar_height
+		}
+	}
+	if r.flag() { // overscan_info_present_flag
+		r.flag() // overscan_appropriate_flag
+	}
+	if r.flag() { // video_signal_type_present_flag
+		r.u(3)        // video_format
+		r.flag()      // video_full_range_flag
+		if r.flag() { // colour_description_present_flag
+			r.u(8) // colour_primaries
+			r.u(8) // transfer_characteristics
+			r.u(8) // matrix_coefficients
+		}
+	}
+	if r.flag() { // chroma_loc_info_present_flag
+		r.ue() // chroma_sample_loc_type_top_field
+		r.ue() // chroma_sample_loc_type_bottom_field
+	}
+	if r.flag() { // timing_info_present_flag
+		unitsInTick := r.u(32)
+		timeScale := r.u(32)
+		r.flag() // fixed_frame_rate_flag
+		if unitsInTick > 0 {
+			// Two ticks per frame, one per field.
+			sps.FrameRate = float64(timeScale) / float64(2*unitsInTick)
+		}
+	}
+	nalHRD := r.flag()
+	if nalHRD {
+		skipHRD(r)
+	}
+	vclHRD := r.flag()
+	if vclHRD {
+		skipHRD(r)
+	}
+	if nalHRD || vclHRD {
+		r.flag() // low_delay_hrd_flag
+	}
+	r.flag()      // pic_struct_present_flag
+	if r.flag() { // bitstream_restriction_flag
+		r.flag() // motion_vectors_over_pic_boundaries_flag
+		r.ue()   // max_bytes_per_pic_denom
+		r.ue()   // max_bits_per_mb_denom
+		r.ue()   // log2_max_mv_length_horizontal
+		r.ue()   // log2_max_mv_length_vertical
+		sps.MaxNumReorderFrames = r.ue()
+		r.ue() // max_dec_frame_buffering
+	}
+}
+
+// Skip HRD parameters (Annex E.1.2).
+func skipHRD(r *bitReader) {
+	n := r.ue() + 1 // cpb_cnt_minus1
+	r.u(4)          // bit_rate_scale
+	r.u(4)          // cpb_size_scale
+	for i := 0; i < n && r.err == nil; i++ {
+		r.ue()   // bit_rate_value_minus1
+		r.ue()   // cpb_size_value_minus1
+		r.flag() // cbr_flag
+	}
+	r.u(5) // initial_cpb_removal_delay_length_minus1
+	r.u(5) // cpb_removal_delay_length_minus1
+	r.u(5) // dpb_output_delay_length_minus1
+	r.u(5) // time_offset_length
+}
+
+// PPS holds the leading fields of a picture parameter set (ITU-T H.264
+// §7.3.2.2).
+type PPS struct {
+	ID    int
+	SPSID int
+
+	// Whether slices are coded with CABAC, which constrained baseline
+	// doesn't allow.
+	EntropyCodingMode bool
+}
+
+// ParsePPS parses a picture parameter set NALU, including its header byte.
+func ParsePPS(nalu []byte) (*PPS, error) {
+	if len(nalu) < 2 || NALU(nalu).Type() != NALUTypePPS {
+		return nil, errNotPPS
+	}
+	r := &bitReader{data: unescapeRBSP(nalu[1:])}
+	pps := &PPS{
+		ID:    r.ue(),
+		SPSID: r.ue(),
+	}
+	pps.EntropyCodingMode = r.flag()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return pps, nil
+}
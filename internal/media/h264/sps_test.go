@@ -0,0 +1,79 @@
+package h264
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		nalu []byte
+		want SPS
+	}{
+		{
+			// Constrained baseline, level 3.1, 1280x720 at 30 fps, with
+			// an emulation prevention byte.
+			nalu: []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0f, 0x23, 0x68, 0x22, 0x11, 0xa8},
+			want: SPS{
+				ProfileIDC:          0x42,
+				Constraints:         0xc0,
+				LevelIDC:            31,
+				ChromaFormatIDC:     1,
+				Width:               1280,
+				Height:              720,
+				FrameMBsOnly:        true,
+				PicOrderCntType:     2,
+				FrameRate:           30,
+				MaxNumReorderFrames: 0,
+			},
+		},
+		{
+			// High, level 4, 1920x1080 (cropped from 1088), no VUI.
+			nalu: []byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0x40},
+			want: SPS{
+				ProfileIDC:          0x64,
+				LevelIDC:            40,
+				ChromaFormatIDC:     1,
+				Width:               1920,
+				Height:              1080,
+				FrameMBsOnly:        true,
+				MaxNumReorderFrames: -1,
+			},
+		},
+	}
+	for _, tt := range tests {
+		sps, err := ParseSPS(tt.nalu)
+		if err != nil {
+			t.Errorf("ParseSPS(%x): %v", tt.nalu, err)
+			continue
+		}
+		if !reflect.DeepEqual(*sps, tt.want) {
+			t.Errorf("ParseSPS(%x) = %+v, want %+v", tt.nalu, *sps, tt.want)
+		}
+	}
+
+	if _, err := ParseSPS([]byte{0x67, 0x42, 0xc0, 0x1f, 0xda}); err == nil {
+		t.Error("ParseSPS succeeded on a truncated SPS")
+	}
+	if _, err := ParseSPS([]byte{0x68, 0xce, 0x3c, 0x80}); err != errNotSPS {
+		t.Errorf("ParseSPS of a PPS: got %v, want %v", err, errNotSPS)
+	}
+}
+
+func TestProfileLevelID(t *testing.T) {
+	sps := SPS{ProfileIDC: 0x42, Constraints: 0xe0, LevelIDC: 0x1f}
+	if got := sps.ProfileLevelID(); got != 0x42e01f {
+		t.Errorf("ProfileLevelID() = %06x, want 42e01f", got)
+	}
+}
+
+func TestParsePPS(t *testing.T) {
+	pps, err := ParsePPS([]byte{0x68, 0xce, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PPS{ID: 0, SPSID: 0, EntropyCodingMode: false}
+	if *pps != want {
+		t.Errorf("ParsePPS() = %+v, want %+v", *pps, want)
+	}
+}
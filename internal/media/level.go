@@ -0,0 +1,142 @@
+package media
+
+import (
+	"math"
+	"sync"
+)
+
+// Audio levels are expressed in -dBov, as in the RTP audio level header
+// extension: 0 is the loudest possible, and 127 is silence (or quieter).
+// See https://tools.ietf.org/html/rfc6464#section-3
+const SilentLevel = 127
+
+// AudioLevel returns the level of a frame of 16-bit linear PCM samples.
+func AudioLevel(pcm []int16) int {
+	if len(pcm) == 0 {
+		return SilentLevel
+	}
+	// Integer arithmetic per sample, and floating point only once per frame,
+	// since softfloat targets emulate it slowly.
+	var sum uint64
+	for _, s := range pcm {
+		sum += uint64(int32(s) * int32(s))
+	}
+	if sum == 0 {
+		return SilentLevel
+	}
+	rms := math.Sqrt(float64(sum)/float64(len(pcm))) / 32768
+	level := int(math.Round(-20 * math.Log10(rms)))
+	if level < 0 {
+		return 0
+	}
+	if level > SilentLevel {
+		return SilentLevel
+	}
+	return level
+}
+
+// Defaults for VoiceDetector.
+const (
+	defaultVoiceThreshold = 50
+	defaultVoiceHangover  = 15
+)
+
+// A VoiceDetector is a simple energy-based voice activity detector. It treats
+// frames louder than a threshold as voice, plus a few quiet frames after each
+// voiced one, so that word endings and short pauses aren't clipped.
+type VoiceDetector struct {
+	// Level, in -dBov, at or above which (i.e. at least as loud) a frame is
+	// voice. Defaults to 50.
+	Threshold int
+
+	// Number of quiet frames after a voiced frame that are still treated as
+	// voice. Defaults to 15, i.e. 300 ms of 20 ms frames.
+	Hangover int
+
+	// Quiet frames still to be treated as voice.
+	remaining int
+}
+
+// Detect reports whether the next frame, with the given level, is voice.
+func (d *VoiceDetector) Detect(level int) bool {
+	threshold := d.Threshold
+	if threshold == 0 {
+		threshold = defaultVoiceThreshold
+	}
+	hangover := d.Hangover
+	if hangover == 0 {
+		hangover = defaultVoiceHangover
+	}
+
+	if level <= threshold {
+		d.remaining = hangover
+		return true
+	}
+	if d.remaining > 0 {
+		d.remaining--
+		return true
+	}
+	return false
+}
+
+// An AudioLevelMeter is an AudioSource that knows the level of the frames it
+// delivers, as measured from PCM samples before encoding. Outgoing RTP
+// streams use it to send the audio level header extension, and to skip
+// silence.
+type AudioLevelMeter interface {
+	// FrameLevel returns the level of a frame delivered by the source, and
+	// whether the frame contains voice. ok is false if the frame is unknown.
+	FrameLevel(frame []byte) (level int, voice bool, ok bool)
+}
+
+// Number of recent frames for which a LevelTracker remembers levels. Enough
+// for the frames queued between an encoder and its slowest receiver.
+const levelTrackerSize = 32
+
+// A LevelTracker implements AudioLevelMeter for an audio encoder. The encoder
+// calls Record with each encoded frame and the PCM samples it came from,
+// before delivering the frame to receivers.
+type LevelTracker struct {
+	// Decides whether each frame contains voice.
+	VoiceDetector
+
+	mu      sync.Mutex
+	entries [levelTrackerSize]levelEntry
+	next    int
+}
+
+type levelEntry struct {
+	frame *byte // identifies the frame by its first byte
+	level int
+	voice bool
+}
+
+// Record the level of an encoded frame, computed from its PCM samples.
+func (t *LevelTracker) Record(frame []byte, pcm []int16) {
+	if len(frame) == 0 {
+		return
+	}
+	level := AudioLevel(pcm)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[t.next] = levelEntry{&frame[0], level, t.Detect(level)}
+	t.next = (t.next + 1) % levelTrackerSize
+}
+
+func (t *LevelTracker) FrameLevel(frame []byte) (level int, voice bool, ok bool) {
+	if len(frame) == 0 {
+		return 0, false, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Newest first, since frame buffers may be reused.
+	for i := 1; i <= levelTrackerSize; i++ {
+		e := &t.entries[(t.next-i+levelTrackerSize)%levelTrackerSize]
+		if e.frame == &frame[0] {
+			return e.level, e.voice, true
+		}
+	}
+	return 0, false, false
+}
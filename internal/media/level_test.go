@@ -0,0 +1,58 @@
+package media
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sine(n int, amplitude float64) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		pcm[i] = int16(amplitude * 32767 * math.Sin(2*math.Pi*float64(i)/48))
+	}
+	return pcm
+}
+
+func TestAudioLevel(t *testing.T) {
+	assert.Equal(t, SilentLevel, AudioLevel(nil))
+	assert.Equal(t, SilentLevel, AudioLevel(make([]int16, 960)))
+
+	// A full-scale sine wave has an RMS 3 dB below full scale.
+	assert.Equal(t, 3, AudioLevel(sine(960, 1)))
+	assert.Equal(t, 23, AudioLevel(sine(960, 0.1)))
+}
+
+func TestVoiceDetector(t *testing.T) {
+	d := VoiceDetector{Threshold: 40, Hangover: 2}
+	var voiced []bool
+	for _, level := range []int{90, 30, 80, 80, 80, 35, 90} {
+		voiced = append(voiced, d.Detect(level))
+	}
+	assert.Equal(t, []bool{false, true, true, true, false, true, true}, voiced)
+}
+
+func TestLevelTracker(t *testing.T) {
+	var tr LevelTracker
+	loud := []byte{1, 2, 3}
+	quiet := []byte{4, 5, 6}
+	tr.Record(loud, sine(960, 1))
+	for i := 0; i < defaultVoiceHangover+1; i++ {
+		tr.Record(quiet, make([]int16, 960))
+	}
+
+	level, voice, ok := tr.FrameLevel(loud)
+	assert.True(t, ok)
+	assert.True(t, voice)
+	assert.Equal(t, 3, level)
+
+	// The most recent record for the reused buffer wins.
+	level, voice, ok = tr.FrameLevel(quiet)
+	assert.True(t, ok)
+	assert.False(t, voice)
+	assert.Equal(t, SilentLevel, level)
+
+	_, _, ok = tr.FrameLevel([]byte{7})
+	assert.False(t, ok)
+}
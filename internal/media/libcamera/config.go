@@ -0,0 +1,26 @@
+package libcamera
+
+// Config mirrors the options of v4l2.Config that libcamera-vid supports.
+type Config struct {
+	// Index of the camera, for boards with more than one. Defaults to 0.
+	Camera int
+
+	Width  int // Video width in pixels
+	Height int // Video height in pixels
+
+	// Encoder bitrate, in bits per second. If zero, libcamera-vid's default
+	// is used.
+	Bitrate int
+
+	// Capture frame rate, in frames per second. If zero, libcamera-vid's
+	// default is used.
+	FrameRate int
+
+	// Number of frames between H.264 IDR pictures. If zero, libcamera-vid's
+	// default is used.
+	KeyframeInterval int
+
+	// Flip the picture.
+	HorizontalFlip bool
+	VerticalFlip   bool
+}
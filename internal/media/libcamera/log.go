@@ -0,0 +1,7 @@
+// +build libcamera !production
+
+package libcamera
+
+import "github.com/lanikai/alohartc/internal/logging"
+
+var log = logging.DefaultLogger.WithTag("libcamera")
@@ -0,0 +1,237 @@
+// +build libcamera !production
+
+// Package libcamera captures H.264 video with libcamera-vid, which replaces
+// the deprecated bcm2835-v4l2 driver on current Raspberry Pi OS releases.
+package libcamera
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/h264"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+// Names of the capture program, newest first. Raspberry Pi OS Bookworm
+// renamed libcamera-vid to rpicam-vid.
+var programs = []string{"rpicam-vid", "libcamera-vid"}
+
+// Largest NALU expected from the encoder.
+const maxNALUSize = 4 << 20
+
+var errNoProgram = errors.New("libcamera: neither rpicam-vid nor libcamera-vid found")
+
+func init() {
+	media.RegisterScheme("libcamera", OpenURI)
+}
+
+// OpenURI opens a camera identified by a URI of the form
+//
+//	libcamera:0?width=1280&height=720&bitrate=1000000&framerate=30
+//
+// where the opaque part is the camera index. Query parameters are named after
+// the fields of Config, in lower case.
+func OpenURI(uri string) (media.VideoSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	index := u.Opaque
+	if index == "" {
+		index = u.Host
+	}
+	if index != "" {
+		if cfg.Camera, err = strconv.Atoi(index); err != nil {
+			return nil, errors.New("libcamera: invalid camera index: " + index)
+		}
+	}
+
+	q := u.Query()
+	for name, field := range map[string]*int{
+		"width":            &cfg.Width,
+		"height":           &cfg.Height,
+		"bitrate":          &cfg.Bitrate,
+		"framerate":        &cfg.FrameRate,
+		"keyframeinterval": &cfg.KeyframeInterval,
+	} {
+		if v := q.Get(name); v != "" {
+			if *field, err = strconv.Atoi(v); err != nil {
+				return nil, errors.New("libcamera: invalid " + name + ": " + v)
+			}
+		}
+	}
+	cfg.HorizontalFlip = q.Get("hflip") == "1"
+	cfg.VerticalFlip = q.Get("vflip") == "1"
+
+	return Open(cfg)
+}
+
+// Open a camera. Capture starts when the first receiver is added.
+func Open(cfg Config) (media.VideoSource, error) {
+	if cfg.Width <= 0 {
+		cfg.Width = 1280
+	}
+	if cfg.Height <= 0 {
+		cfg.Height = 720
+	}
+
+	program := ""
+	for _, p := range programs {
+		if path, err := exec.LookPath(p); err == nil {
+			program = path
+			break
+		}
+	}
+	if program == "" {
+		return nil, errNoProgram
+	}
+
+	v := &videoSource{
+		cfg:     cfg,
+		program: program,
+	}
+	v.Flow.Start = v.start
+	v.Flow.Stop = v.stop
+	return v, nil
+}
+
+// A media.VideoSource reading the output of libcamera-vid.
+type videoSource struct {
+	media.Flow
+
+	cfg Config
+
+	// Path of rpicam-vid or libcamera-vid.
+	program string
+
+	// Guards cmd, since Stop runs in its own goroutine.
+	mu  sync.Mutex
+	cmd *exec.Cmd
+}
+
+func (v *videoSource) Codec() string {
+	return "H264"
+}
+
+func (v *videoSource) Width() int {
+	return v.cfg.Width
+}
+
+func (v *videoSource) Height() int {
+	return v.cfg.Height
+}
+
+// Arguments for libcamera-vid, to write an H.264 elementary stream to stdout
+// until killed.
+func (v *videoSource) args() []string {
+	cfg := v.cfg
+	args := []string{
+		"--nopreview",
+		"--timeout", "0",
+		"--codec", "h264",
+		"--profile", "baseline",
+		"--inline", // Repeat SPS/PPS before each IDR picture
+		"--flush",  // Don't buffer output
+		"--camera", strconv.Itoa(cfg.Camera),
+		"--width", strconv.Itoa(cfg.Width),
+		"--height", strconv.Itoa(cfg.Height),
+		"--output", "-",
+	}
+	if cfg.Bitrate > 0 {
+		args = append(args, "--bitrate", strconv.Itoa(cfg.Bitrate))
+	}
+	if cfg.FrameRate > 0 {
+		args = append(args, "--framerate", strconv.Itoa(cfg.FrameRate))
+	}
+	if cfg.KeyframeInterval > 0 {
+		args = append(args, "--intra", strconv.Itoa(cfg.KeyframeInterval))
+	}
+	if cfg.HorizontalFlip {
+		args = append(args, "--hflip")
+	}
+	if cfg.VerticalFlip {
+		args = append(args, "--vflip")
+	}
+	return args
+}
+
+func (v *videoSource) start() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	cmd := exec.Command(v.program, v.args()...)
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		var stderr io.ReadCloser
+		if stderr, err = cmd.StderrPipe(); err == nil {
+			go logOutput(stderr)
+			err = cmd.Start()
+		}
+	}
+	if err != nil {
+		// Called with the Flow locked, so shut down from another goroutine.
+		go v.Flow.Shutdown(err)
+		return
+	}
+	log.Info("Started %s %v", v.program, cmd.Args[1:])
+	v.cmd = cmd
+
+	go func() {
+		s := bufio.NewScanner(stdout)
+		s.Buffer(make([]byte, 64*1024), maxNALUSize)
+		s.Split(h264.ScanNALUs)
+		for s.Scan() {
+			nalu := append([]byte(nil), s.Bytes()...)
+			buf := packet.NewSharedBuffer(nalu, 1, nil)
+			buf.SetCaptureTime(time.Now())
+			v.Flow.Put(buf)
+		}
+		err := s.Err()
+		if werr := cmd.Wait(); err == nil {
+			err = werr
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		log.Debug("%s exited: %v", v.program, err)
+
+		// Unless stopped, in which case a new process may have started
+		// since, shut down the flow.
+		v.mu.Lock()
+		current := v.cmd == cmd
+		if current {
+			v.cmd = nil
+		}
+		v.mu.Unlock()
+		if current {
+			v.Flow.Shutdown(err)
+		}
+	}()
+}
+
+func (v *videoSource) stop() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.cmd != nil {
+		v.cmd.Process.Kill()
+		v.cmd = nil
+	}
+}
+
+// Log the diagnostics written by libcamera-vid.
+func logOutput(r io.Reader) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		log.Debug("%s", s.Text())
+	}
+}
@@ -0,0 +1,11 @@
+// +build production,!libcamera
+
+package libcamera
+
+import (
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+func Open(cfg Config) (media.VideoSource, error) {
+	panic("libcamera support disabled")
+}
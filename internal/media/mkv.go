@@ -0,0 +1,579 @@
+package media
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Minimal Matroska demuxer, sufficient to play back the H.264 track of a
+// recording. See https://www.matroska.org/technical/specs/index.html
+
+// Matroska element IDs, including the EBML length marker bits.
+const (
+	mkvEBML           = 0x1a45dfa3
+	mkvSegment        = 0x18538067
+	mkvInfo           = 0x1549a966
+	mkvTimecodeScale  = 0x2ad7b1
+	mkvTracks         = 0x1654ae6b
+	mkvTrackEntry     = 0xae
+	mkvTrackNumber    = 0xd7
+	mkvTrackType      = 0x83
+	mkvCodecID        = 0x86
+	mkvCodecPrivate   = 0x63a2
+	mkvVideo          = 0xe0
+	mkvPixelWidth     = 0xb0
+	mkvPixelHeight    = 0xba
+	mkvCluster        = 0x1f43b675
+	mkvTimecode       = 0xe7
+	mkvSimpleBlock    = 0xa3
+	mkvBlockGroup     = 0xa0
+	mkvBlock          = 0xa1
+	mkvReferenceBlock = 0xfb
+)
+
+const (
+	mkvTrackTypeVideo = 1
+	mkvCodecH264      = "V_MPEG4/ISO/AVC"
+
+	// Default duration of a timecode tick.
+	mkvDefaultTimecodeScale = 1000000 // nanoseconds
+)
+
+// Element size indicating that the element extends to the end of its parent.
+const ebmlUnknownSize = -1
+
+// Limit on the size of elements that are read into memory.
+const ebmlMaxElementSize = 16 << 20
+
+type mkvClusterInfo struct {
+	offset   int64
+	timecode int64
+}
+
+// An mkvClip reads the H.264 track of a Matroska file, for Playback.
+type mkvClip struct {
+	file *os.File
+	r    *bufio.Reader
+
+	// Current offset into the file.
+	pos int64
+
+	timecodeScale int64
+	track         uint64
+	width         int
+	height        int
+	lengthSize    int
+	parameterSets [][]byte
+
+	// Offset and timecode of each cluster, in file order.
+	clusters []mkvClusterInfo
+
+	// Timecode of the cluster currently being read.
+	clusterTimecode int64
+
+	// After a seek, frames are skipped until the first key frame.
+	needKeyFrame bool
+}
+
+func openMKVClip(filename string) (clip, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mkvClip{
+		file:          file,
+		r:             bufio.NewReaderSize(file, 64*1024),
+		timecodeScale: mkvDefaultTimecodeScale,
+	}
+	if err := c.scan(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return c, nil
+}
+
+// Read the track headers, and build an index of clusters for seeking.
+func (c *mkvClip) scan() error {
+	id, size, err := c.readHeader()
+	if err != nil {
+		return err
+	}
+	if id != mkvEBML {
+		return errors.New("not a Matroska file")
+	}
+	if err := c.skip(size); err != nil {
+		return err
+	}
+
+	if id, _, err = c.readHeader(); err != nil {
+		return err
+	} else if id != mkvSegment {
+		return errors.New("missing Segment")
+	}
+
+	// Walk the top-level elements of the segment. Clusters may have unknown
+	// size (e.g. when written by a live recorder), in which case their child
+	// elements are walked instead.
+	inCluster := false
+	for {
+		start := c.pos
+		id, size, err := c.readHeader()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch id {
+		case mkvInfo, mkvTracks:
+			body, err := c.readBody(size)
+			if err != nil {
+				return err
+			}
+			if id == mkvInfo {
+				err = c.parseInfo(body)
+			} else {
+				err = c.parseTracks(body)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		case mkvCluster:
+			c.clusters = append(c.clusters, mkvClusterInfo{offset: start, timecode: -1})
+			inCluster = size == ebmlUnknownSize
+			if inCluster {
+				continue
+			}
+			// The cluster timecode is required to come first. Read it, then
+			// skip the rest of the cluster.
+			end := c.pos + size
+			if id, tsize, err := c.readHeader(); err != nil {
+				return err
+			} else if id == mkvTimecode {
+				body, err := c.readBody(tsize)
+				if err != nil {
+					return err
+				}
+				c.clusters[len(c.clusters)-1].timecode = int64(ebmlUint(body))
+			}
+			if err := c.seek(end); err != nil {
+				return err
+			}
+			continue
+		case mkvTimecode:
+			if inCluster && len(c.clusters) > 0 {
+				body, err := c.readBody(size)
+				if err != nil {
+					return err
+				}
+				c.clusters[len(c.clusters)-1].timecode = int64(ebmlUint(body))
+				continue
+			}
+		case mkvSimpleBlock, mkvBlockGroup:
+		default:
+			inCluster = false
+		}
+
+		if size == ebmlUnknownSize {
+			return fmt.Errorf("unexpected unknown-size element %x", id)
+		}
+		if err := c.skip(size); err != nil {
+			return err
+		}
+	}
+
+	if c.track == 0 {
+		return errors.New("no H.264 video track found")
+	}
+
+	// Drop clusters without a timecode; they can't be seeked to.
+	clusters := c.clusters[:0]
+	for _, cl := range c.clusters {
+		if cl.timecode >= 0 {
+			clusters = append(clusters, cl)
+		}
+	}
+	c.clusters = clusters
+	if len(c.clusters) == 0 {
+		return errors.New("no clusters found")
+	}
+
+	return c.seekCluster(0)
+}
+
+func (c *mkvClip) parseInfo(body []byte) error {
+	return ebmlWalk(body, func(id uint32, data []byte) error {
+		if id == mkvTimecodeScale {
+			c.timecodeScale = int64(ebmlUint(data))
+		}
+		return nil
+	})
+}
+
+func (c *mkvClip) parseTracks(body []byte) error {
+	return ebmlWalk(body, func(id uint32, entry []byte) error {
+		if id != mkvTrackEntry || c.track != 0 {
+			return nil
+		}
+
+		var number, trackType uint64
+		var codecID string
+		var private []byte
+		var width, height int
+		err := ebmlWalk(entry, func(id uint32, data []byte) error {
+			switch id {
+			case mkvTrackNumber:
+				number = ebmlUint(data)
+			case mkvTrackType:
+				trackType = ebmlUint(data)
+			case mkvCodecID:
+				codecID = string(data)
+			case mkvCodecPrivate:
+				private = data
+			case mkvVideo:
+				return ebmlWalk(data, func(id uint32, data []byte) error {
+					switch id {
+					case mkvPixelWidth:
+						width = int(ebmlUint(data))
+					case mkvPixelHeight:
+						height = int(ebmlUint(data))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if trackType != mkvTrackTypeVideo || codecID != mkvCodecH264 {
+			log.Debug("Skipping Matroska track %d (%s)", number, codecID)
+			return nil
+		}
+		lengthSize, sps, pps, err := parseAVCDecoderConfig(private)
+		if err != nil {
+			return err
+		}
+		c.track = number
+		c.width = width
+		c.height = height
+		c.lengthSize = lengthSize
+		c.parameterSets = append(sps, pps...)
+		return nil
+	})
+}
+
+func (c *mkvClip) Width() int {
+	return c.width
+}
+
+func (c *mkvClip) Height() int {
+	return c.height
+}
+
+func (c *mkvClip) ParameterSets() [][]byte {
+	return c.parameterSets
+}
+
+func (c *mkvClip) ReadFrame() (*clipFrame, error) {
+	for {
+		id, size, err := c.readHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		switch id {
+		case mkvCluster:
+			// Descend into the cluster.
+			continue
+		case mkvTimecode:
+			body, err := c.readBody(size)
+			if err != nil {
+				return nil, err
+			}
+			c.clusterTimecode = int64(ebmlUint(body))
+			continue
+		case mkvSimpleBlock:
+			body, err := c.readBody(size)
+			if err != nil {
+				return nil, err
+			}
+			f, err := c.parseBlock(body, true, false)
+			if err != nil || f != nil {
+				return f, err
+			}
+			continue
+		case mkvBlockGroup:
+			body, err := c.readBody(size)
+			if err != nil {
+				return nil, err
+			}
+			var block []byte
+			var referenced bool
+			err = ebmlWalk(body, func(id uint32, data []byte) error {
+				switch id {
+				case mkvBlock:
+					block = data
+				case mkvReferenceBlock:
+					referenced = true
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if block == nil {
+				continue
+			}
+			f, err := c.parseBlock(block, false, referenced)
+			if err != nil || f != nil {
+				return f, err
+			}
+			continue
+		}
+
+		if size == ebmlUnknownSize {
+			return nil, fmt.Errorf("mkv: unexpected unknown-size element %x", id)
+		}
+		if err := c.skip(size); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Parse a Block or SimpleBlock. A SimpleBlock flags key frames itself; a Block
+// is a key frame unless it references another. Returns nil if the block should
+// be skipped.
+// See https://www.matroska.org/technical/specs/index.html#block_structure
+func (c *mkvClip) parseBlock(block []byte, simple, referenced bool) (*clipFrame, error) {
+	track, n := ebmlVint(block)
+	if n <= 0 || len(block) < n+3 {
+		return nil, errors.New("mkv: truncated block")
+	}
+	if track != c.track {
+		return nil, nil
+	}
+	relative := int16(uint16(block[n])<<8 | uint16(block[n+1]))
+	flags := block[n+2]
+	keyFrame := !referenced
+	if simple {
+		keyFrame = flags&0x80 != 0
+	}
+	if flags&0x06 != 0 {
+		log.Warn("Skipping laced Matroska video block")
+		return nil, nil
+	}
+
+	if c.needKeyFrame {
+		if !keyFrame {
+			return nil, nil
+		}
+		c.needKeyFrame = false
+	}
+
+	nalus, err := splitAVCC(block[n+3:], c.lengthSize)
+	if err != nil {
+		return nil, err
+	}
+	timecode := c.clusterTimecode + int64(relative)
+	return &clipFrame{
+		Time:     time.Duration(timecode * c.timecodeScale),
+		KeyFrame: keyFrame,
+		NALUs:    nalus,
+	}, nil
+}
+
+func (c *mkvClip) SeekToTime(t time.Duration) error {
+	timecode := int64(t) / c.timecodeScale
+	// Find the last cluster starting at or before t.
+	i := sort.Search(len(c.clusters), func(i int) bool {
+		return c.clusters[i].timecode > timecode
+	})
+	if i > 0 {
+		i--
+	}
+	return c.seekCluster(i)
+}
+
+func (c *mkvClip) seekCluster(i int) error {
+	c.clusterTimecode = c.clusters[i].timecode
+	c.needKeyFrame = true
+	return c.seek(c.clusters[i].offset)
+}
+
+func (c *mkvClip) Close() error {
+	return c.file.Close()
+}
+
+func (c *mkvClip) seek(offset int64) error {
+	if _, err := c.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	c.r.Reset(c.file)
+	c.pos = offset
+	return nil
+}
+
+func (c *mkvClip) skip(n int64) error {
+	if n <= int64(c.r.Buffered()) {
+		c.r.Discard(int(n))
+		c.pos += n
+		return nil
+	}
+	return c.seek(c.pos + n)
+}
+
+// Read an element ID and size. The size is ebmlUnknownSize if not specified.
+func (c *mkvClip) readHeader() (id uint32, size int64, err error) {
+	b, err := c.r.Peek(12)
+	if len(b) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return
+	}
+
+	idLen := ebmlVintLength(b[0])
+	if idLen > 4 || idLen > len(b) {
+		return 0, 0, errors.New("mkv: invalid element ID")
+	}
+	for _, x := range b[:idLen] {
+		id = id<<8 | uint32(x)
+	}
+
+	v, n := ebmlVint(b[idLen:])
+	if n <= 0 {
+		return 0, 0, errors.New("mkv: invalid element size")
+	}
+	if v == 1<<(7*uint(n))-1 {
+		size = ebmlUnknownSize
+	} else {
+		size = int64(v)
+	}
+
+	c.r.Discard(idLen + n)
+	c.pos += int64(idLen + n)
+	return id, size, nil
+}
+
+// Read the body of an element into memory.
+func (c *mkvClip) readBody(size int64) ([]byte, error) {
+	if size < 0 || size > ebmlMaxElementSize {
+		return nil, fmt.Errorf("mkv: element too large (%d bytes)", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	c.pos += size
+	return body, nil
+}
+
+// Return the length of an EBML variable-length integer, from its first byte.
+func ebmlVintLength(b byte) int {
+	for n := 1; n <= 8; n++ {
+		if b&(0x80>>uint(n-1)) != 0 {
+			return n
+		}
+	}
+	return 9
+}
+
+// Decode an EBML variable-length integer, with the length marker removed.
+// Returns the value and the number of bytes consumed, or n <= 0 if invalid.
+func ebmlVint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n = ebmlVintLength(b[0])
+	if n > 8 || n > len(b) {
+		return 0, -1
+	}
+	v = uint64(b[0]) & (0xff >> uint(n))
+	for _, x := range b[1:n] {
+		v = v<<8 | uint64(x)
+	}
+	return v, n
+}
+
+// Decode an EBML unsigned integer element body.
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, x := range b {
+		v = v<<8 | uint64(x)
+	}
+	return v
+}
+
+// Call f for each child element of an in-memory master element.
+func ebmlWalk(b []byte, f func(id uint32, data []byte) error) error {
+	for len(b) > 0 {
+		idLen := ebmlVintLength(b[0])
+		if idLen > 4 || idLen > len(b) {
+			return errors.New("mkv: invalid element ID")
+		}
+		var id uint32
+		for _, x := range b[:idLen] {
+			id = id<<8 | uint32(x)
+		}
+		size, n := ebmlVint(b[idLen:])
+		if n <= 0 || size > uint64(len(b)-idLen-n) {
+			return errors.New("mkv: invalid element size")
+		}
+		b = b[idLen+n:]
+		if err := f(id, b[:size]); err != nil {
+			return err
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+// Parse an AVCDecoderConfigurationRecord, as found in Matroska CodecPrivate
+// and MP4 avcC boxes. See ISO/IEC 14496-15 section 5.2.4.1.
+func parseAVCDecoderConfig(b []byte) (lengthSize int, sps, pps [][]byte, err error) {
+	if len(b) < 6 || b[0] != 1 {
+		return 0, nil, nil, errors.New("mkv: invalid AVC decoder configuration")
+	}
+	lengthSize = int(b[4]&0x03) + 1
+
+	readSets := func(count int, b []byte) ([][]byte, []byte, error) {
+		var sets [][]byte
+		for i := 0; i < count; i++ {
+			if len(b) < 2 {
+				return nil, nil, errors.New("mkv: truncated AVC decoder configuration")
+			}
+			n := int(b[0])<<8 | int(b[1])
+			if len(b) < 2+n {
+				return nil, nil, errors.New("mkv: truncated AVC decoder configuration")
+			}
+			sets = append(sets, b[2:2+n])
+			b = b[2+n:]
+		}
+		return sets, b, nil
+	}
+
+	sps, rest, err := readSets(int(b[5]&0x1f), b[6:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(rest) < 1 {
+		return 0, nil, nil, errors.New("mkv: truncated AVC decoder configuration")
+	}
+	pps, _, err = readSets(int(rest[0]), rest[1:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return lengthSize, sps, pps, nil
+}
@@ -0,0 +1,177 @@
+package media
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Encode an EBML element with the given ID and body. If unknownSize is set,
+// the "unknown size" marker is written instead of the body length.
+func ebmlElement(id uint32, body []byte, unknownSize bool) []byte {
+	var b bytes.Buffer
+	for shift := 24; shift >= 0; shift -= 8 {
+		if x := byte(id >> uint(shift)); x != 0 || b.Len() > 0 {
+			b.WriteByte(x)
+		}
+	}
+	if unknownSize {
+		b.Write([]byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	} else {
+		// Always use an 8-byte size, which is valid if not minimal.
+		n := uint64(len(body))
+		b.WriteByte(0x01)
+		for shift := 48; shift >= 0; shift -= 8 {
+			b.WriteByte(byte(n >> uint(shift)))
+		}
+	}
+	b.Write(body)
+	return b.Bytes()
+}
+
+func ebmlMaster(id uint32, children ...[]byte) []byte {
+	return ebmlElement(id, bytes.Join(children, nil), false)
+}
+
+func ebmlUintElement(id uint32, v uint64) []byte {
+	return ebmlElement(id, []byte{byte(v >> 8), byte(v)}, false)
+}
+
+// Build a SimpleBlock for track 1 containing a single length-prefixed NALU.
+func mkvSimpleBlockElement(relative int16, keyFrame bool, nalu []byte) []byte {
+	flags := byte(0)
+	if keyFrame {
+		flags = 0x80
+	}
+	body := []byte{0x81, byte(relative >> 8), byte(relative), flags}
+	body = append(body, 0, 0, 0, byte(len(nalu)))
+	body = append(body, nalu...)
+	return ebmlElement(mkvSimpleBlock, body, false)
+}
+
+var (
+	testSPS = []byte{0x67, 0x42, 0x00, 0x1f}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+func writeTestMKV(t *testing.T, unknownSizeClusters bool) string {
+	avcC := []byte{1, 0x42, 0x00, 0x1f, 0xff, 0xe1, 0, byte(len(testSPS))}
+	avcC = append(avcC, testSPS...)
+	avcC = append(avcC, 1, 0, byte(len(testPPS)))
+	avcC = append(avcC, testPPS...)
+
+	tracks := ebmlMaster(mkvTracks,
+		ebmlMaster(mkvTrackEntry,
+			ebmlUintElement(mkvTrackNumber, 1),
+			ebmlUintElement(mkvTrackType, mkvTrackTypeVideo),
+			ebmlElement(mkvCodecID, []byte(mkvCodecH264), false),
+			ebmlElement(mkvCodecPrivate, avcC, false),
+			ebmlMaster(mkvVideo,
+				ebmlUintElement(mkvPixelWidth, 640),
+				ebmlUintElement(mkvPixelHeight, 480),
+			),
+		),
+	)
+
+	// Two clusters of three frames each, 100 ms apart. Frame N is a single
+	// NALU whose second byte is N.
+	var clusters [][]byte
+	for i := 0; i < 2; i++ {
+		children := [][]byte{ebmlUintElement(mkvTimecode, uint64(300*i))}
+		for j := 0; j < 3; j++ {
+			nalu := []byte{0x65, byte(3*i + j)}
+			if j > 0 {
+				nalu[0] = 0x41
+			}
+			children = append(children, mkvSimpleBlockElement(int16(100*j), j == 0, nalu))
+		}
+		clusters = append(clusters, ebmlElement(mkvCluster, bytes.Join(children, nil), unknownSizeClusters))
+	}
+
+	segment := [][]byte{
+		ebmlMaster(mkvInfo, ebmlElement(mkvTimecodeScale, []byte{0x0f, 0x42, 0x40}, false)),
+		tracks,
+	}
+	segment = append(segment, clusters...)
+
+	var file []byte
+	file = append(file, ebmlMaster(mkvEBML)...)
+	file = append(file, ebmlElement(mkvSegment, bytes.Join(segment, nil), true)...)
+
+	dir, err := ioutil.TempDir("", "mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "test.mkv")
+	if err := ioutil.WriteFile(filename, file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestMKVClip(t *testing.T) {
+	for _, unknownSize := range []bool{false, true} {
+		filename := writeTestMKV(t, unknownSize)
+		defer os.RemoveAll(filepath.Dir(filename))
+
+		c, err := openMKVClip(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		assert.Equal(t, 640, c.Width())
+		assert.Equal(t, 480, c.Height())
+		assert.Equal(t, [][]byte{testSPS, testPPS}, c.ParameterSets())
+
+		for n := 0; n < 6; n++ {
+			f, err := c.ReadFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, time.Duration(n)*100*time.Millisecond, f.Time)
+			assert.Equal(t, n%3 == 0, f.KeyFrame)
+			if !assert.Len(t, f.NALUs, 1) {
+				continue
+			}
+			assert.Equal(t, byte(n), f.NALUs[0][1])
+		}
+		_, err = c.ReadFrame()
+		assert.Equal(t, io.EOF, err)
+
+		// Seeking lands on the key frame at the start of the cluster.
+		if err := c.SeekToTime(450 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		f, err := c.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 300*time.Millisecond, f.Time)
+		assert.True(t, f.KeyFrame)
+
+		if err := c.SeekToTime(0); err != nil {
+			t.Fatal(err)
+		}
+		f, err = c.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, time.Duration(0), f.Time)
+	}
+}
+
+func TestSplitAVCC(t *testing.T) {
+	nalus, err := splitAVCC([]byte{0, 0, 0, 2, 0x67, 0x42, 0, 0, 0, 1, 0x68}, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{{0x67, 0x42}, {0x68}}, nalus)
+
+	_, err = splitAVCC([]byte{0, 0, 0, 3, 0x67}, 4)
+	assert.Error(t, err)
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/codec/h264parser"
 	"github.com/nareix/joy4/format/mp4"
+
+	"github.com/lanikai/alohartc/internal/packet"
 )
 
 // Open an MP4 file and return the video stream as a VideoSource.
@@ -74,6 +76,9 @@ func (f *mp4File) readLoop(quit <-chan struct{}) error {
 	// Wall clock offset to the first packet in the file.
 	var start time.Time
 
+	// Origin of presentation times, which continue across loops.
+	origin := time.Now()
+
 	for {
 		select {
 		case <-quit:
@@ -123,7 +128,9 @@ func (f *mp4File) readLoop(quit <-chan struct{}) error {
 			}
 		}
 
-		flow.PutBuffer(data, nil)
+		buf := packet.NewSharedBuffer(data, 1, nil)
+		buf.SetPTS(start.Add(pkt.Time + pkt.CompositionTime).Sub(origin))
+		flow.Put(buf)
 
 		log.Debug("Packet: %6d bytes, starting with %02x", len(data), data[0:4])
 	}
@@ -153,6 +160,87 @@ func (vs *mp4VideoSource) Height() int {
 	return vs.info.Height()
 }
 
+// An mp4Clip reads the H.264 track of an MP4 file, for Playback.
+type mp4Clip struct {
+	file    *os.File
+	demuxer *mp4.Demuxer
+
+	// Index of the video stream.
+	idx   int8
+	video h264parser.CodecData
+}
+
+func openMP4Clip(filename string) (clip, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	demuxer := mp4.NewDemuxer(file)
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	for i, codec := range codecs {
+		if cd, ok := codec.(h264parser.CodecData); ok {
+			return &mp4Clip{
+				file:    file,
+				demuxer: demuxer,
+				idx:     int8(i),
+				video:   cd,
+			}, nil
+		}
+	}
+
+	file.Close()
+	return nil, errors.New("No compatible video stream found")
+}
+
+func (c *mp4Clip) Width() int {
+	return c.video.Width()
+}
+
+func (c *mp4Clip) Height() int {
+	return c.video.Height()
+}
+
+func (c *mp4Clip) ParameterSets() [][]byte {
+	return [][]byte{c.video.SPS(), c.video.PPS()}
+}
+
+func (c *mp4Clip) ReadFrame() (*clipFrame, error) {
+	for {
+		pkt, err := c.demuxer.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if pkt.Idx != c.idx {
+			continue
+		}
+
+		nalus, err := splitAVCC(pkt.Data, 4)
+		if err != nil {
+			return nil, err
+		}
+		return &clipFrame{
+			Time:              pkt.Time,
+			CompositionOffset: pkt.CompositionTime,
+			KeyFrame:          pkt.IsKeyFrame,
+			NALUs:             nalus,
+		}, nil
+	}
+}
+
+func (c *mp4Clip) SeekToTime(t time.Duration) error {
+	return c.demuxer.SeekToTime(t)
+}
+
+func (c *mp4Clip) Close() error {
+	return c.file.Close()
+}
+
 // Skip past the SEI (if present) in a H.264 data packet.
 // See ITU-T H.264 section 7.3.2.3.
 func skipSEI(data []byte) []byte {
@@ -7,3 +7,7 @@ import "errors"
 func OpenMP4(filename string) (VideoSource, error) {
 	return nil, errors.New("MP4 support disabled")
 }
+
+func openMP4Clip(filename string) (clip, error) {
+	return nil, errors.New("MP4 support disabled")
+}
@@ -0,0 +1,267 @@
+// +build onvif !production
+
+// Package onvif finds the RTSP stream of an ONVIF camera, so that it can be
+// opened by address instead of by a handcrafted rtsp:// URL. It implements
+// just enough of ONVIF Profile S: WS-Discovery, and the device and media
+// services' GetCapabilities, GetProfiles and GetStreamUri operations.
+package onvif
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Path of the device service, the entry point of every ONVIF device.
+const deviceServicePath = "/onvif/device_service"
+
+var errNoProfile = errors.New("onvif: no H.264 media profile")
+
+// Client calls the services of an ONVIF device.
+type Client struct {
+	// URL of the device service, e.g.
+	// http://192.168.1.10/onvif/device_service.
+	URL string
+
+	// Credentials, sent as a WS-Security UsernameToken. If empty, requests
+	// are not authenticated.
+	Username string
+	Password string
+
+	// HTTP client, or nil for http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Difference between the device's clock and ours, which WS-Security
+	// timestamps must account for.
+	clockOffset time.Duration
+
+	// URL of the media service, once known.
+	mediaURL string
+}
+
+// NewClient returns a client of the device at host, e.g. "192.168.1.10" or
+// "camera.local:8080".
+func NewClient(host, username, password string) *Client {
+	return &Client{
+		URL:      "http://" + host + deviceServicePath,
+		Username: username,
+		Password: password,
+	}
+}
+
+// A Profile is a media configuration of a device, e.g. its main stream or a
+// lower resolution substream.
+type Profile struct {
+	Token string `xml:"token,attr"`
+	Name  string
+
+	VideoEncoderConfiguration *struct {
+		Encoding   string
+		Resolution struct {
+			Width  int
+			Height int
+		}
+	}
+}
+
+// Encoding returns the video encoding, e.g. "H264", or "" if the profile has
+// no video.
+func (p *Profile) Encoding() string {
+	if p.VideoEncoderConfiguration == nil {
+		return ""
+	}
+	return p.VideoEncoderConfiguration.Encoding
+}
+
+// SyncClock measures the offset of the device's clock, so that WS-Security
+// timestamps are accepted by a device whose clock is wrong, as is common for
+// cameras without network time. The request needs no credentials.
+func (c *Client) SyncClock(ctx context.Context) error {
+	var resp struct {
+		SystemDateAndTime struct {
+			UTCDateTime *struct {
+				Date struct {
+					Year, Month, Day int
+				}
+				Time struct {
+					Hour, Minute, Second int
+				}
+			}
+		}
+	}
+	req := struct {
+		XMLName xml.Name `xml:"http://www.onvif.org/ver10/device/wsdl GetSystemDateAndTime"`
+	}{}
+	unauthenticated := *c
+	unauthenticated.Username = ""
+	if err := unauthenticated.call(ctx, c.URL, nsDevice, "GetSystemDateAndTime", &req, &resp); err != nil {
+		return err
+	}
+	utc := resp.SystemDateAndTime.UTCDateTime
+	if utc == nil {
+		return errors.New("onvif: device did not report UTC time")
+	}
+	deviceTime := time.Date(utc.Date.Year, time.Month(utc.Date.Month), utc.Date.Day,
+		utc.Time.Hour, utc.Time.Minute, utc.Time.Second, 0, time.UTC)
+	c.clockOffset = deviceTime.Sub(time.Now())
+	if c.clockOffset > time.Minute || c.clockOffset < -time.Minute {
+		log.Info("Clock of %s is off by %v", c.URL, c.clockOffset.Round(time.Second))
+	}
+	return nil
+}
+
+// Return the URL of the media service.
+func (c *Client) mediaService(ctx context.Context) (string, error) {
+	if c.mediaURL != "" {
+		return c.mediaURL, nil
+	}
+	req := struct {
+		XMLName  xml.Name `xml:"http://www.onvif.org/ver10/device/wsdl GetCapabilities"`
+		Category string
+	}{Category: "Media"}
+	var resp struct {
+		Capabilities struct {
+			Media struct {
+				XAddr string
+			}
+		}
+	}
+	if err := c.call(ctx, c.URL, nsDevice, "GetCapabilities", &req, &resp); err != nil {
+		return "", err
+	}
+	xaddr := strings.TrimSpace(resp.Capabilities.Media.XAddr)
+	if xaddr == "" {
+		return "", errors.New("onvif: device has no media service")
+	}
+	c.mediaURL = c.reachable(xaddr)
+	return c.mediaURL, nil
+}
+
+// Devices behind NAT, or with several addresses, may advertise service URLs
+// we can't reach. Use the address by which we reached the device service
+// instead, keeping the advertised port. Services of the same scheme without a
+// port are taken to share the device service's, e.g. if port-forwarded.
+func (c *Client) reachable(xaddr string) string {
+	u, err := url.Parse(xaddr)
+	if err != nil {
+		return xaddr
+	}
+	device, err := url.Parse(c.URL)
+	if err != nil {
+		return xaddr
+	}
+	host := device.Hostname()
+	if u.Port() == "" && u.Scheme == device.Scheme {
+		u.Host = device.Host
+	} else if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+	return u.String()
+}
+
+// GetProfiles returns the device's media profiles.
+func (c *Client) GetProfiles(ctx context.Context) ([]Profile, error) {
+	mediaURL, err := c.mediaService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := struct {
+		XMLName xml.Name `xml:"http://www.onvif.org/ver10/media/wsdl GetProfiles"`
+	}{}
+	var resp struct {
+		Profiles []Profile
+	}
+	if err := c.call(ctx, mediaURL, nsMedia, "GetProfiles", &req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Profiles, nil
+}
+
+// GetStreamURI returns the rtsp:// URL of a profile's stream, as RTP over
+// RTSP, without credentials.
+func (c *Client) GetStreamURI(ctx context.Context, profileToken string) (string, error) {
+	mediaURL, err := c.mediaService(ctx)
+	if err != nil {
+		return "", err
+	}
+	type transport struct {
+		Protocol string `xml:"http://www.onvif.org/ver10/schema Protocol"`
+	}
+	type streamSetup struct {
+		Stream    string    `xml:"http://www.onvif.org/ver10/schema Stream"`
+		Transport transport `xml:"http://www.onvif.org/ver10/schema Transport"`
+	}
+	req := struct {
+		XMLName      xml.Name    `xml:"http://www.onvif.org/ver10/media/wsdl GetStreamUri"`
+		StreamSetup  streamSetup `xml:"http://www.onvif.org/ver10/media/wsdl StreamSetup"`
+		ProfileToken string      `xml:"http://www.onvif.org/ver10/media/wsdl ProfileToken"`
+	}{
+		StreamSetup: streamSetup{
+			Stream:    "RTP-Unicast",
+			Transport: transport{Protocol: "RTSP"},
+		},
+		ProfileToken: profileToken,
+	}
+	var resp struct {
+		MediaUri struct {
+			Uri string
+		}
+	}
+	if err := c.call(ctx, mediaURL, nsMedia, "GetStreamUri", &req, &resp); err != nil {
+		return "", err
+	}
+	uri := strings.TrimSpace(resp.MediaUri.Uri)
+	if uri == "" {
+		return "", errors.New("onvif: device returned no stream URI")
+	}
+	return uri, nil
+}
+
+// StreamURI returns the rtsp:// URL of the named profile, or of the device's
+// first H.264 profile if profileToken is empty, with the client's credentials
+// added for the RTSP server's challenge.
+func (c *Client) StreamURI(ctx context.Context, profileToken string) (string, error) {
+	if err := c.SyncClock(ctx); err != nil {
+		// Not all devices allow it; carry on with our own clock.
+		log.Debug("Failed to read clock of %s: %v", c.URL, err)
+	}
+
+	if profileToken == "" {
+		profiles, err := c.GetProfiles(ctx)
+		if err != nil {
+			return "", err
+		}
+		for _, p := range profiles {
+			if p.Encoding() == "H264" {
+				log.Debug("Using profile %q (%s)", p.Token, p.Name)
+				profileToken = p.Token
+				break
+			}
+		}
+		if profileToken == "" {
+			return "", errNoProfile
+		}
+	}
+
+	uri, err := c.GetStreamURI(ctx, profileToken)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(c.reachable(uri))
+	if err != nil {
+		return "", err
+	}
+	if u.User == nil && c.Username != "" {
+		u.User = url.UserPassword(c.Username, c.Password)
+	}
+	return u.String(), nil
+}
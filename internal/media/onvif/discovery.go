@@ -0,0 +1,151 @@
+// +build onvif !production
+
+package onvif
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Multicast group of WS-Discovery.
+// See http://docs.oasis-open.org/ws-dd/discovery/1.1/os/wsdd-discovery-1.1-spec-os.html
+const discoveryAddress = "239.255.255.250:3702"
+
+// How long Discover waits for devices to answer, unless its context ends first.
+const defaultDiscoveryTimeout = 3 * time.Second
+
+// A Device is an ONVIF device found by Discover.
+type Device struct {
+	// Endpoint reference, a URN identifying the device.
+	Address string
+
+	// URLs of the device service, e.g.
+	// http://192.168.1.10/onvif/device_service.
+	XAddrs []string
+
+	// Scopes describing the device, e.g. onvif://www.onvif.org/name/Camera.
+	Scopes []string
+}
+
+// Name returns the device's name, from its scopes, or "" if not given.
+func (d *Device) Name() string {
+	const prefix = "onvif://www.onvif.org/name/"
+	for _, s := range d.Scopes {
+		if strings.HasPrefix(s, prefix) {
+			return strings.Replace(s[len(prefix):], "_", " ", -1)
+		}
+	}
+	return ""
+}
+
+// A WS-Discovery probe for ONVIF video devices.
+const probeTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing">
+<s:Header>
+<a:Action s:mustUnderstand="1">http://schemas.xmlsoap.org/ws/2005/04/discovery/Probe</a:Action>
+<a:MessageID>uuid:%s</a:MessageID>
+<a:ReplyTo><a:Address>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>
+<a:To s:mustUnderstand="1">urn:schemas-xmlsoap-org:ws:2005:04:discovery</a:To>
+</s:Header>
+<s:Body>
+<d:Probe xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery"><d:Types xmlns:dn="http://www.onvif.org/ver10/network/wsdl">dn:NetworkVideoTransmitter</d:Types></d:Probe>
+</s:Body>
+</s:Envelope>`
+
+type probeMatches struct {
+	Body struct {
+		ProbeMatches struct {
+			ProbeMatch []struct {
+				EndpointReference struct {
+					Address string
+				}
+				Scopes string
+				XAddrs string
+			}
+		}
+	}
+}
+
+// Discover probes the local network for ONVIF cameras, and returns those
+// that answer within a few seconds, or until ctx is done.
+func Discover(ctx context.Context) ([]Device, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDiscoveryTimeout)
+		defer cancel()
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	group, err := net.ResolveUDPAddr("udp4", discoveryAddress)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo([]byte(fmt.Sprintf(probeTemplate, newUUID())), group); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	var devices []Device
+	seen := make(map[string]bool)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return devices, nil
+			}
+			return devices, err
+		}
+		for _, d := range parseProbeMatches(buf[:n]) {
+			if seen[d.Address] {
+				continue
+			}
+			seen[d.Address] = true
+			log.Debug("Found ONVIF device %s at %s: %v", d.Address, from, d.XAddrs)
+			devices = append(devices, d)
+		}
+	}
+}
+
+// Parse the devices in a ProbeMatches message, ignoring anything else.
+func parseProbeMatches(data []byte) []Device {
+	var m probeMatches
+	if err := xml.Unmarshal(data, &m); err != nil {
+		log.Debug("Ignoring malformed discovery message: %v", err)
+		return nil
+	}
+	var devices []Device
+	for _, pm := range m.Body.ProbeMatches.ProbeMatch {
+		d := Device{
+			Address: strings.TrimSpace(pm.EndpointReference.Address),
+			XAddrs:  strings.Fields(pm.XAddrs),
+			Scopes:  strings.Fields(pm.Scopes),
+		}
+		if len(d.XAddrs) > 0 {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// Return a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
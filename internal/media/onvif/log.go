@@ -0,0 +1,7 @@
+// +build onvif !production
+
+package onvif
+
+import "github.com/lanikai/alohartc/internal/logging"
+
+var log = logging.DefaultLogger.WithTag("onvif")
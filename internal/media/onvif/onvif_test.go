@@ -0,0 +1,152 @@
+package onvif
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A fake camera, with a JPEG and an H.264 profile, that advertises service
+// URLs on an address we can't reach.
+func fakeCamera(t *testing.T, password string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		var req struct {
+			Header struct {
+				Security struct {
+					UsernameToken struct {
+						Username string
+						Password string
+						Nonce    string
+						Created  string
+					}
+				}
+			}
+			Body struct {
+				Content []byte `xml:",innerxml"`
+			}
+		}
+		if err := xml.Unmarshal(data, &req); err != nil {
+			t.Errorf("malformed request: %v", err)
+			return
+		}
+		var op struct {
+			XMLName xml.Name
+		}
+		xml.Unmarshal(req.Body.Content, &op)
+
+		w.Header().Set("Content-Type", "application/soap+xml")
+		reply := func(body string) {
+			fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema"><s:Body>%s</s:Body></s:Envelope>`, body)
+		}
+
+		if op.XMLName.Local == "GetSystemDateAndTime" {
+			reply(`<tds:GetSystemDateAndTimeResponse><tds:SystemDateAndTime><tt:UTCDateTime><tt:Date><tt:Year>2020</tt:Year><tt:Month>1</tt:Month><tt:Day>2</tt:Day></tt:Date><tt:Time><tt:Hour>3</tt:Hour><tt:Minute>4</tt:Minute><tt:Second>5</tt:Second></tt:Time></tt:UTCDateTime></tds:SystemDateAndTime></tds:GetSystemDateAndTimeResponse>`)
+			return
+		}
+
+		// Everything else needs a valid UsernameToken.
+		token := req.Header.Security.UsernameToken
+		nonce, _ := base64.StdEncoding.DecodeString(token.Nonce)
+		h := sha1.New()
+		h.Write(nonce)
+		h.Write([]byte(token.Created))
+		h.Write([]byte(password))
+		if token.Username != "admin" || token.Password != base64.StdEncoding.EncodeToString(h.Sum(nil)) {
+			w.WriteHeader(http.StatusBadRequest)
+			reply(`<s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value>ter:NotAuthorized</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en">Sender not authorized</s:Text></s:Reason></s:Fault>`)
+			return
+		}
+		if !strings.HasPrefix(token.Created, "2020-01-02T03:04:") {
+			t.Errorf("UsernameToken created at %s, not by the camera's clock", token.Created)
+		}
+
+		switch op.XMLName.Local {
+		case "GetCapabilities":
+			reply(`<tds:GetCapabilitiesResponse><tds:Capabilities><tt:Media><tt:XAddr>http://10.255.255.1/onvif/media_service</tt:XAddr></tt:Media></tds:Capabilities></tds:GetCapabilitiesResponse>`)
+		case "GetProfiles":
+			if r.URL.Path != "/onvif/media_service" {
+				t.Errorf("GetProfiles at %s", r.URL.Path)
+			}
+			reply(`<trt:GetProfilesResponse>` +
+				`<trt:Profiles token="jpeg"><tt:Name>Snapshot</tt:Name><tt:VideoEncoderConfiguration><tt:Encoding>JPEG</tt:Encoding></tt:VideoEncoderConfiguration></trt:Profiles>` +
+				`<trt:Profiles token="main"><tt:Name>Main</tt:Name><tt:VideoEncoderConfiguration><tt:Encoding>H264</tt:Encoding><tt:Resolution><tt:Width>1920</tt:Width><tt:Height>1080</tt:Height></tt:Resolution></tt:VideoEncoderConfiguration></trt:Profiles>` +
+				`</trt:GetProfilesResponse>`)
+		case "GetStreamUri":
+			if !strings.Contains(string(req.Body.Content), "main</") {
+				t.Errorf("GetStreamUri of the wrong profile: %s", req.Body.Content)
+			}
+			reply(`<trt:GetStreamUriResponse><trt:MediaUri><tt:Uri>rtsp://10.255.255.1:554/stream1</tt:Uri></trt:MediaUri></trt:GetStreamUriResponse>`)
+		default:
+			t.Errorf("unexpected operation %s", op.XMLName.Local)
+		}
+	}))
+}
+
+func TestStreamURI(t *testing.T) {
+	camera := fakeCamera(t, "secret")
+	defer camera.Close()
+	host := strings.TrimPrefix(camera.URL, "http://")
+
+	c := NewClient(host, "admin", "secret")
+	if err := c.SyncClock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := c.GetProfiles(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || profiles[1].Token != "main" || profiles[1].VideoEncoderConfiguration.Resolution.Width != 1920 {
+		t.Errorf("unexpected profiles: %+v", profiles)
+	}
+
+	uri, err := NewClient(host, "admin", "secret").StreamURI(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname := strings.Split(host, ":")[0]
+	if want := "rtsp://admin:secret@" + hostname + ":554/stream1"; uri != want {
+		t.Errorf("stream URI = %s, want %s", uri, want)
+	}
+
+	_, err = NewClient(host, "admin", "wrong").StreamURI(context.Background(), "main")
+	if f, ok := err.(*Fault); !ok || f.Code != "ter:NotAuthorized" {
+		t.Errorf("expected NotAuthorized fault, got %v", err)
+	}
+}
+
+func TestParseProbeMatches(t *testing.T) {
+	msg := `<?xml version="1.0" encoding="UTF-8"?>
+<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery">
+<SOAP-ENV:Header><wsa:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches</wsa:Action></SOAP-ENV:Header>
+<SOAP-ENV:Body><d:ProbeMatches><d:ProbeMatch>
+<wsa:EndpointReference><wsa:Address>urn:uuid:2419d68a-2dd2-21b2-a205-ec2c40b5a1f0</wsa:Address></wsa:EndpointReference>
+<d:Types>dn:NetworkVideoTransmitter</d:Types>
+<d:Scopes>onvif://www.onvif.org/type/video_encoder onvif://www.onvif.org/name/Front_Door</d:Scopes>
+<d:XAddrs>http://192.168.1.10/onvif/device_service http://[fe80::1]/onvif/device_service</d:XAddrs>
+<d:MetadataVersion>1</d:MetadataVersion>
+</d:ProbeMatch></d:ProbeMatches></SOAP-ENV:Body></SOAP-ENV:Envelope>`
+
+	devices := parseProbeMatches([]byte(msg))
+	if len(devices) != 1 {
+		t.Fatalf("parsed %d devices", len(devices))
+	}
+	d := devices[0]
+	if d.Address != "urn:uuid:2419d68a-2dd2-21b2-a205-ec2c40b5a1f0" || len(d.XAddrs) != 2 || d.XAddrs[0] != "http://192.168.1.10/onvif/device_service" {
+		t.Errorf("unexpected device: %+v", d)
+	}
+	if d.Name() != "Front Door" {
+		t.Errorf("name = %q", d.Name())
+	}
+
+	if devices := parseProbeMatches([]byte("not xml")); devices != nil {
+		t.Errorf("parsed %v from garbage", devices)
+	}
+}
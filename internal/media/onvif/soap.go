@@ -0,0 +1,179 @@
+// +build onvif !production
+
+package onvif
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Namespaces of ONVIF services, which prefix the actions of their operations.
+const (
+	nsDevice = "http://www.onvif.org/ver10/device/wsdl"
+	nsMedia  = "http://www.onvif.org/ver10/media/wsdl"
+)
+
+// Types of UsernameToken fields.
+const (
+	passwordDigest = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest"
+	base64Binary   = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary"
+)
+
+// Largest SOAP response read from a device.
+const maxResponseSize = 1 << 20
+
+type envelope struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2003/05/soap-envelope Envelope"`
+	Header  *header  `xml:"http://www.w3.org/2003/05/soap-envelope Header,omitempty"`
+	Body    body     `xml:"http://www.w3.org/2003/05/soap-envelope Body"`
+}
+
+type header struct {
+	Security *security
+}
+
+type body struct {
+	Content interface{}
+}
+
+// WS-Security UsernameToken, which ONVIF devices use to authenticate
+// requests (see ONVIF Core Specification Section 5.12).
+type security struct {
+	XMLName        xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd Security"`
+	MustUnderstand string   `xml:"http://www.w3.org/2003/05/soap-envelope mustUnderstand,attr"`
+	UsernameToken  struct {
+		Username string
+		Password struct {
+			Type   string `xml:",attr"`
+			Digest string `xml:",chardata"`
+		}
+		Nonce struct {
+			EncodingType string `xml:",attr"`
+			Nonce        string `xml:",chardata"`
+		}
+		Created struct {
+			XMLName xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd Created"`
+			Time    string   `xml:",chardata"`
+		}
+	}
+}
+
+// Return a UsernameToken for the credentials, created at the given time.
+// The password digest is Base64(SHA-1(nonce + created + password)).
+func newSecurity(username, password string, created time.Time) *security {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return newSecurityWithNonce(username, password, created, nonce)
+}
+
+func newSecurityWithNonce(username, password string, created time.Time, nonce []byte) *security {
+	s := &security{MustUnderstand: "1"}
+	t := &s.UsernameToken
+	t.Username = username
+	t.Created.Time = created.UTC().Format("2006-01-02T15:04:05.000Z")
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(t.Created.Time))
+	h.Write([]byte(password))
+	t.Password.Type = passwordDigest
+	t.Password.Digest = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	t.Nonce.EncodingType = base64Binary
+	t.Nonce.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	return s
+}
+
+// A SOAP fault returned by a device.
+type fault struct {
+	Code struct {
+		Value   string
+		Subcode struct {
+			Value string
+		}
+	}
+	Reason struct {
+		Text string
+	}
+}
+
+// Fault is an error reported by an ONVIF device.
+type Fault struct {
+	Operation string
+	Code      string
+	Reason    string
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("onvif: %s failed: %s: %s", f.Operation, f.Code, f.Reason)
+}
+
+// Post a request for an operation of the ONVIF service in namespace ns, and
+// decode the response into resp. Requests are authenticated if the client has
+// credentials.
+func (c *Client) call(ctx context.Context, url, ns, operation string, req, resp interface{}) error {
+	env := envelope{Body: body{Content: req}}
+	if c.Username != "" {
+		env.Header = &header{Security: newSecurity(c.Username, c.Password, time.Now().Add(c.clockOffset))}
+	}
+	data, err := xml.Marshal(&env)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(append([]byte(xml.Header), data...)))
+	if err != nil {
+		return err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", `application/soap+xml; charset=utf-8; action="`+ns+"/"+operation+`"`)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpResp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize+1))
+	if err != nil {
+		return err
+	}
+	if len(content) > maxResponseSize {
+		return fmt.Errorf("onvif: %s response too large", operation)
+	}
+
+	// Faults come with an HTTP error status, so look for one first.
+	var out struct {
+		Body struct {
+			Fault   *fault
+			Content []byte `xml:",innerxml"`
+		} `xml:"http://www.w3.org/2003/05/soap-envelope Body"`
+	}
+	if err := xml.Unmarshal(content, &out); err != nil {
+		if httpResp.StatusCode != http.StatusOK {
+			return fmt.Errorf("onvif: %s failed: %s", operation, httpResp.Status)
+		}
+		return fmt.Errorf("onvif: %s: %v", operation, err)
+	}
+	if f := out.Body.Fault; f != nil {
+		code := f.Code.Value
+		if f.Code.Subcode.Value != "" {
+			code = f.Code.Subcode.Value
+		}
+		return &Fault{Operation: operation, Code: code, Reason: f.Reason.Text}
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("onvif: %s failed: %s", operation, httpResp.Status)
+	}
+	return xml.Unmarshal(out.Body.Content, resp)
+}
@@ -0,0 +1,27 @@
+// +build production,!onvif
+
+package onvif
+
+import (
+	"context"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+func Open(uri string) (media.VideoSource, error) {
+	panic("ONVIF support disabled")
+}
+
+type Device struct {
+	Address string
+	XAddrs  []string
+	Scopes  []string
+}
+
+func (d *Device) Name() string {
+	return ""
+}
+
+func Discover(ctx context.Context) ([]Device, error) {
+	panic("ONVIF support disabled")
+}
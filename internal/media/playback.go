@@ -0,0 +1,344 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+// A clip is a recorded H.264 video track that can be read one frame at a time.
+type clip interface {
+	Width() int
+	Height() int
+
+	// ParameterSets returns the SPS and PPS NALUs, which are sent ahead of
+	// each key frame.
+	ParameterSets() [][]byte
+
+	// ReadFrame returns the next frame in the clip, or io.EOF at the end.
+	ReadFrame() (*clipFrame, error)
+
+	// SeekToTime positions the clip such that the next frame read is a key
+	// frame at or shortly before t.
+	SeekToTime(t time.Duration) error
+
+	Close() error
+}
+
+type clipFrame struct {
+	// Decode time, relative to the start of the clip. Frames are read and
+	// sent in decode order.
+	Time time.Duration
+
+	// Presentation time minus decode time, nonzero for reordered frames,
+	// e.g. H.264 B-frames and the frames they refer to.
+	CompositionOffset time.Duration
+
+	KeyFrame bool
+
+	// NAL units making up the frame, without start codes or length prefixes.
+	NALUs [][]byte
+}
+
+// Playback is a VideoSource that streams a recorded clip, with VCR-style
+// controls. Unlike OpenMP4, a Playback does not loop: it pauses at the end of
+// the clip, keeping the last frame on screen until the viewer seeks elsewhere.
+//
+// The controls act on the source, and therefore on every receiver at once.
+type Playback struct {
+	Flow
+
+	clip clip
+
+	// Signaled when the playback state changes, to wake the read loop.
+	wake chan struct{}
+
+	// Origin of the presentation times given to receivers.
+	origin time.Time
+
+	// Playback state, guarded by mu.
+	mu          sync.Mutex
+	paused      bool
+	speed       float64
+	position    time.Duration
+	seekPending bool
+	seekTarget  time.Duration
+}
+
+// OpenPlayback opens a recording for playback. MP4 (.mp4, .m4v, .mov) and
+// Matroska (.mkv) files containing an H.264 video track are supported.
+func OpenPlayback(filename string) (*Playback, error) {
+	var c clip
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".mp4", ".m4v", ".mov":
+		c, err = openMP4Clip(filename)
+	case ".mkv":
+		c, err = openMKVClip(filename)
+	default:
+		return nil, fmt.Errorf("media: unsupported recording format: %s", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Opened recording %s: %dx%d", filename, c.Width(), c.Height())
+	return newPlayback(c), nil
+}
+
+func newPlayback(c clip) *Playback {
+	p := &Playback{
+		clip:   c,
+		wake:   make(chan struct{}, 1),
+		speed:  1,
+		origin: time.Now(),
+	}
+	loop := newSingletonLoop(p.readLoop)
+	p.Flow.Start = loop.start
+	p.Flow.Stop = loop.stop
+	return p
+}
+
+func (p *Playback) Codec() string {
+	return "H264"
+}
+
+func (p *Playback) Width() int {
+	return p.clip.Width()
+}
+
+func (p *Playback) Height() int {
+	return p.clip.Height()
+}
+
+// ParameterSets implements media.ParameterSetProvider.
+func (p *Playback) ParameterSets() [][]byte {
+	return p.clip.ParameterSets()
+}
+
+// Close releases the underlying file. Receivers must be removed first.
+func (p *Playback) Close() error {
+	return p.clip.Close()
+}
+
+// Pause stops sending frames. Viewers continue to display the last frame.
+func (p *Playback) Pause() {
+	p.update(func() { p.paused = true })
+}
+
+// Resume continues playback after Pause, or after the end of the clip.
+func (p *Playback) Resume() {
+	p.update(func() { p.paused = false })
+}
+
+// Paused reports whether playback is paused.
+func (p *Playback) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// Seek jumps to the key frame at or shortly before t. If playback is paused,
+// the frame at the new position is still sent, so viewers see where they are.
+func (p *Playback) Seek(t time.Duration) {
+	if t < 0 {
+		t = 0
+	}
+	p.update(func() {
+		p.seekPending = true
+		p.seekTarget = t
+	})
+}
+
+// SetSpeed sets the playback rate, e.g. 2 for double speed or 0.5 for half
+// speed. The speed must be positive.
+func (p *Playback) SetSpeed(speed float64) error {
+	if speed <= 0 {
+		return errors.New("media: playback speed must be positive")
+	}
+	p.update(func() { p.speed = speed })
+	return nil
+}
+
+// Speed returns the current playback rate.
+func (p *Playback) Speed() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.speed
+}
+
+// Position returns the presentation time of the most recently sent frame.
+func (p *Playback) Position() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.position
+}
+
+// Apply a change to the playback state, then wake the read loop.
+func (p *Playback) update(change func()) {
+	p.mu.Lock()
+	change()
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Playback) readLoop(quit <-chan struct{}) error {
+	// The loop may be restarting after all receivers went away. Resume from a
+	// key frame, so that new receivers can decode the first frame they get.
+	p.mu.Lock()
+	if !p.seekPending {
+		p.seekPending = true
+		p.seekTarget = p.position
+	}
+	p.mu.Unlock()
+
+	var (
+		// Frame read from the clip, waiting to be sent.
+		next *clipFrame
+
+		// Send the next frame immediately, even if paused.
+		step bool
+
+		// Wall clock and clip times from which frames are paced. A zero
+		// wallBase means the next frame is sent without delay.
+		wallBase time.Time
+		clipBase time.Duration
+	)
+
+	for {
+		p.mu.Lock()
+		seekPending, seekTarget := p.seekPending, p.seekTarget
+		paused, speed := p.paused, p.speed
+		p.seekPending = false
+		p.mu.Unlock()
+
+		if seekPending {
+			if err := p.clip.SeekToTime(seekTarget); err != nil {
+				log.Error("Playback seek to %v failed: %v", seekTarget, err)
+				p.Shutdown(err)
+				return err
+			}
+			next = nil
+			step = true
+			wallBase = time.Time{}
+		}
+
+		if paused && !step {
+			wallBase = time.Time{}
+			select {
+			case <-quit:
+				return nil
+			case <-p.wake:
+			}
+			continue
+		}
+
+		if next == nil {
+			f, err := p.clip.ReadFrame()
+			if err == io.EOF {
+				log.Info("Playback reached end of clip")
+				p.mu.Lock()
+				p.paused = true
+				p.mu.Unlock()
+				step = false
+				continue
+			} else if err != nil {
+				log.Error("Playback read failed: %v", err)
+				p.Shutdown(err)
+				return err
+			}
+			next = f
+		}
+
+		if step || wallBase.IsZero() {
+			wallBase, clipBase = time.Now(), next.Time
+		} else if d := time.Until(wallBase.Add(time.Duration(float64(next.Time-clipBase) / speed))); d > 0 {
+			// Sleep until the frame is due, unless the state changes first.
+			timer := time.NewTimer(d)
+			select {
+			case <-quit:
+				timer.Stop()
+				return nil
+			case <-p.wake:
+				timer.Stop()
+				wallBase = time.Time{}
+				continue
+			case <-timer.C:
+			}
+		}
+
+		p.send(next)
+		next = nil
+		step = false
+	}
+}
+
+func (p *Playback) send(f *clipFrame) {
+	p.mu.Lock()
+	speed := p.speed
+	p.mu.Unlock()
+
+	// Frames are sent as they are due for decoding, so a frame is presented
+	// after its composition offset, at the playback speed.
+	pts := time.Since(p.origin) + time.Duration(float64(f.CompositionOffset)/speed)
+	put := func(nalu []byte, continued bool) {
+		buf := packet.NewSharedBuffer(nalu, 1, nil)
+		buf.SetPTS(pts)
+		buf.SetContinued(continued)
+		p.Put(buf)
+	}
+
+	if f.KeyFrame {
+		for _, ps := range p.clip.ParameterSets() {
+			put(ps, true)
+		}
+	}
+	for i, nalu := range f.NALUs {
+		put(nalu, i < len(f.NALUs)-1)
+	}
+
+	p.mu.Lock()
+	p.position = f.Time
+	p.mu.Unlock()
+}
+
+// Split a frame stored as length-prefixed NAL units, as in MP4 and Matroska
+// files. See ISO/IEC 14496-15 section 5.3.4.2.
+func splitAVCC(data []byte, lengthSize int) ([][]byte, error) {
+	var nalus [][]byte
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nil, errors.New("media: truncated NALU length")
+		}
+		var n uint32
+		switch lengthSize {
+		case 1:
+			n = uint32(data[0])
+		case 2:
+			n = uint32(binary.BigEndian.Uint16(data))
+		case 4:
+			n = binary.BigEndian.Uint32(data)
+		default:
+			return nil, fmt.Errorf("media: invalid NALU length size %d", lengthSize)
+		}
+		data = data[lengthSize:]
+		if uint32(len(data)) < n {
+			return nil, errors.New("media: truncated NALU")
+		}
+		if n > 0 {
+			nalus = append(nalus, data[:n])
+		}
+		data = data[n:]
+	}
+	return nalus, nil
+}
@@ -0,0 +1,89 @@
+package media
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A fakeClip has one frame every 10 ms, with a key frame every 5 frames. Each
+// frame is a single NALU whose second byte is the frame number.
+type fakeClip struct {
+	frames int
+	next   int
+}
+
+func (c *fakeClip) Width() int              { return 640 }
+func (c *fakeClip) Height() int             { return 480 }
+func (c *fakeClip) ParameterSets() [][]byte { return [][]byte{testSPS, testPPS} }
+func (c *fakeClip) Close() error            { return nil }
+
+func (c *fakeClip) ReadFrame() (*clipFrame, error) {
+	if c.next >= c.frames {
+		return nil, io.EOF
+	}
+	n := c.next
+	c.next++
+	return &clipFrame{
+		Time:     time.Duration(n) * 10 * time.Millisecond,
+		KeyFrame: n%5 == 0,
+		NALUs:    [][]byte{{0x41, byte(n)}},
+	}, nil
+}
+
+func (c *fakeClip) SeekToTime(t time.Duration) error {
+	n := int(t / (10 * time.Millisecond))
+	c.next = n - n%5
+	return nil
+}
+
+// Return the frame number of the next picture NALU, skipping parameter sets.
+func nextFrame(t *testing.T, r Receiver) int {
+	for {
+		select {
+		case buf := <-r.Buffers():
+			b := buf.Bytes()
+			buf.Release()
+			if b[0] == 0x41 {
+				return int(b[1])
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for frame")
+		}
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	p := newPlayback(&fakeClip{frames: 20})
+	p.Pause()
+
+	r := p.AddReceiver(64)
+	defer p.RemoveReceiver(r)
+
+	// Starting while paused still shows the first frame.
+	assert.Equal(t, 0, nextFrame(t, r))
+
+	// Seeking while paused shows the preceding key frame, then stops.
+	p.Seek(120 * time.Millisecond)
+	assert.Equal(t, 10, nextFrame(t, r))
+	select {
+	case buf := <-r.Buffers():
+		t.Fatalf("unexpected buffer while paused: %x", buf.Bytes())
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 100*time.Millisecond, p.Position())
+
+	// Resume at double speed; frames arrive in order, then playback pauses
+	// at the end of the clip.
+	assert.NoError(t, p.SetSpeed(2))
+	assert.Error(t, p.SetSpeed(0))
+	p.Resume()
+	for n := 11; n < 20; n++ {
+		assert.Equal(t, n, nextFrame(t, r))
+	}
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, p.Paused())
+	assert.Equal(t, 190*time.Millisecond, p.Position())
+}
@@ -0,0 +1,99 @@
+// Package raw processes uncompressed video frames, e.g. between a camera that
+// captures raw frames and the encoder, with a chain of transforms: flips,
+// cropping, scaling, and overlays such as a burned-in timestamp.
+package raw
+
+import (
+	"errors"
+	"time"
+)
+
+var errFrameSize = errors.New("raw: frame size doesn't match I420 dimensions")
+
+// A Frame is a picture in planar YUV 4:2:0 (I420), with the planes stored
+// contiguously and without padding: Y at full resolution, then U and V at
+// half resolution in each dimension. Width and height are even.
+type Frame struct {
+	Width  int
+	Height int
+
+	Y, U, V []byte
+
+	// When the frame was captured.
+	Time time.Time
+
+	data []byte
+}
+
+// NewFrame allocates a black frame. Odd dimensions are rounded down.
+func NewFrame(width, height int) *Frame {
+	width &^= 1
+	height &^= 1
+	f, _ := FromI420(make([]byte, i420Size(width, height)), width, height)
+	f.Fill(16, 128, 128)
+	return f
+}
+
+// FromI420 wraps a buffer holding an I420 frame, without copying it.
+func FromI420(data []byte, width, height int) (*Frame, error) {
+	if width <= 0 || height <= 0 || width%2 != 0 || height%2 != 0 || len(data) < i420Size(width, height) {
+		return nil, errFrameSize
+	}
+	ySize := width * height
+	cSize := ySize / 4
+	return &Frame{
+		Width:  width,
+		Height: height,
+		Y:      data[:ySize],
+		U:      data[ySize : ySize+cSize],
+		V:      data[ySize+cSize : ySize+2*cSize],
+		data:   data[:ySize+2*cSize],
+	}, nil
+}
+
+func i420Size(width, height int) int {
+	return width * height * 3 / 2
+}
+
+// Bytes returns the frame in I420 layout.
+func (f *Frame) Bytes() []byte {
+	return f.data
+}
+
+// Fill sets every pixel to the given color.
+func (f *Frame) Fill(y, u, v byte) {
+	fill(f.Y, y)
+	fill(f.U, u)
+	fill(f.V, v)
+}
+
+func fill(b []byte, c byte) {
+	for i := range b {
+		b[i] = c
+	}
+}
+
+// FillRect sets the pixels of a rectangle, clipped to the frame, to the given
+// color. Chroma is set for the 2x2 blocks the rectangle covers.
+func (f *Frame) FillRect(x, y, width, height int, cy, cu, cv byte) {
+	x0, y0 := clip(x, f.Width), clip(y, f.Height)
+	x1, y1 := clip(x+width, f.Width), clip(y+height, f.Height)
+	for row := y0; row < y1; row++ {
+		fill(f.Y[row*f.Width+x0:row*f.Width+x1], cy)
+	}
+	cw := f.Width / 2
+	for row := y0 / 2; row < (y1+1)/2; row++ {
+		fill(f.U[row*cw+x0/2:row*cw+(x1+1)/2], cu)
+		fill(f.V[row*cw+x0/2:row*cw+(x1+1)/2], cv)
+	}
+}
+
+func clip(v, max int) int {
+	if v < 0 {
+		return 0
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,102 @@
+package raw
+
+import (
+	"strings"
+)
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// A 5x7 bitmap font, one byte per row, most significant of the low 5 bits on
+// the left. Lower case letters are drawn as upper case, and characters
+// without a glyph as blanks.
+var glyphs = map[rune][glyphHeight]byte{
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'A': {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'B': {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D': {0x1c, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1c},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G': {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H': {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P': {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q': {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T': {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X': {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x11, 0x0a, 0x04, 0x04, 0x04},
+	'Z': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	',': {0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'+': {0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'#': {0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a},
+	'%': {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	'(': {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')': {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	'_': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+}
+
+// DrawText draws a line of white text on a black background, with its top
+// left corner at (x, y). Each font pixel is drawn as a scale x scale square.
+// Text outside the frame is clipped.
+func (f *Frame) DrawText(x, y int, text string, scale int) {
+	if scale < 1 {
+		scale = 1
+	}
+	text = strings.ToUpper(text)
+	n := len([]rune(text))
+	if n == 0 {
+		return
+	}
+
+	// Background, with a margin of one font pixel.
+	advance := (glyphWidth + 1) * scale
+	f.FillRect(x-scale, y-scale, n*advance+scale, (glyphHeight+2)*scale, 16, 128, 128)
+
+	for _, r := range text {
+		glyph := glyphs[r]
+		for row, bits := range glyph {
+			for col := 0; col < glyphWidth; col++ {
+				if bits&(0x10>>uint(col)) != 0 {
+					f.fillLuma(x+col*scale, y+row*scale, scale, 235)
+				}
+			}
+		}
+		x += advance
+	}
+}
+
+// Set the luma of a square, clipped to the frame.
+func (f *Frame) fillLuma(x, y, size int, c byte) {
+	x0, y0 := clip(x, f.Width), clip(y, f.Height)
+	x1, y1 := clip(x+size, f.Width), clip(y+size, f.Height)
+	for row := y0; row < y1; row++ {
+		fill(f.Y[row*f.Width+x0:row*f.Width+x1], c)
+	}
+}
@@ -0,0 +1,180 @@
+package raw
+
+// A Transform processes raw frames.
+type Transform interface {
+	// Size returns the size of the frames output for input frames of the
+	// given size.
+	Size(width, height int) (int, int)
+
+	// Apply transforms a frame, either in place or into a new frame, which
+	// it returns.
+	Apply(f *Frame) *Frame
+}
+
+// A Chain applies transforms in order.
+type Chain []Transform
+
+func (c Chain) Size(width, height int) (int, int) {
+	for _, t := range c {
+		width, height = t.Size(width, height)
+	}
+	return width, height
+}
+
+func (c Chain) Apply(f *Frame) *Frame {
+	for _, t := range c {
+		f = t.Apply(f)
+	}
+	return f
+}
+
+// FlipHorizontal mirrors frames left to right, for cameras without a
+// horizontal flip control.
+type FlipHorizontal struct{}
+
+func (FlipHorizontal) Size(width, height int) (int, int) {
+	return width, height
+}
+
+func (FlipHorizontal) Apply(f *Frame) *Frame {
+	mirrorRows(f.Y, f.Width)
+	mirrorRows(f.U, f.Width/2)
+	mirrorRows(f.V, f.Width/2)
+	return f
+}
+
+func mirrorRows(plane []byte, stride int) {
+	for row := 0; row+stride <= len(plane); row += stride {
+		line := plane[row : row+stride]
+		for i, j := 0, len(line)-1; i < j; i, j = i+1, j-1 {
+			line[i], line[j] = line[j], line[i]
+		}
+	}
+}
+
+// FlipVertical turns frames upside down, for cameras without a vertical flip
+// control.
+type FlipVertical struct{}
+
+func (FlipVertical) Size(width, height int) (int, int) {
+	return width, height
+}
+
+func (FlipVertical) Apply(f *Frame) *Frame {
+	flipRows(f.Y, f.Width)
+	flipRows(f.U, f.Width/2)
+	flipRows(f.V, f.Width/2)
+	return f
+}
+
+func flipRows(plane []byte, stride int) {
+	tmp := make([]byte, stride)
+	for i, j := 0, len(plane)/stride-1; i < j; i, j = i+1, j-1 {
+		top := plane[i*stride : (i+1)*stride]
+		bottom := plane[j*stride : (j+1)*stride]
+		copy(tmp, top)
+		copy(top, bottom)
+		copy(bottom, tmp)
+	}
+}
+
+// Crop cuts a rectangle out of each frame. Coordinates and dimensions are
+// rounded down to even numbers, and the rectangle is clipped to the frame.
+type Crop struct {
+	X, Y          int
+	Width, Height int
+}
+
+// Return the rectangle cropped from a frame of the given size.
+func (c Crop) rect(width, height int) (x, y, w, h int) {
+	x, y = clip(c.X&^1, width), clip(c.Y&^1, height)
+	w, h = clip(c.Width&^1, width-x), clip(c.Height&^1, height-y)
+	return
+}
+
+func (c Crop) Size(width, height int) (int, int) {
+	_, _, w, h := c.rect(width, height)
+	return w, h
+}
+
+func (c Crop) Apply(f *Frame) *Frame {
+	x, y, w, h := c.rect(f.Width, f.Height)
+	if w == f.Width && h == f.Height {
+		return f
+	}
+	out := NewFrame(w, h)
+	out.Time = f.Time
+	for row := 0; row < h; row++ {
+		copy(out.Y[row*w:(row+1)*w], f.Y[(y+row)*f.Width+x:])
+	}
+	cw := f.Width / 2
+	for row := 0; row < h/2; row++ {
+		copy(out.U[row*w/2:(row+1)*w/2], f.U[(y/2+row)*cw+x/2:])
+		copy(out.V[row*w/2:(row+1)*w/2], f.V[(y/2+row)*cw+x/2:])
+	}
+	return out
+}
+
+// Scale resizes frames, by nearest-neighbor sampling. Dimensions are rounded
+// down to even numbers.
+type Scale struct {
+	Width, Height int
+}
+
+func (s Scale) Size(width, height int) (int, int) {
+	return s.Width &^ 1, s.Height &^ 1
+}
+
+func (s Scale) Apply(f *Frame) *Frame {
+	w, h := s.Size(f.Width, f.Height)
+	if w == f.Width && h == f.Height {
+		return f
+	}
+	out := NewFrame(w, h)
+	out.Time = f.Time
+	scalePlane(out.Y, w, h, f.Y, f.Width, f.Height)
+	scalePlane(out.U, w/2, h/2, f.U, f.Width/2, f.Height/2)
+	scalePlane(out.V, w/2, h/2, f.V, f.Width/2, f.Height/2)
+	return out
+}
+
+func scalePlane(dst []byte, dw, dh int, src []byte, sw, sh int) {
+	if dw == 0 || dh == 0 {
+		return
+	}
+	cols := make([]int, dw)
+	for x := range cols {
+		cols[x] = x * sw / dw
+	}
+	for y := 0; y < dh; y++ {
+		line := src[(y*sh/dh)*sw:]
+		out := dst[y*dw : (y+1)*dw]
+		for x, sx := range cols {
+			out[x] = line[sx]
+		}
+	}
+}
+
+// An Overlay draws on frames in place, e.g. a logo or caption.
+type Overlay func(f *Frame)
+
+func (o Overlay) Size(width, height int) (int, int) {
+	return width, height
+}
+
+func (o Overlay) Apply(f *Frame) *Frame {
+	o(f)
+	return f
+}
+
+// TimestampOverlay burns the capture time of each frame into its top left
+// corner, formatted with the given time layout, e.g. "2006-01-02 15:04:05".
+func TimestampOverlay(layout string) Overlay {
+	return func(f *Frame) {
+		scale := f.Height / 360
+		if scale < 1 {
+			scale = 1
+		}
+		f.DrawText(4*scale, 4*scale, f.Time.Format(layout), scale)
+	}
+}
@@ -0,0 +1,96 @@
+package raw
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Return a 4x4 frame whose luma values are 0 to 15 in raster order, and whose
+// chroma values are 0 to 3.
+func testFrame() *Frame {
+	f := NewFrame(4, 4)
+	for i := range f.Y {
+		f.Y[i] = byte(i)
+	}
+	for i := range f.U {
+		f.U[i] = byte(i)
+		f.V[i] = byte(i)
+	}
+	return f
+}
+
+func TestFlip(t *testing.T) {
+	f := FlipHorizontal{}.Apply(testFrame())
+	if want := []byte{3, 2, 1, 0, 7, 6, 5, 4, 11, 10, 9, 8, 15, 14, 13, 12}; !reflect.DeepEqual(f.Y, want) {
+		t.Errorf("horizontal flip: Y = %v, want %v", f.Y, want)
+	}
+	if want := []byte{1, 0, 3, 2}; !reflect.DeepEqual(f.U, want) {
+		t.Errorf("horizontal flip: U = %v, want %v", f.U, want)
+	}
+
+	f = FlipVertical{}.Apply(testFrame())
+	if want := []byte{12, 13, 14, 15, 8, 9, 10, 11, 4, 5, 6, 7, 0, 1, 2, 3}; !reflect.DeepEqual(f.Y, want) {
+		t.Errorf("vertical flip: Y = %v, want %v", f.Y, want)
+	}
+	if want := []byte{2, 3, 0, 1}; !reflect.DeepEqual(f.V, want) {
+		t.Errorf("vertical flip: V = %v, want %v", f.V, want)
+	}
+}
+
+func TestCrop(t *testing.T) {
+	c := Crop{X: 2, Y: 2, Width: 4, Height: 4}
+	if w, h := c.Size(4, 4); w != 2 || h != 2 {
+		t.Errorf("Size = %dx%d, want 2x2", w, h)
+	}
+	f := c.Apply(testFrame())
+	if want := []byte{10, 11, 14, 15}; !reflect.DeepEqual(f.Y, want) {
+		t.Errorf("Y = %v, want %v", f.Y, want)
+	}
+	if want := []byte{3}; !reflect.DeepEqual(f.U, want) {
+		t.Errorf("U = %v, want %v", f.U, want)
+	}
+}
+
+func TestScale(t *testing.T) {
+	f := Scale{Width: 2, Height: 2}.Apply(testFrame())
+	if want := []byte{0, 2, 8, 10}; !reflect.DeepEqual(f.Y, want) {
+		t.Errorf("Y = %v, want %v", f.Y, want)
+	}
+	if want := []byte{0}; !reflect.DeepEqual(f.U, want) {
+		t.Errorf("U = %v, want %v", f.U, want)
+	}
+}
+
+func TestChain(t *testing.T) {
+	c := Chain{FlipHorizontal{}, Crop{Width: 640, Height: 480}, Scale{Width: 321, Height: 240}}
+	if w, h := c.Size(1280, 720); w != 320 || h != 240 {
+		t.Errorf("Size = %dx%d, want 320x240", w, h)
+	}
+	f := c.Apply(NewFrame(1280, 720))
+	if f.Width != 320 || f.Height != 240 || len(f.Bytes()) != 320*240*3/2 {
+		t.Errorf("got %dx%d frame of %d bytes", f.Width, f.Height, len(f.Bytes()))
+	}
+}
+
+func TestDrawText(t *testing.T) {
+	f := NewFrame(16, 10)
+	f.DrawText(1, 1, "1", 1)
+	// The stem of the "1" is in column 3 of the glyph.
+	for row := 1; row < 1+glyphHeight; row++ {
+		if c := f.Y[row*f.Width+3]; c != 235 {
+			t.Errorf("row %d: luma %d, want 235", row, c)
+		}
+	}
+	if c := f.Y[1*f.Width+1]; c != 16 {
+		t.Errorf("background luma %d, want 16", c)
+	}
+}
+
+func TestFromI420(t *testing.T) {
+	if _, err := FromI420(make([]byte, 10), 4, 4); err == nil {
+		t.Error("accepted a short buffer")
+	}
+	if _, err := FromI420(make([]byte, 24), 3, 4); err == nil {
+		t.Error("accepted an odd width")
+	}
+}
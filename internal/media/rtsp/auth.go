@@ -0,0 +1,133 @@
+// +build rtsp !production
+
+package rtsp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Credentials answering a server's challenge, as most IP cameras require.
+// See https://tools.ietf.org/html/rfc2326#appendix-D.2.1 and RFC 2617.
+type authenticator struct {
+	username string
+	password string
+
+	// Parameters of the server's challenge, e.g. "realm" and "nonce".
+	scheme string
+	params map[string]string
+
+	// Number of requests made with the current nonce.
+	nc int
+}
+
+// Parse a WWW-Authenticate header, e.g.
+// `Digest realm="camera", nonce="3a1f"`. Only Basic and Digest are supported.
+func parseChallenge(header string) (scheme string, params map[string]string, err error) {
+	scheme, rest := split2(strings.TrimSpace(header), ' ')
+	params = make(map[string]string)
+	for rest != "" {
+		var param string
+		param, rest = nextParam(rest)
+		name, value := split2(param, '=')
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			params[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return "Basic", params, nil
+	case "digest":
+		if params["nonce"] == "" {
+			return "", nil, fmt.Errorf("RTSP digest challenge without nonce: %s", header)
+		}
+		if alg := params["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+			return "", nil, fmt.Errorf("unsupported RTSP digest algorithm: %s", alg)
+		}
+		return "Digest", params, nil
+	}
+	return "", nil, fmt.Errorf("unsupported RTSP authentication: %s", header)
+}
+
+// Split the first comma-separated parameter from s, respecting quotes.
+func nextParam(s string) (param, rest string) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+			}
+		}
+	}
+	return strings.TrimSpace(s), ""
+}
+
+// Take up a challenge from the server.
+func (a *authenticator) challenge(header string) error {
+	scheme, params, err := parseChallenge(header)
+	if err != nil {
+		return err
+	}
+	a.scheme, a.params, a.nc = scheme, params, 0
+	return nil
+}
+
+// Return the Authorization header for a request, or "" if not challenged yet.
+func (a *authenticator) authorization(method, uri string) string {
+	switch a.scheme {
+	case "Basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password))
+	case "Digest":
+		realm, nonce := a.params["realm"], a.params["nonce"]
+		ha1 := md5Hex(a.username + ":" + realm + ":" + a.password)
+		ha2 := md5Hex(method + ":" + uri)
+		header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+			a.username, realm, nonce, uri)
+		if qopOffered(a.params["qop"], "auth") {
+			a.nc++
+			nc := fmt.Sprintf("%08x", a.nc)
+			cnonce := newCNonce()
+			response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+			header += fmt.Sprintf(`, response="%s", qop=auth, nc=%s, cnonce="%s"`, response, nc, cnonce)
+		} else {
+			header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+		}
+		if opaque, ok := a.params["opaque"]; ok {
+			header += fmt.Sprintf(`, opaque="%s"`, opaque)
+		}
+		if algorithm, ok := a.params["algorithm"]; ok {
+			header += ", algorithm=" + algorithm
+		}
+		return header
+	}
+	return ""
+}
+
+func qopOffered(qop, want string) bool {
+	for _, q := range strings.Split(qop, ",") {
+		if strings.TrimSpace(q) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// Return a client nonce. Replaced in tests.
+var newCNonce = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,82 @@
+package rtsp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDigestAuthorization(t *testing.T) {
+	// Example from RFC 2617 Section 3.5.
+	defer func(f func() string) { newCNonce = f }(newCNonce)
+	newCNonce = func() string { return "0a4f113b" }
+
+	a := &authenticator{username: "Mufasa", password: "Circle Of Life"}
+	err := a.challenge(`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := a.authorization("GET", "/dir/index.html")
+	for _, want := range []string{
+		`username="Mufasa"`,
+		`nc=00000001`,
+		`response="6629fae49393a05397450978507c4ef1"`,
+		`opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("authorization %q lacks %s", got, want)
+		}
+	}
+
+	if err := a.challenge(`Basic realm="camera"`); err != nil {
+		t.Fatal(err)
+	}
+	if got := a.authorization("DESCRIBE", "rtsp://camera/"); got != "Basic TXVmYXNhOkNpcmNsZSBPZiBMaWZl" {
+		t.Errorf("basic authorization = %q", got)
+	}
+
+	for _, header := range []string{`NTLM`, `Digest realm="x"`, `Digest nonce="1", algorithm=SHA-256`} {
+		if err := a.challenge(header); err == nil {
+			t.Errorf("expected challenge %q to be rejected", header)
+		}
+	}
+}
+
+func TestClientAuthentication(t *testing.T) {
+	conn, serverConn := net.Pipe()
+	defer conn.Close()
+	cli := &Client{conn: conn}
+	cli.SetCredentials("admin", "secret")
+
+	authorized := make(chan string, 2)
+	go func() {
+		defer serverConn.Close()
+		br := bufio.NewReader(serverConn)
+		for _, status := range []string{
+			"401 Unauthorized\r\nWWW-Authenticate: Digest realm=\"camera\", nonce=\"abc\"",
+			"200 OK\r\nPublic: OPTIONS, DESCRIBE",
+		} {
+			req, err := readRequest(br)
+			if err != nil {
+				return
+			}
+			authorized <- req.Headers["Authorization"]
+			serverConn.Write([]byte("RTSP/1.0 " + status + "\r\nCSeq: " + req.Headers["CSeq"] + "\r\n\r\n"))
+		}
+	}()
+
+	options, err := cli.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options) != 2 {
+		t.Errorf("options = %q", options)
+	}
+	if auth := <-authorized; auth != "" {
+		t.Errorf("first request authorized before a challenge: %s", auth)
+	}
+	if auth := <-authorized; !strings.HasPrefix(auth, `Digest username="admin", realm="camera", nonce="abc", uri="*"`) {
+		t.Errorf("authorization = %q", auth)
+	}
+}
@@ -25,6 +25,9 @@ type Client struct {
 	// Monotonically increasing request sequence number.
 	cseq int
 
+	// Credentials, used once the server asks for them.
+	auth *authenticator
+
 	sync.Mutex
 }
 
@@ -46,6 +49,14 @@ func DialContext(ctx context.Context, address string) (*Client, error) {
 	return cli, nil
 }
 
+// SetCredentials sets the user name and password with which to answer the
+// server's authentication challenge, if any.
+func (cli *Client) SetCredentials(username, password string) {
+	cli.Lock()
+	defer cli.Unlock()
+	cli.auth = &authenticator{username: username, password: password}
+}
+
 type HeaderMap map[string]string
 
 type Response struct {
@@ -66,11 +77,32 @@ func (f *RequestFailure) Error() string {
 	return fmt.Sprintf("RTSP request failure: %s %s => %d %s", f.method, f.uri, f.status, f.reason)
 }
 
-// Sends a request to the RTSP server, and parses the response.
+// Sends a request to the RTSP server, and parses the response. If the server
+// asks for credentials, the request is repeated with them.
 func (cli *Client) Request(method, uri string, headers HeaderMap) (*Response, error) {
 	cli.Lock()
 	defer cli.Unlock()
 
+	resp, err := cli.roundTrip(method, uri, headers)
+	if err == nil && resp.Status == 401 && cli.auth != nil {
+		if err := cli.auth.challenge(resp.Headers["WWW-Authenticate"]); err != nil {
+			return nil, err
+		}
+		resp, err = cli.roundTrip(method, uri, headers)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO: Automatically handle redirects.
+	if resp.Status >= 400 {
+		return nil, &RequestFailure{method, uri, resp.Status, resp.Reason}
+	}
+
+	return resp, nil
+}
+
+func (cli *Client) roundTrip(method, uri string, headers HeaderMap) (*Response, error) {
 	cli.cseq++
 
 	buf := &bytes.Buffer{}
@@ -85,6 +117,11 @@ func (cli *Client) Request(method, uri string, headers HeaderMap) (*Response, er
 	for name, value := range headers {
 		fmt.Fprintf(buf, "%s: %s\r\n", name, value)
 	}
+	if cli.auth != nil {
+		if auth := cli.auth.authorization(method, uri); auth != "" {
+			fmt.Fprintf(buf, "Authorization: %s\r\n", auth)
+		}
+	}
 
 	// Terminating CLRF.
 	buf.WriteString("\r\n")
@@ -141,12 +178,7 @@ func (cli *Client) Request(method, uri string, headers HeaderMap) (*Response, er
 		}
 	}
 
-	// TODO: Automatically handle redirects.
-	if resp.Status >= 400 {
-		return nil, &RequestFailure{method, uri, resp.Status, resp.Reason}
-	}
-
-	return resp, err
+	return resp, nil
 }
 
 // Send an OPTIONS request, and parse the response from the Public header..
@@ -203,17 +235,18 @@ func (cli *Client) Setup(uri string) (*Transport, string, error) {
 	return tr, session, nil
 }
 
+// Send a PLAY request, and return where each track's RTP stream begins, as
+// far as the server says.
 // See https://tools.ietf.org/html/rfc2326#section-10.5
-func (cli *Client) Play(uri, session string) (rtpInfo string, err error) {
+func (cli *Client) Play(uri, session string) ([]RTPInfo, error) {
 	resp, err := cli.Request("PLAY", uri, HeaderMap{
 		"Session": session,
 	})
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	rtpInfo = resp.Headers["RTP-Info"]
-	return
+	return ParseRTPInfo(resp.Headers["RTP-Info"]), nil
 }
 
 // Send a PAUSE request.
@@ -0,0 +1,68 @@
+package rtsp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+func TestOpenRequestsKeyframes(t *testing.T) {
+	srv := NewServer()
+	src := newTestVideoSource()
+	srv.Handle("live", src)
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	video, err := Open("rtsp://" + l.Addr().String() + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := video.AddReceiver(16)
+	defer video.(*videoSource).Flow.RemoveReceiver(r)
+	select {
+	case buf := <-r.Buffers():
+		buf.Release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("no video received")
+	}
+	go func() {
+		for buf := range r.Buffers() {
+			buf.Release()
+		}
+	}()
+
+	// A viewer's request reaches the camera as a PLI.
+	before := atomic.LoadInt32(&src.keyframes)
+	if err := video.(media.KeyframeRequester).RequestKeyframe(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&src.keyframes) == before {
+		if time.Now().After(deadline) {
+			t.Fatal("keyframe request not relayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResolveControl(t *testing.T) {
+	for _, tt := range []struct {
+		base, control, expect string
+	}{
+		{"rtsp://cam/live", "trackID=1", "rtsp://cam/live/trackID=1"},
+		{"rtsp://cam/live/", "trackID=1", "rtsp://cam/live/trackID=1"},
+		{"rtsp://cam/live", "rtsp://cam/live/video", "rtsp://cam/live/video"},
+		{"rtsp://cam/live", "*", "rtsp://cam/live"},
+	} {
+		if got := resolveControl(tt.base, tt.control); got != tt.expect {
+			t.Errorf("resolveControl(%q, %q) = %q, want %q", tt.base, tt.control, got, tt.expect)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// +build rtsp !production
+
+package rtsp
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/rtp"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// Payload type of republished video.
+const payloadType = 96
+
+// Profile and level to describe when the SPS isn't known yet: Constrained
+// Baseline, level 3.1, as browsers send by default.
+const defaultProfileLevelID = 0x42e01f
+
+// Interval at which to ask for keyframes when sending plain RTP, which gives
+// receivers no way to ask for one when they join or lose packets.
+const keyframeInterval = 10 * time.Second
+
+// A session sending a video source to an RTSP client.
+type serverSession struct {
+	id     string
+	src    media.VideoSource
+	rtp    *rtp.Session
+	stream *rtp.Stream
+
+	// Closed to stop sending, and closed once the sender returns.
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newServerSession(id string, src media.VideoSource, tr *Transport) (*serverSession, error) {
+	session, err := rtp.NewSession(rtp.SessionOptions{
+		DataConn:    tr.RTP,
+		ControlConn: tr.RTCP,
+	})
+	if err != nil {
+		return nil, err
+	}
+	stream := session.AddStream(rtp.StreamOptions{
+		LocalSSRC:  rand.Uint32(),
+		LocalCNAME: "alohartc",
+		Direction:  "sendonly",
+	})
+	return &serverSession{
+		id:     id,
+		src:    src,
+		rtp:    session,
+		stream: stream,
+		quit:   make(chan struct{}),
+	}, nil
+}
+
+// Start sending, unless already playing.
+func (s *serverSession) play() {
+	if s.done != nil {
+		return
+	}
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := s.stream.SendVideo(s.quit, payloadType, s.src); err != nil {
+			log.Debug("RTSP session %s stopped: %v", s.id, err)
+		}
+	}()
+
+	// Don't leave the client waiting for the next keyframe to start decoding.
+	if kr, ok := s.src.(media.KeyframeRequester); ok {
+		kr.RequestKeyframe()
+	}
+}
+
+// Stop sending, and say goodbye.
+func (s *serverSession) close() {
+	close(s.quit)
+	if s.done != nil {
+		<-s.done
+	}
+	s.stream.Close()
+	s.rtp.Close()
+}
+
+// SendUDP sends video from src as plain RTP to addr, e.g. "239.0.0.1:5004"
+// or a host on the LAN, with RTCP to the next port up, until quit is closed or
+// src ends. Receivers can't ask for anything, so keyframes are requested at
+// intervals, when src supports it. Receivers need the session description
+// from DescribeUDP.
+func SendUDP(quit <-chan struct{}, addr string, src media.VideoSource) error {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	dataConn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return err
+	}
+	controlConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: raddr.IP, Port: raddr.Port + 1, Zone: raddr.Zone})
+	if err != nil {
+		dataConn.Close()
+		return err
+	}
+
+	session, err := rtp.NewSession(rtp.SessionOptions{
+		DataConn:    dataConn,
+		ControlConn: controlConn,
+	})
+	if err != nil {
+		dataConn.Close()
+		controlConn.Close()
+		return err
+	}
+	defer session.Close()
+	stream := session.AddStream(rtp.StreamOptions{
+		LocalSSRC:  rand.Uint32(),
+		LocalCNAME: "alohartc",
+		Direction:  "sendonly",
+	})
+	defer stream.Close()
+
+	if kr, ok := src.(media.KeyframeRequester); ok {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			ticker := time.NewTicker(keyframeInterval)
+			defer ticker.Stop()
+			for {
+				kr.RequestKeyframe()
+				select {
+				case <-quit:
+					return
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+
+	return stream.SendVideo(quit, payloadType, src)
+}
+
+// DescribeUDP returns the session description of video sent by SendUDP to
+// addr, e.g. for saving to a .sdp file that VLC or ffmpeg can open.
+func DescribeUDP(addr string, src media.VideoSource) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	desc := describe(src, host)
+	desc.Connection = &sdp.Connection{NetworkType: "IN", AddressType: addressType(host), Address: host}
+	desc.Media[0].Port, _ = strconv.Atoi(port)
+	return desc.String(), nil
+}
+
+// Return the session description of video from src, sent from host.
+func describe(src media.VideoSource, host string) sdp.Session {
+	fmtp := sdp.H264FormatParameters{
+		PacketizationMode: 1,
+		ProfileLevelID:    defaultProfileLevelID,
+	}
+	if p, ok := src.(media.ParameterSetProvider); ok {
+		fmtp.SpropParameterSets = p.ParameterSets()
+		for _, ps := range fmtp.SpropParameterSets {
+			// The profile-level-id is the 3 bytes following the SPS
+			// NALU header.
+			if len(ps) >= 4 && ps[0]&0x1f == 7 {
+				fmtp.ProfileLevelID = int(ps[1])<<16 | int(ps[2])<<8 | int(ps[3])
+			}
+		}
+	}
+
+	pt := strconv.Itoa(payloadType)
+	return sdp.Session{
+		Version: 0,
+		Origin: sdp.Origin{
+			Username:       "-",
+			SessionId:      strconv.FormatInt(time.Now().Unix(), 10),
+			SessionVersion: 1,
+			NetworkType:    "IN",
+			AddressType:    addressType(host),
+			Address:        host,
+		},
+		Name:       "alohartc",
+		Time:       []sdp.Time{{}},
+		Attributes: []sdp.Attribute{{Key: "control", Value: "*"}},
+		Media: []sdp.Media{{
+			Type:   "video",
+			Proto:  "RTP/AVP",
+			Format: []string{pt},
+			Attributes: []sdp.Attribute{
+				{Key: "rtpmap", Value: pt + " H264/90000"},
+				{Key: "fmtp", Value: pt + " " + fmtp.Marshal()},
+				{Key: "control", Value: trackControl},
+			},
+		}},
+	}
+}
+
+func addressType(host string) string {
+	if strings.Contains(host, ":") {
+		return "IP6"
+	}
+	return "IP4"
+}
@@ -0,0 +1,95 @@
+// +build rtsp !production
+
+package rtsp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/lanikai/alohartc/internal/rtp"
+)
+
+// RTPInfo describes where the RTP stream of one track begins after a PLAY
+// request.
+// See https://tools.ietf.org/html/rfc2326#section-12.33
+type RTPInfo struct {
+	// Control URL of the track, as given by the server.
+	URL string
+
+	// Where the track's RTP packets begin, from the seq and rtptime
+	// parameters, either of which may be missing.
+	Start rtp.ReceiveStart
+}
+
+// ParseRTPInfo parses an RTP-Info header, skipping malformed parameters.
+func ParseRTPInfo(header string) []RTPInfo {
+	var infos []RTPInfo
+	for _, stream := range splitStreams(header) {
+		var info RTPInfo
+		for _, param := range strings.Split(stream, ";") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch strings.ToLower(kv[0]) {
+			case "url":
+				info.URL = strings.Trim(kv[1], `"`)
+			case "seq":
+				if n, err := strconv.ParseUint(kv[1], 10, 16); err == nil {
+					info.Start.Sequence = uint16(n)
+					info.Start.HasSequence = true
+				}
+			case "rtptime":
+				if n, err := strconv.ParseUint(kv[1], 10, 32); err == nil {
+					info.Start.Timestamp = uint32(n)
+					info.Start.HasTimestamp = true
+				}
+			}
+		}
+		if info.URL != "" {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+// Split an RTP-Info header into the descriptions of each stream, at the
+// commas followed by a url parameter.
+func splitStreams(header string) []string {
+	var streams []string
+	start := 0
+	for i := 0; i < len(header); i++ {
+		if header[i] != ',' {
+			continue
+		}
+		rest := strings.ToLower(strings.TrimLeft(header[i+1:], " "))
+		if strings.HasPrefix(rest, "url=") {
+			streams = append(streams, header[start:i])
+			start = i + 1
+		}
+	}
+	if strings.TrimSpace(header[start:]) != "" {
+		streams = append(streams, header[start:])
+	}
+	return streams
+}
+
+// Return the entry of an RTP-Info header for a track, given its control URL.
+// Servers may give the URL in full where the session description gave it
+// relative to the base URL, or the other way round.
+func findRTPInfo(infos []RTPInfo, url string) (RTPInfo, bool) {
+	for _, info := range infos {
+		if info.URL == url {
+			return info, true
+		}
+	}
+	for _, info := range infos {
+		if strings.HasSuffix(info.URL, "/"+url) || strings.HasSuffix(url, "/"+info.URL) {
+			return info, true
+		}
+	}
+	if len(infos) == 1 {
+		return infos[0], true
+	}
+	return RTPInfo{}, false
+}
@@ -0,0 +1,44 @@
+package rtsp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/rtp"
+)
+
+func TestParseRTPInfo(t *testing.T) {
+	infos := ParseRTPInfo("url=rtsp://cam/live/trackID=1;seq=45102;rtptime=12345678, " +
+		"url=rtsp://cam/live/trackID=2;rtptime=4000000000,url=trackID=3;seq=bogus")
+	assert.Equal(t, []RTPInfo{
+		{URL: "rtsp://cam/live/trackID=1", Start: rtp.ReceiveStart{
+			Sequence: 45102, HasSequence: true, Timestamp: 12345678, HasTimestamp: true}},
+		{URL: "rtsp://cam/live/trackID=2", Start: rtp.ReceiveStart{
+			Timestamp: 4000000000, HasTimestamp: true}},
+		{URL: "trackID=3"},
+	}, infos)
+	assert.Empty(t, ParseRTPInfo(""))
+}
+
+func TestFindRTPInfo(t *testing.T) {
+	infos := []RTPInfo{{URL: "rtsp://cam/live/trackID=1"}, {URL: "trackID=2"}}
+	for _, tt := range []struct {
+		url    string
+		expect string
+	}{
+		{"rtsp://cam/live/trackID=1", "rtsp://cam/live/trackID=1"},
+		{"trackID=1", "rtsp://cam/live/trackID=1"},
+		{"rtsp://cam/live/trackID=2", "trackID=2"},
+		{"trackID=3", ""},
+	} {
+		info, ok := findRTPInfo(infos, tt.url)
+		assert.Equal(t, tt.expect != "", ok, tt.url)
+		assert.Equal(t, tt.expect, info.URL, tt.url)
+	}
+
+	// A lone entry applies whatever its URL.
+	info, ok := findRTPInfo(infos[:1], "stream")
+	assert.True(t, ok)
+	assert.Equal(t, infos[0], info)
+}
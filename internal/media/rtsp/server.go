@@ -0,0 +1,475 @@
+// +build rtsp !production
+
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+// Path suffix of the single track of each stream, as given in its control
+// attribute.
+const trackControl = "trackID=0"
+
+// Seconds after which a client that sends nothing may be dropped, as
+// advertised in the Session header. Sessions actually end when the client's
+// RTSP connection closes.
+const sessionTimeout = 60
+
+var errServerClosed = errors.New("rtsp: server closed")
+
+// Server is an RTSP 1.0 server republishing video sources on the LAN, e.g. to
+// NVR software that doesn't speak WebRTC. Each source is served at a path,
+// e.g. rtsp://device:8554/live, as H.264 over RTP/UDP. Interleaved (TCP)
+// transport is not supported.
+type Server struct {
+	mu        sync.Mutex
+	sources   map[string]media.VideoSource
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	closed    bool
+}
+
+func NewServer() *Server {
+	return &Server{
+		sources:   make(map[string]media.VideoSource),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*serverConn]struct{}),
+	}
+}
+
+// Handle serves src at path, e.g. "/live", replacing any source already
+// there. Clients already playing the old source carry on with it.
+func (srv *Server) Handle(path string, src media.VideoSource) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.sources[cleanPath(path)] = src
+}
+
+// Remove stops serving src at path, unless it has since been replaced.
+func (srv *Server) Remove(path string, src media.VideoSource) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	path = cleanPath(path)
+	if srv.sources[path] == src {
+		delete(srv.sources, path)
+	}
+}
+
+func (srv *Server) lookup(path string) media.VideoSource {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.sources[cleanPath(path)]
+}
+
+// ListenAndServe listens on the TCP address addr, e.g. ":8554", and serves
+// RTSP clients until Close.
+func (srv *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Serve accepts RTSP clients on l until Close, and closes l.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		l.Close()
+		return errServerClosed
+	}
+	srv.listeners[l] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closed := srv.closed
+			srv.mu.Unlock()
+			if closed {
+				return errServerClosed
+			}
+			return err
+		}
+
+		c := &serverConn{
+			srv:      srv,
+			conn:     conn,
+			sessions: make(map[string]*serverSession),
+		}
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			conn.Close()
+			return errServerClosed
+		}
+		srv.conns[c] = struct{}{}
+		srv.mu.Unlock()
+		go c.serve()
+	}
+}
+
+// Close stops listening, and ends all sessions.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	srv.closed = true
+	listeners := srv.listeners
+	conns := srv.conns
+	srv.listeners = make(map[net.Listener]struct{})
+	srv.conns = make(map[*serverConn]struct{})
+	srv.mu.Unlock()
+
+	for l := range listeners {
+		l.Close()
+	}
+	for c := range conns {
+		c.conn.Close()
+	}
+	return nil
+}
+
+// An RTSP request from a client.
+type request struct {
+	Method  string
+	URI     string
+	Headers HeaderMap
+	Content []byte
+}
+
+// Read an RTSP request. See https://tools.ietf.org/html/rfc2326#section-6
+func readRequest(br *bufio.Reader) (*request, error) {
+	req := &request{Headers: make(HeaderMap)}
+	contentLength := 0
+	for {
+		lineBytes, _, err := br.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line := string(lineBytes)
+
+		if req.Method == "" {
+			if line == "" {
+				// Tolerate blank lines between requests.
+				continue
+			}
+			// Parse request line, e.g. "DESCRIBE rtsp://host/live RTSP/1.0".
+			fields := strings.Fields(line)
+			if len(fields) != 3 || !strings.HasPrefix(fields[2], "RTSP/") {
+				return nil, fmt.Errorf("invalid RTSP request line: %q", line)
+			}
+			req.Method, req.URI = fields[0], fields[1]
+		} else if line == "" {
+			// Empty line indicates end of request headers.
+			break
+		} else {
+			name, value := split2(line, ':')
+			if value == "" && !strings.HasSuffix(line, ":") {
+				return nil, fmt.Errorf("invalid RTSP header: %q", line)
+			}
+			// Header names are case-insensitive.
+			name = canonicalHeader(strings.TrimSpace(name))
+			value = strings.TrimSpace(value)
+			req.Headers[name] = value
+			if name == "Content-Length" {
+				contentLength, _ = strconv.Atoi(value)
+			}
+		}
+	}
+
+	if contentLength > 0 {
+		req.Content = make([]byte, contentLength)
+		if _, err := io.ReadFull(br, req.Content); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// Return a header name with the usual capitalization, e.g. "CSeq" for "cseq".
+func canonicalHeader(name string) string {
+	switch strings.ToLower(name) {
+	case "cseq":
+		return "CSeq"
+	case "rtp-info":
+		return "RTP-Info"
+	case "www-authenticate":
+		return "WWW-Authenticate"
+	}
+	parts := strings.Split(strings.ToLower(name), "-")
+	for i, p := range parts {
+		if p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// An RTSP connection from a client, which may set up sessions.
+type serverConn struct {
+	srv  *Server
+	conn net.Conn
+
+	sessions map[string]*serverSession
+}
+
+func (c *serverConn) serve() {
+	defer func() {
+		for _, s := range c.sessions {
+			s.close()
+		}
+		c.conn.Close()
+		c.srv.mu.Lock()
+		delete(c.srv.conns, c)
+		c.srv.mu.Unlock()
+	}()
+
+	br := bufio.NewReader(c.conn)
+	for {
+		req, err := readRequest(br)
+		if err != nil {
+			if err != io.EOF {
+				log.Debug("RTSP client %s: %v", c.conn.RemoteAddr(), err)
+			}
+			return
+		}
+		log.Debug("RTSP client %s: %s %s", c.conn.RemoteAddr(), req.Method, req.URI)
+
+		status, headers, content := c.handle(req)
+		if err := c.respond(req, status, headers, content); err != nil {
+			return
+		}
+	}
+}
+
+// Handle a request, and return the response.
+func (c *serverConn) handle(req *request) (status int, headers HeaderMap, content []byte) {
+	headers = make(HeaderMap)
+	switch req.Method {
+	case "OPTIONS":
+		headers["Public"] = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+		return 200, headers, nil
+
+	case "DESCRIBE":
+		path, ok := requestPath(req.URI)
+		if !ok {
+			return 400, headers, nil
+		}
+		src := c.srv.lookup(path)
+		if src == nil {
+			return 404, headers, nil
+		}
+		host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+		desc := describe(src, host)
+		headers["Content-Base"] = strings.TrimSuffix(req.URI, "/") + "/"
+		headers["Content-Type"] = "application/sdp"
+		return 200, headers, []byte(desc.String())
+
+	case "SETUP":
+		return c.setup(req, headers)
+
+	case "PLAY":
+		s := c.sessions[sessionID(req)]
+		if s == nil {
+			return 454, headers, nil
+		}
+		s.play()
+		headers["Session"] = s.id
+		headers["Range"] = "npt=0.000-"
+		return 200, headers, nil
+
+	case "TEARDOWN":
+		id := sessionID(req)
+		s := c.sessions[id]
+		if s == nil {
+			return 454, headers, nil
+		}
+		s.close()
+		delete(c.sessions, id)
+		return 200, headers, nil
+
+	case "GET_PARAMETER", "SET_PARAMETER":
+		// Used by clients as keepalives.
+		if id := sessionID(req); id != "" {
+			if c.sessions[id] == nil {
+				return 454, headers, nil
+			}
+			headers["Session"] = id
+		}
+		return 200, headers, nil
+	}
+	return 501, headers, nil
+}
+
+// Set up a session sending the requested stream to the client's UDP ports.
+// See https://tools.ietf.org/html/rfc2326#section-10.4
+func (c *serverConn) setup(req *request, headers HeaderMap) (int, HeaderMap, []byte) {
+	path, ok := requestPath(req.URI)
+	if !ok {
+		return 400, headers, nil
+	}
+	path = strings.TrimSuffix(strings.TrimSuffix(path, trackControl), "/")
+	src := c.srv.lookup(path)
+	if src == nil {
+		return 404, headers, nil
+	}
+	if sessionID(req) != "" {
+		// Aggregate control of several tracks is moot with just one.
+		return 459, headers, nil
+	}
+
+	rtpPort, rtcpPort, err := parseClientTransport(req.Headers["Transport"])
+	if err != nil {
+		log.Debug("RTSP client %s: %v", c.conn.RemoteAddr(), err)
+		return 461, headers, nil
+	}
+	clientIP := c.conn.RemoteAddr().(*net.TCPAddr).IP
+	tr, err := dialTransport(clientIP, rtpPort, rtcpPort)
+	if err != nil {
+		log.Warn("RTSP client %s: %v", c.conn.RemoteAddr(), err)
+		return 500, headers, nil
+	}
+
+	s, err := newServerSession(newSessionID(), src, tr)
+	if err != nil {
+		tr.Close()
+		log.Warn("RTSP client %s: %v", c.conn.RemoteAddr(), err)
+		return 500, headers, nil
+	}
+	c.sessions[s.id] = s
+	headers["Transport"] = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=%08X",
+		rtpPort, rtcpPort, getPort(tr.RTP.LocalAddr()), getPort(tr.RTCP.LocalAddr()), s.stream.LocalSSRC)
+	headers["Session"] = fmt.Sprintf("%s;timeout=%d", s.id, sessionTimeout)
+	return 200, headers, nil
+}
+
+func (c *serverConn) respond(req *request, status int, headers HeaderMap, content []byte) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "RTSP/1.0 %d %s\r\n", status, statusText(status))
+	fmt.Fprintf(buf, "CSeq: %s\r\n", req.Headers["CSeq"])
+	for name, value := range headers {
+		fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+	}
+	if len(content) > 0 {
+		fmt.Fprintf(buf, "Content-Length: %d\r\n", len(content))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(content)
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+// Return the path of a request URI, e.g. "/live" for "rtsp://host/live".
+func requestPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "rtsp" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+func cleanPath(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
+
+func sessionID(req *request) string {
+	// Strip parameters, e.g. ";timeout=60".
+	id, _ := split2(req.Headers["Session"], ';')
+	return strings.TrimSpace(id)
+}
+
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Parse the client ports of a Transport request header, e.g.
+// "RTP/AVP;unicast;client_port=5000-5001".
+func parseClientTransport(header string) (rtpPort, rtcpPort int, err error) {
+	// A client may list alternatives; use the first one we support.
+	for _, spec := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+		if params[0] != "RTP/AVP" && params[0] != "RTP/AVP/UDP" {
+			continue
+		}
+		unicast := false
+		rtpPort, rtcpPort = 0, 0
+		for _, p := range params[1:] {
+			name, value := split2(p, '=')
+			switch name {
+			case "unicast":
+				unicast = true
+			case "client_port":
+				first, second := split2(value, '-')
+				rtpPort, _ = strconv.Atoi(first)
+				if rtcpPort, _ = strconv.Atoi(second); second == "" {
+					rtcpPort = rtpPort + 1
+				}
+			}
+		}
+		if unicast && rtpPort > 0 && rtcpPort > 0 {
+			return rtpPort, rtcpPort, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("unsupported transport: %s", header)
+}
+
+// Bind local ports for RTP and RTCP, connected to the client's.
+func dialTransport(ip net.IP, rtpPort, rtcpPort int) (*Transport, error) {
+	tr, err := NewTransport()
+	if err != nil {
+		return nil, err
+	}
+	if tr.RTP, err = rebindUDP(tr.RTP, &net.UDPAddr{IP: ip, Port: rtpPort}); err != nil {
+		tr.Close()
+		return nil, err
+	}
+	if tr.RTCP, err = rebindUDP(tr.RTCP, &net.UDPAddr{IP: ip, Port: rtcpPort}); err != nil {
+		tr.Close()
+		return nil, err
+	}
+	return tr, nil
+}
+
+func statusText(status int) string {
+	switch status {
+	case 200:
+		return "OK"
+	case 400:
+		return "Bad Request"
+	case 404:
+		return "Not Found"
+	case 454:
+		return "Session Not Found"
+	case 459:
+		return "Aggregate Operation Not Allowed"
+	case 461:
+		return "Unsupported Transport"
+	case 500:
+		return "Internal Server Error"
+	case 501:
+		return "Not Implemented"
+	}
+	return "Unknown"
+}
@@ -0,0 +1,185 @@
+package rtsp
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/packet"
+	"github.com/lanikai/alohartc/internal/rtp"
+)
+
+// Parameter sets of a 1280x720 Constrained Baseline stream.
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0f, 0x23, 0x68, 0x22, 0x11, 0xa8}
+	testPPS = []byte{0x68, 0xce, 0x0f, 0xc8}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+)
+
+// A video source repeating a keyframe, counting requests for more.
+type testVideoSource struct {
+	media.Flow
+	quit      chan struct{}
+	keyframes int32
+}
+
+func newTestVideoSource() *testVideoSource {
+	src := &testVideoSource{}
+	src.Flow.Start = func() {
+		src.quit = make(chan struct{})
+		go func(quit chan struct{}) {
+			for {
+				for _, nalu := range [][]byte{testSPS, testPPS, testIDR} {
+					src.Put(packet.NewSharedBuffer(nalu, 1, nil))
+				}
+				select {
+				case <-quit:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+		}(src.quit)
+	}
+	src.Flow.Stop = func() {
+		close(src.quit)
+	}
+	return src
+}
+
+func (src *testVideoSource) Codec() string { return "H264" }
+func (src *testVideoSource) Width() int    { return 1280 }
+func (src *testVideoSource) Height() int   { return 720 }
+
+func (src *testVideoSource) ParameterSets() [][]byte {
+	return [][]byte{testSPS, testPPS}
+}
+
+func (src *testVideoSource) RequestKeyframe() error {
+	atomic.AddInt32(&src.keyframes, 1)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	srv := NewServer()
+	src := newTestVideoSource()
+	srv.Handle("live", src)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	cli, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "rtsp://" + l.Addr().String()
+
+	if _, err := cli.Describe(base + "/missing"); err == nil {
+		t.Error("expected DESCRIBE of an unknown path to fail")
+	}
+	desc, err := cli.Describe(base + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := desc.Media[0]
+	if got := m.GetAttr("rtpmap"); got != "96 H264/90000" {
+		t.Errorf("rtpmap = %q", got)
+	}
+	uri, parameterSets, sps, err := extractVideoMetadata(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri != trackControl || len(parameterSets) != 2 || sps.Width != 1280 {
+		t.Errorf("described %q, %d parameter sets, SPS %+v", uri, len(parameterSets), sps)
+	}
+
+	tr, session, err := cli.Setup(base + "/live/" + trackControl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.SSRC == 0 || getPort(tr.RTP.RemoteAddr()) == 0 {
+		t.Fatalf("unexpected transport: %s", tr.Header())
+	}
+	if _, err := cli.Play(base+"/live", session); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&src.keyframes); n != 1 {
+		t.Errorf("requested %d keyframes on PLAY, want 1", n)
+	}
+
+	rtpSession, err := rtp.NewSession(rtp.SessionOptions{
+		DataConn:    tr.RTP,
+		ControlConn: tr.RTCP,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := rtpSession.AddStream(rtp.StreamOptions{
+		RemoteSSRC: tr.SSRC,
+		Direction:  "recvonly",
+	})
+	quit := make(chan struct{})
+	received := make(chan struct{})
+	go stream.ReceiveVideo(quit, func(buf *packet.SharedBuffer) error {
+		if bytes.Equal(buf.Bytes(), testIDR) {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+		buf.Release()
+		return nil
+	})
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no video received")
+	}
+	close(quit)
+
+	if err := cli.Teardown(base+"/live", session); err != nil {
+		t.Error(err)
+	}
+	if _, err := cli.GetParameter(base+"/live", session); err == nil {
+		t.Error("expected the session to be gone after TEARDOWN")
+	}
+	rtpSession.Close()
+
+	srv.Close()
+	if err := <-served; err != errServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestParseClientTransport(t *testing.T) {
+	for _, tt := range []struct {
+		header        string
+		rtp, rtcp     int
+		expectFailure bool
+	}{
+		{header: "RTP/AVP;unicast;client_port=5000-5001", rtp: 5000, rtcp: 5001},
+		{header: "RTP/AVP/UDP;unicast;client_port=6000", rtp: 6000, rtcp: 6001},
+		{header: "RTP/AVP/TCP;unicast;interleaved=0-1,RTP/AVP;unicast;client_port=7000-7001", rtp: 7000, rtcp: 7001},
+		{header: "RTP/AVP/TCP;unicast;interleaved=0-1", expectFailure: true},
+		{header: "RTP/AVP;multicast", expectFailure: true},
+	} {
+		rtpPort, rtcpPort, err := parseClientTransport(tt.header)
+		if tt.expectFailure {
+			if err == nil {
+				t.Errorf("%s: expected failure", tt.header)
+			}
+			continue
+		}
+		if err != nil || rtpPort != tt.rtp || rtcpPort != tt.rtcp {
+			t.Errorf("%s: got %d-%d, %v", tt.header, rtpPort, rtcpPort, err)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// +build production,!rtsp
+
+package rtsp
+
+import (
+	"errors"
+	"net"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+var errDisabled = errors.New("RTSP support disabled")
+
+type Server struct{}
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func (srv *Server) Handle(path string, src media.VideoSource) {}
+
+func (srv *Server) Remove(path string, src media.VideoSource) {}
+
+func (srv *Server) ListenAndServe(addr string) error {
+	return errDisabled
+}
+
+func (srv *Server) Serve(l net.Listener) error {
+	l.Close()
+	return errDisabled
+}
+
+func (srv *Server) Close() error {
+	return nil
+}
+
+func SendUDP(quit <-chan struct{}, addr string, src media.VideoSource) error {
+	return errDisabled
+}
+
+func DescribeUDP(addr string, src media.VideoSource) (string, error) {
+	return "", errDisabled
+}
@@ -74,7 +74,8 @@ func (tr *Transport) parseServerResponse(transportHeader string, serverIP net.IP
 		}
 	}
 
-	if spec != "RTP/AVP/UDP" {
+	// RTP/AVP means the same as RTP/AVP/UDP.
+	if spec != "RTP/AVP/UDP" && spec != "RTP/AVP" {
 		return fmt.Errorf("unsupported transport spec: %s", spec)
 	}
 	if _, ok := params["unicast"]; !ok {
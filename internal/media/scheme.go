@@ -0,0 +1,81 @@
+package media
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A SourceFactory opens the video source identified by uri. The URI scheme is
+// guaranteed to match the scheme under which the factory was registered.
+type SourceFactory func(uri string) (VideoSource, error)
+
+var (
+	schemes     = make(map[string]SourceFactory)
+	schemesLock sync.RWMutex
+)
+
+// RegisterScheme makes a video source available under the given URI scheme,
+// e.g. "rtsp". Packages implementing a source typically call this from an
+// init() function. Scheme names are case-insensitive. It panics if the scheme
+// is empty, if factory is nil, or if the scheme is already registered.
+func RegisterScheme(scheme string, factory SourceFactory) {
+	schemesLock.Lock()
+	defer schemesLock.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	if scheme == "" {
+		panic("media: RegisterScheme with empty scheme")
+	}
+	if factory == nil {
+		panic("media: RegisterScheme with nil factory for " + scheme)
+	}
+	if _, dup := schemes[scheme]; dup {
+		panic("media: RegisterScheme called twice for " + scheme)
+	}
+	schemes[scheme] = factory
+}
+
+// Schemes returns a sorted list of the registered URI schemes.
+func Schemes() []string {
+	schemesLock.RLock()
+	defer schemesLock.RUnlock()
+
+	var list []string
+	for scheme := range schemes {
+		list = append(list, scheme)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// lookupScheme returns the factory registered for the scheme of uri, if any.
+func lookupScheme(uri string) (SourceFactory, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" {
+		return nil, false
+	}
+
+	schemesLock.RLock()
+	defer schemesLock.RUnlock()
+
+	factory, ok := schemes[strings.ToLower(u.Scheme)]
+	return factory, ok
+}
+
+// CanOpen reports whether uri has a registered scheme.
+func CanOpen(uri string) bool {
+	_, ok := lookupScheme(uri)
+	return ok
+}
+
+// Open a video source using the factory registered for the scheme of uri.
+func Open(uri string) (VideoSource, error) {
+	factory, ok := lookupScheme(uri)
+	if !ok {
+		return nil, fmt.Errorf("media: no source registered for %q", uri)
+	}
+	return factory(uri)
+}
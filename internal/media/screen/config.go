@@ -0,0 +1,26 @@
+package screen
+
+// Config describes how to capture and encode the screen.
+type Config struct {
+	// DRM device, e.g. /dev/dri/card0, or framebuffer device, e.g. /dev/fb0.
+	// By default, the first DRM device driving a display, or else /dev/fb0.
+	Device string
+
+	// Size of the encoded picture, or 0 for the screen's size. The screen is
+	// scaled to fit.
+	Width  int
+	Height int
+
+	// Capture frame rate, in frames per second. Defaults to 10.
+	FrameRate int
+
+	// Memory-to-memory H.264 encoder device, e.g. /dev/video11 on a
+	// Raspberry Pi. If empty, frames are encoded in software, losslessly
+	// coding only the parts of the screen that change, which suits mostly
+	// static content such as signage and dashboards.
+	Encoder string
+
+	// Bitrate of the M2M encoder, in bits per second. If zero, the driver
+	// default is used.
+	Bitrate int
+}
@@ -0,0 +1,120 @@
+// +build screen !production
+
+package screen
+
+import (
+	"github.com/lanikai/alohartc/internal/media/raw"
+)
+
+// A bitfield locates a color channel within a pixel, as in
+// struct fb_bitfield.
+type bitfield struct {
+	offset uint32
+	length uint32
+}
+
+// Return the channel of a pixel, scaled to 8 bits.
+func (b bitfield) value(pixel uint32) uint32 {
+	if b.length == 0 {
+		return 0
+	}
+	v := pixel >> b.offset & (1<<b.length - 1)
+	if b.length >= 8 {
+		return v >> (b.length - 8)
+	}
+	// Replicate the high bits into the low ones, so that full scale maps to
+	// 255.
+	return (v<<(8-b.length) | v>>(2*b.length-8)) & 0xff
+}
+
+// A pixelFormat describes packed RGB pixels, of 16, 24 or 32 bits.
+type pixelFormat struct {
+	bitsPerPixel     int
+	red, green, blue bitfield
+}
+
+// Packed RGB formats of DRM framebuffers, by fourcc code from drm_fourcc.h.
+// Pixels are little-endian.
+var drmPixelFormats = map[string]pixelFormat{
+	"RG16": {16, bitfield{11, 5}, bitfield{5, 6}, bitfield{0, 5}},
+	"RG24": {24, bitfield{16, 8}, bitfield{8, 8}, bitfield{0, 8}},
+	"BG24": {24, bitfield{0, 8}, bitfield{8, 8}, bitfield{16, 8}},
+	"XR24": {32, bitfield{16, 8}, bitfield{8, 8}, bitfield{0, 8}},
+	"AR24": {32, bitfield{16, 8}, bitfield{8, 8}, bitfield{0, 8}},
+	"XB24": {32, bitfield{0, 8}, bitfield{8, 8}, bitfield{16, 8}},
+	"AB24": {32, bitfield{0, 8}, bitfield{8, 8}, bitfield{16, 8}},
+}
+
+func drmPixelFormat(fourcc uint32) (pixelFormat, bool) {
+	pf, ok := drmPixelFormats[fourCCString(fourcc)]
+	return pf, ok
+}
+
+func fourCCString(fourcc uint32) string {
+	return string([]byte{byte(fourcc), byte(fourcc >> 8), byte(fourcc >> 16), byte(fourcc >> 24)})
+}
+
+// Return the fourcc code of a framebuffer described only by its bits per
+// pixel and color depth, as libdrm does, or 0 if unknown.
+func legacyFourCC(bpp, depth uint32) uint32 {
+	var code string
+	switch {
+	case bpp == 16 && depth == 16:
+		code = "RG16"
+	case bpp == 24 && depth == 24:
+		code = "RG24"
+	case bpp == 32 && depth == 24:
+		code = "XR24"
+	case bpp == 32 && depth == 32:
+		code = "AR24"
+	default:
+		return 0
+	}
+	return uint32(code[0]) | uint32(code[1])<<8 | uint32(code[2])<<16 | uint32(code[3])<<24
+}
+
+// Convert a packed RGB image, with rows stride bytes apart, to an I420 frame
+// of the same size, using BT.601 limited range coefficients. Chroma is
+// averaged over each 2x2 block.
+func (pf *pixelFormat) toI420(dst *raw.Frame, src []byte, stride int) {
+	bpp := pf.bitsPerPixel / 8
+	cw := dst.Width / 2
+	rs := make([]int32, cw) // Sums for the chroma blocks of a row pair
+	gs := make([]int32, cw)
+	bs := make([]int32, cw)
+	for y := 0; y < dst.Height; y++ {
+		if y%2 == 0 {
+			for c := range rs {
+				rs[c], gs[c], bs[c] = 0, 0, 0
+			}
+		}
+		line := src[y*stride:]
+		for x := 0; x < dst.Width; x++ {
+			var pixel uint32
+			p := line[x*bpp:]
+			switch bpp {
+			case 2:
+				pixel = uint32(p[0]) | uint32(p[1])<<8
+			case 3:
+				pixel = uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16
+			default:
+				pixel = uint32(p[0]) | uint32(p[1])<<8 | uint32(p[2])<<16 | uint32(p[3])<<24
+			}
+			r := int32(pf.red.value(pixel))
+			g := int32(pf.green.value(pixel))
+			b := int32(pf.blue.value(pixel))
+			dst.Y[y*dst.Width+x] = byte((66*r+129*g+25*b+128)>>8 + 16)
+			rs[x/2] += r
+			gs[x/2] += g
+			bs[x/2] += b
+		}
+		if y%2 == 1 {
+			row := y / 2 * cw
+			for c := range rs {
+				r, g, b := rs[c]/4, gs[c]/4, bs[c]/4
+				dst.U[row+c] = byte((-38*r-74*g+112*b+128)>>8 + 128)
+				dst.V[row+c] = byte((112*r-94*g-18*b+128)>>8 + 128)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package screen
+
+import (
+	"testing"
+
+	"github.com/lanikai/alohartc/internal/media/raw"
+)
+
+func TestBitfieldValue(t *testing.T) {
+	for _, tt := range []struct {
+		field bitfield
+		pixel uint32
+		value uint32
+	}{
+		{bitfield{16, 8}, 0x00ab0000, 0xab},
+		{bitfield{11, 5}, 0xf800, 0xff},
+		{bitfield{11, 5}, 0x0800, 0x08},
+		{bitfield{5, 6}, 0x07e0, 0xff},
+		{bitfield{0, 5}, 0x0010, 0x84},
+		{bitfield{0, 10}, 0x3ff, 0xff},
+		{bitfield{0, 0}, 0xffff, 0},
+	} {
+		if v := tt.field.value(tt.pixel); v != tt.value {
+			t.Errorf("%+v.value(%x) = %x, expected %x", tt.field, tt.pixel, v, tt.value)
+		}
+	}
+}
+
+func TestToI420(t *testing.T) {
+	// 4x2 pixels: a white 2x2 block, then a red one.
+	xrgb := pixelFormat{32, bitfield{16, 8}, bitfield{8, 8}, bitfield{0, 8}}
+	rgb565 := pixelFormat{16, bitfield{11, 5}, bitfield{5, 6}, bitfield{0, 5}}
+	for _, tt := range []struct {
+		name   string
+		format pixelFormat
+		white  []byte
+		red    []byte
+	}{
+		{"XRGB8888", xrgb, []byte{0xff, 0xff, 0xff, 0}, []byte{0, 0, 0xff, 0}},
+		{"RGB565", rgb565, []byte{0xff, 0xff}, []byte{0, 0xf8}},
+	} {
+		var row []byte
+		for x := 0; x < 4; x++ {
+			if x < 2 {
+				row = append(row, tt.white...)
+			} else {
+				row = append(row, tt.red...)
+			}
+		}
+		// Pad rows, as framebuffers may.
+		stride := len(row) + 8
+		src := make([]byte, 2*stride)
+		copy(src, row)
+		copy(src[stride:], row)
+
+		f := raw.NewFrame(4, 2)
+		tt.format.toI420(f, src, stride)
+		if string(f.Y) != string([]byte{235, 235, 82, 82, 235, 235, 82, 82}) {
+			t.Errorf("%s: Y = %v", tt.name, f.Y)
+		}
+		if f.U[0] != 128 || f.V[0] != 128 {
+			t.Errorf("%s: white UV = %d, %d", tt.name, f.U[0], f.V[0])
+		}
+		if f.U[1] != 90 || f.V[1] != 240 {
+			t.Errorf("%s: red UV = %d, %d", tt.name, f.U[1], f.V[1])
+		}
+	}
+}
+
+func TestDRMPixelFormat(t *testing.T) {
+	for _, tt := range []struct {
+		bpp, depth uint32
+		fourcc     string
+	}{
+		{16, 16, "RG16"},
+		{24, 24, "RG24"},
+		{32, 24, "XR24"},
+		{32, 32, "AR24"},
+	} {
+		code := legacyFourCC(tt.bpp, tt.depth)
+		if s := fourCCString(code); s != tt.fourcc {
+			t.Errorf("%d bpp, depth %d: got %q, expected %q", tt.bpp, tt.depth, s, tt.fourcc)
+		}
+		pf, ok := drmPixelFormat(code)
+		if !ok || uint32(pf.bitsPerPixel) != tt.bpp {
+			t.Errorf("%s: got %+v, %v", tt.fourcc, pf, ok)
+		}
+	}
+	if code := legacyFourCC(8, 8); code != 0 {
+		t.Errorf("8 bpp: got %q, expected none", fourCCString(code))
+	}
+	if _, ok := drmPixelFormat(0x3231564e); ok { // NV12
+		t.Error("NV12 is not packed RGB")
+	}
+}
@@ -0,0 +1,175 @@
+// +build screen !production
+// +build linux
+
+package screen
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lanikai/alohartc/internal/media/raw"
+)
+
+// Framebuffer ioctls, from linux/fb.h.
+const (
+	fbioGetVScreenInfo = 0x4600
+	fbioGetFScreenInfo = 0x4602
+)
+
+// struct fb_var_screeninfo
+type fbVarScreenInfo struct {
+	xres, yres               uint32
+	xresVirtual, yresVirtual uint32
+	xoffset, yoffset         uint32
+	bitsPerPixel             uint32
+	grayscale                uint32
+	red, green, blue, transp fbBitfield
+	nonstd, activate         uint32
+	height, width            uint32
+	accelFlags               uint32
+	timing                   [9]uint32 // pixclock through vmode
+	rotate, colorspace       uint32
+	reserved                 [4]uint32
+}
+
+// struct fb_bitfield
+type fbBitfield struct {
+	offset, length, msbRight uint32
+}
+
+// struct fb_fix_screeninfo
+type fbFixScreenInfo struct {
+	id                            [16]byte
+	smemStart                     uintptr
+	smemLen                       uint32
+	typ, typeAux, visual          uint32
+	xpanstep, ypanstep, ywrapstep uint16
+	lineLength                    uint32
+	mmioStart                     uintptr
+	mmioLen                       uint32
+	accel                         uint32
+	capabilities                  uint16
+	reserved                      [2]uint16
+}
+
+// A framebuffer is a memory-mapped Linux framebuffer device, e.g. /dev/fb0,
+// which mirrors the display of a KMS driver through its fbdev emulation.
+type framebuffer struct {
+	file *os.File
+	mem  []byte
+
+	width, height int
+	stride        int
+	bytesPerPixel int
+	format        pixelFormat
+}
+
+func openFramebuffer(path string) (*framebuffer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fb := &framebuffer{file: file}
+	if err := fb.init(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return fb, nil
+}
+
+func (fb *framebuffer) init() error {
+	var v fbVarScreenInfo
+	if err := fb.ioctl(fbioGetVScreenInfo, unsafe.Pointer(&v)); err != nil {
+		return err
+	}
+	var f fbFixScreenInfo
+	if err := fb.ioctl(fbioGetFScreenInfo, unsafe.Pointer(&f)); err != nil {
+		return err
+	}
+	switch v.bitsPerPixel {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("unsupported pixel depth: %d bits", v.bitsPerPixel)
+	}
+	if v.grayscale != 0 || v.nonstd != 0 {
+		return errors.New("unsupported pixel format")
+	}
+
+	fb.width = int(v.xres)
+	fb.height = int(v.yres)
+	fb.stride = int(f.lineLength)
+	fb.bytesPerPixel = int(v.bitsPerPixel) / 8
+	fb.format = pixelFormat{
+		bitsPerPixel: int(v.bitsPerPixel),
+		red:          bitfield{v.red.offset, v.red.length},
+		green:        bitfield{v.green.offset, v.green.length},
+		blue:         bitfield{v.blue.offset, v.blue.length},
+	}
+
+	mem, err := unix.Mmap(int(fb.file.Fd()), 0, int(f.smemLen), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	fb.mem = mem
+	if _, err := fb.visible(); err != nil {
+		unix.Munmap(mem)
+		return err
+	}
+	log.Info("Framebuffer %s: %dx%d, %d bits per pixel", cString(f.id[:]), fb.width, fb.height, v.bitsPerPixel)
+	return nil
+}
+
+func (fb *framebuffer) ioctl(request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fb.file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (fb *framebuffer) size() (width, height int) {
+	return fb.width, fb.height
+}
+
+// Return the visible part of the virtual screen, which double-buffering
+// drivers pan between frames.
+func (fb *framebuffer) visible() ([]byte, error) {
+	var v fbVarScreenInfo
+	if err := fb.ioctl(fbioGetVScreenInfo, unsafe.Pointer(&v)); err != nil {
+		return nil, err
+	}
+	offset := int(v.yoffset)*fb.stride + int(v.xoffset)*fb.bytesPerPixel
+	if offset+(fb.height-1)*fb.stride+fb.width*fb.bytesPerPixel > len(fb.mem) {
+		return nil, errors.New("visible screen exceeds framebuffer memory")
+	}
+	return fb.mem[offset:], nil
+}
+
+// Read the screen into an I420 frame, whose size is the screen's rounded
+// down to even numbers.
+func (fb *framebuffer) read(dst *raw.Frame) error {
+	mem, err := fb.visible()
+	if err != nil {
+		return err
+	}
+	fb.format.toI420(dst, mem, fb.stride)
+	return nil
+}
+
+func (fb *framebuffer) Close() error {
+	unix.Munmap(fb.mem)
+	return fb.file.Close()
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
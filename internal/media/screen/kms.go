@@ -0,0 +1,363 @@
+// +build screen !production
+// +build linux
+
+package screen
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lanikai/alohartc/internal/media/raw"
+)
+
+// struct drm_mode_card_res
+type drmModeCardRes struct {
+	fbIDPtr, crtcIDPtr, connectorIDPtr, encoderIDPtr uint64
+	countFbs, countCrtcs                             uint32
+	countConnectors, countEncoders                   uint32
+	minWidth, maxWidth, minHeight, maxHeight         uint32
+}
+
+// struct drm_mode_modeinfo
+type drmModeModeInfo struct {
+	clock                                         uint32
+	hdisplay, hsyncStart, hsyncEnd, htotal, hskew uint16
+	vdisplay, vsyncStart, vsyncEnd, vtotal, vscan uint16
+	vrefresh                                      uint32
+	flags                                         uint32
+	typ                                           uint32
+	name                                          [32]byte
+}
+
+// struct drm_mode_crtc
+type drmModeCrtc struct {
+	setConnectorsPtr uint64
+	countConnectors  uint32
+	crtcID           uint32
+	fbID             uint32
+	x, y             uint32
+	gammaSize        uint32
+	modeValid        uint32
+	mode             drmModeModeInfo
+}
+
+// struct drm_mode_fb_cmd
+type drmModeFbCmd struct {
+	fbID          uint32
+	width, height uint32
+	pitch         uint32
+	bpp, depth    uint32
+	handle        uint32
+}
+
+// struct drm_mode_fb_cmd2
+type drmModeFbCmd2 struct {
+	fbID          uint32
+	width, height uint32
+	pixelFormat   uint32
+	flags         uint32
+	handles       [4]uint32
+	pitches       [4]uint32
+	offsets       [4]uint32
+	_             uint32 // Aligns modifier, as on every architecture
+	modifier      [4]uint64
+}
+
+// struct drm_prime_handle
+type drmPrimeHandle struct {
+	handle uint32
+	flags  uint32
+	fd     int32
+}
+
+// struct drm_gem_close
+type drmGemClose struct {
+	handle uint32
+	pad    uint32
+}
+
+// struct dma_buf_sync
+type dmaBufSync struct {
+	flags uint64
+}
+
+// Compute an ioctl request number, like _IOC in asm-generic/ioctl.h.
+func ioc(dir, typ, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | typ<<8 | nr
+}
+
+// DRM and DMA-BUF ioctls, from drm.h and dma-buf.h.
+var (
+	drmIoctlGemClose         = ioc(1, 'd', 0x09, unsafe.Sizeof(drmGemClose{}))
+	drmIoctlPrimeHandleToFD  = ioc(3, 'd', 0x2d, unsafe.Sizeof(drmPrimeHandle{}))
+	drmIoctlModeGetResources = ioc(3, 'd', 0xa0, unsafe.Sizeof(drmModeCardRes{}))
+	drmIoctlModeGetCrtc      = ioc(3, 'd', 0xa1, unsafe.Sizeof(drmModeCrtc{}))
+	drmIoctlModeGetFB        = ioc(3, 'd', 0xad, unsafe.Sizeof(drmModeFbCmd{}))
+	drmIoctlModeGetFB2       = ioc(3, 'd', 0xce, unsafe.Sizeof(drmModeFbCmd2{}))
+	dmaBufIoctlSync          = ioc(1, 'b', 0, unsafe.Sizeof(dmaBufSync{}))
+)
+
+const (
+	drmModeFbModifiers = 1 << 1
+
+	dmaBufSyncRead  = 1 << 0
+	dmaBufSyncStart = 0 << 2
+	dmaBufSyncEnd   = 1 << 2
+
+	// Framebuffers mapped at once. Compositors flip between two or three.
+	maxMappedFramebuffers = 4
+)
+
+// A kmsDisplay captures the framebuffer scanned out by a CRTC of a DRM device,
+// e.g. /dev/dri/card0, as FFmpeg's kmsgrab does. Reading the framebuffer takes
+// CAP_SYS_ADMIN. Overlay planes, such as hardware cursors and video, aren't
+// captured.
+type kmsDisplay struct {
+	file   *os.File
+	crtcID uint32
+
+	// Visible part of the framebuffer.
+	x, y          int
+	width, height int
+
+	// Framebuffers mapped so far, by ID.
+	buffers map[uint32]*kmsBuffer
+}
+
+// A framebuffer exported as a DMA-BUF, and mapped into memory.
+type kmsBuffer struct {
+	fd     int
+	mem    []byte
+	size   int
+	offset int
+	stride int
+	format pixelFormat
+}
+
+func openKMS(path string) (*kmsDisplay, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &kmsDisplay{file: file, buffers: make(map[uint32]*kmsBuffer)}
+	if err := d.init(); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return d, nil
+}
+
+// Find the first CRTC driving a display.
+func (d *kmsDisplay) init() error {
+	var res drmModeCardRes
+	if err := d.ioctl(drmIoctlModeGetResources, unsafe.Pointer(&res)); err != nil {
+		return err
+	}
+	if res.countCrtcs == 0 {
+		return errors.New("no CRTCs")
+	}
+	crtcIDs := make([]uint32, res.countCrtcs)
+	res = drmModeCardRes{
+		crtcIDPtr:  uint64(uintptr(unsafe.Pointer(&crtcIDs[0]))),
+		countCrtcs: uint32(len(crtcIDs)),
+	}
+	if err := d.ioctl(drmIoctlModeGetResources, unsafe.Pointer(&res)); err != nil {
+		return err
+	}
+
+	for _, id := range crtcIDs[:res.countCrtcs] {
+		crtc, err := d.getCrtc(id)
+		if err != nil {
+			return err
+		}
+		if crtc.modeValid == 0 || crtc.fbID == 0 {
+			continue
+		}
+		d.crtcID = id
+		d.x, d.y = int(crtc.x), int(crtc.y)
+		d.width, d.height = int(crtc.mode.hdisplay), int(crtc.mode.vdisplay)
+		b, err := d.buffer(crtc.fbID)
+		if err != nil {
+			return err
+		}
+		if _, err := d.visible(b); err != nil {
+			return err
+		}
+		log.Info("DRM CRTC %d: %dx%d, mode %s", id, d.width, d.height, cString(crtc.mode.name[:]))
+		return nil
+	}
+	return errors.New("no active display")
+}
+
+func (d *kmsDisplay) ioctl(request uintptr, arg unsafe.Pointer) error {
+	return ioctlFD(int(d.file.Fd()), request, arg)
+}
+
+func (d *kmsDisplay) getCrtc(id uint32) (*drmModeCrtc, error) {
+	crtc := &drmModeCrtc{crtcID: id}
+	if err := d.ioctl(drmIoctlModeGetCrtc, unsafe.Pointer(crtc)); err != nil {
+		return nil, err
+	}
+	return crtc, nil
+}
+
+func (d *kmsDisplay) size() (width, height int) {
+	return d.width, d.height
+}
+
+// Return the mapping of a framebuffer, mapping it if necessary.
+func (d *kmsDisplay) buffer(fbID uint32) (*kmsBuffer, error) {
+	if b := d.buffers[fbID]; b != nil {
+		return b, nil
+	}
+	if len(d.buffers) >= maxMappedFramebuffers {
+		// The compositor has moved on to new framebuffers.
+		d.unmapAll()
+	}
+
+	handle, b, err := d.getFB(fbID)
+	if err != nil {
+		return nil, err
+	}
+	prime := drmPrimeHandle{handle: handle, flags: unix.O_CLOEXEC}
+	err = d.ioctl(drmIoctlPrimeHandleToFD, unsafe.Pointer(&prime))
+	gemClose := drmGemClose{handle: handle}
+	d.ioctl(drmIoctlGemClose, unsafe.Pointer(&gemClose))
+	if err != nil {
+		return nil, fmt.Errorf("exporting framebuffer: %v", err)
+	}
+	b.fd = int(prime.fd)
+
+	b.mem, err = unix.Mmap(b.fd, 0, b.size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		unix.Close(b.fd)
+		return nil, fmt.Errorf("mapping framebuffer: %v", err)
+	}
+	d.buffers[fbID] = b
+	return b, nil
+}
+
+// Return the part of a framebuffer that the CRTC scans out.
+func (d *kmsDisplay) visible(b *kmsBuffer) ([]byte, error) {
+	bpp := b.format.bitsPerPixel / 8
+	start := b.offset + d.y*b.stride + d.x*bpp
+	if start+(d.height-1)*b.stride+d.width*bpp > len(b.mem) {
+		return nil, errors.New("visible screen exceeds framebuffer memory")
+	}
+	return b.mem[start:], nil
+}
+
+// Describe a framebuffer, and return a GEM handle for it, which must be
+// closed.
+func (d *kmsDisplay) getFB(fbID uint32) (uint32, *kmsBuffer, error) {
+	fb2 := drmModeFbCmd2{fbID: fbID}
+	err := d.ioctl(drmIoctlModeGetFB2, unsafe.Pointer(&fb2))
+	if err == unix.ENOTTY || err == unix.EINVAL {
+		// Kernels before 5.7 describe only the depth of a framebuffer.
+		fb := drmModeFbCmd{fbID: fbID}
+		if err := d.ioctl(drmIoctlModeGetFB, unsafe.Pointer(&fb)); err != nil {
+			return 0, nil, err
+		}
+		fb2 = drmModeFbCmd2{
+			height:      fb.height,
+			pixelFormat: legacyFourCC(fb.bpp, fb.depth),
+			handles:     [4]uint32{fb.handle},
+			pitches:     [4]uint32{fb.pitch},
+		}
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	handle := fb2.handles[0]
+	if handle == 0 {
+		return 0, nil, errors.New("no access to framebuffer: CAP_SYS_ADMIN is required")
+	}
+	// Close handles of other planes, which packed RGB formats don't have.
+	for _, h := range fb2.handles[1:] {
+		if h != 0 && h != handle {
+			gemClose := drmGemClose{handle: h}
+			d.ioctl(drmIoctlGemClose, unsafe.Pointer(&gemClose))
+		}
+	}
+
+	format, ok := drmPixelFormat(fb2.pixelFormat)
+	if !ok {
+		err = fmt.Errorf("unsupported framebuffer format %q", fourCCString(fb2.pixelFormat))
+	} else if fb2.flags&drmModeFbModifiers != 0 && fb2.modifier[0] != 0 {
+		err = fmt.Errorf("unsupported framebuffer layout: modifier %#x", fb2.modifier[0])
+	}
+	if err != nil {
+		gemClose := drmGemClose{handle: handle}
+		d.ioctl(drmIoctlGemClose, unsafe.Pointer(&gemClose))
+		return 0, nil, err
+	}
+	return handle, &kmsBuffer{
+		size:   int(fb2.offsets[0] + fb2.height*fb2.pitches[0]),
+		offset: int(fb2.offsets[0]),
+		stride: int(fb2.pitches[0]),
+		format: format,
+	}, nil
+}
+
+// Read the framebuffer currently scanned out into an I420 frame, whose size
+// is the display's rounded down to even numbers.
+func (d *kmsDisplay) read(dst *raw.Frame) error {
+	crtc, err := d.getCrtc(d.crtcID)
+	if err != nil {
+		return err
+	}
+	if crtc.modeValid == 0 || crtc.fbID == 0 {
+		return errors.New("display turned off")
+	}
+	if int(crtc.mode.hdisplay) != d.width || int(crtc.mode.vdisplay) != d.height {
+		return errors.New("display mode changed")
+	}
+	d.x, d.y = int(crtc.x), int(crtc.y)
+	b, err := d.buffer(crtc.fbID)
+	if err != nil {
+		return err
+	}
+	mem, err := d.visible(b)
+	if err != nil {
+		return err
+	}
+
+	// Make the CPU's view of the buffer coherent while reading it.
+	sync := dmaBufSync{flags: dmaBufSyncRead | dmaBufSyncStart}
+	syncErr := ioctlFD(b.fd, dmaBufIoctlSync, unsafe.Pointer(&sync))
+	b.format.toI420(dst, mem, b.stride)
+	if syncErr == nil {
+		sync.flags = dmaBufSyncRead | dmaBufSyncEnd
+		ioctlFD(b.fd, dmaBufIoctlSync, unsafe.Pointer(&sync))
+	}
+	return nil
+}
+
+func ioctlFD(fd int, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (d *kmsDisplay) unmapAll() {
+	for id, b := range d.buffers {
+		b.close()
+		delete(d.buffers, id)
+	}
+}
+
+func (b *kmsBuffer) close() {
+	unix.Munmap(b.mem)
+	unix.Close(b.fd)
+}
+
+func (d *kmsDisplay) Close() error {
+	d.unmapAll()
+	return d.file.Close()
+}
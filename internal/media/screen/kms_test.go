@@ -0,0 +1,30 @@
+// +build screen !production
+// +build linux
+
+package screen
+
+import (
+	"testing"
+)
+
+// Check the ioctl request numbers, which encode the sizes of their structs,
+// against those of the kernel headers.
+func TestKMSIoctls(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		request  uintptr
+		expected uintptr
+	}{
+		{"DRM_IOCTL_GEM_CLOSE", drmIoctlGemClose, 0x40086409},
+		{"DRM_IOCTL_PRIME_HANDLE_TO_FD", drmIoctlPrimeHandleToFD, 0xc00c642d},
+		{"DRM_IOCTL_MODE_GETRESOURCES", drmIoctlModeGetResources, 0xc04064a0},
+		{"DRM_IOCTL_MODE_GETCRTC", drmIoctlModeGetCrtc, 0xc06864a1},
+		{"DRM_IOCTL_MODE_GETFB", drmIoctlModeGetFB, 0xc01c64ad},
+		{"DRM_IOCTL_MODE_GETFB2", drmIoctlModeGetFB2, 0xc06864ce},
+		{"DMA_BUF_IOCTL_SYNC", dmaBufIoctlSync, 0x40086200},
+	} {
+		if tt.request != tt.expected {
+			t.Errorf("%s = %#x, expected %#x", tt.name, tt.request, tt.expected)
+		}
+	}
+}
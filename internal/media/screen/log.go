@@ -0,0 +1,7 @@
+// +build screen !production
+
+package screen
+
+import "github.com/lanikai/alohartc/internal/logging"
+
+var log = logging.DefaultLogger.WithTag("screen")
@@ -0,0 +1,317 @@
+// +build screen !production
+// +build linux
+
+// Package screen captures the local display through DRM/KMS or a Linux
+// framebuffer device, e.g. to stream a kiosk or digital signage player, and
+// encodes it with an M2M hardware encoder or in software.
+package screen
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/h264"
+	"github.com/lanikai/alohartc/internal/media/raw"
+	"github.com/lanikai/alohartc/internal/packet"
+	"github.com/lanikai/alohartc/internal/v4l2"
+)
+
+const (
+	defaultFramebuffer = "/dev/fb0"
+	defaultFrameRate   = 10
+
+	// Interval between keyframes of the software encoder, which are large
+	// since they are not compressed, unless a receiver asks for one.
+	keyframeInterval = 30 * time.Second
+)
+
+func init() {
+	media.RegisterScheme("screen", OpenURI)
+}
+
+// OpenURI opens a screen given by a URI of the form
+//
+//	screen:/dev/dri/card1?width=1280&height=720&framerate=10&encoder=/dev/video11&bitrate=2000000
+//
+// where every part is optional. Query parameters are named after the fields
+// of Config, in lower case.
+func OpenURI(uri string) (media.VideoSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	cfg := Config{Device: u.Opaque}
+	if cfg.Device == "" {
+		cfg.Device = u.Path
+	}
+	q := u.Query()
+	for name, field := range map[string]*int{
+		"width":     &cfg.Width,
+		"height":    &cfg.Height,
+		"framerate": &cfg.FrameRate,
+		"bitrate":   &cfg.Bitrate,
+	} {
+		if v := q.Get(name); v != "" {
+			if *field, err = strconv.Atoi(v); err != nil {
+				return nil, errors.New("screen: invalid " + name + ": " + v)
+			}
+		}
+	}
+	cfg.Encoder = q.Get("encoder")
+	return Open(cfg)
+}
+
+// Open a screen. Capture starts when the first receiver is added.
+func Open(cfg Config) (media.VideoSource, error) {
+	if cfg.FrameRate <= 0 {
+		cfg.FrameRate = defaultFrameRate
+	}
+	d, err := openDisplay(cfg.Device)
+	if err != nil {
+		return nil, err
+	}
+
+	width, height := d.size()
+	s := &screenSource{
+		cfg:     cfg,
+		display: d,
+		width:   width &^ 1,
+		height:  height &^ 1,
+	}
+	if cfg.Width > 0 && cfg.Height > 0 && (cfg.Width != s.width || cfg.Height != s.height) {
+		s.transforms = raw.Chain{raw.Scale{Width: cfg.Width, Height: cfg.Height}}
+	}
+	width, height = s.transforms.Size(s.width, s.height)
+	if cfg.Encoder != "" {
+		s.m2m, err = v4l2.OpenEncoder(cfg.Encoder, v4l2.EncoderConfig{
+			Width:     width,
+			Height:    height,
+			FrameRate: cfg.FrameRate,
+			Bitrate:   cfg.Bitrate,
+		})
+	} else {
+		s.enc, err = h264.NewEncoder(width, height)
+	}
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	s.Flow.Start = s.start
+	s.Flow.Stop = s.stop
+	return s, nil
+}
+
+// A display that can be captured.
+type display interface {
+	size() (width, height int)
+
+	// Read the screen into an I420 frame, whose size is the screen's rounded
+	// down to even numbers.
+	read(dst *raw.Frame) error
+
+	Close() error
+}
+
+// Open the display of a DRM device, such as /dev/dri/card0, or a framebuffer
+// device, such as /dev/fb0. By default, the first DRM device driving a
+// display is used, or else /dev/fb0.
+func openDisplay(path string) (display, error) {
+	if strings.HasPrefix(path, "/dev/dri/") {
+		return openKMS(path)
+	} else if path != "" {
+		return openFramebuffer(path)
+	}
+
+	cards, _ := filepath.Glob("/dev/dri/card*")
+	for _, card := range cards {
+		d, err := openKMS(card)
+		if err == nil {
+			return d, nil
+		}
+		log.Debug("Not capturing %v", err)
+	}
+	return openFramebuffer(defaultFramebuffer)
+}
+
+// A media.VideoSource capturing a display.
+type screenSource struct {
+	media.Flow
+
+	cfg     Config
+	display display
+
+	// Size of the screen, rounded down to even numbers, and the transforms
+	// that scale it to the encoded size.
+	width, height int
+	transforms    raw.Chain
+
+	// Either a hardware encoder, or the software encoder.
+	m2m *v4l2.Encoder
+	enc *h264.Encoder
+
+	// Guards the capture loop, and keyframe requests of the software
+	// encoder.
+	mu       sync.Mutex
+	quit     chan struct{}
+	done     chan struct{}
+	keyframe bool
+}
+
+func (s *screenSource) Codec() string {
+	return "H264"
+}
+
+func (s *screenSource) Width() int {
+	w, _ := s.transforms.Size(s.width, s.height)
+	return w
+}
+
+func (s *screenSource) Height() int {
+	_, h := s.transforms.Size(s.width, s.height)
+	return h
+}
+
+// ParameterSets implements media.ParameterSetProvider. The M2M encoder's
+// parameter sets are only known from its output, so it returns nil for them.
+func (s *screenSource) ParameterSets() [][]byte {
+	if s.enc == nil {
+		return nil
+	}
+	return s.enc.ParameterSets()
+}
+
+// RequestKeyframe implements media.KeyframeRequester.
+func (s *screenSource) RequestKeyframe() error {
+	if s.m2m != nil {
+		return s.m2m.RequestKeyframe()
+	}
+	s.mu.Lock()
+	s.keyframe = true
+	s.mu.Unlock()
+	return nil
+}
+
+// Close releases the display and the encoder.
+func (s *screenSource) Close() error {
+	s.stop()
+	if s.m2m != nil {
+		s.m2m.Close()
+	}
+	return s.display.Close()
+}
+
+func (s *screenSource) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// After a failure, the loop may have ended without being stopped.
+	s.halt()
+
+	if s.m2m != nil {
+		if err := s.m2m.Start(); err != nil {
+			// Called with the Flow locked, so shut down from another
+			// goroutine.
+			go s.Flow.Shutdown(err)
+			return
+		}
+		go s.readEncoded()
+	}
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+	s.keyframe = true
+	go s.run(s.quit, s.done)
+}
+
+func (s *screenSource) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.halt()
+}
+
+// Stop the capture loop, if running. Called with s.mu held.
+func (s *screenSource) halt() {
+	if s.quit == nil {
+		return
+	}
+	close(s.quit)
+	s.mu.Unlock()
+	<-s.done
+	s.mu.Lock()
+	s.quit, s.done = nil, nil
+	if s.m2m != nil {
+		s.m2m.Stop()
+	}
+}
+
+// Capture the screen at the configured frame rate, and encode it.
+func (s *screenSource) run(quit, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(time.Second / time.Duration(s.cfg.FrameRate))
+	defer ticker.Stop()
+
+	frame := raw.NewFrame(s.width, s.height)
+	lastKeyframe := time.Now()
+	for {
+		frame.Time = time.Now()
+		err := s.display.read(frame)
+		if err == nil {
+			out := s.transforms.Apply(frame)
+			if s.m2m != nil {
+				err = s.m2m.Encode(out)
+			} else {
+				s.mu.Lock()
+				keyframe := s.keyframe || time.Since(lastKeyframe) >= keyframeInterval
+				s.keyframe = false
+				s.mu.Unlock()
+				if keyframe {
+					lastKeyframe = time.Now()
+				}
+				s.put(s.enc.Encode(out.Y, out.U, out.V, keyframe), frame.Time)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Warn("Screen capture failed: %v", err)
+				go s.Flow.Shutdown(err)
+			}
+			return
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deliver the output of the hardware encoder, until it is stopped.
+func (s *screenSource) readEncoded() {
+	for {
+		nalus, t, err := s.m2m.ReadNALUs()
+		if err != nil {
+			if err != io.EOF {
+				s.Flow.Shutdown(err)
+			}
+			return
+		}
+		s.put(nalus, t)
+	}
+}
+
+func (s *screenSource) put(nalus [][]byte, t time.Time) {
+	for _, nalu := range nalus {
+		buf := packet.NewSharedBuffer(nalu, 1, nil)
+		buf.SetCaptureTime(t)
+		s.Flow.Put(buf)
+	}
+}
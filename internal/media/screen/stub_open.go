@@ -0,0 +1,13 @@
+// +build !linux production,!screen
+
+package screen
+
+import (
+	"errors"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+func Open(cfg Config) (media.VideoSource, error) {
+	return nil, errors.New("screen capture is not supported in this build")
+}
@@ -0,0 +1,198 @@
+package media
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media/g711"
+	"github.com/lanikai/alohartc/internal/media/h264"
+	"github.com/lanikai/alohartc/internal/media/raw"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+const (
+	// Duration of each tone buffer.
+	toneFrameDuration = 20 * time.Millisecond
+
+	// Amplitude of the tone, at -12 dBFS.
+	toneAmplitude = 0.25
+)
+
+// NewTestVideoSource returns a video source looping a few seconds of color
+// bars with a frame counter, like NewBarsSource, but encoded up front, so
+// that streaming costs next to no CPU, e.g. in CI. A keyframe request
+// restarts the loop from its keyframe.
+func NewTestVideoSource(width, height, fps int) (VideoSource, error) {
+	if fps <= 0 {
+		return nil, errors.New("media: invalid test video frame rate")
+	}
+	enc, err := h264.NewEncoder(width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	// Loop a sweep of the bar, over a whole number of cycles of frame_num,
+	// so that the stream stays valid as it wraps around.
+	n := (4*fps + 15) / 16 * 16
+	v := &testVideoSource{
+		width:  width,
+		height: height,
+		fps:    fps,
+		sps:    enc.ParameterSets(),
+		frames: make([][]byte, n),
+	}
+	frame := raw.NewFrame(width, height)
+	for i := 0; i <= n; i++ {
+		drawBars(frame, i%n, n)
+		nalus := enc.Encode(frame.Y, frame.U, frame.V, i == 0)
+		if i == 0 {
+			v.keyframes[0] = nalus
+		} else {
+			// Frame 0 follows the last frame from the second time round.
+			v.frames[i%n] = nalus[0]
+		}
+	}
+
+	// A second keyframe, whose idr_pic_id differs from the first's, in case
+	// two are requested in a row.
+	drawBars(frame, 0, n)
+	v.keyframes[1] = enc.Encode(frame.Y, frame.U, frame.V, true)
+
+	loop := newSingletonLoop(v.run)
+	v.Flow.Start = loop.start
+	v.Flow.Stop = loop.stop
+	return v, nil
+}
+
+// A VideoSource looping pre-encoded color bars.
+type testVideoSource struct {
+	Flow
+
+	width, height, fps int
+
+	sps       [][]byte
+	keyframes [2][][]byte // SPS, PPS and IDR of frame 0
+	frames    [][]byte    // Slices coded against the previous frame
+
+	// Guards restart, set by a keyframe request.
+	mu      sync.Mutex
+	restart bool
+}
+
+func (v *testVideoSource) Codec() string {
+	return "H264"
+}
+
+func (v *testVideoSource) Width() int {
+	return v.width
+}
+
+func (v *testVideoSource) Height() int {
+	return v.height
+}
+
+// ParameterSets implements ParameterSetProvider.
+func (v *testVideoSource) ParameterSets() [][]byte {
+	return v.sps
+}
+
+// RequestKeyframe implements KeyframeRequester.
+func (v *testVideoSource) RequestKeyframe() error {
+	v.mu.Lock()
+	v.restart = true
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *testVideoSource) run(quit <-chan struct{}) error {
+	ticker := time.NewTicker(time.Second / time.Duration(v.fps))
+	defer ticker.Stop()
+
+	v.RequestKeyframe()
+	i, k := 0, 0
+	for {
+		v.mu.Lock()
+		restart := v.restart
+		v.restart = false
+		v.mu.Unlock()
+
+		nalus := v.frames[i : i+1]
+		if restart {
+			i = 0
+			nalus = v.keyframes[k]
+			k = 1 - k
+		}
+		now := time.Now()
+		for _, nalu := range nalus {
+			buf := packet.NewSharedBuffer(nalu, 1, nil)
+			buf.SetCaptureTime(now)
+			v.Flow.Put(buf)
+		}
+		i = (i + 1) % len(v.frames)
+
+		select {
+		case <-quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewToneAudioSource returns an audio source generating a sine wave of the
+// given frequency, in Hz, as G.711 µ-law ("PCMU") in 20 ms buffers. Opus
+// would need an encoder in C; every browser decodes PCMU.
+func NewToneAudioSource(freq float64) (AudioSource, error) {
+	if freq <= 0 || freq >= g711.SampleRate/2 {
+		return nil, errors.New("media: tone frequency out of range")
+	}
+	t := &toneSource{freq: freq}
+	loop := newSingletonLoop(t.run)
+	t.Flow.Start = loop.start
+	t.Flow.Stop = loop.stop
+	return t, nil
+}
+
+// An AudioSource generating a tone.
+type toneSource struct {
+	Flow
+
+	freq float64
+}
+
+func (t *toneSource) Codec() string {
+	return "PCMU"
+}
+
+func (t *toneSource) SampleRate() int {
+	return g711.SampleRate
+}
+
+func (t *toneSource) BytesPerSample() int {
+	return 1
+}
+
+func (t *toneSource) run(quit <-chan struct{}) error {
+	ticker := time.NewTicker(toneFrameDuration)
+	defer ticker.Stop()
+
+	samples := make([]int16, int(toneFrameDuration*g711.SampleRate/time.Second))
+	step := 2 * math.Pi * t.freq / g711.SampleRate
+	phase := 0.0
+	for {
+		for i := range samples {
+			samples[i] = int16(toneAmplitude * math.MaxInt16 * math.Sin(phase))
+			phase = math.Mod(phase+step, 2*math.Pi)
+		}
+		buf := packet.NewSharedBuffer(g711.Encode(nil, samples), 1, nil)
+		buf.SetCaptureTime(time.Now())
+		t.Flow.Put(buf)
+
+		select {
+		case <-quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package media
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/media/g711"
+	"github.com/lanikai/alohartc/internal/media/h264"
+)
+
+func TestTestVideoSource(t *testing.T) {
+	src, err := NewTestVideoSource(64, 48, 100)
+	if !assert.NoError(t, err) {
+		return
+	}
+	v := src.(*testVideoSource)
+	assert.Equal(t, 400, len(v.frames))
+	assert.Equal(t, 3, len(v.keyframes[1]))
+
+	r := src.AddReceiver(64)
+	defer src.RemoveReceiver(r)
+
+	// The loop wraps around after 400 frames, the first being a keyframe.
+	var types []byte
+	timeout := time.After(10 * time.Second)
+	for len(types) < 2+402 {
+		select {
+		case buf := <-r.Buffers():
+			types = append(types, h264.NALU(buf.Bytes()).Type())
+			buf.Release()
+		case <-timeout:
+			t.Fatalf("timed out after %d NALUs", len(types))
+		}
+	}
+	assert.Equal(t, []byte{7, 8, 5, 1}, types[:4])
+	for _, typ := range types[3:] {
+		if typ != h264.NALUTypeSlice {
+			t.Fatalf("unexpected NALU type %d", typ)
+		}
+	}
+
+	_, err = NewTestVideoSource(64, 48, 0)
+	assert.Error(t, err)
+}
+
+func TestToneAudioSource(t *testing.T) {
+	src, err := NewToneAudioSource(1000)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "PCMU", src.Codec())
+	assert.Equal(t, 8000, src.SampleRate())
+
+	r := src.AddReceiver(4)
+	defer src.RemoveReceiver(r)
+	buf := <-r.Buffers()
+	defer buf.Release()
+
+	samples := g711.Decode(nil, buf.Bytes())
+	assert.Equal(t, 160, len(samples))
+	// 1 kHz at 8 kHz: a period of 8 samples, peaking at the second.
+	peak := toneAmplitude * math.MaxInt16
+	assert.InDelta(t, peak*math.Sqrt2/2, float64(samples[1]), peak/16)
+	assert.InDelta(t, float64(samples[1]), float64(samples[9]), peak/16)
+	assert.InDelta(t, -float64(samples[1]), float64(samples[5]), peak/16)
+
+	_, err = NewToneAudioSource(5000)
+	assert.Error(t, err)
+}
@@ -13,3 +13,76 @@ type VideoSource interface {
 
 	//AdjustBitrate(bps int)
 }
+
+// A ParameterSetProvider is a video source whose H.264 parameter sets are
+// known before streaming starts, e.g. from a file header or an RTSP session
+// description, rather than only in band.
+type ParameterSetProvider interface {
+	// ParameterSets returns the SPS and PPS NALUs, without start codes.
+	ParameterSets() [][]byte
+}
+
+// A KeyframeRequester is a video source that can be asked for a keyframe out
+// of turn, e.g. when a receiver reports picture loss, or a new receiver starts
+// decoding mid-stream.
+type KeyframeRequester interface {
+	// RequestKeyframe asks for the next picture to be a keyframe.
+	RequestKeyframe() error
+}
+
+// A BitrateAdjuster is a source whose encoder bitrate can be changed while it
+// is running, e.g. to track the bandwidth available to a connection.
+type BitrateAdjuster interface {
+	// AdjustBitrate sets the target encoder bitrate, in bits per second.
+	AdjustBitrate(bps int) error
+}
+
+// A ResolutionAdjuster is a source whose picture size can be changed while it
+// is running, e.g. to step down under congestion.
+type ResolutionAdjuster interface {
+	// AdjustResolution sets the size of encoded pictures. A size of 0x0
+	// restores the source's configured size.
+	AdjustResolution(width, height int) error
+}
+
+// An EncoderController is a source whose encoder can be tuned while it is
+// running, e.g. by users or a congestion controller. Encoders may reject some
+// changes while streaming.
+type EncoderController interface {
+	BitrateAdjuster
+
+	// AdjustFrameRate sets the capture frame rate, in frames per second.
+	AdjustFrameRate(fps int) error
+
+	// SetGOPSize sets the number of frames between keyframes.
+	SetGOPSize(frames int) error
+
+	// SetH264Profile sets the H.264 profile and level. The level is ten
+	// times the level number, e.g. 41 for level 4.1.
+	SetH264Profile(profile H264Profile, level int) error
+
+	// SetBitrateMode selects constant or variable bitrate encoding.
+	SetBitrateMode(mode BitrateMode) error
+}
+
+// H264Profile is an H.264 profile supported by hardware encoders.
+type H264Profile int
+
+const (
+	H264ProfileConstrainedBaseline H264Profile = iota
+	H264ProfileMain
+	H264ProfileHigh
+)
+
+// BitrateMode selects how an encoder spends its target bitrate.
+type BitrateMode int
+
+const (
+	// Variable bitrate: quality stays steady, and the bitrate varies with
+	// the complexity of the picture.
+	BitrateVariable BitrateMode = iota
+
+	// Constant bitrate: the bitrate stays steady, which suits constrained
+	// links.
+	BitrateConstant
+)
@@ -13,6 +13,10 @@ import (
 type Endpoint struct {
 	mux *Mux
 
+	// Which packets this endpoint accepts, and in what order it is tried.
+	match    MatchFunc
+	priority int
+
 	// A circular queue of buffers, each of which can hold a single data packet.
 	bufs [][]byte
 
@@ -31,6 +35,15 @@ type Endpoint struct {
 	// One-time channel indicating that the endpoint has been closed.
 	dead chan struct{}
 
+	// Error returned by reads once the endpoint is closed, and any queued
+	// packets have been consumed.
+	err error
+
+	// Read deadline, or the zero time for none. Changes are signaled on
+	// deadlineChanged, to wake up a pending Read.
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+
 	// Mutex held when modifying circular queue state.
 	sync.Mutex
 }
@@ -44,33 +57,49 @@ func createEndpoint(mux *Mux, nbufs int, bufsize int) *Endpoint {
 		bufs[i] = bufpool[i*bufsize : (i+1)*bufsize]
 	}
 	return &Endpoint{
-		mux:       mux,
-		bufs:      bufs,
-		nbufs:     nbufs,
-		nused:     0,
-		first:     0,
-		available: make(chan struct{}, 1),
-		dead:      make(chan struct{}),
+		mux:             mux,
+		bufs:            bufs,
+		nbufs:           nbufs,
+		nused:           0,
+		first:           0,
+		available:       make(chan struct{}, 1),
+		dead:            make(chan struct{}),
+		deadlineChanged: make(chan struct{}, 1),
 	}
 }
 
 // Close unregisters the endpoint from the Mux
 func (e *Endpoint) Close() error {
-	e.close()
+	e.closeWithError(nil)
 	e.mux.RemoveEndpoint(e)
 	return nil
 }
 
-func (e *Endpoint) close() {
+// Mark the endpoint closed, so that reads fail with err, or io.EOF if err is
+// nil. Only the first call has any effect.
+func (e *Endpoint) closeWithError(err error) {
 	e.Lock()
 	select {
 	case <-e.dead:
 	default:
+		if err == nil {
+			err = io.EOF
+		}
+		e.err = err
 		close(e.dead)
 	}
 	e.Unlock()
 }
 
+// errTimeout is returned by reads after the read deadline has passed.
+var errTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "mux: read timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 // Exchange the provided buffer (containing a packet of data) with an unused
 // buffer from this endpoint's circular queue.
 func (e *Endpoint) deliver(buf []byte) []byte {
@@ -129,24 +158,43 @@ func (e *Endpoint) tryConsume(p []byte) (int, error, bool) {
 // Read reads a packet of len(p) bytes from the underlying conn
 // that are matched by the associated MuxFunc
 func (e *Endpoint) Read(p []byte) (int, error) {
-	if e.nused > 0 {
-		// There's a packet waiting. Try to consume it right away.
-		n, err, ok := e.tryConsume(p)
-		if ok {
-			return n, err
-		}
+	// If there's a packet waiting, consume it right away.
+	if n, err, ok := e.tryConsume(p); ok {
+		return n, err
 	}
 
 	// Otherwise, wait for a packet to arrive. Avoid racing with other readers.
 	for {
+		e.Lock()
+		deadline := e.readDeadline
+		e.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, errTimeout
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		n, err, ok := 0, error(nil), false
 		select {
 		case <-e.dead:
-			return 0, io.EOF
+			n, err, ok = 0, e.err, true
 		case <-e.available:
-			n, err, ok := e.tryConsume(p)
-			if ok {
-				return n, err
-			}
+			n, err, ok = e.tryConsume(p)
+		case <-timeout:
+			n, err, ok = 0, errTimeout, true
+		case <-e.deadlineChanged:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ok {
+			return n, err
 		}
 	}
 }
@@ -166,13 +214,24 @@ func (e *Endpoint) RemoteAddr() net.Addr {
 	return e.mux.nextConn.RemoteAddr()
 }
 
-// SetDeadline is a stub
+// SetDeadline sets the read deadline. Writes go straight to the underlying
+// conn, which is shared with other endpoints, so they have no deadline.
 func (e *Endpoint) SetDeadline(t time.Time) error {
-	return nil
+	return e.SetReadDeadline(t)
 }
 
-// SetReadDeadline is a stub
+// SetReadDeadline sets the deadline for pending and future reads from this
+// endpoint, without affecting other endpoints. A zero value for t means reads
+// do not time out.
 func (e *Endpoint) SetReadDeadline(t time.Time) error {
+	e.Lock()
+	e.readDeadline = t
+	e.Unlock()
+
+	select {
+	case e.deadlineChanged <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
@@ -1,9 +1,11 @@
 package mux
 
 import (
-	"fmt"
+	"errors"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -11,11 +13,25 @@ const (
 	numBufferPackets = 32
 )
 
+var errUnknownEndpoint = errors.New("mux: endpoint is not registered")
+
 // Mux allows multiplexing
 type Mux struct {
-	lock       sync.Mutex
-	nextConn   net.Conn
-	endpoints  map[*Endpoint]MatchFunc
+	// Number of packets that matched no endpoint. Accessed atomically, so must
+	// be first for 64-bit alignment on 32-bit platforms.
+	dropped uint64
+
+	lock     sync.Mutex
+	nextConn net.Conn
+
+	// Registered endpoints, in the order they are matched: highest priority
+	// first, and in registration order among equal priorities.
+	endpoints []*Endpoint
+
+	// Whether the Mux has been closed, and the error passed on to endpoints.
+	closed   bool
+	closeErr error
+
 	bufferSize int
 }
 
@@ -24,7 +40,6 @@ type Mux struct {
 func NewMux(conn net.Conn, bufferSize int) *Mux {
 	m := &Mux{
 		nextConn:   conn,
-		endpoints:  make(map[*Endpoint]MatchFunc),
 		bufferSize: bufferSize,
 	}
 
@@ -33,32 +48,70 @@ func NewMux(conn net.Conn, bufferSize int) *Mux {
 	return m
 }
 
-// NewEndpoint creates a new Endpoint
+// NewEndpoint creates a new Endpoint with priority 0.
 func (m *Mux) NewEndpoint(f MatchFunc) *Endpoint {
+	return m.NewEndpointWithPriority(f, 0)
+}
+
+// NewEndpointWithPriority creates a new Endpoint. Each packet is delivered to
+// the first matching endpoint, trying higher priorities first.
+func (m *Mux) NewEndpointWithPriority(f MatchFunc, priority int) *Endpoint {
 	e := createEndpoint(m, numBufferPackets, m.bufferSize)
+	e.match = f
+	e.priority = priority
 
 	m.lock.Lock()
-	m.endpoints[e] = f
+	if m.closed {
+		m.lock.Unlock()
+		e.closeWithError(m.closeErr)
+		return e
+	}
+	m.endpoints = append(m.endpoints, e)
+	sort.SliceStable(m.endpoints, func(i, j int) bool {
+		return m.endpoints[i].priority > m.endpoints[j].priority
+	})
 	m.lock.Unlock()
 
 	return e
 }
 
+// Unregister removes an endpoint from the Mux and closes it. Packets that
+// only it matched are dropped from then on, and pending reads return io.EOF.
+// The underlying conn and other endpoints are unaffected.
+func (m *Mux) Unregister(e *Endpoint) error {
+	if !m.remove(e) {
+		return errUnknownEndpoint
+	}
+	e.closeWithError(nil)
+	return nil
+}
+
 // RemoveEndpoint removes an endpoint from the Mux
 func (m *Mux) RemoveEndpoint(e *Endpoint) {
+	m.remove(e)
+}
+
+func (m *Mux) remove(e *Endpoint) bool {
 	m.lock.Lock()
-	delete(m.endpoints, e)
-	m.lock.Unlock()
+	defer m.lock.Unlock()
+
+	for i, other := range m.endpoints {
+		if other == e {
+			m.endpoints = append(m.endpoints[:i], m.endpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Dropped returns the number of packets that matched no endpoint.
+func (m *Mux) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
 }
 
 // Close closes the Mux and all associated Endpoints.
 func (m *Mux) Close() error {
-	m.lock.Lock()
-	for e := range m.endpoints {
-		e.close()
-		delete(m.endpoints, e)
-	}
-	m.lock.Unlock()
+	m.closeEndpoints(nil)
 
 	err := m.nextConn.Close()
 	if err != nil {
@@ -68,16 +121,33 @@ func (m *Mux) Close() error {
 	return nil
 }
 
+// Close all endpoints, so that pending reads fail with err (or io.EOF if err
+// is nil).
+func (m *Mux) closeEndpoints(err error) {
+	m.lock.Lock()
+	if !m.closed {
+		m.closed = true
+		m.closeErr = err
+	}
+	endpoints := m.endpoints
+	m.endpoints = nil
+	m.lock.Unlock()
+
+	for _, e := range endpoints {
+		e.closeWithError(err)
+	}
+}
+
 // Read continually from the underlying connection and dispatch to the
 // appropriate endpoint. Terminate on read error, e.g. when the underlying
-// connection is closed.
+// connection is closed, and pass the error on to the endpoints' readers.
 func (m *Mux) readLoop() {
-	defer m.Close()
-
 	buf := make([]byte, m.bufferSize)
 	for {
 		n, err := m.nextConn.Read(buf)
 		if err != nil {
+			m.closeEndpoints(err)
+			m.Close()
 			return
 		}
 
@@ -96,8 +166,8 @@ func (m *Mux) dispatch(buf []byte) []byte {
 	var endpoint *Endpoint
 
 	m.lock.Lock()
-	for e, f := range m.endpoints {
-		if f(buf) {
+	for _, e := range m.endpoints {
+		if e.match(buf) {
 			endpoint = e
 			break
 		}
@@ -105,7 +175,7 @@ func (m *Mux) dispatch(buf []byte) []byte {
 	m.lock.Unlock()
 
 	if endpoint == nil {
-		fmt.Printf("Warning: mux: no endpoint for packet starting with %d\n", buf[0])
+		atomic.AddUint64(&m.dropped, 1)
 		return buf
 	}
 
@@ -2,14 +2,16 @@ package mux
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDispatch(t *testing.T) {
-	m := &Mux{
-		endpoints: make(map[*Endpoint]MatchFunc),
-	}
+	m := &Mux{}
 	e := m.NewEndpoint(MatchRange(0, 255))
 
 	if e.nused != 0 {
@@ -45,6 +47,103 @@ func TestDispatch(t *testing.T) {
 	}
 }
 
+func TestPriority(t *testing.T) {
+	m := &Mux{}
+	low := m.NewEndpoint(MatchAll)
+	high := m.NewEndpointWithPriority(MatchRange(0, 3), 1)
+
+	// The higher priority endpoint gets first pick, despite registering last.
+	m.dispatch([]byte{1})
+	m.dispatch([]byte{100})
+	if high.nused != 1 || low.nused != 1 {
+		t.Errorf("Expected one packet per endpoint: high %d, low %d", high.nused, low.nused)
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	m := &Mux{}
+	e := m.NewEndpoint(MatchRange(0, 3))
+	other := m.NewEndpoint(MatchRange(4, 7))
+
+	if err := m.Unregister(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unregister(e); err == nil {
+		t.Error("Expected error unregistering twice")
+	}
+	if _, err := e.Read(make([]byte, 32)); err != io.EOF {
+		t.Errorf("Expected EOF from unregistered endpoint: %v", err)
+	}
+
+	// Packets for the unregistered endpoint are dropped and counted, while
+	// the other endpoint keeps working.
+	m.dispatch([]byte{1})
+	m.dispatch([]byte{5})
+	if m.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped packet: %d", m.Dropped())
+	}
+	if other.nused != 1 {
+		t.Errorf("Expected other endpoint to receive its packet: %d", other.nused)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	m := &Mux{}
+	e := m.NewEndpoint(MatchAll)
+	other := m.NewEndpoint(MatchAll)
+
+	e.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := e.Read(make([]byte, 32))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Expected timeout: %v", err)
+	}
+
+	// Clearing the deadline wakes up a pending Read, which then waits for a
+	// packet.
+	e.SetReadDeadline(time.Now().Add(time.Hour))
+	done := make(chan error)
+	go func() {
+		_, err := e.Read(make([]byte, 32))
+		done <- err
+	}()
+	e.SetReadDeadline(time.Now())
+	if err := <-done; err != errTimeout {
+		t.Errorf("Expected timeout after deadline change: %v", err)
+	}
+
+	// The other endpoint has no deadline.
+	m.Unregister(e)
+	m.dispatch([]byte("test"))
+	if _, err := other.Read(make([]byte, 32)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	errBroken := errors.New("broken")
+	m := NewMux(brokenConn{errBroken}, 1500)
+	e := m.NewEndpoint(MatchAll)
+
+	// A read error on the underlying conn is passed on to pending reads.
+	if _, err := e.Read(make([]byte, 32)); err != errBroken {
+		t.Errorf("Expected read error from underlying conn: %v", err)
+	}
+}
+
+// A net.Conn whose reads fail with a fixed error.
+type brokenConn struct {
+	err error
+}
+
+func (c brokenConn) Read(p []byte) (int, error)         { return 0, c.err }
+func (c brokenConn) Write(p []byte) (int, error)        { return 0, c.err }
+func (c brokenConn) Close() error                       { return nil }
+func (c brokenConn) LocalAddr() net.Addr                { return nil }
+func (c brokenConn) RemoteAddr() net.Addr               { return nil }
+func (c brokenConn) SetDeadline(t time.Time) error      { return nil }
+func (c brokenConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c brokenConn) SetWriteDeadline(t time.Time) error { return nil }
+
 // Checks if two byte slices refer to the exact same memory region.
 func identical(b1, b2 []byte) bool {
 	return len(b1) == len(b2) &&
@@ -1,6 +1,9 @@
 package packet
 
-import "sync/atomic"
+import (
+	"sync/atomic"
+	"time"
+)
 
 /*
 A SharedBuffer represents a read-only byte buffer that may be accessed
@@ -40,10 +43,67 @@ type SharedBuffer struct {
 
 	count int32
 	done  func()
+
+	captureTime time.Time
+
+	pts    time.Duration
+	hasPTS bool
+
+	continued bool
 }
 
 func NewSharedBuffer(data []byte, count int, done func()) *SharedBuffer {
-	return &SharedBuffer{data, int32(count), done}
+	return &SharedBuffer{data: data, count: int32(count), done: done}
+}
+
+// CaptureTime returns when the data was captured, e.g. by a camera sensor, or
+// the zero time if unknown.
+func (buf *SharedBuffer) CaptureTime() time.Time {
+	return buf.captureTime
+}
+
+// SetCaptureTime records when the data was captured. It must be called before
+// the buffer is shared.
+func (buf *SharedBuffer) SetCaptureTime(t time.Time) {
+	buf.captureTime = t
+}
+
+// PTS returns the presentation time of the data, relative to an origin chosen
+// by its source, and whether it is known. It differs from the capture time
+// when frames are reordered, as with H.264 B-frames.
+func (buf *SharedBuffer) PTS() (time.Duration, bool) {
+	return buf.pts, buf.hasPTS
+}
+
+// SetPTS records the presentation time of the data. It must be called before
+// the buffer is shared.
+func (buf *SharedBuffer) SetPTS(pts time.Duration) {
+	buf.pts = pts
+	buf.hasPTS = true
+}
+
+// Continued reports whether more buffers of the same frame follow, e.g. the
+// remaining slices of a picture.
+func (buf *SharedBuffer) Continued() bool {
+	return buf.continued
+}
+
+// SetContinued marks the buffer as not the last of its frame. It must be
+// called before the buffer is shared.
+func (buf *SharedBuffer) SetContinued(continued bool) {
+	buf.continued = continued
+}
+
+// OnRelease arranges for f to be called, after the done function, when the
+// hold count reaches zero. It must be called before the buffer is shared.
+func (buf *SharedBuffer) OnRelease(f func()) {
+	done := buf.done
+	buf.done = func() {
+		if done != nil {
+			done()
+		}
+		f()
+	}
 }
 
 // Bytes returns the underlying byte buffer.
@@ -0,0 +1,42 @@
+package packet
+
+import "sync"
+
+// A BufferPool recycles byte buffers of a fixed size, so that the packet
+// pipeline doesn't allocate a new buffer for each packet. It is safe for
+// concurrent use.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func NewBufferPool(size int) *BufferPool {
+	p := &BufferPool{size: size}
+	p.pool.New = func() interface{} {
+		return make([]byte, p.size)
+	}
+	return p
+}
+
+// Get returns a buffer of the pool's size. Its contents are arbitrary.
+func (p *BufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+// Put returns a buffer obtained from Get to the pool. The buffer must not be
+// used afterwards. Buffers of the wrong size (e.g. after reslicing beyond
+// their capacity) are discarded.
+func (p *BufferPool) Put(b []byte) {
+	if cap(b) != p.size {
+		return
+	}
+	p.pool.Put(b[:p.size])
+}
+
+// Share wraps data, which must lie within buf, in a SharedBuffer with a hold
+// count of 1. When the last hold is released, buf is returned to the pool.
+func (p *BufferPool) Share(buf, data []byte) *SharedBuffer {
+	return NewSharedBuffer(data, 1, func() {
+		p.Put(buf)
+	})
+}
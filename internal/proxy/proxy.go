@@ -0,0 +1,279 @@
+// Package proxy makes TCP connections through the HTTP and SOCKS proxies that
+// enterprise networks force outgoing traffic through, for signaling and TURN
+// over TLS.
+//
+// A proxy is given by URL: "http://host:port" and "https://host:port" proxies
+// tunnel with the CONNECT method, and "socks5://host:port" proxies with SOCKS
+// version 5 [RFC1928]. "socks5h" is accepted as a synonym, since the proxy
+// resolves host names either way. Credentials in the URL are sent with HTTP
+// basic authentication [RFC7617] or SOCKS username/password authentication
+// [RFC1929].
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Time allowed to connect to the proxy and for it to connect onwards, unless
+// the context has an earlier deadline.
+const dialTimeout = 30 * time.Second
+
+// FromEnvironment returns the proxy to use for connections to addr, from the
+// HTTPS_PROXY and NO_PROXY environment variables (or their lowercase
+// versions), as net/http does. It returns nil if no proxy is configured.
+func FromEnvironment(addr string) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+}
+
+// Check returns an error if u is not a supported proxy URL.
+func Check(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("proxy URL %s has no host", u)
+	}
+	return nil
+}
+
+// Dial connects to addr, a host and port, through the proxy given by u. If u
+// is nil, it connects directly. The connection to the proxy, or to addr, is
+// made with d, e.g. to bind a local address, or a zero Dialer if d is nil.
+func Dial(ctx context.Context, d *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	if u == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	if err := Check(u); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", proxyAddress(u))
+	if err != nil {
+		return nil, err
+	}
+
+	// Abandon the handshake if ctx ends first.
+	raw := conn
+	deadline, _ := ctx.Deadline()
+	raw.SetDeadline(deadline)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			raw.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		err = connectHTTP(conn, u, addr)
+	default:
+		err = connectSOCKS5(conn, u, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", u.Host, err)
+	}
+	raw.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Return the address of the proxy, with the scheme's default port if none is
+// given.
+func proxyAddress(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		default:
+			port = "1080"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Open a tunnel to addr with an HTTP CONNECT request [RFC7231 §4.3.6].
+func connectHTTP(conn net.Conn, u *url.URL, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := u.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// Read the response a byte at a time, so that nothing sent through the
+	// tunnel after it is consumed. The body, if any, is the tunnel itself.
+	resp, err := http.ReadResponse(bufio.NewReader(byteReader{conn}), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s failed: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// A byteReader reads one byte at a time.
+type byteReader struct {
+	r io.Reader
+}
+
+func (br byteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return br.r.Read(b)
+}
+
+// SOCKS version 5 protocol constants [RFC1928].
+const (
+	socksVersion      = 5
+	socksAuthNone     = 0
+	socksAuthPassword = 2
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+	socksSucceeded    = 0
+)
+
+var errSOCKSAuth = errors.New("SOCKS authentication failed")
+
+// Open a tunnel to addr with a SOCKS5 CONNECT request.
+func connectSOCKS5(conn net.Conn, u *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port in %s", addr)
+	}
+
+	// Negotiate authentication.
+	methods := []byte{socksAuthNone}
+	if u.User != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if u.User == nil {
+			return errSOCKSAuth
+		}
+		// [RFC1929 §2]
+		username := u.User.Username()
+		password, _ := u.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS credentials too long")
+		}
+		req := []byte{1, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errSOCKSAuth
+		}
+	default:
+		return errSOCKSAuth
+	}
+
+	// Request a connection. Host names are resolved by the proxy, since the
+	// local network may not resolve external names.
+	req := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %s", host)
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksIPv6)
+		req = append(req, ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply carries the proxy's bound address, which is not needed.
+	var header [5]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != socksSucceeded {
+		return fmt.Errorf("SOCKS CONNECT %s failed with code %d", addr, header[1])
+	}
+	var n int
+	switch header[3] {
+	case socksIPv4:
+		n = net.IPv4len - 1
+	case socksIPv6:
+		n = net.IPv6len - 1
+	case socksDomain:
+		n = int(header[4])
+	default:
+		return fmt.Errorf("unexpected SOCKS address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
@@ -0,0 +1,199 @@
+package rtp
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+// RTP packetization of audio streams, one frame per packet.
+
+// SendAudio sends each frame delivered by src in its own RTP packet. If src is
+// a media.AudioLevelMeter, each packet carries the audio level header
+// extension (when negotiated), and silent frames are skipped if SkipSilence
+// is set.
+func (s *Stream) SendAudio(quit <-chan struct{}, payloadType byte, src media.AudioSource) error {
+	w := s.rtpOut
+	meter, _ := src.(media.AudioLevelMeter)
+	codec := src.Codec()
+	if strings.EqualFold(codec, "opus") {
+		w.clockRate = 48000
+	} else {
+		w.clockRate = src.SampleRate()
+	}
+	var timestamp uint32
+
+	queueSize := s.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	r := src.AddReceiver(queueSize)
+	defer src.RemoveReceiver(r)
+
+	reportTicker := s.clock.NewTicker(2 * time.Second)
+	defer reportTicker.Stop()
+
+	// The first packet of each talkspurt has the marker bit set. Its timestamp
+	// is taken from the session's shared clock; later ones count samples.
+	// See https://tools.ietf.org/html/rfc3551#section-4.1
+	talkspurt := true
+	started := false
+
+	for {
+		select {
+		case <-quit:
+			return nil
+		case buf, more := <-r.Buffers():
+			if !more {
+				log.Debug("SendAudio %d stopping: %v", payloadType, r.Err())
+				return r.Err()
+			}
+			frame := buf.Bytes()
+			samples := audioFrameSamples(codec, frame, src.BytesPerSample())
+			if talkspurt {
+				ts := w.clockTimestamp(w.clock.Now())
+				if !started || int32(ts-timestamp) > 0 {
+					timestamp = ts
+				}
+				started = true
+			}
+
+			var extra []rtpExtension
+			if meter != nil {
+				if level, voice, ok := meter.FrameLevel(frame); ok {
+					if s.SkipSilence && !voice {
+						buf.Release()
+						timestamp += uint32(samples)
+						talkspurt = true
+						continue
+					}
+					if id := w.extensionIDs.audioLevel; id != 0 {
+						extra = append(extra, audioLevelExtension(id, level, voice))
+					}
+				}
+			}
+
+			err := w.writePacketWithExtensions(payloadType, talkspurt, timestamp, frame, extra)
+			buf.Release()
+			if err != nil {
+				return err
+			}
+			timestamp += uint32(samples)
+			talkspurt = false
+		case <-reportTicker.C:
+			s.sendSenderReport()
+		}
+	}
+}
+
+// ReceiveAudio passes each received frame to consume, in the sender's order,
+// until quit is closed, or until the remote source says goodbye, when it
+// returns ErrGoodbye. Frames given up as lost are skipped, for the decoder
+// to conceal.
+func (s *Stream) ReceiveAudio(quit <-chan struct{}, consume func(buf *packet.SharedBuffer) error) error {
+	r := s.rtpIn
+	frames := make(chan *packet.SharedBuffer, 16)
+	done := make(chan struct{})
+	defer close(done)
+
+	jitter := newJitterBuffer(s.JitterBufferDepth)
+	jitter.setStart(s.ReceiveStart)
+	jitter.emit = func(hdr rtpHeader, payload []byte) error {
+		if len(payload) == 0 {
+			// Padding only.
+			return nil
+		}
+		frame := make([]byte, len(payload))
+		copy(frame, payload)
+		select {
+		case frames <- packet.NewSharedBuffer(frame, 1, nil):
+		case <-done:
+		}
+		return nil
+	}
+	jitter.lost = func(first uint16, n int) {
+		log.Debug("lost %d audio packets starting at %d", n, first)
+		atomic.AddUint64(&r.lost, uint64(n))
+	}
+	jitter.late = func() {
+		atomic.AddUint64(&r.late, 1)
+	}
+
+	s.readMutex.Lock()
+	r.handler = func(hdr rtpHeader, payload []byte) error {
+		return jitter.push(hdr, payload, r.clock.Now())
+	}
+	s.readMutex.Unlock()
+
+	reportDue := make(chan struct{}, 1)
+	stopReport := s.scheduleReceiverReport(reportDue)
+	defer func() { stopReport() }()
+
+	for {
+		select {
+		case <-quit:
+			return nil
+		case <-s.goodbye:
+			return ErrGoodbye
+		case buf, more := <-frames:
+			if !more {
+				return io.EOF
+			}
+			if err := consume(buf); err != nil {
+				return err
+			}
+		case <-reportDue:
+			s.sendReceiverReport()
+			stopReport = s.scheduleReceiverReport(reportDue)
+		}
+	}
+}
+
+// Return the number of samples, in RTP clock units, in an encoded frame.
+func audioFrameSamples(codec string, frame []byte, bytesPerSample int) int {
+	if strings.EqualFold(codec, "opus") {
+		return opusFrameSamples(frame)
+	}
+	if bytesPerSample <= 0 {
+		bytesPerSample = 1
+	}
+	return len(frame) / bytesPerSample
+}
+
+// Duration of each Opus frame, in 48 kHz samples, by TOC configuration number.
+// The RTP clock for Opus is always 48 kHz, whatever the encoded bandwidth.
+// See https://tools.ietf.org/html/rfc6716#section-3.1
+// and https://tools.ietf.org/html/rfc7587#section-4.1
+var opusConfigSamples = [32]int{
+	// SILK: 10, 20, 40, 60 ms
+	480, 960, 1920, 2880, 480, 960, 1920, 2880, 480, 960, 1920, 2880,
+	// Hybrid: 10, 20 ms
+	480, 960, 480, 960,
+	// CELT: 2.5, 5, 10, 20 ms
+	120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960,
+}
+
+// Return the number of 48 kHz samples in an Opus packet, from its TOC byte.
+func opusFrameSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	n := opusConfigSamples[toc>>3]
+	switch toc & 0x3 {
+	case 0:
+		return n
+	case 1, 2:
+		return 2 * n
+	default:
+		// Code 3: frame count in the next byte.
+		if len(packet) < 2 {
+			return 0
+		}
+		return int(packet[1]&0x3f) * n
+	}
+}
@@ -0,0 +1,38 @@
+package rtp
+
+import (
+	"testing"
+)
+
+func TestOpusFrameSamples(t *testing.T) {
+	cases := []struct {
+		packet  []byte
+		samples int
+	}{
+		{[]byte{0x78}, 960},              // CELT 20 ms, one frame
+		{[]byte{0x79}, 1920},             // two frames
+		{[]byte{0x08 | 0x3, 0x03}, 2880}, // SILK 20 ms, code 3 with three frames
+		{[]byte{0x60}, 480},              // hybrid 10 ms
+		{nil, 0},
+	}
+	for _, c := range cases {
+		if n := opusFrameSamples(c.packet); n != c.samples {
+			t.Errorf("%x: expected %d samples, not %d", c.packet, c.samples, n)
+		}
+	}
+
+	if n := audioFrameSamples("PCMU", make([]byte, 160), 1); n != 160 {
+		t.Errorf("PCMU: expected 160 samples, not %d", n)
+	}
+}
+
+func TestAudioLevelExtension(t *testing.T) {
+	ext := audioLevelExtension(1, 30, true)
+	if ext.id != 1 || len(ext.data) != 1 || ext.data[0] != 0x80|30 {
+		t.Errorf("unexpected audio level extension: %#v", ext)
+	}
+	ext = audioLevelExtension(1, 127, false)
+	if ext.data[0] != 127 {
+		t.Errorf("unexpected audio level extension: %#v", ext)
+	}
+}
@@ -12,6 +12,7 @@ import (
 const (
 	fmtNACK = 1
 	fmtPLI  = 1
+	fmtAFB  = 15
 )
 
 func newFeedbackPacket(packetType byte, fmt int) rtcpPacket {
@@ -24,6 +25,8 @@ func newFeedbackPacket(packetType byte, fmt int) rtcpPacket {
 		switch fmt {
 		case fmtPLI:
 			return new(pliFeedbackMessage)
+		case fmtAFB:
+			return new(rembFeedbackMessage)
 		}
 	}
 
@@ -134,3 +137,81 @@ func (pli *pliFeedbackMessage) readFrom(r *packet.Reader, h *rtcpHeader) error {
 	pli.source = r.ReadUint32()
 	return nil
 }
+
+// Receiver Estimated Maximum Bitrate, an application layer feedback message.
+// See https://tools.ietf.org/html/draft-alvestrand-rmcat-remb-03#section-2.2
+type rembFeedbackMessage struct {
+	sender uint32 // SSRC of REMB sender
+
+	bitrate uint64   // estimated maximum bitrate, in bits per second
+	ssrcs   []uint32 // SSRCs of the media sources the estimate applies to
+
+	// Set if the application layer feedback message was not REMB, in which
+	// case the other fields are meaningless.
+	unknown bool
+}
+
+const rembIdentifier = "REMB"
+
+func (remb *rembFeedbackMessage) writeTo(w *packet.Writer) error {
+	h := rtcpHeader{
+		packetType: rtcpPayloadSpecificFeedbackType,
+		count:      fmtAFB,
+		length:     4 + len(remb.ssrcs),
+	}
+	if err := h.writeTo(w); err != nil {
+		return err
+	}
+
+	if err := w.CheckCapacity(4 * h.length); err != nil {
+		return err
+	}
+
+	// The bitrate is encoded as an 18-bit mantissa and 6-bit exponent.
+	mantissa, exp := remb.bitrate, uint(0)
+	for mantissa >= 1<<18 {
+		mantissa >>= 1
+		exp++
+	}
+
+	w.WriteUint32(remb.sender)
+	w.WriteUint32(0) // media source is unused
+	w.WriteString(rembIdentifier)
+	w.WriteByte(byte(len(remb.ssrcs)))
+	w.WriteByte(byte(exp<<2) | byte(mantissa>>16))
+	w.WriteUint16(uint16(mantissa))
+	for _, ssrc := range remb.ssrcs {
+		w.WriteUint32(ssrc)
+	}
+	return nil
+}
+
+func (remb *rembFeedbackMessage) readFrom(r *packet.Reader, h *rtcpHeader) error {
+	if h.length < 4 {
+		return errors.Errorf("invalid application layer Feedback Message: length = %d", h.length)
+	}
+	if err := r.CheckRemaining(4 * h.length); err != nil {
+		return err
+	}
+	remb.sender = r.ReadUint32()
+	r.Skip(4) // media source
+	if r.ReadString(4) != rembIdentifier {
+		remb.unknown = true
+		r.Skip(4 * (h.length - 3))
+		return nil
+	}
+
+	n := int(r.ReadByte())
+	if n != h.length-4 {
+		return errors.Errorf("invalid REMB Feedback Message: length = %d, SSRCs = %d", h.length, n)
+	}
+	b := r.ReadByte()
+	exp := uint(b >> 2)
+	mantissa := uint64(b&0x03)<<16 | uint64(r.ReadUint16())
+	remb.bitrate = mantissa << exp
+	remb.ssrcs = make([]uint32, n)
+	for i := range remb.ssrcs {
+		remb.ssrcs[i] = r.ReadUint32()
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package rtp
 
 import (
 	"testing"
+
+	"github.com/lanikai/alohartc/internal/packet"
 )
 
 func TestNACK(t *testing.T) {
@@ -20,3 +22,37 @@ func TestNACK(t *testing.T) {
 		t.Errorf("unexpected NACK lost packets: %v", lost)
 	}
 }
+
+func TestREMB(t *testing.T) {
+	in := rembFeedbackMessage{
+		sender:  0x01020304,
+		bitrate: 1500000,
+		ssrcs:   []uint32{0xaabbccdd},
+	}
+	w := packet.NewWriterSize(64)
+	if err := in.writeTo(w); err != nil {
+		t.Fatal(err)
+	}
+
+	r := packet.NewReader(w.Bytes())
+	var h rtcpHeader
+	if err := h.readFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	p := newFeedbackPacket(h.packetType, h.count)
+	out, ok := p.(*rembFeedbackMessage)
+	if !ok {
+		t.Fatalf("expected REMB, got %T", p)
+	}
+	if err := out.readFrom(r, &h); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1500000 needs 3 bits of exponent, so the low bits are truncated.
+	if out.bitrate != 1500000&^0x7 {
+		t.Errorf("expected bitrate %d, not %d", 1500000&^0x7, out.bitrate)
+	}
+	if out.unknown || out.sender != in.sender || len(out.ssrcs) != 1 || out.ssrcs[0] != in.ssrcs[0] {
+		t.Errorf("unexpected REMB: %#v", out)
+	}
+}
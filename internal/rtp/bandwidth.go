@@ -0,0 +1,185 @@
+package rtp
+
+import (
+	"sort"
+	"sync"
+)
+
+// Stream priorities for bandwidth allocation. Audio is cheap and matters most
+// to a conversation, so it is served before video.
+const (
+	PriorityAudio = 2
+	PriorityVideo = 1
+)
+
+// A BandwidthAllocator divides the bitrate available to a session among its
+// streams, so that streams sharing a transport don't each try to saturate the
+// link. The target is the session's estimate of available bandwidth, e.g. from
+// REMB feedback.
+//
+// Every stream first receives its minimum bitrate, in priority order. What
+// remains is then given out in priority order, up to each stream's maximum,
+// and split evenly between streams of equal priority.
+type BandwidthAllocator struct {
+	mu sync.Mutex
+
+	// Target bitrate for the session, in bits per second. Zero until the
+	// first estimate arrives.
+	target int
+
+	// Sorted by decreasing priority.
+	shares []*BandwidthShare
+}
+
+// A BandwidthShare is one stream's portion of a BandwidthAllocator's target.
+type BandwidthShare struct {
+	priority int
+	min      int
+	max      int
+
+	// Called with the new bitrate whenever the allocation changes.
+	apply func(bps int)
+
+	// Current allocation, in bits per second.
+	allocated int
+}
+
+// Add a stream with the given priority and bitrate limits, in bits per second.
+// A max of zero means no limit. apply is called, without the allocator's lock
+// held, whenever the stream's allocation changes.
+func (a *BandwidthAllocator) Add(priority, min, max int, apply func(bps int)) *BandwidthShare {
+	share := &BandwidthShare{
+		priority: priority,
+		min:      min,
+		max:      max,
+		apply:    apply,
+	}
+
+	a.mu.Lock()
+	a.shares = append(a.shares, share)
+	sort.SliceStable(a.shares, func(i, j int) bool {
+		return a.shares[i].priority > a.shares[j].priority
+	})
+	a.mu.Unlock()
+
+	a.reallocate()
+	return share
+}
+
+// Remove a stream, and redistribute its allocation to the others.
+func (a *BandwidthAllocator) Remove(share *BandwidthShare) {
+	a.mu.Lock()
+	for i, s := range a.shares {
+		if s == share {
+			a.shares = append(a.shares[:i], a.shares[i+1:]...)
+			break
+		}
+	}
+	a.mu.Unlock()
+
+	a.reallocate()
+}
+
+// SetTarget updates the session's target bitrate, in bits per second.
+func (a *BandwidthAllocator) SetTarget(bps int) {
+	a.mu.Lock()
+	changed := bps != a.target
+	a.target = bps
+	a.mu.Unlock()
+
+	if changed {
+		a.reallocate()
+	}
+}
+
+// Target returns the session's target bitrate, in bits per second.
+func (a *BandwidthAllocator) Target() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.target
+}
+
+func (a *BandwidthAllocator) reallocate() {
+	type update struct {
+		share *BandwidthShare
+		bps   int
+	}
+	var updates []update
+
+	a.mu.Lock()
+	if a.target > 0 {
+		alloc := allocateBandwidth(a.target, a.shares)
+		for i, s := range a.shares {
+			if alloc[i] != s.allocated {
+				s.allocated = alloc[i]
+				updates = append(updates, update{s, alloc[i]})
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	for _, u := range updates {
+		if u.share.apply != nil {
+			u.share.apply(u.bps)
+		}
+	}
+}
+
+// Divide the target among shares, which are sorted by decreasing priority.
+func allocateBandwidth(target int, shares []*BandwidthShare) []int {
+	alloc := make([]int, len(shares))
+	remaining := target
+
+	// Minimums first.
+	for i, s := range shares {
+		n := s.min
+		if n > remaining {
+			n = remaining
+		}
+		alloc[i] = n
+		remaining -= n
+	}
+
+	// Then fill each priority level in turn, splitting evenly between streams
+	// of the same priority. A stream that reaches its maximum leaves the rest
+	// to its peers.
+	for start := 0; start < len(shares) && remaining > 0; {
+		end := start + 1
+		for end < len(shares) && shares[end].priority == shares[start].priority {
+			end++
+		}
+
+		for remaining > 0 {
+			var open []int
+			for i := start; i < end; i++ {
+				if shares[i].max == 0 || alloc[i] < shares[i].max {
+					open = append(open, i)
+				}
+			}
+			if len(open) == 0 {
+				break
+			}
+
+			each := remaining / len(open)
+			if each == 0 {
+				// Hand out the last few bits one at a time.
+				each = 1
+			}
+			for _, i := range open {
+				n := each
+				if max := shares[i].max; max > 0 && alloc[i]+n > max {
+					n = max - alloc[i]
+				}
+				if n > remaining {
+					n = remaining
+				}
+				alloc[i] += n
+				remaining -= n
+			}
+		}
+
+		start = end
+	}
+
+	return alloc
+}
@@ -0,0 +1,55 @@
+package rtp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllocateBandwidth(t *testing.T) {
+	audio := &BandwidthShare{priority: PriorityAudio, min: 20000, max: 64000}
+	video1 := &BandwidthShare{priority: PriorityVideo, min: 100000}
+	video2 := &BandwidthShare{priority: PriorityVideo, min: 100000, max: 300000}
+	shares := []*BandwidthShare{audio, video1, video2}
+
+	cases := []struct {
+		target int
+		expect []int
+	}{
+		// Not enough for every minimum: audio first.
+		{50000, []int{20000, 30000, 0}},
+		// Audio is filled to its maximum before video gets more than its
+		// minimum.
+		{250000, []int{50000, 100000, 100000}},
+		// Video streams split the rest evenly, up to their maximums.
+		{464000, []int{64000, 200000, 200000}},
+		{1064000, []int{64000, 700000, 300000}},
+	}
+	for _, c := range cases {
+		alloc := allocateBandwidth(c.target, shares)
+		if !reflect.DeepEqual(alloc, c.expect) {
+			t.Errorf("target %d: expected %v, not %v", c.target, c.expect, alloc)
+		}
+	}
+}
+
+func TestBandwidthAllocator(t *testing.T) {
+	var a BandwidthAllocator
+	var audio, video []int
+	a.Add(PriorityVideo, 100000, 0, func(bps int) { video = append(video, bps) })
+	share := a.Add(PriorityAudio, 20000, 64000, func(bps int) { audio = append(audio, bps) })
+
+	// Nothing is applied until there's a target.
+	if len(audio)+len(video) != 0 {
+		t.Errorf("unexpected allocation before target: %v %v", audio, video)
+	}
+
+	a.SetTarget(1000000)
+	a.SetTarget(1000000)
+	a.Remove(share)
+	if !reflect.DeepEqual(audio, []int{64000}) {
+		t.Errorf("unexpected audio allocations: %v", audio)
+	}
+	if !reflect.DeepEqual(video, []int{936000, 1000000}) {
+		t.Errorf("unexpected video allocations: %v", video)
+	}
+}
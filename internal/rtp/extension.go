@@ -0,0 +1,229 @@
+package rtp
+
+import (
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+// RTP header extensions, in the one-byte and two-byte formats.
+// See [RFC 8285](https://tools.ietf.org/html/rfc8285).
+
+// Header extension URIs, as negotiated by SDP `extmap` attributes.
+const (
+	// Time at which the packet was sent, used by receive-side bandwidth
+	// estimation (REMB).
+	// See https://webrtc.org/experiments/rtp-hdrext/abs-send-time/
+	ExtensionAbsSendTime = "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time"
+
+	// Media identification, binding the stream to its SDP media section.
+	// See https://tools.ietf.org/html/rfc8843#section-15.1
+	ExtensionMID = "urn:ietf:params:rtp-hdrext:sdes:mid"
+
+	// Transport-wide sequence number, shared by all streams in a session,
+	// used by send-side bandwidth estimation.
+	// See https://tools.ietf.org/html/draft-holmer-rmcat-transport-wide-cc-extensions-01
+	ExtensionTransportCC = "http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01"
+
+	// Level of the audio in each packet, and whether it contains voice, so
+	// the receiver can render level meters without decoding.
+	// See https://tools.ietf.org/html/rfc6464
+	ExtensionAudioLevel = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+
+	// Bounds on the delay the receiver adds before rendering, e.g. zero for
+	// a browser to render video as soon as it is decoded.
+	// See https://webrtc.org/experiments/rtp-hdrext/playout-delay/
+	ExtensionPlayoutDelay = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
+)
+
+// A PlayoutDelay bounds the delay that the receiver adds between receiving and
+// rendering media, e.g. for its jitter buffer. Both are rounded down to 10 ms,
+// and limited to 40.95 s.
+type PlayoutDelay struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+const (
+	extensionProfileOneByte = 0xBEDE
+	extensionProfileTwoByte = 0x1000 // "appbits" in the low 4 bits are zero
+
+	// Largest ID and data length representable in the one-byte format.
+	maxOneByteID     = 14
+	maxOneByteLength = 16
+)
+
+// A single RTP header extension element.
+type rtpExtension struct {
+	id   byte
+	data []byte
+}
+
+// Return the encoded size of the extension block, including its 4-byte
+// header, or 0 if there are no extensions.
+func extensionBlockSize(exts []rtpExtension) int {
+	if len(exts) == 0 {
+		return 0
+	}
+	n := 0
+	oneByte := useOneByteFormat(exts)
+	for _, ext := range exts {
+		if oneByte {
+			n += 1 + len(ext.data)
+		} else {
+			n += 2 + len(ext.data)
+		}
+	}
+	// Pad to a multiple of 4 bytes.
+	return 4 + (n+3)&^3
+}
+
+func useOneByteFormat(exts []rtpExtension) bool {
+	for _, ext := range exts {
+		if ext.id > maxOneByteID || len(ext.data) == 0 || len(ext.data) > maxOneByteLength {
+			return false
+		}
+	}
+	return true
+}
+
+// See https://tools.ietf.org/html/rfc8285#section-4.2
+// and https://tools.ietf.org/html/rfc8285#section-4.3
+func writeExtensions(w *packet.Writer, exts []rtpExtension) {
+	size := extensionBlockSize(exts)
+	oneByte := useOneByteFormat(exts)
+	if oneByte {
+		w.WriteUint16(extensionProfileOneByte)
+	} else {
+		w.WriteUint16(extensionProfileTwoByte)
+	}
+	w.WriteUint16(uint16((size - 4) / 4))
+
+	start := w.Length()
+	for _, ext := range exts {
+		if oneByte {
+			w.WriteByte(ext.id<<4 | byte(len(ext.data)-1))
+		} else {
+			w.WriteByte(ext.id)
+			w.WriteByte(byte(len(ext.data)))
+		}
+		w.WriteSlice(ext.data)
+	}
+	w.ZeroPad(size - 4 - (w.Length() - start))
+}
+
+// Parse an extension block. Returns the block size, including its header.
+// Extensions in unrecognized profiles are skipped.
+func readExtensions(r *packet.Reader) (exts []rtpExtension, size int, err error) {
+	if err = r.CheckRemaining(4); err != nil {
+		return nil, 0, errors.Errorf("short buffer: %v", err)
+	}
+	profile := r.ReadUint16()
+	n := 4 * int(r.ReadUint16())
+	if err = r.CheckRemaining(n); err != nil {
+		return nil, 0, errors.Errorf("short buffer: %v", err)
+	}
+	body := r.ReadSlice(n)
+	size = 4 + n
+
+	var oneByte bool
+	switch {
+	case profile == extensionProfileOneByte:
+		oneByte = true
+	case profile&0xfff0 == extensionProfileTwoByte:
+		oneByte = false
+	default:
+		return nil, size, nil
+	}
+
+	for i := 0; i < len(body); {
+		var id byte
+		var length int
+		if oneByte {
+			id = body[i] >> 4
+			length = int(body[i]&0x0f) + 1
+			if id == 0 {
+				// Padding.
+				i++
+				continue
+			}
+			if id == 15 {
+				// Reserved; stop processing [RFC8285 §4.2].
+				break
+			}
+			i++
+		} else {
+			id = body[i]
+			if id == 0 {
+				i++
+				continue
+			}
+			if i+1 >= len(body) {
+				return nil, 0, errors.New("truncated RTP header extension")
+			}
+			length = int(body[i+1])
+			i += 2
+		}
+		if i+length > len(body) {
+			return nil, 0, errors.New("truncated RTP header extension")
+		}
+		exts = append(exts, rtpExtension{id, body[i : i+length]})
+		i += length
+	}
+	return exts, size, nil
+}
+
+// Header extension IDs negotiated for a stream, keyed by URI. A zero ID means
+// the extension is not used.
+type extensionIDs struct {
+	absSendTime  byte
+	mid          byte
+	transportCC  byte
+	audioLevel   byte
+	playoutDelay byte
+}
+
+func makeExtensionIDs(m map[string]byte) extensionIDs {
+	return extensionIDs{
+		absSendTime:  m[ExtensionAbsSendTime],
+		mid:          m[ExtensionMID],
+		transportCC:  m[ExtensionTransportCC],
+		audioLevel:   m[ExtensionAudioLevel],
+		playoutDelay: m[ExtensionPlayoutDelay],
+	}
+}
+
+// Encode a playout delay as two 12-bit numbers of 10 ms units.
+func playoutDelayExtension(id byte, d PlayoutDelay) rtpExtension {
+	units := func(t time.Duration) uint32 {
+		n := uint32(t / (10 * time.Millisecond))
+		if t < 0 {
+			n = 0
+		} else if n > 0xfff {
+			n = 0xfff
+		}
+		return n
+	}
+	v := units(d.Min)<<12 | units(d.Max)
+	return rtpExtension{id, []byte{byte(v >> 16), byte(v >> 8), byte(v)}}
+}
+
+// Encode an audio level, in -dBov, and voice activity flag.
+// See https://tools.ietf.org/html/rfc6464#section-3
+func audioLevelExtension(id byte, level int, voice bool) rtpExtension {
+	b := byte(level) & 0x7f
+	if voice {
+		b |= 0x80
+	}
+	return rtpExtension{id, []byte{b}}
+}
+
+// Encode a time as abs-send-time, a 6.18 fixed point number of seconds, modulo
+// 64. The NTP epoch is a multiple of 64 seconds before the Unix epoch, so Unix
+// time gives the same result.
+func absSendTime(t time.Time) []byte {
+	v := uint32(t.Unix()&0x3f)<<18 | uint32(uint64(t.Nanosecond())<<18/1e9)
+	return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+}
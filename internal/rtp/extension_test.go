@@ -0,0 +1,90 @@
+package rtp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+func TestHeaderExtensions(t *testing.T) {
+	for _, exts := range [][]rtpExtension{
+		// One-byte format, padded to 4 bytes.
+		{{3, []byte{1, 2, 3}}, {4, []byte("0")}},
+		// Two-byte format, because of the large ID.
+		{{3, []byte{1, 2, 3}}, {20, []byte("video")}},
+	} {
+		in := rtpHeader{
+			payloadType: 96,
+			sequence:    1234,
+			ssrc:        0xdeadbeef,
+			extensions:  exts,
+		}
+		w := packet.NewWriterSize(64)
+		in.writeTo(w)
+		w.WriteSlice([]byte("payload"))
+		if w.Length()%4 != 3 {
+			t.Errorf("extension block not padded: %x", w.Bytes())
+		}
+
+		var out rtpHeader
+		buf := w.Bytes()
+		if err := out.readFrom(packet.NewReader(buf)); err != nil {
+			t.Fatal(err)
+		}
+		if !out.extension || out.length() != in.length() {
+			t.Errorf("header length %d, expected %d", out.length(), in.length())
+		}
+		if !bytes.Equal(buf[out.length():], []byte("payload")) {
+			t.Errorf("unexpected payload: %x", buf[out.length():])
+		}
+		for _, ext := range exts {
+			if got := out.getExtension(ext.id); !bytes.Equal(got, ext.data) {
+				t.Errorf("extension %d: expected %x, got %x", ext.id, ext.data, got)
+			}
+		}
+	}
+}
+
+func TestUnknownExtensionProfile(t *testing.T) {
+	buf := []byte{
+		0x90, 96, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, // header with X bit
+		0x12, 0x34, 0, 1, 1, 2, 3, 4, // unknown profile, one word
+		0xff, // payload
+	}
+	var h rtpHeader
+	if err := h.readFrom(packet.NewReader(buf)); err != nil {
+		t.Fatal(err)
+	}
+	if h.length() != 20 || len(h.extensions) != 0 {
+		t.Errorf("unexpected header: %+v", h)
+	}
+
+	// Truncated extension block.
+	if err := h.readFrom(packet.NewReader(buf[:18])); err == nil {
+		t.Error("expected error for truncated extension block")
+	}
+}
+
+func TestAbsSendTime(t *testing.T) {
+	// 65.5 seconds is 1.5 modulo 64, i.e. 0x60000 in 6.18 fixed point.
+	got := absSendTime(time.Unix(65, 500000000))
+	if !bytes.Equal(got, []byte{0x06, 0x00, 0x00}) {
+		t.Errorf("unexpected abs-send-time: %x", got)
+	}
+}
+
+func TestPlayoutDelayExtension(t *testing.T) {
+	// 100 ms to 2 s, i.e. 10 and 200 units: 0x00a and 0x0c8.
+	ext := playoutDelayExtension(5, PlayoutDelay{Min: 100 * time.Millisecond, Max: 2 * time.Second})
+	if ext.id != 5 || !bytes.Equal(ext.data, []byte{0x00, 0xa0, 0xc8}) {
+		t.Errorf("unexpected playout delay: %d %x", ext.id, ext.data)
+	}
+
+	// Zero asks for rendering as soon as possible; too long is clamped.
+	ext = playoutDelayExtension(5, PlayoutDelay{Max: time.Minute})
+	if !bytes.Equal(ext.data, []byte{0x00, 0x0f, 0xff}) {
+		t.Errorf("unexpected playout delay: %x", ext.data)
+	}
+}
@@ -0,0 +1,28 @@
+// +build gofuzz
+
+package rtp
+
+// Fuzz is the entry point for go-fuzz. See the README for usage. Like
+// Session.readLoop, it reads data as an RTP or RTCP packet depending on its
+// packet type. The corpus in testdata/fuzz/corpus holds RTP packets and the
+// RTCP packets that browsers send.
+func Fuzz(data []byte) int {
+	isRTCP, ssrc, err := identifyPacket(data)
+	if err != nil {
+		return 0
+	}
+
+	if isRTCP {
+		r := newRTCPReader(ssrc, nil)
+		r.handler = func(p rtcpPacket) error { return nil }
+		err = r.readPacket(data)
+	} else {
+		r := newRTPReader(ssrc, nil)
+		r.handler = func(hdr rtpHeader, payload []byte) error { return nil }
+		err = r.readPacket(data)
+	}
+	if err != nil {
+		return 0
+	}
+	return 1
+}
@@ -3,10 +3,12 @@ package rtp
 import (
 	"bytes"
 	"io"
-	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/h264"
 	"github.com/lanikai/alohartc/internal/packet"
 )
 
@@ -26,34 +28,84 @@ func (s *Stream) SendVideo(quit <-chan struct{}, payloadType byte, src media.Vid
 	w := h264Writer{
 		rtpWriter:   s.rtpOut,
 		payloadType: payloadType,
-		timestamp:   rand.Uint32(),
+		latency:     &s.latency,
 	}
+	w.clockRate = 90000
 
 	resendPackets := make(chan uint16, 16)
 
+	s.readMutex.Lock()
 	s.rtcpIn.handler = func(pkt rtcpPacket) error {
 		switch p := pkt.(type) {
+		case *rtcpSenderReport:
+			s.handleSenderReport(p)
 		case *rtcpReceiverReport:
 			log.Debug("Received ReceiverReport for stream %d: %#v", payloadType, p)
+			s.handleReceiverReport(p)
+		case *rtcpExtendedReport:
+			s.handleExtendedReport(p)
 		case *nackFeedbackMessage:
 			log.Debug("Received NACK for stream %d: %#v", payloadType, p)
 			for _, pid := range p.getLostPackets() {
-				resendPackets <- pid
+				select {
+				case resendPackets <- pid:
+				default:
+					// Too many to resend. The receiver will ask again.
+				}
 			}
 		case *pliFeedbackMessage:
 			log.Debug("Received PLI for stream %d: %#v", payloadType, p)
-			// TODO: src.TriggerIFrame()
+			if kr, ok := src.(media.KeyframeRequester); ok {
+				if err := kr.RequestKeyframe(); err != nil {
+					log.Debug("Failed to request keyframe: %v", err)
+				}
+			}
+		case *rembFeedbackMessage:
+			log.Debug("Received REMB for stream %d: %d bps", payloadType, p.bitrate)
+			s.handleREMB(p)
+		case *rtcpGoodbye:
+			s.handleGoodbye(p)
 		default:
 			log.Debug("Received unrecognized RTCP packet for stream %d: %#v", payloadType, p)
 		}
-		// TODO: FIR, REMB, others
+		// TODO: FIR, others
 		return nil
 	}
-
-	r := src.AddReceiver(16)
+	s.readMutex.Unlock()
+
+	// Once stopped, e.g. because the track was removed, stop handling
+	// feedback for it too.
+	defer func() {
+		s.readMutex.Lock()
+		s.rtcpIn.handler = s.handleControl
+		s.readMutex.Unlock()
+	}()
+
+	queueSize := s.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	r := s.addVideoReceiver(src, queueSize)
+	defer s.retireDropCounter()
 	defer src.RemoveReceiver(r)
 
+	// Periodically ask the remote peer for a DLRR response, to measure
+	// round-trip time.
+	reportTicker := s.clock.NewTicker(2 * time.Second)
+	defer reportTicker.Stop()
+
 	for {
+		if s.PrioritizeResend {
+			// A late retransmission is useless to a receiver with no jitter
+			// buffer, so don't let it wait behind new media.
+			select {
+			case seq := <-resendPackets:
+				w.resend(seq)
+				continue
+			default:
+			}
+		}
+
 		select {
 		case <-quit:
 			return nil
@@ -62,38 +114,154 @@ func (s *Stream) SendVideo(quit <-chan struct{}, payloadType byte, src media.Vid
 				log.Debug("SendVideo %d stopping: %v", payloadType, r.Err())
 				return r.Err()
 			}
-			err := w.packetize(buf.Bytes())
+			err := w.packetizeBuffer(buf)
 			buf.Release()
 			if err != nil {
 				return err
 			}
 		case seq := <-resendPackets:
 			w.resend(seq)
+		case <-reportTicker.C:
+			s.sendSenderReport()
 		}
 		// TODO: Sender reports, RTCP feedback, etc.
 	}
 }
 
+// Add a receiver to src, which drops whole groups of pictures according to
+// the stream's drop policy if the source supports it, and count its drops.
+func (s *Stream) addVideoReceiver(src media.VideoSource, queueSize int) media.Receiver {
+	adder, ok := src.(media.VideoReceiverAdder)
+	if !ok {
+		return src.AddReceiver(queueSize)
+	}
+	var requestKeyframe func()
+	if kr, ok := src.(media.KeyframeRequester); ok {
+		requestKeyframe = func() {
+			if err := kr.RequestKeyframe(); err != nil {
+				log.Debug("Failed to request keyframe: %v", err)
+			}
+		}
+	}
+	r := adder.AddVideoReceiver(queueSize, s.DropPolicy, requestKeyframe)
+	if counter, ok := r.(media.DropCounter); ok {
+		s.dropMutex.Lock()
+		s.dropCounter = counter
+		s.dropMutex.Unlock()
+	}
+	return r
+}
+
+// Fold the drops of the current receiver into the stream's totals, once it
+// is removed.
+func (s *Stream) retireDropCounter() {
+	s.dropMutex.Lock()
+	defer s.dropMutex.Unlock()
+	if s.dropCounter != nil {
+		s.drops = s.drops.Add(s.dropCounter.Drops())
+		s.dropCounter = nil
+	}
+}
+
 type h264Writer struct {
 	*rtpWriter
 
 	payloadType byte
-	timestamp   uint32
+
+	// Timestamp of the current picture.
+	timestamp uint32
+	started   bool
+
+	// RTP timestamp of presentation time zero, for sources that give
+	// presentation times.
+	ptsBase    uint32
+	ptsStarted bool
+
+	// Duration of a frame in clock ticks, from the frame rate signaled in
+	// the most recent SPS, or 0 if unknown.
+	frameTicks uint32
 
 	// Accumulated STAP-A packet. This is initialized when a SPS or PPS is
 	// encountered, and saved until the next coded picture needs to be sent.
 	stap []byte
+
+	// Reused for assembling each FU-A payload.
+	fragment []byte
+
+	// Where to record the delays of sent pictures, or nil.
+	latency *sendLatency
 }
 
-func (w *h264Writer) packetize(nalu []byte) error {
+// Timing and framing of a NALU, from the metadata of its buffer.
+type naluTiming struct {
+	// When the NALU was captured, or zero if unknown.
+	captureTime time.Time
+
+	// Presentation time, if known. With B-frames, presentation times are
+	// not in the order that pictures are sent.
+	pts    time.Duration
+	hasPTS bool
+
+	// Whether more NALUs of the same access unit follow, in which case the
+	// NALU's last packet doesn't get the marker bit.
+	continued bool
+}
+
+// Packetize a NALU delivered in a buffer.
+func (w *h264Writer) packetizeBuffer(buf *packet.SharedBuffer) error {
+	t := naluTiming{
+		captureTime: buf.CaptureTime(),
+		continued:   buf.Continued(),
+	}
+	t.pts, t.hasPTS = buf.PTS()
+	dequeued := w.clock.Now()
+	if err := w.packetizeNALU(buf.Bytes(), t); err != nil {
+		return err
+	}
+
+	// Measure each picture once its last slice is sent. Sources that don't
+	// mark continued slices are measured at every slice.
+	if w.latency == nil || t.captureTime.IsZero() || t.continued {
+		return nil
+	}
+	switch buf.Bytes()[0] & 0x1f {
+	case 1, 2, 5: // coded slice, data partition A, IDR slice
+		w.latency.record(dequeued.Sub(t.captureTime), w.clock.Now().Sub(dequeued))
+	}
+	return nil
+}
+
+// Packetize a NALU captured at the given time, or now if captureTime is zero.
+func (w *h264Writer) packetize(nalu []byte, captureTime time.Time) error {
+	return w.packetizeNALU(nalu, naluTiming{captureTime: captureTime})
+}
+
+func (w *h264Writer) packetizeNALU(nalu []byte, t naluTiming) error {
 	naluType := nalu[0] & 0x1f
 	switch naluType {
 	case naluTypeSEI, naluTypeSPS, naluTypePPS:
+		if naluType == naluTypeSPS {
+			w.handleSPS(nalu)
+		}
 		// Merge consecutive SEI/SPS/PPS into a single STAP-A packet.
 		w.stap = appendSTAP(w.stap, nalu)
 		return nil
 	}
 
+	// Parameter sets share the timestamp of the picture they precede, and
+	// the slices of a picture share one timestamp.
+	if !w.started || startsPicture(nalu) {
+		if t.hasPTS {
+			w.timestamp = w.ptsTimestamp(t)
+		} else {
+			w.timestamp = w.nextTimestamp(t.captureTime)
+		}
+	}
+
+	// The last packet of an access unit gets the marker bit (RFC 6184
+	// §5.1).
+	marker := !t.continued
+
 	// Send accumulated STAP-A packet, if present.
 	if len(w.stap) > 0 {
 		if err := w.writePacket(w.payloadType, false, w.timestamp, w.stap); err != nil {
@@ -102,16 +270,13 @@ func (w *h264Writer) packetize(nalu []byte) error {
 		w.stap = w.stap[:0]
 	}
 
-	defer w.advanceTimestamp()
-
 	// Maximum payload size.
-	// TODO: Get this from the rtpWriter.
-	maxSize := 1280
+	maxSize := w.maxPayloadSize()
 
 	// If it fits, send the NALU as a single RTP packet.
 	// See https://tools.ietf.org/html/rfc6184#section-5.6
-	if len(nalu) < maxSize {
-		return w.writePacket(w.payloadType, true, w.timestamp, nalu)
+	if len(nalu) <= maxSize {
+		return w.writePacket(w.payloadType, marker, w.timestamp, nalu)
 	}
 
 	// Otherwise, fragment the NALU into multiple FU-A packets.
@@ -119,7 +284,10 @@ func (w *h264Writer) packetize(nalu []byte) error {
 	indicator := nalu[0]&0xe0 | naluTypeFU_A
 	start := byte(0x80)
 	end := byte(0)
-	p := packet.NewWriterSize(maxSize) // TODO: sync.Pool
+	if cap(w.fragment) < maxSize {
+		w.fragment = make([]byte, maxSize)
+	}
+	p := packet.NewWriter(w.fragment[:maxSize])
 	for i := 1; i < len(nalu); i += maxSize - 2 {
 		tail := i + maxSize - 2
 		if tail >= len(nalu) {
@@ -132,7 +300,7 @@ func (w *h264Writer) packetize(nalu []byte) error {
 		p.WriteByte(start | end | naluType) // FU header
 		p.WriteSlice(nalu[i:tail])
 
-		if err := w.writePacket(w.payloadType, end != 0, w.timestamp, p.Bytes()); err != nil {
+		if err := w.writePacket(w.payloadType, marker && end != 0, w.timestamp, p.Bytes()); err != nil {
 			return err
 		}
 
@@ -141,25 +309,130 @@ func (w *h264Writer) packetize(nalu []byte) error {
 	return nil
 }
 
-func (w *h264Writer) advanceTimestamp() {
-	// TODO: Use framerate from video source
-	w.timestamp += 3000
+// Return the timestamp for a picture captured at the given time, or now if
+// zero. Successive pictures need distinct timestamps, even if the encoder
+// delivers them together.
+func (w *h264Writer) nextTimestamp(captureTime time.Time) uint32 {
+	uncaptured := captureTime.IsZero()
+	if uncaptured {
+		captureTime = w.clock.Now()
+	}
+	ts := w.clockTimestamp(captureTime)
+	if w.started {
+		min := w.timestamp + 1
+		if uncaptured && w.frameTicks > 0 {
+			// Pictures from a file or relay may arrive in bursts. Without
+			// capture times, keep them at least a frame apart.
+			min = w.timestamp + w.frameTicks
+		}
+		if int32(ts-min) < 0 {
+			ts = min
+		}
+	}
+	w.started = true
+	return ts
+}
+
+// Largest difference between a presentation time and the capture (or send)
+// time of a picture before the presentation times are taken to have jumped,
+// e.g. when a recording is seeked. Reordering delays are much smaller.
+const maxPTSSkew = time.Second
+
+// Return the timestamp for a picture with a presentation time. Timestamps
+// follow presentation order, so are not monotonic with B-frames.
+func (w *h264Writer) ptsTimestamp(t naluTiming) uint32 {
+	ticks := uint32(int64(t.pts) * int64(w.clockRate) / int64(time.Second))
+	captureTime := t.captureTime
+	if captureTime.IsZero() {
+		captureTime = w.clock.Now()
+	}
+	now := w.clockTimestamp(captureTime)
+
+	ts := w.ptsBase + ticks
+	skew := int64(int32(ts - now))
+	limit := int64(maxPTSSkew) * int64(w.clockRate) / int64(time.Second)
+	if !w.ptsStarted || skew > limit || skew < -limit {
+		if w.ptsStarted {
+			log.Debug("Presentation time jumped by %d ticks, resynchronizing", skew)
+		}
+		w.ptsBase = now - ticks
+		w.ptsStarted = true
+		ts = now
+	}
+	w.started = true
+	return ts
+}
+
+// Note the frame rate and picture size of a new SPS.
+func (w *h264Writer) handleSPS(nalu []byte) {
+	sps, err := h264.ParseSPS(nalu)
+	if err != nil {
+		log.Debug("Ignoring SPS: %v", err)
+		return
+	}
+	var frameTicks uint32
+	if sps.FrameRate > 0 {
+		frameTicks = uint32(float64(w.clockRate) / sps.FrameRate)
+	}
+	if frameTicks != w.frameTicks {
+		log.Debug("SPS: %dx%d, profile-level-id %06x, %.2f fps",
+			sps.Width, sps.Height, sps.ProfileLevelID(), sps.FrameRate)
+		w.frameTicks = frameTicks
+	}
+}
+
+// Report whether a NALU begins a new picture, i.e. is not a second or later
+// slice of one. Slices starting at macroblock 0 (first_mb_in_slice, coded as
+// ue(v), is 0 exactly when the first bit is set) begin a picture.
+func startsPicture(nalu []byte) bool {
+	switch nalu[0] & 0x1f {
+	case 1, 2, 5: // coded slice, data partition A, IDR slice
+		return len(nalu) < 2 || nalu[1]&0x80 != 0
+	}
+	return true
 }
 
 func (s *Stream) ReceiveVideo(quit <-chan struct{}, consume func(buf *packet.SharedBuffer) error) error {
 	r := h264Reader{
-		rtpReader: s.rtpIn,
-		ch:        make(chan *packet.SharedBuffer, 4),
+		rtpReader:   s.rtpIn,
+		ch:          make(chan *packet.SharedBuffer, 4),
+		pictureLost: make(chan struct{}, 1),
+		done:        make(chan struct{}),
 	}
+	defer close(r.done)
+	r.jitter = newJitterBuffer(s.JitterBufferDepth)
+	r.jitter.setStart(s.ReceiveStart)
+	r.jitter.emit = r.depacketize
+	r.jitter.lost = r.handleLoss
+	r.jitter.late = func() {
+		atomic.AddUint64(&r.late, 1)
+	}
+
+	s.readMutex.Lock()
+	s.rtpIn.nacks = newNACKTracker()
 	s.rtpIn.handler = r.handleData
+	s.rtpIn.stats.clockRate = 90000
+	s.readMutex.Unlock()
+
+	nackTicker := s.clock.NewTicker(nackInterval)
+	defer nackTicker.Stop()
+
+	reportDue := make(chan struct{}, 1)
+	stopReport := s.scheduleReceiverReport(reportDue)
+	defer func() { stopReport() }()
+
+	if s.MaxReceiveBitrate > 0 {
+		s.sendREMB(s.MaxReceiveBitrate)
+	}
 
-	receiverReportTicker := time.NewTicker(2 * time.Second)
-	defer receiverReportTicker.Stop()
+	var lastPLI time.Time
 
 	for {
 		select {
 		case <-quit:
 			return nil
+		case <-s.goodbye:
+			return ErrGoodbye
 		case buf, more := <-r.ch:
 			if !more {
 				return io.EOF
@@ -168,38 +441,120 @@ func (s *Stream) ReceiveVideo(quit <-chan struct{}, consume func(buf *packet.Sha
 			if err := consume(buf); err != nil {
 				return err
 			}
-		case <-receiverReportTicker.C:
+		case <-r.pictureLost:
+			// Ask for a keyframe, since the decoder can't recover from the
+			// loss on its own. Rate-limited, as one keyframe repairs all.
+			if s.clock.Now().Sub(lastPLI) < minPLIInterval {
+				break
+			}
+			lastPLI = s.clock.Now()
+			log.Debug("sending PLI for remote SSRC %02x", s.RemoteSSRC)
+			s.sendPictureLossIndication()
+		case <-nackTicker.C:
+			if lost := s.rtpIn.nacks.due(s.clock.Now()); len(lost) > 0 {
+				log.Debug("sending NACK for %d packets from remote SSRC %02x", len(lost), s.RemoteSSRC)
+				s.sendNACKs(lost)
+			}
+		case <-reportDue:
 			log.Debug("sending Receiver Report for remote SSRC %02x", s.RemoteSSRC)
 			s.sendReceiverReport()
+			stopReport = s.scheduleReceiverReport(reportDue)
+			if s.MaxReceiveBitrate > 0 {
+				s.sendREMB(s.MaxReceiveBitrate)
+			}
 		}
 	}
 }
 
+// Minimum time between PLI requests for a received stream.
+const minPLIInterval = 500 * time.Millisecond
+
 type h264Reader struct {
 	*rtpReader
 
 	// Channel for received NAL units.
 	ch chan *packet.SharedBuffer
 
+	// Closed once ReceiveVideo returns, after which NAL units are dropped.
+	done chan struct{}
+
+	// Restores packet order before depacketization.
+	jitter *jitterBuffer
+
+	// Signaled when packets are lost, so that a keyframe can be requested.
+	pictureLost chan struct{}
+
 	// Buffer for assembling FU-A packets into a complete NALU.
 	buf *bytes.Buffer
 }
 
+// Buffers for received NALUs, recycled once every consumer has released them.
+var naluPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// Return a NALU buffer from the pool.
+func getNALUBuffer() *bytes.Buffer {
+	b := naluPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// Share the contents of a NALU buffer, returning it to the pool when released.
+func shareNALUBuffer(b *bytes.Buffer) *packet.SharedBuffer {
+	return packet.NewSharedBuffer(b.Bytes(), 1, func() {
+		naluPool.Put(b)
+	})
+}
+
 func (r *h264Reader) handleData(hdr rtpHeader, payload []byte) error {
+	return r.jitter.push(hdr, payload, r.clock.Now())
+}
+
+// Called by the jitter buffer when packets are given up as lost.
+func (r *h264Reader) handleLoss(first uint16, n int) {
+	log.Debug("lost %d RTP packets starting at %d", n, first)
+	atomic.AddUint64(&r.lost, uint64(n))
+
+	// A partially assembled NALU is missing pieces; discard it.
+	if r.buf != nil {
+		naluPool.Put(r.buf)
+		r.buf = nil
+	}
+
+	// Retransmissions would now arrive too late.
+	if r.nacks != nil {
+		r.nacks.forget(first, n)
+	}
+
+	select {
+	case r.pictureLost <- struct{}{}:
+	default:
+	}
+}
+
+func (r *h264Reader) depacketize(hdr rtpHeader, payload []byte) error {
 	log.Trace(4, "Received RTP payload: %d", len(payload))
+	if len(payload) == 0 {
+		// Padding only, e.g. a bandwidth probe.
+		return nil
+	}
 
 	// Assemble RTP packets into full NAL units.
 	naluType := payload[0] & 0x1f
 	switch naluType {
 	case naluTypeSTAP_A:
 		// STAP-A packet potentially contains SEI, SPS, and PPS.
-		payload = copyBytes(payload)
 		nalus, err := splitSTAP(payload)
 		if err != nil {
 			return err
 		}
 		for _, nalu := range nalus {
-			r.ch <- packet.NewSharedBuffer(nalu, 1, nil)
+			b := getNALUBuffer()
+			b.Write(nalu)
+			r.emit(shareNALUBuffer(b))
 		}
 	case naluTypeFU_A:
 		// Reassemble a sequence of FU-A packets.
@@ -209,7 +564,10 @@ func (r *h264Reader) handleData(hdr rtpHeader, payload []byte) error {
 		start := header & 0x80
 		end := header & 0x40
 		if start != 0 {
-			r.buf = new(bytes.Buffer) // TODO: sync.Pool
+			if r.buf != nil {
+				naluPool.Put(r.buf)
+			}
+			r.buf = getNALUBuffer()
 			fnri := indicator & 0xe0
 			naluType := header & 0x1f
 			r.buf.WriteByte(fnri | naluType)
@@ -219,17 +577,27 @@ func (r *h264Reader) handleData(hdr rtpHeader, payload []byte) error {
 		}
 		r.buf.Write(payload[2:])
 		if end != 0 {
-			r.ch <- packet.NewSharedBuffer(r.buf.Bytes(), 1, nil)
+			r.emit(shareNALUBuffer(r.buf))
 			r.buf = nil
 		}
 	default:
 		// Payload is a single NALU.
-		payload = copyBytes(payload)
-		r.ch <- packet.NewSharedBuffer(payload, 1, nil)
+		b := getNALUBuffer()
+		b.Write(payload)
+		r.emit(shareNALUBuffer(b))
 	}
 	return nil
 }
 
+// Pass a NAL unit on to ReceiveVideo, unless it has returned.
+func (r *h264Reader) emit(buf *packet.SharedBuffer) {
+	select {
+	case r.ch <- buf:
+	case <-r.done:
+		buf.Release()
+	}
+}
+
 // See https://tools.ietf.org/html/rfc6184#section-5.7.1
 func appendSTAP(stap, nalu []byte) []byte {
 	if len(stap) == 0 {
@@ -0,0 +1,228 @@
+package rtp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+func TestH264RoundTrip(t *testing.T) {
+	var out packetRecorder
+	w := &h264Writer{rtpWriter: newRTPWriter(&out, 1, nil, 500)}
+
+	sps := []byte{0x67, 1, 2, 3}
+	pps := []byte{0x68, 4, 5}
+	idr := make([]byte, 2000)
+	idr[0] = 0x65
+	for i := 1; i < len(idr); i++ {
+		idr[i] = byte(i)
+	}
+	slice := []byte{0x41, 6, 7, 8}
+	sent := [][]byte{sps, pps, idr, slice, idr}
+	for _, nalu := range sent {
+		if err := w.packetize(nalu, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := h264Reader{ch: make(chan *packet.SharedBuffer, len(sent))}
+	var received [][]byte
+	for _, b := range out {
+		var hdr rtpHeader
+		p := packet.NewReader(b)
+		if err := hdr.readFrom(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.depacketize(hdr, b[hdr.length():]); err != nil {
+			t.Fatal(err)
+		}
+		// Release each NALU right away, so that later ones reuse its buffer.
+		for len(r.ch) > 0 {
+			buf := <-r.ch
+			received = append(received, append([]byte(nil), buf.Bytes()...))
+			buf.Release()
+		}
+	}
+
+	if len(received) != len(sent) {
+		t.Fatalf("expected %d NALUs, not %d", len(sent), len(received))
+	}
+	for i := range sent {
+		if !bytes.Equal(received[i], sent[i]) {
+			t.Errorf("NALU %d differs", i)
+		}
+	}
+}
+
+func TestH264CaptureTimestamp(t *testing.T) {
+	var out packetRecorder
+	w := &h264Writer{rtpWriter: newRTPWriter(&out, 1, nil, 500)}
+	w.clockRate = 90000
+
+	// Pictures stamped with their capture time, 40 ms apart, even though
+	// they are packetized at the same moment.
+	captured := w.epoch.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		at := captured.Add(time.Duration(i) * 40 * time.Millisecond)
+		if err := w.packetize([]byte{0x41, 0x80 | byte(i)}, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, b := range out {
+		var hdr rtpHeader
+		if err := hdr.readFrom(packet.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		expected := w.timestampOffset + 90000 + uint32(i*3600)
+		if hdr.timestamp != expected {
+			t.Errorf("picture %d: expected timestamp %d, got %d", i, expected, hdr.timestamp)
+		}
+	}
+}
+
+func TestH264SliceTimestamps(t *testing.T) {
+	var out packetRecorder
+	w := &h264Writer{rtpWriter: newRTPWriter(&out, 1, nil, 500)}
+	w.clockRate = 90000
+
+	// An SPS signaling 30 fps, then two pictures of two slices each,
+	// delivered at once without capture times.
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0f, 0x23, 0x68, 0x22, 0x11, 0xa8}
+	nalus := [][]byte{sps, {0x65, 0x88}, {0x65, 0x48}, {0x41, 0x9a}, {0x41, 0x5a}}
+	for _, nalu := range nalus {
+		if err := w.packetize(nalu, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.frameTicks != 3000 {
+		t.Errorf("expected 3000 ticks per frame, got %d", w.frameTicks)
+	}
+
+	var timestamps []uint32
+	for _, b := range out {
+		var hdr rtpHeader
+		if err := hdr.readFrom(packet.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		timestamps = append(timestamps, hdr.timestamp)
+	}
+	// STAP-A with the SPS, then one packet per slice.
+	if len(timestamps) != 5 {
+		t.Fatalf("expected 5 packets, got %d", len(timestamps))
+	}
+	if timestamps[0] != timestamps[1] || timestamps[1] != timestamps[2] {
+		t.Errorf("first picture has timestamps %v", timestamps[:3])
+	}
+	if timestamps[3] != timestamps[4] {
+		t.Errorf("second picture has timestamps %v", timestamps[3:])
+	}
+	if d := timestamps[3] - timestamps[2]; d < 3000 {
+		t.Errorf("pictures are %d ticks apart, expected at least 3000", d)
+	}
+}
+
+func TestH264PresentationTimestamps(t *testing.T) {
+	var out packetRecorder
+	w := &h264Writer{rtpWriter: newRTPWriter(&out, 1, nil, 500)}
+	w.clockRate = 90000
+
+	// I P B B in decode order, presented as I B B P, 40 ms apart. The first
+	// slice of the I picture is followed by a second.
+	type nalu struct {
+		data      []byte
+		pts       time.Duration
+		continued bool
+	}
+	nalus := []nalu{
+		{[]byte{0x65, 0x88}, 0, true},
+		{[]byte{0x65, 0x48}, 0, false},
+		{[]byte{0x41, 0x9a}, 120 * time.Millisecond, false},
+		{[]byte{0x01, 0x9e}, 40 * time.Millisecond, false},
+		{[]byte{0x01, 0x9e}, 80 * time.Millisecond, false},
+	}
+	for _, n := range nalus {
+		buf := packet.NewSharedBuffer(n.data, 1, nil)
+		buf.SetPTS(n.pts)
+		buf.SetContinued(n.continued)
+		if err := w.packetizeBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(out) != len(nalus) {
+		t.Fatalf("expected %d packets, got %d", len(nalus), len(out))
+	}
+	var first uint32
+	for i, b := range out {
+		var hdr rtpHeader
+		if err := hdr.readFrom(packet.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = hdr.timestamp
+		}
+		expected := first + uint32(nalus[i].pts*90000/time.Second)
+		if hdr.timestamp != expected {
+			t.Errorf("packet %d: expected timestamp %d, got %d", i, expected, hdr.timestamp)
+		}
+		if hdr.marker == nalus[i].continued {
+			t.Errorf("packet %d: marker bit %v", i, hdr.marker)
+		}
+	}
+}
+
+// Advances a fake clock by 5 ms for every packet written, as if paced.
+type pacedWriter struct {
+	clock *clock.Fake
+	count int
+}
+
+func (w *pacedWriter) Write(b []byte) (int, error) {
+	w.clock.Advance(5 * time.Millisecond)
+	w.count++
+	return len(b), nil
+}
+
+func TestH264Latency(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1500000000, 0))
+	out := &pacedWriter{clock: fake}
+	var latency sendLatency
+	w := &h264Writer{rtpWriter: newRTPWriter(out, 1, nil, 500), latency: &latency}
+	w.clockRate = 90000
+	w.clock = fake
+
+	send := func(nalu []byte, captured time.Time, continued bool) {
+		buf := packet.NewSharedBuffer(nalu, 1, nil)
+		buf.SetCaptureTime(captured)
+		buf.SetContinued(continued)
+		if err := w.packetizeBuffer(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A picture of two slices, captured 30 ms ago, the second of which is
+	// fragmented into three packets.
+	captured := fake.Now().Add(-30 * time.Millisecond)
+	send([]byte{0x67, 1, 2, 3}, captured, true)
+	send([]byte{0x65, 0x80}, captured, true)
+	if latency.source != 0 {
+		t.Fatal("measured a picture before its last slice")
+	}
+	send(append([]byte{0x65, 0x40}, make([]byte, 1000)...), captured, false)
+	if out.count != 5 {
+		t.Fatalf("expected 5 packets, got %d", out.count)
+	}
+	if source, send := time.Duration(latency.source), time.Duration(latency.send); source != 40*time.Millisecond || send != 15*time.Millisecond {
+		t.Errorf("expected delays of 40 ms and 15 ms, got %v and %v", source, send)
+	}
+
+	// Later pictures are smoothed in.
+	send([]byte{0x41, 0x80}, fake.Now().Add(-200*time.Millisecond), false)
+	if source := time.Duration(latency.source); source != 50*time.Millisecond {
+		t.Errorf("expected smoothed delay of 50 ms, got %v", source)
+	}
+}
@@ -0,0 +1,200 @@
+package rtp
+
+import (
+	"time"
+)
+
+const (
+	// Default number of packets held while waiting for a missing one.
+	defaultJitterBufferDepth = 64
+
+	// Longest time a packet is held while waiting for a missing one, before
+	// the missing one is given up as lost.
+	maxJitterDelay = 200 * time.Millisecond
+)
+
+// A jitterBuffer restores the sender's order of received RTP packets before
+// they are depacketized. A packet that arrives ahead of a gap is held until
+// the gap is filled, until depth packets are waiting, or until it has waited
+// maxJitterDelay, whichever comes first. Packets arriving after their turn
+// has passed are discarded.
+//
+// A jitterBuffer is used only from the RTP read loop, so it needs no locking.
+type jitterBuffer struct {
+	depth int
+
+	// Sequence number of the next packet to emit.
+	next    uint16
+	started bool
+
+	// Until started, packets stamped before startTimestamp are discarded,
+	// if waitTimestamp is set.
+	startTimestamp uint32
+	waitTimestamp  bool
+
+	// Packets waiting for an earlier one, keyed by sequence number.
+	pending map[uint16]jitterPacket
+
+	// Called with each packet, in sequence number order.
+	emit func(hdr rtpHeader, payload []byte) error
+
+	// Called when n packets, starting at sequence number first, are given up
+	// as lost.
+	lost func(first uint16, n int)
+
+	// Called when a packet arrives after its turn.
+	late func()
+}
+
+type jitterPacket struct {
+	hdr     rtpHeader
+	payload []byte
+	arrival time.Time
+}
+
+func newJitterBuffer(depth int) *jitterBuffer {
+	if depth <= 0 {
+		depth = defaultJitterBufferDepth
+	}
+	return &jitterBuffer{
+		depth:   depth,
+		pending: make(map[uint16]jitterPacket),
+	}
+}
+
+// Set where the stream starts, if known before the first packet arrives.
+func (jb *jitterBuffer) setStart(start *ReceiveStart) {
+	switch {
+	case start == nil:
+	case start.HasSequence:
+		jb.next = start.Sequence
+		jb.started = true
+	case start.HasTimestamp:
+		jb.startTimestamp = start.Timestamp
+		jb.waitTimestamp = true
+	}
+}
+
+// Add a received packet. The payload is copied if the packet has to wait.
+func (jb *jitterBuffer) push(hdr rtpHeader, payload []byte, now time.Time) error {
+	if !jb.started {
+		if jb.waitTimestamp && int32(hdr.timestamp-jb.startTimestamp) < 0 {
+			if jb.late != nil {
+				jb.late()
+			}
+			return nil
+		}
+		jb.next = hdr.sequence
+		jb.started = true
+	}
+
+	delta := int16(hdr.sequence - jb.next)
+	if delta < 0 {
+		if jb.late != nil {
+			jb.late()
+		}
+		return nil
+	}
+
+	// Fast path: the expected packet, with nothing waiting.
+	if delta == 0 && len(jb.pending) == 0 {
+		jb.next++
+		return jb.emit(hdr, payload)
+	}
+
+	if _, ok := jb.pending[hdr.sequence]; ok {
+		// Duplicate.
+		return nil
+	}
+
+	// No room to wait any longer for the packets before this one.
+	if int(delta) >= jb.depth {
+		if err := jb.skipTo(hdr.sequence - uint16(jb.depth) + 1); err != nil {
+			return err
+		}
+	}
+
+	// The header's extensions point into the receive buffer, and aren't
+	// needed past this point.
+	hdr.extensions = nil
+	jb.pending[hdr.sequence] = jitterPacket{hdr, copyBytes(payload), now}
+	if err := jb.drain(); err != nil {
+		return err
+	}
+
+	// Give up on gaps that have been waited on for too long.
+	for len(jb.pending) > 0 && now.Sub(jb.oldestArrival()) > maxJitterDelay {
+		if err := jb.skipTo(jb.firstPending()); err != nil {
+			return err
+		}
+		if err := jb.drain(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Emit packets until the next gap.
+func (jb *jitterBuffer) drain() error {
+	for {
+		p, ok := jb.pending[jb.next]
+		if !ok {
+			return nil
+		}
+		delete(jb.pending, jb.next)
+		jb.next++
+		if err := jb.emit(p.hdr, p.payload); err != nil {
+			return err
+		}
+	}
+}
+
+// Advance to seq, emitting any waiting packets before it and reporting the
+// rest as lost.
+func (jb *jitterBuffer) skipTo(seq uint16) error {
+	for jb.next != seq {
+		if p, ok := jb.pending[jb.next]; ok {
+			delete(jb.pending, jb.next)
+			jb.next++
+			if err := jb.emit(p.hdr, p.payload); err != nil {
+				return err
+			}
+			continue
+		}
+
+		first := jb.next
+		n := 0
+		for jb.next != seq {
+			if _, ok := jb.pending[jb.next]; ok {
+				break
+			}
+			jb.next++
+			n++
+		}
+		if jb.lost != nil {
+			jb.lost(first, n)
+		}
+	}
+	return nil
+}
+
+// Return the lowest waiting sequence number. Only valid if len(pending) > 0.
+func (jb *jitterBuffer) firstPending() uint16 {
+	seq := jb.next
+	for {
+		if _, ok := jb.pending[seq]; ok {
+			return seq
+		}
+		seq++
+	}
+}
+
+func (jb *jitterBuffer) oldestArrival() time.Time {
+	var oldest time.Time
+	for _, p := range jb.pending {
+		if oldest.IsZero() || p.arrival.Before(oldest) {
+			oldest = p.arrival
+		}
+	}
+	return oldest
+}
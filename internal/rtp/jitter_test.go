@@ -0,0 +1,134 @@
+package rtp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type jitterRecorder struct {
+	emitted []uint16
+	lost    []uint16
+	late    int
+}
+
+func newTestJitterBuffer(depth int) (*jitterBuffer, *jitterRecorder) {
+	rec := new(jitterRecorder)
+	jb := newJitterBuffer(depth)
+	jb.emit = func(hdr rtpHeader, payload []byte) error {
+		rec.emitted = append(rec.emitted, hdr.sequence)
+		return nil
+	}
+	jb.lost = func(first uint16, n int) {
+		for i := 0; i < n; i++ {
+			rec.lost = append(rec.lost, first+uint16(i))
+		}
+	}
+	jb.late = func() { rec.late++ }
+	return jb, rec
+}
+
+func TestJitterBufferReorder(t *testing.T) {
+	jb, rec := newTestJitterBuffer(8)
+	now := time.Now()
+	for _, seq := range []uint16{65534, 0, 65535, 1, 3, 2, 2, 65533} {
+		jb.push(rtpHeader{sequence: seq}, []byte{0}, now)
+	}
+
+	expect := []uint16{65534, 65535, 0, 1, 2, 3}
+	if !reflect.DeepEqual(rec.emitted, expect) {
+		t.Errorf("expected %v, not %v", expect, rec.emitted)
+	}
+	if len(rec.lost) != 0 {
+		t.Errorf("unexpected loss: %v", rec.lost)
+	}
+	// The duplicate 2 and the packet before the first are late.
+	if rec.late != 2 {
+		t.Errorf("expected 2 late packets, not %d", rec.late)
+	}
+}
+
+func TestJitterBufferDepth(t *testing.T) {
+	jb, rec := newTestJitterBuffer(4)
+	now := time.Now()
+	for _, seq := range []uint16{10, 12, 13, 14, 15, 11} {
+		jb.push(rtpHeader{sequence: seq}, []byte{0}, now)
+	}
+
+	// 15 leaves no room to wait for 11, which is then too late.
+	expect := []uint16{10, 12, 13, 14, 15}
+	if !reflect.DeepEqual(rec.emitted, expect) {
+		t.Errorf("expected %v, not %v", expect, rec.emitted)
+	}
+	if !reflect.DeepEqual(rec.lost, []uint16{11}) {
+		t.Errorf("expected 11 lost, not %v", rec.lost)
+	}
+	if rec.late != 1 {
+		t.Errorf("expected 1 late packet, not %d", rec.late)
+	}
+}
+
+func TestJitterBufferDelay(t *testing.T) {
+	jb, rec := newTestJitterBuffer(64)
+	now := time.Now()
+	jb.push(rtpHeader{sequence: 100}, []byte{0}, now)
+	jb.push(rtpHeader{sequence: 103}, []byte{0}, now)
+	jb.push(rtpHeader{sequence: 104}, []byte{0}, now.Add(maxJitterDelay/2))
+	if !reflect.DeepEqual(rec.emitted, []uint16{100}) {
+		t.Fatalf("emitted %v while waiting for 101", rec.emitted)
+	}
+
+	// 103 has now waited too long, but 106 has only just arrived, so it
+	// keeps waiting for 105.
+	jb.push(rtpHeader{sequence: 106}, []byte{0}, now.Add(2*maxJitterDelay))
+	expect := []uint16{100, 103, 104}
+	if !reflect.DeepEqual(rec.emitted, expect) {
+		t.Errorf("expected %v, not %v", expect, rec.emitted)
+	}
+	if !reflect.DeepEqual(rec.lost, []uint16{101, 102}) {
+		t.Errorf("expected 101, 102 lost, not %v", rec.lost)
+	}
+}
+
+func TestJitterBufferStartSequence(t *testing.T) {
+	jb, rec := newTestJitterBuffer(8)
+	jb.setStart(&ReceiveStart{Sequence: 100, HasSequence: true})
+	now := time.Now()
+	for _, seq := range []uint16{98, 101, 100, 102} {
+		jb.push(rtpHeader{sequence: seq}, []byte{0}, now)
+	}
+
+	// 101 waits for the first packet, and 98 predates it.
+	expect := []uint16{100, 101, 102}
+	if !reflect.DeepEqual(rec.emitted, expect) {
+		t.Errorf("expected %v, not %v", expect, rec.emitted)
+	}
+	if rec.late != 1 {
+		t.Errorf("expected 1 late packet, not %d", rec.late)
+	}
+}
+
+func TestJitterBufferStartTimestamp(t *testing.T) {
+	jb, rec := newTestJitterBuffer(8)
+	jb.setStart(&ReceiveStart{Timestamp: 0xfffffff0, HasTimestamp: true})
+	now := time.Now()
+	for _, p := range []struct {
+		seq uint16
+		ts  uint32
+	}{
+		{7, 0xffffffe0},
+		{8, 0xfffffff0},
+		{9, 0x10},
+		{10, 0x10},
+	} {
+		jb.push(rtpHeader{sequence: p.seq, timestamp: p.ts}, []byte{0}, now)
+	}
+
+	expect := []uint16{8, 9, 10}
+	if !reflect.DeepEqual(rec.emitted, expect) {
+		t.Errorf("expected %v, not %v", expect, rec.emitted)
+	}
+	if rec.late != 1 {
+		t.Errorf("expected 1 late packet, not %d", rec.late)
+	}
+}
@@ -0,0 +1,33 @@
+package rtp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Delays of outgoing pictures, in nanoseconds, smoothed over recent pictures
+// with the same gain as the interarrival jitter of RFC 3550. Written by the
+// sender, and read atomically by Stats.
+type sendLatency struct {
+	// From capture until the sender dequeued the picture: encoding, and
+	// queueing behind earlier pictures.
+	source int64
+
+	// From then until the picture's last packet was written: packetization
+	// and pacing.
+	send int64
+}
+
+// Record the delays of a picture.
+func (l *sendLatency) record(source, send time.Duration) {
+	smooth := func(avg *int64, sample time.Duration) {
+		old := atomic.LoadInt64(avg)
+		if old == 0 {
+			atomic.StoreInt64(avg, int64(sample))
+		} else {
+			atomic.StoreInt64(avg, old+(int64(sample)-old)/16)
+		}
+	}
+	smooth(&l.source, source)
+	smooth(&l.send, send)
+}
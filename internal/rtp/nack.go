@@ -0,0 +1,134 @@
+package rtp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Receiver-side generation of Generic NACKs for lost RTP packets.
+// See https://tools.ietf.org/html/rfc4585#section-6.2.1
+
+const (
+	// How often the receive loop checks for packets to NACK.
+	nackInterval = 20 * time.Millisecond
+
+	// Minimum time between requests for the same packet, roughly one round
+	// trip, so that a retransmission in flight isn't requested again.
+	nackRetryInterval = 100 * time.Millisecond
+
+	// Number of times a packet is requested before giving up on it.
+	maxNACKRetries = 3
+
+	// Age beyond which a missing packet is no longer worth requesting, as the
+	// jitter buffer will have given up on it anyway.
+	maxNACKAge = time.Second
+
+	// Maximum number of missing packets tracked. A gap larger than this is
+	// better repaired with a keyframe than with retransmissions.
+	maxNACKMissing = 256
+
+	// Maximum number of NACK messages per compound RTCP packet.
+	maxNACKsPerPacket = 64
+
+	// Size of a NACK message with a single FCI entry.
+	nackSize = 16
+)
+
+// A nackTracker records sequence gaps in a received stream, and decides which
+// missing packets to request. Gaps are recorded from the RTP read loop, and
+// requests are made from the stream's receive loop.
+type nackTracker struct {
+	sync.Mutex
+
+	// Missing packets, keyed by sequence number.
+	missing map[uint16]*nackState
+}
+
+type nackState struct {
+	// Extended sequence number, for ordering.
+	index uint64
+
+	firstSeen time.Time
+	lastSent  time.Time
+	retries   int
+}
+
+func newNACKTracker() *nackTracker {
+	return &nackTracker{
+		missing: make(map[uint16]*nackState),
+	}
+}
+
+// Record the arrival of the packet with the given index, where prev was the
+// highest index received before it.
+func (t *nackTracker) received(prev, index uint64, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	if index <= prev {
+		// Late or retransmitted; no longer missing.
+		delete(t.missing, uint16(index))
+		return
+	}
+
+	for i := prev + 1; i < index && len(t.missing) < maxNACKMissing; i++ {
+		t.missing[uint16(i)] = &nackState{index: i, firstSeen: now}
+	}
+}
+
+// Stop requesting the given packets, e.g. because they have been given up.
+func (t *nackTracker) forget(first uint16, n int) {
+	t.Lock()
+	defer t.Unlock()
+
+	for i := 0; i < n; i++ {
+		delete(t.missing, first+uint16(i))
+	}
+}
+
+// Return the sequence numbers to request now, in order.
+func (t *nackTracker) due(now time.Time) []uint16 {
+	t.Lock()
+	defer t.Unlock()
+
+	var states []*nackState
+	for seq, s := range t.missing {
+		if s.retries >= maxNACKRetries || now.Sub(s.firstSeen) > maxNACKAge {
+			delete(t.missing, seq)
+			continue
+		}
+		if s.retries > 0 && now.Sub(s.lastSent) < nackRetryInterval {
+			continue
+		}
+		s.lastSent = now
+		s.retries++
+		states = append(states, s)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].index < states[j].index
+	})
+	seqs := make([]uint16, len(states))
+	for i, s := range states {
+		seqs[i] = uint16(s.index)
+	}
+	return seqs
+}
+
+// Batch lost sequence numbers, in order, into NACK messages, each covering a
+// packet ID and the 16 packets following it.
+func makeNACKs(sender, source uint32, lost []uint16) []rtcpPacket {
+	var nacks []rtcpPacket
+	for len(lost) > 0 {
+		n := 1
+		for n < len(lost) && lost[n]-lost[0] <= 16 {
+			n++
+		}
+		nack := &nackFeedbackMessage{sender: sender, source: source}
+		nack.setLostPackets(lost[:n])
+		nacks = append(nacks, nack)
+		lost = lost[n:]
+	}
+	return nacks
+}
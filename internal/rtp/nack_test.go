@@ -0,0 +1,58 @@
+package rtp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNACKTracker(t *testing.T) {
+	tr := newNACKTracker()
+	now := time.Now()
+
+	// 65535 and 1 are missing across the rollover.
+	tr.received(65533, 65534, now)
+	tr.received(65534, 65536, now)
+	tr.received(65536, 65538, now)
+
+	lost := tr.due(now)
+	if !reflect.DeepEqual(lost, []uint16{65535, 1}) {
+		t.Fatalf("expected 65535 and 1 due, not %v", lost)
+	}
+
+	// Not requested again until the retry interval has passed.
+	if lost := tr.due(now.Add(nackRetryInterval / 2)); len(lost) != 0 {
+		t.Errorf("requested again too soon: %v", lost)
+	}
+
+	// The retransmission of 1 arrives.
+	tr.received(65538, 65537, now)
+	lost = tr.due(now.Add(nackRetryInterval))
+	if !reflect.DeepEqual(lost, []uint16{65535}) {
+		t.Errorf("expected 65535 due, not %v", lost)
+	}
+
+	// Given up after maxNACKRetries.
+	for i := 2; i <= maxNACKRetries; i++ {
+		tr.due(now.Add(time.Duration(i) * nackRetryInterval))
+	}
+	if lost := tr.due(now.Add(time.Duration(maxNACKRetries+1) * nackRetryInterval)); len(lost) != 0 {
+		t.Errorf("requested more than %d times: %v", maxNACKRetries, lost)
+	}
+}
+
+func TestMakeNACKs(t *testing.T) {
+	lost := []uint16{65530, 65531, 65535, 10, 11, 40}
+	nacks := makeNACKs(1, 2, lost)
+	if len(nacks) != 3 {
+		t.Fatalf("expected 3 NACKs, not %d", len(nacks))
+	}
+
+	var all []uint16
+	for _, p := range nacks {
+		all = append(all, p.(*nackFeedbackMessage).getLostPackets()...)
+	}
+	if !reflect.DeepEqual(all, lost) {
+		t.Errorf("expected %v, not %v", lost, all)
+	}
+}
@@ -0,0 +1,98 @@
+package rtp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Bytes that may be sent back-to-back before pacing starts, by default:
+	// about ten full-size packets.
+	defaultPacingBurst = 12000
+
+	// Packets are paced at a multiple of the target bitrate, so that the
+	// pacer spreads out bursts without holding back the average rate: 2.5
+	// times, as a fraction, since softfloat targets (e.g. GOARM=5, or
+	// GOMIPS=softfloat) emulate floating point slowly.
+	pacingFactorNum   = 5
+	pacingFactorDenom = 2
+)
+
+// A pacer is a leaky bucket that spaces outgoing packets according to a target
+// bitrate, so that e.g. the many packets of a keyframe don't leave in one
+// burst and overflow the queue of a low-end router. Credit for up to burst
+// bytes accumulates while the link is idle.
+type pacer struct {
+	mu sync.Mutex
+
+	// Bytes per second, or 0 to send without pacing.
+	rate int64
+
+	// Maximum credit, in bytes per second times nanoseconds, so that the
+	// credit earned over short intervals isn't lost to rounding.
+	burst int64
+
+	// Current credit, in the same units, as of last. Negative when packets
+	// have been sent ahead of the rate.
+	credit int64
+	last   time.Time
+
+	// Replaceable for testing.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newPacer(burst int) *pacer {
+	if burst <= 0 {
+		burst = defaultPacingBurst
+	}
+	return &pacer{
+		burst:  int64(burst) * int64(time.Second),
+		credit: int64(burst) * int64(time.Second),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Set the target bitrate, in bits per second. Zero disables pacing.
+func (p *pacer) setBitrate(bps int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refill(p.now())
+	p.rate = int64(bps) * pacingFactorNum / pacingFactorDenom / 8
+}
+
+// Block until a packet of n bytes may be sent.
+func (p *pacer) wait(n int) {
+	p.mu.Lock()
+	if p.rate == 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.refill(p.now())
+	p.credit -= int64(n) * int64(time.Second)
+	var delay time.Duration
+	if p.credit < 0 {
+		delay = time.Duration(-p.credit / p.rate)
+	}
+	p.mu.Unlock()
+
+	if delay > 0 {
+		p.sleep(delay)
+	}
+}
+
+// Add the credit earned since the last update. Must be called with the lock
+// held.
+func (p *pacer) refill(now time.Time) {
+	if elapsed := int64(now.Sub(p.last)); !p.last.IsZero() && elapsed > 0 {
+		// Compare before multiplying, which could overflow after a long
+		// idle period.
+		if p.rate == 0 || elapsed >= (p.burst-p.credit)/p.rate {
+			p.credit = p.burst
+		} else {
+			p.credit += elapsed * p.rate
+		}
+	}
+	p.last = now
+}
@@ -0,0 +1,59 @@
+package rtp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	now := time.Unix(0, 0)
+	var delays []time.Duration
+	p := newPacer(3000)
+	p.now = func() time.Time { return now }
+	p.sleep = func(d time.Duration) {
+		delays = append(delays, d)
+		now = now.Add(d)
+	}
+
+	// Unpaced until a bitrate is set.
+	p.wait(100000)
+	if len(delays) != 0 {
+		t.Fatalf("unexpected delays before bitrate set: %v", delays)
+	}
+
+	// 1.6 Mbps, paced at 4 Mbps, i.e. 500 bytes per millisecond. The burst
+	// goes out at once, then packets are spaced.
+	p.setBitrate(1600000)
+	for i := 0; i < 5; i++ {
+		p.wait(1000)
+	}
+	expected := []time.Duration{2 * time.Millisecond, 2 * time.Millisecond}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("got delays %v, expected %v", delays, expected)
+	}
+
+	// Credit accumulates while idle, up to the burst allowance.
+	delays = nil
+	now = now.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		p.wait(1000)
+	}
+	if len(delays) != 0 {
+		t.Errorf("unexpected delays after idle: %v", delays)
+	}
+	p.wait(1000)
+	if !reflect.DeepEqual(delays, []time.Duration{2 * time.Millisecond}) {
+		t.Errorf("got delays %v, expected one of 2ms", delays)
+	}
+
+	// Nor does a long idle period earn more, or overflow.
+	delays = nil
+	now = now.Add(1000 * time.Hour)
+	for i := 0; i < 4; i++ {
+		p.wait(1000)
+	}
+	if !reflect.DeepEqual(delays, []time.Duration{2 * time.Millisecond}) {
+		t.Errorf("got delays %v after long idle, expected one of 2ms", delays)
+	}
+}
@@ -0,0 +1,93 @@
+package rtp
+
+import (
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// Largest padding an RTP packet can carry, since its length is one octet.
+	maxPaddingSize = 255
+
+	// Fewest packets in a probe cluster, below which the remote bandwidth
+	// estimator ignores it.
+	minProbePackets = 5
+
+	// Interval at which probe packets that have fallen due are sent.
+	probeTick = time.Millisecond
+)
+
+// A ProbeCluster is a burst of padding sent at a fixed bitrate. From the
+// spacing of its packets on arrival, the remote peer's bandwidth estimator
+// can tell whether the path sustains that bitrate, and raise its estimate
+// accordingly, instead of waiting for media to fill the link. See the probing
+// of Google Congestion Control (draft-ietf-rmcat-gcc), which needs the
+// abs-send-time or transport-wide sequence number header extension.
+type ProbeCluster struct {
+	// Bitrate to send the padding at, in bits per second.
+	Bitrate int
+
+	// How long to send for. Clusters always have at least a few packets.
+	Duration time.Duration
+}
+
+// Probe sends each cluster in turn, as padding-only packets of the given
+// payload type, bypassing the pacer. It returns once all have been sent, or
+// quit is closed.
+func (s *Stream) Probe(quit <-chan struct{}, payloadType byte, clusters []ProbeCluster) error {
+	if s.rtpOut == nil {
+		return errors.New("probing a receive-only stream")
+	}
+	for _, c := range clusters {
+		if err := s.rtpOut.probe(quit, payloadType, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send a probe cluster.
+func (w *rtpWriter) probe(quit <-chan struct{}, payloadType byte, c ProbeCluster) error {
+	if c.Bitrate <= 0 {
+		return errors.Errorf("invalid probe bitrate: %d", c.Bitrate)
+	}
+
+	size := w.maxPayloadSize()
+	if size > maxPaddingSize {
+		size = maxPaddingSize
+	}
+	packetSize := w.maxPacketSize - w.maxPayloadSize() + size
+	interval := time.Duration(int64(8*packetSize) * int64(time.Second) / int64(c.Bitrate))
+	if interval <= 0 {
+		interval = 1
+	}
+	n := int(c.Duration / interval)
+	if n < minProbePackets {
+		n = minProbePackets
+	}
+
+	ticker := w.clock.NewTicker(probeTick)
+	defer ticker.Stop()
+	start := w.clock.Now()
+	for sent := 0; sent < n; {
+		// Send every packet due by now, to keep the average rate despite
+		// the coarse ticker.
+		due := int(w.clock.Now().Sub(start)/interval) + 1
+		for ; sent < due && sent < n; sent++ {
+			if err := w.writePadding(payloadType, size); err != nil {
+				return err
+			}
+		}
+		if sent == n {
+			break
+		}
+
+		select {
+		case <-quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	var out packetRecorder
+	w := newRTPWriter(&out, 1, nil, 500)
+
+	// 267-byte packets, 12 of header and 255 of padding, every 2.136 ms.
+	start := time.Now()
+	if err := w.probe(nil, 96, ProbeCluster{Bitrate: 1000000, Duration: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("probe sent in %v, faster than its bitrate", elapsed)
+	}
+	if len(out) != 9 {
+		t.Fatalf("expected 9 packets, got %d", len(out))
+	}
+
+	r := newRTPReader(1, nil)
+	r.handler = func(hdr rtpHeader, payload []byte) error {
+		if !hdr.padding || hdr.payloadType != 96 || len(payload) != 0 {
+			t.Errorf("unexpected probe packet %+v with %d bytes of payload", hdr, len(payload))
+		}
+		return nil
+	}
+	for i, b := range out {
+		if len(b) != 267 {
+			t.Errorf("packet %d has %d bytes", i, len(b))
+		}
+		if err := r.readPacket(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Short clusters still have a few packets.
+	out = nil
+	if err := w.probe(nil, 96, ProbeCluster{Bitrate: 1000000}); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != minProbePackets {
+		t.Errorf("expected %d packets, got %d", minProbePackets, len(out))
+	}
+}
+
+func TestReadPadding(t *testing.T) {
+	var out packetRecorder
+	w := newRTPWriter(&out, 1, nil, 500)
+	w.writePacket(96, false, 0, []byte{1, 2, 3, 0, 0, 3})
+	w.writePacket(96, false, 0, []byte{1, 2, 0})
+
+	// Set the padding bit of both packets; the second then has invalid
+	// padding.
+	r := newRTPReader(1, nil)
+	r.handler = func(hdr rtpHeader, payload []byte) error {
+		if string(payload) != "\x01\x02\x03" {
+			t.Errorf("unexpected payload %v", payload)
+		}
+		return nil
+	}
+	out[0][0] |= 0x20
+	if err := r.readPacket(out[0]); err != nil {
+		t.Error(err)
+	}
+	out[1][0] |= 0x20
+	if err := r.readPacket(out[1]); err == nil {
+		t.Error("accepted a padding length of 0")
+	}
+}
@@ -0,0 +1,160 @@
+package rtp
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Default mean interval between receiver reports.
+const defaultReportInterval = 2 * time.Second
+
+// Statistics of a received stream, for its receiver reports.
+// See https://tools.ietf.org/html/rfc3550#appendix-A.3
+type receptionStats struct {
+	// Extended sequence number of the first packet received.
+	baseIndex uint64
+
+	// Packets expected and received as of the previous report, for the
+	// fraction lost since.
+	expectedPrior uint64
+	receivedPrior uint64
+
+	// Clock rate of the stream's RTP timestamps, or 0 if unknown, in which
+	// case jitter isn't measured.
+	clockRate int
+
+	// Interarrival jitter, in sixteenths of a timestamp unit, and the
+	// relative transit time of the previous packet. Integer arithmetic, as in
+	// RFC 3550 Appendix A.8, spares softfloat targets per-packet floating
+	// point.
+	jitter      uint32
+	transit     uint32
+	haveTransit bool
+	epoch       time.Time
+
+	// Middle 32 bits of the NTP timestamp of the latest Sender Report, and
+	// when it arrived, or zero if none has.
+	lastSenderReport     uint32
+	lastSenderReportTime time.Time
+}
+
+// Record the arrival of a packet with the given index and RTP timestamp.
+// first is whether it is the first packet of the stream.
+func (st *receptionStats) received(first bool, index uint64, timestamp uint32, now time.Time) {
+	if first {
+		st.baseIndex = index
+		st.epoch = now
+	}
+	if st.clockRate == 0 {
+		return
+	}
+	arrival := uint32(int64(now.Sub(st.epoch)) * int64(st.clockRate) / int64(time.Second))
+	transit := arrival - timestamp
+	if st.haveTransit {
+		d := int32(transit - st.transit)
+		if d < 0 {
+			d = -d
+		}
+		st.jitter += uint32(d) - ((st.jitter + 8) >> 4)
+	}
+	st.transit = transit
+	st.haveTransit = true
+}
+
+// Return the report block for a source, whose highest extended sequence
+// number so far is lastIndex, after count packets. Counters are advanced to
+// the next report.
+func (st *receptionStats) report(source uint32, lastIndex, count uint64, now time.Time) rtcpReport {
+	report := rtcpReport{
+		Source:       source,
+		LastReceived: uint32(lastIndex),
+		Jitter:       st.jitter >> 4,
+	}
+	if count == 0 {
+		return report
+	}
+
+	// Cumulative loss is a signed 24-bit number, negative after duplicates.
+	expected := lastIndex - st.baseIndex + 1
+	lost := int64(expected) - int64(count)
+	if lost > 0x7fffff {
+		lost = 0x7fffff
+	} else if lost < -0x800000 {
+		lost = -0x800000
+	}
+	report.TotalLost = int(lost & 0xffffff)
+
+	expectedInterval := int64(expected - st.expectedPrior)
+	lostInterval := expectedInterval - int64(count-st.receivedPrior)
+	if expectedInterval > 0 && lostInterval > 0 {
+		// Rounded down to the 1/256ths sent, so never a full 1.
+		report.FractionLost = float32(lostInterval*256/expectedInterval) / 256
+		if report.FractionLost >= 1 {
+			report.FractionLost = 255.0 / 256
+		}
+	}
+	st.expectedPrior = expected
+	st.receivedPrior = count
+
+	if !st.lastSenderReportTime.IsZero() {
+		report.LastSenderReportTimestamp = st.lastSenderReport
+		report.LastSenderReportDelay = uint32(now.Sub(st.lastSenderReportTime) * 65536 / time.Second)
+	}
+	return report
+}
+
+// Record a Sender Report from the remote peer, for the LSR and DLSR fields of
+// receiver reports, from which it measures the round-trip time.
+func (s *Stream) handleSenderReport(sr *rtcpSenderReport) {
+	if s.rtpIn == nil || sr.sender != s.RemoteSSRC {
+		return
+	}
+	s.rtpIn.stats.lastSenderReport = uint32(sr.ntpTimestamp >> 16)
+	s.rtpIn.stats.lastSenderReportTime = s.clock.Now()
+}
+
+// Send a Receiver Report for the remote source, with its CNAME and a Receiver
+// Reference Time block.
+// See https://tools.ietf.org/html/rfc3550#section-6.4.2
+func (s *Stream) sendReceiverReport() error {
+	now := s.clock.Now()
+	s.readMutex.Lock()
+	report := s.rtpIn.stats.report(s.RemoteSSRC, s.rtpIn.lastIndex, atomic.LoadUint64(&s.rtpIn.count), now)
+	s.readMutex.Unlock()
+
+	rr := &rtcpReceiverReport{
+		receiver: s.LocalSSRC,
+		reports:  []rtcpReport{report},
+	}
+	sdes := &rtcpSourceDescription{
+		ssrc:  s.LocalSSRC,
+		cname: s.LocalCNAME,
+	}
+	// Let the remote sender respond with a DLRR block, from which we can
+	// measure round-trip time without sending media of our own.
+	xr := &rtcpExtendedReport{
+		ssrc:          s.LocalSSRC,
+		referenceTime: toNTP(now),
+	}
+	return s.rtcpOut.writePacket(rr, sdes, xr)
+}
+
+// Schedule the next receiver report, signalling due when it is. Intervals are
+// randomized between half and one and a half times the mean, so that the
+// reports of receivers that started together spread out.
+// See https://tools.ietf.org/html/rfc3550#section-6.3.1
+func (s *Stream) scheduleReceiverReport(due chan<- struct{}) func() {
+	interval := s.ReportInterval
+	if interval <= 0 {
+		interval = defaultReportInterval
+	}
+	delay := interval/2 + time.Duration(rand.Int63n(int64(interval)))
+	t := s.clock.AfterFunc(delay, func() {
+		select {
+		case due <- struct{}{}:
+		default:
+		}
+	})
+	return func() { t.Stop() }
+}
@@ -0,0 +1,55 @@
+package rtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceptionReport(t *testing.T) {
+	var st receptionStats
+	now := time.Now()
+
+	// 10 packets expected from index 100, of which 8 arrived.
+	st.received(true, 100, 0, now)
+	report := st.report(1, 109, 8, now)
+	assert.Equal(t, uint32(1), report.Source)
+	assert.Equal(t, uint32(109), report.LastReceived)
+	assert.Equal(t, 2, report.TotalLost)
+	assert.Equal(t, float32(51)/256, report.FractionLost)
+	assert.Equal(t, uint32(0), report.LastSenderReportTimestamp)
+
+	// 10 more, all of which arrived.
+	st.lastSenderReport = 0x12345678
+	st.lastSenderReportTime = now.Add(-500 * time.Millisecond)
+	report = st.report(1, 119, 18, now)
+	assert.Equal(t, 2, report.TotalLost)
+	assert.Equal(t, float32(0), report.FractionLost)
+	assert.Equal(t, uint32(0x12345678), report.LastSenderReportTimestamp)
+	assert.Equal(t, uint32(32768), report.LastSenderReportDelay)
+
+	// Duplicates make the cumulative loss negative, in 24 bits.
+	report = st.report(1, 119, 21, now)
+	assert.Equal(t, 0xffffff, report.TotalLost)
+	assert.Equal(t, float32(0), report.FractionLost)
+}
+
+func TestReceptionJitter(t *testing.T) {
+	st := receptionStats{clockRate: 90000}
+	now := time.Now()
+
+	// Packets sent every 10 ms, arriving alternately 0 and 2 ms late.
+	for i := 0; i < 200; i++ {
+		arrival := now.Add(time.Duration(i) * 10 * time.Millisecond)
+		if i%2 == 1 {
+			arrival = arrival.Add(2 * time.Millisecond)
+		}
+		st.received(i == 0, uint64(i), uint32(1000+i*900), arrival)
+	}
+	report := st.report(1, 199, 200, now)
+
+	// Each transit differs by 2 ms, or 180 ticks, from the previous.
+	assert.InDelta(t, 180, report.Jitter, 1)
+	assert.Equal(t, 0, report.TotalLost)
+}
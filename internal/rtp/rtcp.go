@@ -28,6 +28,10 @@ type rtcpHeader struct {
 }
 
 func (h *rtcpHeader) readFrom(r *packet.Reader) error {
+	if err := r.CheckRemaining(rtcpHeaderSize); err != nil {
+		return errors.Errorf("short buffer: %v", err)
+	}
+
 	var version, count byte
 	version, h.padding, count = splitByte215(r.ReadByte())
 	if version != rtpVersion {
@@ -261,7 +265,9 @@ func (sdes *rtcpSourceDescription) readFrom(r *packet.Reader, h *rtcpHeader) err
 
 	var item sdesItem
 	for r.Remaining() > 0 {
-		item.readFrom(r)
+		if err := item.readFrom(r); err != nil {
+			return err
+		}
 		switch item.what {
 		case sdesItemEnd:
 			return nil
@@ -302,27 +308,51 @@ func (item *sdesItem) writeTo(w *packet.Writer) {
 	}
 }
 
-func (item *sdesItem) readFrom(r *packet.Reader) {
+func (item *sdesItem) readFrom(r *packet.Reader) error {
 	item.what = r.ReadByte()
 	if item.what == sdesItemEnd {
 		// Discard zeros up to the next 32-bit (i.e. 4-byte) boundary.
 		r.Align(4)
-	} else {
-		length := int(r.ReadByte())
-		item.text = r.ReadString(length)
+		return nil
 	}
+	if err := r.CheckRemaining(1); err != nil {
+		return errors.Errorf("truncated SDES item: %v", err)
+	}
+	length := int(r.ReadByte())
+	if err := r.CheckRemaining(length); err != nil {
+		return errors.Errorf("truncated SDES item: %v", err)
+	}
+	item.text = r.ReadString(length)
+	return nil
 }
 
 type rtcpGoodbye struct {
 	ssrc   uint32
 	reason string
+
+	// Further sources leaving, e.g. contributing sources of a mixer. Only
+	// parsed, never sent.
+	others []uint32
+}
+
+// Report whether the packet says goodbye from ssrc.
+func (bye *rtcpGoodbye) includes(ssrc uint32) bool {
+	if bye.ssrc == ssrc {
+		return true
+	}
+	for _, other := range bye.others {
+		if other == ssrc {
+			return true
+		}
+	}
+	return false
 }
 
 func (bye *rtcpGoodbye) writeTo(w *packet.Writer) error {
 	h := rtcpHeader{
 		packetType: rtcpGoodbyeType,
 		count:      1,
-		length:     1 + (len(bye.reason)+3)/4,
+		length:     1 + (1+len(bye.reason)+3)/4,
 	}
 	if err := h.writeTo(w); err != nil {
 		return err
@@ -338,10 +368,27 @@ func (bye *rtcpGoodbye) writeTo(w *packet.Writer) error {
 }
 
 func (p *rtcpGoodbye) readFrom(r *packet.Reader, h *rtcpHeader) error {
-	if err := r.CheckRemaining(4); err != nil {
+	if h.length < 1 {
+		return errors.Errorf("invalid Goodbye: length = %d", h.length)
+	}
+	if err := r.CheckRemaining(4 * h.length); err != nil {
 		return err
 	}
+	if h.count == 0 || h.count > h.length {
+		return errors.Errorf("invalid Goodbye: count = %d, length = %d", h.count, h.length)
+	}
 	p.ssrc = r.ReadUint32()
+	for i := 1; i < h.count; i++ {
+		p.others = append(p.others, r.ReadUint32())
+	}
+	// The optional reason follows the SSRCs, padded to 32 bits.
+	if r.Remaining() > 0 {
+		length := int(r.ReadByte())
+		if err := r.CheckRemaining(length); err != nil {
+			return errors.Errorf("truncated Goodbye reason: %v", err)
+		}
+		p.reason = r.ReadString(length)
+	}
 	return nil
 }
 
@@ -362,19 +409,89 @@ type rtcpWriter struct {
 	// SRTP cryptographic context.
 	crypto *cryptoContext
 
+	// CNAME included in compound packets.
+	cname string
+
+	// Whether packets may be sent on their own, rather than in compound
+	// packets (RFC 5506).
+	reducedSize bool
+
 	// Prevent simultaneous writes from multiple goroutines.
 	sync.Mutex
 }
 
-func newRTCPWriter(out io.Writer, ssrc uint32, crypto *cryptoContext) *rtcpWriter {
+func newRTCPWriter(out io.Writer, ssrc uint32, crypto *cryptoContext, maxPacketSize int) *rtcpWriter {
 	w := new(rtcpWriter)
 	w.out = out
 	w.ssrc = ssrc
-	w.buf = make([]byte, 1500) // TODO: Determine from MTU
-	w.crypto = crypto          // By value so that we have our own copy
+	w.buf = make([]byte, maxPacketSize)
+	w.crypto = crypto // By value so that we have our own copy
 	return w
 }
 
+// Return the largest compound RTCP packet that fits in the buffer, once the
+// SRTCP index and authentication tag are added.
+func (w *rtcpWriter) maxCompoundSize() int {
+	n := len(w.buf)
+	if w.crypto != nil {
+		n -= 4 + authTagLength
+	}
+	return n
+}
+
+// Make a valid compound packet from ps, unless reduced-size RTCP is in use: it
+// must start with a Sender or Receiver Report, and include an SDES CNAME. An
+// empty Receiver Report and the SDES are added if missing.
+// See https://tools.ietf.org/html/rfc3550#section-6.1
+func (w *rtcpWriter) compound(ps []rtcpPacket) []rtcpPacket {
+	if w.reducedSize {
+		return ps
+	}
+
+	report := false
+	switch ps[0].(type) {
+	case *rtcpSenderReport, *rtcpReceiverReport:
+		report = true
+	}
+	sdes := false
+	for _, p := range ps {
+		if _, ok := p.(*rtcpSourceDescription); ok {
+			sdes = true
+			break
+		}
+	}
+	if report && sdes {
+		return ps
+	}
+
+	out := make([]rtcpPacket, 0, len(ps)+2)
+	if report {
+		out = append(out, ps[0])
+		ps = ps[1:]
+	} else {
+		out = append(out, &rtcpReceiverReport{receiver: w.ssrc})
+	}
+	if !sdes {
+		out = append(out, &rtcpSourceDescription{ssrc: w.ssrc, cname: w.cname})
+	}
+	return append(out, ps...)
+}
+
+// Return the number of bytes compound adds to a packet without a report or
+// SDES.
+func (w *rtcpWriter) compoundOverhead() int {
+	if w.reducedSize {
+		return 0
+	}
+	items := []sdesItem{{sdesItemCNAME, w.cname}, {sdesItemEnd, ""}}
+	n := 0
+	for _, item := range items {
+		n += item.size()
+	}
+	// Empty Receiver Report, then SDES header, SSRC, and padded items.
+	return 8 + 8 + (n+3)&^3
+}
+
 func (w *rtcpWriter) index() uint64 {
 	return w.count
 }
@@ -386,6 +503,7 @@ func (w *rtcpWriter) writePacket(ps ...rtcpPacket) error {
 	if len(ps) == 0 {
 		return nil
 	}
+	ps = w.compound(ps)
 
 	b := packet.NewWriter(w.buf)
 	for _, p := range ps {
@@ -444,7 +562,10 @@ func (r *rtcpReader) readPacket(buf []byte) error {
 	var index uint64
 	if r.crypto != nil {
 		var err error
-		if buf, index, err = r.crypto.verifyAndDecryptRTCP(buf); err != nil {
+		if buf, index, err = r.crypto.unprotectRTCP(buf); err == errSRTPReplay {
+			log.Debug("Dropping replayed SRTCP packet from %08x", r.ssrc)
+			return nil
+		} else if err != nil {
 			return err
 		}
 	} else {
@@ -462,6 +583,11 @@ func (r *rtcpReader) readPacket(buf []byte) error {
 		if err := h.readFrom(pr); err != nil {
 			return err
 		}
+		if err := pr.CheckRemaining(4 * h.length); err != nil {
+			return errors.Errorf("truncated RTCP packet: type = %d, %v", h.packetType, err)
+		}
+		// Confine each packet's parser to the length in its header.
+		body := packet.NewReader(pr.ReadSlice(4 * h.length))
 
 		var p rtcpPacket
 		switch h.packetType {
@@ -475,16 +601,17 @@ func (r *rtcpReader) readPacket(buf []byte) error {
 			p = new(rtcpGoodbye)
 		case rtcpTransportLayerFeedbackType, rtcpPayloadSpecificFeedbackType:
 			p = newFeedbackPacket(h.packetType, h.count)
+		case rtcpExtendedReportType:
+			p = new(rtcpExtendedReport)
 		default:
 			log.Debug("Ignoring unimplemented RTCP packet type: %d", h.packetType)
 		}
 
 		if p == nil {
-			pr.Skip(4 * h.length)
 			continue
 		}
 
-		if err := p.readFrom(pr, &h); err != nil {
+		if err := p.readFrom(body, &h); err != nil {
 			return err
 		}
 		r.count += 1
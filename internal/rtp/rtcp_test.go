@@ -0,0 +1,105 @@
+package rtp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCompoundRTCP(t *testing.T) {
+	cases := []struct {
+		reducedSize bool
+		packets     []rtcpPacket
+		expected    []string
+	}{
+		// Feedback on its own is wrapped in a compound packet.
+		{false, []rtcpPacket{&pliFeedbackMessage{sender: 1, source: 2}},
+			[]string{"*rtp.rtcpReceiverReport", "*rtp.rtcpSourceDescription", "*rtp.pliFeedbackMessage"}},
+		// A report without SDES gets one after the report.
+		{false, []rtcpPacket{&rtcpReceiverReport{receiver: 1}, &rtcpExtendedReport{ssrc: 1}},
+			[]string{"*rtp.rtcpReceiverReport", "*rtp.rtcpSourceDescription", "*rtp.rtcpExtendedReport"}},
+		// Already valid.
+		{false, []rtcpPacket{&rtcpReceiverReport{receiver: 1}, &rtcpSourceDescription{ssrc: 1, cname: "x"}},
+			[]string{"*rtp.rtcpReceiverReport", "*rtp.rtcpSourceDescription"}},
+		// Reduced-size RTCP is sent as is.
+		{true, []rtcpPacket{&pliFeedbackMessage{sender: 1, source: 2}},
+			[]string{"*rtp.pliFeedbackMessage"}},
+	}
+
+	for i, c := range cases {
+		var out packetRecorder
+		w := newRTCPWriter(&out, 1, nil, 1200)
+		w.cname = "alohartc"
+		w.reducedSize = c.reducedSize
+		if err := w.writePacket(c.packets...); err != nil {
+			t.Fatal(err)
+		}
+
+		var types []string
+		r := newRTCPReader(2, nil)
+		r.handler = func(p rtcpPacket) error {
+			types = append(types, fmt.Sprintf("%T", p))
+			return nil
+		}
+		if err := r.readPacket(out[0]); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(types, c.expected) {
+			t.Errorf("case %d: expected %v, not %v", i, c.expected, types)
+		}
+		// A PLI is 12 bytes; the rest is what compound added.
+		if i == 0 && len(out[0]) != 12+w.compoundOverhead() {
+			t.Errorf("compound overhead is %d bytes, not %d", len(out[0])-12, w.compoundOverhead())
+		}
+	}
+}
+
+// Truncated packets must be rejected, not read past the end of the buffer.
+func TestTruncatedRTCP(t *testing.T) {
+	var out packetRecorder
+	w := newRTCPWriter(&out, 1, nil, 1200)
+	w.cname = "alohartc"
+	err := w.writePacket(
+		&rtcpReceiverReport{receiver: 1, reports: []rtcpReport{{Source: 2}}},
+		&nackFeedbackMessage{sender: 1, source: 2, pid: 10, blp: 0x2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRTCPReader(2, nil)
+	r.handler = func(p rtcpPacket) error { return nil }
+	for n := 0; n < len(out[0]); n++ {
+		// Errors are expected; panics are not.
+		r.readPacket(out[0][:n])
+	}
+}
+
+func TestGoodbye(t *testing.T) {
+	// BYE from two sources, with a reason.
+	buf := []byte{
+		0x82, 203, 0, 4,
+		0, 0, 0x16, 0x2e,
+		0, 0, 0x04, 0xd2,
+		4, 'g', 'o', 'n',
+		'e', 0, 0, 0,
+	}
+	var bye *rtcpGoodbye
+	r := newRTCPReader(5678, nil)
+	r.handler = func(p rtcpPacket) error {
+		bye, _ = p.(*rtcpGoodbye)
+		return nil
+	}
+	if err := r.readPacket(buf); err != nil {
+		t.Fatal(err)
+	}
+	if bye == nil {
+		t.Fatal("expected a BYE")
+	}
+	if bye.ssrc != 5678 || bye.reason != "gone" {
+		t.Errorf("expected BYE from 5678 with reason \"gone\", got %#v", bye)
+	}
+	if !bye.includes(1234) || bye.includes(42) {
+		t.Errorf("wrong sources in %#v", bye)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"io"
 	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	errors "golang.org/x/xerrors"
 
 	"github.com/golang/groupcache/lru"
+	"github.com/lanikai/alohartc/internal/clock"
 	"github.com/lanikai/alohartc/internal/packet"
 )
 
@@ -29,18 +32,32 @@ import (
 //   |                             ....                              |
 //   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 type rtpHeader struct {
-	padding     bool // unused
-	extension   bool // unused
+	padding     bool
+	extension   bool
 	marker      bool
 	payloadType byte
 	sequence    uint16
 	timestamp   uint32
 	ssrc        uint32
 	csrc        []uint32 // unused
+	extensions  []rtpExtension
+
+	// Size of the header extension block, set by readFrom and writeTo.
+	extensionSize int
 }
 
 func (h *rtpHeader) length() int {
-	return rtpHeaderSize + 4*len(h.csrc)
+	return rtpHeaderSize + 4*len(h.csrc) + h.extensionSize
+}
+
+// Return the data of the extension with the given ID, or nil if absent.
+func (h *rtpHeader) getExtension(id byte) []byte {
+	for _, ext := range h.extensions {
+		if ext.id == id {
+			return ext.data
+		}
+	}
+	return nil
 }
 
 const (
@@ -49,6 +66,7 @@ const (
 )
 
 func (h *rtpHeader) writeTo(w *packet.Writer) {
+	h.extension = len(h.extensions) > 0
 	w.WriteByte(joinByte2114(rtpVersion, h.padding, h.extension, byte(len(h.csrc))))
 	w.WriteByte(joinByte17(h.marker, h.payloadType))
 	w.WriteUint16(h.sequence)
@@ -57,6 +75,11 @@ func (h *rtpHeader) writeTo(w *packet.Writer) {
 	for i := range h.csrc {
 		w.WriteUint32(h.csrc[i])
 	}
+	h.extensionSize = 0
+	if h.extension {
+		h.extensionSize = extensionBlockSize(h.extensions)
+		writeExtensions(w, h.extensions)
+	}
 }
 
 func (h *rtpHeader) readFrom(r *packet.Reader) error {
@@ -69,7 +92,7 @@ func (h *rtpHeader) readFrom(r *packet.Reader) error {
 	if version != rtpVersion {
 		return errBadVersion(version)
 	}
-	if err := r.CheckRemaining(4 * int(csrcCount)); err != nil {
+	if err := r.CheckRemaining(rtpHeaderSize - 1 + 4*int(csrcCount)); err != nil {
 		return errors.Errorf("short buffer: %v", err)
 	}
 	h.marker, h.payloadType = splitByte17(r.ReadByte())
@@ -80,6 +103,14 @@ func (h *rtpHeader) readFrom(r *packet.Reader) error {
 	for i := 0; i < int(csrcCount); i++ {
 		h.csrc = append(h.csrc, r.ReadUint32())
 	}
+	h.extensions = nil
+	h.extensionSize = 0
+	if h.extension {
+		var err error
+		if h.extensions, h.extensionSize, err = readExtensions(r); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -90,8 +121,9 @@ type rtpWriter struct {
 	ssrc uint32
 
 	// Initial sequence number. The current sequence number is computed from
-	// sequenceStart and count.
+	// sequenceStart and the packets sent since, count less countStart.
 	sequenceStart uint16
+	countStart    uint64
 
 	// Number of RTP packets sent.
 	count uint64
@@ -102,26 +134,62 @@ type rtpWriter struct {
 	// SRTP cryptographic context.
 	crypto *cryptoContext
 
+	// Negotiated header extensions.
+	extensionIDs extensionIDs
+
+	// Value of the MID header extension.
+	mid string
+
+	// Value of the playout delay header extension, or nil to not send it.
+	playoutDelay *PlayoutDelay
+
+	// Maximum size of a serialized packet, including the SRTP tag.
+	maxPacketSize int
+
+	// Transport-wide sequence number, shared with the other streams in the
+	// session. Accessed atomically.
+	transportSequence *uint32
+
+	// Media clock: timestamps are derived from the wall-clock time elapsed
+	// since the session's epoch, at clockRate, plus a random offset.
+	epoch           time.Time
+	clockRate       int
+	timestampOffset uint32
+
+	// Latest timestamp sent, and the wall-clock time it was first
+	// sent at, for mapping timestamps to NTP time in Sender Reports.
+	lastTimestamp uint32
+	lastTime      time.Time
+
 	// Prevent simultaneous writes from multiple goroutines.
 	sync.Mutex
 
 	// Least-recently used cache for retransmitting lost packets.
 	cache *lru.Cache
 
+	// Spaces out packets, or nil to send them as fast as possible.
+	pacer *pacer
+
 	// Buffer pool used for serializing packets.
 	pool sync.Pool
+
+	// Source of wall-clock time.
+	clock clock.Clock
 }
 
-func newRTPWriter(out io.Writer, ssrc uint32, crypto *cryptoContext) *rtpWriter {
+func newRTPWriter(out io.Writer, ssrc uint32, crypto *cryptoContext, maxPacketSize int) *rtpWriter {
 	w := new(rtpWriter)
 	w.out = out
 	w.ssrc = ssrc
+	w.maxPacketSize = maxPacketSize
 	w.sequenceStart = uint16(rand.Uint32())
+	w.timestampOffset = rand.Uint32()
 	w.crypto = crypto
 	w.cache = lru.New(rtpCacheSize)
+	w.clock = clock.System
 	w.pool = sync.Pool{
 		New: func() interface{} {
-			return make([]byte, 1500) // TODO: Determine from MTU
+			return make([]byte, w.maxPacketSize)
 		},
 	}
 	w.cache.OnEvicted = func(key lru.Key, value interface{}) {
@@ -135,6 +203,12 @@ func newRTPWriter(out io.Writer, ssrc uint32, crypto *cryptoContext) *rtpWriter
 
 // Send a single RTP packet to the remote peer.
 func (w *rtpWriter) writePacket(payloadType byte, marker bool, timestamp uint32, payload []byte) error {
+	return w.writePacketWithExtensions(payloadType, marker, timestamp, payload, nil)
+}
+
+// Send a single RTP packet, with additional header extensions specific to its
+// payload (e.g. audio level).
+func (w *rtpWriter) writePacketWithExtensions(payloadType byte, marker bool, timestamp uint32, payload []byte, extra []rtpExtension) error {
 	w.Lock()
 	defer w.Unlock()
 
@@ -145,6 +219,7 @@ func (w *rtpWriter) writePacket(payloadType byte, marker bool, timestamp uint32,
 		sequence:    uint16(index),
 		timestamp:   timestamp,
 		ssrc:        w.ssrc,
+		extensions:  append(w.makeExtensions(), extra...),
 	}
 
 	p := packet.NewWriter(w.pool.Get().([]byte))
@@ -162,14 +237,138 @@ func (w *rtpWriter) writePacket(payloadType byte, marker bool, timestamp uint32,
 
 	w.count += 1
 	w.totalBytes += uint64(len(payload))
+	// Timestamps of reordered pictures (B-frames) go backwards, and don't
+	// say when they were sent.
+	if int32(timestamp-w.lastTimestamp) > 0 || w.lastTime.IsZero() {
+		w.lastTimestamp = timestamp
+		w.lastTime = w.clock.Now()
+	}
 
 	// Add packet to cache for retransmission in case of nack.
 	w.cache.Add(uint16(index), p.Bytes())
 
+	if w.pacer != nil {
+		w.pacer.wait(len(p.Bytes()))
+	}
+	_, err := w.out.Write(p.Bytes())
+	return err
+}
+
+// Send a packet of padding only, with a padding length of size bytes (at most
+// 255), which the receiver discards. It takes the timestamp of the latest
+// media, or that of the session's epoch before any, and is not kept for
+// retransmission.
+// See https://tools.ietf.org/html/rfc3550#section-5.1
+func (w *rtpWriter) writePadding(payloadType byte, size int) error {
+	w.Lock()
+	defer w.Unlock()
+
+	index := w.index()
+	// The clock rate may not be set yet, so don't extrapolate.
+	timestamp := w.lastTimestamp
+	if w.lastTime.IsZero() {
+		timestamp = w.timestampOffset
+	}
+	hdr := rtpHeader{
+		padding:     true,
+		payloadType: payloadType,
+		sequence:    uint16(index),
+		timestamp:   timestamp,
+		ssrc:        w.ssrc,
+		extensions:  w.makeExtensions(),
+	}
+
+	buf := w.pool.Get().([]byte)
+	defer w.pool.Put(buf)
+	p := packet.NewWriter(buf)
+	hdr.writeTo(p)
+	padding := make([]byte, size)
+	padding[size-1] = byte(size)
+	if err := p.WriteSlice(padding); err != nil {
+		return err
+	}
+
+	if w.crypto != nil {
+		if err := w.crypto.encryptAndSignRTP(p, &hdr, index); err != nil {
+			return err
+		}
+	}
+
+	w.count += 1
 	_, err := w.out.Write(p.Bytes())
 	return err
 }
 
+// Return the RTP timestamp for media captured at t, derived from the session's
+// shared epoch so that all streams in the session agree.
+func (w *rtpWriter) clockTimestamp(t time.Time) uint32 {
+	elapsed := t.Sub(w.epoch)
+	rate := int64(w.clockRate)
+	secs := int64(elapsed / time.Second)
+	frac := int64(elapsed % time.Second)
+	return w.timestampOffset + uint32(secs*rate+frac*rate/int64(time.Second))
+}
+
+// Extrapolate the RTP timestamp at time t from the most recently sent one.
+// Must be called with the lock held.
+func (w *rtpWriter) timestampAt(t time.Time) uint32 {
+	if w.lastTime.IsZero() {
+		return w.clockTimestamp(t)
+	}
+	elapsed := t.Sub(w.lastTime)
+	return w.lastTimestamp + uint32(int64(elapsed)*int64(w.clockRate)/int64(time.Second))
+}
+
+// Return the largest payload that fits in a packet of maxPacketSize, once the
+// header, the session's header extensions, and the SRTP tag are added.
+// Payload-specific extensions are not accounted for.
+func (w *rtpWriter) maxPayloadSize() int {
+	n := w.maxPacketSize - rtpHeaderSize - w.extensionSize()
+	if w.crypto != nil {
+		n -= authTagLength
+	}
+	return n
+}
+
+// Return the size of the header extension block added by makeExtensions.
+func (w *rtpWriter) extensionSize() int {
+	var exts []rtpExtension
+	ids := w.extensionIDs
+	if ids.absSendTime != 0 {
+		exts = append(exts, rtpExtension{ids.absSendTime, make([]byte, 3)})
+	}
+	if ids.mid != 0 && w.mid != "" {
+		exts = append(exts, rtpExtension{ids.mid, []byte(w.mid)})
+	}
+	if ids.transportCC != 0 && w.transportSequence != nil {
+		exts = append(exts, rtpExtension{ids.transportCC, make([]byte, 2)})
+	}
+	if ids.playoutDelay != 0 && w.playoutDelay != nil {
+		exts = append(exts, rtpExtension{ids.playoutDelay, make([]byte, 3)})
+	}
+	return extensionBlockSize(exts)
+}
+
+// Return the header extensions for the next outgoing packet.
+func (w *rtpWriter) makeExtensions() []rtpExtension {
+	var exts []rtpExtension
+	ids := w.extensionIDs
+	if ids.absSendTime != 0 {
+		exts = append(exts, rtpExtension{ids.absSendTime, absSendTime(w.clock.Now())})
+	}
+	if ids.mid != 0 && w.mid != "" {
+		exts = append(exts, rtpExtension{ids.mid, []byte(w.mid)})
+	}
+	if ids.transportCC != 0 && w.transportSequence != nil {
+		seq := atomic.AddUint32(w.transportSequence, 1)
+		exts = append(exts, rtpExtension{ids.transportCC, []byte{byte(seq >> 8), byte(seq)}})
+	}
+	if ids.playoutDelay != 0 && w.playoutDelay != nil {
+		exts = append(exts, playoutDelayExtension(ids.playoutDelay, *w.playoutDelay))
+	}
+	return exts
+}
+
 // Resend the specified sequence number if available in cache.
 func (w *rtpWriter) resend(sequenceNumber uint16) {
 	w.Lock()
@@ -186,7 +385,16 @@ func (w *rtpWriter) resend(sequenceNumber uint16) {
 // Compute the RTP packet index, also known as the extended sequence number.
 // Equivalent to rolloverCounter*2^16 + sequenceNumber (i.e. ROC || SEQ).
 func (w *rtpWriter) index() uint64 {
-	return w.count + uint64(w.sequenceStart)
+	return w.count - w.countStart + uint64(w.sequenceStart)
+}
+
+// Switch to sending from ssrc. The receiver starts the new SSRC's ROC at 0
+// (see RFC 3711 Section 3.3.1), so the index starts over from the current
+// sequence number. Must be called with the lock held.
+func (w *rtpWriter) setSSRC(ssrc uint32) {
+	w.ssrc = ssrc
+	w.sequenceStart = uint16(w.index())
+	w.countStart = w.count
 }
 
 // Compute the current sequence number.
@@ -202,6 +410,18 @@ func (w *rtpWriter) rolloverCounter() uint32 {
 
 // rtpReader maintains state necessary for receiving RTP data packets.
 type rtpReader struct {
+	// Number of RTP packets received. Accessed atomically, so must be 64-bit
+	// aligned (see sync/atomic bugs).
+	count uint64
+
+	// Total number of payload bytes received. Accessed atomically.
+	totalBytes uint64
+
+	// Number of packets given up as lost, and number discarded for arriving
+	// too late to be used. Accessed atomically.
+	lost uint64
+	late uint64
+
 	ssrc uint32
 
 	// Most recent observed sequence number.
@@ -211,25 +431,31 @@ type rtpReader struct {
 	// observed sequence number and the number of times it has rolled over.
 	lastIndex uint64
 
-	// Number of RTP packets received.
-	count uint64
-
-	// Total number of payload bytes received.
-	totalBytes uint64
-
 	// SRTP cryptographic context.
 	crypto *cryptoContext
 
+	// Loss, jitter and Sender Reports, for receiver reports. Updated under
+	// the stream's readMutex.
+	stats receptionStats
+
+	// Gaps in the received sequence, for requesting retransmission. Nil if
+	// NACKs are not sent.
+	nacks *nackTracker
+
 	// Callback for RTP packets. This function should return quickly to avoid
 	// blocking the RTP read loop. If it needs the payload bytes for longer than
 	// the lifetime of the function call, it *must* make a copy.
 	handler func(hdr rtpHeader, payload []byte) error
+
+	// Source of wall-clock time.
+	clock clock.Clock
 }
 
 func newRTPReader(ssrc uint32, crypto *cryptoContext) *rtpReader {
 	r := new(rtpReader)
 	r.ssrc = ssrc
 	r.crypto = crypto
+	r.clock = clock.System
 	return r
 }
 
@@ -242,20 +468,44 @@ func (r *rtpReader) readPacket(buf []byte) error {
 		return err
 	}
 
-	index := r.updateIndex(hdr.sequence)
-
+	// The crypto context tracks the ROC of each SSRC, since a stream may
+	// receive from more than one, and only advances it for authenticated
+	// packets. Duplicates, e.g. a retransmission of a packet that arrived
+	// after all, are dropped.
 	var payload []byte
 	if r.crypto != nil {
 		var err error
-		if payload, err = r.crypto.verifyAndDecryptRTP(buf, &hdr, index); err != nil {
+		if payload, _, err = r.crypto.unprotectRTP(buf, &hdr); err == errSRTPReplay {
+			log.Debug("Dropping replayed SRTP packet %d from %08x", hdr.sequence, hdr.ssrc)
+			return nil
+		} else if err != nil {
 			return err
 		}
 	} else {
 		payload = buf[hdr.length():]
 	}
+	prevIndex := r.lastIndex
+	index := r.updateIndex(hdr.sequence)
+	if hdr.padding {
+		// The last octet counts the padding, including itself.
+		if len(payload) == 0 || int(payload[len(payload)-1]) == 0 || int(payload[len(payload)-1]) > len(payload) {
+			return errors.New("invalid RTP padding")
+		}
+		payload = payload[:len(payload)-int(payload[len(payload)-1])]
+	}
+
+	// Only authenticated packets count towards gaps, so that forged ones
+	// can't provoke a flood of NACKs.
+	if r.nacks != nil && atomic.LoadUint64(&r.count) > 0 {
+		r.nacks.received(prevIndex, index, r.clock.Now())
+	}
 
-	r.count += 1
-	r.totalBytes += uint64(len(payload))
+	r.stats.received(atomic.LoadUint64(&r.count) == 0, index, hdr.timestamp, r.clock.Now())
+
+	// Counters are updated atomically, since Stream.Stats() may read them
+	// from another goroutine.
+	atomic.AddUint64(&r.count, 1)
+	atomic.AddUint64(&r.totalBytes, uint64(len(payload)))
 
 	if r.handler == nil {
 		log.Warn("received RTP packet, but no handler registered")
@@ -276,22 +526,32 @@ func (r *rtpReader) updateIndex(sequence uint16) uint64 {
 		return r.lastIndex
 	}
 
+	index := estimateIndex(r.lastIndex, r.lastSequence, sequence)
+	if index > r.lastIndex {
+		r.lastIndex = index
+		r.lastSequence = sequence
+	}
+	return index
+}
+
+// Estimate the index of a packet with the given sequence number, from the
+// highest index received so far and its sequence number: the index nearest
+// lastIndex, correcting for rollover.
+func estimateIndex(lastIndex uint64, lastSequence, sequence uint16) uint64 {
 	// If either sequence or lastSequence is close to 2^16, and the other is
 	// close to 0, then correct for rollover.
-	delta := int64(sequence) - int64(r.lastSequence)
+	delta := int64(sequence) - int64(lastSequence)
 	if delta > 32768 {
 		delta -= 65536
 	} else if delta <= -32768 {
 		delta += 65536
 	}
 	if delta > 4096 {
-		log.Debug("large RTP sequence number delta: %d -> %d", r.lastSequence, sequence)
+		log.Debug("large RTP sequence number delta: %d -> %d", lastSequence, sequence)
 	}
-
-	index := uint64(int64(r.lastIndex) + delta)
-	if index > r.lastIndex {
-		r.lastIndex = index
-		r.lastSequence = sequence
+	if int64(lastIndex)+delta < 0 {
+		// Before the first packet, with ROC 0.
+		return uint64(sequence)
 	}
-	return index
+	return uint64(int64(lastIndex) + delta)
 }
@@ -0,0 +1,81 @@
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaClock(t *testing.T) {
+	epoch := time.Now()
+	video := &rtpWriter{epoch: epoch, clockRate: 90000, timestampOffset: 1000}
+	audio := &rtpWriter{epoch: epoch, clockRate: 48000, timestampOffset: 0xfffffff0}
+
+	// Both clocks advance in step with the shared epoch, even across rollover
+	// and after long sessions.
+	at := epoch.Add(72*time.Hour + 1500*time.Millisecond)
+	elapsed := uint64(72*3600) + 1
+	if ts := video.clockTimestamp(at); ts != uint32(1000+elapsed*90000+45000) {
+		t.Errorf("unexpected video timestamp %d", ts)
+	}
+	if ts := audio.clockTimestamp(at); ts != uint32(0xfffffff0+elapsed*48000+24000) {
+		t.Errorf("unexpected audio timestamp %d", ts)
+	}
+
+	// Sender Reports extrapolate from the last sent timestamp.
+	video.lastTimestamp = 5000
+	video.lastTime = at
+	if ts := video.timestampAt(at.Add(100 * time.Millisecond)); ts != 5000+9000 {
+		t.Errorf("expected timestamp %d, not %d", 5000+9000, ts)
+	}
+}
+
+type packetRecorder [][]byte
+
+func (r *packetRecorder) Write(b []byte) (int, error) {
+	*r = append(*r, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestSetSSRCRestartsROC(t *testing.T) {
+	w := &rtpWriter{sequenceStart: 65534, count: 4}
+	if w.index() != 65538 {
+		t.Fatalf("unexpected index %d", w.index())
+	}
+
+	// The sequence continues, but the new SSRC's ROC is 0.
+	w.setSSRC(2)
+	if w.ssrc != 2 || w.index() != 2 {
+		t.Errorf("unexpected index %d after switching SSRC", w.index())
+	}
+	w.count++
+	if w.sequenceNumber() != 3 || w.rolloverCounter() != 0 {
+		t.Errorf("unexpected sequence %d, ROC %d", w.sequenceNumber(), w.rolloverCounter())
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	const maxPacketSize = 1000 - ipUDPOverhead
+	var out packetRecorder
+	crypto, err := newCryptoContext(make([]byte, encryptKeyLength), make([]byte, saltKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &h264Writer{rtpWriter: newRTPWriter(&out, 1, crypto, maxPacketSize)}
+	w.extensionIDs = extensionIDs{absSendTime: 1, mid: 2, transportCC: 3}
+	w.mid = "video"
+	w.transportSequence = new(uint32)
+
+	nalu := make([]byte, 5000)
+	nalu[0] = 0x65 // IDR slice
+	if err := w.packetize(nalu, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) < 6 {
+		t.Errorf("expected at least 6 FU-A packets, not %d", len(out))
+	}
+	for i, b := range out {
+		if len(b) > maxPacketSize {
+			t.Errorf("packet %d is %d bytes, larger than %d", i, len(b), maxPacketSize)
+		}
+	}
+}
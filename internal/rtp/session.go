@@ -1,8 +1,15 @@
 package rtp
 
 import (
+	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/lanikai/alohartc/internal/leak"
 )
 
 type SessionOptions struct {
@@ -19,58 +26,114 @@ type SessionOptions struct {
 	WriteKey  []byte
 	WriteSalt []byte
 
-	// Maximum size of outgoing packets, factoring in MTU and protocol overhead.
+	// Maximum transmission unit of the path to the remote peer, i.e. the
+	// largest IP packet that gets through unfragmented. Defaults to
+	// DefaultMTU.
+	MTU int
+
+	// Maximum size of outgoing packets (UDP payloads), including RTP headers
+	// and SRTP authentication tags. Defaults to MTU less the IP and UDP
+	// headers.
 	MaxPacketSize int
+
+	// Allocator to update with the remote peer's bandwidth estimates (REMB),
+	// shared by all streams in the session. May be nil.
+	Bandwidth *BandwidthAllocator
+
+	// Don't change a stream's SSRC when the remote peer is found to be
+	// sending with it. See OnSSRCCollision.
+	IgnoreSSRCCollisions bool
+
+	// Called, from the session's read loop, after a stream switched to a
+	// new SSRC because of a collision (see RFC 3550 Section 8.2), e.g. to
+	// update the session description. May be nil.
+	OnSSRCCollision func(stream *Stream, oldSSRC, newSSRC uint32)
+
+	// Clock for timestamps and for the timing of RTCP reports and feedback,
+	// so that tests can drive them with a fake clock. Defaults to the system
+	// clock.
+	Clock clock.Clock
+
+	// Resources, if non-nil, accounts for the session's read loops, which
+	// run until its connections are closed.
+	Resources *leak.Tracker
 }
 
 const (
-	// It's hard to find authoritative information, but according to a popular
-	// StackOverflow answer, a 512-byte UDP payload is generally considered safe
-	// (https://stackoverflow.com/a/1099359/11194515).
-	defaultMaxPacketSize = 512
+	// The minimum MTU of IPv6 links. Few paths have a smaller MTU, even
+	// through tunnels and VPNs, so it is a safe default when the actual path
+	// MTU is unknown. See https://tools.ietf.org/html/rfc8200#section-5
+	DefaultMTU = 1280
+
+	// Size of IP and UDP headers, assuming IPv6 (40 bytes) since it's larger
+	// than IPv4 (20 bytes without options).
+	ipUDPOverhead = 40 + 8
 )
 
 // A Session represents an established RTP/RTCP connection to a remote peer. It
 // contains one or more streams, each represented by their own SSRC.
 type Session struct {
+	// Transport-wide sequence number for the transport-cc header extension.
+	// Accessed atomically.
+	transportSequence uint32
+
 	SessionOptions
 
+	// Reference time from which every outgoing stream derives its RTP
+	// timestamps, so that their media clocks advance together.
+	epoch time.Time
+
 	// RTP streams in this session, keyed by SSRC. Every stream appears twice in
 	// the map, once for the local SSRC and once for the remote SSRC.
-	streams map[uint32]*Stream
+	streams      map[uint32]*Stream
+	streamsMutex sync.Mutex
 
 	// SRTP cryptographic contexts.
 	readContext  *cryptoContext
 	writeContext *cryptoContext
 }
 
-func NewSession(opts SessionOptions) *Session {
+// NewSession starts an RTP session over the connections in opts. It fails if
+// the SRTP keys in opts are invalid.
+func NewSession(opts SessionOptions) (*Session, error) {
+	if opts.MTU == 0 {
+		opts.MTU = DefaultMTU
+	}
 	if opts.MaxPacketSize == 0 {
-		opts.MaxPacketSize = defaultMaxPacketSize
+		opts.MaxPacketSize = opts.MTU - ipUDPOverhead
+	}
+	if opts.Clock == nil {
+		opts.Clock = clock.System
 	}
 
 	s := &Session{
 		SessionOptions: opts,
+		epoch:          opts.Clock.Now(),
 		streams:        make(map[uint32]*Stream),
 	}
 
+	var err error
 	if opts.ReadKey != nil && opts.ReadSalt != nil {
-		s.readContext = newCryptoContext(opts.ReadKey, opts.ReadSalt)
+		if s.readContext, err = newCryptoContext(opts.ReadKey, opts.ReadSalt); err != nil {
+			return nil, fmt.Errorf("SRTP read key: %v", err)
+		}
 	}
 	if opts.WriteKey != nil && opts.WriteSalt != nil {
-		s.writeContext = newCryptoContext(opts.WriteKey, opts.WriteSalt)
+		if s.writeContext, err = newCryptoContext(opts.WriteKey, opts.WriteSalt); err != nil {
+			return nil, fmt.Errorf("SRTP write key: %v", err)
+		}
 	}
 
 	if s.MuxConn != nil {
 		// Mux RTP and RTCP over a single connection.
 		s.DataConn = s.MuxConn
 		s.ControlConn = s.MuxConn
-		go s.readLoop(s.MuxConn)
+		s.Resources.Go("RTP read loop", func() { s.readLoop(s.MuxConn) })
 	} else {
-		go s.readLoop(s.DataConn)
-		go s.readLoop(s.ControlConn)
+		s.Resources.Go("RTP read loop", func() { s.readLoop(s.DataConn) })
+		s.Resources.Go("RTCP read loop", func() { s.readLoop(s.ControlConn) })
 	}
-	return s
+	return s, nil
 }
 
 func (s *Session) Close() error {
@@ -88,14 +151,49 @@ func (s *Session) AddStream(opts StreamOptions) *Stream {
 		opts.MaxPacketSize = s.MaxPacketSize
 	}
 	stream := newStream(s, opts)
+	s.streamsMutex.Lock()
 	s.streams[stream.LocalSSRC] = stream
 	s.streams[stream.RemoteSSRC] = stream
+	s.streamsMutex.Unlock()
 	return stream
 }
 
 func (s *Session) RemoveStream(stream *Stream) {
+	s.streamsMutex.Lock()
 	delete(s.streams, stream.LocalSSRC)
 	delete(s.streams, stream.RemoteSSRC)
+	s.streamsMutex.Unlock()
+}
+
+// Return the stream with the given local or remote SSRC, or nil.
+func (s *Session) lookupStream(ssrc uint32) *Stream {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+	return s.streams[ssrc]
+}
+
+// Switch a stream whose SSRC collided to a new random one, saying goodbye from
+// the old one first (see RFC 3550 Section 8.2).
+func (s *Session) resolveCollision(stream *Stream) {
+	oldSSRC := stream.LocalSSRC
+	newSSRC := oldSSRC
+	for newSSRC == 0 || s.lookupStream(newSSRC) != nil {
+		newSSRC = rand.Uint32()
+	}
+	log.Warn("RTP session: SSRC collision on %08x, switching to %08x", oldSSRC, newSSRC)
+
+	stream.sendGoodbye("SSRC collision")
+	s.streamsMutex.Lock()
+	if oldSSRC != stream.RemoteSSRC {
+		delete(s.streams, oldSSRC)
+	}
+	stream.setLocalSSRC(newSSRC)
+	s.streams[newSSRC] = stream
+	s.streamsMutex.Unlock()
+
+	if s.OnSSRCCollision != nil {
+		s.OnSSRCCollision(stream, oldSSRC, newSSRC)
+	}
 }
 
 // Reads packets from conn. Returns on read error or when conn is closed.
@@ -115,24 +213,41 @@ func (s *Session) readLoop(conn net.Conn) {
 		pkt := buf[0:n]
 		rtcp, ssrc, err := identifyPacket(pkt)
 		if err != nil {
-			log.Error("RTP session: %v", err)
-			return
+			// Don't let a stray packet end the session.
+			log.Debug("RTP session: %v", err)
+			continue
 		}
 
-		stream := s.streams[ssrc]
+		stream := s.lookupStream(ssrc)
+		if stream == nil {
+			// A stream whose remote SSRC wasn't announced, e.g. an RTSP
+			// client's, takes packets from any unknown source.
+			stream = s.lookupStream(0)
+		}
 		if stream == nil {
 			log.Debug("RTP session: unknown SSRC %02x", ssrc)
 			continue
 		}
 
+		// Our own packets never come back, so the remote peer (or a
+		// loop) is using our SSRC.
+		if ssrc == stream.LocalSSRC && !s.IgnoreSSRCCollisions {
+			s.resolveCollision(stream)
+			if stream = s.lookupStream(ssrc); stream == nil {
+				continue
+			}
+		}
+
+		stream.readMutex.Lock()
 		if rtcp {
 			if err := stream.rtcpIn.readPacket(pkt); err != nil {
 				log.Error("RTP session: %v", err)
 			}
-		} else {
+		} else if stream.rtpIn != nil {
 			if err := stream.rtpIn.readPacket(pkt); err != nil {
 				log.Error("RTP session: %v", err)
 			}
 		}
+		stream.readMutex.Unlock()
 	}
 }
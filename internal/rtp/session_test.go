@@ -0,0 +1,189 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+func TestSSRCCollision(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	type change struct{ oldSSRC, newSSRC uint32 }
+	changes := make(chan change, 1)
+	session, err := NewSession(SessionOptions{
+		MuxConn: local,
+		OnSSRCCollision: func(stream *Stream, oldSSRC, newSSRC uint32) {
+			changes <- change{oldSSRC, newSSRC}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stream := session.AddStream(StreamOptions{
+		LocalSSRC:  1234,
+		LocalCNAME: "test",
+		RemoteSSRC: 5678,
+		Direction:  "sendrecv",
+	})
+
+	// The remote peer sends RTP with our SSRC.
+	pkt := make([]byte, 13)
+	pkt[0] = 0x80
+	pkt[1] = 96
+	binary.BigEndian.PutUint32(pkt[8:], 1234)
+	go remote.Write(pkt)
+
+	// We say goodbye from the old SSRC.
+	buf := make([]byte, 1500)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := remote.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bye *rtcpGoodbye
+	r := newRTCPReader(5678, nil)
+	r.handler = func(p rtcpPacket) error {
+		if b, ok := p.(*rtcpGoodbye); ok {
+			bye = b
+		}
+		return nil
+	}
+	if err := r.readPacket(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if bye == nil || bye.ssrc != 1234 {
+		t.Errorf("expected BYE from SSRC 1234, got %#v", bye)
+	}
+
+	select {
+	case c := <-changes:
+		if c.oldSSRC != 1234 || c.newSSRC == 1234 || c.newSSRC != stream.LocalSSRC {
+			t.Errorf("unexpected SSRC change %v, stream now has %d", c, stream.LocalSSRC)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no SSRC change")
+	}
+}
+
+func TestRemoteGoodbye(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	session, err := NewSession(SessionOptions{MuxConn: local})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stream := session.AddStream(StreamOptions{
+		LocalSSRC:  1234,
+		LocalCNAME: "test",
+		RemoteSSRC: 5678,
+		Direction:  "recvonly",
+	})
+
+	received := make(chan error, 1)
+	go func() {
+		received <- stream.ReceiveAudio(nil, func(buf *packet.SharedBuffer) error {
+			buf.Release()
+			return nil
+		})
+	}()
+
+	// A BYE from some other source is ignored.
+	w := newRTCPWriter(remote, 42, nil, 1200)
+	w.cname = "other"
+	if err := w.writePacket(&rtcpGoodbye{ssrc: 42, reason: "bye"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-received:
+		t.Fatalf("reception ended on another source's BYE: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if stream.Stats().RemoteEnded {
+		t.Error("remote source ended by another source's BYE")
+	}
+
+	// The remote source's BYE ends reception.
+	w = newRTCPWriter(remote, 5678, nil, 1200)
+	w.cname = "remote"
+	if err := w.writePacket(&rtcpGoodbye{ssrc: 5678, reason: "track stopped"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-received:
+		if err != ErrGoodbye {
+			t.Errorf("expected ErrGoodbye, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reception didn't end")
+	}
+	if !stream.Stats().RemoteEnded {
+		t.Error("remote source not reported as ended")
+	}
+}
+
+func TestSenderReportClock(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	fake := clock.NewFake(time.Unix(1500000000, 0))
+	session, err := NewSession(SessionOptions{MuxConn: local, Clock: fake})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stream := session.AddStream(StreamOptions{
+		LocalSSRC:  1234,
+		LocalCNAME: "test",
+		Direction:  "sendonly",
+	})
+	stream.rtpOut.clockRate = 90000
+
+	// Read a Sender Report sent by the stream.
+	readReport := func() *rtcpSenderReport {
+		go stream.sendSenderReport()
+		buf := make([]byte, 1500)
+		remote.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := remote.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sr *rtcpSenderReport
+		r := newRTCPReader(0, nil)
+		r.handler = func(p rtcpPacket) error {
+			if p, ok := p.(*rtcpSenderReport); ok {
+				sr = p
+			}
+			return nil
+		}
+		if err := r.readPacket(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if sr == nil {
+			t.Fatal("expected a Sender Report")
+		}
+		return sr
+	}
+
+	// Both timestamps follow the fake clock.
+	sr1 := readReport()
+	if sr1.ntpTimestamp != toNTP(fake.Now()) {
+		t.Errorf("NTP timestamp %x, expected %x", sr1.ntpTimestamp, toNTP(fake.Now()))
+	}
+	fake.Advance(1500 * time.Millisecond)
+	sr2 := readReport()
+	if sr2.ntpTimestamp != toNTP(fake.Now()) {
+		t.Errorf("NTP timestamp %x, expected %x", sr2.ntpTimestamp, toNTP(fake.Now()))
+	}
+	if elapsed := sr2.rtpTimestamp - sr1.rtpTimestamp; elapsed != 135000 {
+		t.Errorf("RTP timestamp advanced by %d, expected 135000", elapsed)
+	}
+}
@@ -47,10 +47,75 @@ type cryptoContext struct {
 	authenticateSRTP  authFunc
 	authenticateSRTCP authFunc
 
-	// TODO: Replay lists
+	// State of each SSRC whose packets have been received with this context,
+	// created on its first authenticated packet.
+	sources      map[uint32]*sourceState
+	sourcesMutex sync.Mutex
 }
 
-func newCryptoContext(masterKey, masterSalt []byte) *cryptoContext {
+// The receive state of an SSRC [RFC3711 §3.2.3]: the highest index of its
+// SRTP packets, from which the ROC of the next is estimated, and replay lists
+// for SRTP and SRTCP.
+type sourceState struct {
+	lastSequence uint16
+	lastIndex    uint64
+	rtpReplay    replayWindow
+	rtcpReplay   replayWindow
+}
+
+// Number of packets before the highest index received that are still
+// accepted, if not already received [RFC3711 §3.3.2]. Retransmissions of
+// video can arrive well behind, so the window is wider than the 64 required.
+const replayWindowSize = 1024
+
+// A replay list: which indices of the window ending at the highest received
+// have been received already.
+type replayWindow struct {
+	started bool
+	highest uint64
+	seen    [replayWindowSize / 64]uint64 // Bit index % replayWindowSize
+}
+
+var errSRTPReplay = errors.New("SRTP packet replayed, or too old")
+
+// Whether a packet with this index may be accepted: it's ahead of the window,
+// or within it but not yet received.
+func (w *replayWindow) check(index uint64) bool {
+	if !w.started || index > w.highest {
+		return true
+	}
+	if w.highest-index >= replayWindowSize {
+		return false
+	}
+	return w.seen[index%replayWindowSize/64]&(1<<(index%64)) == 0
+}
+
+// Record the receipt of an authenticated packet, sliding the window forward if
+// it's the highest yet.
+func (w *replayWindow) accept(index uint64) {
+	if !w.started {
+		w.started = true
+		w.highest = index
+	} else if index > w.highest {
+		// Forget the indices that slide out of the window.
+		if index-w.highest >= replayWindowSize {
+			w.seen = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := w.highest + 1; i < index; i++ {
+				w.seen[i%replayWindowSize/64] &^= 1 << (i % 64)
+			}
+		}
+		w.highest = index
+	}
+	w.seen[index%replayWindowSize/64] |= 1 << (index % 64)
+}
+
+func newCryptoContext(masterKey, masterSalt []byte) (*cryptoContext, error) {
+	// The session keys derived below are valid if the master key is.
+	if _, err := aes.NewCipher(masterKey); err != nil {
+		return nil, err
+	}
+
 	var (
 		srtpEncryptKey  = deriveKey(masterKey, masterSalt, 0, 0x00, encryptKeyLength)
 		srtpAuthKey     = deriveKey(masterKey, masterSalt, 0, 0x01, authKeyLength)
@@ -64,7 +129,69 @@ func newCryptoContext(masterKey, masterSalt []byte) *cryptoContext {
 		encryptSRTCP:      defaultEncryptTransform(srtcpEncryptKey, srtcpSaltKey),
 		authenticateSRTP:  defaultAuthTransform(srtpAuthKey),
 		authenticateSRTCP: defaultAuthTransform(srtcpAuthKey),
+		sources:           make(map[uint32]*sourceState),
+	}, nil
+}
+
+// Verify and decrypt a received SRTP packet, as verifyAndDecryptRTP, with the
+// index estimated from the ROC of its SSRC (see RFC 3711 Section 3.3.1).
+// Replayed packets are rejected with errSRTPReplay. The SSRC's state is only
+// updated once the packet is authenticated. Returns the payload and index.
+func (c *cryptoContext) unprotectRTP(buf []byte, hdr *rtpHeader) ([]byte, uint64, error) {
+	c.sourcesMutex.Lock()
+	defer c.sourcesMutex.Unlock()
+
+	src := c.sources[hdr.ssrc]
+	started := src != nil && src.rtpReplay.started
+	index := uint64(hdr.sequence) // ROC 0 for the first packet
+	if started {
+		index = estimateIndex(src.lastIndex, src.lastSequence, hdr.sequence)
+		if !src.rtpReplay.check(index) {
+			return nil, 0, errSRTPReplay
+		}
 	}
+
+	payload, err := c.verifyAndDecryptRTP(buf, hdr, index)
+	if err != nil {
+		return nil, 0, err
+	}
+	if src == nil {
+		src = &sourceState{}
+		c.sources[hdr.ssrc] = src
+	}
+	if !started || index > src.lastIndex {
+		src.lastIndex, src.lastSequence = index, hdr.sequence
+	}
+	src.rtpReplay.accept(index)
+	return payload, index, nil
+}
+
+// Verify and decrypt a received SRTCP packet, as verifyAndDecryptRTCP,
+// rejecting replayed packets of its SSRC with errSRTPReplay.
+func (c *cryptoContext) unprotectRTCP(buf []byte) ([]byte, uint64, error) {
+	if len(buf) < 8 {
+		return nil, 0, errors.New("SRTCP packet too short")
+	}
+	ssrc := binary.BigEndian.Uint32(buf[4:8])
+
+	c.sourcesMutex.Lock()
+	defer c.sourcesMutex.Unlock()
+
+	// The index is authenticated along with the rest of the packet.
+	packet, index, err := c.verifyAndDecryptRTCP(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	src := c.sources[ssrc]
+	if src == nil {
+		src = &sourceState{}
+		c.sources[ssrc] = src
+	}
+	if !src.rtcpReplay.check(index) {
+		return nil, 0, errSRTPReplay
+	}
+	src.rtcpReplay.accept(index)
+	return packet, index, nil
 }
 
 // Encrypt the payload of an RTP packet in place, then compute and append the
@@ -205,7 +332,7 @@ func deriveKey(masterKey, masterSalt []byte, r uint64, label byte, n int) []byte
 func defaultPRF(masterKey, x []byte) cipher.Stream {
 	block, err := aes.NewCipher(masterKey)
 	if err != nil {
-		panic(err)
+		panic(err) // checked by newCryptoContext
 	}
 	if len(x) != aes.BlockSize {
 		// IV equal to (x*2^16)
@@ -220,10 +347,15 @@ type encryptTransform func(key, salt []byte) encryptFunc
 
 // AES in counter mode (the default encryption transform for SRTP).
 // See https://tools.ietf.org/html/rfc3711#section-4.1.1
+//
+// crypto/aes uses the CPU's AES instructions where Go supports them (AES-NI on
+// amd64, the ARMv8 Cryptography Extensions on arm64), and falls back to a
+// software implementation elsewhere, e.g. on 32-bit ARM. Compare with
+// `go test -bench . ./internal/rtp` on the target.
 func aesCounterMode(key, salt []byte) encryptFunc {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err) // invalid key size
+		panic(err) // session keys have a valid size
 	}
 	// Reuse IV byte slices, to reduce heap allocations.
 	ivPool := sync.Pool{
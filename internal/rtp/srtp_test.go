@@ -12,7 +12,10 @@ import (
 func TestEncryptRTP(t *testing.T) {
 	masterKey := []byte("TopSecret128bits")
 	masterSalt := []byte("SodiumChloride")
-	crypto := newCryptoContext(masterKey, masterSalt)
+	crypto, err := newCryptoContext(masterKey, masterSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	index := uint64(123456)
 	hdr := rtpHeader{
@@ -28,7 +31,7 @@ func TestEncryptRTP(t *testing.T) {
 	hdr.writeTo(p)
 	p.WriteSlice(payload)
 
-	err := crypto.encryptAndSignRTP(p, &hdr, index)
+	err = crypto.encryptAndSignRTP(p, &hdr, index)
 	if err != nil {
 		t.Error(err)
 	}
@@ -43,10 +46,89 @@ func TestEncryptRTP(t *testing.T) {
 	}
 }
 
+// Encrypt an SRTP packet from ssrc with the given index.
+func protectRTP(t *testing.T, crypto *cryptoContext, ssrc uint32, index uint64) ([]byte, rtpHeader) {
+	hdr := rtpHeader{payloadType: 100, sequence: uint16(index), ssrc: ssrc}
+	p := packet.NewWriterSize(512)
+	hdr.writeTo(p)
+	p.WriteSlice([]byte("payload"))
+	if err := crypto.encryptAndSignRTP(p, &hdr, index); err != nil {
+		t.Fatal(err)
+	}
+	return p.Bytes(), hdr
+}
+
+func TestUnprotectRTPPerSSRC(t *testing.T) {
+	crypto, err := newCryptoContext([]byte("TopSecret128bits"), []byte("SodiumChloride"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first SSRC rolls over, but the second starts with ROC 0.
+	for _, c := range []struct {
+		ssrc  uint32
+		index uint64
+	}{
+		{1, 65534},
+		{1, 65535},
+		{1, 65536},
+		{2, 5},
+		{1, 65537},
+	} {
+		buf, hdr := protectRTP(t, crypto, c.ssrc, c.index)
+		payload, index, err := crypto.unprotectRTP(buf, &hdr)
+		if err != nil || index != c.index || string(payload) != "payload" {
+			t.Fatalf("SSRC %d index %d: got %q, index %d, error %v", c.ssrc, c.index, payload, index, err)
+		}
+	}
+
+	// A packet received already is a replay, but one missed isn't.
+	buf, hdr := protectRTP(t, crypto, 2, 5)
+	if _, _, err := crypto.unprotectRTP(buf, &hdr); err != errSRTPReplay {
+		t.Errorf("Replayed packet: error %v", err)
+	}
+	buf, hdr = protectRTP(t, crypto, 1, 65533)
+	if _, _, err := crypto.unprotectRTP(buf, &hdr); err != nil {
+		t.Errorf("Late packet: error %v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, index := range []uint64{100, 102, 101} {
+		if !w.check(index) {
+			t.Fatalf("Index %d rejected", index)
+		}
+		w.accept(index)
+	}
+	if w.check(101) || w.check(102) {
+		t.Errorf("Received indices should be rejected")
+	}
+
+	// The window slides forward, forgetting what falls out of it.
+	w.accept(100 + replayWindowSize)
+	if w.check(100) || !w.check(103) || !w.check(99+replayWindowSize) {
+		t.Errorf("Window should end at %d", 100+replayWindowSize)
+	}
+	w.accept(103 + 2*replayWindowSize)
+	if w.check(103+replayWindowSize) || !w.check(104+replayWindowSize) {
+		t.Errorf("Window should end at %d", 103+2*replayWindowSize)
+	}
+}
+
+func TestInvalidMasterKey(t *testing.T) {
+	if _, err := newCryptoContext([]byte("short"), []byte("SodiumChloride")); err == nil {
+		t.Error("Expected an error for a 5-byte master key")
+	}
+}
+
 func TestEncryptRTCP(t *testing.T) {
 	masterKey := []byte("TopSecret128bits")
 	masterSalt := []byte("SodiumChloride")
-	crypto := newCryptoContext(masterKey, masterSalt)
+	crypto, err := newCryptoContext(masterKey, masterSalt)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	hdr := uint32(0x81c8000a)
 	ssrc := uint32(0x1337d00d)
@@ -59,7 +141,7 @@ func TestEncryptRTCP(t *testing.T) {
 	p.WriteUint32(ssrc)
 	p.WriteSlice(payload)
 
-	err := crypto.encryptAndSignRTCP(p, index)
+	err = crypto.encryptAndSignRTCP(p, index)
 	if err != nil {
 		t.Error(err)
 	}
@@ -131,3 +213,52 @@ func TestDeriveKey(t *testing.T) {
 func checkHex(value []byte, expectedHex string) bool {
 	return hex.EncodeToString(value) == strings.ToLower(expectedHex)
 }
+
+// Typical size of a video RTP payload.
+const benchmarkPayloadSize = 1200
+
+func BenchmarkAESCounterMode(b *testing.B) {
+	encrypt := aesCounterMode([]byte("TopSecret128bits"), []byte("SodiumChloride"))
+	payload := make([]byte, benchmarkPayloadSize)
+	b.SetBytes(benchmarkPayloadSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encrypt(payload, 0x1337d00d, uint64(i))
+	}
+}
+
+func BenchmarkHMACSHA1(b *testing.B) {
+	auth := hmacSHA1([]byte("TopSecretAuthKey0123"))
+	payload := make([]byte, benchmarkPayloadSize)
+	b.SetBytes(benchmarkPayloadSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		auth(payload)
+	}
+}
+
+func BenchmarkEncryptRTP(b *testing.B) {
+	crypto, err := newCryptoContext([]byte("TopSecret128bits"), []byte("SodiumChloride"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	hdr := rtpHeader{
+		payloadType: 100,
+		timestamp:   55555555,
+		ssrc:        0x1337d00d,
+	}
+	payload := make([]byte, benchmarkPayloadSize)
+	p := packet.NewWriterSize(rtpHeaderSize + benchmarkPayloadSize + authTagLength)
+	b.SetBytes(benchmarkPayloadSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index := uint64(i)
+		hdr.sequence = uint16(index)
+		p.Reset()
+		hdr.writeTo(p)
+		p.WriteSlice(payload)
+		if err := crypto.encryptAndSignRTP(p, &hdr, index); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
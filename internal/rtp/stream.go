@@ -1,5 +1,15 @@
 package rtp
 
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/lanikai/alohartc/internal/media"
+)
+
 // Payload type description, as provided via SDP.
 type PayloadType struct {
 	// Payload type number (<= 127) assigned by the SDP `rtpmap` attribute.
@@ -33,9 +43,102 @@ type StreamOptions struct {
 
 	// Maximum size of outgoing packets, factoring in MTU and protocol overhead.
 	MaxPacketSize int
+
+	// Number of source buffers (e.g. NALUs) queued for packetization before
+	// new ones are dropped. Defaults to 16.
+	QueueSize int
+
+	// What video to drop when the sender falls behind its source. See
+	// media.DropPolicy.
+	DropPolicy media.DropPolicy
+
+	// Retransmit packets requested via NACK before sending any new media.
+	PrioritizeResend bool
+
+	// Bytes of media that may be sent back-to-back before outgoing packets
+	// are paced. Defaults to 12000. See SetPacingRate.
+	PacingBurst int
+
+	// Don't send audio frames that the source's voice detector marks as
+	// silence. See media.AudioLevelMeter.
+	SkipSilence bool
+
+	// Number of received packets held while waiting for a missing earlier
+	// one, before it is given up as lost. Defaults to 64.
+	JitterBufferDepth int
+
+	// Where the remote peer's packets begin, if known in advance. Nil means
+	// from the first packet to arrive.
+	ReceiveStart *ReceiveStart
+
+	// Mean interval between receiver reports for received media. Defaults
+	// to 2 seconds. RFC 3550 recommends at least 5 seconds for a stream
+	// whose sender expects the usual RTCP bandwidth, e.g. an RTSP server.
+	ReportInterval time.Duration
+
+	// Cap on the bitrate of received media, in bits per second, sent to the
+	// remote peer in REMB feedback along with each receiver report. Zero
+	// means no cap. Requires negotiated goog-remb feedback.
+	MaxReceiveBitrate int
+
+	// Negotiated RTP header extension IDs, keyed by URI (e.g.
+	// ExtensionAbsSendTime). Unsupported extensions are ignored.
+	Extensions map[string]byte
+
+	// Media identification, from the SDP `mid` attribute. Sent in the MID
+	// header extension, if negotiated.
+	MID string
+
+	// Playout delay for the remote peer to apply to the media we send, in
+	// the playout delay header extension, if negotiated. Nil leaves it to
+	// the receiver.
+	PlayoutDelay *PlayoutDelay
+
+	// Whether reduced-size RTCP was negotiated (`a=rtcp-rsize`). If so,
+	// feedback messages are sent on their own; otherwise every RTCP packet is
+	// a compound packet with a report and a CNAME. See RFC 5506.
+	ReducedSize bool
+}
+
+const defaultQueueSize = 16
+
+// ErrGoodbye is returned by ReceiveVideo and ReceiveAudio when the remote
+// source leaves with an RTCP BYE, e.g. because the remote peer stopped the
+// track (see RFC 3550 Section 6.6).
+var ErrGoodbye = errors.New("remote source said goodbye (RTCP BYE)")
+
+// A ReceiveStart gives the first sequence number and RTP timestamp of a
+// received stream, e.g. from the RTP-Info header of an RTSP PLAY response
+// (RFC 2326 Section 12.33). Packets from before the start, e.g. left over
+// from an earlier play range, are discarded, and packets arriving ahead of the
+// first one wait for it in the jitter buffer, rather than the first one being
+// discarded as late.
+type ReceiveStart struct {
+	// Sequence number of the first packet, if HasSequence.
+	Sequence    uint16
+	HasSequence bool
+
+	// RTP timestamp of the start of playback, if HasTimestamp. Only used
+	// without a sequence number, to find the first packet.
+	Timestamp    uint32
+	HasTimestamp bool
 }
 
 type Stream struct {
+	// Most recently measured round-trip time, in nanoseconds, or 0 if not yet
+	// measured. Accessed atomically, so must be first for 64-bit alignment.
+	rtt int64
+
+	// Delays of outgoing video, measured by the sender. Accessed atomically,
+	// so must follow rtt for 64-bit alignment.
+	latency sendLatency
+
+	// Loss of outgoing packets, as reported by the remote receiver: the
+	// fraction lost since its previous report (in 1/256ths), and the total.
+	// Accessed atomically.
+	remoteFractionLost uint32
+	remoteTotalLost    uint32
+
 	StreamOptions
 
 	// RTP state for outgoing data.
@@ -49,6 +152,25 @@ type Stream struct {
 
 	// RTCP state for incoming control packets.
 	rtcpIn *rtcpReader
+
+	// Held while the session's read loop hands a packet to rtpIn or rtcpIn,
+	// so that their handlers can be installed while it runs.
+	readMutex sync.Mutex
+
+	// NALUs dropped by earlier video senders, and the current sender's
+	// receiver, if it counts its drops.
+	dropMutex   sync.Mutex
+	drops       media.DropCounts
+	dropCounter media.DropCounter
+
+	// Session-wide bandwidth allocator, or nil.
+	bandwidth *BandwidthAllocator
+
+	// The session's clock.
+	clock clock.Clock
+
+	// Closed when the remote source says goodbye. Closed under readMutex.
+	goodbye chan struct{}
 }
 
 func newStream(session *Session, opts StreamOptions) *Stream {
@@ -56,46 +178,282 @@ func newStream(session *Session, opts StreamOptions) *Stream {
 	s := new(Stream)
 	s.StreamOptions = opts
 	if opts.Direction == "sendonly" || opts.Direction == "sendrecv" {
-		s.rtpOut = newRTPWriter(session.DataConn, opts.LocalSSRC, session.writeContext)
+		s.rtpOut = newRTPWriter(session.DataConn, opts.LocalSSRC, session.writeContext, opts.MaxPacketSize)
+		s.rtpOut.extensionIDs = makeExtensionIDs(opts.Extensions)
+		s.rtpOut.mid = opts.MID
+		s.rtpOut.playoutDelay = opts.PlayoutDelay
+		s.rtpOut.transportSequence = &session.transportSequence
+		s.rtpOut.epoch = session.epoch
+		s.rtpOut.pacer = newPacer(opts.PacingBurst)
+		s.rtpOut.clock = session.Clock
 	}
 	if opts.Direction == "recvonly" || opts.Direction == "sendrecv" {
 		s.rtpIn = newRTPReader(opts.RemoteSSRC, session.readContext)
+		s.rtpIn.clock = session.Clock
 	}
-	s.rtcpOut = newRTCPWriter(session.ControlConn, opts.LocalSSRC, session.writeContext)
+	s.rtcpOut = newRTCPWriter(session.ControlConn, opts.LocalSSRC, session.writeContext, opts.MaxPacketSize)
+	s.rtcpOut.cname = opts.LocalCNAME
+	s.rtcpOut.reducedSize = opts.ReducedSize
 	s.rtcpIn = newRTCPReader(opts.RemoteSSRC, session.readContext)
+	s.rtcpIn.handler = s.handleControl
+	s.bandwidth = session.Bandwidth
+	s.clock = session.Clock
+	s.goodbye = make(chan struct{})
 	return s
 }
 
 func (s *Stream) Close() error {
 	s.sendGoodbye("stream closed")
-	s.rtpOut.cache.Clear()
-	s.rtpOut = nil
-	s.rtpIn = nil
+	if s.rtpOut != nil {
+		s.rtpOut.cache.Clear()
+	}
 	return nil
 }
 
+// StreamStats is a snapshot of the packet counters for a stream.
+type StreamStats struct {
+	PacketsSent     uint64
+	BytesSent       uint64
+	PacketsReceived uint64
+	BytesReceived   uint64
+
+	// Received packets never delivered, because they were lost or arrived
+	// too late to be put back in order.
+	PacketsLost uint64
+	PacketsLate uint64
+
+	// Loss of sent packets, as reported by the remote peer: the fraction lost
+	// over its most recent reporting interval, and the total.
+	RemoteFractionLost float32
+	RemotePacketsLost  uint64
+
+	// Round-trip time to the remote peer, or 0 if not yet measured.
+	RoundTripTime time.Duration
+
+	// NALUs of video dropped because the sender fell behind its source.
+	Drops media.DropCounts
+
+	// Delays of sent video, averaged over recent pictures: from capture until
+	// the sender dequeued the picture (encoding and queueing), and from then
+	// until its last packet was written to the network (packetization and
+	// pacing). Zero if the source doesn't record capture times.
+	SourceDelay time.Duration
+	SendDelay   time.Duration
+
+	// Whether the remote source has left with an RTCP BYE.
+	RemoteEnded bool
+}
+
+// Stats returns the current packet counters for this stream. Byte counts
+// include only RTP payloads, not headers.
+func (s *Stream) Stats() (stats StreamStats) {
+	if w := s.rtpOut; w != nil {
+		w.Lock()
+		stats.PacketsSent = w.count
+		stats.BytesSent = w.totalBytes
+		w.Unlock()
+	}
+	if r := s.rtpIn; r != nil {
+		stats.PacketsReceived = atomic.LoadUint64(&r.count)
+		stats.BytesReceived = atomic.LoadUint64(&r.totalBytes)
+		stats.PacketsLost = atomic.LoadUint64(&r.lost)
+		stats.PacketsLate = atomic.LoadUint64(&r.late)
+	}
+	stats.RemoteFractionLost = float32(atomic.LoadUint32(&s.remoteFractionLost)) / 256
+	stats.RemotePacketsLost = uint64(atomic.LoadUint32(&s.remoteTotalLost))
+	stats.RoundTripTime = time.Duration(atomic.LoadInt64(&s.rtt))
+	s.dropMutex.Lock()
+	stats.Drops = s.drops
+	if s.dropCounter != nil {
+		stats.Drops = stats.Drops.Add(s.dropCounter.Drops())
+	}
+	s.dropMutex.Unlock()
+	stats.SourceDelay = time.Duration(atomic.LoadInt64(&s.latency.source))
+	stats.SendDelay = time.Duration(atomic.LoadInt64(&s.latency.send))
+	select {
+	case <-s.goodbye:
+		stats.RemoteEnded = true
+	default:
+	}
+	return
+}
+
+// Send a Sender Report, which maps the stream's RTP timestamps to wall-clock
+// (NTP) time so that the receiver can synchronize it with the session's other
+// streams. It also carries a Receiver Reference Time block, for measuring
+// round-trip time.
+// See https://tools.ietf.org/html/rfc3550#section-6.4.1
 func (s *Stream) sendSenderReport() error {
+	now := s.clock.Now()
+	w := s.rtpOut
+	w.Lock()
+	sr := &rtcpSenderReport{
+		sender:       s.LocalSSRC,
+		ntpTimestamp: toNTP(now),
+		rtpTimestamp: w.timestampAt(now),
+		packetCount:  uint32(w.count),
+		totalBytes:   uint32(w.totalBytes),
+	}
+	w.Unlock()
 	sdes := &rtcpSourceDescription{
 		ssrc:  s.LocalSSRC,
 		cname: s.LocalCNAME,
 	}
-	return s.rtcpOut.writePacket(sdes)
+	xr := &rtcpExtendedReport{
+		ssrc:          s.LocalSSRC,
+		referenceTime: sr.ntpTimestamp,
+	}
+	return s.rtcpOut.writePacket(sr, sdes, xr)
 }
 
-func (s *Stream) sendReceiverReport() error {
-	rr := &rtcpReceiverReport{
-		receiver: s.LocalSSRC,
-		reports: []rtcpReport{{
-			Source:       s.RemoteSSRC,
-			LastReceived: uint32(s.rtpIn.lastIndex),
-			// TODO: Jitter, arrival delay, etc.
-		}},
+// Handle the RTCP packets that matter whether or not media is being sent or
+// received on the stream. Senders install their own handler while running.
+func (s *Stream) handleControl(pkt rtcpPacket) error {
+	switch p := pkt.(type) {
+	case *rtcpSenderReport:
+		s.handleSenderReport(p)
+	case *rtcpReceiverReport:
+		s.handleReceiverReport(p)
+	case *rtcpExtendedReport:
+		s.handleExtendedReport(p)
+	case *rembFeedbackMessage:
+		s.handleREMB(p)
+	case *rtcpGoodbye:
+		s.handleGoodbye(p)
 	}
-	sdes := &rtcpSourceDescription{
-		ssrc:  s.LocalSSRC,
-		cname: s.LocalCNAME,
+	return nil
+}
+
+// Note the remote source leaving, which ends reception. A stream whose remote
+// SSRC wasn't announced takes a goodbye from any source other than its own.
+// Must be called with readMutex held.
+func (s *Stream) handleGoodbye(bye *rtcpGoodbye) {
+	if s.RemoteSSRC != 0 && !bye.includes(s.RemoteSSRC) {
+		return
+	}
+	if s.RemoteSSRC == 0 && bye.includes(s.LocalSSRC) {
+		return
+	}
+	select {
+	case <-s.goodbye:
+		return
+	default:
+	}
+	log.Info("Remote source %08x said goodbye: %q", bye.ssrc, bye.reason)
+	close(s.goodbye)
+}
+
+// Record the loss of outgoing packets reported by the remote receiver.
+func (s *Stream) handleReceiverReport(rr *rtcpReceiverReport) {
+	for _, report := range rr.reports {
+		if report.Source == s.LocalSSRC {
+			atomic.StoreUint32(&s.remoteFractionLost, uint32(report.FractionLost*256))
+			atomic.StoreUint32(&s.remoteTotalLost, uint32(report.TotalLost))
+		}
+	}
+}
+
+// Respond to the remote peer's reference time, and measure round-trip time
+// from its responses to ours.
+func (s *Stream) handleExtendedReport(xr *rtcpExtendedReport) {
+	now := s.clock.Now()
+	for _, item := range xr.dlrr {
+		if item.ssrc != s.LocalSSRC {
+			continue
+		}
+		if rtt, ok := roundTripTime(item, now); ok {
+			atomic.StoreInt64(&s.rtt, int64(rtt))
+		}
+	}
+
+	if xr.referenceTime != 0 {
+		// Respond immediately, so the delay since receipt is negligible.
+		dlrr := &rtcpExtendedReport{
+			ssrc: s.LocalSSRC,
+			dlrr: []dlrrItem{{ssrc: xr.ssrc, lastRR: ntpMiddle(xr.referenceTime)}},
+		}
+		if err := s.rtcpOut.writePacket(dlrr); err != nil {
+			log.Warn("failed to send DLRR: %v", err)
+		}
+	}
+}
+
+// Ask the remote sender to retransmit lost packets.
+func (s *Stream) sendNACKs(lost []uint16) error {
+	nacks := makeNACKs(s.LocalSSRC, s.RemoteSSRC, lost)
+	for len(nacks) > 0 {
+		// Keep each compound packet within the maximum packet size.
+		n := len(nacks)
+		if n > maxNACKsPerPacket {
+			n = maxNACKsPerPacket
+		}
+		if max := (s.rtcpOut.maxCompoundSize() - s.rtcpOut.compoundOverhead()) / nackSize; n > max {
+			n = max
+		}
+		if err := s.rtcpOut.writePacket(nacks[:n]...); err != nil {
+			return err
+		}
+		nacks = nacks[n:]
+	}
+	return nil
+}
+
+// RequestKeyframe asks the remote sender for a keyframe, e.g. when a new
+// consumer of the received video starts decoding.
+func (s *Stream) RequestKeyframe() error {
+	return s.sendPictureLossIndication()
+}
+
+// Ask the remote sender for a keyframe.
+// See https://tools.ietf.org/html/rfc4585#section-6.3.1
+func (s *Stream) sendPictureLossIndication() error {
+	pli := &pliFeedbackMessage{
+		sender: s.LocalSSRC,
+		source: s.RemoteSSRC,
+	}
+	return s.rtcpOut.writePacket(pli)
+}
+
+// SetPacingRate sets the target bitrate of outgoing media, in bits per second,
+// to pace packets by, e.g. the stream's share of the bandwidth estimate.
+// Packets are sent unpaced until it is called.
+func (s *Stream) SetPacingRate(bps int) {
+	if s.rtpOut != nil {
+		s.rtpOut.pacer.setBitrate(bps)
+	}
+}
+
+// Ask the remote peer to send no more than bitrate bits per second.
+func (s *Stream) sendREMB(bitrate int) error {
+	remb := &rembFeedbackMessage{
+		sender:  s.LocalSSRC,
+		bitrate: uint64(bitrate),
+		ssrcs:   []uint32{s.RemoteSSRC},
+	}
+	return s.rtcpOut.writePacket(remb)
+}
+
+// Apply a bandwidth estimate from the remote peer to the whole session.
+func (s *Stream) handleREMB(remb *rembFeedbackMessage) {
+	if remb.unknown {
+		return
+	}
+	if s.bandwidth != nil {
+		s.bandwidth.SetTarget(int(remb.bitrate))
+	}
+}
+
+// Change the SSRC of the stream's outgoing packets.
+func (s *Stream) setLocalSSRC(ssrc uint32) {
+	s.LocalSSRC = ssrc
+	if s.rtpOut != nil {
+		s.rtpOut.Lock()
+		s.rtpOut.setSSRC(ssrc)
+		s.rtpOut.Unlock()
 	}
-	return s.rtcpOut.writePacket(rr, sdes)
+	s.rtcpOut.Lock()
+	s.rtcpOut.ssrc = ssrc
+	s.rtcpOut.Unlock()
 }
 
 // Send RTCP Goodbye packet to inform the remote peer that we're leaving.
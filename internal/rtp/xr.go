@@ -0,0 +1,156 @@
+package rtp
+
+import (
+	"time"
+
+	errors "golang.org/x/xerrors"
+
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+// RTCP Extended Reports (XR), as defined in RFC 3611. Only the blocks needed
+// for a receiver to measure round-trip time are implemented: the Receiver
+// Reference Time block, and the DLRR block sent in response.
+
+const (
+	rtcpExtendedReportType = 207
+
+	xrReceiverReferenceTimeBlock = 4
+	xrDLRRBlock                  = 5
+)
+
+// Extended Report (XR) RTCP packet.
+// See https://tools.ietf.org/html/rfc3611#section-2
+type rtcpExtendedReport struct {
+	ssrc uint32 // SSRC of the sender of this report
+
+	// NTP timestamp from a Receiver Reference Time block, or 0 if none.
+	// See https://tools.ietf.org/html/rfc3611#section-4.4
+	referenceTime uint64
+
+	// Sub-blocks of a DLRR block.
+	// See https://tools.ietf.org/html/rfc3611#section-4.5
+	dlrr []dlrrItem
+}
+
+type dlrrItem struct {
+	ssrc uint32 // SSRC of the receiver this item responds to
+
+	// Middle 32 bits of the receiver's reference time, or 0 if none has been
+	// received.
+	lastRR uint32
+
+	// Time in 1/65536 seconds between receiving the reference time and
+	// sending this item.
+	delay uint32
+}
+
+func (xr *rtcpExtendedReport) writeTo(w *packet.Writer) error {
+	length := 1
+	if xr.referenceTime != 0 {
+		length += 3
+	}
+	if len(xr.dlrr) > 0 {
+		length += 1 + 3*len(xr.dlrr)
+	}
+	h := rtcpHeader{
+		packetType: rtcpExtendedReportType,
+		length:     length,
+	}
+	if err := h.writeTo(w); err != nil {
+		return err
+	}
+
+	if err := w.CheckCapacity(4 * h.length); err != nil {
+		return errors.Errorf("insufficient buffer for ExtendedReport: %v", err)
+	}
+	w.WriteUint32(xr.ssrc)
+	if xr.referenceTime != 0 {
+		w.WriteByte(xrReceiverReferenceTimeBlock)
+		w.WriteByte(0)
+		w.WriteUint16(2)
+		w.WriteUint64(xr.referenceTime)
+	}
+	if len(xr.dlrr) > 0 {
+		w.WriteByte(xrDLRRBlock)
+		w.WriteByte(0)
+		w.WriteUint16(uint16(3 * len(xr.dlrr)))
+		for _, item := range xr.dlrr {
+			w.WriteUint32(item.ssrc)
+			w.WriteUint32(item.lastRR)
+			w.WriteUint32(item.delay)
+		}
+	}
+	return nil
+}
+
+func (xr *rtcpExtendedReport) readFrom(r *packet.Reader, h *rtcpHeader) error {
+	if h.length < 1 {
+		return errors.Errorf("invalid Extended Report: length = %d", h.length)
+	}
+	if err := r.CheckRemaining(4 * h.length); err != nil {
+		return errors.Errorf("short buffer: %v", err)
+	}
+
+	xr.ssrc = r.ReadUint32()
+	remaining := 4 * (h.length - 1)
+	for remaining > 0 {
+		if remaining < 4 {
+			return errors.New("truncated Extended Report block")
+		}
+		blockType := r.ReadByte()
+		r.ReadByte() // type-specific
+		n := 4 * int(r.ReadUint16())
+		remaining -= 4
+		if n > remaining {
+			return errors.Errorf("invalid Extended Report block: type = %d, length = %d", blockType, n)
+		}
+		remaining -= n
+
+		switch {
+		case blockType == xrReceiverReferenceTimeBlock && n == 8:
+			xr.referenceTime = r.ReadUint64()
+		case blockType == xrDLRRBlock && n%12 == 0:
+			for i := 0; i < n; i += 12 {
+				xr.dlrr = append(xr.dlrr, dlrrItem{
+					ssrc:   r.ReadUint32(),
+					lastRR: r.ReadUint32(),
+					delay:  r.ReadUint32(),
+				})
+			}
+		default:
+			// Unsupported block type.
+			r.Skip(n)
+		}
+	}
+	return nil
+}
+
+// Seconds between the NTP epoch (1900) and the Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// Convert a time to a 64-bit NTP timestamp.
+func toNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+// Return the middle 32 bits of an NTP timestamp, in 1/65536 seconds.
+func ntpMiddle(ntp uint64) uint32 {
+	return uint32(ntp >> 16)
+}
+
+// Compute round-trip time from a DLRR item, received at now.
+// See https://tools.ietf.org/html/rfc3611#section-4.5
+func roundTripTime(item dlrrItem, now time.Time) (time.Duration, bool) {
+	if item.lastRR == 0 {
+		return 0, false
+	}
+	rtt := ntpMiddle(toNTP(now)) - item.lastRR - item.delay
+	if int32(rtt) < 0 {
+		// Clock went backwards, or the item is bogus.
+		return 0, false
+	}
+	return time.Duration(uint64(rtt) * uint64(time.Second) >> 16), true
+}
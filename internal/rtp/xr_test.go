@@ -0,0 +1,65 @@
+package rtp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+func TestExtendedReport(t *testing.T) {
+	in := rtcpExtendedReport{
+		ssrc:          0x01020304,
+		referenceTime: toNTP(time.Now()),
+		dlrr: []dlrrItem{
+			{ssrc: 0xaabbccdd, lastRR: 0x12345678, delay: 0x8000},
+		},
+	}
+	w := packet.NewWriterSize(64)
+	if err := in.writeTo(w); err != nil {
+		t.Fatal(err)
+	}
+	// A block of unsupported type (VoIP metrics, truncated) must be skipped.
+	b := append([]byte(nil), w.Bytes()...)
+	b[3] += 2
+	b = append(b, 7, 0, 0, 1, 0xde, 0xad, 0xbe, 0xef)
+
+	r := packet.NewReader(b)
+	var h rtcpHeader
+	if err := h.readFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	if h.packetType != rtcpExtendedReportType {
+		t.Fatalf("expected XR, got packet type %d", h.packetType)
+	}
+	var out rtcpExtendedReport
+	if err := out.readFrom(r, &h); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("expected %#v, not %#v", in, out)
+	}
+	if r.Remaining() != 0 {
+		t.Errorf("%d bytes left unread", r.Remaining())
+	}
+}
+
+func TestRoundTripTime(t *testing.T) {
+	sent := time.Now()
+	item := dlrrItem{
+		lastRR: ntpMiddle(toNTP(sent)),
+		delay:  65536 / 10, // 100 ms at the remote peer
+	}
+	rtt, ok := roundTripTime(item, sent.Add(150*time.Millisecond))
+	if !ok {
+		t.Fatal("no round-trip time")
+	}
+	if rtt < 49*time.Millisecond || rtt > 51*time.Millisecond {
+		t.Errorf("expected 50ms, not %v", rtt)
+	}
+
+	if _, ok := roundTripTime(dlrrItem{}, sent); ok {
+		t.Error("round-trip time without a reference time")
+	}
+}
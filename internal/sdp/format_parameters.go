@@ -47,12 +47,14 @@ func (fmtp *H264FormatParameters) Unmarshal(format string) error {
 	errMalformedFormatParameters := errors.New("malformed format parameters")
 
 	for _, param := range strings.Split(format, ";") {
-		pieces := strings.SplitN(param, "=", 2)
+		// Browsers differ in parameter order, spacing, and case (Safari
+		// writes profile-level-id in upper case hex, for one).
+		pieces := strings.SplitN(strings.TrimSpace(param), "=", 2)
 		if len(pieces) < 2 {
 			return errMalformedFormatParameters
 		}
 
-		switch pieces[0] {
+		switch strings.ToLower(pieces[0]) {
 		case "level-asymmetry-allowed":
 			switch pieces[1] {
 			case "0":
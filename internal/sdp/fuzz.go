@@ -0,0 +1,12 @@
+// +build gofuzz
+
+package sdp
+
+// Fuzz is the entry point for go-fuzz. See the README for usage. The corpus in
+// testdata/fuzz/corpus holds offers captured from browsers.
+func Fuzz(data []byte) int {
+	if _, err := ParseSession(string(data)); err != nil {
+		return 0
+	}
+	return 1
+}
@@ -27,9 +27,6 @@ type Session struct {
 	//	encryptionKey string  // Optional
 	Attributes []Attribute
 	Media      []Media
-
-	// Initialized on first call to GetAttr()
-	attrCache map[string][]string
 }
 
 type Origin struct {
@@ -58,6 +55,13 @@ type Attribute struct {
 	Value string
 }
 
+// Bandwidth information, e.g. "b=AS:500" (kilobits per second) or "b=TIAS:500000"
+// (bits per second). See RFC 4566 §5.8 and RFC 3890.
+type Bandwidth struct {
+	Type  string
+	Value int
+}
+
 type Media struct {
 	Type   string
 	Port   int
@@ -66,12 +70,9 @@ type Media struct {
 
 	Info       string      // Optional
 	Connection *Connection // Optional
-	//	bandwidth []string
+	Bandwidth  []Bandwidth // Optional
 	//	encryptionKey string  // Optional
 	Attributes []Attribute
-
-	// Initialized on first call to GetAttr()
-	attrCache map[string][]string
 }
 
 type writer strings.Builder
@@ -163,6 +164,22 @@ func fromNtp(ntp int64) *time.Time {
 	return &t
 }
 
+func (b Bandwidth) String() string {
+	return fmt.Sprintf("%s:%d", b.Type, b.Value)
+}
+
+func parseBandwidth(s string) (b Bandwidth, err error) {
+	f := strings.SplitN(s, ":", 2)
+	if len(f) != 2 {
+		return b, &sdpParseError{"bandwidth", s, nil}
+	}
+	b.Type = f[0]
+	if b.Value, err = strconv.Atoi(f[1]); err != nil {
+		err = &sdpParseError{"bandwidth", s, err}
+	}
+	return
+}
+
 func (a Attribute) String() string {
 	if a.Value == "" {
 		return a.Key
@@ -181,14 +198,10 @@ func parseAttribute(s string) (a Attribute, err error) {
 	return
 }
 
+// GetAttrs returns the values of the attributes with the given key. Attributes
+// are looked up afresh each time, so they may be modified in place.
 func (m *Media) GetAttrs(key string) []string {
-	if m.attrCache == nil {
-		m.attrCache = make(map[string][]string)
-		for _, a := range m.Attributes {
-			m.attrCache[a.Key] = append(m.attrCache[a.Key], a.Value)
-		}
-	}
-	return m.attrCache[key]
+	return attrValues(m.Attributes, key)
 }
 
 func (m *Media) GetAttr(key string) string {
@@ -199,6 +212,12 @@ func (m *Media) GetAttr(key string) string {
 	return values[0]
 }
 
+// HasAttr reports whether the media description has the given attribute,
+// e.g. a property attribute such as "rtcp-mux".
+func (m *Media) HasAttr(key string) bool {
+	return len(m.GetAttrs(key)) > 0
+}
+
 func (m *Media) String() string {
 	var w writer
 	w.Writef("m=%s %d %s %s\r\n", m.Type, m.Port, m.Proto, strings.Join(m.Format, " "))
@@ -208,6 +227,9 @@ func (m *Media) String() string {
 	if m.Connection != nil {
 		w.Write("c=", m.Connection.String(), "\r\n")
 	}
+	for _, b := range m.Bandwidth {
+		w.Write("b=", b.String(), "\r\n")
+	}
 	for _, a := range m.Attributes {
 		w.Write("a=", a.String(), "\r\n")
 	}
@@ -245,6 +267,10 @@ loop:
 			var c Connection
 			c, err = parseConnection(value)
 			m.Connection = &c
+		case 'b':
+			var b Bandwidth
+			b, err = parseBandwidth(value)
+			m.Bandwidth = append(m.Bandwidth, b)
 		case 'a':
 			var a Attribute
 			a, err = parseAttribute(value)
@@ -259,14 +285,19 @@ loop:
 	return m, text, err
 }
 
+// GetAttrs returns the values of the session-level attributes with the given
+// key.
 func (s *Session) GetAttrs(key string) []string {
-	if s.attrCache == nil {
-		s.attrCache = make(map[string][]string)
-		for _, a := range s.Attributes {
-			s.attrCache[a.Key] = append(s.attrCache[a.Key], a.Value)
+	return attrValues(s.Attributes, key)
+}
+
+func attrValues(attrs []Attribute, key string) (values []string) {
+	for _, a := range attrs {
+		if a.Key == key {
+			values = append(values, a.Value)
 		}
 	}
-	return s.attrCache[key]
+	return values
 }
 
 func (s *Session) GetAttr(key string) string {
@@ -277,6 +308,12 @@ func (s *Session) GetAttr(key string) string {
 	return values[0]
 }
 
+// HasAttr reports whether the session description has the given attribute,
+// e.g. a property attribute such as "ice-lite".
+func (s *Session) HasAttr(key string) bool {
+	return len(s.GetAttrs(key)) > 0
+}
+
 func (s *Session) String() string {
 	var w writer
 	w.Writef("v=%d\r\n", s.Version)
@@ -136,3 +136,25 @@ func TestWriteSession(t *testing.T) {
 		"v=0\r\no=fred 123 9 IN IP4 127.0.0.1\r\ns=mysession\r\n",
 		s.String())
 }
+
+func TestMediaBandwidth(t *testing.T) {
+	sdp := "v=0\r\n" +
+		"o=- 123 2 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"b=AS:500\r\n" +
+		"b=TIAS:500000\r\n" +
+		"a=mid:0\r\n"
+	s, err := ParseSession(sdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, s.Media, 1)
+	assert.Equal(t, []Bandwidth{{"AS", 500}, {"TIAS", 500000}}, s.Media[0].Bandwidth)
+	assert.Equal(t, sdp, s.String())
+
+	_, err = ParseSession("v=0\r\nm=video 9 RTP/AVP 96\r\nb=AS\r\n")
+	assert.Error(t, err)
+}
@@ -0,0 +1,193 @@
+// Package demux sorts signaling messages, arriving over a connection shared by
+// all sessions, into per-session queues. It implements the session half of a
+// signaling.Transport.
+package demux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// How long messages for an ended session are dropped, rather than starting a
+// new session.
+const endedSessionTimeout = time.Minute
+
+// Number of new sessions that may wait to be returned by WaitForSession.
+const pendingSessionLimit = 16
+
+// ErrTooManySessions is returned by Deliver when new sessions aren't being
+// accepted quickly enough.
+var ErrTooManySessions = errors.New("too many pending sessions")
+
+// A Demux holds queued messages for each session. It is safe for concurrent
+// use.
+type Demux struct {
+	// Sessions not yet returned by WaitForSession.
+	newSessions chan string
+
+	// Loss of the connection, not yet returned by WaitForSession.
+	lost chan error
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	ended    map[string]time.Time
+}
+
+type session struct {
+	sync.Mutex
+	queue []message
+
+	// Set when the remote peer has hung up.
+	hungUp bool
+
+	// Signaled when a message is queued or the remote peer hangs up.
+	notify chan struct{}
+}
+
+type message struct {
+	what    string
+	payload []byte
+}
+
+func New() *Demux {
+	return &Demux{
+		newSessions: make(chan string, pendingSessionLimit),
+		lost:        make(chan error, 1),
+		sessions:    make(map[string]*session),
+		ended:       make(map[string]time.Time),
+	}
+}
+
+// Deliver queues an incoming message for a session, starting the session if
+// it is new. Messages for recently ended sessions are dropped.
+func (d *Demux) Deliver(id, what string, payload []byte) error {
+	d.mu.Lock()
+	if _, ok := d.ended[id]; ok {
+		d.mu.Unlock()
+		return nil
+	}
+	s, ok := d.sessions[id]
+	if !ok {
+		select {
+		case d.newSessions <- id:
+		default:
+			d.mu.Unlock()
+			return ErrTooManySessions
+		}
+		s = &session{notify: make(chan struct{}, 1)}
+		d.sessions[id] = s
+	}
+	d.mu.Unlock()
+
+	s.Lock()
+	s.queue = append(s.queue, message{what, payload})
+	s.Unlock()
+	s.signal()
+	return nil
+}
+
+// Hangup marks a session as ended by the remote peer. Receive returns io.EOF
+// once the session's queued messages have been received.
+func (d *Demux) Hangup(id string) {
+	d.mu.Lock()
+	s := d.sessions[id]
+	d.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	s.hungUp = true
+	s.Unlock()
+	s.signal()
+}
+
+func (s *session) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Disconnected makes WaitForSession return err, e.g. when the connection over
+// which messages arrive is lost, so that the transport is reconnected.
+func (d *Demux) Disconnected(err error) {
+	select {
+	case d.lost <- err:
+	default:
+	}
+}
+
+// Connected forgets a disconnection not yet returned by WaitForSession, once
+// the transport has connected again.
+func (d *Demux) Connected() {
+	select {
+	case <-d.lost:
+	default:
+	}
+}
+
+// WaitForSession blocks until a message for a new session is delivered, and
+// returns the session's ID, or until the connection is lost.
+func (d *Demux) WaitForSession(ctx context.Context) (string, error) {
+	select {
+	case id := <-d.newSessions:
+		return id, nil
+	case err := <-d.lost:
+		return "", err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Receive blocks until the next message for a session is delivered. Once ctx
+// is done, the session is over, and later messages for it are dropped.
+func (d *Demux) Receive(ctx context.Context, id string) (string, []byte, error) {
+	d.mu.Lock()
+	s := d.sessions[id]
+	d.mu.Unlock()
+	if s == nil {
+		return "", nil, errors.New("unknown session: " + id)
+	}
+
+	for {
+		s.Lock()
+		if len(s.queue) > 0 {
+			m := s.queue[0]
+			s.queue = s.queue[1:]
+			s.Unlock()
+			return m.what, m.payload, nil
+		}
+		hungUp := s.hungUp
+		s.Unlock()
+		if hungUp {
+			d.end(id)
+			return "", nil, io.EOF
+		}
+
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			d.end(id)
+			return "", nil, ctx.Err()
+		}
+	}
+}
+
+// Forget an ended session, and drop stray messages for it for a while.
+func (d *Demux) end(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.sessions, id)
+	now := time.Now()
+	for other, ended := range d.ended {
+		if now.Sub(ended) > endedSessionTimeout {
+			delete(d.ended, other)
+		}
+	}
+	d.ended[id] = now
+}
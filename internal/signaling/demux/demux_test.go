@@ -0,0 +1,74 @@
+package demux
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDemux(t *testing.T) {
+	ctx := context.Background()
+	d := New()
+
+	// The first message for a session starts it, and messages are received
+	// in order.
+	d.Deliver("a", "sdp-offer", []byte("v=0"))
+	d.Deliver("a", "ice-candidate", nil)
+	if id, err := d.WaitForSession(ctx); err != nil || id != "a" {
+		t.Fatalf("got session %q, %v; expected a", id, err)
+	}
+	for _, expected := range []string{"sdp-offer", "ice-candidate"} {
+		if what, _, err := d.Receive(ctx, "a"); err != nil || what != expected {
+			t.Fatalf("got %s, %v; expected %s", what, err, expected)
+		}
+	}
+
+	// Hanging up ends the session once its messages are received.
+	d.Deliver("a", "command", []byte("stop\n"))
+	d.Hangup("a")
+	if what, _, err := d.Receive(ctx, "a"); err != nil || what != "command" {
+		t.Fatalf("got %s, %v; expected command", what, err)
+	}
+	if _, _, err := d.Receive(ctx, "a"); err != io.EOF {
+		t.Fatalf("got %v after hangup, expected EOF", err)
+	}
+
+	// Stray messages for the ended session don't start a new one.
+	d.Deliver("a", "ice-candidate", nil)
+	d.Deliver("b", "sdp-offer", []byte("v=0"))
+	if id, err := d.WaitForSession(ctx); err != nil || id != "b" {
+		t.Fatalf("got session %q, %v; expected b", id, err)
+	}
+}
+
+func TestDemuxTooManySessions(t *testing.T) {
+	d := New()
+	for i := 0; i < pendingSessionLimit; i++ {
+		if err := d.Deliver(string(rune('a'+i)), "sdp-offer", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Deliver("z", "sdp-offer", nil); err != ErrTooManySessions {
+		t.Errorf("got %v, expected %v", err, ErrTooManySessions)
+	}
+}
+
+func TestDemuxDisconnected(t *testing.T) {
+	ctx := context.Background()
+	d := New()
+
+	lost := errors.New("connection lost")
+	d.Disconnected(lost)
+	if _, err := d.WaitForSession(ctx); err != lost {
+		t.Errorf("got %v, expected %v", err, lost)
+	}
+
+	// A disconnection not yet returned is forgotten once reconnected.
+	d.Disconnected(lost)
+	d.Connected()
+	d.Deliver("a", "sdp-offer", nil)
+	if id, err := d.WaitForSession(ctx); err != nil || id != "a" {
+		t.Errorf("got session %q, %v; expected a", id, err)
+	}
+}
@@ -13,10 +13,8 @@ import (
 
 	flag "github.com/spf13/pflag"
 
-	"github.com/gorilla/websocket"
-
-	"github.com/lanikai/alohartc/internal/ice"
 	"github.com/lanikai/alohartc/internal/signaling/localdata"
+	"github.com/lanikai/alohartc/internal/signaling/ws"
 )
 
 var (
@@ -31,18 +29,31 @@ func init() {
 }
 
 // Serve a static web page that uses a WebSocket for signaling. This is meant
-// for development and debugging only.
+// for development and debugging only. The device joins the default room of
+// its own signaling server, and the page joins the room named by its "room"
+// query parameter (the default room if absent). Alternatively, /whep.html
+// plays the video using WHEP, with no WebSocket.
 func localWebsocketListener(handle SessionHandler) error {
+	signals := ws.NewServer()
 	router := http.NewServeMux()
 	router.Handle("/", http.FileServer(localdata.FS(false)))
-	router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		websocketHandler(w, r, handle)
-	})
+	router.Handle("/ws", signals)
+	whep := NewWHEPHandler(handle)
+	router.Handle("/whep", whep)
+	router.Handle("/whep/", whep)
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", flagPort),
 		Handler: router,
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := ServeTransport(ctx, signals.Attach(""), handle); err != nil {
+			log.Warn("Local signaling failed: %v", err)
+		}
+	}()
+
 	// Get hostname
 	url, err := os.Hostname()
 	if err != nil {
@@ -54,73 +65,11 @@ func localWebsocketListener(handle SessionHandler) error {
 		url += fmt.Sprintf(":%d", flagPort)
 	}
 
-	fmt.Printf("Open http://%s/ in a browser\n", url)
-	return server.ListenAndServe()
-}
-
-func websocketHandler(w http.ResponseWriter, r *http.Request, handle SessionHandler) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// Upgrade websocket connection
-	ws, err := new(websocket.Upgrader).Upgrade(w, r, nil)
-	if err != nil {
-		log.Warn("upgrade: %v", err)
-		return
-	}
-	defer ws.Close()
-
-	offerCh := make(chan string)
-	rcandCh := make(chan ice.Candidate)
-	session := &Session{
-		Context:          ctx,
-		Offer:            offerCh,
-		RemoteCandidates: rcandCh,
-		SendAnswer: func(sdp string) error {
-			return ws.WriteJSON(map[string]string{
-				"type": "answer",
-				"sdp":  sdp,
-			})
-		},
-		SendLocalCandidate: func(c *ice.Candidate) error {
-			msg := map[string]string{"type": "iceCandidate"}
-			if c != nil {
-				msg["candidate"] = c.String()
-				msg["sdpMid"] = c.Mid()
-			}
-			return ws.WriteJSON(msg)
-		},
-	}
-
-	go handle(session)
-
-	// Process incoming websocket messages. We expect JSON messages of the following form:
-	//   { "type": "offer", "sdp": "..." }
-	//   { "type": "iceCandidate", "candidate": "...", "sdpMid": "..." }
-	for {
-		msg := map[string]string{}
-		if err := ws.ReadJSON(&msg); err != nil {
-			log.Warn("Failed to read websocket message: %v", err)
-			return
-		}
-
-		switch msg["type"] {
-		case "offer":
-			offerCh <- msg["sdp"]
-		case "iceCandidate":
-			if _, ok := msg["candidate"]; !ok {
-				// An empty candidate indicates the end of ICE trickling.
-				close(rcandCh)
-				break
-			}
-			c, err := ice.ParseCandidate(msg["candidate"], msg["sdpMid"])
-			if err != nil {
-				log.Warn("Invalid ICE candidate '%s': %v", msg["candidate"], err)
-			} else {
-				rcandCh <- c
-			}
-		default:
-			log.Warn("Unexpected websocket message: %v", msg)
-		}
+	// The page skips its STUN server with "?lan".
+	page := "/"
+	if lanOnly {
+		page = "/?lan"
 	}
+	fmt.Printf("Open http://%s%s in a browser\n", url, page)
+	return server.ListenAndServe()
 }
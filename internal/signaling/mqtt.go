@@ -1,62 +1,167 @@
 package signaling
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"strings"
-	"sync"
+	"io/ioutil"
+	"time"
 
 	flag "github.com/spf13/pflag"
 
+	"github.com/lanikai/alohartc/internal/clock"
 	"github.com/lanikai/alohartc/internal/config"
-	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/lanikai/alohartc/internal/signaling/demux"
 	"github.com/lanikai/oahu/api/mq"
 )
 
 var (
-	mqttBrokerFlag string
-	certFlag       string
-	keyFlag        string
+	mqttBrokerFlag   string
+	certFlag         string
+	keyFlag          string
+	mqttTLSFlag      bool
+	mqttCAFlag       string
+	mqttClientIDFlag string
+	mqttTopicsFlag   string
 )
 
 func init() {
 	flag.StringVarP(&mqttBrokerFlag, "mqtt-address", "m", config.MQTT_BROKER, "MQTT broker address")
 	flag.StringVarP(&certFlag, "certificate", "c", "/etc/alohartcd/cert.pem", "Client certificate for connecting to MQTT broker")
 	flag.StringVarP(&keyFlag, "private-key", "k", "/etc/alohartcd/key.pem", "Private key corresponding to client certificate")
+	flag.BoolVar(&mqttTLSFlag, "mqtt-tls", true, "Connect to the MQTT broker over TLS")
+	flag.StringVar(&mqttCAFlag, "mqtt-ca", "", "CA certificate for verifying the MQTT broker")
+	flag.StringVar(&mqttClientIDFlag, "mqtt-client-id", "", "MQTT client ID (default: client certificate's common name)")
+	flag.StringVar(&mqttTopicsFlag, "mqtt-topic-prefix", "", "Prefix of MQTT signaling topics (default: devices/CLIENT-ID)")
 
 	RegisterListener(mqttListener)
 }
 
-// Connect to the Oahu MQTT broker and subscribe to topics for incoming calls.
+// The broker is pinged, by publishing to a topic of our own, every
+// mqttKeepaliveInterval, and presumed lost if the ping doesn't come back
+// within mqttKeepaliveTimeout.
+const (
+	mqttKeepaliveInterval = 15 * time.Second
+	mqttKeepaliveTimeout  = 10 * time.Second
+)
+
+var errBrokerUnresponsive = errors.New("MQTT broker stopped responding")
+
+// Connect to the MQTT broker given by command line flags (by default, the Oahu
+// broker) and subscribe to topics for incoming calls.
 func mqttListener(handler SessionHandler) error {
-	// Load certificate and key.
-	cert, err := tls.LoadX509KeyPair(certFlag, keyFlag)
+	if lanOnly && mqttBrokerFlag == config.MQTT_BROKER {
+		log.Info("LAN-only mode: not connecting to the default MQTT broker")
+		return nil
+	}
+	config, err := mqttConfigFromFlags()
 	if err != nil {
 		return err
 	}
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		InsecureSkipVerify: true,
+	return ServeTransport(context.Background(), NewMQTTTransport(config), handler)
+}
+
+func mqttConfigFromFlags() (MQTTConfig, error) {
+	config := MQTTConfig{
+		Broker:      mqttBrokerFlag,
+		ClientID:    mqttClientIDFlag,
+		TopicPrefix: mqttTopicsFlag,
+	}
+	if !mqttTLSFlag {
+		if config.ClientID == "" {
+			return config, errors.New("--mqtt-client-id is required without TLS")
+		}
+		return config, nil
 	}
 
+	config.TLSConfig = &tls.Config{}
+	if mqttCAFlag != "" {
+		pem, err := ioutil.ReadFile(mqttCAFlag)
+		if err != nil {
+			return config, err
+		}
+		config.TLSConfig.RootCAs = x509.NewCertPool()
+		if !config.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return config, fmt.Errorf("no certificates found in %s", mqttCAFlag)
+		}
+	} else {
+		config.TLSConfig.InsecureSkipVerify = true
+	}
+
+	// Load certificate and key. A self-hosted broker may not require a client
+	// certificate, provided the client ID is given.
+	cert, err := tls.LoadX509KeyPair(certFlag, keyFlag)
+	if err != nil {
+		if config.ClientID == "" {
+			return config, err
+		}
+		log.Info("Connecting to MQTT broker without a client certificate: %v", err)
+		return config, nil
+	}
+	config.TLSConfig.Certificates = []tls.Certificate{cert}
+
 	// Extract the subject Common Name from the client certificate, and use it
 	// as the MQTT client ID.
-	var clientID string
-	tlsConfig.BuildNameToCertificate()
-	for clientID, _ = range tlsConfig.NameToCertificate {
-		break
+	if config.ClientID == "" {
+		config.TLSConfig.BuildNameToCertificate()
+		for config.ClientID = range config.TLSConfig.NameToCertificate {
+			break
+		}
 	}
+	return config, nil
+}
+
+// MQTTConfig configures an MQTT signaling transport.
+type MQTTConfig struct {
+	// Broker address, e.g. "mqtt.example.com:8883".
+	Broker string
+
+	// TLS configuration for connecting to the broker, including any client
+	// certificate. Nil for an unencrypted connection.
+	TLSConfig *tls.Config
+
+	// MQTT client ID, unique among the broker's clients.
+	ClientID string
+
+	// Prefix of this device's topics. Remote peers publish messages to
+	// PREFIX/calls/CALL-ID/remote/TYPE, and replies are published to
+	// PREFIX/calls/CALL-ID/local/TYPE. The connection status is published to
+	// PREFIX/status. Defaults to "devices/" followed by the client ID.
+	TopicPrefix string
+}
+
+type mqttTransport struct {
+	MQTTConfig
 
-	topicPrefix := fmt.Sprintf("devices/%s", clientID)
+	// Incoming messages, sorted by call.
+	*demux.Demux
 
-	// Connect to MQTT broker.
-	err = mq.Connect(mq.Config{
-		Server:      mqttBrokerFlag,
-		ClientID:    clientID,
-		TLSConfig:   tlsConfig,
-		WillTopic:   topicPrefix + "/status",
+	// Stops monitoring the connection to the broker.
+	stopMonitor context.CancelFunc
+}
+
+// NewMQTTTransport returns a Transport that exchanges signaling messages with
+// remote peers through an MQTT broker, e.g. a self-hosted Mosquitto. Only one
+// MQTT transport may be connected at a time.
+func NewMQTTTransport(config MQTTConfig) Transport {
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = "devices/" + config.ClientID
+	}
+	return &mqttTransport{
+		MQTTConfig: config,
+		Demux:      demux.New(),
+	}
+}
+
+func (t *mqttTransport) Connect(ctx context.Context) error {
+	statusTopic := t.TopicPrefix + "/status"
+	err := mq.Connect(mq.Config{
+		Server:      t.Broker,
+		ClientID:    t.ClientID,
+		TLSConfig:   t.TLSConfig,
+		WillTopic:   statusTopic,
 		WillRetain:  true,
 		WillPayload: []byte("disconnected"),
 	})
@@ -64,105 +169,100 @@ func mqttListener(handler SessionHandler) error {
 		return err
 	}
 
-	var callLock sync.Mutex
-	calls := make(map[string]*callState)
-
-	ctx := context.TODO()
-
-	// Listen for incoming calls.
-	topicFilter := topicPrefix + "/calls/+/remote/#"
-	mq.Subscribe(topicFilter, 1, func(msg mq.Message) {
-		log.Debug("Received MQTT message on topic %s: %q", msg.Topic, msg.Payload)
-		callID := msg.Wildcards[0]
-		what := msg.Wildcards[1]
-		body := string(msg.Payload)
-
-		// If this is a new call, invoke the handler.
-		callLock.Lock()
-		call, existing := calls[callID]
-		if !existing {
-			call = newCall(callID, fmt.Sprintf("%s/calls/%s/local", topicPrefix, callID))
-			calls[callID] = call
-			go handler(call.session)
-		}
-		callLock.Unlock()
+	t.Connected()
+	mq.Subscribe(t.subscription(), 1, t.dispatch)
+	mq.Publish(statusTopic, 1, []byte("connected"))
 
-		call.handleMessage(what, body)
+	// Watch for the connection dropping, so that WaitForSession returns and
+	// the transport is reconnected.
+	pong := make(chan struct{}, 1)
+	mq.Subscribe(t.keepaliveTopic(), 1, func(mq.Message) {
+		select {
+		case pong <- struct{}{}:
+		default:
+		}
 	})
-	defer mq.Unsubscribe(topicFilter)
+	ping := func() {
+		mq.Publish(t.keepaliveTopic(), 1, []byte("ping"))
+	}
+	ctx, t.stopMonitor = context.WithCancel(ctx)
+	go func() {
+		err := monitorBroker(ctx, clock.System, mqttKeepaliveInterval, mqttKeepaliveTimeout, ping, pong)
+		if err != nil {
+			log.Warn("Lost connection to MQTT broker %s: %v", t.Broker, err)
+			t.Disconnected(err)
+		}
+	}()
+	return nil
+}
 
-	mq.Publish(topicPrefix+"/status", 1, []byte("connected"))
+func (t *mqttTransport) subscription() string {
+	return t.TopicPrefix + "/calls/+/remote/#"
+}
 
-	<-ctx.Done()
-	return nil
+func (t *mqttTransport) keepaliveTopic() string {
+	return t.TopicPrefix + "/keepalive"
 }
 
-// Creates a new call object.
-func newCall(id, topicPrefix string) *callState {
-	offerCh := make(chan string)
-	rcandCh := make(chan ice.Candidate)
-	session := &Session{
-		Context:          context.Background(),
-		Offer:            offerCh,
-		RemoteCandidates: rcandCh,
-		SendAnswer: func(sdp string) error {
-			mq.Publish(topicPrefix+"/sdp-answer", 0, []byte(sdp))
+// Ping the broker every interval, until ctx is done or a ping doesn't come
+// back on pong within timeout.
+func monitorBroker(ctx context.Context, clk clock.Clock, interval, timeout time.Duration, ping func(), pong <-chan struct{}) error {
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
 			return nil
-		},
-		SendLocalCandidate: func(c *ice.Candidate) error {
-			var payload bytes.Buffer
-			if c != nil {
-				fmt.Fprintf(&payload, "%s\nmid:%s\n", c.String(), c.Mid())
-			}
-			mq.Publish(topicPrefix+"/ice-candidate", 0, payload.Bytes())
+		}
+
+		// Forget a late reply to an earlier ping.
+		select {
+		case <-pong:
+		default:
+		}
+
+		expired := make(chan struct{})
+		timer := clk.AfterFunc(timeout, func() { close(expired) })
+		// Publishing may block while the connection is down.
+		go ping()
+		select {
+		case <-pong:
+			timer.Stop()
+		case <-expired:
+			return errBrokerUnresponsive
+		case <-ctx.Done():
+			timer.Stop()
 			return nil
-		},
+		}
 	}
+}
 
-	return &callState{
-		id:      id,
-		offerCh: offerCh,
-		rcandCh: rcandCh,
-		session: session,
+// Queue an incoming message for its session, starting a new session if
+// necessary.
+func (t *mqttTransport) dispatch(msg mq.Message) {
+	log.Debug("Received MQTT message on topic %s: %q", msg.Topic, msg.Payload)
+	if len(msg.Wildcards) < 2 {
+		log.Warn("Unexpected MQTT topic: %s", msg.Topic)
+		return
+	}
+	id, what := msg.Wildcards[0], msg.Wildcards[1]
+	if err := t.Deliver(id, what, msg.Payload); err != nil {
+		log.Warn("Dropping call %s: %v", id, err)
 	}
 }
 
-type callState struct {
-	id      string
-	offerCh chan string
-	rcandCh chan ice.Candidate
-	session *Session
+func (t *mqttTransport) Send(sessionID, what string, payload []byte) error {
+	topic := fmt.Sprintf("%s/calls/%s/local/%s", t.TopicPrefix, sessionID, what)
+	mq.Publish(topic, 0, payload)
+	return nil
 }
 
-func (call *callState) handleMessage(what, body string) {
-	switch what {
-	case "sdp-offer":
-		call.offerCh <- body
-	case "ice-candidate":
-		if len(body) == 0 {
-			close(call.rcandCh)
-			break
-		}
-		var desc, sdpMid string
-		for _, line := range strings.Split(body, "\n") {
-			if line == "" {
-				continue
-			} else if strings.HasPrefix(line, "candidate:") {
-				desc = line
-			} else if strings.HasPrefix(line, "mid:") {
-				sdpMid = line[4:]
-			} else {
-				log.Warn("Invalid 'ice-candidate' payload: %q", body)
-			}
-		}
-		if desc == "" {
-			log.Debug("Empty ICE candidate: sdpMid = %s", sdpMid)
-		} else if c, err := ice.ParseCandidate(desc, sdpMid); err != nil {
-			log.Warn("Invalid ICE candidate (%q, %q): %v", desc, sdpMid, err)
-		} else {
-			call.rcandCh <- c
-		}
-	default:
-		log.Warn("Unrecognized MQTT topic level: %s", what)
+func (t *mqttTransport) Close() error {
+	if t.stopMonitor != nil {
+		t.stopMonitor()
 	}
+	mq.Unsubscribe(t.subscription())
+	mq.Unsubscribe(t.keepaliveTopic())
+	return nil
 }
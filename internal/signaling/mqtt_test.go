@@ -0,0 +1,57 @@
+package signaling
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+)
+
+func TestMonitorBroker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := clock.NewFake(time.Unix(0, 0))
+
+	// The broker echoes pings until told otherwise.
+	pong := make(chan struct{})
+	pinged := make(chan struct{})
+	alive := true
+	ping := func() {
+		if alive {
+			pong <- struct{}{}
+		}
+		pinged <- struct{}{}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- monitorBroker(ctx, clk, mqttKeepaliveInterval, mqttKeepaliveTimeout, ping, pong)
+	}()
+
+	// Pings answered before the timeout keep the connection.
+	clk.WaitForTimers(1)
+	for i := 0; i < 3; i++ {
+		clk.Advance(mqttKeepaliveInterval)
+		<-pinged
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("monitor stopped while the broker responds: %v", err)
+	default:
+	}
+
+	// Once a ping goes unanswered, the connection is lost.
+	alive = false
+	clk.Advance(mqttKeepaliveInterval)
+	<-pinged
+	clk.Advance(mqttKeepaliveTimeout)
+	select {
+	case err := <-done:
+		if err != errBrokerUnresponsive {
+			t.Errorf("got %v, expected %v", err, errBrokerUnresponsive)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("monitor didn't notice the broker stop responding")
+	}
+}
@@ -29,7 +29,28 @@ type Session struct {
 	// Client-specific function for sending local ICE candidates to remote peer.
 	SendLocalCandidate func(c *ice.Candidate) error
 
-	// TODO: Add method to close session.
+	// Channel for receiving application commands from remote peer, e.g. to
+	// control playback of a recording. Nil if the client does not support
+	// commands.
+	Commands <-chan Command
+
+	// Ends the session. Nil if the client provides no way to end it.
+	cancel context.CancelFunc
+}
+
+// Close ends the session, e.g. once the call is over. The session's context is
+// canceled, and no more messages are exchanged with the remote peer.
+func (s *Session) Close() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// A Command is an application-level request from the remote peer, carried
+// over the signaling channel.
+type Command struct {
+	Name string
+	Arg  string
 }
 
 // A ListenFunc connects to a signaling server and listens for incoming calls.
@@ -38,6 +59,17 @@ type ListenFunc func(handler SessionHandler) error
 
 var listeners []ListenFunc
 
+// Whether signaling is restricted to the local network.
+var lanOnly bool
+
+// SetLANOnly restricts signaling to listeners that need no internet access,
+// for closed networks. MQTT then connects only to a broker other than the
+// default, e.g. one on the LAN, and the local web page gathers no candidates
+// from a STUN server.
+func SetLANOnly(enabled bool) {
+	lanOnly = enabled
+}
+
 func RegisterListener(lf ListenFunc) {
 	listeners = append(listeners, lf)
 }
@@ -0,0 +1,46 @@
+package signaling
+
+import (
+	"context"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/lanikai/alohartc/internal/signaling/sip"
+)
+
+var (
+	sipListenFlag    string
+	sipRegistrarFlag string
+	sipUserFlag      string
+	sipPasswordFlag  string
+	sipDomainFlag    string
+)
+
+func init() {
+	flag.StringVar(&sipListenFlag, "sip-listen", "", "Local UDP address on which to answer SIP calls, e.g. :5060")
+	flag.StringVar(&sipRegistrarFlag, "sip-registrar", "", "SIP registrar or PBX with which to register")
+	flag.StringVar(&sipUserFlag, "sip-user", "alohartc", "SIP user name")
+	flag.StringVar(&sipPasswordFlag, "sip-password", "", "SIP password, for registering")
+	flag.StringVar(&sipDomainFlag, "sip-domain", "", "SIP domain (default: the registrar's host)")
+
+	RegisterListener(sipListener)
+}
+
+// Answer SIP calls, if enabled by command line flags.
+func sipListener(handler SessionHandler) error {
+	if sipListenFlag == "" && sipRegistrarFlag == "" {
+		return nil
+	}
+	listen := sipListenFlag
+	if listen == "" {
+		listen = ":5060"
+	}
+	ua := sip.NewUA(sip.Config{
+		ListenAddr: listen,
+		Registrar:  sipRegistrarFlag,
+		User:       sipUserFlag,
+		Password:   sipPasswordFlag,
+		Domain:     sipDomainFlag,
+	})
+	return ServeTransport(context.Background(), ua, handler)
+}
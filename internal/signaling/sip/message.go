@@ -0,0 +1,207 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Message is a SIP request or response (RFC 3261 Section 7).
+type Message struct {
+	// Request line, for requests.
+	Method     string
+	RequestURI string
+
+	// Status line, for responses.
+	StatusCode int
+	Reason     string
+
+	// Header fields, in order. Names are in their long form.
+	Header []HeaderField
+
+	Body []byte
+}
+
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Long forms of compact header field names (RFC 3261 Section 7.3.3).
+var compactNames = map[string]string{
+	"c": "Content-Type",
+	"f": "From",
+	"i": "Call-ID",
+	"k": "Supported",
+	"l": "Content-Length",
+	"m": "Contact",
+	"t": "To",
+	"v": "Via",
+}
+
+func (m *Message) IsRequest() bool {
+	return m.Method != ""
+}
+
+// Get returns the value of the first header field with the given name, or ""
+// if there is none.
+func (m *Message) Get(name string) string {
+	for _, h := range m.Header {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// GetAll returns the values of all header fields with the given name.
+func (m *Message) GetAll(name string) []string {
+	var values []string
+	for _, h := range m.Header {
+		if strings.EqualFold(h.Name, name) {
+			values = append(values, h.Value)
+		}
+	}
+	return values
+}
+
+// Set replaces the header fields with the given name, or adds one.
+func (m *Message) Set(name, value string) {
+	for i, h := range m.Header {
+		if strings.EqualFold(h.Name, name) {
+			m.Header[i].Value = value
+			m.del(name, i+1)
+			return
+		}
+	}
+	m.Add(name, value)
+}
+
+func (m *Message) Add(name, value string) {
+	m.Header = append(m.Header, HeaderField{name, value})
+}
+
+// Remove header fields with the given name, from index i on.
+func (m *Message) del(name string, i int) {
+	fields := m.Header[:i]
+	for _, h := range m.Header[i:] {
+		if !strings.EqualFold(h.Name, name) {
+			fields = append(fields, h)
+		}
+	}
+	m.Header = fields
+}
+
+// CSeq returns the sequence number and method of the CSeq header field.
+func (m *Message) CSeq() (seq uint32, method string) {
+	f := strings.Fields(m.Get("CSeq"))
+	if len(f) != 2 {
+		return 0, ""
+	}
+	n, _ := strconv.ParseUint(f[0], 10, 32)
+	return uint32(n), f[1]
+}
+
+// Bytes returns the message in wire format, with Content-Length set.
+func (m *Message) Bytes() []byte {
+	var b bytes.Buffer
+	if m.IsRequest() {
+		fmt.Fprintf(&b, "%s %s SIP/2.0\r\n", m.Method, m.RequestURI)
+	} else {
+		fmt.Fprintf(&b, "SIP/2.0 %d %s\r\n", m.StatusCode, m.Reason)
+	}
+	for _, h := range m.Header {
+		if strings.EqualFold(h.Name, "Content-Length") {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", h.Name, h.Value)
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(m.Body))
+	b.Write(m.Body)
+	return b.Bytes()
+}
+
+// ParseMessage parses a SIP message received in a datagram.
+func ParseMessage(data []byte) (*Message, error) {
+	head, body := data, []byte(nil)
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head, body = data[:i], data[i+4:]
+	}
+
+	lines := strings.Split(string(head), "\r\n")
+	m := &Message{}
+	first := strings.SplitN(lines[0], " ", 3)
+	if len(first) != 3 {
+		return nil, fmt.Errorf("malformed start line: %q", lines[0])
+	}
+	if first[0] == "SIP/2.0" {
+		code, err := strconv.Atoi(first[1])
+		if err != nil || code < 100 || code > 699 {
+			return nil, fmt.Errorf("malformed status line: %q", lines[0])
+		}
+		m.StatusCode, m.Reason = code, first[2]
+	} else if first[2] == "SIP/2.0" {
+		m.Method, m.RequestURI = first[0], first[1]
+	} else {
+		return nil, fmt.Errorf("malformed start line: %q", lines[0])
+	}
+
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation of the previous field (RFC 3261 Section 7.3.1).
+			if len(m.Header) == 0 {
+				return nil, errors.New("malformed header")
+			}
+			m.Header[len(m.Header)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed header field: %q", line)
+		}
+		name := strings.TrimSpace(line[:i])
+		if long, ok := compactNames[strings.ToLower(name)]; ok {
+			name = long
+		}
+		m.Add(name, strings.TrimSpace(line[i+1:]))
+	}
+
+	if cl := m.Get("Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > len(body) {
+			return nil, fmt.Errorf("invalid Content-Length: %q", cl)
+		}
+		body = body[:n]
+	}
+	m.Body = body
+	return m, nil
+}
+
+// Return a header field parameter, e.g. the tag in `<sip:bob@example.com>;tag=1234`.
+func headerParam(value, name string) string {
+	for _, p := range strings.Split(value, ";")[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(strings.ToLower(p), name+"=") {
+			return p[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// NewResponse returns a response to a request, copying the header fields
+// that identify the transaction (RFC 3261 Section 8.2.6.2).
+func NewResponse(req *Message, code int, reason string) *Message {
+	res := &Message{StatusCode: code, Reason: reason}
+	for _, via := range req.GetAll("Via") {
+		res.Add("Via", via)
+	}
+	for _, name := range []string{"From", "To", "Call-ID", "CSeq"} {
+		res.Add(name, req.Get(name))
+	}
+	return res
+}
@@ -0,0 +1,74 @@
+package sip
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	data := "INVITE sip:alohartc@192.168.1.10 SIP/2.0\r\n" +
+		"v: SIP/2.0/UDP 192.168.1.20:5060;branch=z9hG4bK776asdhds\r\n" +
+		"Via: SIP/2.0/UDP 192.168.1.1:5060;branch=z9hG4bK123\r\n" +
+		"From: <sip:door@example.com>;tag=1928301774\r\n" +
+		"To: <sip:alohartc@example.com>\r\n" +
+		"Call-ID: a84b4c76e66710\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Subject: first line,\r\n" +
+		" second line\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Content-Length: 4\r\n" +
+		"\r\n" +
+		"v=0\nextra"
+
+	m, err := ParseMessage([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Method != "INVITE" || m.RequestURI != "sip:alohartc@192.168.1.10" {
+		t.Errorf("request line: %q %q", m.Method, m.RequestURI)
+	}
+	if got := len(m.GetAll("Via")); got != 2 {
+		t.Errorf("expected 2 Via fields, got %d", got)
+	}
+	if got := headerParam(m.Get("From"), "tag"); got != "1928301774" {
+		t.Errorf("From tag: %q", got)
+	}
+	if seq, method := m.CSeq(); seq != 314159 || method != "INVITE" {
+		t.Errorf("CSeq: %d %s", seq, method)
+	}
+	if got := m.Get("Subject"); got != "first line, second line" {
+		t.Errorf("folded Subject: %q", got)
+	}
+	if string(m.Body) != "v=0\n" {
+		t.Errorf("body: %q", m.Body)
+	}
+
+	res := NewResponse(m, 200, "OK")
+	parsed, err := ParseMessage(res.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.StatusCode != 200 || !reflect.DeepEqual(parsed.GetAll("Via"), m.GetAll("Via")) {
+		t.Errorf("response round trip: %q", res.Bytes())
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	params, err := parseChallenge(`Digest realm="example.com", nonce="a,b", qop="auth,auth-int", algorithm=MD5`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"realm":     "example.com",
+		"nonce":     "a,b",
+		"qop":       "auth,auth-int",
+		"algorithm": "MD5",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("got %v, expected %v", params, expected)
+	}
+
+	if _, err := parseChallenge(`Basic realm="example.com"`); err == nil {
+		t.Error("expected error for Basic authentication")
+	}
+}
@@ -0,0 +1,648 @@
+// Package sip implements a minimal SIP user agent (RFC 3261) over UDP, which
+// registers with a registrar or PBX and answers incoming calls, so that a
+// device can be called from SIP video phones, e.g. as a door intercom.
+//
+// Calls are answered with a WebRTC answer (ICE, DTLS-SRTP, and H.264), so the
+// caller must support WebRTC media, as e.g. Asterisk does with webrtc=yes.
+// Since SIP has no trickle ICE, the answer is sent only after the device has
+// gathered its candidates, and the caller's candidates are taken from its
+// offer.
+package sip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/sdp"
+	"github.com/lanikai/alohartc/internal/signaling/demux"
+)
+
+const (
+	// Retransmission timers (RFC 3261 Section 17.1.1.1).
+	timerT1 = 500 * time.Millisecond
+	timerT2 = 4 * time.Second
+
+	// How long a transaction may go unanswered.
+	transactionTimeout = 64 * timerT1
+
+	// How long to wait for local ICE candidates before answering with those
+	// gathered so far.
+	gatheringTimeout = 5 * time.Second
+
+	// Largest datagram accepted.
+	maxMessageSize = 65535
+
+	// Default registration lifetime.
+	defaultExpires = time.Hour
+
+	allowedMethods = "INVITE, ACK, CANCEL, BYE, OPTIONS"
+)
+
+var errTimeout = errors.New("SIP transaction timed out")
+
+// Config configures a SIP user agent.
+type Config struct {
+	// Local UDP address to receive calls on, e.g. ":5060".
+	ListenAddr string
+
+	// Registrar with which to register, e.g. "pbx.example.com:5060". If
+	// empty, the user agent doesn't register, and only answers calls made
+	// directly to its address.
+	Registrar string
+
+	// User part of the device's SIP address, and credentials for registering.
+	User     string
+	Password string
+
+	// Domain of the device's SIP address. Defaults to the registrar's host.
+	Domain string
+
+	// Registration lifetime, refreshed halfway through. Defaults to an hour.
+	Expires time.Duration
+}
+
+// A UA is a SIP user agent that answers calls. It implements
+// signaling.Transport, with one session per call.
+type UA struct {
+	Config
+
+	// Incoming messages, sorted by Call-ID.
+	*demux.Demux
+
+	conn      *net.UDPConn
+	registrar *net.UDPAddr
+	cancel    context.CancelFunc
+
+	// Registration dialog.
+	regCallID string
+	regTag    string
+
+	mu      sync.Mutex
+	cseq    uint32
+	calls   map[string]*call
+	pending map[string]chan *Message // client transactions, by Via branch
+}
+
+// An incoming call.
+type call struct {
+	invite   *Message
+	addr     *net.UDPAddr
+	localTag string
+
+	// SDP answer, waiting for local candidates.
+	answer     string
+	candidates []string
+	timer      *time.Timer
+
+	// Final response to the INVITE, retransmitted until acknowledged.
+	response *Message
+	acked    chan struct{}
+}
+
+func NewUA(config Config) *UA {
+	if config.Domain == "" && config.Registrar != "" {
+		config.Domain = config.Registrar
+		if host, _, err := net.SplitHostPort(config.Registrar); err == nil {
+			config.Domain = host
+		}
+	}
+	if config.Expires == 0 {
+		config.Expires = defaultExpires
+	}
+	return &UA{
+		Config:    config,
+		Demux:     demux.New(),
+		regCallID: newToken(),
+		regTag:    newToken(),
+		calls:     make(map[string]*call),
+		pending:   make(map[string]chan *Message),
+	}
+}
+
+// Connect starts listening for calls, and registers with the registrar, if
+// any.
+func (ua *UA) Connect(ctx context.Context) error {
+	laddr, err := net.ResolveUDPAddr("udp", ua.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if ua.conn, err = net.ListenUDP("udp", laddr); err != nil {
+		return err
+	}
+	ctx, ua.cancel = context.WithCancel(ctx)
+	go ua.readLoop()
+
+	if ua.Registrar == "" {
+		log.Info("Listening for SIP calls on %s", ua.conn.LocalAddr())
+		return nil
+	}
+	if ua.registrar, err = net.ResolveUDPAddr("udp", ua.Registrar); err != nil {
+		ua.conn.Close()
+		return err
+	}
+	if err := ua.register(ctx, ua.Expires); err != nil {
+		ua.conn.Close()
+		return fmt.Errorf("SIP registration failed: %v", err)
+	}
+	log.Info("Registered as sip:%s@%s", ua.User, ua.Domain)
+	go ua.refreshRegistration(ctx)
+	return nil
+}
+
+func (ua *UA) refreshRegistration(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ua.Expires / 2):
+		}
+		if err := ua.register(ctx, ua.Expires); err != nil {
+			log.Warn("SIP registration refresh failed: %v", err)
+		}
+	}
+}
+
+// Register, or unregister if expires is 0, answering any digest challenge.
+func (ua *UA) register(ctx context.Context, expires time.Duration) error {
+	aor := fmt.Sprintf("<sip:%s@%s>", ua.User, ua.Domain)
+	uri := "sip:" + ua.Domain
+
+	var authHeader, authorization string
+	for attempt := 0; attempt < 2; attempt++ {
+		req := &Message{Method: "REGISTER", RequestURI: uri}
+		req.Add("Max-Forwards", "70")
+		req.Add("From", aor+";tag="+ua.regTag)
+		req.Add("To", aor)
+		req.Add("Call-ID", ua.regCallID)
+		req.Add("CSeq", fmt.Sprintf("%d REGISTER", ua.nextCSeq()))
+		req.Add("Contact", ua.contact(ua.registrar))
+		req.Add("Expires", fmt.Sprint(int(expires/time.Second)))
+		if authorization != "" {
+			req.Add(authHeader, authorization)
+		}
+
+		res, err := ua.request(ctx, req, ua.registrar)
+		if err != nil {
+			return err
+		}
+		switch res.StatusCode {
+		case 200:
+			return nil
+		case 401, 407:
+			challengeHeader := "WWW-Authenticate"
+			authHeader = "Authorization"
+			if res.StatusCode == 407 {
+				challengeHeader = "Proxy-Authenticate"
+				authHeader = "Proxy-Authorization"
+			}
+			challenge, err := parseChallenge(res.Get(challengeHeader))
+			if err != nil {
+				return err
+			}
+			authorization = digestAuthorization(challenge, "REGISTER", uri, ua.User, ua.Password)
+		default:
+			return fmt.Errorf("%d %s", res.StatusCode, res.Reason)
+		}
+	}
+	return errors.New("authentication failed")
+}
+
+func (ua *UA) nextCSeq() uint32 {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	ua.cseq++
+	return ua.cseq
+}
+
+// Return the Contact header value for messages sent to addr.
+func (ua *UA) contact(addr *net.UDPAddr) string {
+	return fmt.Sprintf("<sip:%s@%s>", ua.User, ua.localHost(addr))
+}
+
+// Return the local address, as host:port, at which addr can reach us.
+func (ua *UA) localHost(addr *net.UDPAddr) string {
+	local := ua.conn.LocalAddr().(*net.UDPAddr)
+	ip := local.IP
+	if ip.IsUnspecified() {
+		// Find the address of the interface used to reach addr. No packets
+		// are sent.
+		if c, err := net.DialUDP("udp", nil, addr); err == nil {
+			ip = c.LocalAddr().(*net.UDPAddr).IP
+			c.Close()
+		}
+	}
+	return net.JoinHostPort(ip.String(), fmt.Sprint(local.Port))
+}
+
+// Send a request, retransmitting it until a final response arrives.
+func (ua *UA) request(ctx context.Context, req *Message, addr *net.UDPAddr) (*Message, error) {
+	branch := "z9hG4bK" + newToken()
+	req.Header = append([]HeaderField{{"Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=%s;rport", ua.localHost(addr), branch)}}, req.Header...)
+
+	responses := make(chan *Message, 1)
+	ua.mu.Lock()
+	ua.pending[branch] = responses
+	ua.mu.Unlock()
+	defer func() {
+		ua.mu.Lock()
+		delete(ua.pending, branch)
+		ua.mu.Unlock()
+	}()
+
+	data := req.Bytes()
+	deadline := time.After(transactionTimeout)
+	interval := timerT1
+	for {
+		if _, err := ua.conn.WriteToUDP(data, addr); err != nil {
+			return nil, err
+		}
+		retransmit := time.After(interval)
+	wait:
+		for {
+			select {
+			case res := <-responses:
+				if res.StatusCode >= 200 {
+					return res, nil
+				}
+				// A provisional response stops retransmission of all but
+				// INVITE requests, but the transaction may still time out.
+				retransmit = nil
+			case <-retransmit:
+				break wait
+			case <-deadline:
+				return nil, errTimeout
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if interval *= 2; interval > timerT2 {
+			interval = timerT2
+		}
+	}
+}
+
+func (ua *UA) readLoop() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := ua.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Debug("SIP read loop exiting: %v", err)
+			return
+		}
+		m, err := ParseMessage(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			log.Debug("Dropping malformed SIP message from %s: %v", addr, err)
+			continue
+		}
+		if m.IsRequest() {
+			ua.handleRequest(m, addr)
+		} else {
+			ua.handleResponse(m)
+		}
+	}
+}
+
+// Pass a response to the client transaction awaiting it.
+func (ua *UA) handleResponse(res *Message) {
+	branch := headerParam(res.Get("Via"), "branch")
+	ua.mu.Lock()
+	responses := ua.pending[branch]
+	ua.mu.Unlock()
+	if responses == nil {
+		log.Debug("Dropping stray SIP response: %d %s", res.StatusCode, res.Reason)
+		return
+	}
+	select {
+	case responses <- res:
+	default:
+	}
+}
+
+func (ua *UA) handleRequest(req *Message, addr *net.UDPAddr) {
+	log.Debug("Received SIP %s from %s", req.Method, addr)
+	callID := req.Get("Call-ID")
+	ua.mu.Lock()
+	c := ua.calls[callID]
+	ua.mu.Unlock()
+
+	switch req.Method {
+	case "INVITE":
+		if c != nil {
+			// A retransmitted INVITE gets the same response. Re-INVITEs,
+			// e.g. to put the call on hold, aren't supported.
+			if seq, _ := req.CSeq(); seq != c.inviteCSeq() {
+				ua.respond(NewResponse(req, 488, "Not Acceptable Here"), addr)
+			} else if res := ua.finalResponse(c); res != nil {
+				ua.respond(res, addr)
+			}
+			return
+		}
+		ua.handleInvite(req, addr)
+	case "ACK":
+		if c != nil {
+			ua.mu.Lock()
+			select {
+			case <-c.acked:
+			default:
+				close(c.acked)
+			}
+			ua.mu.Unlock()
+		}
+	case "BYE":
+		ua.respond(NewResponse(req, 200, "OK"), addr)
+		if c != nil {
+			ua.endCall(callID)
+			ua.Hangup(callID)
+		}
+	case "CANCEL":
+		ua.respond(NewResponse(req, 200, "OK"), addr)
+		if c != nil && ua.finalResponse(c) == nil {
+			ua.sendFinalResponse(callID, c, NewResponse(c.invite, 487, "Request Terminated"))
+			ua.Hangup(callID)
+		}
+	case "OPTIONS":
+		res := NewResponse(req, 200, "OK")
+		res.Add("Allow", allowedMethods)
+		res.Add("Accept", "application/sdp")
+		ua.respond(res, addr)
+	default:
+		res := NewResponse(req, 405, "Method Not Allowed")
+		res.Add("Allow", allowedMethods)
+		ua.respond(res, addr)
+	}
+}
+
+func (c *call) inviteCSeq() uint32 {
+	seq, _ := c.invite.CSeq()
+	return seq
+}
+
+// Start a call, and pass its offer and the remote candidates in it to the
+// session.
+func (ua *UA) handleInvite(req *Message, addr *net.UDPAddr) {
+	callID := req.Get("Call-ID")
+	if !strings.HasPrefix(req.Get("Content-Type"), "application/sdp") || len(req.Body) == 0 {
+		ua.respond(NewResponse(req, 415, "Unsupported Media Type"), addr)
+		return
+	}
+
+	ua.respond(NewResponse(req, 100, "Trying"), addr)
+	c := &call{
+		invite:   req,
+		addr:     addr,
+		localTag: newToken(),
+		acked:    make(chan struct{}),
+	}
+	ua.mu.Lock()
+	ua.calls[callID] = c
+	ua.mu.Unlock()
+
+	offer := string(req.Body)
+	if err := ua.Deliver(callID, "sdp-offer", []byte(offer)); err != nil {
+		log.Warn("Rejecting SIP call %s: %v", callID, err)
+		ua.sendFinalResponse(callID, c, NewResponse(req, 486, "Busy Here"))
+		return
+	}
+	for _, payload := range offerCandidates(offer) {
+		ua.Deliver(callID, "ice-candidate", []byte(payload))
+	}
+	ua.Deliver(callID, "ice-candidate", nil)
+}
+
+// Send a response to a request from addr.
+func (ua *UA) respond(res *Message, addr *net.UDPAddr) {
+	if _, err := ua.conn.WriteToUDP(res.Bytes(), addr); err != nil {
+		log.Warn("Failed to send SIP response: %v", err)
+	}
+}
+
+func (ua *UA) finalResponse(c *call) *Message {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	return c.response
+}
+
+// Send the final response to a call's INVITE, retransmitting it until
+// acknowledged (RFC 3261 Section 13.3.1.4). Unacknowledged calls are dropped.
+func (ua *UA) sendFinalResponse(callID string, c *call, res *Message) {
+	ua.mu.Lock()
+	if c.response != nil {
+		ua.mu.Unlock()
+		return
+	}
+	c.response = res
+	ua.mu.Unlock()
+
+	ua.respond(res, c.addr)
+	go func() {
+		deadline := time.After(transactionTimeout)
+		interval := timerT1
+		for {
+			select {
+			case <-c.acked:
+				if res.StatusCode >= 300 {
+					ua.endCall(callID)
+				}
+				return
+			case <-deadline:
+				log.Warn("SIP call %s not acknowledged", callID)
+				ua.endCall(callID)
+				ua.Hangup(callID)
+				return
+			case <-time.After(interval):
+				ua.respond(res, c.addr)
+			}
+			if interval *= 2; interval > timerT2 {
+				interval = timerT2
+			}
+		}
+	}()
+}
+
+// Forget a call.
+func (ua *UA) endCall(callID string) *call {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	c := ua.calls[callID]
+	delete(ua.calls, callID)
+	if c != nil && c.timer != nil {
+		c.timer.Stop()
+	}
+	return c
+}
+
+// Send takes the SDP answer and local ICE candidates for a call, and answers
+// the call once all candidates are gathered.
+func (ua *UA) Send(callID, what string, payload []byte) error {
+	ua.mu.Lock()
+	c := ua.calls[callID]
+	if c == nil {
+		ua.mu.Unlock()
+		return fmt.Errorf("unknown SIP call: %s", callID)
+	}
+
+	complete := false
+	switch what {
+	case "sdp-answer":
+		c.answer = string(payload)
+		c.timer = time.AfterFunc(gatheringTimeout, func() {
+			log.Warn("ICE gathering timed out, answering SIP call with partial candidates")
+			ua.answer(callID, c, false)
+		})
+	case "ice-candidate":
+		if len(payload) == 0 {
+			complete = c.answer != ""
+		} else {
+			c.candidates = append(c.candidates, string(payload))
+		}
+	default:
+		log.Debug("Ignoring %s for SIP call %s", what, callID)
+	}
+	ua.mu.Unlock()
+
+	if complete {
+		ua.answer(callID, c, true)
+	}
+	return nil
+}
+
+// Answer a call with the SDP answer and the local candidates gathered so far.
+func (ua *UA) answer(callID string, c *call, complete bool) {
+	ua.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	body, err := answerWithCandidates(c.answer, c.candidates, complete)
+	ua.mu.Unlock()
+	if err != nil {
+		log.Warn("Invalid SDP answer for SIP call %s: %v", callID, err)
+		ua.sendFinalResponse(callID, c, NewResponse(c.invite, 500, "Server Internal Error"))
+		return
+	}
+
+	res := NewResponse(c.invite, 200, "OK")
+	res.Set("To", c.invite.Get("To")+";tag="+c.localTag)
+	for _, rr := range c.invite.GetAll("Record-Route") {
+		res.Add("Record-Route", rr)
+	}
+	res.Add("Contact", ua.contact(c.addr))
+	res.Add("Allow", allowedMethods)
+	res.Add("Content-Type", "application/sdp")
+	res.Body = []byte(body)
+	ua.sendFinalResponse(callID, c, res)
+}
+
+// Receive the next message of a call. When the session ends, the call is hung
+// up, if the caller hasn't already.
+func (ua *UA) Receive(ctx context.Context, callID string) (string, []byte, error) {
+	what, payload, err := ua.Demux.Receive(ctx, callID)
+	if err != nil && err != io.EOF {
+		if c := ua.endCall(callID); c != nil {
+			go ua.hangup(c)
+		}
+	}
+	return what, payload, err
+}
+
+// Send BYE for an answered call, or reject an unanswered one.
+func (ua *UA) hangup(c *call) {
+	res := ua.finalResponse(c)
+	if res == nil {
+		ua.sendFinalResponse(c.invite.Get("Call-ID"), c, NewResponse(c.invite, 603, "Decline"))
+		return
+	}
+	if res.StatusCode >= 300 {
+		return
+	}
+
+	// The caller's Contact is the remote target (RFC 3261 Section 12.1.1).
+	target := strings.Trim(c.invite.Get("Contact"), "<>")
+	if i := strings.Index(target, ">"); i >= 0 {
+		target = target[:i]
+	}
+	req := &Message{Method: "BYE", RequestURI: target}
+	for _, rr := range c.invite.GetAll("Record-Route") {
+		req.Add("Route", rr)
+	}
+	req.Add("Max-Forwards", "70")
+	req.Add("From", res.Get("To"))
+	req.Add("To", c.invite.Get("From"))
+	req.Add("Call-ID", c.invite.Get("Call-ID"))
+	req.Add("CSeq", fmt.Sprintf("%d BYE", ua.nextCSeq()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), transactionTimeout)
+	defer cancel()
+	if _, err := ua.request(ctx, req, c.addr); err != nil {
+		log.Warn("SIP BYE failed: %v", err)
+	}
+}
+
+// Close hangs up all calls, unregisters, and stops listening.
+func (ua *UA) Close() error {
+	if ua.conn == nil {
+		return nil
+	}
+	ua.mu.Lock()
+	calls := ua.calls
+	ua.calls = make(map[string]*call)
+	ua.mu.Unlock()
+	for _, c := range calls {
+		ua.hangup(c)
+	}
+
+	if ua.registrar != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := ua.register(ctx, 0); err != nil {
+			log.Debug("SIP unregistration failed: %v", err)
+		}
+		cancel()
+	}
+	ua.cancel()
+	return ua.conn.Close()
+}
+
+// Return the ice-candidate payloads for the candidates in an SDP offer.
+func offerCandidates(offer string) []string {
+	var payloads []string
+	var mid string
+	for _, line := range strings.Split(offer, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = line[len("a=mid:"):]
+		case strings.HasPrefix(line, "a=candidate:"):
+			payloads = append(payloads, fmt.Sprintf("%s\nmid:%s\n", line[2:], mid))
+		}
+	}
+	return payloads
+}
+
+// Write ice-candidate payloads into an SDP answer, in their media sections.
+func answerWithCandidates(answer string, payloads []string, complete bool) (string, error) {
+	s, err := sdp.ParseSession(answer)
+	if err != nil {
+		return "", err
+	}
+	for i := range s.Media {
+		m := &s.Media[i]
+		mid := m.GetAttr("mid")
+		for _, p := range payloads {
+			lines := strings.Split(p, "\n")
+			if len(lines) > 1 && lines[1] == "mid:"+mid {
+				m.Attributes = append(m.Attributes, sdp.Attribute{Key: "candidate", Value: strings.TrimPrefix(lines[0], "candidate:")})
+			}
+		}
+		if complete {
+			m.Attributes = append(m.Attributes, sdp.Attribute{Key: "end-of-candidates"})
+		}
+	}
+	return s.String(), nil
+}
@@ -0,0 +1,277 @@
+package signaling
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/lanikai/alohartc/internal/ice"
+)
+
+// A Transport carries signaling messages between this device and remote
+// peers, e.g. through an MQTT broker. Each call from a remote peer is a
+// session, identified by an ID the transport assigns. Messages have a type
+// and a payload:
+//
+//	sdp-offer, sdp-answer  SDP
+//	ice-candidate          candidate line, then "mid:" and the SDP mid on the
+//	                       next line; empty after the last candidate
+//	command                command name, then its argument on the next line
+type Transport interface {
+	// Connect to the signaling server, and start accepting sessions. Sessions
+	// in progress continue after reconnecting.
+	Connect(ctx context.Context) error
+
+	// WaitForSession blocks until a remote peer starts a new session, and
+	// returns its ID. An error means the connection was lost; the transport is
+	// then closed, and connected again.
+	WaitForSession(ctx context.Context) (string, error)
+
+	// Send a message to the remote peer of a session.
+	Send(sessionID, what string, payload []byte) error
+
+	// Receive blocks until the next message from the remote peer of a session
+	// arrives. Once ctx is done, the session is over, and later messages for
+	// it are dropped.
+	Receive(ctx context.Context, sessionID string) (what string, payload []byte, err error)
+
+	// Close disconnects from the signaling server.
+	Close() error
+}
+
+// Message types exchanged over a Transport.
+const (
+	messageOffer     = "sdp-offer"
+	messageAnswer    = "sdp-answer"
+	messageCandidate = "ice-candidate"
+	messageCommand   = "command"
+)
+
+// Number of commands from a remote peer that may wait to be handled.
+const pendingCommandLimit = 8
+
+// Delays between attempts to connect a Transport, doubling after each failure.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// How long sessions survive their Transport being disconnected. Sessions
+// resume once the transport reconnects, and are ended if it doesn't in time.
+const sessionResumeTimeout = 30 * time.Second
+
+// ServeTransport connects t and listens for incoming calls, invoking handler
+// with a Session for each. The session ends when the handler returns. Blocks
+// until ctx is done.
+func ServeTransport(ctx context.Context, t Transport, handler SessionHandler) error {
+	for s := range Accept(ctx, t) {
+		go func(s *Session) {
+			handler(s)
+			s.Close()
+		}(s)
+	}
+	return nil
+}
+
+// Accept connects t, and returns a channel of incoming sessions, each of which
+// must be closed when finished. If t fails, it is reconnected with jittered
+// exponential backoff. The channel is closed once ctx is done.
+func Accept(ctx context.Context, t Transport) <-chan *Session {
+	return accept(ctx, t, clock.System)
+}
+
+// Accept, timing reconnection and the expiry of sessions with clk.
+func accept(ctx context.Context, t Transport, clk clock.Clock) <-chan *Session {
+	sessions := make(chan *Session)
+	go func() {
+		defer close(sessions)
+
+		sessionCtx, endSessions := context.WithCancel(ctx)
+		var expire *clock.Timer
+		delay := minReconnectDelay
+		for {
+			err := t.Connect(ctx)
+			if err == nil {
+				if expire != nil && !expire.Stop() {
+					// Sessions from before the disconnection have ended.
+					sessionCtx, endSessions = context.WithCancel(ctx)
+				}
+				expire = nil
+				delay = minReconnectDelay
+
+				err = acceptSessions(ctx, sessionCtx, t, sessions)
+				t.Close()
+			}
+			if ctx.Err() != nil {
+				endSessions()
+				return
+			}
+
+			if expire == nil {
+				expire = clk.AfterFunc(sessionResumeTimeout, endSessions)
+			}
+			wait := jitter(delay)
+			log.Warn("Signaling failed, reconnecting in %v: %v", wait.Round(time.Millisecond), err)
+			waited := make(chan struct{})
+			timer := clk.AfterFunc(wait, func() { close(waited) })
+			select {
+			case <-waited:
+			case <-ctx.Done():
+				timer.Stop()
+				endSessions()
+				return
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}()
+	return sessions
+}
+
+// Return a random duration between d/2 and d, so that devices disconnected at
+// the same time don't all reconnect at the same time.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Start sessions for incoming calls over a connected Transport, until it fails
+// or ctx is done.
+func acceptSessions(ctx, sessionCtx context.Context, t Transport, sessions chan<- *Session) error {
+	for {
+		id, err := t.WaitForSession(ctx)
+		if err != nil {
+			return err
+		}
+		s := startTransportSession(sessionCtx, t, id)
+		select {
+		case sessions <- s:
+		case <-ctx.Done():
+			s.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+// Start a session for a call over a Transport, relaying its messages until
+// the session is closed or the remote peer hangs up.
+func startTransportSession(ctx context.Context, t Transport, id string) *Session {
+	ctx, cancel := context.WithCancel(ctx)
+
+	offerCh := make(chan string)
+	rcandCh := make(chan ice.Candidate)
+	commandCh := make(chan Command, pendingCommandLimit)
+	session := &Session{
+		Context:          ctx,
+		Offer:            offerCh,
+		RemoteCandidates: rcandCh,
+		Commands:         commandCh,
+		SendAnswer: func(sdp string) error {
+			return t.Send(id, messageAnswer, []byte(sdp))
+		},
+		SendLocalCandidate: func(c *ice.Candidate) error {
+			var payload bytes.Buffer
+			if c != nil {
+				fmt.Fprintf(&payload, "%s\nmid:%s\n", c.String(), c.Mid())
+			}
+			return t.Send(id, messageCandidate, payload.Bytes())
+		},
+		cancel: cancel,
+	}
+
+	go func() {
+		defer cancel()
+
+		candidatesDone := false
+		for {
+			what, payload, err := t.Receive(ctx, id)
+			if err != nil {
+				if err == io.EOF {
+					log.Debug("Remote peer hung up signaling session %s", id)
+				} else if ctx.Err() == nil {
+					log.Warn("Signaling session %s failed: %v", id, err)
+				}
+				return
+			}
+
+			switch what {
+			case messageOffer:
+				select {
+				case offerCh <- string(payload):
+				case <-ctx.Done():
+					return
+				}
+			case messageCandidate:
+				if candidatesDone {
+					break
+				}
+				if len(payload) == 0 {
+					// An empty candidate indicates the end of ICE trickling.
+					close(rcandCh)
+					candidatesDone = true
+					break
+				}
+				c, ok := parseCandidateMessage(string(payload))
+				if !ok {
+					break
+				}
+				select {
+				case rcandCh <- c:
+				case <-ctx.Done():
+					return
+				}
+			case messageCommand:
+				name, arg := splitLine(string(payload))
+				select {
+				case commandCh <- Command{Name: name, Arg: arg}:
+				default:
+					log.Warn("Dropping command %q: too many pending", name)
+				}
+			default:
+				log.Warn("Unrecognized signaling message type: %s", what)
+			}
+		}
+	}()
+
+	return session
+}
+
+// Split s at the first newline.
+func splitLine(s string) (first, rest string) {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// Parse an "ice-candidate" payload, consisting of the candidate line followed
+// by a "mid:" line.
+func parseCandidateMessage(body string) (c ice.Candidate, ok bool) {
+	var desc, sdpMid string
+	for _, line := range strings.Split(body, "\n") {
+		if line == "" {
+			continue
+		} else if strings.HasPrefix(line, "candidate:") {
+			desc = line
+		} else if strings.HasPrefix(line, "mid:") {
+			sdpMid = line[4:]
+		} else {
+			log.Warn("Invalid 'ice-candidate' payload: %q", body)
+		}
+	}
+	if desc == "" {
+		log.Debug("Empty ICE candidate: sdpMid = %s", sdpMid)
+		return
+	}
+	c, err := ice.ParseCandidate(desc, sdpMid)
+	if err != nil {
+		log.Warn("Invalid ICE candidate (%q, %q): %v", desc, sdpMid, err)
+		return
+	}
+	return c, true
+}
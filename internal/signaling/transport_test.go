@@ -0,0 +1,152 @@
+package signaling
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/clock"
+	"github.com/lanikai/alohartc/internal/signaling/demux"
+)
+
+// A Transport whose connection attempts succeed or fail as the test decides.
+type fakeTransport struct {
+	*demux.Demux
+
+	// Result of each call to Connect.
+	connect chan error
+
+	mu     sync.Mutex
+	closed int
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		Demux:   demux.New(),
+		connect: make(chan error),
+	}
+}
+
+func (t *fakeTransport) Connect(ctx context.Context) error {
+	select {
+	case err := <-t.connect:
+		if err == nil {
+			t.Connected()
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *fakeTransport) Send(sessionID, what string, payload []byte) error {
+	return nil
+}
+
+func (t *fakeTransport) Close() error {
+	t.mu.Lock()
+	t.closed++
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *fakeTransport) closeCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// Start a session with an offer, and return it once Accept does.
+func startFakeSession(t *testing.T, ft *fakeTransport, sessions <-chan *Session, id string) *Session {
+	if err := ft.Deliver(id, messageOffer, []byte("v=0")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-sessions:
+		if offer := <-s.Offer; offer != "v=0" {
+			t.Fatalf("got offer %q, expected %q", offer, "v=0")
+		}
+		return s
+	case <-time.After(time.Second):
+		t.Fatalf("session %s not accepted", id)
+		return nil
+	}
+}
+
+func TestAcceptResumesSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := clock.NewFake(time.Unix(0, 0))
+	ft := newFakeTransport()
+	sessions := accept(ctx, ft, clk)
+
+	ft.connect <- nil
+	s := startFakeSession(t, ft, sessions, "a")
+
+	// Losing the connection closes the transport, and reconnects it after a
+	// delay, while the session waits.
+	ft.Disconnected(errors.New("connection lost"))
+	clk.WaitForTimers(2)
+	if n := ft.closeCount(); n != 1 {
+		t.Errorf("transport closed %d times, expected once", n)
+	}
+	clk.Advance(minReconnectDelay)
+	ft.connect <- nil
+
+	// New sessions are accepted once reconnected, and the old one survives
+	// past the resume timeout.
+	startFakeSession(t, ft, sessions, "b")
+	clk.Advance(sessionResumeTimeout)
+	if err := s.Context.Err(); err != nil {
+		t.Errorf("session ended after reconnecting: %v", err)
+	}
+
+	cancel()
+	for range sessions {
+	}
+	if err := s.Context.Err(); err == nil {
+		t.Error("session not ended after Accept stopped")
+	}
+}
+
+func TestAcceptExpiresSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := clock.NewFake(time.Unix(0, 0))
+	ft := newFakeTransport()
+	sessions := accept(ctx, ft, clk)
+
+	ft.connect <- nil
+	s := startFakeSession(t, ft, sessions, "a")
+
+	// Failing to reconnect backs off, and the session lasts until the resume
+	// timeout.
+	ft.Disconnected(errors.New("connection lost"))
+	clk.WaitForTimers(2)
+	clk.Advance(minReconnectDelay)
+	ft.connect <- errors.New("connection refused")
+	clk.WaitForTimers(2)
+	if err := s.Context.Err(); err != nil {
+		t.Fatalf("session ended before the resume timeout: %v", err)
+	}
+
+	clk.Advance(sessionResumeTimeout)
+	select {
+	case <-s.Context.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session not ended after the resume timeout")
+	}
+
+	// Sessions started after reconnecting aren't affected.
+	ft.connect <- nil
+	s = startFakeSession(t, ft, sessions, "b")
+	if err := s.Context.Err(); err != nil {
+		t.Errorf("new session ended: %v", err)
+	}
+
+	cancel()
+	for range sessions {
+	}
+}
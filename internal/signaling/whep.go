@@ -0,0 +1,325 @@
+package signaling
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+const (
+	// Largest SDP offer accepted from a viewer.
+	maxWHEPOfferSize = 64 * 1024
+
+	// How long to wait for local ICE candidates before answering with those
+	// gathered so far. Candidates gathered later are dropped.
+	whepGatheringTimeout = 5 * time.Second
+)
+
+// WHEPHandler is an http.Handler implementing WHEP, the WebRTC-HTTP Egress
+// Protocol (draft-murillo-whep). A viewer POSTs an SDP offer to the endpoint,
+// and receives an SDP answer that already includes the device's ICE
+// candidates, so no other signaling channel is needed. Each call is a resource
+// under the endpoint (its Location), to which the viewer may PATCH trickled
+// ICE candidates (RFC 8840), and which the viewer DELETEs to hang up.
+//
+// When mounted on an http.ServeMux, register both the endpoint and the
+// endpoint with a trailing slash, e.g. "/whep" and "/whep/".
+type WHEPHandler struct {
+	handle SessionHandler
+
+	mu       sync.Mutex
+	sessions map[string]*whepSession
+}
+
+// A WHEP call in progress.
+type whepSession struct {
+	cancel context.CancelFunc
+	ctx    context.Context
+
+	// Guards sending to and closing rcand.
+	mu          sync.Mutex
+	rcand       chan ice.Candidate
+	rcandClosed bool
+}
+
+// NewWHEPHandler returns a WHEPHandler that invokes handle with a Session for
+// each call.
+func NewWHEPHandler(handle SessionHandler) *WHEPHandler {
+	return &WHEPHandler{
+		handle:   handle,
+		sessions: make(map[string]*whepSession),
+	}
+}
+
+func (h *WHEPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		h.serveOffer(w, r)
+	case http.MethodPatch:
+		h.serveTrickle(w, r)
+	case http.MethodDelete:
+		s := h.session(r)
+		if s == nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.cancel()
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, POST, PATCH, DELETE")
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Start a call, and respond with the SDP answer.
+func (h *WHEPHandler) serveOffer(w http.ResponseWriter, r *http.Request) {
+	if !hasContentType(r, "application/sdp") {
+		http.Error(w, "expected application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWHEPOfferSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(offer) > maxWHEPOfferSize {
+		http.Error(w, "offer too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &whepSession{
+		cancel: cancel,
+		ctx:    ctx,
+		rcand:  make(chan ice.Candidate),
+	}
+
+	offerCh := make(chan string, 1)
+	offerCh <- string(offer)
+	answerCh := make(chan string, 1)
+
+	// Collect local candidates until gathering completes or times out.
+	var mu sync.Mutex
+	var lcands []ice.Candidate
+	gathered := make(chan struct{})
+	final := false // set once the candidates in the answer are final
+
+	session := &Session{
+		Context:          ctx,
+		Offer:            offerCh,
+		RemoteCandidates: s.rcand,
+		SendAnswer: func(sdp string) error {
+			select {
+			case answerCh <- sdp:
+				return nil
+			default:
+				return errors.New("answer already sent")
+			}
+		},
+		SendLocalCandidate: func(c *ice.Candidate) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if final {
+				log.Debug("Dropping ICE candidate gathered after WHEP answer: %v", c)
+			} else if c == nil {
+				close(gathered)
+				final = true
+			} else {
+				lcands = append(lcands, *c)
+			}
+			return nil
+		},
+		cancel: cancel,
+	}
+
+	id := newWHEPSessionID()
+	h.mu.Lock()
+	h.sessions[id] = s
+	h.mu.Unlock()
+
+	go func() {
+		h.handle(session)
+		cancel()
+		s.closeRemoteCandidates()
+
+		h.mu.Lock()
+		delete(h.sessions, id)
+		h.mu.Unlock()
+	}()
+
+	// Pass along the candidates in the offer, if any.
+	go func() {
+		cands, end := parseSDPCandidates(string(offer))
+		s.addRemoteCandidates(cands, end)
+	}()
+
+	var answer string
+	select {
+	case answer = <-answerCh:
+	case <-ctx.Done():
+		http.Error(w, "call failed", http.StatusInternalServerError)
+		return
+	case <-r.Context().Done():
+		cancel()
+		return
+	}
+
+	timer := time.NewTimer(whepGatheringTimeout)
+	defer timer.Stop()
+	select {
+	case <-gathered:
+	case <-timer.C:
+		log.Warn("ICE gathering timed out, answering WHEP offer with partial candidates")
+	case <-ctx.Done():
+		http.Error(w, "call failed", http.StatusInternalServerError)
+		return
+	}
+
+	mu.Lock()
+	complete := final
+	final = true
+	cands := lcands
+	mu.Unlock()
+
+	answer, err = addSDPCandidates(answer, cands, complete)
+	if err != nil {
+		cancel()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// Pass trickled remote candidates to a call in progress.
+func (h *WHEPHandler) serveTrickle(w http.ResponseWriter, r *http.Request) {
+	s := h.session(r)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !hasContentType(r, "application/trickle-ice-sdpfrag") {
+		http.Error(w, "expected application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		return
+	}
+	frag, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWHEPOfferSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cands, end := parseSDPCandidates(string(frag))
+	go s.addRemoteCandidates(cands, end)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Return the call named by the last element of the request path.
+func (h *WHEPHandler) session(r *http.Request) *whepSession {
+	id := path.Base(r.URL.Path)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sessions[id]
+}
+
+func (s *whepSession) addRemoteCandidates(cands []ice.Candidate, end bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rcandClosed {
+		return
+	}
+	for _, c := range cands {
+		select {
+		case s.rcand <- c:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+	if end {
+		close(s.rcand)
+		s.rcandClosed = true
+	}
+}
+
+func (s *whepSession) closeRemoteCandidates() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.rcandClosed {
+		close(s.rcand)
+		s.rcandClosed = true
+	}
+}
+
+// Parse the candidates in an SDP offer or fragment, and report whether it
+// marks the end of candidates.
+func parseSDPCandidates(text string) (cands []ice.Candidate, end bool) {
+	var mid string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			mid = ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = line[len("a=mid:"):]
+		case strings.HasPrefix(line, "a=candidate:"):
+			if c, ok := parseCandidateMessage(line[2:] + "\nmid:" + mid); ok {
+				cands = append(cands, c)
+			}
+		case line == "a=end-of-candidates":
+			end = true
+		}
+	}
+	return
+}
+
+// Write local candidates into an SDP answer, in their media sections.
+func addSDPCandidates(answer string, cands []ice.Candidate, complete bool) (string, error) {
+	s, err := sdp.ParseSession(answer)
+	if err != nil {
+		return "", err
+	}
+	for i := range s.Media {
+		m := &s.Media[i]
+		mid := m.GetAttr("mid")
+		for _, c := range cands {
+			if c.Mid() == mid {
+				m.Attributes = append(m.Attributes, sdp.Attribute{Key: "candidate", Value: strings.TrimPrefix(c.String(), "candidate:")})
+			}
+		}
+		if complete {
+			m.Attributes = append(m.Attributes, sdp.Attribute{Key: "end-of-candidates"})
+		}
+	}
+	return s.String(), nil
+}
+
+func hasContentType(r *http.Request, want string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == want
+}
+
+// Return a random, unguessable session ID.
+func newWHEPSessionID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
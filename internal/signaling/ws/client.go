@@ -0,0 +1,192 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/lanikai/alohartc/internal/proxy"
+	"github.com/lanikai/alohartc/internal/signaling/demux"
+)
+
+// Delays between attempts to reconnect, doubling after each failure.
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+var errNotConnected = errors.New("not connected to signaling server")
+
+// A Client is a peer in a room on a signaling Server, e.g. a device answering
+// calls from the room's viewers. Its Transport sessions are the other peers
+// in the room that send it messages. If the connection drops, the client
+// reconnects with exponential backoff until closed.
+type Client struct {
+	// WebSocket URL of the server, e.g. "wss://example.com/ws".
+	URL string
+
+	// Room to join.
+	Room string
+
+	// Proxy, if non-nil, is the URL of an HTTP or SOCKS5 proxy through which
+	// to connect. Otherwise the HTTPS_PROXY environment variable is used.
+	Proxy *url.URL
+
+	// Incoming messages, sorted by sending peer.
+	*demux.Demux
+
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	cancel context.CancelFunc
+}
+
+func NewClient(serverURL, room string) *Client {
+	return &Client{
+		URL:   serverURL,
+		Room:  room,
+		Demux: demux.New(),
+	}
+}
+
+// Connect to the server. Fails only if the first attempt does; later
+// disconnections are retried in the background, until ctx is done or the
+// client is closed.
+func (c *Client) Connect(ctx context.Context) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.conn = conn
+	c.cancel = cancel
+	c.mu.Unlock()
+
+	go c.run(ctx, conn)
+	return nil
+}
+
+func (c *Client) dial() (*websocket.Conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("room", c.Room)
+	u.RawQuery = q.Encode()
+
+	dialer := websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			p := c.Proxy
+			if p == nil {
+				var err error
+				if p, err = proxy.FromEnvironment(addr); err != nil {
+					return nil, err
+				}
+			}
+			return proxy.Dial(context.Background(), nil, p, addr)
+		},
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+	}
+	conn, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(maxMessageSize)
+	return conn, nil
+}
+
+// Read messages until ctx is done, reconnecting as necessary.
+func (c *Client) run(ctx context.Context, conn *websocket.Conn) {
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.mu.Unlock()
+	}()
+
+	delay := minReconnectDelay
+	for {
+		c.read(conn)
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+
+		// Reconnect, backing off exponentially.
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			var err error
+			if conn, err = c.dial(); err == nil {
+				break
+			}
+			log.Warn("Failed to reconnect to %s: %v", c.URL, err)
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+		log.Info("Reconnected to %s", c.URL)
+		delay = minReconnectDelay
+
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+		if ctx.Err() != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Read messages from conn until it fails.
+func (c *Client) read(conn *websocket.Conn) {
+	defer conn.Close()
+	for {
+		var m Message
+		if err := conn.ReadJSON(&m); err != nil {
+			log.Debug("Disconnected from %s: %v", c.URL, err)
+			return
+		}
+		deliverToDemux(c.Demux, m)
+	}
+}
+
+func (c *Client) Send(sessionID, what string, payload []byte) error {
+	m, err := fromTransport(what, payload)
+	if err != nil {
+		return err
+	}
+	m.To = sessionID
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return errNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteJSON(m)
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	cancel := c.cancel
+	c.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
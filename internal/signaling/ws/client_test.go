@@ -0,0 +1,58 @@
+package ws
+
+import (
+	"context"
+	"testing"
+)
+
+func TestClientReconnects(t *testing.T) {
+	s, u, stop := startServer()
+	defer stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := NewClient(u, "garage")
+	if err := client.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A viewer joining the room calls the client.
+	viewer := dialRoom(t, u, "garage")
+	defer viewer.Close()
+	if err := viewer.WriteJSON(Message{Type: TypeOffer, SDP: "v=0"}); err != nil {
+		t.Fatal(err)
+	}
+	viewerID, err := client.WaitForSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if what, payload, err := client.Receive(ctx, viewerID); err != nil || what != "sdp-offer" || string(payload) != "v=0" {
+		t.Fatalf("got %s %q, %v; expected the offer", what, payload, err)
+	}
+	if err := client.Send(viewerID, "sdp-answer", []byte("v=1")); err != nil {
+		t.Fatal(err)
+	}
+	clientID := expectMessage(t, viewer, TypeAnswer, "").From
+
+	// Drop the client's connection on the server side.
+	s.mu.Lock()
+	s.rooms["garage"][clientID].(*connMember).conn.Close()
+	s.mu.Unlock()
+	if m := expectMessage(t, viewer, TypePeerLeft, ""); m.Peer != clientID {
+		t.Fatalf("viewer told %s left, expected %s", m.Peer, clientID)
+	}
+
+	// The client rejoins the room, and the session carries on.
+	clientID = expectMessage(t, viewer, TypePeerJoined, "").Peer
+	if err := viewer.WriteJSON(Message{Type: TypeCommand, To: clientID, Name: "zoom", Arg: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if what, payload, err := client.Receive(ctx, viewerID); err != nil || what != "command" || string(payload) != "zoom\n2" {
+		t.Fatalf("got %s %q, %v; expected the command", what, payload, err)
+	}
+	if err := client.Send(viewerID, "ice-candidate", nil); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, viewer, TypeICECandidate, clientID)
+}
@@ -0,0 +1,7 @@
+package ws
+
+import (
+	"github.com/lanikai/alohartc/internal/logging"
+)
+
+var log = logging.DefaultLogger.WithTag("ws")
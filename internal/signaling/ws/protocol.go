@@ -0,0 +1,93 @@
+// Package ws implements WebSocket signaling: a server that relays messages
+// between the peers in named rooms, and a client for devices that answer calls
+// through such a server. Both the client and the server's in-process peers
+// implement signaling.Transport.
+package ws
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Message is a JSON object exchanged over a signaling WebSocket:
+//
+//	{ "type": "offer", "sdp": "..." }
+//	{ "type": "answer", "sdp": "..." }
+//	{ "type": "iceCandidate", "candidate": "...", "sdpMid": "..." }
+//	{ "type": "command", "name": "...", "arg": "..." }
+//
+// An iceCandidate message without a candidate marks the end of candidates.
+// The server sets "from" on relayed messages to the sender's peer ID, and
+// delivers a message with "to" only to that peer, or else to every other peer
+// in the room. It also announces peers joining and leaving the room:
+//
+//	{ "type": "peerJoined", "peer": "..." }
+//	{ "type": "peerLeft", "peer": "..." }
+type Message struct {
+	Type string `json:"type"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+
+	SDP       string `json:"sdp,omitempty"`
+	Candidate string `json:"candidate,omitempty"`
+	SDPMid    string `json:"sdpMid,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arg       string `json:"arg,omitempty"`
+	Peer      string `json:"peer,omitempty"`
+}
+
+// Message types.
+const (
+	TypeOffer        = "offer"
+	TypeAnswer       = "answer"
+	TypeICECandidate = "iceCandidate"
+	TypeCommand      = "command"
+	TypePeerJoined   = "peerJoined"
+	TypePeerLeft     = "peerLeft"
+)
+
+// Convert a relayed message to a signaling.Transport message. ok is false for
+// messages that aren't part of a call.
+func toTransport(m Message) (what string, payload []byte, ok bool) {
+	switch m.Type {
+	case TypeOffer:
+		return "sdp-offer", []byte(m.SDP), true
+	case TypeAnswer:
+		return "sdp-answer", []byte(m.SDP), true
+	case TypeICECandidate:
+		if m.Candidate == "" {
+			return "ice-candidate", nil, true
+		}
+		return "ice-candidate", []byte(fmt.Sprintf("%s\nmid:%s\n", m.Candidate, m.SDPMid)), true
+	case TypeCommand:
+		return "command", []byte(m.Name + "\n" + m.Arg), true
+	}
+	return "", nil, false
+}
+
+// Convert a signaling.Transport message to a Message.
+func fromTransport(what string, payload []byte) (Message, error) {
+	switch what {
+	case "sdp-offer":
+		return Message{Type: TypeOffer, SDP: string(payload)}, nil
+	case "sdp-answer":
+		return Message{Type: TypeAnswer, SDP: string(payload)}, nil
+	case "ice-candidate":
+		m := Message{Type: TypeICECandidate}
+		for _, line := range strings.Split(string(payload), "\n") {
+			if strings.HasPrefix(line, "mid:") {
+				m.SDPMid = line[4:]
+			} else if line != "" {
+				m.Candidate = line
+			}
+		}
+		return m, nil
+	case "command":
+		m := Message{Type: TypeCommand, Name: string(payload)}
+		if i := strings.IndexByte(m.Name, '\n'); i >= 0 {
+			m.Name, m.Arg = m.Name[:i], m.Name[i+1:]
+		}
+		return m, nil
+	}
+	return Message{}, fmt.Errorf("unsupported message type: %s", what)
+}
@@ -0,0 +1,257 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/lanikai/alohartc/internal/signaling/demux"
+)
+
+const (
+	// Largest message accepted from a peer. SDP offers are the largest
+	// messages, and are rarely more than a few kilobytes.
+	maxMessageSize = 128 * 1024
+
+	// Time allowed to write a message to a peer.
+	writeTimeout = 10 * time.Second
+
+	// Number of messages that may wait to be written to a peer. A peer that
+	// falls further behind is disconnected, rather than holding up the room.
+	sendQueueLength = 64
+)
+
+// A Server relays signaling messages between the peers in each room. Peers
+// connect with a WebSocket, naming their room with the "room" query parameter
+// (e.g. /ws?room=garage), or are attached in-process. Rooms exist for as long
+// as they have peers.
+type Server struct {
+	// CheckOrigin decides whether to accept a WebSocket from the origin of a
+	// request. By default, only same-origin requests are accepted.
+	CheckOrigin func(r *http.Request) bool
+
+	mu    sync.Mutex
+	rooms map[string]map[string]member
+}
+
+// A member of a room receives the messages relayed to it.
+type member interface {
+	deliver(m Message)
+}
+
+func NewServer() *Server {
+	return &Server{
+		rooms: make(map[string]map[string]member),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: s.CheckOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Warn("upgrade: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxMessageSize)
+
+	member := newConnMember(conn)
+	go member.writeLoop()
+	defer close(member.done)
+
+	room := r.URL.Query().Get("room")
+	id := s.join(room, member)
+	defer s.leave(room, id)
+
+	for {
+		var m Message
+		if err := conn.ReadJSON(&m); err != nil {
+			log.Debug("Peer %s left room %q: %v", id, room, err)
+			return
+		}
+		m.From = id
+		s.relay(room, m)
+	}
+}
+
+// Add a member to a room, and return its peer ID.
+func (s *Server) join(room string, m member) string {
+	id := newPeerID()
+
+	s.mu.Lock()
+	peers := s.rooms[room]
+	if peers == nil {
+		peers = make(map[string]member)
+		s.rooms[room] = peers
+	}
+	peers[id] = m
+	s.mu.Unlock()
+
+	log.Debug("Peer %s joined room %q", id, room)
+	s.relay(room, Message{Type: TypePeerJoined, From: id, Peer: id})
+	return id
+}
+
+func (s *Server) leave(room, id string) {
+	s.mu.Lock()
+	peers := s.rooms[room]
+	delete(peers, id)
+	if len(peers) == 0 {
+		delete(s.rooms, room)
+	}
+	s.mu.Unlock()
+
+	s.relay(room, Message{Type: TypePeerLeft, From: id, Peer: id})
+}
+
+// Deliver a message to its recipient, or to every other peer in the room.
+func (s *Server) relay(room string, m Message) {
+	var recipients []member
+	s.mu.Lock()
+	for id, peer := range s.rooms[room] {
+		if (m.To == "" && id != m.From) || id == m.To {
+			recipients = append(recipients, peer)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(recipients) == 0 && m.To != "" {
+		log.Debug("Dropping %s for unknown peer %s in room %q", m.Type, m.To, room)
+	}
+	for _, peer := range recipients {
+		peer.deliver(m)
+	}
+}
+
+// Return a random peer ID.
+func newPeerID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// A room member connected by WebSocket. Messages are queued for a goroutine
+// that writes them, so that relaying doesn't wait for slow peers.
+type connMember struct {
+	conn *websocket.Conn
+
+	// Messages waiting to be written.
+	send chan Message
+
+	// Closed once the member has left its room.
+	done chan struct{}
+}
+
+func newConnMember(conn *websocket.Conn) *connMember {
+	return &connMember{
+		conn: conn,
+		send: make(chan Message, sendQueueLength),
+		done: make(chan struct{}),
+	}
+}
+
+func (c *connMember) deliver(m Message) {
+	select {
+	case c.send <- m:
+	case <-c.done:
+	default:
+		// The read loop will fail too, and remove the member from its room.
+		log.Debug("Disconnecting peer: too many messages queued")
+		c.conn.Close()
+	}
+}
+
+// Write queued messages until the member leaves, or a write fails.
+func (c *connMember) writeLoop() {
+	for {
+		select {
+		case m := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteJSON(m); err != nil {
+				// The read loop will fail too, and remove the member from
+				// its room.
+				log.Debug("Failed to write to peer: %v", err)
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Attach returns a peer in the given room that runs in this process, e.g. a
+// device that serves its own signaling page. Its Transport sessions are the
+// other peers in the room that send it messages. It joins the room on Connect,
+// and leaves on Close.
+func (s *Server) Attach(room string) *LocalPeer {
+	return &LocalPeer{
+		server: s,
+		room:   room,
+		Demux:  demux.New(),
+	}
+}
+
+// A LocalPeer is a room member in the server's own process.
+type LocalPeer struct {
+	server *Server
+	room   string
+	id     string
+
+	// Incoming messages, sorted by sending peer.
+	*demux.Demux
+}
+
+func (p *LocalPeer) Connect(ctx context.Context) error {
+	if p.id != "" {
+		return errors.New("already connected")
+	}
+	p.id = p.server.join(p.room, p)
+	return nil
+}
+
+func (p *LocalPeer) deliver(m Message) {
+	deliverToDemux(p.Demux, m)
+}
+
+func (p *LocalPeer) Send(sessionID, what string, payload []byte) error {
+	m, err := fromTransport(what, payload)
+	if err != nil {
+		return err
+	}
+	m.From = p.id
+	m.To = sessionID
+	p.server.relay(p.room, m)
+	return nil
+}
+
+func (p *LocalPeer) Close() error {
+	if p.id != "" {
+		p.server.leave(p.room, p.id)
+		p.id = ""
+	}
+	return nil
+}
+
+// Sort a message from another peer into that peer's session.
+func deliverToDemux(d *demux.Demux, m Message) {
+	if m.Type == TypePeerLeft {
+		d.Hangup(m.Peer)
+		return
+	}
+	what, payload, ok := toTransport(m)
+	if !ok {
+		return
+	}
+	if err := d.Deliver(m.From, what, payload); err != nil {
+		log.Warn("Dropping %s from peer %s: %v", m.Type, m.From, err)
+	}
+}
@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Start a server, and return its WebSocket URL.
+func startServer() (*Server, string, func()) {
+	s := NewServer()
+	hs := httptest.NewServer(s)
+	return s, "ws" + strings.TrimPrefix(hs.URL, "http"), hs.Close
+}
+
+// Connect a peer to a room.
+func dialRoom(t *testing.T, serverURL, room string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(serverURL+"?room="+room, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// Read the next message relayed to a peer.
+func readMessage(t *testing.T, conn *websocket.Conn) Message {
+	var m Message
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func expectMessage(t *testing.T, conn *websocket.Conn, typ, from string) Message {
+	m := readMessage(t, conn)
+	if m.Type != typ || (from != "" && m.From != from) {
+		t.Fatalf("got %+v, expected %s from %q", m, typ, from)
+	}
+	return m
+}
+
+func TestServerRooms(t *testing.T) {
+	_, u, stop := startServer()
+	defer stop()
+
+	a := dialRoom(t, u, "garage")
+	defer a.Close()
+	b := dialRoom(t, u, "garage")
+	defer b.Close()
+	other := dialRoom(t, u, "porch")
+	defer other.Close()
+
+	// Peers already in the room are told of those joining.
+	bID := expectMessage(t, a, TypePeerJoined, "").Peer
+	c := dialRoom(t, u, "garage")
+	cID := expectMessage(t, a, TypePeerJoined, "").Peer
+	if m := expectMessage(t, b, TypePeerJoined, ""); m.Peer != cID {
+		t.Errorf("b told %s joined, expected %s", m.Peer, cID)
+	}
+
+	// A directed message reaches only its recipient, with the sender set.
+	if err := a.WriteJSON(Message{Type: TypeOffer, To: bID, SDP: "v=0"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := expectMessage(t, b, TypeOffer, ""); m.SDP != "v=0" || m.To != bID || m.From == "" {
+		t.Errorf("b got %+v", m)
+	}
+
+	// A broadcast reaches every other peer in the room, but not the sender.
+	if err := c.WriteJSON(Message{Type: TypeCommand, Name: "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, a, TypeCommand, cID)
+	if m := expectMessage(t, b, TypeCommand, cID); m.Name != "ping" {
+		t.Errorf("b got %+v", m)
+	}
+
+	// c didn't see a's offer to b: its next message is b's broadcast.
+	if err := b.WriteJSON(Message{Type: TypeCommand, Name: "pong"}); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, c, TypeCommand, bID)
+	expectMessage(t, a, TypeCommand, bID)
+
+	// Leaving is announced to the peers remaining.
+	c.Close()
+	if m := expectMessage(t, a, TypePeerLeft, ""); m.Peer != cID {
+		t.Errorf("a told %s left, expected %s", m.Peer, cID)
+	}
+	if m := expectMessage(t, b, TypePeerLeft, ""); m.Peer != cID {
+		t.Errorf("b told %s left, expected %s", m.Peer, cID)
+	}
+
+	// Nothing crossed into the other room.
+	var stray Message
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := other.ReadJSON(&stray); err == nil {
+		t.Errorf("peer in another room got %+v", stray)
+	}
+}
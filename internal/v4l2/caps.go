@@ -0,0 +1,84 @@
+package v4l2
+
+// Format returns the device's format with the given FourCC code, or nil.
+func (caps *DeviceCaps) Format(pixelFormat int) *Format {
+	for i := range caps.Formats {
+		if caps.Formats[i].PixelFormat == pixelFormat {
+			return &caps.Formats[i]
+		}
+	}
+	return nil
+}
+
+// Supports reports whether the format can capture frames of the given size.
+func (f *Format) Supports(width, height int) bool {
+	for _, s := range f.Sizes {
+		if s.contains(width, height) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClosestSize returns the supported frame size closest to width x height. ok
+// is false if the format lists no sizes.
+func (f *Format) ClosestSize(width, height int) (w, h int, ok bool) {
+	best := -1
+	for _, s := range f.Sizes {
+		sw, sh := s.closest(width, height)
+		d := abs(sw-width) + abs(sh-height)
+		if best < 0 || d < best {
+			w, h, best = sw, sh, d
+		}
+	}
+	return w, h, best >= 0
+}
+
+func (s *FrameSize) contains(width, height int) bool {
+	w, h := s.closest(width, height)
+	return w == width && h == height
+}
+
+// Return the size in the range closest to width x height.
+func (s *FrameSize) closest(width, height int) (w, h int) {
+	if s.MaxWidth == 0 || s.MaxHeight == 0 {
+		return s.Width, s.Height
+	}
+	return clampStep(width, s.Width, s.MaxWidth, s.StepWidth),
+		clampStep(height, s.Height, s.MaxHeight, s.StepHeight)
+}
+
+// Clamp x to [min, max], and round it to the nearest multiple of step above
+// min.
+func clampStep(x, min, max, step int) int {
+	if x <= min {
+		return min
+	}
+	if x >= max {
+		return max
+	}
+	if step > 1 {
+		x = min + (x-min+step/2)/step*step
+		if x > max {
+			x -= step
+		}
+	}
+	return x
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// FourCC returns the four-character code of a pixel format, e.g. "H264".
+func FourCC(pixelFormat int) string {
+	return string([]byte{
+		byte(pixelFormat),
+		byte(pixelFormat >> 8),
+		byte(pixelFormat >> 16),
+		byte(pixelFormat >> 24),
+	})
+}
@@ -1,5 +1,10 @@
 package v4l2
 
+import (
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/raw"
+)
+
 type Config struct {
 	Format int // Video format (e.g. H264)
 	Width  int // Video width in pixels
@@ -7,8 +12,127 @@ type Config struct {
 
 	Bitrate int
 
+	// Capture frame rate, in frames per second. If zero, the driver default
+	// is used.
+	FrameRate int
+
+	// Number of kernel driver buffers. While one frame is being read, the
+	// driver can keep capturing into the others. If zero, 4 buffers are
+	// used.
+	NumBuffers int
+
 	// Repeat sequence headers (i.e. sequence/picture parameter sets) for
 	// H.264 pixel format. This is useful for resynchronization in cases
 	// where the parameter sets are lost.
 	RepeatSequenceHeader bool
+
+	// Number of frames between H.264 IDR pictures. A short interval lets the
+	// receiver recover from packet loss sooner, at the cost of bitrate. If
+	// zero, the driver default is used.
+	KeyframeInterval int
+
+	// Disable B-frames, which add at least one frame of encoder latency, if
+	// the driver has the control.
+	DisableBFrames bool
+
+	// H.264 profile and level, the latter as ten times the level number,
+	// e.g. 41 for level 4.1. If the level is zero, the driver defaults are
+	// used.
+	H264Profile media.H264Profile
+	H264Level   int
+
+	// Constant or variable bitrate encoding. Defaults to variable.
+	BitrateMode media.BitrateMode
+
+	// Path of a memory-to-memory encoder device, e.g. "/dev/video11" for
+	// bcm2835-codec on the Raspberry Pi 4. If set, raw frames are captured
+	// in RawFormat and encoded in Format by this device, and the codec
+	// settings apply to it.
+	Encoder string
+
+	// Raw pixel format captured for Encoder. Defaults to YUV420.
+	RawFormat int
+
+	// Flip the picture. If the camera has no flip controls, frames are
+	// flipped in software, which requires raw capture in YUV420 for
+	// Encoder.
+	HorizontalFlip bool
+	VerticalFlip   bool
+
+	// Transforms applied in software to raw frames before encoding, e.g. to
+	// crop them or burn in a timestamp. Requires raw capture in YUV420 for
+	// Encoder. Width and Height are the size captured; the encoded size is
+	// that output by the transforms.
+	Transforms []raw.Transform
+}
+
+// EncoderConfig describes the frames given to an Encoder, and how to encode
+// them as H.264.
+type EncoderConfig struct {
+	Width  int // Frame width in pixels
+	Height int // Frame height in pixels
+
+	// Rate at which frames are given, in frames per second, which guides
+	// rate control. If zero, the driver default is used.
+	FrameRate int
+
+	// Encoder bitrate, in bits per second. If zero, the driver default is
+	// used.
+	Bitrate int
+
+	// Number of frames between IDR pictures. If zero, the driver default is
+	// used.
+	KeyframeInterval int
+}
+
+// DeviceInfo describes a video capture device.
+type DeviceInfo struct {
+	// Device path, e.g. "/dev/video0".
+	Path string
+
+	// Name of the device, e.g. "mmal service 16.1".
+	Name string
+
+	// Name of the driver, e.g. "bm2835 mmal".
+	Driver string
+}
+
+// DeviceCaps lists the formats a video capture device supports.
+type DeviceCaps struct {
+	DeviceInfo
+
+	Formats []Format
+}
+
+// A Format is a pixel format supported by a device, with its frame sizes.
+type Format struct {
+	// FourCC code, e.g. V4L2_PIX_FMT_H264.
+	PixelFormat int
+
+	// Description from the driver, e.g. "H.264".
+	Description string
+
+	// True for compressed formats, e.g. H.264 and MJPEG.
+	Compressed bool
+
+	Sizes []FrameSize
+}
+
+// A FrameSize is a supported frame size, or a range of sizes.
+type FrameSize struct {
+	// The frame size, or the smallest size of a range.
+	Width  int
+	Height int
+
+	// For a range of sizes, the largest size and the increments between
+	// sizes. Zero for a single size.
+	MaxWidth   int
+	MaxHeight  int
+	StepWidth  int
+	StepHeight int
+
+	// Supported frame rates, in frames per second. For a range of frame
+	// intervals, only the lowest and highest rates are listed. The rates
+	// listed for a range of sizes are those of the largest size.
+	FrameRates []float64
 }
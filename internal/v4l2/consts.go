@@ -9,28 +9,52 @@ package v4l2
 
 const (
 	V4L2_BUF_TYPE_VIDEO_CAPTURE = 1
+	V4L2_BUF_TYPE_VIDEO_OUTPUT  = 2
 
 	V4L2_FIELD_ANY  = 0
 	V4L2_FIELD_NONE = 1
 
-	V4L2_PIX_FMT_JPEG = 'J' | 'P'<<8 | 'E'<<16 | 'G'<<24
-	V4L2_PIX_FMT_H264 = 'H' | '2'<<8 | '6'<<16 | '4'<<24
-	V4L2_PIX_FMT_AVC1 = 'A' | 'V'<<8 | 'C'<<16 | '1'<<24
-	V4L2_PIX_FMT_VP8  = 'V' | 'P'<<8 | '8'<<16 | '0'<<24
+	V4L2_PIX_FMT_YUV420 = 'Y' | 'U'<<8 | '1'<<16 | '2'<<24
+	V4L2_PIX_FMT_JPEG   = 'J' | 'P'<<8 | 'E'<<16 | 'G'<<24
+	V4L2_PIX_FMT_H264   = 'H' | '2'<<8 | '6'<<16 | '4'<<24
+	V4L2_PIX_FMT_AVC1   = 'A' | 'V'<<8 | 'C'<<16 | '1'<<24
+	V4L2_PIX_FMT_VP8    = 'V' | 'P'<<8 | '8'<<16 | '0'<<24
 
 	V4L2_MEMORY_MMAP = 1
 
-	VIDIOC_DQBUF       = 0xc0445611
-	VIDIOC_QBUF        = 0xc044560f
-	VIDIOC_QUERYBUF    = 0xc0445609
-	VIDIOC_QUERYCAP    = 0x80685600
-	VIDIOC_REQBUFS     = 0xc0145608
-	VIDIOC_G_EXT_CTRLS = 0xc0185647
-	VIDIOC_S_EXT_CTRLS = 0xc0185648
-	VIDIOC_S_FMT       = 0xc0cc5605
-	VIDIOC_STREAMON    = 0x40045612
-	VIDIOC_STREAMOFF   = 0x40045613
-	VIDIOC_S_CTRL      = 0xc008561c
+	V4L2_BUF_FLAG_TIMESTAMP_MASK      = 0xe000
+	V4L2_BUF_FLAG_TIMESTAMP_MONOTONIC = 0x2000
+	V4L2_BUF_FLAG_TIMESTAMP_COPY      = 0x4000
+
+	V4L2_FMT_FLAG_COMPRESSED = 0x0001
+
+	V4L2_FRMSIZE_TYPE_DISCRETE   = 1
+	V4L2_FRMSIZE_TYPE_CONTINUOUS = 2
+	V4L2_FRMSIZE_TYPE_STEPWISE   = 3
+
+	V4L2_FRMIVAL_TYPE_DISCRETE   = 1
+	V4L2_FRMIVAL_TYPE_CONTINUOUS = 2
+	V4L2_FRMIVAL_TYPE_STEPWISE   = 3
+
+	V4L2_CAP_VIDEO_CAPTURE = 0x00000001
+	V4L2_CAP_VIDEO_M2M     = 0x00008000
+	V4L2_CAP_DEVICE_CAPS   = 0x80000000
+
+	VIDIOC_DQBUF               = 0xc0445611
+	VIDIOC_ENUM_FMT            = 0xc0405602
+	VIDIOC_ENUM_FRAMESIZES     = 0xc02c564a
+	VIDIOC_ENUM_FRAMEINTERVALS = 0xc034564b
+	VIDIOC_QBUF                = 0xc044560f
+	VIDIOC_QUERYBUF            = 0xc0445609
+	VIDIOC_QUERYCAP            = 0x80685600
+	VIDIOC_REQBUFS             = 0xc0145608
+	VIDIOC_G_EXT_CTRLS         = 0xc0185647
+	VIDIOC_S_EXT_CTRLS         = 0xc0185648
+	VIDIOC_S_FMT               = 0xc0cc5605
+	VIDIOC_S_PARM              = 0xc0cc5616
+	VIDIOC_STREAMON            = 0x40045612
+	VIDIOC_STREAMOFF           = 0x40045613
+	VIDIOC_S_CTRL              = 0xc008561c
 )
 
 // Controls (from linux/v4l2-controls.h)
@@ -65,12 +89,18 @@ const (
 	V4L2_CID_MPEG_CLASS                   = V4L2_CTRL_CLASS_MPEG | 1
 	V4L2_CID_MPEG_VIDEO_B_FRAMES          = V4L2_CID_MPEG_BASE + 202
 	V4L2_CID_MPEG_VIDEO_GOP_SIZE          = V4L2_CID_MPEG_BASE + 203
+	V4L2_CID_MPEG_VIDEO_BITRATE_MODE      = V4L2_CID_MPEG_BASE + 206
 	V4L2_CID_MPEG_VIDEO_BITRATE           = V4L2_CID_MPEG_BASE + 207
 	V4L2_CID_MPEG_VIDEO_REPEAT_SEQ_HEADER = V4L2_CID_MPEG_BASE + 226
+	V4L2_CID_MPEG_VIDEO_FORCE_KEY_FRAME   = V4L2_CID_MPEG_BASE + 229
 	V4L2_CID_MPEG_VIDEO_H264_I_PERIOD     = V4L2_CID_MPEG_BASE + 358
 	V4L2_CID_MPEG_VIDEO_H264_LEVEL        = V4L2_CID_MPEG_BASE + 359
 	V4L2_CID_MPEG_VIDEO_H264_PROFILE      = V4L2_CID_MPEG_BASE + 363
 
+	// Bitrate modes
+	V4L2_MPEG_VIDEO_BITRATE_MODE_VBR = 0
+	V4L2_MPEG_VIDEO_BITRATE_MODE_CBR = 1
+
 	// H.264 Levels
 	V4L2_MPEG_VIDEO_H264_LEVEL_1_0 = 0
 	V4L2_MPEG_VIDEO_H264_LEVEL_1B  = 1
@@ -5,7 +5,9 @@ package v4l2
 
 import (
 	"io"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -14,27 +16,56 @@ import (
 // A V4L2 character device.
 type device struct {
 	// Number of requested kernel driver buffers.
-	// TODO: Currently only numBuffers = 1 is supported.
 	numBuffers int
 
 	// Device path, usually "/dev/video0".
 	path string
 
-	// File descriptor of v4l2 device.
+	// File descriptor of v4l2 device, opened in non-blocking mode.
 	fd int
 
-	// Memory-mapped buffer.
-	mmap []byte
+	// Guards the memory-mapped buffers, which Stop unmaps while ReadFrame
+	// may be running.
+	mu sync.Mutex
+
+	// Memory-mapped buffers, one per kernel driver buffer.
+	mmap [][]byte
+
+	// Sequence number of the last dequeued buffer, to detect dropped frames.
+	sequence uint32
+	started  bool
 }
 
+// A Frame is a buffer of video data read from a device.
+type Frame struct {
+	Data []byte
+
+	// When the first byte of the frame was captured.
+	Time time.Time
+
+	// Frames dropped by the driver since the previous frame, e.g. because
+	// all buffers were full.
+	Dropped int
+
+	// The driver's timestamp, passed on to an encoder.
+	timestamp timeval
+}
+
+// Default number of kernel driver buffers. More buffers let capture continue
+// while frames are waiting to be read, at the cost of memory.
+const defaultNumBuffers = 4
+
+// How long ReadFrame waits for a frame before giving up.
+const readTimeout = 5 * time.Second
+
 func OpenDevice(path string) (*device, error) {
-	fd, err := unix.Open(path, unix.O_RDWR, 0666)
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK, 0666)
 	if err != nil {
 		return nil, err
 	}
 
 	return &device{
-		numBuffers: 1,
+		numBuffers: defaultNumBuffers,
 		path:       path,
 		fd:         fd,
 	}, nil
@@ -62,10 +93,10 @@ func (dev *device) ioctl(request uint, arg unsafe.Pointer) error {
 }
 
 // Query buffer parameters.
-func (dev *device) queryBuffer(n uint32) (length, offset uint32, err error) {
+func (dev *device) queryBuffer(typ, n uint32) (length, offset uint32, err error) {
 	qb := v4l2_buffer{
 		index:  n,
-		typ:    V4L2_BUF_TYPE_VIDEO_CAPTURE,
+		typ:    typ,
 		memory: V4L2_MEMORY_MMAP,
 	}
 	if err = dev.ioctl(VIDIOC_QUERYBUF, unsafe.Pointer(&qb)); err != nil {
@@ -78,10 +109,10 @@ func (dev *device) queryBuffer(n uint32) (length, offset uint32, err error) {
 }
 
 // Request specified number of kernel buffers memory-mapped to user-space.
-func (dev *device) requestBuffers(n int) error {
+func (dev *device) requestBuffers(typ uint32, n int) error {
 	rb := v4l2_requestbuffers{
 		count:  uint32(n),
-		typ:    V4L2_BUF_TYPE_VIDEO_CAPTURE,
+		typ:    typ,
 		memory: V4L2_MEMORY_MMAP,
 	}
 	return dev.ioctl(VIDIOC_REQBUFS, unsafe.Pointer(&rb))
@@ -92,34 +123,55 @@ func (dev *device) mapMemory() error {
 		panic("v4l2 device: memory already mapped")
 	}
 
-	if err := dev.requestBuffers(dev.numBuffers); err != nil {
-		return err
-	}
+	var err error
+	dev.mmap, err = dev.mapBuffers(V4L2_BUF_TYPE_VIDEO_CAPTURE, dev.numBuffers)
+	return err
+}
 
-	length, offset, err := dev.queryBuffer(0)
-	if err != nil {
-		return err
+func (dev *device) unmapMemory() error {
+	err := dev.unmapBuffers(V4L2_BUF_TYPE_VIDEO_CAPTURE, dev.mmap)
+	dev.mmap = nil
+	return err
+}
+
+// Request n kernel buffers of the given type, and map them to user-space.
+func (dev *device) mapBuffers(typ uint32, n int) ([][]byte, error) {
+	if err := dev.requestBuffers(typ, n); err != nil {
+		return nil, err
 	}
 
-	dev.mmap, err = unix.Mmap(
-		dev.fd,
-		int64(offset),
-		int(length),
-		unix.PROT_READ|unix.PROT_WRITE,
-		unix.MAP_SHARED,
-	)
-	return err
+	var mmap [][]byte
+	for i := 0; i < n; i++ {
+		length, offset, err := dev.queryBuffer(typ, uint32(i))
+		if err != nil {
+			dev.unmapBuffers(typ, mmap)
+			return nil, err
+		}
+
+		b, err := unix.Mmap(
+			dev.fd,
+			int64(offset),
+			int(length),
+			unix.PROT_READ|unix.PROT_WRITE,
+			unix.MAP_SHARED,
+		)
+		if err != nil {
+			dev.unmapBuffers(typ, mmap)
+			return nil, err
+		}
+		mmap = append(mmap, b)
+	}
+	return mmap, nil
 }
 
-func (dev *device) unmapMemory() error {
-	if dev.mmap != nil {
-		if err := unix.Munmap(dev.mmap); err != nil {
+func (dev *device) unmapBuffers(typ uint32, mmap [][]byte) error {
+	for _, b := range mmap {
+		if err := unix.Munmap(b); err != nil {
 			return err
 		}
-		dev.mmap = nil
 	}
 
-	return dev.requestBuffers(0)
+	return dev.requestBuffers(typ, 0)
 }
 
 func (dev *device) enqueue(index int) error {
@@ -131,23 +183,50 @@ func (dev *device) enqueue(index int) error {
 	return dev.ioctl(VIDIOC_QBUF, unsafe.Pointer(&qbuf))
 }
 
-func (dev *device) dequeue(index int) (int, error) {
+// Dequeue a filled buffer of the given type. Returns EAGAIN if none is
+// ready.
+func (dev *device) dequeue(typ uint32) (v4l2_buffer, error) {
 	dqbuf := v4l2_buffer{
-		typ:   V4L2_BUF_TYPE_VIDEO_CAPTURE,
-		index: uint32(index),
+		typ:    typ,
+		memory: V4L2_MEMORY_MMAP,
 	}
 	err := dev.ioctl(VIDIOC_DQBUF, unsafe.Pointer(&dqbuf))
-	return int(dqbuf.bytesused), err
+	return dqbuf, err
+}
+
+// Wait until a buffer is ready to be dequeued, or the timeout expires. Poll
+// for POLLIN to dequeue from a CAPTURE queue, and POLLOUT for an OUTPUT
+// queue.
+func (dev *device) poll(events int16, timeout time.Duration) error {
+	fds := []unix.PollFd{{Fd: int32(dev.fd), Events: events}}
+	for {
+		n, err := unix.Poll(fds, int(timeout/time.Millisecond))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errTimeout
+		}
+		return nil
+	}
 }
 
 func (dev *device) enableStream() error {
-	typ := V4L2_BUF_TYPE_VIDEO_CAPTURE
-	return dev.ioctl(VIDIOC_STREAMON, unsafe.Pointer(&typ))
+	return dev.setStreaming(V4L2_BUF_TYPE_VIDEO_CAPTURE, true)
 }
 
 func (dev *device) disableStream() error {
 	// Disable stream (dequeues any outstanding buffers as well)
-	typ := V4L2_BUF_TYPE_VIDEO_CAPTURE
+	return dev.setStreaming(V4L2_BUF_TYPE_VIDEO_CAPTURE, false)
+}
+
+func (dev *device) setStreaming(typ uint32, on bool) error {
+	if on {
+		return dev.ioctl(VIDIOC_STREAMON, unsafe.Pointer(&typ))
+	}
 	return dev.ioctl(VIDIOC_STREAMOFF, unsafe.Pointer(&typ))
 }
 
@@ -179,6 +258,10 @@ func (dev *device) SetBitrate(bitrate int) error {
 }
 
 func (dev *device) SetPixelFormat(width, height, format int) error {
+	return dev.setFormat(V4L2_BUF_TYPE_VIDEO_CAPTURE, width, height, format)
+}
+
+func (dev *device) setFormat(typ uint32, width, height, format int) error {
 	pfmt := v4l2_pix_format{
 		width:       uint32(width),
 		height:      uint32(height),
@@ -186,12 +269,37 @@ func (dev *device) SetPixelFormat(width, height, format int) error {
 		field:       V4L2_FIELD_ANY,
 	}
 	fmt := v4l2_format{
-		typ: V4L2_BUF_TYPE_VIDEO_CAPTURE,
+		typ: typ,
 		fmt: pfmt.marshal(),
 	}
 	return dev.ioctl(VIDIOC_S_FMT, unsafe.Pointer(&fmt))
 }
 
+// Set the capture frame rate, in frames per second.
+func (dev *device) SetFrameRate(fps int) error {
+	return dev.setFrameRate(V4L2_BUF_TYPE_VIDEO_CAPTURE, fps)
+}
+
+// Set the frame rate of a queue. The layout of v4l2_outputparm matches that
+// of v4l2_captureparm.
+func (dev *device) setFrameRate(typ uint32, fps int) error {
+	cparm := v4l2_captureparm{
+		timeperframe: v4l2_fract{numerator: 1, denominator: uint32(fps)},
+	}
+	parm := v4l2_streamparm{
+		typ:  typ,
+		parm: cparm.marshal(),
+	}
+	return dev.ioctl(VIDIOC_S_PARM, unsafe.Pointer(&parm))
+}
+
+// Query the device's capabilities.
+func (dev *device) queryCapabilities() (v4l2_capability, error) {
+	var caps v4l2_capability
+	err := dev.ioctl(VIDIOC_QUERYCAP, unsafe.Pointer(&caps))
+	return caps, err
+}
+
 func (dev *device) SetRepeatSequenceHeader(on bool) error {
 	var value int32
 	if on {
@@ -200,8 +308,35 @@ func (dev *device) SetRepeatSequenceHeader(on bool) error {
 	return dev.setCodecControl(V4L2_CID_MPEG_VIDEO_REPEAT_SEQ_HEADER, value)
 }
 
+func (dev *device) SetKeyframeInterval(frames int) error {
+	return dev.setCodecControl(V4L2_CID_MPEG_VIDEO_H264_I_PERIOD, int32(frames))
+}
+
+func (dev *device) SetH264Profile(profile, level int32) error {
+	if err := dev.setCodecControl(V4L2_CID_MPEG_VIDEO_H264_PROFILE, profile); err != nil {
+		return err
+	}
+	return dev.setCodecControl(V4L2_CID_MPEG_VIDEO_H264_LEVEL, level)
+}
+
+func (dev *device) SetBitrateMode(mode int32) error {
+	return dev.setCodecControl(V4L2_CID_MPEG_VIDEO_BITRATE_MODE, mode)
+}
+
+func (dev *device) SetBFrames(count int) error {
+	return dev.setCodecControl(V4L2_CID_MPEG_VIDEO_B_FRAMES, int32(count))
+}
+
+// Make the next encoded frame a keyframe.
+func (dev *device) ForceKeyframe() error {
+	return dev.setCodecControl(V4L2_CID_MPEG_VIDEO_FORCE_KEY_FRAME, 1)
+}
+
 // Start video capture.
 func (dev *device) Start() error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
 	if err := dev.mapMemory(); err != nil {
 		return err
 	}
@@ -212,6 +347,7 @@ func (dev *device) Start() error {
 		}
 	}
 
+	dev.started = false
 	return dev.enableStream()
 }
 
@@ -222,16 +358,34 @@ func (dev *device) Stop() error {
 		return nil
 	}
 
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
 	return dev.unmapMemory()
 }
 
-// Read a video frame from the device. Blocks until data is available.
-func (dev *device) ReadFrame() (out []byte, err error) {
+// Read a video frame from the device. Blocks until data is available, and
+// returns io.EOF once capture is stopped.
+func (dev *device) ReadFrame() (frame Frame, err error) {
+	for {
+		frame, err = dev.readFrame()
+		if err != unix.EAGAIN {
+			return
+		}
+		if err = dev.poll(unix.POLLIN, readTimeout); err != nil {
+			return
+		}
+	}
+}
+
+func (dev *device) readFrame() (frame Frame, err error) {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
 	if dev.mmap == nil {
-		panic("v4l2 device: illegal state, capture not started")
+		return frame, io.EOF
 	}
 
-	n, err := dev.dequeue(0)
+	buf, err := dev.dequeue(V4L2_BUF_TYPE_VIDEO_CAPTURE)
 	if err != nil {
 		if err == syscall.EINVAL {
 			err = io.EOF
@@ -239,9 +393,47 @@ func (dev *device) ReadFrame() (out []byte, err error) {
 		return
 	}
 
-	// Copy data to new heap-allocated buffer.
-	out = append([]byte(nil), dev.mmap[:n]...)
+	// Copy data to new heap-allocated buffer, and hand the buffer straight
+	// back to the driver.
+	frame.Data = append([]byte(nil), dev.mmap[buf.index][:buf.bytesused]...)
+	if err = dev.enqueue(int(buf.index)); err != nil {
+		return
+	}
 
-	err = dev.enqueue(0)
+	frame.Time = captureTime(buf)
+	frame.timestamp = buf.timestamp
+	if dev.started {
+		frame.Dropped = int(buf.sequence - dev.sequence - 1)
+	}
+	dev.sequence = buf.sequence
+	dev.started = true
 	return
 }
+
+// Convert a buffer's timestamp to wall clock time. Drivers normally stamp
+// buffers with the monotonic clock, which has an arbitrary origin. Encoders
+// copy the timestamp of each raw frame to the encoded frame.
+func captureTime(buf v4l2_buffer) time.Time {
+	now := time.Now()
+	stamp := time.Duration(buf.timestamp.tv_sec)*time.Second +
+		time.Duration(buf.timestamp.tv_usec)*time.Microsecond
+	switch buf.flags & V4L2_BUF_FLAG_TIMESTAMP_MASK {
+	case V4L2_BUF_FLAG_TIMESTAMP_MONOTONIC, V4L2_BUF_FLAG_TIMESTAMP_COPY:
+	default:
+		return now
+	}
+	if stamp == 0 {
+		return now
+	}
+
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return now
+	}
+	age := time.Duration(ts.Nano()) - stamp
+	if age < 0 || age > time.Second {
+		// Implausible; don't trust it.
+		return now
+	}
+	return now.Add(-age)
+}
@@ -0,0 +1,197 @@
+// +build v4l2 !production
+// +build linux
+
+package v4l2
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// Devices lists the V4L2 video capture devices, e.g. /dev/video0. Devices that
+// can't be opened are skipped.
+func Devices() ([]DeviceInfo, error) {
+	paths, err := filepath.Glob("/dev/video*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var devices []DeviceInfo
+	for _, path := range paths {
+		dev, err := OpenDevice(path)
+		if err != nil {
+			log.Debug("Skipping %s: %v", path, err)
+			continue
+		}
+		caps, err := dev.queryCapabilities()
+		dev.Close()
+		if err != nil {
+			log.Debug("Skipping %s: %v", path, err)
+			continue
+		}
+
+		// Prefer the capabilities of this device node over those of the
+		// physical device, which may have other nodes, e.g. for metadata.
+		c := caps.capabilities
+		if c&V4L2_CAP_DEVICE_CAPS != 0 {
+			c = caps.device_caps
+		}
+		if c&V4L2_CAP_VIDEO_CAPTURE == 0 {
+			continue
+		}
+
+		devices = append(devices, DeviceInfo{
+			Path:   path,
+			Name:   cString(caps.card[:]),
+			Driver: cString(caps.driver[:]),
+		})
+	}
+	return devices, nil
+}
+
+// Enumerate lists the V4L2 video capture devices with the pixel formats, frame
+// sizes, and frame rates they support.
+func Enumerate() ([]DeviceCaps, error) {
+	devices, err := Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var all []DeviceCaps
+	for _, info := range devices {
+		dev, err := OpenDevice(info.Path)
+		if err != nil {
+			log.Debug("Skipping %s: %v", info.Path, err)
+			continue
+		}
+		formats, err := dev.enumFormats()
+		dev.Close()
+		if err != nil {
+			log.Debug("Skipping %s: %v", info.Path, err)
+			continue
+		}
+		all = append(all, DeviceCaps{DeviceInfo: info, Formats: formats})
+	}
+	return all, nil
+}
+
+// List the capture formats supported by the device. Each VIDIOC_ENUM_*
+// ioctl returns one entry per index, and EINVAL past the last one. Drivers
+// that don't implement an ioctl return ENOTTY, and list nothing.
+func (dev *device) enumFormats() ([]Format, error) {
+	var formats []Format
+	for i := uint32(0); ; i++ {
+		desc := v4l2_fmtdesc{index: i, typ: V4L2_BUF_TYPE_VIDEO_CAPTURE}
+		err := dev.ioctl(VIDIOC_ENUM_FMT, unsafe.Pointer(&desc))
+		if err == syscall.EINVAL || err == syscall.ENOTTY {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		sizes, err := dev.enumFrameSizes(desc.pixelformat)
+		if err != nil {
+			return nil, err
+		}
+		formats = append(formats, Format{
+			PixelFormat: int(desc.pixelformat),
+			Description: cString(desc.description[:]),
+			Compressed:  desc.flags&V4L2_FMT_FLAG_COMPRESSED != 0,
+			Sizes:       sizes,
+		})
+	}
+	return formats, nil
+}
+
+func (dev *device) enumFrameSizes(pixelFormat uint32) ([]FrameSize, error) {
+	var sizes []FrameSize
+	for i := uint32(0); ; i++ {
+		fse := v4l2_frmsizeenum{index: i, pixel_format: pixelFormat}
+		err := dev.ioctl(VIDIOC_ENUM_FRAMESIZES, unsafe.Pointer(&fse))
+		if err == syscall.EINVAL || err == syscall.ENOTTY {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		sw := fse.stepwise
+		var size FrameSize
+		if fse.typ == V4L2_FRMSIZE_TYPE_DISCRETE {
+			// The discrete width and height overlap min_width and max_width.
+			size.Width, size.Height = int(sw.min_width), int(sw.max_width)
+		} else {
+			size = FrameSize{
+				Width:      int(sw.min_width),
+				Height:     int(sw.min_height),
+				MaxWidth:   int(sw.max_width),
+				MaxHeight:  int(sw.max_height),
+				StepWidth:  int(sw.step_width),
+				StepHeight: int(sw.step_height),
+			}
+		}
+
+		w, h := size.Width, size.Height
+		if size.MaxWidth != 0 {
+			w, h = size.MaxWidth, size.MaxHeight
+		}
+		rates, err := dev.enumFrameRates(pixelFormat, w, h)
+		if err != nil {
+			return nil, err
+		}
+		size.FrameRates = rates
+		sizes = append(sizes, size)
+
+		// Stepwise and continuous ranges have a single entry.
+		if fse.typ != V4L2_FRMSIZE_TYPE_DISCRETE {
+			break
+		}
+	}
+	return sizes, nil
+}
+
+func (dev *device) enumFrameRates(pixelFormat uint32, width, height int) ([]float64, error) {
+	var rates []float64
+	for i := uint32(0); ; i++ {
+		fie := v4l2_frmivalenum{
+			index:        i,
+			pixel_format: pixelFormat,
+			width:        uint32(width),
+			height:       uint32(height),
+		}
+		err := dev.ioctl(VIDIOC_ENUM_FRAMEINTERVALS, unsafe.Pointer(&fie))
+		if err == syscall.EINVAL || err == syscall.ENOTTY {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if fie.typ == V4L2_FRMIVAL_TYPE_DISCRETE {
+			rates = append(rates, fie.stepwise.min.rate())
+		} else {
+			// The shortest interval is the highest rate.
+			rates = append(rates, fie.stepwise.max.rate(), fie.stepwise.min.rate())
+			break
+		}
+	}
+	return rates, nil
+}
+
+// Convert a frame interval, in seconds, to a frame rate.
+func (f v4l2_fract) rate() float64 {
+	if f.numerator == 0 {
+		return 0
+	}
+	return float64(f.denominator) / float64(f.numerator)
+}
+
+// Convert a NUL-terminated C string.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
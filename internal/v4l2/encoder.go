@@ -0,0 +1,129 @@
+// +build v4l2 !production
+// +build linux
+
+package v4l2
+
+import (
+	"bytes"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/lanikai/alohartc/internal/media/raw"
+)
+
+// An Encoder encodes raw frames from a source other than a V4L2 camera, e.g.
+// a screen grabber, with a memory-to-memory encoder such as bcm2835-codec.
+type Encoder struct {
+	enc *encoder
+}
+
+// OpenEncoder opens an encoder device, e.g. /dev/video11, for I420 frames.
+func OpenEncoder(path string, cfg EncoderConfig) (*Encoder, error) {
+	enc, err := openEncoder(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.configure(cfg); err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &Encoder{enc: enc}, nil
+}
+
+func (enc *encoder) configure(cfg EncoderConfig) error {
+	if err := enc.SetPixelFormat(cfg.Width, cfg.Height, V4L2_PIX_FMT_YUV420, V4L2_PIX_FMT_H264); err != nil {
+		return err
+	}
+	if cfg.FrameRate > 0 {
+		if err := enc.SetFrameRate(cfg.FrameRate); err != nil {
+			log.Debug("Failed to set encoder frame rate: %v", err)
+		}
+	}
+	if cfg.Bitrate > 0 {
+		if err := enc.SetBitrate(cfg.Bitrate); err != nil {
+			return err
+		}
+	}
+	if cfg.KeyframeInterval > 0 {
+		if err := enc.SetKeyframeInterval(cfg.KeyframeInterval); err != nil {
+			return err
+		}
+	}
+	// Receivers may join at any keyframe.
+	if err := enc.SetRepeatSequenceHeader(true); err != nil {
+		return err
+	}
+	if err := enc.SetBFrames(0); err != nil {
+		log.Debug("Failed to disable B-frames: %v", err)
+	}
+	return nil
+}
+
+// Start encoding.
+func (e *Encoder) Start() error {
+	return e.enc.Start()
+}
+
+// Stop encoding. ReadNALUs then returns io.EOF.
+func (e *Encoder) Stop() error {
+	return e.enc.Stop()
+}
+
+// Close the encoder device.
+func (e *Encoder) Close() error {
+	return e.enc.Close()
+}
+
+// Encode a frame, which must match the configured size. Blocks until the
+// encoder has room for it.
+func (e *Encoder) Encode(f *raw.Frame) error {
+	return e.enc.Encode(Frame{
+		Data:      f.Bytes(),
+		Time:      f.Time,
+		timestamp: monotonicTimeval(f.Time),
+	})
+}
+
+// ReadNALUs returns the NALUs of the next encoded frame, without start codes,
+// and when its raw frame was captured.
+func (e *Encoder) ReadNALUs() ([][]byte, time.Time, error) {
+	frame, err := e.enc.ReadFrame()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var nalus [][]byte
+	for _, nalu := range bytes.Split(frame.Data, []byte{0, 0, 0, 1}) {
+		if len(nalu) > 0 {
+			nalus = append(nalus, nalu)
+		}
+	}
+	return nalus, frame.Time, nil
+}
+
+// RequestKeyframe implements media.KeyframeRequester.
+func (e *Encoder) RequestKeyframe() error {
+	return e.enc.ForceKeyframe()
+}
+
+// AdjustBitrate implements media.BitrateAdjuster.
+func (e *Encoder) AdjustBitrate(bps int) error {
+	return e.enc.SetBitrate(bps)
+}
+
+// Return the monotonic clock reading at t, which the encoder copies to the
+// encoded frame for captureTime.
+func monotonicTimeval(t time.Time) timeval {
+	var ts unix.Timespec
+	if t.IsZero() || unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts) != nil {
+		return timeval{}
+	}
+	stamp := time.Duration(ts.Nano()) - time.Since(t)
+	if stamp < 0 {
+		return timeval{}
+	}
+	return timeval{
+		tv_sec:  uint32(stamp / time.Second),
+		tv_usec: uint32(stamp % time.Second / time.Microsecond),
+	}
+}
@@ -7,4 +7,5 @@ import "errors"
 
 var (
 	errNotSupported = errors.New("Not supported")
+	errTimeout      = errors.New("Timed out waiting for frame")
 )
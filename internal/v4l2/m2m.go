@@ -0,0 +1,154 @@
+// +build v4l2 !production
+// +build linux
+
+package v4l2
+
+import (
+	"io"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A memory-to-memory encoder, e.g. bcm2835-codec (usually /dev/video11) on the
+// Raspberry Pi 4, whose camera delivers raw frames. Raw frames are written to
+// the encoder's OUTPUT queue, and the encoded bitstream is read from its
+// CAPTURE queue, as from a camera with integrated encoding.
+type encoder struct {
+	*device
+
+	// Memory-mapped OUTPUT buffers, for raw frames. Guarded by device.mu.
+	output [][]byte
+
+	// Indexes of OUTPUT buffers not queued to the driver.
+	free []int
+}
+
+func openEncoder(path string) (*encoder, error) {
+	dev, err := OpenDevice(path)
+	if err != nil {
+		return nil, err
+	}
+	return &encoder{device: dev}, nil
+}
+
+// Set the raw input format, and the encoded output format.
+func (enc *encoder) SetPixelFormat(width, height, rawFormat, format int) error {
+	if err := enc.setFormat(V4L2_BUF_TYPE_VIDEO_OUTPUT, width, height, rawFormat); err != nil {
+		return err
+	}
+	return enc.setFormat(V4L2_BUF_TYPE_VIDEO_CAPTURE, width, height, format)
+}
+
+// Set the frame rate of the raw input, which guides rate control.
+func (enc *encoder) SetFrameRate(fps int) error {
+	return enc.setFrameRate(V4L2_BUF_TYPE_VIDEO_OUTPUT, fps)
+}
+
+// Start encoding.
+func (enc *encoder) Start() error {
+	enc.mu.Lock()
+	output, err := enc.mapBuffers(V4L2_BUF_TYPE_VIDEO_OUTPUT, enc.numBuffers)
+	if err == nil {
+		enc.output = output
+		enc.free = enc.free[:0]
+		for i := range output {
+			enc.free = append(enc.free, i)
+		}
+		err = enc.setStreaming(V4L2_BUF_TYPE_VIDEO_OUTPUT, true)
+	}
+	enc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The CAPTURE queue is set up just like a camera's.
+	return enc.device.Start()
+}
+
+// Stop encoding.
+func (enc *encoder) Stop() error {
+	if err := enc.device.Stop(); err != nil {
+		return err
+	}
+
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	if enc.output == nil {
+		return nil
+	}
+	if err := enc.setStreaming(V4L2_BUF_TYPE_VIDEO_OUTPUT, false); err != nil {
+		return err
+	}
+	err := enc.unmapBuffers(V4L2_BUF_TYPE_VIDEO_OUTPUT, enc.output)
+	enc.output = nil
+	return err
+}
+
+func (enc *encoder) Close() error {
+	if err := enc.Stop(); err != nil {
+		return err
+	}
+
+	return unix.Close(enc.fd)
+}
+
+// Encode a raw frame. Blocks until an OUTPUT buffer is free. The encoded
+// frame is read with ReadFrame.
+func (enc *encoder) Encode(frame Frame) error {
+	for {
+		err := enc.encode(frame)
+		if err != unix.EAGAIN {
+			return err
+		}
+		if err = enc.poll(unix.POLLOUT, readTimeout); err != nil {
+			return err
+		}
+	}
+}
+
+func (enc *encoder) encode(frame Frame) error {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	if enc.output == nil {
+		return io.EOF
+	}
+
+	// Reclaim the buffers the encoder has finished with.
+	for {
+		buf, err := enc.dequeue(V4L2_BUF_TYPE_VIDEO_OUTPUT)
+		if err == unix.EAGAIN {
+			break
+		} else if err == syscall.EINVAL {
+			return io.EOF
+		} else if err != nil {
+			return err
+		}
+		enc.free = append(enc.free, int(buf.index))
+	}
+	if len(enc.free) == 0 {
+		return unix.EAGAIN
+	}
+
+	index := enc.free[len(enc.free)-1]
+	enc.free = enc.free[:len(enc.free)-1]
+	n := copy(enc.output[index], frame.Data)
+	if n < len(frame.Data) {
+		log.Warn("Raw frame truncated from %d to %d bytes", len(frame.Data), n)
+	}
+
+	qbuf := v4l2_buffer{
+		typ:       V4L2_BUF_TYPE_VIDEO_OUTPUT,
+		memory:    V4L2_MEMORY_MMAP,
+		index:     uint32(index),
+		bytesused: uint32(n),
+		timestamp: frame.timestamp,
+	}
+	if err := enc.ioctl(VIDIOC_QBUF, unsafe.Pointer(&qbuf)); err != nil {
+		enc.free = append(enc.free, index)
+		return err
+	}
+	return nil
+}
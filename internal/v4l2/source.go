@@ -5,8 +5,13 @@ package v4l2
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 
 	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/raw"
+	"github.com/lanikai/alohartc/internal/packet"
 )
 
 // Open a V4L2 video device (usually /dev/video0).
@@ -16,6 +21,10 @@ func Open(devpath string, cfg Config) (media.VideoSource, error) {
 		return nil, err
 	}
 
+	if cfg.NumBuffers > 0 {
+		dev.numBuffers = cfg.NumBuffers
+	}
+
 	if cfg.Width <= 0 {
 		cfg.Width = 1280
 	}
@@ -25,45 +34,191 @@ func Open(devpath string, cfg Config) (media.VideoSource, error) {
 	if cfg.Format <= 0 {
 		cfg.Format = V4L2_PIX_FMT_H264
 	}
-	if err := dev.SetPixelFormat(cfg.Width, cfg.Height, cfg.Format); err != nil {
+
+	// With a separate encoder, the camera captures raw frames, and the
+	// encoder takes the codec controls.
+	codec := dev
+	captureFormat := cfg.Format
+	var enc *encoder
+	if cfg.Encoder != "" {
+		if enc, err = openEncoder(cfg.Encoder); err != nil {
+			dev.Close()
+			return nil, err
+		}
+		enc.numBuffers = dev.numBuffers
+		codec = enc.device
+		if cfg.RawFormat <= 0 {
+			cfg.RawFormat = V4L2_PIX_FMT_YUV420
+		}
+		captureFormat = cfg.RawFormat
+	}
+
+	// Fall back to the closest supported size, rather than fail.
+	if formats, err := dev.enumFormats(); err != nil {
+		log.Debug("Failed to enumerate formats of %s: %v", devpath, err)
+	} else if len(formats) > 0 {
+		caps := DeviceCaps{Formats: formats}
+		f := caps.Format(captureFormat)
+		if f == nil {
+			dev.Close()
+			if enc != nil {
+				enc.Close()
+			}
+			return nil, fmt.Errorf("%s does not support pixel format %s", devpath, FourCC(captureFormat))
+		}
+		if !f.Supports(cfg.Width, cfg.Height) {
+			if w, h, ok := f.ClosestSize(cfg.Width, cfg.Height); ok {
+				log.Info("%s does not support %dx%d, using %dx%d", devpath, cfg.Width, cfg.Height, w, h)
+				cfg.Width, cfg.Height = w, h
+			}
+		}
+	}
+
+	// Flip in the camera if it can, and otherwise in software, before any
+	// other transforms.
+	var transforms raw.Chain
+	if cfg.HorizontalFlip {
+		if err := dev.setControl(V4L2_CTRL_CLASS_USER, V4L2_CID_HFLIP, 1); err != nil {
+			log.Debug("%s can't flip horizontally, flipping in software: %v", devpath, err)
+			transforms = append(transforms, raw.FlipHorizontal{})
+		}
+	}
+	if cfg.VerticalFlip {
+		if err := dev.setControl(V4L2_CTRL_CLASS_USER, V4L2_CID_VFLIP, 1); err != nil {
+			log.Debug("%s can't flip vertically, flipping in software: %v", devpath, err)
+			transforms = append(transforms, raw.FlipVertical{})
+		}
+	}
+	transforms = append(transforms, cfg.Transforms...)
+	if len(transforms) > 0 && (enc == nil || captureFormat != V4L2_PIX_FMT_YUV420) {
+		dev.Close()
+		if enc != nil {
+			enc.Close()
+		}
+		return nil, errors.New("v4l2: software flips and transforms require an encoder, with raw capture in YUV420")
+	}
+	width, height := transforms.Size(cfg.Width, cfg.Height)
+
+	if err := dev.SetPixelFormat(cfg.Width, cfg.Height, captureFormat); err != nil {
 		return nil, err
 	}
+	if enc != nil {
+		if err := enc.SetPixelFormat(width, height, captureFormat, cfg.Format); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.FrameRate > 0 {
+		if err := dev.SetFrameRate(cfg.FrameRate); err != nil {
+			return nil, err
+		}
+		if enc != nil {
+			if err := enc.SetFrameRate(cfg.FrameRate); err != nil {
+				log.Debug("Failed to set encoder frame rate: %v", err)
+			}
+		}
+	}
 
 	if cfg.Bitrate > 0 {
-		if err := dev.SetBitrate(cfg.Bitrate); err != nil {
+		if err := codec.SetBitrate(cfg.Bitrate); err != nil {
 			return nil, err
 		}
 	}
 
-	if err := dev.SetRepeatSequenceHeader(cfg.RepeatSequenceHeader); err != nil {
+	if err := codec.SetRepeatSequenceHeader(cfg.RepeatSequenceHeader); err != nil {
 		return nil, err
 	}
 
+	if cfg.KeyframeInterval > 0 {
+		if err := codec.SetKeyframeInterval(cfg.KeyframeInterval); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.H264Level > 0 {
+		profile, level, err := h264ProfileControls(cfg.H264Profile, cfg.H264Level)
+		if err != nil {
+			return nil, err
+		}
+		if err := codec.SetH264Profile(profile, level); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.BitrateMode != media.BitrateVariable {
+		if err := codec.SetBitrateMode(bitrateModeControl(cfg.BitrateMode)); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.DisableBFrames {
+		// Drivers without the control, e.g. bcm2835-codec, don't produce
+		// B-frames anyway.
+		if err := codec.SetBFrames(0); err != nil {
+			log.Debug("Failed to disable B-frames: %v", err)
+		}
+	}
+
 	v := &videoSource{
-		cfg: cfg,
-		dev: dev,
+		cfg:    cfg,
+		width:  width,
+		height: height,
+		dev:    dev,
+		codec:  codec,
 	}
 	v.Flow.Start = func() {
+		if enc != nil {
+			if err := enc.Start(); err != nil {
+				// TODO: Proper error handling.
+				panic(err)
+			}
+		}
 		if err := dev.Start(); err != nil {
 			// TODO: Proper error handling.
 			panic(err)
 		}
 
+		if enc != nil {
+			// Feed raw frames to the encoder.
+			go func() {
+				for {
+					frame, err := dev.ReadFrame()
+					if err == nil && len(transforms) > 0 {
+						err = transformFrame(&frame, cfg.Width, cfg.Height, transforms)
+					}
+					if err == nil {
+						err = enc.Encode(frame)
+					}
+					if err != nil {
+						if err != io.EOF {
+							v.Flow.Shutdown(err)
+						}
+						break
+					}
+				}
+			}()
+		}
+
 		go func() {
 			for {
-				buf, err := dev.ReadFrame()
+				frame, err := codec.ReadFrame()
 				if err != nil {
 					v.Flow.Shutdown(err)
 					break
 				}
+				if frame.Dropped > 0 {
+					log.Debug("Driver dropped %d frames", frame.Dropped)
+				}
 				// On the Raspberry Pi, each picture NALU is delivered as a
 				// separate buffer, prefixed by an Annex-B start code. But
 				// SPS/PPS/SEI may come concatenated together, so to be safe we
 				// always split.
-				for _, nalu := range bytes.Split(buf, []byte{0, 0, 0, 1}) {
+				for _, nalu := range bytes.Split(frame.Data, []byte{0, 0, 0, 1}) {
 					if len(nalu) > 0 {
 						log.Debug("nalu = % 5d bytes, %02x", len(nalu), nalu[0:2])
-						v.Flow.PutBuffer(nalu, nil)
+						buf := packet.NewSharedBuffer(nalu, 1, nil)
+						buf.SetCaptureTime(frame.Time)
+						v.Flow.Put(buf)
 					}
 				}
 			}
@@ -71,6 +226,9 @@ func Open(devpath string, cfg Config) (media.VideoSource, error) {
 	}
 	v.Flow.Stop = func() {
 		dev.Stop()
+		if enc != nil {
+			enc.Stop()
+		}
 	}
 	return v, nil
 }
@@ -83,7 +241,14 @@ type videoSource struct {
 
 	cfg Config
 
-	dev *device
+	// Size of the encoded frames, after transforms.
+	width  int
+	height int
+
+	// The capture device, and the device that encodes its frames. These are
+	// the same, unless Config.Encoder is set.
+	dev   *device
+	codec *device
 }
 
 func (v *videoSource) Codec() string {
@@ -91,9 +256,103 @@ func (v *videoSource) Codec() string {
 }
 
 func (v *videoSource) Width() int {
-	return v.cfg.Width
+	return v.width
 }
 
 func (v *videoSource) Height() int {
-	return v.cfg.Height
+	return v.height
+}
+
+// Apply transforms to a raw I420 frame of the given size.
+func transformFrame(frame *Frame, width, height int, transforms raw.Chain) error {
+	f, err := raw.FromI420(frame.Data, width, height)
+	if err != nil {
+		return err
+	}
+	f.Time = frame.Time
+	frame.Data = transforms.Apply(f).Bytes()
+	return nil
+}
+
+// AdjustBitrate implements media.BitrateAdjuster.
+func (v *videoSource) AdjustBitrate(bps int) error {
+	return v.codec.SetBitrate(bps)
+}
+
+// AdjustFrameRate implements media.EncoderController.
+func (v *videoSource) AdjustFrameRate(fps int) error {
+	if err := v.dev.SetFrameRate(fps); err != nil {
+		return err
+	}
+	if v.codec != v.dev {
+		// Let the encoder's rate control know.
+		if err := v.codec.setFrameRate(V4L2_BUF_TYPE_VIDEO_OUTPUT, fps); err != nil {
+			log.Debug("Failed to set encoder frame rate: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetGOPSize implements media.EncoderController.
+func (v *videoSource) SetGOPSize(frames int) error {
+	return v.codec.SetKeyframeInterval(frames)
+}
+
+// SetH264Profile implements media.EncoderController.
+func (v *videoSource) SetH264Profile(profile media.H264Profile, level int) error {
+	p, l, err := h264ProfileControls(profile, level)
+	if err != nil {
+		return err
+	}
+	return v.codec.SetH264Profile(p, l)
+}
+
+// SetBitrateMode implements media.EncoderController.
+func (v *videoSource) SetBitrateMode(mode media.BitrateMode) error {
+	return v.codec.SetBitrateMode(bitrateModeControl(mode))
+}
+
+// Return the V4L2 control values for an H.264 profile and level.
+func h264ProfileControls(profile media.H264Profile, level int) (int32, int32, error) {
+	p, ok := h264Profiles[profile]
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported H.264 profile: %d", profile)
+	}
+	l, ok := h264Levels[level]
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported H.264 level: %d.%d", level/10, level%10)
+	}
+	return p, l, nil
+}
+
+func bitrateModeControl(mode media.BitrateMode) int32 {
+	if mode == media.BitrateConstant {
+		return V4L2_MPEG_VIDEO_BITRATE_MODE_CBR
+	}
+	return V4L2_MPEG_VIDEO_BITRATE_MODE_VBR
+}
+
+var h264Profiles = map[media.H264Profile]int32{
+	media.H264ProfileConstrainedBaseline: V4L2_MPEG_VIDEO_H264_PROFILE_CONSTRAINED_BASELINE,
+	media.H264ProfileMain:                V4L2_MPEG_VIDEO_H264_PROFILE_MAIN,
+	media.H264ProfileHigh:                V4L2_MPEG_VIDEO_H264_PROFILE_HIGH,
+}
+
+// Levels, keyed by ten times the level number.
+var h264Levels = map[int]int32{
+	10: V4L2_MPEG_VIDEO_H264_LEVEL_1_0,
+	11: V4L2_MPEG_VIDEO_H264_LEVEL_1_1,
+	12: V4L2_MPEG_VIDEO_H264_LEVEL_1_2,
+	13: V4L2_MPEG_VIDEO_H264_LEVEL_1_3,
+	20: V4L2_MPEG_VIDEO_H264_LEVEL_2_0,
+	21: V4L2_MPEG_VIDEO_H264_LEVEL_2_1,
+	22: V4L2_MPEG_VIDEO_H264_LEVEL_2_2,
+	30: V4L2_MPEG_VIDEO_H264_LEVEL_3_0,
+	31: V4L2_MPEG_VIDEO_H264_LEVEL_3_1,
+	32: V4L2_MPEG_VIDEO_H264_LEVEL_3_2,
+	40: V4L2_MPEG_VIDEO_H264_LEVEL_4_0,
+	41: V4L2_MPEG_VIDEO_H264_LEVEL_4_1,
+	42: V4L2_MPEG_VIDEO_H264_LEVEL_4_2,
+	50: V4L2_MPEG_VIDEO_H264_LEVEL_5_0,
+	51: V4L2_MPEG_VIDEO_H264_LEVEL_5_1,
 }
@@ -3,9 +3,34 @@
 package v4l2
 
 import (
+	"time"
+
 	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/raw"
 )
 
 func Open(devpath string, cfg Config) (media.VideoSource, error) {
 	return nil, errNotSupported
 }
+
+func Devices() ([]DeviceInfo, error) {
+	return nil, nil
+}
+
+func Enumerate() ([]DeviceCaps, error) {
+	return nil, nil
+}
+
+type Encoder struct{}
+
+func OpenEncoder(path string, cfg EncoderConfig) (*Encoder, error) {
+	return nil, errNotSupported
+}
+
+func (e *Encoder) Start() error                            { return errNotSupported }
+func (e *Encoder) Stop() error                             { return errNotSupported }
+func (e *Encoder) Close() error                            { return errNotSupported }
+func (e *Encoder) Encode(f *raw.Frame) error               { return errNotSupported }
+func (e *Encoder) ReadNALUs() ([][]byte, time.Time, error) { return nil, time.Time{}, errNotSupported }
+func (e *Encoder) RequestKeyframe() error                  { return errNotSupported }
+func (e *Encoder) AdjustBitrate(bps int) error             { return errNotSupported }
@@ -15,7 +15,9 @@ const (
 	maxSizeBufferDotM         = 4
 	maxSizeExtControlDotValue = 8
 	maxSizeFormatDotFmt       = 200
+	maxSizeStreamparmDotParm  = 200
 	sizePixFormat             = 48
+	sizeCaptureparm           = 40
 )
 
 type v4l2_capability struct {
@@ -48,6 +50,76 @@ type v4l2_format struct {
 	fmt [maxSizeFormatDotFmt]byte // union
 }
 
+type v4l2_fract struct {
+	numerator   uint32
+	denominator uint32
+}
+
+type v4l2_captureparm struct {
+	capability   uint32
+	capturemode  uint32
+	timeperframe v4l2_fract
+	extendedmode uint32
+	readbuffers  uint32
+	reserved     [4]uint32
+}
+
+type v4l2_streamparm struct {
+	typ  uint32
+	parm [maxSizeStreamparmDotParm]byte // union
+}
+
+type v4l2_fmtdesc struct {
+	index       uint32
+	typ         uint32
+	flags       uint32
+	description [32]uint8
+	pixelformat uint32
+	mbus_code   uint32
+	reserved    [3]uint32
+}
+
+type v4l2_frmsize_stepwise struct {
+	min_width   uint32
+	max_width   uint32
+	step_width  uint32
+	min_height  uint32
+	max_height  uint32
+	step_height uint32
+}
+
+type v4l2_frmsizeenum struct {
+	index        uint32
+	pixel_format uint32
+	typ          uint32
+
+	// Union of v4l2_frmsize_discrete, which overlaps the first two fields
+	// of v4l2_frmsize_stepwise, and v4l2_frmsize_stepwise.
+	stepwise v4l2_frmsize_stepwise
+
+	reserved [2]uint32
+}
+
+type v4l2_frmival_stepwise struct {
+	min  v4l2_fract
+	max  v4l2_fract
+	step v4l2_fract
+}
+
+type v4l2_frmivalenum struct {
+	index        uint32
+	pixel_format uint32
+	width        uint32
+	height       uint32
+	typ          uint32
+
+	// Union of the discrete v4l2_fract, which overlaps the first field of
+	// v4l2_frmival_stepwise, and v4l2_frmival_stepwise.
+	stepwise v4l2_frmival_stepwise
+
+	reserved [2]uint32
+}
+
 type v4l2_control struct {
 	id    uint32
 	value int32
@@ -114,3 +186,12 @@ func (pfmt *v4l2_pix_format) marshal() [maxSizeFormatDotFmt]byte {
 
 	return b
 }
+
+// marshals v4l2_captureparm struct into v4l2_streamparm.parm union
+func (cparm *v4l2_captureparm) marshal() [maxSizeStreamparmDotParm]byte {
+	var b [maxSizeStreamparmDotParm]byte
+
+	copy(b[0:sizeCaptureparm], (*[sizeCaptureparm]byte)(unsafe.Pointer(cparm))[:])
+
+	return b
+}
@@ -0,0 +1,8 @@
+// Package interop tests alohartc against other WebRTC implementations, so far
+// pion/webrtc, exchanging media between the two over the local host.
+//
+// It is a separate module to keep those implementations out of alohartc's own
+// dependencies. Run the tests from this directory:
+//
+//	go test -race ./...
+package interop
@@ -0,0 +1,14 @@
+module github.com/lanikai/alohartc/interop
+
+go 1.13
+
+require (
+	github.com/lanikai/alohartc v0.0.0
+	github.com/pion/rtcp v1.2.1
+	github.com/pion/webrtc/v2 v2.1.18
+	github.com/stretchr/testify v1.4.0
+)
+
+replace github.com/lanikai/alohartc => ../
+
+replace github.com/lanikai/alohartc/internal/dtls => ../internal/dtls
@@ -0,0 +1,402 @@
+package interop
+
+import (
+	"encoding/json"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc"
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/packet"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v2"
+	pionmedia "github.com/pion/webrtc/v2/pkg/media"
+	"github.com/stretchr/testify/assert"
+)
+
+// A tiny H.264 stream: an IDR picture with its parameter sets, sent every 20
+// milliseconds by both peers.
+var picture = [][]byte{
+	{0x67, 0x42, 0xe0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}, // SPS
+	{0x68, 0xce, 0x06, 0xe2}, // PPS
+	{0x65, 0x88, 0x84, 0x00, 0x33, 0xff, 0xfe, 0xf6, 0xf0, 0xfe, 0x05, 0x36}, // IDR slice
+}
+
+const pictureInterval = 20 * time.Millisecond
+
+// How long to wait for each step: connecting, media, and RTCP reports (which
+// alohartc sends every 2 seconds).
+const timeout = 10 * time.Second
+
+// alohartc video source repeating picture.
+type videoSource struct {
+	media.Flow
+	quit chan struct{}
+}
+
+func newVideoSource() *videoSource {
+	src := &videoSource{quit: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(pictureInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-src.quit:
+				return
+			case <-ticker.C:
+				for _, nalu := range picture {
+					src.Put(packet.NewSharedBuffer(nalu, 1, nil))
+				}
+			}
+		}
+	}()
+	return src
+}
+
+func (src *videoSource) Close()        { close(src.quit) }
+func (src *videoSource) Codec() string { return "H264" }
+func (src *videoSource) Width() int    { return 640 }
+func (src *videoSource) Height() int   { return 480 }
+
+// Create a pion peer connection supporting only H.264 (payload type 102), or,
+// if offer is non-empty, the codecs in the offer.
+func newPion(t *testing.T, offer string) *webrtc.PeerConnection {
+	m := webrtc.MediaEngine{}
+	if offer != "" {
+		desc := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}
+		if err := m.PopulateFromSDP(desc); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		m.RegisterCodec(webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, 90000))
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+// Send picture on a new pion track, in Annex B format, until quit is closed.
+func addPionTrack(t *testing.T, pc *webrtc.PeerConnection, quit <-chan struct{}) *webrtc.RTPSender {
+	track, err := pc.NewTrack(webrtc.DefaultPayloadTypeH264, 0x50494f4e, "video", "pion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var annexB []byte
+	for _, nalu := range picture {
+		annexB = append(annexB, 0, 0, 0, 1)
+		annexB = append(annexB, nalu...)
+	}
+	go func() {
+		ticker := time.NewTicker(pictureInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				sample := pionmedia.Sample{Data: annexB, Samples: uint32(90000 * pictureInterval / time.Second)}
+				if err := track.WriteSample(sample); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return sender
+}
+
+// Pass JSON-encoded ICE candidates to add once ready is closed, since pion
+// rejects candidates that arrive before the remote description.
+func relay(ready, quit <-chan struct{}, add func([]byte) error) chan<- []byte {
+	candidates := make(chan []byte, 64)
+	go func() {
+		select {
+		case <-ready:
+		case <-quit:
+			return
+		}
+		for {
+			select {
+			case b := <-candidates:
+				if err := add(b); err != nil {
+					log.Printf("adding ICE candidate %s: %v", b, err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return candidates
+}
+
+// Exchange ICE candidates between the two peers, in the form browsers use.
+// Candidates are passed on once ready is closed.
+func exchangeCandidates(aloha *alohartc.PeerConnection, pion *webrtc.PeerConnection, ready, quit <-chan struct{}) {
+	toAloha := relay(ready, quit, func(b []byte) error {
+		var ci alohartc.ICECandidateInit
+		if err := json.Unmarshal(b, &ci); err != nil {
+			return err
+		}
+		if ci.UsernameFragment != nil && *ci.UsernameFragment == "" {
+			ci.UsernameFragment = nil
+		}
+		c, err := ci.ICECandidate()
+		if err != nil || c == nil {
+			return err
+		}
+		aloha.AddIceCandidate(c)
+		return nil
+	})
+	toPion := relay(ready, quit, func(b []byte) error {
+		var ci webrtc.ICECandidateInit
+		if err := json.Unmarshal(b, &ci); err != nil {
+			return err
+		}
+		return pion.AddICECandidate(ci)
+	})
+
+	pion.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		b, err := json.Marshal(c.ToJSON())
+		if err != nil {
+			panic(err)
+		}
+		toAloha <- b
+	})
+	aloha.OnIceCandidate = func(c *alohartc.ICECandidate) {
+		if c == nil {
+			// pion doesn't need the end of candidates.
+			return
+		}
+		b, err := json.Marshal(aloha.CandidateInit(c))
+		if err != nil {
+			panic(err)
+		}
+		toPion <- b
+	}
+}
+
+// Type of the first NALU in an H.264 RTP payload (see RFC 6184 Section 5.2).
+func naluType(payload []byte) byte {
+	if len(payload) < 2 {
+		return 0
+	}
+	switch t := payload[0] & 0x1f; t {
+	case 24: // STAP-A
+		if len(payload) < 4 {
+			return 0
+		}
+		return payload[3] & 0x1f
+	case 28: // FU-A
+		return payload[1] & 0x1f
+	default:
+		return t
+	}
+}
+
+// Watch for alohartc's video and sender reports arriving at pion. Must be
+// called before negotiation, so that no track is missed.
+func watchPion(pion *webrtc.PeerConnection) (idr, senderReport <-chan struct{}) {
+	idrs := make(chan struct{}, 1)
+	senderReports := make(chan struct{}, 1)
+	pion.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+		go watchRTCP(receiver.ReadRTCP, senderReports, func(pkt rtcp.Packet) bool {
+			_, ok := pkt.(*rtcp.SenderReport)
+			return ok
+		})
+		for {
+			pkt, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			// Anything that fails SRTP authentication is dropped, so
+			// this is only reached once decryption works.
+			if pkt.PayloadType == webrtc.DefaultPayloadTypeH264 && naluType(pkt.Payload) == 5 {
+				signal(idrs)
+			}
+		}
+	})
+	return idrs, senderReports
+}
+
+// Read RTCP packets until an error, signaling each that matches.
+func watchRTCP(read func() ([]rtcp.Packet, error), matched chan<- struct{}, match func(rtcp.Packet) bool) {
+	for {
+		pkts, err := read()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			if match(pkt) {
+				signal(matched)
+			}
+		}
+	}
+}
+
+// Send on a buffered channel, unless it is full.
+func signal(c chan<- struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for a signal, failing the test after the timeout.
+func expect(t *testing.T, c <-chan struct{}, what string) {
+	select {
+	case <-c:
+	case <-time.After(timeout):
+		t.Errorf("%s not received", what)
+	}
+}
+
+// Check that alohartc receives pion's video, returning once it has.
+func expectAlohaReceives(t *testing.T, tracks <-chan *alohartc.RemoteTrack) {
+	select {
+	case track := <-tracks:
+		assert.Equal(t, "H264", track.Codec())
+		deadline := time.After(timeout)
+		for {
+			select {
+			case buf, more := <-track.Buffers():
+				if !more {
+					t.Errorf("track ended: %v", track.Err())
+					return
+				}
+				idr := buf.Bytes()[0]&0x1f == 5
+				buf.Release()
+				if idr {
+					return
+				}
+			case <-deadline:
+				t.Error("alohartc received no IDR picture")
+				return
+			}
+		}
+	case <-time.After(timeout):
+		t.Error("alohartc received no track")
+	}
+}
+
+func TestPionOfferer(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	ready := make(chan struct{})
+
+	src := newVideoSource()
+	defer src.Close()
+	aloha := alohartc.Must(alohartc.NewPeerConnection(alohartc.Config{LocalVideo: src}))
+	defer aloha.Close()
+	tracks := make(chan *alohartc.RemoteTrack, 1)
+	aloha.OnTrack(func(track *alohartc.RemoteTrack) {
+		tracks <- track
+	})
+
+	pion := newPion(t, "")
+	defer pion.Close()
+	sender := addPionTrack(t, pion, quit)
+	exchangeCandidates(aloha, pion, ready, quit)
+	idr, senderReport := watchPion(pion)
+
+	// alohartc reports on the video it receives from pion.
+	receiverReport := make(chan struct{}, 1)
+	go watchRTCP(sender.ReadRTCP, receiverReport, func(pkt rtcp.Packet) bool {
+		_, ok := pkt.(*rtcp.ReceiverReport)
+		return ok
+	})
+
+	offer, err := pion.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pion.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := aloha.SetRemoteDescription(offer.SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pion.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(ready)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- aloha.Stream()
+	}()
+
+	expectAlohaReceives(t, tracks)
+	expect(t, idr, "IDR picture from alohartc")
+	expect(t, senderReport, "sender report from alohartc")
+	expect(t, receiverReport, "receiver report from alohartc")
+
+	aloha.Close()
+	assert.NoError(t, <-errs)
+}
+
+func TestPionAnswerer(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+	ready := make(chan struct{})
+
+	src := newVideoSource()
+	defer src.Close()
+	aloha := alohartc.Must(alohartc.NewPeerConnection(alohartc.Config{LocalVideo: src}))
+	defer aloha.Close()
+
+	offer, err := aloha.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pion := newPion(t, offer)
+	defer pion.Close()
+	exchangeCandidates(aloha, pion, ready, quit)
+	idr, senderReport := watchPion(pion)
+	_, err = pion.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RtpTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pion.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := pion.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pion.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := aloha.SetRemoteAnswer(answer.SDP); err != nil {
+		t.Fatal(err)
+	}
+	close(ready)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- aloha.Stream()
+	}()
+
+	expect(t, idr, "IDR picture from alohartc")
+	expect(t, senderReport, "sender report from alohartc")
+
+	aloha.Close()
+	assert.NoError(t, <-errs)
+}
@@ -0,0 +1,71 @@
+package alohartc
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/lanikai/alohartc/internal/ice"
+)
+
+const (
+	// Largest SDP offer accepted from a remote peer. Real offers are a few
+	// kilobytes; anything much bigger is an attempt to waste memory.
+	maxSDPSize = 64 * 1024
+
+	// Maximum number of DTLS handshakes in progress at once, across all peer
+	// connections. Further connections fail immediately rather than queue.
+	maxPendingHandshakes = 4
+)
+
+var (
+	errSDPTooLarge         = errors.New("SDP exceeds maximum size")
+	errTooManyHandshakes   = errors.New("too many DTLS handshakes in progress")
+	pendingHandshakes      = make(chan struct{}, maxPendingHandshakes)
+	rejectedHandshakeCount uint64
+	rejectedSDPCount       uint64
+)
+
+// IngressStats counts incoming traffic rejected by the limits that protect
+// the device from floods, since the process started.
+type IngressStats struct {
+	// Packets dropped by the per-source packet rate limit.
+	RateLimitedPackets uint64
+
+	// Malformed STUN packets dropped.
+	MalformedPackets uint64
+
+	// Outgoing STUN requests abandoned because too many transactions were
+	// outstanding.
+	RejectedTransactions uint64
+
+	// Peer connections refused because too many DTLS handshakes were in
+	// progress.
+	RejectedHandshakes uint64
+
+	// Remote descriptions refused for exceeding the maximum SDP size.
+	RejectedSDP uint64
+}
+
+// GetIngressStats returns a snapshot of the ingress counters.
+func GetIngressStats() IngressStats {
+	c := ice.GetIngressCounters()
+	return IngressStats{
+		RateLimitedPackets:   c.RateLimitedPackets,
+		MalformedPackets:     c.MalformedPackets,
+		RejectedTransactions: c.RejectedTransactions,
+		RejectedHandshakes:   atomic.LoadUint64(&rejectedHandshakeCount),
+		RejectedSDP:          atomic.LoadUint64(&rejectedSDPCount),
+	}
+}
+
+// Reserve a slot for a DTLS handshake. If one is available, the returned
+// function releases it.
+func acquireHandshake() (release func(), err error) {
+	select {
+	case pendingHandshakes <- struct{}{}:
+		return func() { <-pendingHandshakes }, nil
+	default:
+		atomic.AddUint64(&rejectedHandshakeCount, 1)
+		return nil, errTooManyHandshakes
+	}
+}
@@ -0,0 +1,265 @@
+package alohartc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/dtls"
+	"github.com/lanikai/alohartc/internal/leak"
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+// A video source repeating a tiny H.264 stream, an IDR picture with its
+// parameter sets, every 20 milliseconds.
+type loopbackVideoSource struct {
+	media.Flow
+	quit chan struct{}
+}
+
+func newLoopbackVideoSource() *loopbackVideoSource {
+	src := &loopbackVideoSource{quit: make(chan struct{})}
+	go src.run()
+	return src
+}
+
+func (src *loopbackVideoSource) run() {
+	nalus := [][]byte{
+		{0x67, 0x42, 0xe0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x06, 0xd0, 0xa1, 0x35}, // SPS
+		{0x68, 0xce, 0x06, 0xe2}, // PPS
+		{0x65, 0x88, 0x84, 0x00, 0x33, 0xff, 0xfe, 0xf6, 0xf0, 0xfe, 0x05, 0x36}, // IDR slice
+	}
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-src.quit:
+			return
+		case <-ticker.C:
+			for _, nalu := range nalus {
+				src.Put(packet.NewSharedBuffer(nalu, 1, nil))
+			}
+		}
+	}
+}
+
+func (src *loopbackVideoSource) Close()        { close(src.quit) }
+func (src *loopbackVideoSource) Codec() string { return "H264" }
+func (src *loopbackVideoSource) Width() int    { return 640 }
+func (src *loopbackVideoSource) Height() int   { return 480 }
+
+// Configuration for a peer connection that only uses loopback interfaces, and
+// panics if anything is left behind when it closes.
+func loopbackConfig() Config {
+	return Config{
+		ICELoopback: true,
+		InterfaceFilter: func(name string, ip net.IP) bool {
+			return ip.IsLoopback()
+		},
+		ConnectTimeout: 5 * time.Second,
+		TrackResources: true,
+		PanicOnLeak:    true,
+	}
+}
+
+// Negotiate between two peer connections in this process, exchanging ICE
+// candidates directly, and start streaming. The returned function closes
+// both and returns the errors from Stream.
+func connectLoopback(t *testing.T, offerer, answerer *PeerConnection) (closeBoth func() []error) {
+	offerer.OnIceCandidate = answerer.AddIceCandidate
+	answerer.OnIceCandidate = offerer.AddIceCandidate
+
+	offer, err := offerer.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := offerer.SetRemoteAnswer(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	for _, pc := range []*PeerConnection{offerer, answerer} {
+		go func(pc *PeerConnection) {
+			errs <- pc.Stream()
+		}(pc)
+	}
+
+	return func() []error {
+		offerer.Close()
+		answerer.Close()
+		return []error{<-errs, <-errs}
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	offerer := Must(NewPeerConnection(config))
+	answerer := Must(NewPeerConnection(loopbackConfig()))
+	tracks := make(chan *RemoteTrack, 1)
+	answerer.OnTrack(func(track *RemoteTrack) {
+		tracks <- track
+	})
+
+	closeBoth := connectLoopback(t, offerer, answerer)
+
+	// The answerer receives the offerer's video once ICE and DTLS complete.
+	select {
+	case track := <-tracks:
+		assert.Equal(t, "H264", track.Codec())
+		received := make(chan int, 1)
+		go func() {
+			// Release every buffer, so that none leak.
+			for buf := range track.Buffers() {
+				select {
+				case received <- len(buf.Bytes()):
+				default:
+				}
+				buf.Release()
+			}
+		}()
+		select {
+		case n := <-received:
+			if n == 0 {
+				t.Error("empty buffer received")
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("no video received")
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("connection not established")
+	}
+
+	// The offerer took the DTLS server role.
+	assert.True(t, offerer.dtlsServer)
+	assert.False(t, answerer.dtlsServer)
+
+	for _, err := range closeBoth() {
+		assert.NoError(t, err)
+	}
+}
+
+// The offerer takes the DTLS server role, so it must still check the
+// answerer's certificate against the fingerprint in the answer.
+func TestLoopbackFingerprintMismatch(t *testing.T) {
+	offerer := Must(NewPeerConnection(loopbackConfig()))
+	answerer := Must(NewPeerConnection(loopbackConfig()))
+	certErrors := make(chan error, 1)
+	offerer.OnCertificateError = func(err error) {
+		certErrors <- err
+	}
+	offerer.OnIceCandidate = answerer.AddIceCandidate
+	answerer.OnIceCandidate = offerer.AddIceCandidate
+
+	offer, err := offerer.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the answerer's fingerprint for another certificate's.
+	cert, _, err := dtls.GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := dtls.Fingerprint(cert, dtls.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer = strings.Replace(answer, strings.ToUpper(answerer.fingerprint), strings.ToUpper(other), -1)
+	if err := offerer.SetRemoteAnswer(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	for _, pc := range []*PeerConnection{offerer, answerer} {
+		go func(pc *PeerConnection) {
+			errs <- pc.Stream()
+		}(pc)
+	}
+
+	select {
+	case err := <-certErrors:
+		assert.Error(t, err)
+	case <-time.After(10 * time.Second):
+		t.Error("answerer's certificate not checked")
+	}
+	select {
+	case err := <-errs:
+		assert.Error(t, err, "streaming with a mismatched fingerprint")
+	case <-time.After(10 * time.Second):
+		t.Error("handshake not aborted")
+	}
+	// The answerer learns of the rejection from the alert.
+	select {
+	case err := <-errs:
+		assert.Error(t, err, "streaming with a rejected certificate")
+	case <-time.After(10 * time.Second):
+		t.Error("handshake not aborted on the answerer")
+	}
+	assert.True(t, offerer.dtlsServer)
+
+	offerer.Close()
+	answerer.Close()
+}
+
+func TestLoopbackReportsLeaks(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	offerer := Must(NewPeerConnection(config))
+	config = loopbackConfig()
+	config.PanicOnLeak = false
+	answerer := Must(NewPeerConnection(config))
+	tracks := make(chan *RemoteTrack, 1)
+	answerer.OnTrack(func(track *RemoteTrack) {
+		tracks <- track
+	})
+
+	closeBoth := connectLoopback(t, offerer, answerer)
+	defer closeBoth()
+
+	// The application takes a buffer, and doesn't release it.
+	var track *RemoteTrack
+	select {
+	case track = <-tracks:
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection not established")
+	}
+	var buf *packet.SharedBuffer
+	select {
+	case buf = <-track.Buffers():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no video received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := answerer.CloseWithContext(ctx)
+	if err, ok := err.(*leak.Error); !ok || err.Leaks[0] != "buffer received video" {
+		t.Errorf("expected leaked buffers, got %v", err)
+	}
+
+	// Nothing else is left once the buffers are released.
+	buf.Release()
+	for buf := range track.Buffers() {
+		buf.Release()
+	}
+	assert.NoError(t, answerer.CloseWithContext(context.Background()))
+}
@@ -0,0 +1,204 @@
+package alohartc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/alsa"
+	"github.com/lanikai/alohartc/internal/v4l2"
+)
+
+// Kinds of media device, as in the browser's MediaDeviceInfo.kind.
+const (
+	KindVideoInput = "videoinput"
+	KindAudioInput = "audioinput"
+)
+
+var (
+	errNoConstraints     = errors.New("no audio or video requested")
+	errNoDevice          = errors.New("no matching device")
+	errStereoUnsupported = errors.New("only mono audio capture is supported")
+)
+
+// MediaDeviceInfo describes a capture device, like the browser's
+// MediaDeviceInfo.
+type MediaDeviceInfo struct {
+	// Identifies the device in MediaTrackConstraints: a V4L2 device path,
+	// e.g. "/dev/video0", or an ALSA device name, e.g. "hw:1,0".
+	DeviceID string
+
+	// KindVideoInput or KindAudioInput.
+	Kind string
+
+	// Human-readable name of the device.
+	Label string
+}
+
+// MediaStreamConstraints selects the tracks requested from GetUserMedia. A nil
+// field requests no track of that kind.
+type MediaStreamConstraints struct {
+	Video *MediaTrackConstraints
+	Audio *MediaTrackConstraints
+}
+
+// MediaTrackConstraints selects a device and its capture settings. Zero
+// fields take defaults: the first device found, 1280x720 video at 1 Mbps, the
+// driver's frame rate, and mono PCMU audio at 8 kHz.
+type MediaTrackConstraints struct {
+	DeviceID string
+
+	// Video settings.
+	Width     int
+	Height    int
+	FrameRate int
+	Bitrate   int
+
+	// Audio settings. Codec is "PCMU" (the default) or "L16", both
+	// encoded in pure Go, though only PCMU can be sent to a peer. Echo
+	// cancellation and noise suppression require the speexdsp build tag.
+	Codec            string
+	ChannelCount     int
+	SampleRate       int
+	EchoCancellation bool
+	NoiseSuppression bool
+}
+
+// An EncoderController is a video source whose encoder can be tuned while it
+// is streaming, e.g. a V4L2 camera:
+//
+//	if enc, ok := stream.Video.(alohartc.EncoderController); ok {
+//		enc.AdjustFrameRate(15)
+//	}
+type EncoderController = media.EncoderController
+
+// BitrateMode selects constant or variable bitrate encoding.
+type BitrateMode = media.BitrateMode
+
+const (
+	BitrateVariable = media.BitrateVariable
+	BitrateConstant = media.BitrateConstant
+)
+
+// A MediaStream holds the tracks returned by GetUserMedia. Video and Audio
+// plug directly into Config.LocalVideo and Config.LocalAudio.
+type MediaStream struct {
+	Video media.VideoSource
+	Audio media.AudioSource
+}
+
+// Close stops capturing and releases the stream's devices.
+func (s *MediaStream) Close() error {
+	var err error
+	for _, src := range []interface{}{s.Video, s.Audio} {
+		if closer, ok := src.(io.Closer); ok {
+			if e := closer.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// EnumerateDevices lists the available video and audio capture devices.
+func EnumerateDevices() ([]MediaDeviceInfo, error) {
+	var devices []MediaDeviceInfo
+
+	video, err := v4l2.Devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range video {
+		devices = append(devices, MediaDeviceInfo{
+			DeviceID: d.Path,
+			Kind:     KindVideoInput,
+			Label:    d.Name,
+		})
+	}
+
+	audio, err := alsa.CaptureDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range audio {
+		devices = append(devices, MediaDeviceInfo{
+			DeviceID: d.Name,
+			Kind:     KindAudioInput,
+			Label:    d.Label,
+		})
+	}
+
+	return devices, nil
+}
+
+// GetUserMedia opens the capture devices that satisfy constraints, in the
+// manner of the browser's navigator.mediaDevices.getUserMedia. The caller
+// must Close the returned stream.
+func GetUserMedia(constraints MediaStreamConstraints) (*MediaStream, error) {
+	if constraints.Video == nil && constraints.Audio == nil {
+		return nil, errNoConstraints
+	}
+
+	stream := &MediaStream{}
+	if c := constraints.Video; c != nil {
+		src, err := openVideoInput(c)
+		if err != nil {
+			return nil, err
+		}
+		stream.Video = src
+	}
+	if c := constraints.Audio; c != nil {
+		if c.ChannelCount > 1 {
+			stream.Close()
+			return nil, errStereoUnsupported
+		}
+		src, err := alsa.Open(alsa.Config{
+			Device:           c.DeviceID,
+			Codec:            c.Codec,
+			SampleRate:       c.SampleRate,
+			EchoCancellation: c.EchoCancellation,
+			NoiseSuppression: c.NoiseSuppression,
+		})
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		stream.Audio = src
+	}
+	return stream, nil
+}
+
+func openVideoInput(c *MediaTrackConstraints) (media.VideoSource, error) {
+	path := c.DeviceID
+	if path == "" {
+		devices, err := v4l2.Devices()
+		if err != nil {
+			return nil, err
+		}
+		if len(devices) == 0 {
+			return nil, errNoDevice
+		}
+		path = devices[0].Path
+	}
+
+	cfg := v4l2.Config{
+		Width:                c.Width,
+		Height:               c.Height,
+		FrameRate:            c.FrameRate,
+		Bitrate:              c.Bitrate,
+		RepeatSequenceHeader: true,
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		cfg.Width, cfg.Height = defaultCameraWidth, defaultCameraHeight
+	}
+	if cfg.Bitrate == 0 {
+		cfg.Bitrate = defaultCameraBitrate
+	}
+
+	src, err := v4l2.Open(path, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return src, nil
+}
@@ -0,0 +1,228 @@
+package alohartc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Types of SessionDescription.
+const (
+	SDPTypeOffer  = "offer"
+	SDPTypeAnswer = "answer"
+)
+
+var errNegotiationIncomplete = errors.New("signaling ended before negotiation completed")
+
+// A SessionDescription is an SDP offer or answer, in the JSON form used by
+// browsers (RTCSessionDescriptionInit):
+//
+//	{"type": "offer", "sdp": "v=0\r\n..."}
+type SessionDescription struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+// A SignalingMessage carries either a session description or an ICE candidate
+// between the peers, as in the perfect negotiation pattern of the W3C WebRTC
+// specification:
+//
+//	{"description": {"type": "answer", "sdp": "..."}}
+//	{"candidate": {"candidate": "candidate:...", "sdpMid": "0"}}
+type SignalingMessage struct {
+	Description *SessionDescription `json:"description,omitempty"`
+	Candidate   *ICECandidateInit   `json:"candidate,omitempty"`
+}
+
+// A SignalingChannel delivers messages to and from the remote peer, for
+// Connect, e.g. over a WebSocket or a data channel. Messages must arrive in
+// the order they are sent.
+type SignalingChannel interface {
+	// Send delivers a message to the remote peer.
+	Send(msg SignalingMessage) error
+
+	// Receive waits for the next message from the remote peer, until ctx is
+	// done.
+	Receive(ctx context.Context) (SignalingMessage, error)
+}
+
+// Connect negotiates a peer connection over ch, then streams the configured
+// local media until ctx is done or the connection fails. Both peers offer
+// straight away, without regard to which of them called; if their offers
+// cross, the one with Config.Polite set yields (see "Perfect Negotiation" in
+// the W3C WebRTC specification). Candidates are trickled in both directions.
+// If the connection fails, ICE is restarted, and the remote peer's offers to
+// restart ICE are answered.
+func Connect(ctx context.Context, ch SignalingChannel, config Config) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pc, err := NewPeerConnectionWithContext(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	n := &negotiator{
+		pc:         pc,
+		ch:         ch,
+		negotiated: make(chan struct{}),
+	}
+	pc.OnIceCandidate = func(c *ICECandidate) {
+		ci := pc.CandidateInit(c)
+		if err := ch.Send(SignalingMessage{Candidate: &ci}); err != nil {
+			log.Warn("Failed to send local ICE candidate: %v", err)
+		}
+	}
+	pc.OnICEFailure = n.restartICE
+	if err := n.offer(); err != nil {
+		return err
+	}
+
+	// Relay messages from the remote peer for as long as the connection
+	// lasts.
+	signalingDone := make(chan error, 1)
+	pc.resources.Go("negotiation", func() {
+		signalingDone <- n.run(ctx)
+	})
+
+	select {
+	case <-n.negotiated:
+	case err := <-signalingDone:
+		if err == nil {
+			err = errNegotiationIncomplete
+		}
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+
+	err = pc.Stream()
+	cancel()
+	<-signalingDone
+	return err
+}
+
+// The state of perfect negotiation on one side of a connection.
+type negotiator struct {
+	pc *PeerConnection
+	ch SignalingChannel
+
+	// Serializes offers and answers, from the remote peer and from ICE
+	// restarts.
+	mu sync.Mutex
+
+	// Whether the remote offer was ignored, along with its candidates.
+	ignoreOffer bool
+
+	// Closed once an offer has been answered, in either direction.
+	negotiated chan struct{}
+	done       bool
+}
+
+// Send an offer to the remote peer.
+func (n *negotiator) offer() error {
+	offer, err := n.pc.CreateOffer()
+	if err != nil {
+		return err
+	}
+	return n.sendOffer(offer)
+}
+
+func (n *negotiator) sendOffer(offer string) error {
+	return n.ch.Send(SignalingMessage{
+		Description: &SessionDescription{Type: SDPTypeOffer, SDP: offer},
+	})
+}
+
+// Restart ICE after the transport fails. If the remote peer does the same at
+// the same time, the offers collide, and are resolved like the first.
+func (n *negotiator) restartICE(error) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	offer, err := n.pc.RestartICE()
+	if err != nil {
+		return err
+	}
+	return n.sendOffer(offer)
+}
+
+// Handle messages from the remote peer until ctx is done, or the signaling
+// channel fails.
+func (n *negotiator) run(ctx context.Context) error {
+	for {
+		msg, err := n.ch.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		switch {
+		case msg.Description != nil:
+			err = n.handleDescription(msg.Description)
+		case msg.Candidate != nil:
+			err = n.handleCandidate(msg.Candidate)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (n *negotiator) handleDescription(desc *SessionDescription) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch desc.Type {
+	case SDPTypeOffer:
+		// The peer connection resolves collisions with our own offer.
+		answer, err := n.pc.SetRemoteDescription(desc.SDP)
+		n.ignoreOffer = err == ErrOfferCollision
+		if n.ignoreOffer {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := n.ch.Send(SignalingMessage{
+			Description: &SessionDescription{Type: SDPTypeAnswer, SDP: answer},
+		}); err != nil {
+			return err
+		}
+
+	case SDPTypeAnswer:
+		if n.pc.SignalingState() != SignalingStateHaveLocalOffer {
+			// Our offer was rolled back.
+			log.Warn("Ignoring unexpected answer from remote peer")
+			return nil
+		}
+		if err := n.pc.SetRemoteAnswer(desc.SDP); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("invalid session description type: %q", desc.Type)
+	}
+
+	if !n.done {
+		n.done = true
+		close(n.negotiated)
+	}
+	return nil
+}
+
+func (n *negotiator) handleCandidate(ci *ICECandidateInit) error {
+	c, err := ci.ICECandidate()
+	if err != nil {
+		// Candidates of an ignored offer may not make sense to us.
+		if !n.ignoreOffer {
+			log.Warn("Invalid remote ICE candidate: %v", err)
+		}
+		return nil
+	}
+	n.pc.AddIceCandidate(c)
+	return nil
+}
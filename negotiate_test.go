@@ -0,0 +1,95 @@
+package alohartc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// One end of an in-memory signaling channel.
+type memChannel struct {
+	in  <-chan SignalingMessage
+	out chan<- SignalingMessage
+}
+
+func newMemChannels() (a, b *memChannel) {
+	ab := make(chan SignalingMessage, 64)
+	ba := make(chan SignalingMessage, 64)
+	return &memChannel{in: ba, out: ab}, &memChannel{in: ab, out: ba}
+}
+
+func (ch *memChannel) Send(msg SignalingMessage) error {
+	ch.out <- msg
+	return nil
+}
+
+func (ch *memChannel) Receive(ctx context.Context) (SignalingMessage, error) {
+	select {
+	case msg := <-ch.in:
+		return msg, nil
+	case <-ctx.Done():
+		return SignalingMessage{}, ctx.Err()
+	}
+}
+
+func TestConnectResolvesGlare(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	// Both peers offer at once. The polite one yields.
+	impolite := loopbackConfig()
+	impolite.LocalVideo = src
+	polite := loopbackConfig()
+	polite.Polite = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, b := newMemChannels()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- Connect(ctx, a, impolite)
+	}()
+	go func() {
+		errs <- Connect(ctx, b, polite)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(ActiveSessions()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not established")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, <-errs)
+	}
+}
+
+func TestNegotiatorIgnoresCollidingOffer(t *testing.T) {
+	pc := Must(NewPeerConnection(loopbackConfig()))
+	defer pc.Close()
+
+	a, b := newMemChannels()
+	n := &negotiator{pc: pc, ch: a, negotiated: make(chan struct{})}
+	if err := n.offer(); err != nil {
+		t.Fatal(err)
+	}
+	offer := <-b.in
+
+	// An impolite peer keeps its own offer.
+	assert.NoError(t, n.handleDescription(offer.Description))
+	assert.True(t, n.ignoreOffer)
+	assert.True(t, pc.offering)
+	assert.Equal(t, 0, len(b.in))
+
+	// A polite one answers instead.
+	pc.polite = true
+	assert.NoError(t, n.handleDescription(offer.Description))
+	assert.Equal(t, SignalingStateStable, pc.SignalingState())
+	answer := <-b.in
+	assert.Equal(t, SDPTypeAnswer, answer.Description.Type)
+}
@@ -0,0 +1,340 @@
+package alohartc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/rtp"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// Payload types of the dynamic formats we offer, by encoding name, unless
+// overridden by Config.PayloadTypes.
+var defaultPayloadTypes = map[string]int{
+	"H264": 102,
+	"opus": 111,
+}
+
+// Return the payload type to offer for an encoding named in
+// defaultPayloadTypes, looking up overrides case-insensitively.
+func offerPayloadType(overrides map[string]int, encoding string) int {
+	for name, pt := range overrides {
+		if strings.EqualFold(name, encoding) {
+			return pt
+		}
+	}
+	return defaultPayloadTypes[encoding]
+}
+
+// Check payload type overrides: each must name a dynamic format we offer, and
+// map it to a distinct payload type in the dynamic range (RFC 3551 §6).
+func checkPayloadTypes(overrides map[string]int) error {
+	for name := range overrides {
+		known := false
+		for encoding := range defaultPayloadTypes {
+			known = known || strings.EqualFold(name, encoding)
+		}
+		if !known {
+			return fmt.Errorf("no configurable payload type for %s", name)
+		}
+	}
+	used := make(map[int]string)
+	for encoding := range defaultPayloadTypes {
+		pt := offerPayloadType(overrides, encoding)
+		if pt < 96 || pt > 127 {
+			return fmt.Errorf("payload type %d for %s outside dynamic range 96-127", pt, encoding)
+		}
+		if other, ok := used[pt]; ok {
+			return fmt.Errorf("payload type %d used for both %s and %s", pt, other, encoding)
+		}
+		used[pt] = encoding
+	}
+	return nil
+}
+
+// Identifiers of the header extensions we offer (see RFC 8285).
+var offerExtensions = []string{
+	rtp.ExtensionAbsSendTime,
+	rtp.ExtensionMID,
+	rtp.ExtensionTransportCC,
+}
+
+var (
+	errNoLocalOffer   = errors.New("no local offer to answer")
+	errAnswerMismatch = errors.New("remote answer does not match local offer")
+)
+
+// CreateOffer returns an SDP offer for a single H.264 video stream, sent from
+// the local video track and received via OnTrack (so OnTrack must be called
+// first, as for SetRemoteDescription), and for an audio stream if there is a
+// local audio track. The remote peer's answer is then passed to
+// SetRemoteAnswer. The offerer is the controlling ICE agent, and normally the
+// DTLS server.
+//
+// Once the connection is established, CreateOffer returns a new offer for the
+// negotiated m-lines, with directions updated for the current local tracks,
+// e.g. from OnNegotiationNeeded.
+func (pc *PeerConnection) CreateOffer() (sdpOffer string, err error) {
+	if pc.negotiated() {
+		return pc.reoffer(false)
+	}
+	offer, err := pc.createOffer()
+	if err != nil {
+		return "", err
+	}
+	pc.offering = true
+	return offer.String(), nil
+}
+
+func (pc *PeerConnection) createOffer() (sdp.Session, error) {
+	s := sdp.Session{
+		Version: 0,
+		Origin: sdp.Origin{
+			Username:       sdpUsername,
+			SessionId:      strconv.FormatInt(time.Now().UnixNano(), 10),
+			SessionVersion: 2,
+			NetworkType:    "IN",
+			AddressType:    "IP4",
+			Address:        "127.0.0.1",
+		},
+		Name: "-",
+		Time: []sdp.Time{
+			{nil, nil},
+		},
+	}
+
+	if pc.iceLite {
+		// [RFC8839 §5.3] Session-level attribute announcing a lite agent.
+		s.Attributes = append(s.Attributes, sdp.Attribute{Key: "ice-lite"})
+	}
+
+	// Offer the profile of the local stream if its SPS is known in advance,
+	// and level 3.1 otherwise. The answerer may send at any level.
+	fmtp := sdp.H264FormatParameters{
+		LevelAsymmetryAllowed: true,
+		PacketizationMode:     1,
+		ProfileLevelID:        offerProfileLevelID(pc.h264Profile, 31),
+	}
+	if sps := localSPS(pc.localVideo); sps != nil {
+		fmtp.ProfileLevelID = offerProfileLevelID(spsProfile(sps), sps.LevelIDC)
+	}
+	// Announce its parameter sets too, as in answerVideoFormat.
+	if pc.localVideo != nil {
+		fmtp.SpropParameterSets = localParameterSets(pc.localVideo)
+	}
+
+	creds, err := newICECredentials()
+	if err != nil {
+		return sdp.Session{}, err
+	}
+
+	// Video first, then audio if there is a local track for it, bundled.
+	direction := offerDirection(pc.localVideo != nil, pc.onTrack != nil)
+	pt := offerPayloadType(pc.payloadTypes, "H264")
+	video := pc.offerMedia("video", "0", creds, direction)
+	video.Format = []string{strconv.Itoa(pt)}
+	video.Attributes = append(video.Attributes,
+		sdp.Attribute{"rtpmap", fmt.Sprintf("%d H264/90000", pt)},
+		sdp.Attribute{"rtcp-fb", fmt.Sprintf("%d nack", pt)},
+		sdp.Attribute{"rtcp-fb", fmt.Sprintf("%d goog-remb", pt)},
+		sdp.Attribute{"fmtp", fmt.Sprintf("%d %s", pt, fmtp.Marshal())},
+	)
+
+	// In game mode, offer to ask the remote peer to render without delay.
+	// IDs are unique across the bundle, so it follows audio level's.
+	if pc.gameMode {
+		video.Attributes = append(video.Attributes,
+			sdp.Attribute{"extmap", fmt.Sprintf("%d %s", len(offerExtensions)+2, rtp.ExtensionPlayoutDelay)})
+	}
+
+	// Cap what we receive, as in createAnswer. The policy for what we send
+	// is only decided once the answer arrives.
+	if isReceiving(direction) && pc.maxReceiveBitrate > 0 {
+		video.Bandwidth = []sdp.Bandwidth{
+			{Type: "AS", Value: pc.maxReceiveBitrate / 1000},
+			{Type: "TIAS", Value: pc.maxReceiveBitrate},
+		}
+	}
+	s.Media = append(s.Media, video)
+
+	if pc.localAudio != nil {
+		format, ok := offerAudioFormat(pc.localAudio.Codec())
+		if !ok {
+			return sdp.Session{}, fmt.Errorf("unsupported audio codec: %s", pc.localAudio.Codec())
+		}
+		if format.codec() == "opus" {
+			format.payloadType = offerPayloadType(pc.payloadTypes, "opus")
+		}
+		audio := pc.offerMedia("audio", "1", creds, offerDirection(true, pc.onTrack != nil))
+		audio.Format = []string{strconv.Itoa(format.payloadType)}
+		audio.Attributes = append(audio.Attributes, sdp.Attribute{"rtpmap", fmt.Sprintf("%d %s", format.payloadType, format.encoding)})
+		if format.fmtp != "" {
+			audio.Attributes = append(audio.Attributes, sdp.Attribute{"fmtp", fmt.Sprintf("%d %s", format.payloadType, format.fmtp)})
+		}
+		audio.Attributes = append(audio.Attributes,
+			sdp.Attribute{"extmap", fmt.Sprintf("%d %s", len(offerExtensions)+1, rtp.ExtensionAudioLevel)})
+		s.Media = append(s.Media, audio)
+	}
+
+	// Describe the tracks we send, once all m-lines are in place.
+	var mids []string
+	for i := range s.Media {
+		mids = append(mids, s.Media[i].GetAttr("mid"))
+	}
+	s.Attributes = append(s.Attributes, sdp.Attribute{"group", "BUNDLE " + strings.Join(mids, " ")})
+	pc.localDescription = s
+	pc.updateLocalTracks(nil)
+	return pc.localDescription, nil
+}
+
+// Return an offered m-line, with the attributes common to audio and video.
+func (pc *PeerConnection) offerMedia(kind, mid string, creds iceCredentials, direction string) sdp.Media {
+	m := sdp.Media{
+		Type:  kind,
+		Port:  9,
+		Proto: "UDP/TLS/RTP/SAVPF",
+		Connection: &sdp.Connection{
+			NetworkType: "IN",
+			AddressType: "IP4",
+			Address:     "0.0.0.0",
+		},
+		Attributes: []sdp.Attribute{
+			{"mid", mid},
+			{"rtcp", "9 IN IP4 0.0.0.0"},
+			{"ice-ufrag", creds.ufrag},
+			{"ice-pwd", creds.pwd},
+			{"ice-options", "trickle"},
+			{"ice-options", "ice2"},
+			{"fingerprint", "sha-256 " + strings.ToUpper(pc.fingerprint)},
+			{"setup", "actpass"},
+			{direction, ""},
+			{"rtcp-mux", ""},
+			{"rtcp-mux-only", ""},
+			{"rtcp-rsize", ""},
+		},
+	}
+	for i, uri := range offerExtensions {
+		m.Attributes = append(m.Attributes, sdp.Attribute{"extmap", fmt.Sprintf("%d %s", i+1, uri)})
+	}
+	return m
+}
+
+// SetRemoteAnswer sets the remote peer's SDP answer to the offer from
+// CreateOffer. ICE gathering then begins, as it does after
+// SetRemoteDescription for an answerer. It also takes the answer to an offer
+// from RestartICE, of which only the ICE credentials are used.
+func (pc *PeerConnection) SetRemoteAnswer(sdpAnswer string) error {
+	if len(sdpAnswer) > maxSDPSize {
+		atomic.AddUint64(&rejectedSDPCount, 1)
+		return errSDPTooLarge
+	}
+	if pc.SignalingState() != SignalingStateHaveLocalOffer {
+		return errNoLocalOffer
+	}
+
+	answer, err := sdp.ParseSession(sdpAnswer)
+	if err != nil {
+		return err
+	}
+	if len(answer.Media) != len(pc.localDescription.Media) {
+		return errAnswerMismatch
+	}
+	if len(pc.remoteDescription.Media) > 0 {
+		// The answer to a new offer in an established session.
+		return pc.applyReofferAnswer(answer)
+	}
+	pc.mediaMutex.Lock()
+	pc.remoteDescription = answer
+	fingerprint := pc.remoteFingerprint()
+	pc.mediaMutex.Unlock()
+
+	// Without a fingerprint the DTLS handshake can't be authenticated.
+	// See https://tools.ietf.org/html/rfc5763#section-5
+	if fingerprint == "" {
+		return errNoRemoteFingerprint
+	}
+
+	// Decide what the remote peer is allowed to receive.
+	if pc.authorize != nil {
+		if pc.policy, err = pc.authorize(sdpAnswer); err != nil {
+			return fmt.Errorf("remote peer not authorized: %v", err)
+		}
+	}
+	if pc.localVideo, err = pc.policy.selectVideo(pc.localVideo); err != nil {
+		return err
+	}
+
+	// The answer may only accept the formats we offered. The video m-line
+	// comes first, and carries the transport.
+	pc.extensions = make(map[string]byte)
+	for i := range answer.Media {
+		local := &pc.localDescription.Media[i]
+		remote := &answer.Media[i]
+		if remote.Port == 0 {
+			if i == 0 {
+				return errNoAcceptableMedia
+			}
+			continue
+		}
+		if !remote.HasAttr("rtcp-mux") {
+			// The offer demanded it (see RFC 8858 Section 5.2).
+			return errNoRTCPMux
+		}
+
+		switch local.Type {
+		case "video":
+			formats := parseH264Formats(remote)
+			if len(formats) == 0 || strconv.Itoa(formats[0].payloadType) != local.Format[0] {
+				return errNoAcceptableMedia
+			}
+			pc.DynamicType = uint8(formats[0].payloadType)
+			pc.remb = formats[0].hasFeedback("goog-remb")
+			pc.reducedSizeRTCP = remote.HasAttr("rtcp-rsize")
+		case "audio":
+			formats := parseAudioFormats(remote)
+			if len(formats) == 0 || strconv.Itoa(formats[0].payloadType) != local.Format[0] {
+				return errNoAcceptableMedia
+			}
+			pc.audioPayloadType = uint8(formats[0].payloadType)
+			pc.audioCodec = formats[0].codec()
+		}
+
+		for _, value := range remote.GetAttrs("extmap") {
+			if id, uri, ok := parseExtmap(value); ok {
+				pc.extensions[uri] = id
+			}
+		}
+	}
+	pc.applyAnswerDirections(&answer)
+
+	local := &pc.localDescription.Media[0]
+	remote := &answer.Media[0]
+
+	// The answerer picks the DTLS role, normally active (see RFC 5763
+	// Section 5), which leaves us the server.
+	switch setup := mediaSetup(&answer, remote); setup {
+	case "active", "":
+		pc.dtlsServer = true
+	case "passive":
+		pc.dtlsServer = false
+	default:
+		return fmt.Errorf("invalid setup attribute in answer: %s", setup)
+	}
+
+	// The offerer controls ICE, unless it is lite (see RFC 8445 Section
+	// 6.1.1).
+	pc.ice.agent.SetControlling(true)
+
+	localCreds := mediaICECredentials(&pc.localDescription, local)
+	remoteCreds := mediaICECredentials(&answer, remote)
+	username := remoteCreds.ufrag + ":" + localCreds.ufrag
+	pc.ice.agent.Configure(local.GetAttr("mid"), username, localCreds.pwd, remoteCreds.pwd)
+
+	pc.startICE(pc.ice, false)
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package alohartc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/rtp"
+)
+
+func TestCheckPayloadTypes(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]int
+		ok        bool
+	}{
+		{"defaults", nil, true},
+		{"h264", map[string]int{"h264": 120}, true},
+		{"both", map[string]int{"H264": 111, "opus": 102}, true},
+		{"unknown", map[string]int{"VP8": 100}, false},
+		{"static", map[string]int{"H264": 0}, false},
+		{"range", map[string]int{"opus": 128}, false},
+		{"clash", map[string]int{"H264": 111}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPayloadTypes(tt.overrides)
+			assert.Equal(t, tt.ok, err == nil, "%v", err)
+		})
+	}
+}
+
+func TestOfferPayloadType(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	config.PayloadTypes = map[string]int{"H264": 120}
+	offerer := Must(NewPeerConnection(config))
+	defer offerer.Close()
+	answerer := Must(NewPeerConnection(loopbackConfig()))
+	defer answerer.Close()
+	receiveLoopback(answerer)
+
+	offer, err := offerer.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.Contains(offer, "a=rtpmap:120 H264/90000"))
+
+	answer, err := answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, offerer.SetRemoteAnswer(answer))
+	assert.Equal(t, uint8(120), offerer.DynamicType)
+}
+
+func TestGameModePlayoutDelay(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	config.GameMode = true
+	offerer := Must(NewPeerConnection(config))
+	defer offerer.Close()
+	answerer := Must(NewPeerConnection(loopbackConfig()))
+	defer answerer.Close()
+	receiveLoopback(answerer)
+
+	offer, err := offerer.CreateOffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.Contains(offer, "a=extmap:5 "+rtp.ExtensionPlayoutDelay))
+
+	answer, err := answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, offerer.SetRemoteAnswer(answer))
+	assert.Equal(t, byte(5), offerer.extensions[rtp.ExtensionPlayoutDelay])
+}
+
+func TestNewPeerConnectionRejectsPayloadTypes(t *testing.T) {
+	config := loopbackConfig()
+	config.PayloadTypes = map[string]int{"H264": 96, "opus": 96}
+	_, err := NewPeerConnection(config)
+	assert.Error(t, err)
+}
@@ -12,18 +12,23 @@ import (
 	"bytes"
 	"context"
 	"crypto"
-	"crypto/rand"
+	"crypto/ecdsa"
 	"crypto/x509"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lanikai/alohartc/internal/dtls" // subtree merged pions/dtls
 	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/lanikai/alohartc/internal/leak"
 	"github.com/lanikai/alohartc/internal/media"
 	"github.com/lanikai/alohartc/internal/mux"
+	"github.com/lanikai/alohartc/internal/packet"
 	"github.com/lanikai/alohartc/internal/rtp"
 	"github.com/lanikai/alohartc/internal/sdp"
 )
@@ -43,14 +48,49 @@ const (
 
 	maxSRTCPSize = 65536
 
-	connectTimeout = 10 * time.Second
+	defaultConnectTimeout = 10 * time.Second
+
+	// How long Close waits for the connection to be torn down, and how long
+	// teardown waits for in-flight media to be written.
+	closeTimeout = 2 * time.Second
+	flushTimeout = 500 * time.Millisecond
+
+	// Lowest video bitrate the bandwidth allocator will assign, in bits per
+	// second. Below this the picture is unwatchable anyway.
+	minVideoBitrate = 150000
+
+	// Highest bitrate probed for right after connecting, by default, in bits
+	// per second.
+	defaultProbeBitrate = 3000000
 )
 
+var (
+	errNoRemoteFingerprint = errors.New("remote description has no DTLS fingerprint")
+	errNoAcceptableMedia   = errors.New("remote description offers no acceptable media")
+	errAlreadyStreaming    = errors.New("peer connection is already streaming")
+	errSignerNotECDSA      = errors.New("DTLS signer must have an ECDSA public key")
+	errClosed              = errors.New("peer connection closed")
+	errNoRTCPMux           = errors.New("remote description does not multiplex RTCP with RTP (rtcp-mux)")
+)
+
+// ErrICEFailed is returned by Stream when every ICE candidate pair fails, once
+// local gathering has finished and the remote peer has signaled
+// end-of-candidates (see AddIceCandidate).
+var ErrICEFailed = ice.ErrFailed
+
 type PeerConnection struct {
+	// Most recently sampled outgoing bitrate, in bits per second. Accessed
+	// atomically, so must be first for 64-bit alignment on 32-bit platforms.
+	bitrate int64
+
 	// Local context (for signaling)
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// Whether Stream has been called, and closed once it returns.
+	streaming  int32
+	streamDone chan struct{}
+
 	// Local session description
 	localDescription sdp.Session
 
@@ -60,12 +100,63 @@ type PeerConnection struct {
 	// RTP payload type (negotiated via SDP)
 	DynamicType uint8
 
-	iceAgent         *ice.Agent
+	// Current ICE agent, and the channel of remote candidates for the most
+	// recently started one. Both are replaced by an ICE restart.
+	iceMutex         sync.Mutex
+	ice              *iceSession
 	remoteCandidates chan ice.Candidate
 
+	// Configuration for new ICE agents.
+	iceConfig ice.AgentConfig
+
+	// Agent awaiting the remote answer to an offer from RestartICE, and the
+	// local description to restore if the offer is rolled back.
+	pendingICE        *iceSession
+	stableDescription string
+
+	// Restarted agents, for Stream to connect.
+	iceRestarts chan *iceSession
+
 	// Callback when a local ICE candidate is available.
 	OnIceCandidate func(*ice.Candidate)
 
+	// Callback when ICE gathering starts, for each agent, and when it
+	// completes, just before OnIceCandidate(nil). Must return quickly.
+	OnICEGatheringStateChange func(state string)
+
+	// Local candidates of the most recently started ICE agent. Guarded by
+	// iceMutex.
+	gathering gathering
+
+	// Callback for each step of ICE connectivity establishment, e.g. for
+	// connection diagnostics. Must be set before SetRemoteDescription, and
+	// must return quickly.
+	OnIceEvent func(ice.Event)
+
+	// Callback when the remote DTLS certificate does not match the
+	// fingerprint in the remote description, e.g. because of a
+	// man-in-the-middle. The connection is aborted regardless.
+	OnCertificateError func(error)
+
+	// Callback when the remote peer turns out to send with the SSRC of our
+	// video (see RFC 3550 Section 8.2), which is then changed. Peers that
+	// identify the stream by MID follow the change; others may need the
+	// application to renegotiate. Must return quickly.
+	OnSSRCCollision func(oldSSRC, newSSRC uint32)
+
+	// Callback when a change of local tracks, by AddTrack or RemoveTrack,
+	// needs a new offer/answer exchange to take effect, e.g. by sending the
+	// offer from CreateOffer.
+	OnNegotiationNeeded func()
+
+	// Callback when the ICE transport fails while streaming, e.g. because
+	// the network changed. Stream waits for it to arrange an ICE restart,
+	// by exchanging the offer from RestartICE for an answer or by asking the
+	// remote peer for a new offer, and then for the restarted agent to
+	// connect within the connect timeout. If the callback is nil or returns
+	// an error, Stream ends with the ICE failure instead.
+	OnICEFailure func(err error) error
+
 	// Local certificate
 	certificate *x509.Certificate // Public key
 	privateKey  crypto.PrivateKey // Private key
@@ -74,6 +165,114 @@ type PeerConnection struct {
 	// Media tracks
 	localAudio media.AudioSource
 	localVideo media.VideoSource
+
+	// Whether the local ICE agent is lite.
+	iceLite bool
+
+	// Whether answers wait for, and carry, the local candidates.
+	embedCandidates bool
+
+	// Whether to optimize for latency over quality.
+	gameMode bool
+
+	// Profile of the local H.264 encoder, used to choose among offered formats.
+	h264Profile H264Profile
+
+	// Configured path MTU, or 0 to discover it.
+	mtu int
+
+	// Cap on the bitrate of received video, or 0 for none.
+	maxReceiveBitrate int
+
+	// Whether REMB feedback was negotiated.
+	remb bool
+
+	// Policy for degrading the local video under congestion, or nil.
+	degradation *DegradationPolicy
+
+	// Bytes that may be sent back-to-back before packets are paced.
+	pacingBurst int
+
+	// Highest bitrate to probe for once connected, or negative to not probe.
+	probeBitrate int
+
+	// Which video to drop when the sender falls behind.
+	dropPolicy DropPolicy
+
+	// Payload types to offer for dynamic formats, overriding
+	// defaultPayloadTypes.
+	payloadTypes map[string]int
+
+	// Whether to keep our SSRC even if the remote peer uses it too.
+	ignoreSSRCCollisions bool
+
+	// How long Stream waits for ICE to connect.
+	connectTimeout time.Duration
+
+	// Callback to authorize the remote peer.
+	authorize Authorizer
+
+	// Media limits for the remote peer, as decided by authorize.
+	policy StreamPolicy
+
+	// Negotiated RTP header extension IDs, keyed by URI.
+	extensions map[string]byte
+
+	// Whether reduced-size RTCP was negotiated.
+	reducedSizeRTCP bool
+
+	// Negotiated direction of the video we send and receive.
+	videoDirection string
+
+	// Negotiated direction and format of the audio we send and receive, if
+	// audio was accepted.
+	audioDirection   string
+	audioPayloadType uint8
+	audioCodec       string
+
+	// Whether we take the DTLS server role, as negotiated by the setup
+	// attribute.
+	dtlsServer bool
+
+	// Whether CreateOffer has been called, so that the remote description is
+	// an answer.
+	offering bool
+
+	// Whether to yield when offers collide. See Config.Polite.
+	polite bool
+
+	// Time at which Stream() established the connection. Guarded by
+	// mediaMutex.
+	connectedAt time.Time
+
+	// Callback for tracks received from the remote peer. See OnTrack.
+	onTrack func(*RemoteTrack)
+
+	// Identifiers of the video and audio tracks we send.
+	videoIDs localTrackIDs
+	audioIDs localTrackIDs
+
+	// Video stream, once established, if negotiated. Guarded by mediaMutex.
+	videoStream *rtp.Stream
+
+	// Media streams while streaming, and the senders and receivers running
+	// on them. The mutex also guards the descriptions and media directions
+	// against renegotiation once negotiated, and the remote description
+	// against readers such as SessionInfo.
+	mediaMutex sync.Mutex
+	media      *mediaStreams
+
+	// Multiplexer of the connected ICE data stream, once established.
+	// Guarded by mediaMutex.
+	dataMux *mux.Mux
+
+	// DTLS connection, once the handshake completes and dtlsReady is closed.
+	dtlsConn  *dtls.Conn
+	dtlsReady chan struct{}
+
+	// Accounting of owned resources, or nil if not tracked.
+	resources   *leak.Tracker
+	panicOnLeak bool
 }
 
 // Must is a helper that wraps a call to a function returning
@@ -94,16 +293,75 @@ func NewPeerConnection(config Config) (*PeerConnection, error) {
 
 // NewPeerConnectionWithContext creates a new peer connection object
 func NewPeerConnectionWithContext(ctx context.Context, config Config) (*PeerConnection, error) {
+	if err := checkPayloadTypes(config.PayloadTypes); err != nil {
+		return nil, err
+	}
+	if err := config.PortRange.Check(); err != nil {
+		return nil, err
+	}
+	if err := config.NAT1To1.Check(); err != nil {
+		return nil, err
+	}
+
 	// Create cancelable context, derived from upstream context
 	ctx, cancel := context.WithCancel(ctx)
 
+	var resources *leak.Tracker
+	if config.TrackResources {
+		resources = leak.NewTracker()
+	}
+
 	// Create new peer connection (with local audio and video)
 	pc := &PeerConnection{
-		ctx:              ctx,
-		cancel:           cancel,
-		localAudio:       config.LocalAudio,
-		localVideo:       config.LocalVideo,
-		iceAgent:         ice.NewAgent(),
+		ctx:        ctx,
+		cancel:     cancel,
+		streamDone: make(chan struct{}),
+		dtlsReady:  make(chan struct{}),
+		localAudio: config.LocalAudio,
+		localVideo: config.LocalVideo,
+		authorize:  config.Authorize,
+		iceLite:    config.ICELite,
+		gameMode:   config.GameMode,
+		polite:     config.Polite,
+
+		embedCandidates: config.EmbedCandidates,
+
+		h264Profile: config.H264Profile,
+		mtu:         config.MTU,
+
+		maxReceiveBitrate: config.MaxReceiveBitrate,
+		degradation:       config.Degradation,
+		pacingBurst:       config.PacingBurst,
+		probeBitrate:      config.ProbeBitrate,
+		dropPolicy:        config.DropPolicy,
+		payloadTypes:      config.PayloadTypes,
+
+		ignoreSSRCCollisions: config.IgnoreSSRCCollisions,
+
+		resources:   resources,
+		panicOnLeak: config.PanicOnLeak,
+
+		connectTimeout: config.ConnectTimeout,
+		iceConfig: ice.AgentConfig{
+			InterfaceFilter:   config.InterfaceFilter,
+			Loopback:          config.ICELoopback,
+			Lite:              config.ICELite,
+			LANOnly:           config.LANOnly,
+			MDNSCandidates:    config.LANOnly,
+			TURNServers:       config.TURNServers,
+			NAT1To1:           config.NAT1To1,
+			GatheringTimeout:  config.ICEGatheringTimeout,
+			PortRange:         config.PortRange,
+			DSCP:              config.DSCP,
+			SocketPriority:    config.SocketPriority,
+			ReadBufferSize:    config.ReceiveBufferSize,
+			WriteBufferSize:   config.SendBufferSize,
+			KeepaliveInterval: config.ICEKeepaliveInterval,
+			ConsentTimeout:    config.DisconnectedTimeout,
+			ReadTimeout:       config.FailedTimeout,
+			Resources:         resources,
+		},
+		iceRestarts:      make(chan *iceSession, 1),
 		remoteCandidates: make(chan ice.Candidate, 4),
 
 		// Set initial dummy handler for local ICE candidates.
@@ -112,10 +370,27 @@ func NewPeerConnectionWithContext(ctx context.Context, config Config) (*PeerConn
 		},
 	}
 
+	if pc.connectTimeout <= 0 {
+		pc.connectTimeout = defaultConnectTimeout
+	}
+	pc.ice = &iceSession{agent: ice.NewAgent(pc.iceConfig)}
+
 	var err error
 
-	// Dynamically generate a certificate for the peer connection
-	if pc.certificate, pc.privateKey, err = dtls.GenerateSelfSigned(); err != nil {
+	if config.Signer != nil {
+		// Use the configured key, which may live in a secure element.
+		if _, ok := config.Signer.Public().(*ecdsa.PublicKey); !ok {
+			return nil, errSignerNotECDSA
+		}
+		pc.privateKey = config.Signer
+		pc.certificate = config.Certificate
+		if pc.certificate == nil {
+			if pc.certificate, err = dtls.SelfSign(config.Signer); err != nil {
+				return nil, err
+			}
+		}
+	} else if pc.certificate, pc.privateKey, err = dtls.GenerateSelfSigned(); err != nil {
+		// Dynamically generate a certificate for the peer connection
 		return nil, err
 	}
 
@@ -124,6 +399,17 @@ func NewPeerConnectionWithContext(ctx context.Context, config Config) (*PeerConn
 		return nil, err
 	}
 
+	if pc.videoIDs, err = newLocalTrackIDs(); err != nil {
+		return nil, err
+	}
+	if pc.audioIDs, err = newLocalTrackIDs(); err != nil {
+		return nil, err
+	}
+	// Audio and video belong to one stream, with one CNAME, so that the
+	// remote peer synchronizes them (see RFC 7022 Section 4).
+	pc.audioIDs.cname = pc.videoIDs.cname
+	pc.audioIDs.streamID = pc.videoIDs.streamID
+
 	return pc, nil
 }
 
@@ -143,81 +429,113 @@ func (pc *PeerConnection) createAnswer() (sdp.Session, error) {
 		Time: []sdp.Time{
 			{nil, nil},
 		},
-		Attributes: []sdp.Attribute{
-			{"group", pc.remoteDescription.GetAttr("group")},
-		},
 	}
 
+	if pc.iceLite {
+		// [RFC8839 §5.3] Session-level attribute announcing a lite agent.
+		s.Attributes = append(s.Attributes, sdp.Attribute{Key: "ice-lite"})
+	}
+
+	// The SPS of the local stream, if known in advance, decides its profile.
+	profile := pc.h264Profile
+	sps := localSPS(pc.localVideo)
+	if sps != nil {
+		profile = spsProfile(sps)
+	}
+
+	// Answer each offered m-line in order (see RFC 3264 Section 6). Only a
+	// single H.264 video stream and a single audio stream are supported;
+	// anything else is rejected. With BUNDLE, one set of ICE credentials
+	// covers the whole session (see RFC 8843 Section 7.1.1). Without it, only
+	// the first accepted m-line gets a transport.
+	bundled := strings.HasPrefix(pc.remoteDescription.GetAttr("group"), "BUNDLE")
+	creds, err := newICECredentials()
+	if err != nil {
+		return sdp.Session{}, err
+	}
+
+	pc.extensions = make(map[string]byte)
+	pc.videoDirection, pc.audioDirection = "", ""
+	var bundle []string
+	accepted, announced, unmuxed := false, false, false
 	for _, remoteMedia := range pc.remoteDescription.Media {
+		mid := remoteMedia.GetAttr("mid")
+		if remoteMedia.Port == 0 || accepted && !bundled {
+			log.Info("Rejecting %s m-line with mid %s", remoteMedia.Type, mid)
+			s.Media = append(s.Media, rejectMedia(&remoteMedia))
+			continue
+		}
 
-		type payloadTypeAttributes struct {
-			nack   bool
-			pli    bool
-			fmtp   string
-			codec  string
-			reject bool
+		// The ICE agent has a single component, so RTCP must share it with
+		// RTP (see RFC 5761 Section 5.1.1).
+		if remoteMedia.Type != "application" && !remoteMedia.HasAttr("rtcp-mux") {
+			log.Warn("Rejecting %s m-line with mid %s: rtcp-mux not offered", remoteMedia.Type, mid)
+			s.Media = append(s.Media, rejectMedia(&remoteMedia))
+			unmuxed = true
+			continue
 		}
 
-		supportedPayloadTypes := make(map[int]*payloadTypeAttributes)
-
-		// Search attributes for supported codecs
-		for _, attr := range remoteMedia.Attributes {
-			var pt int
-			var text string
-
-			// Parse payload type from attribute. Will bin by payload type.
-			pt = -1
-			switch attr.Key {
-			case "fmtp", "rtcp-fb", "rtpmap":
-				if _, err := fmt.Sscanf(
-					attr.Value, "%3d %s", &pt, &text,
-				); err != nil {
-					log.Warn(fmt.Sprintf("malformed %s", attr.Key))
-					break // switch
-				}
+		// Send and receive as far as both peers want to.
+		offered := mediaDirection(&pc.remoteDescription, &remoteMedia)
+		var (
+			direction string
+			video     h264Format
+			audio     audioFormat
+			ids       localTrackIDs
+			ok        bool
+		)
+		switch {
+		case remoteMedia.Type == "video" && pc.videoDirection == "":
+			// Pick the one offered H.264 format matching the local encoder.
+			if video, ok = selectH264Format(&remoteMedia, profile); !ok {
+				log.Warn("no compatible H.264 format offered for mid %s", mid)
+				break
 			}
-			if pt < 0 {
-				continue // Ignore unsupported attributes
+			if sps != nil && !video.supportsLevel(sps.LevelIDC) {
+				log.Warn("local stream level %d exceeds offered profile-level-id %06x for mid %s",
+					sps.LevelIDC, video.params.ProfileLevelID, mid)
 			}
-
-			if _, ok := supportedPayloadTypes[pt]; !ok {
-				supportedPayloadTypes[pt] = &payloadTypeAttributes{}
+			direction = answerDirection(offered, pc.localVideo != nil, pc.onTrack != nil)
+			pc.videoDirection = direction
+			ids = pc.videoIDs
+
+		case remoteMedia.Type == "audio" && pc.audioDirection == "":
+			// Audio is only accepted if it flows in at least one direction.
+			direction = answerDirection(offered, pc.localAudio != nil, pc.onTrack != nil)
+			if direction == directionInactive {
+				break
 			}
-			switch attr.Key {
-			case "rtpmap":
-				switch text {
-				case "H264/90000":
-					supportedPayloadTypes[pt].codec = text
-				}
-			case "rtcp-fb":
-				switch text {
-				case "nack":
-					supportedPayloadTypes[pt].nack = true
-				}
-			case "fmtp":
-				supportedPayloadTypes[pt].fmtp = text
-				if !strings.Contains(text, "packetization-mode=1") {
-					supportedPayloadTypes[pt].reject = true
-				}
-				if !strings.Contains(text, "profile-level-id=42") {
-					supportedPayloadTypes[pt].reject = true
-				}
+			// Pick the offered format of the local encoder, if any.
+			codec := ""
+			if pc.localAudio != nil {
+				codec = pc.localAudio.Codec()
+			}
+			if audio, ok = selectAudioFormat(&remoteMedia, codec); !ok {
+				log.Warn("no compatible audio format offered for mid %s", mid)
+				break
 			}
+			pc.audioDirection = direction
+			ids = pc.audioIDs
 		}
-
-		// Require 24 and 128 bits of randomness for ufrag and pwd, respectively
-		rnd := make([]byte, 3+16)
-		if _, err := rand.Read(rnd); err != nil {
-			return sdp.Session{}, err
+		if !ok {
+			log.Info("Rejecting %s m-line with mid %s", remoteMedia.Type, mid)
+			s.Media = append(s.Media, rejectMedia(&remoteMedia))
+			continue
+		}
+		accepted = true
+		bundle = append(bundle, mid)
+
+		// Take the DTLS client role, unless the offerer insists on it (see
+		// RFC 5763 Section 5).
+		setup := "active"
+		pc.dtlsServer = mediaSetup(&pc.remoteDescription, &remoteMedia) == "active"
+		if pc.dtlsServer {
+			setup = "passive"
 		}
-
-		// Base64 encode ice-ufrag and ice-pwd
-		ufrag := base64.StdEncoding.EncodeToString(rnd[0:3])
-		pwd := base64.StdEncoding.EncodeToString(rnd[3:])
 
 		// Media description with first part of attributes
 		m := sdp.Media{
-			Type:  "video",
+			Type:  remoteMedia.Type,
 			Port:  9,
 			Proto: "UDP/TLS/RTP/SAVPF",
 			Connection: &sdp.Connection{
@@ -226,122 +544,271 @@ func (pc *PeerConnection) createAnswer() (sdp.Session, error) {
 				Address:     "0.0.0.0",
 			},
 			Attributes: []sdp.Attribute{
-				{"mid", remoteMedia.GetAttr("mid")},
+				{"mid", mid},
 				{"rtcp", "9 IN IP4 0.0.0.0"},
-				{"ice-ufrag", ufrag},
-				{"ice-pwd", pwd},
+				{"ice-ufrag", creds.ufrag},
+				{"ice-pwd", creds.pwd},
 				{"ice-options", "trickle"},
 				{"ice-options", "ice2"},
 				{"fingerprint", "sha-256 " + strings.ToUpper(pc.fingerprint)},
-				{"setup", "active"},
-				{"sendonly", ""},
+				{"setup", setup},
+				{direction, ""},
 				{"rtcp-mux", ""},
-				{"rtcp-rsize", ""},
 			},
 		}
 
-		// Additional attributes per payload type
-		for pt, a := range supportedPayloadTypes {
-			switch {
-			case "H264/90000" == a.codec && "" != a.fmtp && !a.reject:
-				m.Attributes = append(
-					m.Attributes,
-					sdp.Attribute{"rtpmap", fmt.Sprintf("%d %s", pt, a.codec)},
-				)
-
-				if a.nack {
-					m.Attributes = append(
-						m.Attributes,
-						sdp.Attribute{"rtcp-fb", fmt.Sprintf("%d nack", pt)},
-					)
-				}
+		// Only accept reduced-size RTCP if offered (see RFC 5506 Section 5).
+		pc.reducedSizeRTCP = remoteMedia.HasAttr("rtcp-rsize")
+		if pc.reducedSizeRTCP {
+			m.Attributes = append(m.Attributes, sdp.Attribute{"rtcp-rsize", ""})
+		}
 
-				m.Attributes = append(
-					m.Attributes,
-					sdp.Attribute{"fmtp", fmt.Sprintf("%d %s", pt, a.fmtp)},
-				)
-				m.Format = append(m.Format, strconv.Itoa(pt))
-
-				// TODO [chris] Fix payload type selection. Currently we're
-				// rejecting essentially all but one payload type, assigned
-				// here. However, we should be prepared to receive RTP flows
-				// for each accepted payload type.
-				pc.DynamicType = uint8(pt)
+		if m.Type == "video" {
+			pc.answerVideoFormat(&m, video, direction)
+		} else {
+			// Attributes for the selected payload type, echoing the
+			// offered format parameters.
+			pt := audio.payloadType
+			m.Attributes = append(m.Attributes, sdp.Attribute{"rtpmap", fmt.Sprintf("%d %s", pt, audio.encoding)})
+			if audio.fmtp != "" {
+				m.Attributes = append(m.Attributes, sdp.Attribute{"fmtp", fmt.Sprintf("%d %s", pt, audio.fmtp)})
 			}
+			m.Format = append(m.Format, strconv.Itoa(pt))
+			pc.audioPayloadType = uint8(pt)
+			pc.audioCodec = audio.codec()
 		}
 
-		// Final attributes
-		m.Attributes = append(
-			m.Attributes,
-			[]sdp.Attribute{
-				{"ssrc", "2541098696 cname:cYhx/N8U7h7+3GW3"},
-				{"ssrc", "2541098696 msid:SdWLKyaNRoUSWQ7BzkKGcbCWcuV7rScYxCAv e9b60276-a415-4a66-8395-28a893918d4c"},
-				{"ssrc", "2541098696 mslabel:SdWLKyaNRoUSWQ7BzkKGcbCWcuV7rScYxCAv"},
-				{"ssrc", "2541098696 label:e9b60276-a415-4a66-8395-28a893918d4c"},
-			}...,
-		)
+		// Accept the header extensions we can send, with the offered IDs
+		// (see RFC 8285 Section 6). Bundled m-lines share the IDs.
+		for _, value := range remoteMedia.GetAttrs("extmap") {
+			if id, uri, ok := parseExtmap(value); ok {
+				pc.extensions[uri] = id
+				m.Attributes = append(m.Attributes, sdp.Attribute{"extmap", fmt.Sprintf("%d %s", id, uri)})
+			}
+		}
+
+		// Final attributes, describing the stream we send.
+		if isSending(direction) {
+			m.Attributes = append(m.Attributes, trackAttributes(ids)...)
+			if !announced {
+				// Both tracks belong to the same stream.
+				s.Attributes = append(s.Attributes, sdp.Attribute{"msid-semantic", "WMS " + ids.streamID})
+				announced = true
+			}
+		}
 
 		s.Media = append(s.Media, m)
 	}
 
+	if !accepted {
+		if unmuxed {
+			return sdp.Session{}, errNoRTCPMux
+		}
+		return sdp.Session{}, errNoAcceptableMedia
+	}
+
+	// Bundle the accepted m-lines, leaving out rejected ones (see RFC 8843
+	// Section 7.3.3).
+	if bundled {
+		s.Attributes = append(s.Attributes, sdp.Attribute{"group", "BUNDLE " + strings.Join(bundle, " ")})
+	}
+
 	pc.localDescription = s
 	return s, nil
 }
 
+// Add the attributes of the selected H.264 format to an answered video m-line.
+func (pc *PeerConnection) answerVideoFormat(m *sdp.Media, format h264Format, direction string) {
+	// Advertise the cap on what we receive, if any (see RFC 3890). A limit
+	// on what we send is applied to the encoder instead, since the remote
+	// peer can't enforce it.
+	if limit := pc.maxReceiveBitrate; isReceiving(direction) && limit > 0 {
+		m.Bandwidth = []sdp.Bandwidth{
+			{Type: "AS", Value: limit / 1000},
+			{Type: "TIAS", Value: limit},
+		}
+	}
+
+	// Attributes for the selected payload type, echoing the offered format
+	// parameters (see RFC 6184 Section 8.2.2).
+	pt := format.payloadType
+	m.Attributes = append(m.Attributes, sdp.Attribute{"rtpmap", fmt.Sprintf("%d H264/90000", pt)})
+	if format.hasFeedback("nack") {
+		m.Attributes = append(m.Attributes, sdp.Attribute{"rtcp-fb", fmt.Sprintf("%d nack", pt)})
+	}
+	pc.remb = format.hasFeedback("goog-remb")
+	if pc.remb {
+		m.Attributes = append(m.Attributes, sdp.Attribute{"rtcp-fb", fmt.Sprintf("%d goog-remb", pt)})
+	}
+	fmtp := format.fmtp
+	if isSending(direction) {
+		// Announce parameter sets known in advance, so that the remote peer
+		// can decode from the first keyframe even if the source sends them
+		// in band only once, e.g. at the start of a file.
+		if sets := localParameterSets(pc.localVideo); len(sets) > 0 {
+			fmtp = withSpropParameterSets(fmtp, sets)
+		}
+	}
+	if fmtp != "" {
+		m.Attributes = append(m.Attributes, sdp.Attribute{"fmtp", fmt.Sprintf("%d %s", pt, fmtp)})
+	}
+	m.Format = append(m.Format, strconv.Itoa(pt))
+	pc.DynamicType = uint8(pt)
+}
+
+// Return the DTLS role attribute of a media section (see RFC 4145 Section 4),
+// which may be given at session level.
+func mediaSetup(s *sdp.Session, m *sdp.Media) string {
+	if setup := m.GetAttr("setup"); setup != "" {
+		return setup
+	}
+	return s.GetAttr("setup")
+}
+
+// Parse an extmap attribute value, reporting whether it is for a header
+// extension we can send.
+func parseExtmap(value string) (id byte, uri string, ok bool) {
+	var n int
+	if _, err := fmt.Sscanf(value, "%d %s", &n, &uri); err != nil {
+		// Ignore the optional direction, e.g. "3/sendrecv".
+		if _, err := fmt.Sscanf(value, "%d/%s %s", &n, new(string), &uri); err != nil {
+			log.Warn("malformed extmap: %s", value)
+			return 0, "", false
+		}
+	}
+	switch uri {
+	case rtp.ExtensionAbsSendTime, rtp.ExtensionMID, rtp.ExtensionTransportCC, rtp.ExtensionAudioLevel, rtp.ExtensionPlayoutDelay:
+		return byte(n), uri, n > 0 && n < 256
+	}
+	return 0, "", false
+}
+
+// Answer an offered m-line we don't support, by rejecting it with port 0 (see
+// RFC 3264 Section 6). The offered formats are echoed, since an m-line must
+// list at least one.
+func rejectMedia(offered *sdp.Media) sdp.Media {
+	m := sdp.Media{
+		Type:   offered.Type,
+		Port:   0,
+		Proto:  offered.Proto,
+		Format: offered.Format,
+	}
+	if mid := offered.GetAttr("mid"); mid != "" {
+		m.Attributes = []sdp.Attribute{{"mid", mid}}
+	}
+	return m
+}
+
 // Set remote SDP offer. Return SDP answer.
 func (pc *PeerConnection) SetRemoteDescription(sdpOffer string) (sdpAnswer string, err error) {
+	if len(sdpOffer) > maxSDPSize {
+		atomic.AddUint64(&rejectedSDPCount, 1)
+		return "", errSDPTooLarge
+	}
+
 	offer, err := sdp.ParseSession(sdpOffer)
 	if err != nil {
 		return
 	}
+	if err := pc.resolveCollision(); err != nil {
+		return "", err
+	}
+	if len(pc.localDescription.Media) > 0 && len(pc.remoteDescription.Media) > 0 {
+		// A new offer in an established session, from either side.
+		if sdpAnswer, err = pc.answerReoffer(offer); err != nil || !pc.embedCandidates {
+			return
+		}
+		return pc.waitForCandidates()
+	}
+	pc.mediaMutex.Lock()
 	pc.remoteDescription = offer
+	fingerprint := pc.remoteFingerprint()
+	pc.mediaMutex.Unlock()
+
+	// Without a fingerprint the DTLS handshake can't be authenticated.
+	// See https://tools.ietf.org/html/rfc5763#section-5
+	if fingerprint == "" {
+		return "", errNoRemoteFingerprint
+	}
+
+	// Decide what the remote peer is allowed to receive.
+	if pc.authorize != nil {
+		if pc.policy, err = pc.authorize(sdpOffer); err != nil {
+			return "", fmt.Errorf("remote peer not authorized: %v", err)
+		}
+	}
+	if pc.localVideo, err = pc.policy.selectVideo(pc.localVideo); err != nil {
+		return
+	}
 
 	answer, err := pc.createAnswer()
 	if err != nil {
 		return
 	}
 
-	mid := offer.Media[0].GetAttr("mid")
-	remoteUfrag := offer.Media[0].GetAttr("ice-ufrag")
-	localUfrag := answer.Media[0].GetAttr("ice-ufrag")
-	username := remoteUfrag + ":" + localUfrag
-	localPassword := answer.Media[0].GetAttr("ice-pwd")
-	remotePassword := offer.Media[0].GetAttr("ice-pwd")
-	pc.iceAgent.Configure(mid, username, localPassword, remotePassword)
+	// A full agent controls a lite one (see RFC 8445 Section 6.1.1).
+	pc.ice.agent.SetControlling(offer.HasAttr("ice-lite"))
+
+	// Connect the transport of the accepted m-line, which carries all
+	// media when bundled.
+	for i := range answer.Media {
+		if answer.Media[i].Port == 0 {
+			continue
+		}
+		local := mediaICECredentials(&answer, &answer.Media[i])
+		remote := mediaICECredentials(&offer, &offer.Media[i])
+		username := remote.ufrag + ":" + local.ufrag
+		pc.ice.agent.Configure(answer.Media[i].GetAttr("mid"), username, local.pwd, remote.pwd)
+		break
+	}
 
 	// ICE gathering begins implicitly after offer/answer exchange.
-	go pc.startGathering()
+	pc.startICE(pc.ice, false)
 
+	if pc.embedCandidates {
+		return pc.waitForCandidates()
+	}
 	return answer.String(), nil
 }
 
-func (pc *PeerConnection) startGathering() {
+func (pc *PeerConnection) startGathering(ctx context.Context, agent *ice.Agent, rcand <-chan ice.Candidate) {
 	log.Debug("Starting ICE gathering")
-	lcand := pc.iceAgent.Start(pc.ctx, pc.remoteCandidates)
+	if pc.OnIceEvent != nil {
+		agent.OnEvent(pc.OnIceEvent)
+	}
+	lcand := agent.Start(ctx, rcand)
 	for {
 		select {
 		case c, more := <-lcand:
 			if !more {
 				// Signal end-of-candidates.
+				pc.completeGathering(agent)
 				pc.OnIceCandidate(nil)
 				return
 			}
+			pc.addGatheredCandidate(agent, c)
 			pc.OnIceCandidate(&c)
-		case <-pc.ctx.Done():
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// AddIceCandidate adds a remote ICE candidate.
+// AddIceCandidate adds a remote ICE candidate, for the ICE agent started most
+// recently. A nil candidate signals end-of-candidates.
 func (pc *PeerConnection) AddIceCandidate(c *ice.Candidate) {
-	if c == nil {
+	pc.iceMutex.Lock()
+	rcand := pc.remoteCandidates
+	if c == nil && rcand != nil {
 		// nil means end-of-candidates.
-		close(pc.remoteCandidates)
+		close(rcand)
 		pc.remoteCandidates = nil
-	} else {
+	}
+	pc.iceMutex.Unlock()
+
+	if c != nil && rcand != nil {
 		select {
-		case pc.remoteCandidates <- *c:
+		case rcand <- *c:
 		case <-pc.ctx.Done():
 		}
 	}
@@ -349,37 +816,62 @@ func (pc *PeerConnection) AddIceCandidate(c *ice.Candidate) {
 
 // Stream establishes a connection to the remote peer, and streams media to/from
 // the configured tracks. Blocks until an error occurs, or until the
-// PeerConnection is closed.
+// PeerConnection is closed. Returns ErrICEFailed if no connection can be
+// established.
 func (pc *PeerConnection) Stream() error {
+	if !atomic.CompareAndSwapInt32(&pc.streaming, 0, 1) {
+		return errAlreadyStreaming
+	}
+	defer close(pc.streamDone)
+
 	// Wait for ICE agent to establish a connection.
-	timeoutCtx, _ := context.WithTimeout(pc.ctx, connectTimeout)
-	dataStream, err := pc.iceAgent.GetDataStream(timeoutCtx)
+	timeoutCtx, _ := context.WithTimeout(pc.ctx, pc.connectTimeout)
+	dataStream, err := pc.currentICE().GetDataStream(timeoutCtx)
 	if err != nil {
 		return err
 	}
-	defer dataStream.Close()
+	conn := newICEConn(dataStream)
+	defer conn.Close()
 
 	// Instantiate a new net.Conn multiplexer
-	dataMux := mux.NewMux(dataStream, 8192)
+	dataMux := mux.NewMux(conn, 8192)
 	defer dataMux.Close()
+	pc.mediaMutex.Lock()
+	pc.dataMux = dataMux
+	pc.mediaMutex.Unlock()
 
 	// Instantiate a new endpoint for DTLS from multiplexer
 	dtlsEndpoint := dataMux.NewEndpoint(mux.MatchDTLS)
 
 	// Instantiate a new endpoint for SRTP from multiplexer
-	srtpEndpoint := dataMux.NewEndpoint(func(b []byte) bool {
-		// First byte looks like 10??????, representing RTP version 2.
-		return b[0]&0xb0 == 0x80
-	})
-
-	// Configuration for DTLS handshake, namely certificate and private key
-	config := &dtls.Config{Certificate: pc.certificate, PrivateKey: pc.privateKey}
+	srtpEndpoint := dataMux.NewEndpoint(mux.MatchSRTPOrSRTCP)
+
+	// Configuration for DTLS handshake, namely certificate and private key,
+	// and verification of the remote certificate against the SDP fingerprint
+	config := &dtls.Config{
+		Certificate:           pc.certificate,
+		PrivateKey:            pc.privateKey,
+		VerifyPeerCertificate: pc.verifyRemoteCertificate,
+	}
 
-	// Initiate a DTLS handshake as a client
-	dtlsConn, err := dtls.Client(dtlsEndpoint, config)
+	// Initiate a DTLS handshake in the negotiated role
+	release, err := acquireHandshake()
+	if err != nil {
+		return err
+	}
+	handshake := dtls.Client
+	if pc.dtlsServer {
+		handshake = dtls.Server
+	}
+	dtlsConn, err := handshake(dtlsEndpoint, config)
+	release()
 	if err != nil {
 		return err
 	}
+	// Let the remote peer know we're leaving, with a close_notify alert.
+	defer dtlsConn.Close()
+	pc.dtlsConn = dtlsConn
+	close(pc.dtlsReady)
 
 	// Create SRTP keys from DTLS handshake (see RFC5764 Section 4.2)
 	keys, err := dtlsConn.ExportKeyingMaterial("EXTRACTOR-dtls_srtp", nil, 2*keyLen+2*saltLen)
@@ -391,33 +883,60 @@ func (pc *PeerConnection) Stream() error {
 	readKey := keyReader.Next(keyLen)
 	writeSalt := keyReader.Next(saltLen)
 	readSalt := keyReader.Next(saltLen)
+	if pc.dtlsServer {
+		// The client's keys come first.
+		writeKey, readKey = readKey, writeKey
+		writeSalt, readSalt = readSalt, writeSalt
+	}
+
+	// Streams share the bandwidth estimated by the remote peer.
+	bandwidth := new(rtp.BandwidthAllocator)
 
-	rtpSession := rtp.NewSession(rtp.SessionOptions{
+	// Only the local interface's MTU is known. Never exceed the default,
+	// which nearly every path supports.
+	mtu := pc.mtu
+	if mtu == 0 {
+		if m := pc.currentICE().PathMTU(); m > 0 && m < rtp.DefaultMTU {
+			mtu = m
+		}
+	}
+
+	rtpSession, err := rtp.NewSession(rtp.SessionOptions{
 		MuxConn:   srtpEndpoint, // rtcp-mux assumed
 		ReadKey:   readKey,
 		ReadSalt:  readSalt,
 		WriteKey:  writeKey,
 		WriteSalt: writeSalt,
+		MTU:       mtu,
+		Bandwidth: bandwidth,
+		Resources: pc.resources,
+
+		IgnoreSSRCCollisions: pc.ignoreSSRCCollisions,
+		OnSSRCCollision: func(stream *rtp.Stream, oldSSRC, newSSRC uint32) {
+			if pc.OnSSRCCollision != nil {
+				pc.OnSSRCCollision(oldSSRC, newSSRC)
+			}
+		},
 	})
-
-	videoStreamOpts := rtp.StreamOptions{
-		Direction: "sendonly",
-	}
-	for _, m := range pc.localDescription.Media {
-		if m.Type == "video" {
-			fmt.Sscanf(m.GetAttr("ssrc"), "%d cname:%s", &videoStreamOpts.LocalSSRC, &videoStreamOpts.LocalCNAME)
-			break
-		}
-	}
-	for _, m := range pc.remoteDescription.Media {
-		if m.Type == "video" {
-			fmt.Sscanf(m.GetAttr("ssrc"), "%d cname:%s", &videoStreamOpts.RemoteSSRC, &videoStreamOpts.RemoteCNAME)
-			break
-		}
+	if err != nil {
+		return err
 	}
 
-	videoStream := rtpSession.AddStream(videoStreamOpts)
-	go videoStream.SendVideo(pc.ctx.Done(), pc.DynamicType, pc.localVideo)
+	// Media flows until the connection is closed or fails.
+	streamCtx, stopStreaming := context.WithCancel(pc.ctx)
+	defer stopStreaming()
+	pc.startMedia(streamCtx, rtpSession, bandwidth)
+	defer pc.stopMedia()
+
+	// Track this connection in the list of active sessions.
+	pc.mediaMutex.Lock()
+	pc.connectedAt = time.Now()
+	pc.mediaMutex.Unlock()
+	pc.resources.Go("bitrate sampler", func() {
+		pc.sampleBitrate(streamCtx.Done(), pc.mediaBytesSent)
+	})
+	addActiveSession(pc)
+	defer removeActiveSession(pc)
 
 	//rtpSession, err := rtp.NewSecureSession(rtpEndpoint, readKey, readSalt, writeKey, writeSalt)
 	//go streamH264(pc.ctx, pc.localVideoTrack, rtpSession.NewH264Stream(ssrc, cname))
@@ -436,19 +955,195 @@ func (pc *PeerConnection) Stream() error {
 	// parent context is canceled, we should terminate cleanly.
 	// 2. Connection timeout. If the remote peer disconnects unexpectedly, the
 	// read loop on the underlying net.UDPConn will time out. The associated
-	// ice.DataStream will then be marked dead, which we check for here.
-	select {
-	case <-pc.ctx.Done():
-		return nil
-	case <-dataStream.Done():
-		return dataStream.Err()
+	// ice.DataStream will then be marked dead, which we check for here,
+	// unless an ICE restart replaces it in time.
+	return pc.superviseICE(conn)
+}
+
+// The outcome of connecting a restarted ICE agent.
+type iceRestartResult struct {
+	session *iceSession
+	ds      *ice.DataStream
+	err     error
+}
+
+// Keep the connection's data stream alive across ICE restarts, until the
+// peer connection is closed or the ICE transport fails for good.
+func (pc *PeerConnection) superviseICE(conn *iceConn) error {
+	var (
+		// The restarted agent being connected, if any.
+		pending   *iceSession
+		connected = make(chan iceRestartResult, 1)
+
+		// Set while the current data stream has failed.
+		lost       error
+		restartErr = make(chan error, 1)
+		deadline   <-chan time.Time
+	)
+	for {
+		// Watch the current data stream, until it fails.
+		var dead <-chan struct{}
+		if lost == nil {
+			ds, _ := conn.current()
+			dead = ds.Done()
+		}
+
+		select {
+		case <-pc.ctx.Done():
+			return nil
+
+		case s := <-pc.iceRestarts:
+			if pending != nil {
+				pending.stop()
+			}
+			pending = s
+			pc.resources.Go("ICE restart", func() {
+				ds, err := s.agent.GetDataStream(s.ctx)
+				select {
+				case connected <- iceRestartResult{s, ds, err}:
+				case <-pc.ctx.Done():
+				}
+			})
+
+		case r := <-connected:
+			if r.session != pending {
+				// Superseded by a later restart.
+				continue
+			}
+			pending = nil
+			if r.err != nil {
+				log.Warn("ICE restart failed: %v", r.err)
+				continue
+			}
+			log.Info("ICE restarted")
+			conn.replace(r.ds)
+			pc.iceMutex.Lock()
+			old := pc.ice
+			pc.ice = r.session
+			pc.iceMutex.Unlock()
+			old.stop()
+			lost, deadline = nil, nil
+
+		case <-dead:
+			ds, _ := conn.current()
+			lost = ds.Err()
+			if lost == nil {
+				lost = io.EOF
+			}
+			if pc.OnICEFailure == nil {
+				return lost
+			}
+			log.Warn("ICE transport failed: %v", lost)
+			onFailure, failure := pc.OnICEFailure, lost
+			pc.resources.Go("ICE failure callback", func() {
+				err := onFailure(failure)
+				select {
+				case restartErr <- err:
+				case <-pc.ctx.Done():
+				}
+			})
+
+		case err := <-restartErr:
+			if lost == nil {
+				// The restart already completed.
+				continue
+			}
+			if err != nil {
+				log.Warn("Could not restart ICE: %v", err)
+				return lost
+			}
+			deadline = time.After(pc.connectTimeout)
+
+		case <-deadline:
+			return lost
+		}
+	}
+}
+
+// OnTrack registers a callback for each track received from the remote peer,
+// called when the connection is established. Media offered by the remote peer
+// is only accepted for receiving (with an answer of recvonly or sendrecv) if a
+// callback is registered, so it must be called before SetRemoteDescription.
+// The callback must return quickly, e.g. by reading the track's Buffers in a
+// new goroutine.
+func (pc *PeerConnection) OnTrack(f func(track *RemoteTrack)) {
+	pc.onTrack = f
+}
+
+// Check the remote DTLS certificate against the fingerprint in the remote
+// description.
+func (pc *PeerConnection) verifyRemoteCertificate(cert *x509.Certificate) error {
+	pc.mediaMutex.Lock()
+	fp := pc.remoteFingerprint()
+	pc.mediaMutex.Unlock()
+
+	err := errNoRemoteFingerprint
+	if fp != "" {
+		err = dtls.VerifyFingerprint(cert, fp)
 	}
+	if err != nil {
+		log.Warn("Rejecting remote certificate: %v", err)
+		if pc.OnCertificateError != nil {
+			pc.OnCertificateError(err)
+		}
+	}
+	return err
 }
 
-// Close the peer connection
+// Close the peer connection. If streaming, the remote peer is notified, so
+// that it tears down its end immediately, rather than waiting for a timeout.
+// Close waits a short while for this to complete; see CloseWithContext.
 func (pc *PeerConnection) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	if err := pc.CloseWithContext(ctx); err != nil {
+		log.Warn("Peer connection not torn down cleanly: %v", err)
+	}
+}
+
+// CloseWithContext closes the peer connection, and waits until Stream has
+// notified the remote peer with an RTCP BYE and DTLS close_notify, or until
+// ctx is done.
+func (pc *PeerConnection) CloseWithContext(ctx context.Context) error {
 	log.Info("Closing peer connection")
 
 	// Cancel context to notify goroutines to exit.
 	pc.cancel()
+
+	if atomic.LoadInt32(&pc.streaming) != 0 {
+		select {
+		case <-pc.streamDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return pc.checkLeaks(ctx)
+}
+
+// Wait, until ctx is done, for the connection's resources to be released, if
+// tracked. Returns a *leak.Error listing any that aren't, or panics if so
+// configured.
+func (pc *PeerConnection) checkLeaks(ctx context.Context) error {
+	leaks := pc.resources.Wait(ctx)
+	if len(leaks) == 0 {
+		return nil
+	}
+	err := &leak.Error{Leaks: leaks}
+	if pc.panicOnLeak {
+		panic(err)
+	}
+	return err
+}
+
+// Return a function that delivers received buffers to a remote track, so that
+// they are tracked until released.
+func (pc *PeerConnection) trackBuffers(track *RemoteTrack) func(*packet.SharedBuffer) error {
+	if pc.resources == nil {
+		return track.put
+	}
+	desc := "received " + track.kind
+	return func(buf *packet.SharedBuffer) error {
+		buf.OnRelease(pc.resources.Acquire(leak.Buffer, desc))
+		return track.put(buf)
+	}
 }
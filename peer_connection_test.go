@@ -0,0 +1,207 @@
+package alohartc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// An offer with audio, video and a data channel (ICE credentials, fingerprint
+// and most formats trimmed).
+const audioVideoDataOffer = `v=0
+o=- 4611731400430051336 2 IN IP4 127.0.0.1
+s=-
+t=0 0
+a=group:BUNDLE 0 1 2
+m=audio 9 UDP/TLS/RTP/SAVPF 111 0
+c=IN IP4 0.0.0.0
+a=mid:0
+a=sendrecv
+a=rtcp-mux
+a=rtpmap:111 opus/48000/2
+a=rtpmap:0 PCMU/8000
+m=video 9 UDP/TLS/RTP/SAVPF 102 103
+c=IN IP4 0.0.0.0
+a=mid:1
+a=sendrecv
+a=rtcp-mux
+a=rtpmap:102 H264/90000
+a=fmtp:102 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f
+a=rtpmap:103 rtx/90000
+a=fmtp:103 apt=102
+m=application 9 UDP/DTLS/SCTP webrtc-datachannel
+c=IN IP4 0.0.0.0
+a=mid:2
+a=sctp-port:5000
+`
+
+func TestCreateAnswerRejectsUnsupportedMedia(t *testing.T) {
+	offer, err := sdp.ParseSession(strings.ReplaceAll(audioVideoDataOffer, "\n", "\r\n"))
+	assert.NoError(t, err)
+
+	pc := &PeerConnection{remoteDescription: offer}
+	answer, err := pc.createAnswer()
+	assert.NoError(t, err)
+
+	assert.Equal(t, 3, len(answer.Media))
+	for i, m := range answer.Media {
+		assert.Equal(t, offer.Media[i].Type, m.Type)
+		assert.Equal(t, offer.Media[i].GetAttr("mid"), m.GetAttr("mid"))
+	}
+
+	audio, video, data := answer.Media[0], answer.Media[1], answer.Media[2]
+	assert.Equal(t, 0, audio.Port)
+	assert.Equal(t, []string{"111", "0"}, audio.Format)
+	assert.Equal(t, 9, video.Port)
+	assert.Equal(t, []string{"102"}, video.Format)
+	assert.Equal(t, 0, data.Port)
+	assert.Equal(t, "UDP/DTLS/SCTP", data.Proto)
+	assert.Equal(t, "BUNDLE 1", answer.GetAttr("group"))
+}
+
+func TestCreateAnswerNoAcceptableMedia(t *testing.T) {
+	offer, err := sdp.ParseSession(strings.ReplaceAll(audioVideoDataOffer, "\n", "\r\n"))
+	assert.NoError(t, err)
+	offer.Media = append(offer.Media[:1], offer.Media[2:]...)
+
+	pc := &PeerConnection{remoteDescription: offer}
+	_, err = pc.createAnswer()
+	assert.Equal(t, errNoAcceptableMedia, err)
+}
+
+func TestCreateAnswerRequiresRTCPMux(t *testing.T) {
+	offer, err := sdp.ParseSession(strings.ReplaceAll(strings.ReplaceAll(audioVideoDataOffer, "a=rtcp-mux\n", ""), "\n", "\r\n"))
+	assert.NoError(t, err)
+
+	pc := &PeerConnection{remoteDescription: offer}
+	_, err = pc.createAnswer()
+	assert.Equal(t, errNoRTCPMux, err)
+}
+
+// An audio source for the intercom tests, which never delivers a frame.
+type silentAudioSource struct {
+	media.Flow
+	codec string
+}
+
+func (src *silentAudioSource) Codec() string       { return src.codec }
+func (src *silentAudioSource) SampleRate() int     { return 8000 }
+func (src *silentAudioSource) BytesPerSample() int { return 1 }
+
+func TestCreateAnswerAudioOnly(t *testing.T) {
+	offer, err := sdp.ParseSession(strings.ReplaceAll(audioVideoDataOffer, "\n", "\r\n"))
+	assert.NoError(t, err)
+	offer.Media = offer.Media[:1]
+
+	pc := &PeerConnection{
+		remoteDescription: offer,
+		localAudio:        &silentAudioSource{codec: "PCMU"},
+		audioIDs:          localTrackIDs{ssrc: 1234, cname: "cname", streamID: "stream", trackID: "track"},
+	}
+	answer, err := pc.createAnswer()
+	assert.NoError(t, err)
+
+	audio := answer.Media[0]
+	assert.Equal(t, 9, audio.Port)
+	assert.Equal(t, []string{"0"}, audio.Format)
+	assert.Equal(t, "0 PCMU/8000", audio.GetAttr("rtpmap"))
+	assert.Equal(t, directionSendOnly, mediaDirection(&answer, &audio))
+	assert.Equal(t, "1234 cname:cname", audio.GetAttr("ssrc"))
+	assert.Equal(t, "BUNDLE 0", answer.GetAttr("group"))
+	assert.Equal(t, uint8(0), pc.audioPayloadType)
+	assert.Equal(t, "", pc.videoDirection)
+}
+
+func TestCreateAnswerAudioAndVideo(t *testing.T) {
+	offer, err := sdp.ParseSession(strings.ReplaceAll(audioVideoDataOffer, "\n", "\r\n"))
+	assert.NoError(t, err)
+
+	// Received audio is accepted in the first format we support.
+	pc := &PeerConnection{remoteDescription: offer, onTrack: func(*RemoteTrack) {}}
+	answer, err := pc.createAnswer()
+	assert.NoError(t, err)
+
+	audio := answer.Media[0]
+	assert.Equal(t, []string{"111"}, audio.Format)
+	assert.Equal(t, directionRecvOnly, mediaDirection(&answer, &audio))
+	assert.Equal(t, "opus", pc.audioCodec)
+	assert.Equal(t, "BUNDLE 0 1", answer.GetAttr("group"))
+
+	// Without BUNDLE, only the first accepted m-line has a transport.
+	offer.Attributes = nil
+	pc = &PeerConnection{remoteDescription: offer, onTrack: func(*RemoteTrack) {}}
+	answer, err = pc.createAnswer()
+	assert.NoError(t, err)
+	assert.Equal(t, 9, answer.Media[0].Port)
+	assert.Equal(t, 0, answer.Media[1].Port)
+}
+
+func TestCreateAnswerSetup(t *testing.T) {
+	for _, tt := range []struct {
+		offered, answered string
+		server            bool
+	}{
+		{"actpass", "active", false},
+		{"passive", "active", false},
+		{"active", "passive", true},
+	} {
+		offer, err := sdp.ParseSession(strings.ReplaceAll(audioVideoDataOffer, "a=mid:1\n", "a=mid:1\na=setup:"+tt.offered+"\n"))
+		assert.NoError(t, err)
+
+		pc := &PeerConnection{remoteDescription: offer}
+		answer, err := pc.createAnswer()
+		assert.NoError(t, err)
+		assert.Equal(t, tt.answered, answer.Media[1].GetAttr("setup"))
+		assert.Equal(t, tt.server, pc.dtlsServer)
+	}
+}
+
+func TestCloseWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pc := &PeerConnection{ctx: ctx, cancel: cancel, streamDone: make(chan struct{})}
+
+	// Not streaming, so nothing to wait for.
+	assert.NoError(t, pc.CloseWithContext(context.Background()))
+	assert.Error(t, pc.ctx.Err())
+
+	// Streaming, but teardown doesn't finish in time.
+	pc.streaming = 1
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	assert.Equal(t, context.DeadlineExceeded, pc.CloseWithContext(timeout))
+
+	// Teardown finished.
+	close(pc.streamDone)
+	assert.NoError(t, pc.CloseWithContext(context.Background()))
+}
+
+func TestCreateAnswerMaxReceiveBitrate(t *testing.T) {
+	offer, err := sdp.ParseSession(strings.ReplaceAll(audioVideoDataOffer, "\n", "\r\n"))
+	assert.NoError(t, err)
+
+	pc := &PeerConnection{
+		remoteDescription: offer,
+		maxReceiveBitrate: 500000,
+		onTrack:           func(*RemoteTrack) {},
+	}
+	answer, err := pc.createAnswer()
+	assert.NoError(t, err)
+
+	video := answer.Media[1]
+	assert.Equal(t, directionRecvOnly, mediaDirection(&answer, &video))
+	assert.Equal(t, []sdp.Bandwidth{{Type: "AS", Value: 500}, {Type: "TIAS", Value: 500000}}, video.Bandwidth)
+	assert.False(t, pc.remb)
+}
+
+func TestNewPeerConnectionRejectsPortRange(t *testing.T) {
+	config := loopbackConfig()
+	config.PortRange = PortRange{Min: 50100, Max: 50000}
+	_, err := NewPeerConnection(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,87 @@
+package alohartc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+var errPolicyNeedsVideo = errors.New("stream policy limits require a per-viewer video source (StreamPolicy.Video)")
+
+// StreamPolicy limits the media quality that a remote peer may receive. The
+// zero value imposes no limits.
+//
+// The limits apply to a video source of the viewer's own, never to the
+// default Config.LocalVideo, whose encoder other viewers share. Setting any
+// of them requires Video.
+type StreamPolicy struct {
+	// Maximum video dimensions, in pixels. Zero means no limit.
+	MaxWidth  int
+	MaxHeight int
+
+	// Maximum video bitrate, in bits per second. Zero means no limit. The
+	// encoder of Video is capped at the limit from the start, if it can
+	// adjust its bitrate (see media.BitrateAdjuster), and bandwidth
+	// estimates from the remote peer never raise it further. It is not
+	// advertised in SDP, where b=AS and b=TIAS would only limit what the
+	// remote peer sends.
+	MaxBitrate int
+
+	// Video source to stream instead of Config.LocalVideo, e.g. a second
+	// encoder configured for lower resolution and bitrate, used by this
+	// viewer alone. Required if any limit above is set.
+	Video media.VideoSource
+}
+
+// An Authorizer decides whether to accept an incoming SDP offer, and if so,
+// which StreamPolicy applies to the viewer. Returning an error rejects the
+// session. Typical implementations inspect a token carried by the signaling
+// channel, and return a more restrictive policy for guest links than for the
+// device owner.
+type Authorizer func(offer string) (StreamPolicy, error)
+
+// Report whether the policy sets any limit.
+func (policy *StreamPolicy) limited() bool {
+	return policy.MaxWidth > 0 || policy.MaxHeight > 0 || policy.MaxBitrate > 0
+}
+
+// Limit a bitrate, in bits per second, to the policy's maximum.
+func (policy *StreamPolicy) clampBitrate(bps int) int {
+	if policy.MaxBitrate > 0 && bps > policy.MaxBitrate {
+		return policy.MaxBitrate
+	}
+	return bps
+}
+
+// Cap the encoder of a video source at the policy's bitrate limit, if any,
+// if the source is the policy's own, and if it allows it.
+func (policy *StreamPolicy) capBitrate(video media.VideoSource) {
+	if policy.MaxBitrate <= 0 || video == nil || video != policy.Video {
+		return
+	}
+	if adj, ok := video.(media.BitrateAdjuster); ok {
+		log.Info("Capping video bitrate at %d bps", policy.MaxBitrate)
+		if err := adj.AdjustBitrate(policy.MaxBitrate); err != nil {
+			log.Warn("Failed to cap video bitrate: %v", err)
+		}
+	}
+}
+
+// Apply the stream policy, returning the video source to use.
+func (policy *StreamPolicy) selectVideo(def media.VideoSource) (media.VideoSource, error) {
+	video := policy.Video
+	if video == nil {
+		if def != nil && policy.limited() {
+			return nil, errPolicyNeedsVideo
+		}
+		return def, nil
+	}
+
+	if policy.MaxWidth > 0 && video.Width() > policy.MaxWidth ||
+		policy.MaxHeight > 0 && video.Height() > policy.MaxHeight {
+		return nil, fmt.Errorf("video source %dx%d exceeds policy limit %dx%d",
+			video.Width(), video.Height(), policy.MaxWidth, policy.MaxHeight)
+	}
+	return video, nil
+}
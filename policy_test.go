@@ -0,0 +1,83 @@
+package alohartc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// A video source recording the bitrates its encoder is set to.
+type bitrateSource struct {
+	media.VideoSource
+	bitrates []int
+}
+
+func (s *bitrateSource) AdjustBitrate(bps int) error {
+	s.bitrates = append(s.bitrates, bps)
+	return nil
+}
+
+func TestStreamPolicyCapsBitrate(t *testing.T) {
+	src := &bitrateSource{}
+	(&StreamPolicy{Video: src}).capBitrate(src)
+	assert.Nil(t, src.bitrates)
+
+	// The shared default source is left alone.
+	policy := &StreamPolicy{MaxBitrate: 500000, Video: &bitrateSource{}}
+	policy.capBitrate(src)
+	assert.Nil(t, src.bitrates)
+
+	policy.Video = src
+	policy.capBitrate(src)
+	assert.Equal(t, []int{500000}, src.bitrates)
+
+	// Bandwidth estimates never raise a capped viewer.
+	assert.Equal(t, 500000, policy.clampBitrate(2000000))
+	assert.Equal(t, 300000, policy.clampBitrate(300000))
+	assert.Equal(t, 2000000, (&StreamPolicy{}).clampBitrate(2000000))
+}
+
+func TestStreamPolicySelectVideo(t *testing.T) {
+	def := &bitrateSource{}
+
+	video, err := (&StreamPolicy{}).selectVideo(def)
+	assert.NoError(t, err)
+	assert.Equal(t, media.VideoSource(def), video)
+
+	// Limits need a source of the viewer's own.
+	_, err = (&StreamPolicy{MaxBitrate: 500000}).selectVideo(def)
+	assert.Equal(t, errPolicyNeedsVideo, err)
+
+	src := newLoopbackVideoSource()
+	defer src.Close()
+	video, err = (&StreamPolicy{MaxWidth: 640, MaxBitrate: 500000, Video: src}).selectVideo(def)
+	assert.NoError(t, err)
+	assert.Equal(t, media.VideoSource(src), video)
+
+	_, err = (&StreamPolicy{MaxWidth: 320, Video: src}).selectVideo(def)
+	assert.Error(t, err)
+}
+
+func TestCreateAnswerPolicyMaxBitrate(t *testing.T) {
+	offer, err := sdp.ParseSession(strings.ReplaceAll(audioVideoDataOffer, "\n", "\r\n"))
+	assert.NoError(t, err)
+
+	src := newLoopbackVideoSource()
+	defer src.Close()
+	pc := &PeerConnection{
+		remoteDescription: offer,
+		localVideo:        src,
+		policy:            StreamPolicy{MaxBitrate: 500000},
+	}
+	answer, err := pc.createAnswer()
+	assert.NoError(t, err)
+
+	// The limit on what we send is not the remote peer's to enforce.
+	video := answer.Media[1]
+	assert.Equal(t, directionSendOnly, mediaDirection(&answer, &video))
+	assert.Nil(t, video.Bandwidth)
+}
@@ -0,0 +1,109 @@
+package alohartc
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultReconnectRetries = 5
+	defaultReconnectBackoff = time.Second
+	defaultMaxBackoff       = 30 * time.Second
+)
+
+// ReconnectPolicy limits how hard a Reconnector tries to restore a call. The
+// zero value uses the defaults below.
+type ReconnectPolicy struct {
+	// Number of times in a row that the call is signaled anew before it is
+	// abandoned. The count resets whenever a connection is established.
+	// Defaults to 5.
+	MaxRetries int
+
+	// Delay before signaling anew, doubled for each attempt in a row up to
+	// MaxBackoff. Default to 1 and 30 seconds.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// A Reconnector keeps a call going through transient failures, e.g. a network
+// change or a drop in connectivity. When the ICE transport of a connection
+// fails, ICE is first restarted on the same peer connection, which keeps its
+// DTLS and SRTP sessions. If that doesn't work, the connection is closed and
+// signaled anew, with exponential backoff.
+type Reconnector struct {
+	Policy ReconnectPolicy
+
+	// Connect signals a new peer connection, e.g. by sending the offer from
+	// CreateOffer and applying the answer, or by answering an offer from the
+	// remote peer, and starts the exchange of ICE candidates. The peer
+	// connection should derive from ctx, which is canceled once the
+	// connection is abandoned.
+	Connect func(ctx context.Context) (*PeerConnection, error)
+
+	// RestartICE, if set, arranges an ICE restart for a connection whose
+	// transport has failed: either by sending the offer from
+	// PeerConnection.RestartICE and applying the answer, or by asking the
+	// remote peer to send a new offer for SetRemoteDescription. If nil, or if
+	// it returns an error, the call is signaled anew.
+	RestartICE func(ctx context.Context, pc *PeerConnection) error
+}
+
+// Run connects and streams until ctx is done or the peer connection is closed,
+// reconnecting as necessary. It returns the error of the last attempt if the
+// policy gives up.
+func (r *Reconnector) Run(ctx context.Context) error {
+	maxRetries := r.Policy.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultReconnectRetries
+	}
+	backoff := r.Policy.Backoff
+	if backoff <= 0 {
+		backoff = defaultReconnectBackoff
+	}
+	maxBackoff := r.Policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	retries := 0
+	delay := backoff
+	for {
+		connCtx, abandon := context.WithCancel(ctx)
+		pc, err := r.Connect(connCtx)
+		if err == nil {
+			if r.RestartICE != nil {
+				pc.OnICEFailure = func(error) error {
+					return r.RestartICE(connCtx, pc)
+				}
+			}
+			err = pc.Stream()
+			pc.Close()
+
+			// Only Stream writes connectedAt, so it's safe to read now.
+			if !pc.connectedAt.IsZero() {
+				retries, delay = 0, backoff
+			}
+		}
+		abandon()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			// The peer connection was closed, ending the call.
+			return nil
+		}
+
+		if retries++; retries > maxRetries {
+			return err
+		}
+		log.Warn("Call failed, reconnecting in %v: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package alohartc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/stretchr/testify/assert"
+)
+
+// Receive video on a peer connection, releasing every buffer, with a signal
+// on the returned channel for each buffer that isn't dropped.
+func receiveLoopback(pc *PeerConnection) <-chan struct{} {
+	received := make(chan struct{}, 1)
+	pc.OnTrack(func(track *RemoteTrack) {
+		go func() {
+			for buf := range track.Buffers() {
+				select {
+				case received <- struct{}{}:
+				default:
+				}
+				buf.Release()
+			}
+		}()
+	})
+	return received
+}
+
+// Wait for video to be received from now on.
+func expectVideo(t *testing.T, received <-chan struct{}) {
+	select {
+	case <-received:
+	default:
+	}
+	select {
+	case <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no video received")
+	}
+}
+
+// Stop the current ICE agent of a peer connection, as if the network had gone
+// away, so that its transport fails.
+func failICE(pc *PeerConnection) *ice.Agent {
+	pc.iceMutex.Lock()
+	s := pc.ice
+	pc.iceMutex.Unlock()
+	s.stop()
+	return s.agent
+}
+
+// Wait for a peer connection to replace an ICE agent with a restarted one.
+func expectICERestart(t *testing.T, pc *PeerConnection, old *ice.Agent) {
+	deadline := time.Now().Add(10 * time.Second)
+	for pc.currentICE() == old {
+		if time.Now().After(deadline) {
+			t.Fatal("ICE not restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoopbackICERestart(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	offerer := Must(NewPeerConnection(config))
+	answerer := Must(NewPeerConnection(loopbackConfig()))
+	received := receiveLoopback(answerer)
+
+	// The offerer restarts ICE when its transport fails.
+	offerer.OnICEFailure = func(error) error {
+		offer, err := offerer.RestartICE()
+		if err != nil {
+			return err
+		}
+		answer, err := answerer.SetRemoteDescription(offer)
+		if err != nil {
+			return err
+		}
+		return offerer.SetRemoteAnswer(answer)
+	}
+
+	closeBoth := connectLoopback(t, offerer, answerer)
+	expectVideo(t, received)
+
+	// Both ends move to new agents, and video resumes over the same DTLS
+	// session.
+	dtlsConn := answerer.dtlsConn
+	answererAgent := answerer.currentICE()
+	expectICERestart(t, offerer, failICE(offerer))
+	expectICERestart(t, answerer, answererAgent)
+	expectVideo(t, received)
+	assert.True(t, dtlsConn == answerer.dtlsConn)
+
+	// Replaced agents are stopped, or Close would panic.
+	for _, err := range closeBoth() {
+		assert.NoError(t, err)
+	}
+}
+
+func TestRestartICERequiresAnswer(t *testing.T) {
+	pc := Must(NewPeerConnection(loopbackConfig()))
+	defer pc.Close()
+
+	_, err := pc.RestartICE()
+	assert.Equal(t, errNotConnected, err)
+}
+
+func TestReconnector(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	type call struct {
+		offerer, answerer *PeerConnection
+		received          <-chan struct{}
+	}
+	calls := make(chan call, 1)
+
+	var (
+		mu       sync.Mutex
+		remote   *PeerConnection
+		restarts int
+	)
+	r := &Reconnector{
+		Policy: ReconnectPolicy{
+			MaxRetries: 1,
+			Backoff:    10 * time.Millisecond,
+		},
+
+		// Call a new answerer, which hangs up once the call is abandoned.
+		Connect: func(ctx context.Context) (*PeerConnection, error) {
+			config := loopbackConfig()
+			config.LocalVideo = src
+			offerer := Must(NewPeerConnectionWithContext(ctx, config))
+			answerer := Must(NewPeerConnectionWithContext(ctx, loopbackConfig()))
+			received := receiveLoopback(answerer)
+
+			offerer.OnIceCandidate = answerer.AddIceCandidate
+			answerer.OnIceCandidate = offerer.AddIceCandidate
+			offer, err := offerer.CreateOffer()
+			if err != nil {
+				return nil, err
+			}
+			answer, err := answerer.SetRemoteDescription(offer)
+			if err != nil {
+				return nil, err
+			}
+			if err := offerer.SetRemoteAnswer(answer); err != nil {
+				return nil, err
+			}
+			go answerer.Stream()
+			go func() {
+				<-ctx.Done()
+				answerer.Close()
+			}()
+
+			mu.Lock()
+			remote = answerer
+			mu.Unlock()
+			calls <- call{offerer, answerer, received}
+			return offerer, nil
+		},
+
+		// Only the first restart gets through.
+		RestartICE: func(ctx context.Context, pc *PeerConnection) error {
+			mu.Lock()
+			answerer := remote
+			restarts++
+			n := restarts
+			mu.Unlock()
+			if n > 1 {
+				return errors.New("signaling unavailable")
+			}
+
+			offer, err := pc.RestartICE()
+			if err != nil {
+				return err
+			}
+			answer, err := answerer.SetRemoteDescription(offer)
+			if err != nil {
+				return err
+			}
+			return pc.SetRemoteAnswer(answer)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	first := <-calls
+	expectVideo(t, first.received)
+
+	// The first failure is repaired by restarting ICE.
+	expectICERestart(t, first.offerer, failICE(first.offerer))
+	expectVideo(t, first.received)
+
+	// The second is not, so the call is signaled anew.
+	failICE(first.offerer)
+	var second call
+	select {
+	case second = <-calls:
+	case <-time.After(10 * time.Second):
+		t.Fatal("call not signaled anew")
+	}
+	expectVideo(t, second.received)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Error("Run did not return")
+	}
+}
+
+func TestReconnectorGivesUp(t *testing.T) {
+	failure := errors.New("no answer")
+	attempts := 0
+	r := &Reconnector{
+		Policy: ReconnectPolicy{
+			MaxRetries: 2,
+			Backoff:    time.Millisecond,
+		},
+		Connect: func(ctx context.Context) (*PeerConnection, error) {
+			attempts++
+			return nil, failure
+		},
+	}
+	assert.Equal(t, failure, r.Run(context.Background()))
+	assert.Equal(t, 3, attempts)
+}
@@ -0,0 +1,119 @@
+package alohartc
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lanikai/alohartc/internal/packet"
+	"github.com/lanikai/alohartc/internal/rtp"
+)
+
+// Number of received buffers queued for the application before new ones are
+// dropped.
+const remoteTrackQueueSize = 32
+
+var errNotVideo = errors.New("not a video track")
+
+// ErrTrackEnded is reported by RemoteTrack.Err when the remote peer ended the
+// track with an RTCP BYE, e.g. because it stopped the track or is closing.
+var ErrTrackEnded = rtp.ErrGoodbye
+
+// A RemoteTrack is media received from the remote peer, e.g. video pushed by a
+// viewer to the device's display. See PeerConnection.OnTrack.
+type RemoteTrack struct {
+	kind  string
+	codec string
+	mid   string
+	ssrc  uint32
+
+	buffers chan *packet.SharedBuffer
+
+	// Asks the remote peer for a keyframe, or nil if it can't be asked.
+	requestKeyframe func() error
+
+	mu     sync.Mutex
+	err    error
+	closed bool
+}
+
+func newRemoteTrack(kind, codec, mid string, ssrc uint32) *RemoteTrack {
+	return &RemoteTrack{
+		kind:    kind,
+		codec:   codec,
+		mid:     mid,
+		ssrc:    ssrc,
+		buffers: make(chan *packet.SharedBuffer, remoteTrackQueueSize),
+	}
+}
+
+// Kind returns "audio" or "video".
+func (t *RemoteTrack) Kind() string {
+	return t.kind
+}
+
+// Codec returns the negotiated codec, e.g. "H264" or "opus".
+func (t *RemoteTrack) Codec() string {
+	return t.codec
+}
+
+// MID returns the media identification of the track's m-line.
+func (t *RemoteTrack) MID() string {
+	return t.mid
+}
+
+// SSRC returns the synchronization source of the track's RTP packets, as
+// announced by the remote peer, or 0 if not announced.
+func (t *RemoteTrack) SSRC() uint32 {
+	return t.ssrc
+}
+
+// Buffers returns the channel of depacketized media: NALUs, without start
+// codes, for H.264, and one encoded frame per buffer for audio. Each buffer
+// must be released when done with. If the application falls behind, buffers
+// are dropped. The channel is closed when the track ends, after which Err
+// reports why.
+func (t *RemoteTrack) Buffers() <-chan *packet.SharedBuffer {
+	return t.buffers
+}
+
+// RequestKeyframe asks the remote peer to send a keyframe, e.g. so that a new
+// consumer of the track can start decoding without waiting for the next one.
+func (t *RemoteTrack) RequestKeyframe() error {
+	if t.kind != "video" || t.requestKeyframe == nil {
+		return errNotVideo
+	}
+	return t.requestKeyframe()
+}
+
+// Err returns the error that ended the track, or nil if it is still open or
+// ended because the connection was closed. It is ErrTrackEnded if the remote
+// peer ended the track.
+func (t *RemoteTrack) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Deliver a received buffer to the application, dropping it if the queue is
+// full.
+func (t *RemoteTrack) put(buf *packet.SharedBuffer) error {
+	select {
+	case t.buffers <- buf:
+	default:
+		log.Debug("Remote %s track %s: application missed a buffer", t.kind, t.mid)
+		buf.Release()
+	}
+	return nil
+}
+
+// End the track.
+func (t *RemoteTrack) close(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.err = err
+	close(t.buffers)
+}
@@ -0,0 +1,31 @@
+package alohartc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lanikai/alohartc/internal/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteTrack(t *testing.T) {
+	track := newRemoteTrack("video", "H264", "video", 1234)
+
+	// Buffers beyond the queue size are dropped, not blocked on.
+	for i := 0; i < remoteTrackQueueSize+1; i++ {
+		assert.NoError(t, track.put(packet.NewSharedBuffer([]byte{byte(i)}, 1, nil)))
+	}
+
+	errEnded := errors.New("ended")
+	track.close(errEnded)
+	track.close(nil)
+
+	n := 0
+	for buf := range track.Buffers() {
+		assert.Equal(t, []byte{byte(n)}, buf.Bytes())
+		buf.Release()
+		n++
+	}
+	assert.Equal(t, remoteTrackQueueSize, n)
+	assert.Equal(t, errEnded, track.Err())
+}
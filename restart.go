@@ -0,0 +1,326 @@
+package alohartc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+var (
+	errNotConnected = errors.New("ICE restart requires a completed offer/answer exchange")
+)
+
+// An ICE agent, with the means to stop it. An ICE restart (see RFC 8445
+// Section 2.4) replaces the agent with a new one, using new credentials.
+type iceSession struct {
+	agent *ice.Agent
+	ctx   context.Context
+	stop  context.CancelFunc
+}
+
+// Start gathering candidates for an ICE agent, which then runs until stopped
+// or until the peer connection is closed. A restarted agent gets a new channel
+// for the candidates added by AddIceCandidate; the first agent takes those
+// added so far.
+func (pc *PeerConnection) startICE(s *iceSession, restart bool) {
+	ctx, stop := context.WithCancel(pc.ctx)
+
+	pc.iceMutex.Lock()
+	s.ctx, s.stop = ctx, stop
+	if restart {
+		pc.remoteCandidates = make(chan ice.Candidate, 4)
+	}
+	rcand := pc.remoteCandidates
+	pc.iceMutex.Unlock()
+
+	pc.beginGathering(s.agent)
+	pc.resources.Go("candidate gathering", func() {
+		pc.startGathering(ctx, s.agent, rcand)
+	})
+}
+
+// Return the ICE agent of the current connection.
+func (pc *PeerConnection) currentICE() *ice.Agent {
+	pc.iceMutex.Lock()
+	defer pc.iceMutex.Unlock()
+	return pc.ice.agent
+}
+
+// RestartICE returns an SDP offer restarting ICE with new credentials, e.g.
+// after OnIceEvent reports that consent was lost, or from OnICEFailure. The
+// remote peer's answer is passed to SetRemoteAnswer, as for CreateOffer.
+// Media continues to flow over the existing candidate pair, if it still
+// works, until the restarted agent connects; the DTLS and SRTP sessions are
+// kept. Either peer may restart ICE, once the first offer has been answered.
+func (pc *PeerConnection) RestartICE() (sdpOffer string, err error) {
+	if !pc.negotiated() {
+		return "", errNotConnected
+	}
+	return pc.reoffer(true)
+}
+
+// Return a new offer in an established session, for the current local
+// tracks, and with new ICE credentials if restarting ICE. The local
+// description in effect is kept in case the offer is rolled back.
+func (pc *PeerConnection) reoffer(restartICE bool) (sdpOffer string, err error) {
+	var (
+		pending *iceSession
+		creds   iceCredentials
+	)
+	if restartICE {
+		if creds, err = newICECredentials(); err != nil {
+			return "", err
+		}
+		pending = &iceSession{agent: ice.NewAgent(pc.iceConfig)}
+	}
+
+	pc.mediaMutex.Lock()
+	stable := pc.localDescription.String()
+	if restartICE {
+		setICECredentials(&pc.localDescription, creds)
+	}
+	pc.updateLocalTracks(nil)
+	pc.bumpSessionVersion(stable)
+	pc.mediaMutex.Unlock()
+
+	pc.iceMutex.Lock()
+	pc.pendingICE = pending
+	pc.stableDescription = stable
+	pc.iceMutex.Unlock()
+
+	return pc.localDescription.String(), nil
+}
+
+// Apply the remote answer to an offer from RestartICE, or from CreateOffer in
+// an established session.
+func (pc *PeerConnection) applyReofferAnswer(answer sdp.Session) error {
+	pc.iceMutex.Lock()
+	s := pc.pendingICE
+	reoffered := pc.stableDescription != ""
+	pc.pendingICE = nil
+	pc.stableDescription = ""
+	pc.iceMutex.Unlock()
+	if !reoffered {
+		return errNoLocalOffer
+	}
+
+	pc.mediaMutex.Lock()
+	pc.remoteDescription = answer
+	pc.applyAnswerDirections(&answer)
+	pc.mediaMutex.Unlock()
+	pc.updateMedia()
+	if s == nil {
+		return nil
+	}
+
+	i := pc.transportIndex()
+	local := &pc.localDescription.Media[i]
+	remote := &answer.Media[i]
+	localCreds := mediaICECredentials(&pc.localDescription, local)
+	remoteCreds := mediaICECredentials(&answer, remote)
+	s.agent.SetControlling(true)
+	s.agent.Configure(local.GetAttr("mid"), remoteCreds.ufrag+":"+localCreds.ufrag, localCreds.pwd, remoteCreds.pwd)
+
+	pc.restartICE(s)
+	return nil
+}
+
+// Return the index of the m-line carrying the transport, i.e. the first one
+// accepted, or -1 if none is.
+func (pc *PeerConnection) transportIndex() int {
+	for i := range pc.localDescription.Media {
+		if pc.localDescription.Media[i].Port != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Answer a new offer from the remote peer in an established session, which
+// may change the direction of media, e.g. after the remote peer adds or
+// removes a track, and restarts ICE if its credentials have changed. Adding or
+// removing m-lines is not supported.
+func (pc *PeerConnection) answerReoffer(offer sdp.Session) (sdpAnswer string, err error) {
+	i := pc.transportIndex()
+	if i < 0 || len(offer.Media) != len(pc.localDescription.Media) {
+		return "", errNoAcceptableMedia
+	}
+	if !offer.Media[i].HasAttr("rtcp-mux") {
+		return "", errNoRTCPMux
+	}
+
+	pc.mediaMutex.Lock()
+	stable := pc.localDescription.String()
+	pc.updateLocalTracks(&offer)
+
+	var s *iceSession
+	remoteCreds := mediaICECredentials(&offer, &offer.Media[i])
+	if remoteCreds != mediaICECredentials(&pc.remoteDescription, &pc.remoteDescription.Media[i]) {
+		log.Info("Remote peer restarted ICE")
+		creds, err := newICECredentials()
+		if err != nil {
+			pc.mediaMutex.Unlock()
+			return "", err
+		}
+		setICECredentials(&pc.localDescription, creds)
+
+		s = &iceSession{agent: ice.NewAgent(pc.iceConfig)}
+		s.agent.SetControlling(offer.HasAttr("ice-lite"))
+		mid := pc.localDescription.Media[i].GetAttr("mid")
+		s.agent.Configure(mid, remoteCreds.ufrag+":"+creds.ufrag, creds.pwd, remoteCreds.pwd)
+	}
+	pc.bumpSessionVersion(stable)
+	pc.remoteDescription = offer
+	pc.mediaMutex.Unlock()
+
+	pc.updateMedia()
+	if s != nil {
+		pc.restartICE(s)
+	}
+	return pc.localDescription.String(), nil
+}
+
+// Increment the session version if the local description has changed from
+// before, as for each new offer or answer (see RFC 3264 Section 8).
+func (pc *PeerConnection) bumpSessionVersion(before string) {
+	if pc.localDescription.String() != before {
+		pc.localDescription.Origin.SessionVersion++
+	}
+}
+
+// Start a restarted ICE agent, and hand it to Stream to connect. A restart
+// that hasn't connected yet is abandoned in favor of this one.
+func (pc *PeerConnection) restartICE(s *iceSession) {
+	pc.startICE(s, true)
+	for {
+		select {
+		case pc.iceRestarts <- s:
+			return
+		case old := <-pc.iceRestarts:
+			old.stop()
+		}
+	}
+}
+
+// Replace the ICE credentials of every accepted m-line.
+func setICECredentials(s *sdp.Session, creds iceCredentials) {
+	for i := range s.Media {
+		m := &s.Media[i]
+		if m.Port == 0 {
+			continue
+		}
+		for j := range m.Attributes {
+			switch m.Attributes[j].Key {
+			case "ice-ufrag":
+				m.Attributes[j].Value = creds.ufrag
+			case "ice-pwd":
+				m.Attributes[j].Value = creds.pwd
+			}
+		}
+	}
+}
+
+// An iceConn is a net.Conn over the data stream of the current ICE agent,
+// which is replaced when a restarted agent connects. Reads from a failed
+// data stream wait for the replacement, so that the DTLS and SRTP sessions
+// above survive an ICE restart.
+type iceConn struct {
+	mu       sync.Mutex
+	ds       *ice.DataStream
+	replaced chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newICEConn(ds *ice.DataStream) *iceConn {
+	return &iceConn{
+		ds:       ds,
+		replaced: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Return the current data stream, and a channel closed when it is replaced.
+func (c *iceConn) current() (*ice.DataStream, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ds, c.replaced
+}
+
+// Switch to the data stream of a restarted ICE agent.
+func (c *iceConn) replace(ds *ice.DataStream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ds = ds
+	close(c.replaced)
+	c.replaced = make(chan struct{})
+}
+
+func (c *iceConn) Read(b []byte) (int, error) {
+	for {
+		ds, replaced := c.current()
+		n, err := ds.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+
+		// The data stream has failed. Wait for an ICE restart.
+		select {
+		case <-replaced:
+		case <-c.closed:
+			return 0, err
+		}
+	}
+}
+
+// Writes to a failed data stream are dropped, as if lost on the way, so that
+// senders carry on until an ICE restart replaces it.
+func (c *iceConn) Write(b []byte) (int, error) {
+	ds, _ := c.current()
+	select {
+	case <-ds.Done():
+		return len(b), nil
+	default:
+	}
+	return ds.Write(b)
+}
+
+func (c *iceConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	ds, _ := c.current()
+	return ds.Close()
+}
+
+func (c *iceConn) LocalAddr() net.Addr {
+	ds, _ := c.current()
+	return ds.LocalAddr()
+}
+
+func (c *iceConn) RemoteAddr() net.Addr {
+	ds, _ := c.current()
+	return ds.RemoteAddr()
+}
+
+func (c *iceConn) SetDeadline(t time.Time) error {
+	ds, _ := c.current()
+	return ds.SetDeadline(t)
+}
+
+func (c *iceConn) SetReadDeadline(t time.Time) error {
+	ds, _ := c.current()
+	return ds.SetReadDeadline(t)
+}
+
+func (c *iceConn) SetWriteDeadline(t time.Time) error {
+	ds, _ := c.current()
+	return ds.SetWriteDeadline(t)
+}
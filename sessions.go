@@ -0,0 +1,240 @@
+package alohartc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/ice"
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+// SessionInfo describes an active peer connection, e.g. for display in a
+// device UI ("2 viewers connected, 1 relayed").
+type SessionInfo struct {
+	// Anonymized identifier for the remote peer. It is derived from the
+	// remote DTLS certificate fingerprint, so it is stable for the lifetime of
+	// the session but reveals nothing about the viewer.
+	ViewerID string
+
+	// Time at which media started flowing to the remote peer.
+	ConnectedAt time.Time
+
+	// Outgoing media bitrate in bits per second, averaged over the last
+	// sampling interval.
+	Bitrate int
+
+	// ICE candidate types ("host", "srflx", "prflx", or "relay") of the
+	// selected candidate pair.
+	LocalCandidateType  string
+	RemoteCandidateType string
+
+	// Round-trip time to the remote peer, measured with RTCP extended
+	// reports. Zero until the first measurement.
+	RoundTripTime time.Duration
+
+	// Smoothed round-trip time of the STUN connectivity checks and
+	// keepalives on the selected candidate pair. Unlike RoundTripTime, it is
+	// measured without media, from the moment ICE connects. Zero until
+	// measured, and always in ICE-lite mode.
+	ICERoundTripTime time.Duration
+
+	// Fraction of outgoing video packets lost, as most recently reported by
+	// the remote peer, and the total lost since the session began.
+	PacketLoss  float32
+	PacketsLost uint64
+
+	// Number of incoming packets on the selected pair that were neither DTLS
+	// nor SRTP, and so were dropped.
+	UnmatchedPackets uint64
+
+	// Sizes of the selected pair's socket buffers, as allocated by the
+	// kernel, which may differ from those configured. Zero if unknown.
+	ReceiveBufferSize int
+	SendBufferSize    int
+
+	// Counts of packets received on the selected pair's socket by ECN mark,
+	// where the platform reports them (Linux, for host and server-reflexive
+	// candidates). A rising CE count means the network is congested.
+	ECNSupported bool
+	ECN          ECNCounts
+
+	// Delay of outgoing video, by stage, from capture to the remote peer.
+	Latency LatencyBudget
+
+	// NALUs of outgoing video dropped because the link couldn't keep up,
+	// by reason. See DropPolicy.
+	Drops DropCounts
+}
+
+// DropCounts counts dropped NALUs by reason: those that found the send queue
+// full, those dropped with them because they depend on them, and those that
+// no other picture depends on, dropped early under DropForQuality.
+type DropCounts = media.DropCounts
+
+// ECNCounts counts received packets by the value of their ECN field
+// [RFC3168]: not ECN-capable, ECT(0), ECT(1), and Congestion Experienced.
+type ECNCounts = ice.ECNCounts
+
+// A LatencyBudget breaks down the delay of outgoing video, e.g. to tell
+// whether video that lags by seconds is held up at the camera, in the sender,
+// or on the network. Stages are averaged over recent pictures, and are zero
+// until measured. The remote peer's jitter buffer and decoder add their own
+// delay, which is not included.
+type LatencyBudget struct {
+	// From capture until the sender takes the picture: encoding, and
+	// queueing behind earlier pictures. Zero if the video source doesn't
+	// record capture times.
+	Source time.Duration
+
+	// From then until the picture's last packet is written to the network:
+	// packetization and pacing.
+	Send time.Duration
+
+	// One-way network delay, estimated as half the round-trip time.
+	Network time.Duration
+}
+
+// Total returns the delay from capture to arrival at the remote peer.
+func (b LatencyBudget) Total() time.Duration {
+	return b.Source + b.Send + b.Network
+}
+
+// Relayed reports whether the session's media passes through a TURN relay.
+func (si SessionInfo) Relayed() bool {
+	return si.LocalCandidateType == "relay" || si.RemoteCandidateType == "relay"
+}
+
+// How often to sample outgoing byte counts for bitrate computation.
+const bitrateSampleInterval = time.Second
+
+// Registry of peer connections that are currently streaming.
+var activeSessions struct {
+	sync.Mutex
+	m map[*PeerConnection]struct{}
+}
+
+func addActiveSession(pc *PeerConnection) {
+	activeSessions.Lock()
+	defer activeSessions.Unlock()
+
+	if activeSessions.m == nil {
+		activeSessions.m = make(map[*PeerConnection]struct{})
+	}
+	activeSessions.m[pc] = struct{}{}
+}
+
+func removeActiveSession(pc *PeerConnection) {
+	activeSessions.Lock()
+	defer activeSessions.Unlock()
+
+	delete(activeSessions.m, pc)
+}
+
+// ActiveSessions returns a description of each peer connection that is
+// currently streaming, ordered by connect time.
+func ActiveSessions() []SessionInfo {
+	activeSessions.Lock()
+	defer activeSessions.Unlock()
+
+	list := make([]SessionInfo, 0, len(activeSessions.m))
+	for pc := range activeSessions.m {
+		list = append(list, pc.SessionInfo())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ConnectedAt.Before(list[j].ConnectedAt)
+	})
+	return list
+}
+
+// SessionInfo returns a description of this peer connection. Fields that are
+// not yet known (e.g. before the connection is established) are left empty.
+func (pc *PeerConnection) SessionInfo() SessionInfo {
+	pc.mediaMutex.Lock()
+	fingerprint := pc.remoteFingerprint()
+	connectedAt := pc.connectedAt
+	videoStream := pc.videoStream
+	dataMux := pc.dataMux
+	pc.mediaMutex.Unlock()
+
+	si := SessionInfo{
+		ViewerID:    anonymize(fingerprint),
+		ConnectedAt: connectedAt,
+		Bitrate:     int(atomic.LoadInt64(&pc.bitrate)),
+	}
+	if videoStream != nil {
+		stats := videoStream.Stats()
+		si.RoundTripTime = stats.RoundTripTime
+		si.PacketLoss = stats.RemoteFractionLost
+		si.PacketsLost = stats.RemotePacketsLost
+		si.Drops = stats.Drops
+		si.Latency = LatencyBudget{
+			Source:  stats.SourceDelay,
+			Send:    stats.SendDelay,
+			Network: stats.RoundTripTime / 2,
+		}
+	}
+	if dataMux != nil {
+		si.UnmatchedPackets = dataMux.Dropped()
+	}
+	if local, remote, ok := pc.currentICE().SelectedPair(); ok {
+		si.LocalCandidateType = local.Type()
+		si.RemoteCandidateType = remote.Type()
+	}
+	si.ICERoundTripTime = pc.currentICE().SelectedPairRTT()
+	if stats, ok := pc.currentICE().SocketStats(); ok {
+		si.ReceiveBufferSize = stats.ReadBufferSize
+		si.SendBufferSize = stats.WriteBufferSize
+		si.ECNSupported = stats.ECNSupported
+		si.ECN = stats.ECN
+	}
+	return si
+}
+
+// Return the remote DTLS certificate fingerprint, as advertised in SDP. It may
+// appear at either session or media level. Must be called with mediaMutex
+// held.
+func (pc *PeerConnection) remoteFingerprint() string {
+	if fp := pc.remoteDescription.GetAttr("fingerprint"); fp != "" {
+		return fp
+	}
+	for _, m := range pc.remoteDescription.Media {
+		if fp := m.GetAttr("fingerprint"); fp != "" {
+			return fp
+		}
+	}
+	return ""
+}
+
+// Periodically compute the outgoing bitrate from the byte counter returned by
+// bytesSent, until quit is closed.
+func (pc *PeerConnection) sampleBitrate(quit <-chan struct{}, bytesSent func() uint64) {
+	ticker := time.NewTicker(bitrateSampleInterval)
+	defer ticker.Stop()
+
+	last := bytesSent()
+	lastTime := time.Now()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			n := bytesSent()
+			bps := float64(8*(n-last)) / now.Sub(lastTime).Seconds()
+			atomic.StoreInt64(&pc.bitrate, int64(bps))
+			last, lastTime = n, now
+		}
+	}
+}
+
+// Hash an identifying string, truncated to 8 bytes.
+func anonymize(s string) string {
+	if s == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
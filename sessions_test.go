@@ -0,0 +1,67 @@
+package alohartc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Session info is read while the connection is established and renegotiated,
+// as from a device UI. Run with -race.
+func TestSessionInfoWhileRestarting(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	offerer := Must(NewPeerConnection(config))
+	answerer := Must(NewPeerConnection(loopbackConfig()))
+	received := receiveLoopback(answerer)
+
+	quit := make(chan struct{})
+	viewers := make(chan string, 1)
+	go func() {
+		defer close(viewers)
+		var viewer string
+		for {
+			select {
+			case <-quit:
+				viewers <- viewer
+				return
+			default:
+			}
+			for _, si := range ActiveSessions() {
+				if si.ViewerID != "" {
+					viewer = si.ViewerID
+				}
+			}
+			offerer.SessionInfo()
+			answerer.SessionInfo()
+		}
+	}()
+
+	closeBoth := connectLoopback(t, offerer, answerer)
+	expectVideo(t, received)
+
+	oldAgent := offerer.currentICE()
+	offer, err := offerer.RestartICE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.SetRemoteDescription(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, offerer.SetRemoteAnswer(answer))
+	expectICERestart(t, offerer, oldAgent)
+	expectVideo(t, received)
+
+	close(quit)
+	if <-viewers == "" {
+		t.Error("no active session listed")
+	}
+
+	for _, err := range closeBoth() {
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,81 @@
+package alohartc
+
+import (
+	"errors"
+
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+// Signaling states, as RTCSignalingState. Remote offers are answered
+// immediately by SetRemoteDescription, so there is no have-remote-offer.
+const (
+	SignalingStateStable         = "stable"
+	SignalingStateHaveLocalOffer = "have-local-offer"
+)
+
+// ErrOfferCollision is returned by SetRemoteDescription for an offer that
+// crosses an unanswered local offer, if the peer connection is impolite (see
+// Config.Polite). The remote offer should be ignored, along with its
+// candidates: the remote peer is expected to roll back and answer ours.
+var ErrOfferCollision = errors.New("remote offer collides with local offer")
+
+// SignalingState reports whether an offer from CreateOffer or RestartICE is
+// awaiting its answer.
+func (pc *PeerConnection) SignalingState() string {
+	pc.iceMutex.Lock()
+	reoffered := pc.stableDescription != ""
+	pc.iceMutex.Unlock()
+
+	if reoffered || pc.offering && len(pc.remoteDescription.Media) == 0 && len(pc.localDescription.Media) > 0 {
+		return SignalingStateHaveLocalOffer
+	}
+	return SignalingStateStable
+}
+
+// Rollback discards the unanswered offer from CreateOffer or RestartICE,
+// returning to the stable state, as setLocalDescription({type: "rollback"})
+// in the W3C API. A polite peer connection rolls back by itself when the
+// remote peer's offer collides with its own.
+func (pc *PeerConnection) Rollback() error {
+	if pc.SignalingState() != SignalingStateHaveLocalOffer {
+		return errNoLocalOffer
+	}
+
+	pc.iceMutex.Lock()
+	stable := pc.stableDescription
+	pc.pendingICE = nil
+	pc.stableDescription = ""
+	pc.iceMutex.Unlock()
+
+	if stable == "" {
+		// Nothing was negotiated yet.
+		pc.offering = false
+		pc.localDescription = sdp.Session{}
+		return nil
+	}
+
+	// Restore the description of the current session.
+	s, err := sdp.ParseSession(stable)
+	if err != nil {
+		return err
+	}
+	pc.mediaMutex.Lock()
+	pc.localDescription = s
+	pc.mediaMutex.Unlock()
+	return nil
+}
+
+// Resolve a remote offer that crosses our own (see RFC 8829 Section 4.1.8.2
+// and "Perfect Negotiation" in the W3C WebRTC specification): the polite peer
+// rolls back, and the impolite one rejects the remote offer.
+func (pc *PeerConnection) resolveCollision() error {
+	if pc.SignalingState() != SignalingStateHaveLocalOffer {
+		return nil
+	}
+	if !pc.polite {
+		log.Info("Ignoring remote offer, which collides with our own")
+		return ErrOfferCollision
+	}
+	log.Info("Rolling back local offer, which collides with the remote peer's")
+	return pc.Rollback()
+}
@@ -0,0 +1,70 @@
+package alohartc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollbackOffer(t *testing.T) {
+	pc := Must(NewPeerConnection(loopbackConfig()))
+	defer pc.Close()
+
+	assert.Equal(t, SignalingStateStable, pc.SignalingState())
+	if _, err := pc.CreateOffer(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, SignalingStateHaveLocalOffer, pc.SignalingState())
+
+	assert.NoError(t, pc.Rollback())
+	assert.Equal(t, SignalingStateStable, pc.SignalingState())
+	assert.False(t, pc.offering)
+	assert.Equal(t, errNoLocalOffer, pc.Rollback())
+}
+
+func TestRenegotiationGlare(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	config := loopbackConfig()
+	config.LocalVideo = src
+	offerer := Must(NewPeerConnection(config))
+	config = loopbackConfig()
+	config.Polite = true
+	answerer := Must(NewPeerConnection(config))
+	received := receiveLoopback(answerer)
+
+	closeBoth := connectLoopback(t, offerer, answerer)
+	expectVideo(t, received)
+
+	// Both peers restart ICE at once.
+	offererAgent, answererAgent := offerer.currentICE(), answerer.currentICE()
+	offer1, err := offerer.RestartICE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer2, err := answerer.RestartICE()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The impolite offerer ignores the answerer's offer, and the polite
+	// answerer rolls back its own to answer.
+	_, err = offerer.SetRemoteDescription(offer2)
+	assert.Equal(t, ErrOfferCollision, err)
+	answer, err := answerer.SetRemoteDescription(offer1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, offerer.SetRemoteAnswer(answer))
+	assert.Equal(t, SignalingStateStable, offerer.SignalingState())
+	assert.Equal(t, SignalingStateStable, answerer.SignalingState())
+
+	expectICERestart(t, offerer, offererAgent)
+	expectICERestart(t, answerer, answererAgent)
+	expectVideo(t, received)
+
+	for _, err := range closeBoth() {
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,316 @@
+package alohartc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/rtp"
+)
+
+// The RTP stream of a negotiated m-line, with the sender and receiver running
+// on it. Renegotiation starts and stops them, but keeps the stream, so that
+// its SSRC, sequence numbers and SRTP state carry on.
+type mediaStream struct {
+	kind   string
+	stream *rtp.Stream
+
+	// Source being sent, and the means to stop its sender, which closes
+	// sent when it returns.
+	source     media.Source
+	cancelSend context.CancelFunc
+	sent       chan struct{}
+
+	// Track being received, and the means to stop its receiver.
+	track         *RemoteTrack
+	cancelReceive context.CancelFunc
+}
+
+// The media streams of a connection, for as long as Stream runs.
+type mediaStreams struct {
+	ctx       context.Context
+	session   *rtp.Session
+	bandwidth *rtp.BandwidthAllocator
+	streams   []*mediaStream
+
+	// Whether the bandwidth has been probed, which is done once, when video
+	// first starts.
+	probed bool
+}
+
+// Create a stream for each accepted audio or video m-line, and start sending
+// and receiving media as negotiated. The answer mirrors the offer, so
+// accepted m-lines have the same index in both.
+func (pc *PeerConnection) startMedia(ctx context.Context, session *rtp.Session, bandwidth *rtp.BandwidthAllocator) {
+	ms := &mediaStreams{ctx: ctx, session: session, bandwidth: bandwidth}
+	pc.mediaMutex.Lock()
+	for i := range pc.localDescription.Media {
+		m := &pc.localDescription.Media[i]
+		if m.Port == 0 || m.Type != "video" && m.Type != "audio" {
+			continue
+		}
+
+		// Each stream can send and receive, so that renegotiation may start
+		// either. The negotiated direction decides what actually runs.
+		opts := rtp.StreamOptions{
+			Direction:   directionSendRecv,
+			MID:         m.GetAttr("mid"),
+			Extensions:  pc.extensions,
+			ReducedSize: pc.reducedSizeRTCP,
+			PacingBurst: pc.pacingBurst,
+		}
+		fmt.Sscanf(pc.remoteDescription.Media[i].GetAttr("ssrc"), "%d cname:%s", &opts.RemoteSSRC, &opts.RemoteCNAME)
+		if m.Type == "video" {
+			opts.LocalSSRC = pc.videoIDs.ssrc
+			opts.LocalCNAME = pc.videoIDs.cname
+			if pc.remb {
+				opts.MaxReceiveBitrate = pc.maxReceiveBitrate
+			}
+			opts.DropPolicy = pc.dropPolicy
+			if pc.gameMode {
+				opts.QueueSize = gameModeQueueSize
+				opts.DropPolicy = DropForLatency
+				opts.PrioritizeResend = true
+				if opts.PacingBurst == 0 {
+					opts.PacingBurst = gameModePacingBurst
+				}
+				// Render as soon as decoded, without a jitter buffer.
+				opts.PlayoutDelay = &rtp.PlayoutDelay{}
+			}
+		} else {
+			opts.LocalSSRC = pc.audioIDs.ssrc
+			opts.LocalCNAME = pc.audioIDs.cname
+		}
+		stream := session.AddStream(opts)
+		ms.streams = append(ms.streams, &mediaStream{kind: m.Type, stream: stream})
+		if m.Type == "video" && pc.videoStream == nil {
+			pc.videoStream = stream
+		}
+	}
+
+	pc.media = ms
+	pc.mediaMutex.Unlock()
+	pc.updateMedia()
+}
+
+// Stop all media, letting media in flight be written before saying goodbye
+// with an RTCP BYE (see RFC 3550 Section 6.6).
+func (pc *PeerConnection) stopMedia() {
+	pc.mediaMutex.Lock()
+	ms := pc.media
+	pc.media = nil
+	pc.mediaMutex.Unlock()
+	if ms == nil {
+		return
+	}
+
+	timeout := time.After(flushTimeout)
+	for _, m := range ms.streams {
+		m.stopReceiving()
+		m.stopSending(timeout)
+	}
+	for _, m := range ms.streams {
+		m.stream.Close()
+	}
+}
+
+// Start and stop senders and receivers to match the negotiated directions
+// and the current local tracks. Does nothing unless streaming.
+func (pc *PeerConnection) updateMedia() {
+	pc.mediaMutex.Lock()
+	defer pc.mediaMutex.Unlock()
+	ms := pc.media
+	if ms == nil {
+		return
+	}
+
+	for _, m := range ms.streams {
+		var (
+			direction string
+			source    media.Source
+		)
+		switch m.kind {
+		case "video":
+			direction = pc.videoDirection
+			if pc.localVideo != nil {
+				source = pc.localVideo
+			}
+		case "audio":
+			direction = pc.audioDirection
+			if pc.localAudio != nil {
+				source = pc.localAudio
+			}
+		}
+		if !isSending(direction) {
+			source = nil
+		}
+
+		if m.source != source {
+			m.stopSending(time.After(flushTimeout))
+			if source != nil {
+				pc.startSending(ms, m, source)
+			}
+		}
+
+		receiving := isReceiving(direction) && pc.onTrack != nil
+		if m.track != nil && !receiving {
+			m.stopReceiving()
+		} else if m.track == nil && receiving {
+			pc.startReceiving(ms, m)
+		}
+	}
+}
+
+// Return the number of payload bytes sent on all streams.
+func (pc *PeerConnection) mediaBytesSent() (sent uint64) {
+	pc.mediaMutex.Lock()
+	defer pc.mediaMutex.Unlock()
+	if pc.media != nil {
+		for _, m := range pc.media.streams {
+			sent += m.stream.Stats().BytesSent
+		}
+	}
+	return sent
+}
+
+func (pc *PeerConnection) startSending(ms *mediaStreams, m *mediaStream, source media.Source) {
+	ctx, cancel := context.WithCancel(ms.ctx)
+	m.source, m.cancelSend, m.sent = source, cancel, make(chan struct{})
+	sent := m.sent
+	stream := m.stream
+
+	if audio, ok := source.(media.AudioSource); ok {
+		pc.resources.Go("audio sender", func() {
+			defer close(sent)
+			if err := stream.SendAudio(ctx.Done(), pc.audioPayloadType, audio); err != nil {
+				log.Warn("Sending audio failed: %v", err)
+			}
+		})
+		return
+	}
+
+	video := source.(media.VideoSource)
+	pc.policy.capBitrate(video)
+	var degrader *degrader
+	if pc.degradation != nil {
+		degrader = newDegrader(*pc.degradation, video)
+		pc.resources.Go("degrader", func() {
+			degrader.run(ctx.Done())
+		})
+	}
+
+	videoShare := ms.bandwidth.Add(rtp.PriorityVideo, minVideoBitrate, pc.policy.MaxBitrate, func(bps int) {
+		// The allocator caps the share already, but a capped viewer's
+		// encoder must never be raised above its limit.
+		bps = pc.policy.clampBitrate(bps)
+		stream.SetPacingRate(bps)
+		if degrader != nil {
+			degrader.update(bps)
+		}
+
+		// Note that the default encoder may be shared with other peer
+		// connections, in which case the most recent estimate wins. A
+		// viewer with a bitrate limit has an encoder of its own.
+		if adj, ok := video.(media.BitrateAdjuster); ok {
+			log.Info("Adjusting video bitrate to %d bps", bps)
+			if err := adj.AdjustBitrate(bps); err != nil {
+				log.Warn("Failed to adjust video bitrate: %v", err)
+			}
+		}
+	})
+	pc.resources.Go("video sender", func() {
+		defer close(sent)
+		defer ms.bandwidth.Remove(videoShare)
+		stream.SendVideo(ctx.Done(), pc.DynamicType, video)
+	})
+
+	if clusters := pc.probeClusters(); !ms.probed && clusters != nil {
+		ms.probed = true
+		pc.resources.Go("bitrate probe", func() {
+			if err := stream.Probe(ctx.Done(), pc.DynamicType, clusters); err != nil {
+				log.Warn("Bitrate probing failed: %v", err)
+			}
+		})
+	}
+}
+
+// Return the probe clusters to send when video starts, or nil if the remote
+// peer can't estimate bandwidth from them. Of the two clusters, at half and
+// then all of the probed bitrate, the lower still yields an estimate when the
+// link can't sustain the higher.
+func (pc *PeerConnection) probeClusters() []rtp.ProbeCluster {
+	if pc.probeBitrate < 0 || !pc.remb {
+		return nil
+	}
+	if pc.extensions[rtp.ExtensionAbsSendTime] == 0 && pc.extensions[rtp.ExtensionTransportCC] == 0 {
+		return nil
+	}
+	bitrate := pc.probeBitrate
+	if bitrate == 0 {
+		bitrate = defaultProbeBitrate
+	}
+	if max := pc.policy.MaxBitrate; max > 0 && bitrate > max {
+		bitrate = max
+	}
+	if bitrate < minVideoBitrate {
+		return nil
+	}
+	return []rtp.ProbeCluster{
+		{Bitrate: bitrate / 2, Duration: 50 * time.Millisecond},
+		{Bitrate: bitrate, Duration: 50 * time.Millisecond},
+	}
+}
+
+func (pc *PeerConnection) startReceiving(ms *mediaStreams, m *mediaStream) {
+	ctx, cancel := context.WithCancel(ms.ctx)
+	codec := "H264"
+	if m.kind == "audio" {
+		codec = pc.audioCodec
+	}
+	track := newRemoteTrack(m.kind, codec, m.stream.MID, m.stream.RemoteSSRC)
+	m.track, m.cancelReceive = track, cancel
+	stream := m.stream
+	if m.kind == "video" {
+		track.requestKeyframe = stream.RequestKeyframe
+	}
+
+	pc.onTrack(track)
+	pc.resources.Go(m.kind+" receiver", func() {
+		var err error
+		if track.kind == "video" {
+			err = stream.ReceiveVideo(ctx.Done(), pc.trackBuffers(track))
+		} else {
+			err = stream.ReceiveAudio(ctx.Done(), pc.trackBuffers(track))
+		}
+		if err == rtp.ErrGoodbye {
+			log.Info("Remote peer ended %s track %s", track.kind, track.mid)
+		} else if err != nil {
+			log.Warn("Receiving %s failed: %v", track.kind, err)
+		}
+		track.close(err)
+	})
+}
+
+// Stop the sender, if any, and wait for it to return until timeout.
+func (m *mediaStream) stopSending(timeout <-chan time.Time) {
+	if m.cancelSend == nil {
+		return
+	}
+	m.cancelSend()
+	select {
+	case <-m.sent:
+	case <-timeout:
+		log.Debug("Timed out flushing %s stream", m.kind)
+	}
+	m.source, m.cancelSend, m.sent = nil, nil, nil
+}
+
+// Stop the receiver, if any, which ends its track.
+func (m *mediaStream) stopReceiving() {
+	if m.cancelReceive == nil {
+		return
+	}
+	m.cancelReceive()
+	m.track, m.cancelReceive = nil, nil
+}
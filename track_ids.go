@@ -0,0 +1,48 @@
+package alohartc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// Identifiers of a track we send. They are announced in the answer, in msid
+// (RFC 8830) and ssrc (RFC 5576) attributes, and the same SSRC and CNAME are
+// used in the track's RTP and RTCP packets. Each PeerConnection draws its own,
+// so that several connections from one device don't collide.
+type localTrackIDs struct {
+	ssrc     uint32
+	cname    string
+	streamID string
+	trackID  string
+}
+
+func newLocalTrackIDs() (localTrackIDs, error) {
+	// 96 bits of randomness for the CNAME (see RFC 7022 Section 4.1), and
+	// 128 bits each for the stream and track IDs.
+	rnd := make([]byte, 4+12+16+16)
+	if _, err := rand.Read(rnd); err != nil {
+		return localTrackIDs{}, err
+	}
+
+	ids := localTrackIDs{
+		ssrc:     binary.BigEndian.Uint32(rnd[0:4]),
+		cname:    base64.StdEncoding.EncodeToString(rnd[4:16]),
+		streamID: base64.RawURLEncoding.EncodeToString(rnd[16:32]),
+		trackID:  uuid(rnd[32:48]),
+	}
+	if ids.ssrc == 0 {
+		// Reserve 0 to mean "unknown".
+		ids.ssrc = 1
+	}
+	return ids, nil
+}
+
+// Format 16 random bytes as a version 4 UUID (see RFC 4122 Section 4.4), like
+// the track IDs chosen by browsers.
+func uuid(b []byte) string {
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,21 @@
+package alohartc
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLocalTrackIDs(t *testing.T) {
+	a, err := newLocalTrackIDs()
+	assert.NoError(t, err)
+	b, err := newLocalTrackIDs()
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, a, b)
+	assert.NotEqual(t, uint32(0), a.ssrc)
+	assert.Len(t, a.cname, 16)
+	assert.True(t, regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(a.trackID))
+	assert.True(t, regexp.MustCompile(`^[A-Za-z0-9_-]+$`).MatchString(a.streamID))
+}
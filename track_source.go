@@ -0,0 +1,121 @@
+package alohartc
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/media/h264"
+)
+
+var errTrackEnded = errors.New("remote track ended")
+
+// A TrackSource republishes a remote H.264 video track as a media.VideoSource,
+// so that video pushed by a peer can be sent on, e.g. by an RTSP server to
+// legacy NVR software, or to another peer connection.
+type TrackSource struct {
+	media.Flow
+
+	track *RemoteTrack
+
+	// Most recent parameter sets received, and the parsed SPS.
+	mu  sync.Mutex
+	sps []byte
+	pps []byte
+	dim *h264.SPS
+}
+
+// NewTrackSource returns a source of the video received on track. It consumes
+// the track's buffers, which must not be read elsewhere, until the track ends,
+// when its receivers are closed.
+func NewTrackSource(track *RemoteTrack) (*TrackSource, error) {
+	if track.Kind() != "video" || track.Codec() != "H264" {
+		return nil, errNotVideo
+	}
+	src := &TrackSource{track: track}
+	src.Flow.Start = func() {
+		// A new receiver can only start decoding at a keyframe.
+		src.RequestKeyframe()
+	}
+	go src.run()
+	return src, nil
+}
+
+func (src *TrackSource) run() {
+	for buf := range src.track.Buffers() {
+		if nalu := buf.Bytes(); len(nalu) > 0 {
+			src.handleNALU(nalu)
+		}
+		src.Flow.Put(buf)
+	}
+	err := src.track.Err()
+	if err == nil {
+		err = errTrackEnded
+	}
+	src.Flow.Shutdown(err)
+}
+
+// Remember parameter sets, so that they can be described to receivers.
+func (src *TrackSource) handleNALU(nalu []byte) {
+	switch h264.NALU(nalu).Type() {
+	case h264.NALUTypeSPS:
+		sps, err := h264.ParseSPS(nalu)
+		if err != nil {
+			log.Debug("Remote track %s: %v", src.track.MID(), err)
+			return
+		}
+		src.mu.Lock()
+		src.sps = append(src.sps[:0], nalu...)
+		src.dim = sps
+		src.mu.Unlock()
+	case h264.NALUTypePPS:
+		src.mu.Lock()
+		src.pps = append(src.pps[:0], nalu...)
+		src.mu.Unlock()
+	}
+}
+
+// Codec returns "H264".
+func (src *TrackSource) Codec() string {
+	return "H264"
+}
+
+// Width returns the picture width, or 0 until an SPS has been received.
+func (src *TrackSource) Width() int {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.dim == nil {
+		return 0
+	}
+	return src.dim.Width
+}
+
+// Height returns the picture height, or 0 until an SPS has been received.
+func (src *TrackSource) Height() int {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.dim == nil {
+		return 0
+	}
+	return src.dim.Height
+}
+
+// ParameterSets implements media.ParameterSetProvider. It returns nil until
+// both an SPS and a PPS have been received.
+func (src *TrackSource) ParameterSets() [][]byte {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if len(src.sps) == 0 || len(src.pps) == 0 {
+		return nil
+	}
+	return [][]byte{
+		append([]byte(nil), src.sps...),
+		append([]byte(nil), src.pps...),
+	}
+}
+
+// RequestKeyframe implements media.KeyframeRequester, asking the remote peer
+// for a keyframe.
+func (src *TrackSource) RequestKeyframe() error {
+	return src.track.RequestKeyframe()
+}
@@ -0,0 +1,51 @@
+package alohartc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/packet"
+)
+
+func TestTrackSource(t *testing.T) {
+	_, err := NewTrackSource(newRemoteTrack("audio", "opus", "1", 0))
+	assert.Equal(t, errNotVideo, err)
+
+	track := newRemoteTrack("video", "H264", "0", 1234)
+	keyframes := 0
+	track.requestKeyframe = func() error {
+		keyframes++
+		return nil
+	}
+	src, err := NewTrackSource(track)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, src.Width())
+	assert.Nil(t, src.ParameterSets())
+
+	// The first receiver asks for a keyframe to start decoding at.
+	r := src.AddReceiver(8)
+	assert.Equal(t, 1, keyframes)
+
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8, 0x40, 0x00, 0x00, 0x03, 0x00, 0x40, 0x00, 0x00, 0x0f, 0x23, 0x68, 0x22, 0x11, 0xa8}
+	pps := []byte{0x68, 0xce, 0x06, 0xe2}
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	for _, nalu := range [][]byte{sps, pps, idr} {
+		track.put(packet.NewSharedBuffer(nalu, 1, nil))
+	}
+	for _, want := range [][]byte{sps, pps, idr} {
+		buf := <-r.Buffers()
+		assert.Equal(t, want, buf.Bytes())
+		buf.Release()
+	}
+	assert.Equal(t, 1280, src.Width())
+	assert.Equal(t, 720, src.Height())
+	assert.Equal(t, [][]byte{sps, pps}, src.ParameterSets())
+
+	// The end of the track ends the source.
+	track.close(nil)
+	_, more := <-r.Buffers()
+	assert.False(t, more)
+	assert.Equal(t, errTrackEnded, r.Err())
+	src.RemoveReceiver(r)
+}
@@ -0,0 +1,201 @@
+package alohartc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lanikai/alohartc/internal/media"
+	"github.com/lanikai/alohartc/internal/sdp"
+)
+
+var (
+	errUnsupportedTrack = errors.New("track source must be a media.VideoSource or media.AudioSource")
+	errTrackExists      = errors.New("peer connection already has a track of this kind")
+	errUnknownTrack     = errors.New("track does not belong to this peer connection")
+	errNoTransceiver    = errors.New("no negotiated m-line for this kind of track")
+)
+
+// A LocalTrack is media sent to the remote peer, as added by AddTrack. It
+// corresponds to an RTCRtpSender in the W3C API.
+type LocalTrack struct {
+	kind   string
+	source media.Source
+}
+
+// Kind returns "audio" or "video".
+func (t *LocalTrack) Kind() string {
+	return t.kind
+}
+
+// Source returns the media source of the track.
+func (t *LocalTrack) Source() media.Source {
+	return t.source
+}
+
+// AddTrack adds a media source to send to the remote peer: either a
+// media.VideoSource producing H.264, or a media.AudioSource. Only one track
+// of each kind is supported. AddTrack may be called before or after the
+// connection is negotiated, and calls OnNegotiationNeeded either way. Once
+// negotiated, the track is only sent after a new offer/answer exchange, e.g.
+// an offer from CreateOffer, which needs an m-line of the track's kind to have
+// been accepted in the first.
+//
+// Like the offer/answer methods, AddTrack and RemoveTrack must not be called
+// concurrently with each other or with those methods.
+func (pc *PeerConnection) AddTrack(source media.Source) (*LocalTrack, error) {
+	t := &LocalTrack{source: source}
+	switch src := source.(type) {
+	case media.VideoSource:
+		if pc.localVideo != nil {
+			return nil, errTrackExists
+		}
+		t.kind = "video"
+		if pc.negotiated() && pc.mediaIndex(t.kind) < 0 {
+			return nil, errNoTransceiver
+		}
+		pc.mediaMutex.Lock()
+		pc.localVideo = src
+		pc.mediaMutex.Unlock()
+	case media.AudioSource:
+		if pc.localAudio != nil {
+			return nil, errTrackExists
+		}
+		t.kind = "audio"
+		if pc.negotiated() && pc.mediaIndex(t.kind) < 0 {
+			return nil, errNoTransceiver
+		}
+		pc.mediaMutex.Lock()
+		pc.localAudio = src
+		pc.mediaMutex.Unlock()
+	default:
+		return nil, errUnsupportedTrack
+	}
+	pc.negotiationNeeded()
+	return t, nil
+}
+
+// RemoveTrack stops sending a track added by AddTrack, and calls
+// OnNegotiationNeeded. Once negotiated, the remote peer is told that the
+// track is gone by the next offer/answer exchange, as for AddTrack; media
+// stops at once.
+func (pc *PeerConnection) RemoveTrack(t *LocalTrack) error {
+	pc.mediaMutex.Lock()
+	switch {
+	case t.kind == "video" && pc.localVideo != nil && media.Source(pc.localVideo) == t.source:
+		pc.localVideo = nil
+	case t.kind == "audio" && pc.localAudio != nil && media.Source(pc.localAudio) == t.source:
+		pc.localAudio = nil
+	default:
+		pc.mediaMutex.Unlock()
+		return errUnknownTrack
+	}
+	pc.mediaMutex.Unlock()
+	pc.updateMedia()
+	pc.negotiationNeeded()
+	return nil
+}
+
+// Report whether the first offer/answer exchange has completed.
+func (pc *PeerConnection) negotiated() bool {
+	return len(pc.localDescription.Media) > 0 && len(pc.remoteDescription.Media) > 0
+}
+
+func (pc *PeerConnection) negotiationNeeded() {
+	if pc.OnNegotiationNeeded != nil {
+		pc.OnNegotiationNeeded()
+	}
+}
+
+// Return the index of the accepted m-line of the given kind in the local
+// description, or -1 if there is none.
+func (pc *PeerConnection) mediaIndex(kind string) int {
+	for i := range pc.localDescription.Media {
+		if m := &pc.localDescription.Media[i]; m.Type == kind && m.Port != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// Update the accepted m-lines of the local description for the current local
+// tracks, as a new offer (if offer is nil) or in answer to a remote offer.
+// Answered directions take effect at once; offered ones once the answer
+// arrives.
+func (pc *PeerConnection) updateLocalTracks(offer *sdp.Session) {
+	s := &pc.localDescription
+	for i := range s.Media {
+		m := &s.Media[i]
+		if m.Port == 0 {
+			continue
+		}
+
+		var (
+			sending bool
+			ids     localTrackIDs
+		)
+		switch m.Type {
+		case "video":
+			sending, ids = pc.localVideo != nil, pc.videoIDs
+		case "audio":
+			sending, ids = pc.localAudio != nil, pc.audioIDs
+		default:
+			continue
+		}
+		var direction string
+		if offer == nil {
+			direction = offerDirection(sending, pc.onTrack != nil)
+		} else {
+			direction = answerDirection(mediaDirection(offer, &offer.Media[i]), sending, pc.onTrack != nil)
+			pc.setDirection(m.Type, direction)
+		}
+
+		// Replace the direction and the attributes describing the track
+		// we send.
+		attrs := m.Attributes[:0]
+		for _, attr := range m.Attributes {
+			switch attr.Key {
+			case directionSendRecv, directionSendOnly, directionRecvOnly, directionInactive:
+				attr.Key = direction
+			case "msid", "ssrc":
+				continue
+			}
+			attrs = append(attrs, attr)
+		}
+		if isSending(direction) {
+			attrs = append(attrs, trackAttributes(ids)...)
+			if !s.HasAttr("msid-semantic") {
+				s.Attributes = append(s.Attributes, sdp.Attribute{Key: "msid-semantic", Value: "WMS " + ids.streamID})
+			}
+		}
+		m.Attributes = attrs
+	}
+}
+
+// Apply the directions of the remote answer to our offer.
+func (pc *PeerConnection) applyAnswerDirections(answer *sdp.Session) {
+	for i := range answer.Media {
+		if m := &answer.Media[i]; m.Port != 0 {
+			pc.setDirection(m.Type, reverseDirection(mediaDirection(answer, m)))
+		}
+	}
+}
+
+func (pc *PeerConnection) setDirection(kind, direction string) {
+	switch kind {
+	case "video":
+		pc.videoDirection = direction
+	case "audio":
+		pc.audioDirection = direction
+	}
+}
+
+// Return the attributes describing a track we send. The ssrc msid attribute
+// duplicates the media-level msid, for peers that predate unified plan.
+func trackAttributes(ids localTrackIDs) []sdp.Attribute {
+	msid := ids.streamID + " " + ids.trackID
+	return []sdp.Attribute{
+		{Key: "msid", Value: msid},
+		{Key: "ssrc", Value: fmt.Sprintf("%d cname:%s", ids.ssrc, ids.cname)},
+		{Key: "ssrc", Value: fmt.Sprintf("%d msid:%s", ids.ssrc, msid)},
+	}
+}
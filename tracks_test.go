@@ -0,0 +1,116 @@
+package alohartc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lanikai/alohartc/internal/media"
+)
+
+func TestAddTrack(t *testing.T) {
+	pc := Must(NewPeerConnection(loopbackConfig()))
+	defer pc.Close()
+	needed := 0
+	pc.OnNegotiationNeeded = func() {
+		needed++
+	}
+
+	src := newLoopbackVideoSource()
+	defer src.Close()
+	video, err := pc.AddTrack(src)
+	assert.NoError(t, err)
+	assert.Equal(t, "video", video.Kind())
+	assert.Equal(t, 1, needed)
+
+	_, err = pc.AddTrack(src)
+	assert.Equal(t, errTrackExists, err)
+	_, err = pc.AddTrack(&media.Flow{})
+	assert.Equal(t, errUnsupportedTrack, err)
+
+	audio, err := pc.AddTrack(&silentAudioSource{codec: "PCMU"})
+	assert.NoError(t, err)
+	assert.Equal(t, "audio", audio.Kind())
+	assert.Equal(t, 2, needed)
+
+	// Both tracks are offered, bundled.
+	offer, err := pc.createOffer()
+	assert.NoError(t, err)
+	assert.Equal(t, "BUNDLE 0 1", offer.GetAttr("group"))
+	assert.Equal(t, directionSendOnly, mediaDirection(&offer, &offer.Media[0]))
+	assert.Equal(t, "0 PCMU/8000", offer.Media[1].GetAttr("rtpmap"))
+	assert.Equal(t, directionSendOnly, mediaDirection(&offer, &offer.Media[1]))
+
+	assert.NoError(t, pc.RemoveTrack(audio))
+	assert.Equal(t, errUnknownTrack, pc.RemoveTrack(audio))
+	assert.Equal(t, 3, needed)
+}
+
+func TestLoopbackRenegotiateTracks(t *testing.T) {
+	src := newLoopbackVideoSource()
+	defer src.Close()
+
+	// The offerer starts without a track.
+	offerer := Must(NewPeerConnection(loopbackConfig()))
+	answerer := Must(NewPeerConnection(loopbackConfig()))
+	tracks := make(chan *RemoteTrack, 2)
+	answerer.OnTrack(func(track *RemoteTrack) {
+		tracks <- track
+	})
+	renegotiate := func() {
+		offer, err := offerer.CreateOffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := answerer.SetRemoteDescription(offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := offerer.SetRemoteAnswer(answer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offerer.OnNegotiationNeeded = renegotiate
+	closeBoth := connectLoopback(t, offerer, answerer)
+
+	// Adding a track starts video, without a new ICE or DTLS session.
+	agent := answerer.currentICE()
+	track, err := offerer.AddTrack(src)
+	assert.NoError(t, err)
+	var remote *RemoteTrack
+	select {
+	case remote = <-tracks:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no remote track")
+	}
+	select {
+	case buf := <-remote.Buffers():
+		buf.Release()
+	case <-time.After(10 * time.Second):
+		t.Fatal("no video received")
+	}
+	assert.True(t, agent == answerer.currentICE())
+
+	// Removing it ends the remote track.
+	assert.NoError(t, offerer.RemoveTrack(track))
+	deadline := time.After(10 * time.Second)
+	for ended := false; !ended; {
+		select {
+		case buf, more := <-remote.Buffers():
+			if !more {
+				ended = true
+				break
+			}
+			buf.Release()
+		case <-deadline:
+			t.Fatal("remote track not ended")
+		}
+	}
+	assert.NoError(t, remote.Err())
+	assert.Equal(t, SignalingStateStable, offerer.SignalingState())
+
+	for _, err := range closeBoth() {
+		assert.NoError(t, err)
+	}
+}
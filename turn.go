@@ -0,0 +1,38 @@
+package alohartc
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/lanikai/alohartc/internal/ice"
+)
+
+// A TURNServer is a relay used to gather relayed ICE candidates, for peers
+// that can't reach each other directly (e.g. both behind symmetric NATs).
+type TURNServer = ice.TURNServer
+
+// TURNCredentials are a username and password for a TURN server.
+type TURNCredentials = ice.TURNCredentials
+
+// A TURNCredentialProvider returns credentials for a TURN server. It is called
+// for each allocation, so it may return short-lived credentials.
+type TURNCredentialProvider = ice.TURNCredentialProvider
+
+// StaticTURNCredentials returns a provider for a fixed username and password.
+func StaticTURNCredentials(username, password string) TURNCredentialProvider {
+	return ice.StaticTURNCredentials(username, password)
+}
+
+// SharedSecretTURNCredentials returns a provider that derives time-limited
+// credentials, valid for ttl, from a secret shared with the TURN server (e.g.
+// coturn's static-auth-secret).
+func SharedSecretTURNCredentials(secret, user string, ttl time.Duration) TURNCredentialProvider {
+	return ice.SharedSecretTURNCredentials(secret, user, ttl)
+}
+
+// FetchTURNCredentials returns a provider that requests short-lived
+// credentials from an HTTPS endpoint, authenticating with an OAuth 2.0 bearer
+// token. See ice.FetchTURNCredentials for the response format.
+func FetchTURNCredentials(url, token string, client *http.Client) TURNCredentialProvider {
+	return ice.FetchTURNCredentials(url, token, client)
+}